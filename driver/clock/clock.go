@@ -0,0 +1,277 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time and timers. Components take a Clock instead
+// of calling the time package directly so that tests can run long scenarios
+// (timeouts, retention, keepalives) on simulated time.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the Clock equivalent of time.Timer
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the Clock equivalent of time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+// OrReal returns c, or the wall clock if c is nil
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{timer: time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t *realTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Simulated is a Clock whose time only moves when Advance or Set is called.
+// Timers, tickers and sleeps fire in deadline order as time is advanced.
+type Simulated struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*simWaiter
+}
+
+// simWaiter is a pending timer or ticker of a simulated clock
+type simWaiter struct {
+	deadline time.Time
+	period   time.Duration // Non-zero for tickers
+	ch       chan time.Time
+}
+
+// NewSimulated creates a simulated clock starting at start
+func NewSimulated(start time.Time) *Simulated {
+	c := &Simulated{now: start}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// Now returns the simulated time
+func (c *Simulated) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Since returns the simulated time elapsed since t
+func (c *Simulated) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// After returns a channel that receives the simulated time once d has elapsed
+func (c *Simulated) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Sleep blocks until the clock has been advanced by d
+func (c *Simulated) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// NewTimer creates a timer that fires once the clock has been advanced by d
+func (c *Simulated) NewTimer(d time.Duration) Timer {
+	timer := &simTimer{clock: c, waiter: &simWaiter{ch: make(chan time.Time, 1)}}
+	c.mutex.Lock()
+	c.schedule(timer.waiter, d)
+	c.fireUntil(c.now)
+	c.mutex.Unlock()
+	return timer
+}
+
+// NewTicker creates a ticker that fires every d of simulated time
+func (c *Simulated) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	ticker := &simTicker{clock: c, waiter: &simWaiter{ch: make(chan time.Time, 1), period: d}}
+	c.mutex.Lock()
+	c.schedule(ticker.waiter, d)
+	c.mutex.Unlock()
+	return ticker
+}
+
+// Advance moves the clock forward by d, firing every timer and ticker whose
+// deadline is reached, in deadline order
+func (c *Simulated) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to t. Moving backwards does not fire anything.
+func (c *Simulated) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.fireUntil(t)
+	c.now = t
+}
+
+// fireUntil fires the waiters due at or before t. Callers hold c.mutex.
+func (c *Simulated) fireUntil(t time.Time) {
+	for len(c.waiters) > 0 && !c.waiters[0].deadline.After(t) {
+		waiter := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		if waiter.deadline.After(c.now) {
+			c.now = waiter.deadline
+		}
+
+		// Like time.Ticker, drop ticks the receiver is not keeping up with
+		select {
+		case waiter.ch <- waiter.deadline:
+		default:
+		}
+
+		if waiter.period > 0 {
+			c.schedule(waiter, waiter.period)
+		}
+	}
+}
+
+// Waiters returns the number of pending timers, tickers and sleeps
+func (c *Simulated) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n timers, tickers or sleeps are pending.
+// Tests use it to wait for a goroutine to start waiting before advancing time.
+func (c *Simulated) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+// schedule adds a waiter due d after now. Callers hold c.mutex.
+func (c *Simulated) schedule(waiter *simWaiter, d time.Duration) {
+	waiter.deadline = c.now.Add(d)
+	c.waiters = append(c.waiters, waiter)
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].deadline.Before(c.waiters[j].deadline)
+	})
+	c.cond.Broadcast()
+}
+
+// remove drops a pending waiter. Callers hold c.mutex.
+func (c *Simulated) remove(waiter *simWaiter) bool {
+	for i, pending := range c.waiters {
+		if pending == waiter {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type simTimer struct {
+	clock  *Simulated
+	waiter *simWaiter
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.waiter.ch
+}
+
+func (t *simTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.remove(t.waiter)
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.clock.remove(t.waiter)
+	t.clock.schedule(t.waiter, d)
+	t.clock.fireUntil(t.clock.now)
+	return active
+}
+
+type simTicker struct {
+	clock  *Simulated
+	waiter *simWaiter
+}
+
+func (t *simTicker) C() <-chan time.Time {
+	return t.waiter.ch
+}
+
+func (t *simTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.clock.remove(t.waiter)
+}
@@ -0,0 +1,4 @@
+// Package clock abstracts time and timers behind the Clock interface, so
+// that timeouts, timestamps and keep-alives can run on virtual time in
+// tests.
+package clock
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+// Benchmark is a hot path measured by the suite. One operation is one frame,
+// record or message, so operations per second are frames (messages) per
+// second.
+type Benchmark struct {
+	Name string
+	Run  func(b *testing.B)
+}
+
+// inputs are the records, frames and messages the benchmarks parse,
+// generated from the sample deterioration scenario so that every run
+// measures the same data
+type inputs struct {
+	waveRecord  []byte
+	alarmRecord []byte
+	alarmMsg    *serial.AlarmSubrecords // Alarm status message of alarmRecord
+	frames      []byte                  // Framed waveform and alarm records
+	frameCount  int
+	oru         string
+	batch       string
+}
+
+// loadInputs generates the benchmark inputs
+func loadInputs() (*inputs, error) {
+	samples := hl7.NewSampleHL7Messages()
+	scenario := samples.GetDeteriorationScenario(time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC))
+
+	records, err := serial.ScenarioRecords(scenario, serial.ScenarioRecordOptions{Waveforms: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DRI records: %v", err)
+	}
+	in := &inputs{}
+	var frames bytes.Buffer
+	for _, record := range records {
+		header, _, err := serial.ValidateRecord(record.Data)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case header.RMainType == serial.DRI_MT_WAVE && in.waveRecord == nil:
+			in.waveRecord = record.Data
+		case header.RMainType == serial.DRI_MT_ALARM && in.alarmRecord == nil:
+			in.alarmRecord = record.Data
+		}
+		frames.Write(serial.Frame(record.Data))
+		in.frameCount++
+	}
+	if in.waveRecord == nil || in.alarmRecord == nil {
+		return nil, fmt.Errorf("scenario has no waveform or alarm record")
+	}
+	in.frames = frames.Bytes()
+
+	_, subrecords, err := serial.ValidateRecord(in.alarmRecord)
+	if err != nil {
+		return nil, err
+	}
+	in.alarmMsg = &serial.AlarmSubrecords{}
+	if err := in.alarmMsg.UnmarshalBinary(subrecords[0].Data); err != nil {
+		return nil, fmt.Errorf("failed to decode alarm status message: %v", err)
+	}
+
+	events, err := scenario.Generate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate HL7 messages: %v", err)
+	}
+	var messages []string
+	for _, event := range events {
+		if event.Kind == hl7.SCENARIO_EVENT_VITALS && in.oru == "" {
+			in.oru = event.Message
+		}
+		if len(messages) < 10 {
+			messages = append(messages, event.Message)
+		}
+	}
+	if in.oru == "" {
+		return nil, fmt.Errorf("scenario has no ORU message")
+	}
+	in.batch, _, err = hl7.BuildBatch(hl7.BatchHeader{SendingApplication: "BENCH"}, messages, scenario.Start)
+	if err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// benchmarks returns the suite
+func benchmarks(in *inputs) []Benchmark {
+	return []Benchmark{
+		{"dri/frame_reader", func(b *testing.B) {
+			// Every frame of the scenario, read again as often as needed
+			reader := serial.NewFrameReader(bytes.NewReader(nil))
+			for i := 0; i < b.N; i++ {
+				if i%in.frameCount == 0 {
+					reader = serial.NewFrameReader(bytes.NewReader(in.frames))
+				}
+				if _, err := reader.ReadRecord(); err != nil && err != io.EOF {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"dri/validate_record", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := serial.ValidateRecord(in.waveRecord); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"dri/parse_waveform", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := serial.ParseWaveformRecords(in.waveRecord, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"dri/parse_waveform_compact", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, waveforms, err := serial.ParseCompactWaveformRecords(in.waveRecord, nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, waveform := range waveforms {
+					waveform.Release()
+				}
+			}
+		}},
+		{"dri/encode_waveform", func(b *testing.B) {
+			encoder := json.NewEncoder(io.Discard)
+			for i := 0; i < b.N; i++ {
+				_, waveforms, err := serial.ParseWaveformRecords(in.waveRecord, nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, waveform := range waveforms {
+					if err := encoder.Encode(waveform); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}},
+		{"dri/encode_waveform_compact", func(b *testing.B) {
+			encoder := json.NewEncoder(io.Discard)
+			for i := 0; i < b.N; i++ {
+				_, waveforms, err := serial.ParseCompactWaveformRecords(in.waveRecord, nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, waveform := range waveforms {
+					if err := encoder.Encode(waveform); err != nil {
+						b.Fatal(err)
+					}
+					waveform.Release()
+				}
+			}
+		}},
+		{"dri/parse_alarm", func(b *testing.B) {
+			parser := serial.NewAlarmParser()
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.ParseAlarmData(in.alarmRecord); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"dri/encode_alarm_map", func(b *testing.B) {
+			encoder := json.NewEncoder(io.Discard)
+			for i := 0; i < b.N; i++ {
+				if err := encoder.Encode(in.alarmMsg.ToJSON()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"dri/encode_alarm_struct", func(b *testing.B) {
+			encoder := json.NewEncoder(io.Discard)
+			for i := 0; i < b.N; i++ {
+				if err := encoder.Encode(in.alarmMsg.ToStruct()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"hl7/parse_oru", func(b *testing.B) {
+			parser := hl7.NewHL7Parser()
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.ParseMessage(in.oru); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"hl7/oru_to_json", func(b *testing.B) {
+			parser := hl7.NewHL7Parser()
+			for i := 0; i < b.N; i++ {
+				message, err := parser.ParseMessage(in.oru)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := message.ToJSON(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"hl7/parse_batch", func(b *testing.B) {
+			parser := hl7.NewHL7Parser()
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.ParseBatch(in.batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+	}
+}
@@ -0,0 +1,169 @@
+// Command bench runs the benchmarks of the DRI and HL7 hot paths and
+// compares them with a stored baseline. It exits with status 1 when a
+// benchmark is slower or allocates more than the threshold allows, so that
+// it can gate a build.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+// Result is the measurement of one benchmark, as stored in the baseline
+type Result struct {
+	OpsPerSec   float64 `json:"ops_per_sec"` // Frames or messages per second
+	NsPerOp     int64   `json:"ns_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+}
+
+func main() {
+	baselineFile := flag.String("baseline", "baseline.json", "Baseline results to compare with")
+	update := flag.Bool("update", false, "Write the results as the new baseline instead of comparing")
+	threshold := flag.Float64("threshold", 10, "Largest allowed regression in percent of throughput or allocations")
+	run := flag.String("run", "", "Run only the benchmarks matching this regular expression")
+	count := flag.Int("count", 3, "Runs of each benchmark; the fastest is kept")
+	flag.Parse()
+
+	// Refuse to decode with a binary layout that does not match the DRI structures
+	if err := serial.VerifyLayouts(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		log.Fatalf("Invalid -run: %v", err)
+	}
+	if *count < 1 {
+		log.Fatalf("-count must be at least 1")
+	}
+
+	in, err := loadInputs()
+	if err != nil {
+		log.Fatalf("Failed to prepare inputs: %v", err)
+	}
+
+	results := make(map[string]Result)
+	for _, benchmark := range benchmarks(in) {
+		if !filter.MatchString(benchmark.Name) {
+			continue
+		}
+		var best Result
+		for i := 0; i < *count; i++ {
+			measured := measure(benchmark.Run)
+			if measured.OpsPerSec > best.OpsPerSec {
+				best = measured
+			}
+		}
+		results[benchmark.Name] = best
+		fmt.Printf("%-24s %12.0f ops/s %10d ns/op %6d allocs/op %8d B/op\n",
+			benchmark.Name, best.OpsPerSec, best.NsPerOp, best.AllocsPerOp, best.BytesPerOp)
+	}
+
+	if *update {
+		if err := writeBaseline(*baselineFile, results); err != nil {
+			log.Fatalf("Failed to write baseline: %v", err)
+		}
+		fmt.Printf("Baseline written to %s\n", *baselineFile)
+		return
+	}
+
+	baseline, err := readBaseline(*baselineFile)
+	if err != nil {
+		log.Fatalf("Failed to read baseline: %v", err)
+	}
+	regressions := compare(baseline, results, *threshold)
+	for _, regression := range regressions {
+		fmt.Printf("REGRESSION %s\n", regression)
+	}
+	if len(regressions) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("No regression beyond %.1f%% against %s\n", *threshold, *baselineFile)
+}
+
+// measure runs one benchmark
+func measure(run func(b *testing.B)) Result {
+	result := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		run(b)
+	})
+	measured := Result{
+		NsPerOp:     result.NsPerOp(),
+		AllocsPerOp: result.AllocsPerOp(),
+		BytesPerOp:  result.AllocedBytesPerOp(),
+	}
+	if result.T > 0 {
+		measured.OpsPerSec = float64(result.N) / result.T.Seconds()
+	}
+	return measured
+}
+
+// compare returns the benchmarks whose throughput dropped, or whose
+// allocations per operation grew, by more than threshold percent of the
+// baseline. Benchmarks missing from the baseline are not compared.
+func compare(baseline, results map[string]Result, threshold float64) []string {
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var regressions []string
+	for _, name := range names {
+		base, exists := baseline[name]
+		if !exists {
+			fmt.Printf("%s: not in the baseline\n", name)
+			continue
+		}
+		result := results[name]
+		if base.OpsPerSec > 0 {
+			change := (result.OpsPerSec - base.OpsPerSec) / base.OpsPerSec * 100
+			if change < -threshold {
+				regressions = append(regressions, fmt.Sprintf("%s: %.0f ops/s, %.1f%% below the baseline of %.0f ops/s",
+					name, result.OpsPerSec, -change, base.OpsPerSec))
+			}
+		}
+		if result.AllocsPerOp > base.AllocsPerOp {
+			change := 100.0
+			if base.AllocsPerOp > 0 {
+				change = float64(result.AllocsPerOp-base.AllocsPerOp) / float64(base.AllocsPerOp) * 100
+			}
+			if change > threshold {
+				regressions = append(regressions, fmt.Sprintf("%s: %d allocs/op, %.1f%% above the baseline of %d allocs/op",
+					name, result.AllocsPerOp, change, base.AllocsPerOp))
+			}
+		}
+	}
+	return regressions
+}
+
+// readBaseline reads stored results
+func readBaseline(file string) (map[string]Result, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var baseline map[string]Result
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("invalid baseline %s: %v", file, err)
+	}
+	return baseline, nil
+}
+
+// writeBaseline stores results
+func writeBaseline(file string, results map[string]Result) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0644)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+// Report describes a decoded record
+type Report struct {
+	Source     string            `json:"source,omitempty"`
+	Record     int               `json:"record"`
+	Offset     *int              `json:"offset,omitempty"` // Unframed layout only
+	Length     int               `json:"length"`           // Bytes of the record (frame payload without checksum)
+	Header     *HeaderReport     `json:"header,omitempty"`
+	Subrecords []SubrecordReport `json:"subrecords,omitempty"`
+	Parsed     json.RawMessage   `json:"parsed,omitempty"` // Groups (physiological data), alarm data or waveforms
+	Note       string            `json:"note,omitempty"`
+	Issues     []string          `json:"issues,omitempty"`
+}
+
+// HeaderReport is the header of a record
+type HeaderReport struct {
+	RLen             int    `json:"r_len"`
+	RNbr             int    `json:"r_nbr"`
+	DriLevel         int    `json:"dri_level"`
+	DriLevelDesc     string `json:"dri_level_description"`
+	PlugID           int    `json:"plug_id"`
+	RTime            uint32 `json:"r_time"`
+	RTimeUTC         string `json:"r_time_utc"`
+	NSubnet          int    `json:"n_subnet"`
+	Reserved2        int    `json:"reserved2"`
+	Reserved3        int    `json:"reserved3"`
+	MainType         int    `json:"r_maintype"`
+	MainTypeName     string `json:"r_maintype_name"`
+	ActiveSubrecords int    `json:"active_subrecords"`
+}
+
+// SubrecordReport is a subrecord listed in the header
+type SubrecordReport struct {
+	Index    int    `json:"index"`
+	Type     int    `json:"type"`
+	TypeName string `json:"type_name"`
+	Offset   int    `json:"offset"` // From the start of the data area
+	Length   int    `json:"length"`
+}
+
+// decodeRecord validates and parses a record with the parser of its main
+// type. Network records (patient identification) are not parsed, so that
+// the output can be shared.
+func decodeRecord(record Record, samples bool) *Report {
+	report := &Report{Source: record.Source, Record: record.Position, Length: len(record.Data)}
+	if record.Offset >= 0 {
+		offset := record.Offset
+		report.Offset = &offset
+	}
+	if record.Err != nil {
+		report.Issues = append(report.Issues, record.Err.Error())
+	}
+	if len(record.Data) == 0 {
+		return report
+	}
+
+	header, subrecords, err := serial.ValidateRecord(record.Data)
+	if err != nil {
+		report.Issues = append(report.Issues, err.Error())
+	}
+	if header == nil {
+		return report
+	}
+	report.Header = newHeaderReport(header)
+	checkHeader(report, header, len(record.Data))
+	for _, subrecord := range subrecords {
+		name := subrecordTypeName(header.RMainType, subrecord.Type)
+		report.Subrecords = append(report.Subrecords, SubrecordReport{
+			Index:    subrecord.Index,
+			Type:     int(subrecord.Type),
+			TypeName: name,
+			Offset:   subrecord.Offset,
+			Length:   len(subrecord.Data),
+		})
+		if strings.HasPrefix(name, "Unknown") {
+			report.Issues = append(report.Issues, fmt.Sprintf("subrecord %d: unknown type %d for %s",
+				subrecord.Index, subrecord.Type, header.GetMainTypeName()))
+		}
+	}
+	if err != nil {
+		return report
+	}
+
+	parsed, issues := parseRecord(record.Data, header, samples)
+	report.Issues = append(report.Issues, issues...)
+	if header.RMainType == serial.DRI_MT_NETWORK {
+		report.Note = "patient identification, payload not shown"
+	}
+	if parsed != nil {
+		encoded, err := serial.MarshalOutput(parsed)
+		if err != nil {
+			report.Issues = append(report.Issues, fmt.Sprintf("failed to encode output: %v", err))
+		} else {
+			report.Parsed = encoded
+		}
+	}
+	return report
+}
+
+// newHeaderReport describes a header
+func newHeaderReport(header *serial.DatexHeader) *HeaderReport {
+	return &HeaderReport{
+		RLen:             int(header.RLen),
+		RNbr:             int(header.RNbr),
+		DriLevel:         int(header.DriLevel),
+		DriLevelDesc:     header.GetDriLevelDescription(),
+		PlugID:           int(header.PlugID),
+		RTime:            header.RTime,
+		RTimeUTC:         time.Unix(int64(header.RTime), 0).UTC().Format(time.RFC3339),
+		NSubnet:          int(header.NSubnet),
+		Reserved2:        int(header.Reserved2),
+		Reserved3:        int(header.Reserved3),
+		MainType:         int(header.RMainType),
+		MainTypeName:     header.GetMainTypeName(),
+		ActiveSubrecords: header.GetActiveSubrecordCount(),
+	}
+}
+
+// checkHeader flags the header fields the parsers accept but a monitor
+// should not send
+func checkHeader(report *Report, header *serial.DatexHeader, length int) {
+	if int(header.RLen) >= header.Size() && length > int(header.RLen) {
+		report.Issues = append(report.Issues, fmt.Sprintf("%d bytes after r_len %d", length-int(header.RLen), header.RLen))
+	}
+	if err := header.ValidateReservedFields(); err != nil {
+		report.Issues = append(report.Issues, err.Error())
+	}
+	if strings.HasPrefix(header.GetDriLevelDescription(), "Unknown") {
+		report.Issues = append(report.Issues, fmt.Sprintf("unknown DRI level %d", header.DriLevel))
+	}
+	if strings.HasPrefix(header.GetMainTypeName(), "Unknown") {
+		report.Issues = append(report.Issues, fmt.Sprintf("unknown main type %d", header.RMainType))
+	}
+	if header.RTime == 0 {
+		report.Issues = append(report.Issues, "r_time is 0")
+	}
+	if header.GetActiveSubrecordCount() == 0 {
+		report.Issues = append(report.Issues, "no subrecords listed")
+	}
+}
+
+// parseRecord parses a valid record and returns its parsed content and the
+// problems the parser reported
+func parseRecord(data []byte, header *serial.DatexHeader, samples bool) (interface{}, []string) {
+	var issues []string
+	switch header.RMainType {
+	case serial.DRI_MT_PHDB:
+		trend, err := serial.NewTrendParser().ParseTrendData(data)
+		if err != nil {
+			return nil, []string{err.Error()}
+		}
+		issues = append(issues, trend.ParseErrors...)
+		if !trend.IsValid {
+			issues = append(issues, "trend parser marked the record invalid")
+		}
+		return trend.Groups, issues
+	case serial.DRI_MT_WAVE:
+		_, waveforms, err := serial.ParseWaveformRecords(data, nil, nil)
+		if err != nil {
+			issues = append(issues, err.Error())
+		}
+		if !samples {
+			for i, waveform := range waveforms {
+				summary := *waveform
+				summary.Samples = nil
+				waveforms[i] = &summary
+			}
+		}
+		return waveforms, issues
+	case serial.DRI_MT_ALARM:
+		alarm, err := serial.NewAlarmParser().ParseAlarmData(data)
+		if err != nil {
+			return nil, []string{err.Error()}
+		}
+		issues = append(issues, alarm.ParseErrors...)
+		if !alarm.IsValid {
+			issues = append(issues, "alarm parser marked the record invalid")
+		}
+		return alarm.AlarmData, issues
+	}
+	return nil, nil
+}
+
+// subrecordTypeName names a subrecord type of a main type
+func subrecordTypeName(mainType int16, subrecordType byte) string {
+	switch mainType {
+	case serial.DRI_MT_PHDB:
+		switch subrecordType {
+		case serial.DRI_PH_DISPL:
+			return "Displayed Values"
+		case serial.DRI_PH_10S_TREND:
+			return "10 Second Trended Values"
+		case serial.DRI_PH_60S_TREND:
+			return "60 Second Trended Values"
+		case serial.DRI_PH_AUX_INFO:
+			return "Auxiliary Information"
+		}
+	case serial.DRI_MT_WAVE:
+		if subrecordType == serial.DRI_WF_CMD {
+			return "Waveform Command"
+		}
+		if key := serial.GetWaveformChannelKey(int(subrecordType)); key != fmt.Sprintf("WF%d", subrecordType) {
+			return key
+		}
+	case serial.DRI_MT_ALARM:
+		if subrecordType == serial.DRI_AL_STATUS {
+			return "Alarm Status"
+		}
+	case serial.DRI_MT_NETWORK, serial.DRI_MT_FO:
+		return fmt.Sprintf("Type %d", subrecordType)
+	}
+	return fmt.Sprintf("Unknown Type %d", subrecordType)
+}
+
+// printReport writes a report as text
+func printReport(w io.Writer, report *Report) {
+	switch {
+	case report.Record == 0:
+		fmt.Fprintf(w, "\n=== Input")
+	case report.Length == 0:
+		fmt.Fprintf(w, "\n=== Record %d (discarded frame)", report.Record)
+	default:
+		fmt.Fprintf(w, "\n=== Record %d (%d bytes)", report.Record, report.Length)
+	}
+	if report.Source != "" {
+		fmt.Fprintf(w, " of %s", report.Source)
+	}
+	if report.Offset != nil {
+		fmt.Fprintf(w, " at offset %d", *report.Offset)
+	}
+	fmt.Fprintln(w)
+
+	if header := report.Header; header != nil {
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(table, "  r_len\t%d\n", header.RLen)
+		fmt.Fprintf(table, "  r_nbr\t%d\n", header.RNbr)
+		fmt.Fprintf(table, "  dri_level\t%d (%s)\n", header.DriLevel, header.DriLevelDesc)
+		fmt.Fprintf(table, "  plug_id\t%d\n", header.PlugID)
+		fmt.Fprintf(table, "  r_time\t%d (%s)\n", header.RTime, header.RTimeUTC)
+		fmt.Fprintf(table, "  reserved\tn_subnet=%d reserved2=%d reserved3=%d\n", header.NSubnet, header.Reserved2, header.Reserved3)
+		fmt.Fprintf(table, "  r_maintype\t%d (%s)\n", header.MainType, header.MainTypeName)
+		table.Flush()
+	}
+
+	if len(report.Subrecords) > 0 {
+		fmt.Fprintf(w, "  Subrecords:\n")
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintf(table, "    index\ttype\toffset\tlength\t  name\n")
+		for _, subrecord := range report.Subrecords {
+			fmt.Fprintf(table, "    %d\t%d\t%d\t%d\t  %s\n",
+				subrecord.Index, subrecord.Type, subrecord.Offset, subrecord.Length, subrecord.TypeName)
+		}
+		table.Flush()
+	}
+
+	if report.Note != "" {
+		fmt.Fprintf(w, "  Note: %s\n", report.Note)
+	}
+	if len(report.Parsed) > 0 {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, report.Parsed, "    ", "  "); err == nil {
+			fmt.Fprintf(w, "  Parsed:\n    %s\n", indented.String())
+		}
+	}
+
+	if len(report.Issues) == 0 {
+		fmt.Fprintf(w, "  OK\n")
+		return
+	}
+	fmt.Fprintf(w, "  Issues:\n")
+	for _, issue := range report.Issues {
+		fmt.Fprintf(w, "    ! %s\n", issue)
+	}
+}
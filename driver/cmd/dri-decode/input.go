@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+// Layouts of the input, as detected by splitRecords
+const (
+	LAYOUT_FRAMED   = "framed"   // Serial frames: flags, escaping and checksum
+	LAYOUT_UNFRAMED = "unframed" // Records back to back, delimited by r_len
+	LAYOUT_PCAP     = "pcap"     // Serial frames carried over TCP
+)
+
+// Record is a record, or a discarded frame, found in the input. Bytes that
+// are not part of any frame are reported as a Record of position 0.
+type Record struct {
+	Source   string // TCP stream of a pcap input
+	Position int    // Position in the input (or stream), from 1
+	Offset   int    // Byte offset of the record in the input (unframed layout, -1 otherwise)
+	Data     []byte
+	Err      error // Frame error of a discarded frame, or why the rest of the input could not be delimited
+}
+
+// readInput reads a file ("-": standard input). A file holding only hex
+// digits and separators is decoded as a hex dump.
+func readInput(name string) ([]byte, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isHexText(data) {
+		return decodeHex(string(data))
+	}
+	return data, nil
+}
+
+// isHexText reports whether data looks like a hex dump rather than binary
+func isHexText(data []byte) bool {
+	digits := 0
+	for _, b := range data {
+		switch {
+		case b >= '0' && b <= '9', b >= 'a' && b <= 'f', b >= 'A' && b <= 'F':
+			digits++
+		case b == ' ', b == '\t', b == '\r', b == '\n', b == ':', b == ',', b == '-', b == 'x', b == 'X':
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+// decodeHex decodes a hex dump. Whitespace, the separators ":", "," and
+// "-", and "0x" prefixes are ignored.
+func decodeHex(text string) ([]byte, error) {
+	text = strings.NewReplacer("0x", "", "0X", "").Replace(text)
+	digits := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', ':', ',', '-':
+			return -1
+		}
+		return r
+	}, text)
+	if len(digits)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits (%d)", len(digits))
+	}
+	data, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %v", err)
+	}
+	return data, nil
+}
+
+// splitRecords finds the record boundaries of the input. A pcap file is
+// reassembled into its TCP streams of serial frames. Otherwise the input is
+// read as records back to back if their r_len chain covers it exactly, as
+// serial frames if it starts with a flag, then as records back to back if
+// it starts with a valid record, and as serial frames if it holds a flag.
+func splitRecords(data []byte, port int) (string, []Record, error) {
+	if serial.IsPcap(data) {
+		streams, err := serial.ReadTCPStreams(bytes.NewReader(data), port)
+		if err != nil {
+			return "", nil, err
+		}
+		var records []Record
+		for _, stream := range streams {
+			records = append(records, readFrames(stream.Name(), stream.Data)...)
+		}
+		return LAYOUT_PCAP, records, nil
+	}
+
+	switch {
+	case isRecordChain(data):
+	case data[0] == serial.FRAME_FLAG:
+		return LAYOUT_FRAMED, readFrames("", data), nil
+	case isRecordStart(data):
+	case bytes.IndexByte(data, serial.FRAME_FLAG) >= 0:
+		return LAYOUT_FRAMED, readFrames("", data), nil
+	}
+	return LAYOUT_UNFRAMED, splitUnframed(data), nil
+}
+
+// isRecordStart reports whether data starts with a valid record
+func isRecordStart(data []byte) bool {
+	length, ok := recordLength(data)
+	if !ok || length > len(data) {
+		return false
+	}
+	_, _, err := serial.ValidateRecord(data[:length])
+	return err == nil
+}
+
+// isRecordChain reports whether data is a sequence of records whose
+// lengths add up to the length of data
+func isRecordChain(data []byte) bool {
+	for offset := 0; offset < len(data); {
+		length, ok := recordLength(data[offset:])
+		if !ok || offset+length > len(data) {
+			return false
+		}
+		offset += length
+	}
+	return len(data) > 0
+}
+
+// recordLength returns the r_len of the record starting data
+func recordLength(data []byte) (int, bool) {
+	header := &serial.DatexHeader{}
+	if len(data) < header.Size() {
+		return 0, false
+	}
+	length := int(int16(binary.LittleEndian.Uint16(data)))
+	return length, length >= header.Size()
+}
+
+// splitUnframed delimits records back to back by their r_len. When a length
+// is invalid, the rest of the input is returned as one record so that it
+// is reported.
+func splitUnframed(data []byte) []Record {
+	var records []Record
+	for offset := 0; offset < len(data); {
+		record := Record{Position: len(records) + 1, Offset: offset}
+		length, ok := recordLength(data[offset:])
+		if !ok || offset+length > len(data) {
+			record.Data = data[offset:]
+			record.Err = fmt.Errorf("the %d bytes left cannot be delimited", len(data)-offset)
+			return append(records, record)
+		}
+		record.Data = data[offset : offset+length]
+		records = append(records, record)
+		offset += length
+	}
+	return records
+}
+
+// readFrames deframes the records of a serial capture, including the
+// frames that were discarded
+func readFrames(source string, data []byte) []Record {
+	var records []Record
+	reader := serial.NewFrameReader(bytes.NewReader(data))
+	for {
+		payload, err := reader.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		record := Record{Source: source, Position: len(records) + 1, Offset: -1, Data: payload, Err: err}
+		records = append(records, record)
+		if err != nil && !errors.Is(err, serial.ErrInvalidFrame) && !errors.Is(err, serial.ErrChecksumMismatch) {
+			break
+		}
+	}
+	if stats := reader.Stats(); stats.DiscardedBytes > 0 {
+		records = append(records, Record{Source: source, Offset: -1,
+			Err: fmt.Errorf("%d bytes outside of a frame", stats.DiscardedBytes)})
+	}
+	if last := bytes.LastIndexByte(data, serial.FRAME_FLAG); last >= 0 && last < len(data)-1 {
+		records = append(records, Record{Source: source, Offset: -1,
+			Err: fmt.Errorf("input ends inside a frame (%d bytes after the last flag)", len(data)-1-last)})
+	}
+	return records
+}
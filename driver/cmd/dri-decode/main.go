@@ -0,0 +1,103 @@
+// Command dri-decode inspects DRI records for debugging interface problems:
+// it reads a hex dump or a binary file (a serial capture, concatenated
+// records or a pcap of serial-over-TCP traffic), finds the record
+// boundaries, prints the header, subrecords and parsed groups of every
+// record, and flags what the parsers would reject or warn about.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+func main() {
+	hexInput := flag.String("hex", "", "Hex dump of the data, e.g. \"7E 28 00 ...\" (separators and 0x prefixes are ignored)")
+	port := flag.Int("port", 0, "pcap input: only the TCP connections from or to this port (0: all)")
+	jsonOutput := flag.Bool("json", false, "Print one JSON object per record instead of text")
+	samples := flag.Bool("samples", false, "Include the samples of waveform subrecords")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: dri-decode [flags] [file]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Reads -hex, the file (binary or hex text) or standard input.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Refuse to decode with a binary layout that does not match the DRI structures
+	if err := serial.VerifyLayouts(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case *hexInput != "":
+		data, err = decodeHex(*hexInput)
+	case flag.NArg() > 0:
+		data, err = readInput(flag.Arg(0))
+	default:
+		data, err = readInput("-")
+	}
+	if err != nil {
+		log.Fatalf("Failed to read input: %v", err)
+	}
+	if len(data) == 0 {
+		log.Fatalf("No input data")
+	}
+
+	layout, records, err := splitRecords(data, *port)
+	if err != nil {
+		log.Fatalf("Failed to read input: %v", err)
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+	found := 0
+	for _, record := range records {
+		if record.Position > 0 {
+			found++
+		}
+	}
+	if !*jsonOutput {
+		fmt.Fprintf(output, "%d bytes, %s, %d records\n", len(data), layout, found)
+	}
+	flagged, failed := 0, false
+	for _, record := range records {
+		report := decodeRecord(record, *samples)
+		if len(report.Issues) > 0 {
+			failed = true
+			if record.Position > 0 {
+				flagged++
+			}
+		}
+		if *jsonOutput {
+			printJSON(output, report)
+		} else {
+			printReport(output, report)
+		}
+	}
+	if !*jsonOutput {
+		fmt.Fprintf(output, "\n%d of %d records flagged\n", flagged, found)
+	}
+
+	// Exit with 1 when an issue was found so that the tool can be scripted
+	if failed {
+		output.Flush()
+		os.Exit(1)
+	}
+}
+
+// printJSON writes a report as one line of JSON
+func printJSON(w io.Writer, report *Report) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(report); err != nil {
+		log.Printf("Record %d: failed to encode report: %v", report.Record, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+)
+
+// rawMessage is the segments of a message as they appear in a file
+type rawMessage struct {
+	segments []string
+	lines    []int // Line of every segment, from 1
+}
+
+// splitMessages splits the content of a file into messages. Segments may
+// be separated by CR, LF or CRLF, and MLLP framing characters are removed,
+// so that messages copied from logs or captures can be checked. Every MSH
+// starts a message; the headers and trailers of batches and files
+// (FHS, BHS, BTS, FTS) are skipped. Segments before the first MSH form a
+// message of their own, reported as missing its MSH.
+func splitMessages(content string) []rawMessage {
+	content = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x0b", "", "\x1c", "").Replace(content)
+
+	var messages []rawMessage
+	var current *rawMessage
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		segmentType := line
+		if len(segmentType) > 3 {
+			segmentType = segmentType[:3]
+		}
+		switch segmentType {
+		case hl7.HL7_SEG_FHS, hl7.HL7_SEG_BHS, hl7.HL7_SEG_BTS, hl7.HL7_SEG_FTS:
+			current = nil
+			continue
+		case hl7.HL7_SEG_MSH:
+			current = nil
+		}
+		if current == nil {
+			messages = append(messages, rawMessage{})
+			current = &messages[len(messages)-1]
+		}
+		current.segments = append(current.segments, line)
+		current.lines = append(current.lines, i+1)
+	}
+	return messages
+}
@@ -0,0 +1,174 @@
+// Command hl7-lint validates the HL7 messages of files, such as the
+// samples of a new interface or messages copied from a log, and prints
+// the structural errors, missing required fields and invalid values of
+// every message with their segment and field positions.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+)
+
+// Result is the validation of one message of a file
+type Result struct {
+	File      string         `json:"file"`
+	Message   int            `json:"message"` // Position in the file, from 1
+	Line      int            `json:"line"`    // Line of the first segment
+	Type      string         `json:"type,omitempty"`
+	ControlID string         `json:"control_id,omitempty"`
+	Issues    []Issue        `json:"issues"`
+	lines     []int          // Line of every segment
+	counts    map[string]int // Issues by severity
+}
+
+// Issue is a validation issue with the line of its segment
+type Issue struct {
+	hl7.ValidationIssue
+	Line     int    `json:"line,omitempty"`
+	Position string `json:"position"`
+}
+
+func main() {
+	jsonOutput := flag.Bool("json", false, "Print one JSON object per message instead of text")
+	strict := flag.Bool("strict", false, "Exit with 1 on warnings too")
+	quiet := flag.Bool("quiet", false, "Print only the messages with issues")
+	noWarnings := flag.Bool("no-warnings", false, "Do not report warnings")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: hl7-lint [flags] [file ...]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Reads standard input without files.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+	totals := map[string]int{}
+	messages, failed := 0, 0
+	for _, file := range files {
+		results, err := lintFile(file, *noWarnings)
+		if err != nil {
+			output.Flush()
+			log.Printf("%s: %v", file, err)
+			failed++
+			continue
+		}
+		for _, result := range results {
+			messages++
+			for severity, count := range result.counts {
+				totals[severity] += count
+			}
+			if *quiet && len(result.Issues) == 0 {
+				continue
+			}
+			if *jsonOutput {
+				encoder := json.NewEncoder(output)
+				encoder.SetEscapeHTML(false)
+				encoder.Encode(result)
+			} else {
+				printResult(output, result)
+			}
+		}
+	}
+	if !*jsonOutput {
+		fmt.Fprintf(output, "%d messages: %d errors, %d warnings\n",
+			messages, totals[hl7.VALIDATION_ERROR], totals[hl7.VALIDATION_WARNING])
+	}
+
+	if failed > 0 || totals[hl7.VALIDATION_ERROR] > 0 || *strict && totals[hl7.VALIDATION_WARNING] > 0 {
+		output.Flush()
+		os.Exit(1)
+	}
+}
+
+// lintFile validates the messages of a file ("-": standard input)
+func lintFile(file string, noWarnings bool) ([]*Result, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	name := file
+	if file == "-" {
+		name = "stdin"
+	}
+	parser := hl7.NewHL7Parser()
+	var results []*Result
+	for _, message := range splitMessages(string(data)) {
+		result := &Result{File: name, Message: len(results) + 1, Line: message.lines[0], lines: message.lines,
+			Issues: []Issue{}, counts: map[string]int{}}
+		results = append(results, result)
+
+		parsed, err := parser.ParseMessage(strings.Join(message.segments, "\r") + "\r")
+		if err != nil {
+			result.add(hl7.ValidationIssue{Severity: hl7.VALIDATION_ERROR, Kind: hl7.VALIDATION_STRUCTURE,
+				Message: fmt.Sprintf("message cannot be parsed: %v", err)})
+			continue
+		}
+		if msh := parsed.MSH(); msh != nil {
+			result.Type = msh.MessageType()
+			if event := msh.TriggerEvent(); event != "" {
+				result.Type += "^" + event
+			}
+			result.ControlID = msh.ControlID()
+		}
+		for _, issue := range hl7.ValidateMessage(parsed) {
+			if noWarnings && issue.Severity == hl7.VALIDATION_WARNING {
+				continue
+			}
+			result.add(issue)
+		}
+	}
+	return results, nil
+}
+
+// add records an issue with the line of its segment
+func (r *Result) add(issue hl7.ValidationIssue) {
+	entry := Issue{ValidationIssue: issue, Position: issue.Position()}
+	if issue.Sequence > 0 && issue.Sequence <= len(r.lines) {
+		entry.Line = r.lines[issue.Sequence-1]
+	}
+	r.Issues = append(r.Issues, entry)
+	r.counts[issue.Severity]++
+}
+
+// printResult writes the result of a message as text
+func printResult(w io.Writer, result *Result) {
+	fmt.Fprintf(w, "%s:%d: message %d", result.File, result.Line, result.Message)
+	if result.Type != "" {
+		fmt.Fprintf(w, " %s", result.Type)
+	}
+	if result.ControlID != "" {
+		fmt.Fprintf(w, " (control ID %s)", result.ControlID)
+	}
+	if len(result.Issues) == 0 {
+		fmt.Fprintf(w, ": OK\n")
+		return
+	}
+	fmt.Fprintf(w, "\n")
+	for _, issue := range result.Issues {
+		line := "-"
+		if issue.Line > 0 {
+			line = fmt.Sprint(issue.Line)
+		}
+		fmt.Fprintf(w, "  line %-5s %-12s %-8s %-10s %s\n", line, issue.Position, issue.Severity, issue.Kind, issue.Message)
+	}
+}
@@ -0,0 +1,213 @@
+// Command hl7-server runs the HL7 server with a configuration file,
+// optionally verified against a signed release manifest.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/fhir"
+	"github.com/harusin0516/healthcare/driver/hl7"
+	"github.com/harusin0516/healthcare/driver/publish"
+)
+
+func main() {
+	// Parse command line flags
+	configFile := flag.String("config", "config.json", "Configuration file path")
+	manifestFile := flag.String("manifest", "", "Signed release manifest listing the binary and configuration hashes")
+	manifestKey := flag.String("manifest-key", hl7.ManifestPublicKey, "Base64 Ed25519 public key of the manifest signer")
+	integrity := flag.String("integrity", hl7.INTEGRITY_POLICY_OFF, "Integrity policy when the manifest does not match (off, warn, enforce)")
+	conformance := flag.String("conformance", "", "Print the conformance statement of the configuration (json or markdown) and exit")
+	flag.Parse()
+
+	// Verify the binary and the configuration bundle against the signed manifest
+	if !hl7.ValidIntegrityPolicy(*integrity) {
+		log.Fatalf("Unknown integrity policy %q", *integrity)
+	}
+	var manifest *hl7.Manifest
+	if *integrity != hl7.INTEGRITY_POLICY_OFF {
+		if *manifestFile == "" {
+			log.Fatalf("Integrity policy %s requires -manifest", *integrity)
+		}
+		var err error
+		manifest, err = hl7.LoadManifest(*manifestFile, *manifestKey)
+		if err == nil {
+			err = manifest.Verify(*configFile)
+		}
+		if err != nil {
+			if *integrity == hl7.INTEGRITY_POLICY_ENFORCE {
+				log.Fatalf("Refusing to start: %v", err)
+			}
+			log.Printf("WARNING: %v", err)
+		}
+	}
+	enforce := manifest != nil && *integrity == hl7.INTEGRITY_POLICY_ENFORCE
+
+	// Load configuration
+	config, err := hl7.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Describe the interface for integration governance instead of serving it
+	if *conformance != "" {
+		statement := hl7.BuildConformanceStatement(config, time.Now())
+		switch *conformance {
+		case hl7.CONFORMANCE_FORMAT_JSON:
+			data, err := json.MarshalIndent(statement, "", "  ")
+			if err != nil {
+				log.Fatalf("Failed to encode conformance statement: %v", err)
+			}
+			fmt.Println(string(data))
+		case hl7.CONFORMANCE_FORMAT_MARKDOWN:
+			fmt.Print(statement.Markdown())
+		default:
+			log.Fatalf("Unknown conformance statement format %q", *conformance)
+		}
+		return
+	}
+
+	// Create HL7 server
+	server := hl7.NewHL7Server(config)
+
+	// Archive received messages if storage is configured
+	storage, err := hl7.NewStorage(config.Storage)
+	if err != nil {
+		log.Fatalf("Failed to open message storage: %v", err)
+	}
+	server.SetStorage(storage)
+
+	// Publish parsed messages if an event bus is configured
+	publisher, err := publish.New(config.Publisher)
+	if err != nil {
+		log.Fatalf("Failed to create publisher: %v", err)
+	}
+	server.SetPublisher(publisher, config.Publisher.TopicTemplate)
+
+	// Export observations to a FHIR server if one is configured
+	fhirClient, err := fhir.New(config.FHIR)
+	if err != nil {
+		log.Fatalf("Failed to create FHIR client: %v", err)
+	}
+	server.SetFHIRClient(fhirClient)
+
+	// Handle graceful shutdown
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Report runtime errors without stopping the server
+	server.SetErrorHandler(func(err error) {
+		log.Printf("HL7 server error: %v", err)
+	})
+
+	// Start server in a goroutine
+	startErr := make(chan error, 2)
+	go func() {
+		startErr <- server.Start(ctx)
+	}()
+
+	// Start the admin API if enabled
+	var admin *hl7.AdminServer
+	if config.Admin.Enabled {
+		admin = hl7.NewAdminServer(server, config.Admin)
+		go func() {
+			if err := admin.Start(ctx); err != nil {
+				startErr <- err
+			}
+		}()
+	}
+
+	// Report to the fleet management service and apply its signed updates if enabled
+	if config.Fleet.Enabled {
+		fleet, err := hl7.NewFleetClient(server, config.Fleet, *configFile)
+		if err != nil {
+			log.Fatalf("Failed to create fleet client: %v", err)
+		}
+		if enforce {
+			fleet.SetManifest(manifest)
+		}
+		go fleet.Start(ctx)
+	}
+
+	// Reload mutable settings (allowed IPs, timeouts, log level) and the TLS certificates on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go func() {
+		for range reload {
+			if manifest != nil {
+				data, err := os.ReadFile(*configFile)
+				if err == nil {
+					err = manifest.VerifyConfig(*configFile, data)
+				}
+				if err != nil && enforce {
+					log.Printf("Configuration not reloaded: %v", err)
+					continue
+				}
+				if err != nil {
+					log.Printf("WARNING: %v", err)
+				}
+			}
+			newConfig, err := hl7.LoadConfig(*configFile)
+			if err != nil {
+				log.Printf("Configuration not reloaded: %v", err)
+				continue
+			}
+			if err := server.Reload(newConfig); err != nil {
+				log.Printf("Configuration not reloaded: %v", err)
+			}
+		}
+	}()
+
+	// Print server status
+	status := server.Status()
+	statusJSON, _ := json.MarshalIndent(status, "", "  ")
+	fmt.Printf("HL7 Server Status:\n%s\n", statusJSON)
+
+	// Wait for shutdown signal or a startup failure
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		fmt.Println("\nShutting down HL7 server...")
+	case err := <-startErr:
+		if err != nil {
+			log.Printf("Failed to start server: %v", err)
+			exitCode = 1
+		}
+	}
+
+	// Stop the admin API and the server
+	if admin != nil {
+		if err := admin.Stop(); err != nil {
+			log.Printf("Error stopping admin API: %v", err)
+		}
+	}
+	if err := server.Stop(); err != nil {
+		log.Printf("Error stopping server: %v", err)
+	}
+
+	// Close publisher, FHIR client and message storage (os.Exit skips deferred calls)
+	if publisher != nil {
+		if err := publisher.Close(); err != nil {
+			log.Printf("Error closing publisher: %v", err)
+		}
+	}
+	if fhirClient != nil {
+		fhirClient.Close()
+	}
+	if storage != nil {
+		if err := storage.Close(); err != nil {
+			log.Printf("Error closing message storage: %v", err)
+		}
+	}
+
+	fmt.Println("HL7 server stopped")
+	os.Exit(exitCode)
+}
@@ -1,15 +1,17 @@
+// Command hl7-test-client sends sample HL7 messages to an HL7 server and
+// prints the acknowledgments.
 package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
-	"os"
+	"strconv"
 	"time"
-	"driver/hl7"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
 )
 
 func main() {
@@ -29,7 +31,7 @@ func main() {
 	}
 
 	// Connect to HL7 server
-	address := fmt.Sprintf("%s:%d", *serverHost, *serverPort)
+	address := net.JoinHostPort(*serverHost, strconv.Itoa(*serverPort))
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		log.Fatalf("Failed to connect to HL7 server: %v", err)
@@ -94,7 +96,7 @@ func NewTestClient(host string, port int) *TestClient {
 
 // Connect connects to the HL7 server
 func (c *TestClient) Connect() error {
-	address := fmt.Sprintf("%s:%d", c.host, c.port)
+	address := net.JoinHostPort(c.host, strconv.Itoa(c.port))
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		return fmt.Errorf("failed to connect to HL7 server: %v", err)
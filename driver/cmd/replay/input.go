@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+// newArchiveFilter selects the archived messages to replay
+func newArchiveFilter(from, to, patient, messageType string) (hl7.MessageFilter, error) {
+	filter := hl7.MessageFilter{PatientID: patient, MessageType: messageType}
+	var err error
+	if from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return filter, fmt.Errorf("invalid -from: %v", err)
+		}
+	}
+	if to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return filter, fmt.Errorf("invalid -to: %v", err)
+		}
+	}
+	return filter, nil
+}
+
+// loadArchive reads the messages of an archive, oldest first. A message
+// without a date/time (MSH-7) is given its receipt time, so that every
+// replayed message carries the time it was originally sent.
+func loadArchive(storageType, path string, filter hl7.MessageFilter) ([]Item, error) {
+	// The storage would create a missing archive
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	storage, err := hl7.NewStorage(hl7.StorageConfig{Type: storageType, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("-storage is required")
+	}
+	defer storage.Close()
+
+	stored, err := storage.Query(filter)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(stored))
+	for _, message := range stored {
+		raw := message.Raw
+		label := fmt.Sprintf("%s %s", message.MessageType, message.ControlID)
+		if parsed, err := message.Message(); err == nil {
+			if msh := parsed.MSH(); msh != nil && msh.FieldValue(7) == "" {
+				msh.SetFieldValue(7, message.ReceivedAt.Format("20060102150405-0700"))
+				raw = parsed.Encode()
+			}
+		}
+		items = append(items, Item{Time: message.ReceivedAt, Label: label, Data: []byte(raw)})
+	}
+	return items, nil
+}
+
+// loadCapture reads the records of a raw serial capture, timed by their
+// r_time. Discarded frames are reported and skipped; a record whose header
+// cannot be read keeps the time of the previous record.
+func loadCapture(file string) ([]Item, error) {
+	capture, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer capture.Close()
+
+	reader := serial.NewFrameReader(capture)
+	items := make([]Item, 0)
+	var last time.Time
+	for {
+		record, err := reader.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, serial.ErrInvalidFrame) || errors.Is(err, serial.ErrChecksumMismatch) {
+				continue
+			}
+			return nil, err
+		}
+		header := &serial.DatexHeader{}
+		label := fmt.Sprintf("record %d", len(items)+1)
+		if header.UnmarshalBinary(record) == nil {
+			last = time.Unix(int64(header.RTime), 0)
+			label = fmt.Sprintf("record %d (plug %d, %s)", len(items)+1, header.PlugID, header.GetMainTypeName())
+		}
+		items = append(items, Item{Time: last, Label: label, Data: record})
+	}
+	if stats := reader.Stats(); stats.ChecksumFailures > 0 || stats.InvalidFrames > 0 {
+		fmt.Printf("Skipped %d frames with a checksum mismatch and %d invalid frames\n", stats.ChecksumFailures, stats.InvalidFrames)
+	}
+	return items, nil
+}
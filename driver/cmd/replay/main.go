@@ -0,0 +1,155 @@
+// Command replay reads archived HL7 messages or a raw DRI capture and
+// replays them against a server or the parsers, at the pace they were
+// received: in real time, faster, or as fast as possible. Messages and
+// records are sent as they were captured, so downstream systems see their
+// original timestamps in the header (MSH-7, DRI r_time) rather than the
+// time of the replay.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+// Input formats
+const (
+	FORMAT_HL7 = "hl7" // Message archive of the HL7 server (filesystem or SQLite storage)
+	FORMAT_DRI = "dri" // Raw bytes received on the serial line of a monitor
+)
+
+// Item is a message or record to replay
+type Item struct {
+	Time  time.Time // Original receipt time (HL7) or r_time (DRI)
+	Label string    // Identifies the item in errors, e.g. the control ID
+	Data  []byte
+}
+
+// Target receives the replayed items
+type Target interface {
+	Send(item Item) error
+	Close() error
+}
+
+// Summary counts the replayed items
+type Summary struct {
+	Sent    int
+	Failed  int
+	Elapsed time.Duration
+}
+
+func main() {
+	format := flag.String("format", FORMAT_HL7, "Input format: hl7 (message archive) or dri (raw serial capture)")
+	input := flag.String("input", "", "Archive directory or SQLite file (hl7), or capture file (dri)")
+	storage := flag.String("storage", hl7.STORAGE_FILESYSTEM, "Archive type of hl7 input: filesystem or sqlite")
+	from := flag.String("from", "", "Replay hl7 messages received at or after this time (RFC 3339)")
+	to := flag.String("to", "", "Replay hl7 messages received before this time (RFC 3339)")
+	patient := flag.String("patient", "", "Replay only the hl7 messages of this patient ID")
+	messageType := flag.String("type", "", "Replay only hl7 messages of this type (MSH-9.1), e.g. ORU")
+	target := flag.String("target", "", "host:port to send to (MLLP for hl7, TCP for dri); empty parses locally")
+	speed := flag.Float64("speed", 1, "Replay speed: 1 real time, 10 ten times faster, 0 as fast as possible")
+	maxGap := flag.Duration("max-gap", 0, "Longest wait between two items, e.g. 1m to skip the nights of an archive (0: no limit)")
+	timeout := flag.Duration("timeout", 10*time.Second, "Connection and acknowledgment timeout")
+	verbose := flag.Bool("v", false, "Print every item; with local parsing, print the parsed JSON")
+	flag.Parse()
+
+	// Refuse to decode with a binary layout that does not match the DRI structures
+	if err := serial.VerifyLayouts(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if *input == "" {
+		log.Fatalf("-input is required")
+	}
+	if *speed < 0 {
+		log.Fatalf("-speed must not be negative")
+	}
+
+	var items []Item
+	var err error
+	switch *format {
+	case FORMAT_HL7:
+		var filter hl7.MessageFilter
+		filter, err = newArchiveFilter(*from, *to, *patient, *messageType)
+		if err == nil {
+			items, err = loadArchive(*storage, *input, filter)
+		}
+	case FORMAT_DRI:
+		items, err = loadCapture(*input)
+	default:
+		err = fmt.Errorf("unknown format %q (hl7 or dri)", *format)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", *input, err)
+	}
+	if len(items) == 0 {
+		log.Fatalf("Nothing to replay in %s", *input)
+	}
+
+	destination, err := newTarget(*format, *target, *timeout, *verbose)
+	if err != nil {
+		log.Fatalf("Failed to open target: %v", err)
+	}
+	defer destination.Close()
+
+	first, last := items[0].Time, items[len(items)-1].Time
+	fmt.Printf("Replaying %d items captured from %s to %s at %s\n",
+		len(items), first.Format(time.RFC3339), last.Format(time.RFC3339), speedName(*speed))
+	summary := replay(items, destination, *speed, *maxGap, *verbose)
+	fmt.Printf("Sent %d, failed %d in %s\n", summary.Sent, summary.Failed, summary.Elapsed.Round(time.Millisecond))
+}
+
+// replay sends the items, waiting between two items for the time that
+// separated them divided by speed (no wait if speed is 0). Gaps longer
+// than maxGap are shortened to it. A failed item is reported and the
+// replay continues.
+func replay(items []Item, target Target, speed float64, maxGap time.Duration, verbose bool) Summary {
+	var summary Summary
+	started := time.Now()
+	var offset time.Duration // Capture time elapsed since the first item, with long gaps shortened
+	for i, item := range items {
+		if i > 0 {
+			gap := item.Time.Sub(items[i-1].Time)
+			if gap < 0 {
+				gap = 0
+			}
+			if maxGap > 0 && gap > maxGap {
+				gap = maxGap
+			}
+			offset += gap
+		}
+		if speed > 0 {
+			due := started.Add(time.Duration(float64(offset) / speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		if err := target.Send(item); err != nil {
+			summary.Failed++
+			log.Printf("%s: %v", item.Label, err)
+			continue
+		}
+		summary.Sent++
+		if verbose {
+			fmt.Printf("%s %s\n", item.Time.Format(time.RFC3339Nano), item.Label)
+		}
+	}
+	summary.Elapsed = time.Since(started)
+	return summary
+}
+
+// speedName describes a replay speed
+func speedName(speed float64) string {
+	switch speed {
+	case 0:
+		return "full speed"
+	case 1:
+		return "real time"
+	}
+	return fmt.Sprintf("%gx", speed)
+}
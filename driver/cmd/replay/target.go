@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+	"github.com/harusin0516/healthcare/driver/serial"
+)
+
+// newTarget opens the destination of a replay: an MLLP listener (hl7) or
+// a TCP port receiving the serial stream of a monitor (dri), or the local
+// parsers if address is empty
+func newTarget(format, address string, timeout time.Duration, verbose bool) (Target, error) {
+	switch {
+	case address == "" && format == FORMAT_HL7:
+		return &hl7ParserTarget{parser: hl7.NewHL7Parser(), verbose: verbose}, nil
+	case address == "":
+		return &driParserTarget{verbose: verbose}, nil
+	case format == FORMAT_HL7:
+		return &mllpTarget{client: hl7.NewMLLPClient(address, timeout)}, nil
+	}
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", address, err)
+	}
+	return &streamTarget{conn: conn, timeout: timeout}, nil
+}
+
+// mllpTarget sends messages to an MLLP listener, each on its own connection,
+// and waits for their acknowledgment
+type mllpTarget struct {
+	client *hl7.MLLPClient
+}
+
+// Send sends a message and fails if it is not accepted
+func (t *mllpTarget) Send(item Item) error {
+	_, err := t.client.Send(string(item.Data))
+	return err
+}
+
+// Close does nothing: connections are closed after every message
+func (t *mllpTarget) Close() error {
+	return nil
+}
+
+// streamTarget writes framed DRI records on one connection, as a monitor
+// does on its serial line
+type streamTarget struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Send frames a record and writes it
+func (t *streamTarget) Send(item Item) error {
+	t.conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	_, err := t.conn.Write(serial.Frame(item.Data))
+	return err
+}
+
+// Close closes the connection
+func (t *streamTarget) Close() error {
+	return t.conn.Close()
+}
+
+// hl7ParserTarget parses the messages
+type hl7ParserTarget struct {
+	parser  *hl7.HL7Parser
+	verbose bool
+}
+
+// Send parses a message and prints it as JSON if verbose
+func (t *hl7ParserTarget) Send(item Item) error {
+	message, err := t.parser.ParseMessage(string(item.Data))
+	if err != nil || !t.verbose {
+		return err
+	}
+	output, err := message.ToJSON()
+	if err != nil {
+		return err
+	}
+	fmt.Println(output)
+	return nil
+}
+
+// Close does nothing
+func (t *hl7ParserTarget) Close() error {
+	return nil
+}
+
+// driParserTarget parses the records with the parser of their main type
+type driParserTarget struct {
+	verbose bool
+}
+
+// Send validates and parses a record and prints it as JSON if verbose.
+// Records of other main types are only validated.
+func (t *driParserTarget) Send(item Item) error {
+	header, _, err := serial.ValidateRecord(item.Data)
+	if err != nil {
+		return err
+	}
+	var parsed interface{}
+	switch header.RMainType {
+	case serial.DRI_MT_PHDB:
+		parsed, err = serial.NewTrendParser().ParseTrendData(item.Data)
+	case serial.DRI_MT_WAVE:
+		_, parsed, err = serial.ParseWaveformRecords(item.Data, nil, nil)
+	case serial.DRI_MT_ALARM:
+		parsed, err = serial.NewAlarmParser().ParseAlarmData(item.Data)
+	default:
+		parsed = header
+	}
+	if err != nil || !t.verbose {
+		return err
+	}
+	output, err := serial.MarshalOutput(parsed)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+// Close does nothing
+func (t *driParserTarget) Close() error {
+	return nil
+}
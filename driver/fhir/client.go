@@ -0,0 +1,143 @@
+package fhir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// FHIR_CONTENT_TYPE is the media type of FHIR JSON resources
+const FHIR_CONTENT_TYPE = "application/fhir+json"
+
+// FHIR_DEFAULT_TIMEOUT is the request timeout in seconds when none is configured
+const FHIR_DEFAULT_TIMEOUT = 10
+
+// Config configures the export to a FHIR server
+type Config struct {
+	URL               string            `json:"url"`                // Base URL of the FHIR server, e.g. "https://fhir.example.org/r4" (empty: disabled)
+	Token             string            `json:"token"`              // Bearer token (empty: no Authorization header)
+	Timeout           int               `json:"timeout"`            // Request timeout in seconds (0: 10)
+	PatientSystem     string            `json:"patient_system"`     // Identifier system of patient IDs (default "urn:healthcare:patient")
+	DeviceSystem      string            `json:"device_system"`      // Identifier system of device IDs (default "urn:healthcare:device")
+	ObservationSystem string            `json:"observation_system"` // Identifier system of observation IDs (default "urn:healthcare:observation")
+	ConvertUnits      map[string]string `json:"convert_units"`      // UCUM units converted before export, e.g. {"kPa": "mm[Hg]"}
+	Transport         transport.Config  `json:"transport"`          // TLS and proxy
+}
+
+// Client posts transaction bundles to a FHIR server
+type Client struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// operationOutcome is the error body returned by FHIR servers
+type operationOutcome struct {
+	ResourceType string `json:"resourceType"`
+	Issue        []struct {
+		Severity    string `json:"severity"`
+		Code        string `json:"code"`
+		Diagnostics string `json:"diagnostics"`
+	} `json:"issue"`
+}
+
+// New creates a client for config. It returns nil and no error when the
+// export is disabled.
+func New(config Config) (*Client, error) {
+	if config.URL == "" {
+		return nil, nil
+	}
+	client, err := NewClient(config.URL, config.Token, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if client.client, err = config.Transport.HTTPClient(client.client.Timeout); err != nil {
+		return nil, fmt.Errorf("FHIR server transport: %v", err)
+	}
+	return client, nil
+}
+
+// NewClient creates a client for the FHIR server at baseURL
+func NewClient(baseURL, token string, timeout int) (*Client, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid FHIR server URL: %s", baseURL)
+	}
+	if timeout <= 0 {
+		timeout = FHIR_DEFAULT_TIMEOUT
+	}
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}, nil
+}
+
+// Send posts a transaction bundle to the server base URL and returns the
+// transaction-response. The server applies a transaction completely or not
+// at all, so a bundle that failed can be sent again.
+func (c *Client) Send(bundle *Bundle) (*Bundle, error) {
+	body, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, c.baseURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", FHIR_CONTENT_TYPE)
+	request.Header.Set("Accept", FHIR_CONTENT_TYPE)
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send FHIR bundle: %v", err)
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 1024*1024))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("FHIR server returned %s: %s", response.Status, outcomeText(responseBody))
+	}
+
+	result := &Bundle{}
+	if err := json.Unmarshal(responseBody, result); err != nil {
+		return nil, fmt.Errorf("invalid FHIR transaction response: %v", err)
+	}
+	for i, entry := range result.Entry {
+		if entry.Response != nil && !strings.HasPrefix(entry.Response.Status, "2") {
+			return result, fmt.Errorf("FHIR bundle entry %d failed: %s", i, entry.Response.Status)
+		}
+	}
+	return result, nil
+}
+
+// Close releases idle HTTP connections
+func (c *Client) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// outcomeText returns the diagnostics of an OperationOutcome body, or the
+// body itself if it is not one
+func outcomeText(body []byte) string {
+	var outcome operationOutcome
+	if err := json.Unmarshal(body, &outcome); err == nil && outcome.ResourceType == "OperationOutcome" {
+		messages := make([]string, 0, len(outcome.Issue))
+		for _, issue := range outcome.Issue {
+			messages = append(messages, firstNonEmpty(issue.Diagnostics, issue.Code))
+		}
+		return strings.Join(messages, "; ")
+	}
+	return strings.TrimSpace(string(body))
+}
@@ -0,0 +1,342 @@
+package fhir
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+	"github.com/harusin0516/healthcare/driver/ucum"
+)
+
+// Identifier systems used when none are configured
+const (
+	DEFAULT_PATIENT_SYSTEM     = "urn:healthcare:patient"
+	DEFAULT_DEVICE_SYSTEM      = "urn:healthcare:device"
+	DEFAULT_OBSERVATION_SYSTEM = "urn:healthcare:observation"
+)
+
+// codingSystems maps HL7 v2 coding system names (CE/CWE component 3) to FHIR systems
+var codingSystems = map[string]string{
+	mdc.CODING_SYSTEM: SYSTEM_MDC,
+	"LN":              SYSTEM_LOINC,
+	"SCT":             SYSTEM_SNOMED,
+	"SNM":             SYSTEM_SNOMED,
+}
+
+// ucumUnits maps MDC unit reference IDs and common unit texts that are not
+// UCUM codes themselves to UCUM codes
+var ucumUnits = map[string]string{
+	"MDC_DIM_DIMLESS":        "1",
+	"MDC_DIM_PERCENT":        "%",
+	"MDC_DIM_BEAT_PER_MIN":   "/min",
+	"MDC_DIM_RESP_PER_MIN":   "/min",
+	"MDC_DIM_MMHG":           "mm[Hg]",
+	"MDC_DIM_CM_H2O":         "cm[H2O]",
+	"MDC_DIM_DEGC":           "Cel",
+	"MDC_DIM_MILLI_VOLT":     "mV",
+	"MDC_DIM_MICRO_VOLT":     "uV",
+	"MDC_DIM_MILLI_L":        "mL",
+	"MDC_DIM_MILLI_L_PER_HR": "mL/h",
+	"MDC_DIM_L_PER_MIN":      "L/min",
+	"MDC_DIM_MIN":            "min",
+	"mmHg":                   "mm[Hg]",
+	"cmH2O":                  "cm[H2O]",
+	"bpm":                    "/min",
+	"°C":                     "Cel",
+	"ml":                     "mL",
+	"l/min":                  "L/min",
+	"mEq/L":                  "meq/L",
+}
+
+// observationStatuses maps HL7 v2 result statuses (OBX-11, table 0085) to FHIR
+var observationStatuses = map[string]string{
+	"F": "final",
+	"C": "corrected",
+	"P": "preliminary",
+	"R": "preliminary",
+	"S": "preliminary",
+	"I": "registered",
+	"D": "entered-in-error",
+	"W": "entered-in-error",
+	"X": "cancelled",
+}
+
+// interpretations maps HL7 v2 abnormal flags (OBX-8, table 0078) to
+// v3-ObservationInterpretation; both use the same codes for these flags
+var interpretations = map[string]string{
+	"L": "Low", "H": "High", "LL": "Critical low", "HH": "Critical high",
+	"N": "Normal", "A": "Abnormal", "AA": "Critical abnormal",
+}
+
+// genders maps HL7 v2 administrative sex (PID-8, table 0001) to FHIR
+var genders = map[string]string{"M": "male", "F": "female", "O": "other", "A": "other", "U": "unknown", "N": "unknown"}
+
+// PatientInfo identifies the subject of the observations
+type PatientInfo struct {
+	ID        string
+	Family    string
+	Given     string
+	Sex       string // HL7 administrative sex (PID-8): M, F, O, U, A or N
+	BirthDate time.Time
+}
+
+// DeviceInfo identifies a device that produced observations
+type DeviceInfo struct {
+	ID   string // e.g. OBX-18 or the DRI plug ID
+	Name string
+	Type string // MDC reference ID of the device, e.g. "MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS"
+}
+
+// Measurement is one observation to export, from an HL7 OBX segment or a
+// DRI physiological database value
+type Measurement struct {
+	ID             string // Unique per observation, e.g. "<control ID>-<OBX-1>"; used for idempotent retries
+	Code           string // e.g. "150033" (MDC) or "2823-3" (LOINC)
+	CodingSystem   string // HL7 coding system name: "MDC", "LN", "SCT" or a local name
+	Display        string // e.g. "MDC_PRESS_BLD_ART_SYS"
+	Value          string
+	NumericValue   *float64
+	Unit           string // MDC unit reference ID, UCUM code or text
+	Time           time.Time
+	Status         string // HL7 result status (OBX-11); empty is final
+	AbnormalFlags  string // HL7 abnormal flags (OBX-8), repetitions separated by "~"
+	ReferenceRange string
+	DeviceID       string // ID of the DeviceInfo that produced the value
+	Category       string // Observation category, e.g. CATEGORY_VITAL_SIGNS (empty: none)
+}
+
+// Converter builds FHIR resources with the configured identifier systems
+type Converter struct {
+	patientSystem     string
+	deviceSystem      string
+	observationSystem string
+	convertUnits      map[string]string
+}
+
+// NewConverter creates a converter
+func NewConverter(config Config) *Converter {
+	return &Converter{
+		patientSystem:     firstNonEmpty(config.PatientSystem, DEFAULT_PATIENT_SYSTEM),
+		deviceSystem:      firstNonEmpty(config.DeviceSystem, DEFAULT_DEVICE_SYSTEM),
+		observationSystem: firstNonEmpty(config.ObservationSystem, DEFAULT_OBSERVATION_SYSTEM),
+		convertUnits:      config.ConvertUnits,
+	}
+}
+
+// Bundle builds a transaction with the patient, the devices and one
+// Observation per measurement. Patients, devices and observations are created
+// only if no resource with the same identifier exists, so a bundle can be
+// sent again after a failure. Devices referenced by measurements but missing
+// from devices are added with their ID only. patient may be nil.
+func (c *Converter) Bundle(patient *PatientInfo, devices []DeviceInfo, measurements []Measurement) *Bundle {
+	bundle := &Bundle{ResourceType: RESOURCE_BUNDLE, Type: "transaction"}
+
+	var subject *Reference
+	if patient != nil && patient.ID != "" {
+		subject = c.addEntry(bundle, c.Patient(*patient), RESOURCE_PATIENT, c.patientSystem, patient.ID)
+	}
+
+	deviceRefs := make(map[string]*Reference)
+	for _, device := range devices {
+		if device.ID != "" && deviceRefs[device.ID] == nil {
+			deviceRefs[device.ID] = c.addEntry(bundle, c.Device(device), RESOURCE_DEVICE, c.deviceSystem, device.ID)
+		}
+	}
+	for _, measurement := range measurements {
+		if id := measurement.DeviceID; id != "" && deviceRefs[id] == nil {
+			deviceRefs[id] = c.addEntry(bundle, c.Device(DeviceInfo{ID: id}), RESOURCE_DEVICE, c.deviceSystem, id)
+		}
+	}
+
+	for _, measurement := range measurements {
+		observation := c.Observation(measurement, subject, deviceRefs[measurement.DeviceID])
+		if measurement.ID == "" {
+			bundle.Entry = append(bundle.Entry, BundleEntry{
+				FullURL:  newUUID(),
+				Resource: observation,
+				Request:  &BundleEntryRequest{Method: "POST", URL: RESOURCE_OBSERVATION},
+			})
+			continue
+		}
+		c.addEntry(bundle, observation, RESOURCE_OBSERVATION, c.observationSystem, measurement.ID)
+	}
+
+	return bundle
+}
+
+// addEntry adds a conditional create of resource and returns a reference to it
+func (c *Converter) addEntry(bundle *Bundle, resource interface{}, resourceType, system, id string) *Reference {
+	fullURL := newUUID()
+	bundle.Entry = append(bundle.Entry, BundleEntry{
+		FullURL:  fullURL,
+		Resource: resource,
+		Request: &BundleEntryRequest{
+			Method:      "POST",
+			URL:         resourceType,
+			IfNoneExist: "identifier=" + url.QueryEscape(system+"|"+id),
+		},
+	})
+	return &Reference{Reference: fullURL}
+}
+
+// Patient converts patient information into a Patient resource
+func (c *Converter) Patient(patient PatientInfo) *Patient {
+	resource := &Patient{
+		ResourceType: RESOURCE_PATIENT,
+		Identifier:   []Identifier{{System: c.patientSystem, Value: patient.ID}},
+		Gender:       genders[strings.ToUpper(patient.Sex)],
+	}
+	if patient.Family != "" || patient.Given != "" {
+		name := HumanName{Family: patient.Family}
+		if patient.Given != "" {
+			name.Given = []string{patient.Given}
+		}
+		resource.Name = []HumanName{name}
+	}
+	if !patient.BirthDate.IsZero() {
+		resource.BirthDate = patient.BirthDate.Format("2006-01-02")
+	}
+	return resource
+}
+
+// Device converts device information into a Device resource
+func (c *Converter) Device(device DeviceInfo) *Device {
+	resource := &Device{
+		ResourceType: RESOURCE_DEVICE,
+		Identifier:   []Identifier{{System: c.deviceSystem, Value: device.ID}},
+	}
+	if device.Name != "" {
+		resource.DeviceName = []DeviceName{{Name: device.Name, Type: "user-friendly-name"}}
+	}
+	if device.Type != "" {
+		resource.Type = &CodeableConcept{Coding: []Coding{mdcCoding(device.Type)}}
+	}
+	return resource
+}
+
+// Observation converts a measurement into an Observation resource
+func (c *Converter) Observation(measurement Measurement, subject, device *Reference) *Observation {
+	observation := &Observation{
+		ResourceType: RESOURCE_OBSERVATION,
+		Status:       ObservationStatus(measurement.Status),
+		Code:         measurementCode(measurement),
+		Subject:      subject,
+		Device:       device,
+	}
+	if measurement.ID != "" {
+		observation.Identifier = []Identifier{{System: c.observationSystem, Value: measurement.ID}}
+	}
+	if measurement.Category != "" {
+		observation.Category = []CodeableConcept{category(measurement.Category)}
+	}
+	if !measurement.Time.IsZero() {
+		observation.EffectiveDateTime = measurement.Time.Format(time.RFC3339)
+	}
+
+	if measurement.NumericValue != nil {
+		observation.ValueQuantity = c.quantity(*measurement.NumericValue, measurement.Unit)
+	} else if measurement.Value != "" {
+		observation.ValueString = measurement.Value
+	}
+
+	for _, flag := range strings.Split(measurement.AbnormalFlags, "~") {
+		if display, known := interpretations[flag]; known {
+			observation.Interpretation = append(observation.Interpretation, CodeableConcept{
+				Coding: []Coding{{System: SYSTEM_INTERPRETATION, Code: flag, Display: display}},
+			})
+		}
+	}
+	if measurement.ReferenceRange != "" {
+		observation.ReferenceRange = []ReferenceRange{{Text: measurement.ReferenceRange}}
+	}
+	return observation
+}
+
+// ObservationStatus maps an HL7 v2 result status (OBX-11) to an Observation
+// status. An empty or unknown status is final.
+func ObservationStatus(status string) string {
+	if mapped, known := observationStatuses[strings.ToUpper(status)]; known {
+		return mapped
+	}
+	return "final"
+}
+
+// measurementCode builds the code of a measurement. MDC codes sent with only
+// a reference ID are completed from the code table.
+func measurementCode(measurement Measurement) CodeableConcept {
+	if measurement.CodingSystem == mdc.CODING_SYSTEM {
+		coding := mdcCoding(firstNonEmpty(measurement.Display, measurement.Code))
+		if coding.Code == "" {
+			coding.Code = measurement.Code
+		}
+		return CodeableConcept{Coding: []Coding{coding}, Text: mdc.Describe(0, coding.Display)}
+	}
+
+	coding := Coding{System: codingSystems[measurement.CodingSystem], Code: measurement.Code, Display: measurement.Display}
+	if coding.Code == "" {
+		return CodeableConcept{Text: measurement.Display}
+	}
+	return CodeableConcept{Coding: []Coding{coding}, Text: measurement.Display}
+}
+
+// mdcCoding returns the MDC coding of a reference ID; the numeric code is
+// only set if the reference ID is in the code table
+func mdcCoding(referenceID string) Coding {
+	coding := Coding{System: SYSTEM_MDC, Display: referenceID}
+	if code, found := mdc.LookupReferenceID(referenceID); found {
+		coding.Code = fmt.Sprint(code.Code)
+	}
+	return coding
+}
+
+// quantity builds a Quantity, with a UCUM code if the unit is a UCUM code or
+// maps to one. Units the FHIR server would reject as non-UCUM are sent as
+// text only. A value in a unit of convertUnits is converted to its target.
+func (c *Converter) quantity(value float64, unit string) *Quantity {
+	result := &Quantity{Value: value, Unit: unit}
+	if code, found := mdc.LookupReferenceID(unit); found {
+		result.Unit = code.Description
+	}
+	code, known := ucumUnits[unit]
+	if !known && ucum.Validate(unit) == nil {
+		code, known = unit, true
+	}
+	if !known {
+		return result
+	}
+	if target, exists := c.convertUnits[code]; exists {
+		if converted, err := ucum.Convert(value, code, target); err == nil {
+			result.Value, result.Unit, code = converted, target, target
+		}
+	}
+	result.System = SYSTEM_UCUM
+	result.Code = code
+	return result
+}
+
+// category builds an observation-category concept
+func category(code string) CodeableConcept {
+	return CodeableConcept{Coding: []Coding{{System: SYSTEM_CATEGORY, Code: code}}}
+}
+
+// newUUID returns a random "urn:uuid:" URI for bundle entries
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// firstNonEmpty returns the first non-empty value
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,4 @@
+// Package fhir converts HL7 OBX observations and DRI measurements to FHIR
+// R4 Observation, Patient and Device resources and posts them to a FHIR
+// server as transaction Bundles.
+package fhir
@@ -0,0 +1,141 @@
+package fhir
+
+// FHIR R4 resources used by the export. Only the elements filled in by this
+// package are declared; every resource carries its resourceType so that it
+// can be sent on its own or inside a Bundle.
+
+// Resource types
+const (
+	RESOURCE_BUNDLE      = "Bundle"
+	RESOURCE_OBSERVATION = "Observation"
+	RESOURCE_PATIENT     = "Patient"
+	RESOURCE_DEVICE      = "Device"
+)
+
+// Code systems and identifier systems
+const (
+	SYSTEM_MDC            = "urn:iso:std:iso:11073:10101"
+	SYSTEM_LOINC          = "http://loinc.org"
+	SYSTEM_SNOMED         = "http://snomed.info/sct"
+	SYSTEM_UCUM           = "http://unitsofmeasure.org"
+	SYSTEM_CATEGORY       = "http://terminology.hl7.org/CodeSystem/observation-category"
+	SYSTEM_INTERPRETATION = "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation"
+)
+
+// Observation categories
+const (
+	CATEGORY_VITAL_SIGNS = "vital-signs"
+	CATEGORY_LABORATORY  = "laboratory"
+)
+
+// Coding is a code from a code system
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// CodeableConcept is a concept given by codings and/or text
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+// Identifier is a business identifier of a resource
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+
+// Reference refers to another resource, e.g. "urn:uuid:..." inside a Bundle
+type Reference struct {
+	Reference string `json:"reference,omitempty"`
+	Display   string `json:"display,omitempty"`
+}
+
+// Quantity is a measured amount with a UCUM unit where one is known
+type Quantity struct {
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	System string  `json:"system,omitempty"`
+	Code   string  `json:"code,omitempty"`
+}
+
+// ReferenceRange gives the normal range of an observation as text
+type ReferenceRange struct {
+	Text string `json:"text"`
+}
+
+// HumanName is a patient name
+type HumanName struct {
+	Family string   `json:"family,omitempty"`
+	Given  []string `json:"given,omitempty"`
+}
+
+// DeviceName is a name of a device
+type DeviceName struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // "user-friendly-name", "model-name", ...
+}
+
+// Observation is a FHIR R4 Observation
+type Observation struct {
+	ResourceType      string            `json:"resourceType"`
+	Identifier        []Identifier      `json:"identifier,omitempty"`
+	Status            string            `json:"status"`
+	Category          []CodeableConcept `json:"category,omitempty"`
+	Code              CodeableConcept   `json:"code"`
+	Subject           *Reference        `json:"subject,omitempty"`
+	EffectiveDateTime string            `json:"effectiveDateTime,omitempty"`
+	ValueQuantity     *Quantity         `json:"valueQuantity,omitempty"`
+	ValueString       string            `json:"valueString,omitempty"`
+	Interpretation    []CodeableConcept `json:"interpretation,omitempty"`
+	ReferenceRange    []ReferenceRange  `json:"referenceRange,omitempty"`
+	Device            *Reference        `json:"device,omitempty"`
+}
+
+// Patient is a FHIR R4 Patient
+type Patient struct {
+	ResourceType string       `json:"resourceType"`
+	Identifier   []Identifier `json:"identifier,omitempty"`
+	Name         []HumanName  `json:"name,omitempty"`
+	Gender       string       `json:"gender,omitempty"` // male, female, other, unknown
+	BirthDate    string       `json:"birthDate,omitempty"`
+}
+
+// Device is a FHIR R4 Device
+type Device struct {
+	ResourceType string           `json:"resourceType"`
+	Identifier   []Identifier     `json:"identifier,omitempty"`
+	DeviceName   []DeviceName     `json:"deviceName,omitempty"`
+	Type         *CodeableConcept `json:"type,omitempty"`
+}
+
+// Bundle is a FHIR R4 Bundle. Bundles built by this package are transactions;
+// the server answers with a transaction-response Bundle.
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Type         string        `json:"type"` // "transaction", "transaction-response"
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+// BundleEntry is one resource of a Bundle
+type BundleEntry struct {
+	FullURL  string               `json:"fullUrl,omitempty"`
+	Resource interface{}          `json:"resource,omitempty"`
+	Request  *BundleEntryRequest  `json:"request,omitempty"`
+	Response *BundleEntryResponse `json:"response,omitempty"`
+}
+
+// BundleEntryRequest tells the server what to do with an entry of a transaction
+type BundleEntryRequest struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	IfNoneExist string `json:"ifNoneExist,omitempty"`
+}
+
+// BundleEntryResponse is the outcome of one entry of a transaction
+type BundleEntryResponse struct {
+	Status   string `json:"status"` // e.g. "201 Created"
+	Location string `json:"location,omitempty"`
+}
@@ -0,0 +1,214 @@
+package hl7
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Listener networks
+const (
+	NETWORK_DUAL_STACK = "tcp"  // IPv4 and IPv6 when the host is empty or unspecified ("::", "0.0.0.0")
+	NETWORK_IPV4       = "tcp4" // IPv4 only
+	NETWORK_IPV6       = "tcp6" // IPv6 only, also on "::"
+)
+
+// accessRule matches client addresses by IP address, CIDR range or host name
+type accessRule struct {
+	entry   string     // Entry as configured
+	network *net.IPNet // CIDR range, or a single address as /32 or /128
+	host    string     // Host name, resolved to networks when the list is built
+}
+
+// accessList decides which clients may connect. A client matching a deny
+// rule is rejected; otherwise it is accepted if the allow list is empty or
+// contains a matching rule.
+type accessList struct {
+	closed bool // The configuration was invalid; every client is rejected
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	rules  map[*net.IPNet]string // Configured entry of each network, for logging
+}
+
+// parseAccessRule parses an allowed_ips or denied_ips entry: an IPv4 or IPv6
+// address, a CIDR range (10.20.0.0/16, fd00::/8) or a host name
+func parseAccessRule(entry string) (*accessRule, error) {
+	value := strings.TrimSpace(entry)
+	if value == "" {
+		return nil, fmt.Errorf("empty entry")
+	}
+
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid CIDR range", entry)
+		}
+		return &accessRule{entry: entry, network: unmapNetwork(network)}, nil
+	}
+
+	// Accept bracketed and zoned IPv6 addresses ("[fe80::1%eth0]")
+	address := strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	if i := strings.Index(address, "%"); i >= 0 {
+		address = address[:i]
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return &accessRule{entry: entry, network: singleAddress(ip)}, nil
+	}
+
+	if !isHostName(value) {
+		return nil, fmt.Errorf("%q is not an IP address, CIDR range or host name", entry)
+	}
+	return &accessRule{entry: entry, host: strings.ToLower(value)}, nil
+}
+
+// newAccessList builds an access list, resolving host names. Host names that
+// cannot be resolved are skipped and returned as warnings so that a DNS
+// failure does not stop the server; they are resolved again on reload.
+func newAccessList(allowed, denied []string) (*accessList, []string, error) {
+	list := &accessList{rules: make(map[*net.IPNet]string)}
+	var warnings []string
+
+	build := func(entries []string) ([]*net.IPNet, error) {
+		networks := make([]*net.IPNet, 0, len(entries))
+		for _, entry := range entries {
+			rule, err := parseAccessRule(entry)
+			if err != nil {
+				return nil, err
+			}
+			if rule.network != nil {
+				list.rules[rule.network] = rule.entry
+				networks = append(networks, rule.network)
+				continue
+			}
+
+			ips, err := net.LookupIP(rule.host)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("host %s not resolved: %v", rule.host, err))
+				continue
+			}
+			for _, ip := range ips {
+				network := singleAddress(ip)
+				list.rules[network] = rule.entry
+				networks = append(networks, network)
+			}
+		}
+		return networks, nil
+	}
+
+	var err error
+	if list.allow, err = build(allowed); err != nil {
+		return nil, nil, err
+	}
+	if list.deny, err = build(denied); err != nil {
+		return nil, nil, err
+	}
+	return list, warnings, nil
+}
+
+// check returns whether the client address (host:port or a bare IP) may
+// connect, and the reason (empty if no rules are configured)
+func (l *accessList) check(address string) (bool, string) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+
+	if l != nil && l.closed {
+		return false, "invalid access configuration"
+	}
+	if l == nil || (len(l.allow) == 0 && len(l.deny) == 0) {
+		return true, ""
+	}
+	if ip == nil {
+		return false, "unrecognized client address"
+	}
+
+	for _, network := range l.deny {
+		if network.Contains(ip) {
+			return false, "denied by " + l.rules[network]
+		}
+	}
+	if len(l.allow) == 0 {
+		return true, ""
+	}
+	for _, network := range l.allow {
+		if network.Contains(ip) {
+			return true, "allowed by " + l.rules[network]
+		}
+	}
+	return false, "not in allowed_ips"
+}
+
+// unmapNetwork converts an IPv4-mapped IPv6 range (::ffff:10.0.0.0/104) to
+// the IPv4 range it maps. IPv4 clients of a dual-stack listener have IPv4
+// addresses, which an IPv6 range never contains.
+func unmapNetwork(network *net.IPNet) *net.IPNet {
+	ones, bits := network.Mask.Size()
+	if bits != 8*net.IPv6len || ones < 96 {
+		return network
+	}
+	if ip4 := network.IP.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 32)}
+	}
+	return network
+}
+
+// listenAddress joins a listen host and port. IPv6 hosts may be given with
+// or without brackets ("::", "[::]", "fd00::10").
+func listenAddress(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+// validNetwork reports whether network is a listener network (empty: tcp)
+func validNetwork(network string) bool {
+	switch network {
+	case "", NETWORK_DUAL_STACK, NETWORK_IPV4, NETWORK_IPV6:
+		return true
+	}
+	return false
+}
+
+// listenNetwork returns the network to listen on (empty: dual stack)
+func listenNetwork(network string) string {
+	if network == "" {
+		return NETWORK_DUAL_STACK
+	}
+	return network
+}
+
+// singleAddress returns a network containing only ip
+func singleAddress(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// isHostName reports whether value is a syntactically valid DNS host name
+func isHostName(value string) bool {
+	value = strings.TrimSuffix(value, ".")
+	if value == "" || len(value) > 253 {
+		return false
+	}
+	// A numeric top-level label is a mistyped address such as "10.0.1"
+	labels := strings.Split(value, ".")
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
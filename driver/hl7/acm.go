@@ -0,0 +1,231 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// IHE PCD-04 (Report Alert) message identifiers
+const (
+	ACM_PROFILE_ID      = "IHE_PCD_ACM_001"                                         // MSH-21.1
+	ACM_PROFILE         = ACM_PROFILE_ID + "^IHE PCD^1.3.6.1.4.1.19376.1.6.4.4^ISO" // MSH-21
+	ACM_VERSION         = "2.6"                                                     // MSH-12
+	ACM_MESSAGE_TYPE    = "ORU^R40^ORU_R40"                                         // MSH-9
+	ACM_DEFAULT_TIMEOUT = 5                                                         // Seconds to wait for the acknowledgment
+)
+
+// Alert priorities (OBX-8 of the event identification)
+const (
+	ACM_PRIORITY_HIGH   = "PH"
+	ACM_PRIORITY_MEDIUM = "PM"
+	ACM_PRIORITY_LOW    = "PL"
+	ACM_PRIORITY_NONE   = "PN"
+)
+
+// Alert kinds (OBX-8 of the event identification)
+const (
+	ACM_KIND_PHYSIOLOGICAL = "SP"
+	ACM_KIND_TECHNICAL     = "ST"
+)
+
+// Alert phases (MDC_ATTR_EVENT_PHASE)
+const (
+	ACM_PHASE_START      = "start"
+	ACM_PHASE_UPDATE     = "update"
+	ACM_PHASE_ESCALATE   = "escalate"
+	ACM_PHASE_DEESCALATE = "deescalate"
+	ACM_PHASE_END        = "end"
+)
+
+// Alert states (MDC_ATTR_ALARM_STATE)
+const (
+	ACM_STATE_ACTIVE   = "active"
+	ACM_STATE_INACTIVE = "inactive"
+)
+
+// Alert inactivation states (MDC_ATTR_ALARM_INACTIVATION_STATE)
+const (
+	ACM_INACTIVATION_ENABLED      = "enabled"
+	ACM_INACTIVATION_AUDIO_PAUSED = "audio-paused" // Silenced for a limited time
+	ACM_INACTIVATION_AUDIO_OFF    = "audio-off"    // Silenced until unsilenced
+)
+
+// MDC codes of the alert observations
+const (
+	ACM_CODE_ALARM        = "196616^MDC_EVT_ALARM^MDC"                     // Unspecified alarm event
+	ACM_CODE_DEVICE       = "69965^MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS^MDC" // Multi-parameter monitor
+	ACM_CODE_PHASE        = "68481^MDC_ATTR_EVENT_PHASE^MDC"
+	ACM_CODE_STATE        = "68482^MDC_ATTR_ALARM_STATE^MDC"
+	ACM_CODE_INACTIVATION = "68483^MDC_ATTR_ALARM_INACTIVATION_STATE^MDC"
+	ACM_CODE_PRIORITY     = "68484^MDC_ATTR_ALARM_PRIORITY^MDC"
+	ACM_CODE_KIND         = "68485^MDC_ATTR_ALERT_TYPE^MDC"
+)
+
+// ACMConfig configures the alert manager (e.g. a nurse call system) that
+// receives ORU^R40 alert messages
+type ACMConfig struct {
+	Destination          string           `json:"destination"`           // host:port of the alert manager's MLLP listener
+	SendingApplication   string           `json:"sending_application"`   // MSH-3 (default HL7SERVER)
+	SendingFacility      string           `json:"sending_facility"`      // MSH-4 (default HOSPITAL)
+	ReceivingApplication string           `json:"receiving_application"` // MSH-5
+	ReceivingFacility    string           `json:"receiving_facility"`    // MSH-6
+	Timeout              int              `json:"timeout"`               // Seconds to wait for the acknowledgment (0: 5)
+	Transport            transport.Config `json:"transport"`             // TLS and proxy
+}
+
+// ACMAlert is one state of an alert reported to the alert manager. Every
+// message of the same alert carries the same AlertID.
+type ACMAlert struct {
+	AlertID      string    `json:"alert_id"`      // OBR-2/OBR-3, unique per alert
+	EventCode    string    `json:"event_code"`    // OBX-3 of the event identification (default MDC_EVT_ALARM)
+	Text         string    `json:"text"`          // Alarm text (OBX-5)
+	Priority     string    `json:"priority"`      // PH, PM, PL or PN
+	Kind         string    `json:"kind"`          // SP (default) or ST
+	Phase        string    `json:"phase"`         // start, update, escalate, deescalate or end
+	State        string    `json:"state"`         // active (default) or inactive
+	Inactivation string    `json:"inactivation"`  // enabled (default), audio-paused or audio-off
+	Time         time.Time `json:"time"`          // When the alert changed (OBR-7, OBX-14)
+	DeviceID     string    `json:"device_id"`     // Source device (PRT-10, OBX-18)
+	PatientID    string    `json:"patient_id"`    // PID-3
+	FamilyName   string    `json:"family_name"`   // PID-5.1
+	GivenName    string    `json:"given_name"`    // PID-5.2
+	DateOfBirth  string    `json:"date_of_birth"` // PID-7
+	Sex          string    `json:"sex"`           // PID-8
+	PatientClass string    `json:"patient_class"` // PV1-2 (default "U")
+	Location     string    `json:"location"`      // PV1-3 as point of care^room^bed
+}
+
+// acmSequence numbers the alert messages generated within the same second
+var acmSequence uint64
+
+// Validate checks the fields an alert manager requires
+func (a *ACMAlert) Validate() error {
+	problems := make([]string, 0)
+	if a.AlertID == "" {
+		problems = append(problems, "alert_id is required")
+	}
+	if a.Phase == "" {
+		problems = append(problems, "phase is required")
+	}
+	switch a.Priority {
+	case ACM_PRIORITY_HIGH, ACM_PRIORITY_MEDIUM, ACM_PRIORITY_LOW, ACM_PRIORITY_NONE:
+	default:
+		problems = append(problems, fmt.Sprintf("priority must be %s, %s, %s or %s, got %q",
+			ACM_PRIORITY_HIGH, ACM_PRIORITY_MEDIUM, ACM_PRIORITY_LOW, ACM_PRIORITY_NONE, a.Priority))
+	}
+	if a.Time.IsZero() {
+		problems = append(problems, "time is required")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid alert: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// BuildACM generates an IHE PCD-04 ORU^R40 message (HL7 2.6) for an alert
+// and returns it with its message control ID. The patient segments are
+// included when the patient or bed is known. The message is parsed again
+// before it is returned.
+func BuildACM(config ACMConfig, alert ACMAlert, now time.Time) (string, string, error) {
+	if err := alert.Validate(); err != nil {
+		return "", "", err
+	}
+
+	timestamp := now.Format("20060102150405")
+	alertTime := alert.Time.Format("20060102150405")
+	controlID := fmt.Sprintf("ACM%s%04d", timestamp, atomic.AddUint64(&acmSequence, 1)%10000)
+	sendingApp := escapeHL7(firstNonEmpty(config.SendingApplication, ORDER_DEFAULT_SENDING_APP))
+	alertID := escapeHL7(alert.AlertID) + "^" + sendingApp
+	device := escapeHL7(alert.DeviceID)
+
+	segments := []string{
+		strings.Join([]string{"MSH", "^~\\&", sendingApp,
+			escapeHL7(firstNonEmpty(config.SendingFacility, ORDER_DEFAULT_FACILITY)),
+			escapeHL7(config.ReceivingApplication), escapeHL7(config.ReceivingFacility),
+			timestamp, "", ACM_MESSAGE_TYPE, controlID, "P", ACM_VERSION,
+			"", "", "AL", "NE", "", "UNICODE UTF-8", "", "", ACM_PROFILE}, "|"),
+	}
+	if alert.PatientID != "" || alert.Location != "" {
+		location := strings.Split(alert.Location, "^")
+		for i := range location {
+			location[i] = escapeHL7(location[i])
+		}
+		segments = append(segments,
+			strings.TrimRight(strings.Join([]string{"PID", "1", "", escapeHL7(alert.PatientID), "",
+				escapeHL7(alert.FamilyName) + "^" + escapeHL7(alert.GivenName), "",
+				escapeHL7(alert.DateOfBirth), escapeHL7(alert.Sex)}, "|"), "|^"),
+			strings.Join([]string{"PV1", "1", escapeHL7(firstNonEmpty(alert.PatientClass, "U")), strings.Join(location, "^")}, "|"))
+	}
+	segments = append(segments,
+		strings.Join([]string{"OBR", "1", alertID, alertID, ACM_CODE_ALARM, "", "", alertTime}, "|"),
+		strings.Join([]string{"PRT", escapeHL7(alert.AlertID), "UC", "", "SB^Send by^participation",
+			"", "", "", "", "", device}, "|"))
+
+	// Event identification, source identification and the alert attributes
+	observations := []struct{ valueType, code, value, flags string }{
+		{"ST", firstNonEmpty(alert.EventCode, ACM_CODE_ALARM), escapeHL7(alert.Text),
+			alert.Priority + "~" + firstNonEmpty(alert.Kind, ACM_KIND_PHYSIOLOGICAL)},
+		{"ST", ACM_CODE_DEVICE, device, ""},
+		{"ST", ACM_CODE_PHASE, escapeHL7(alert.Phase), ""},
+		{"ST", ACM_CODE_STATE, escapeHL7(firstNonEmpty(alert.State, ACM_STATE_ACTIVE)), ""},
+		{"ST", ACM_CODE_INACTIVATION, escapeHL7(firstNonEmpty(alert.Inactivation, ACM_INACTIVATION_ENABLED)), ""},
+		{"ST", ACM_CODE_PRIORITY, alert.Priority, ""},
+		{"ST", ACM_CODE_KIND, firstNonEmpty(alert.Kind, ACM_KIND_PHYSIOLOGICAL), ""},
+	}
+	for i, observation := range observations {
+		segments = append(segments, strings.Join([]string{"OBX", fmt.Sprint(i + 1), observation.valueType,
+			observation.code, fmt.Sprintf("1.0.0.0.%d", i+1), observation.value, "", "", observation.flags,
+			"", "", "F", "", "", alertTime, "", "", "", device}, "|"))
+	}
+	message := strings.Join(segments, "\r") + "\r"
+
+	parsed, err := NewHL7Parser().ParseMessage(message)
+	if err != nil {
+		return "", "", fmt.Errorf("generated ORU^R40 message is invalid: %v", err)
+	}
+	if msh := parsed.MSH(); msh == nil || msh.MessageProfileID() != ACM_PROFILE_ID {
+		return "", "", fmt.Errorf("generated ORU^R40 message has no %s profile", ACM_PROFILE_ID)
+	}
+	return message, controlID, nil
+}
+
+// ACMSender sends alerts to an alert manager over MLLP
+type ACMSender struct {
+	config ACMConfig
+	client *MLLPClient
+	err    error // Invalid transport settings, returned by Send
+}
+
+// NewACMSender creates a sender for the alert manager of config
+func NewACMSender(config ACMConfig) *ACMSender {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = ACM_DEFAULT_TIMEOUT
+	}
+	sender := &ACMSender{
+		config: config,
+		client: NewMLLPClient(config.Destination, time.Duration(timeout)*time.Second),
+	}
+	sender.err = sender.client.SetTransport(config.Transport)
+	return sender
+}
+
+// Send generates an ORU^R40 message for an alert and sends it. It returns
+// the message control ID once the alert manager has accepted the message.
+func (s *ACMSender) Send(alert ACMAlert) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	message, controlID, err := BuildACM(s.config, alert, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.client.Send(message); err != nil {
+		return controlID, fmt.Errorf("alert %s: %v", alert.AlertID, err)
+	}
+	return controlID, nil
+}
@@ -0,0 +1,629 @@
+package hl7
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/metrics"
+	"github.com/harusin0516/healthcare/driver/precision"
+	"github.com/harusin0516/healthcare/driver/transport"
+	"github.com/harusin0516/healthcare/proto"
+)
+
+// Admin API defaults
+const (
+	ADMIN_DEFAULT_HOST = "127.0.0.1"
+	ADMIN_DEFAULT_PORT = 8081
+)
+
+// AdminConfig configures the HTTP admin API
+type AdminConfig struct {
+	Enabled          bool   `json:"enabled"`
+	Host             string `json:"host"`              // Listen address (default 127.0.0.1)
+	Port             int    `json:"port"`              // Listen port (default 8081)
+	Network          string `json:"network"`           // tcp (default: IPv4 and IPv6 on "::"), tcp4 or tcp6
+	Token            string `json:"token"`             // Bearer token required on every request
+	DecimalSeparator string `json:"decimal_separator"` // Decimal separator of CSV reports: "." (default) or "," (fields separated by ";")
+}
+
+// ClientStatus describes a connected client in admin API responses
+type ClientStatus struct {
+	ID          string    `json:"id"`
+	Address     string    `json:"address"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// AdminServer exposes the status of an HL7Server over HTTP so operators can
+// monitor and manage the listener without restarting it. Every request
+// except /api/sync must carry "Authorization: Bearer <token>".
+//
+//	GET    /api/status          server status
+//	GET    /api/clients         connected clients
+//	DELETE /api/clients/{id}    disconnect a client (id is the URL-escaped remote address)
+//	GET    /api/messages/stats  message counters and recent messages
+//	GET    /api/crash-reports   recovered panics (PHI scrubbed)
+//	GET    /api/infusions       infusion pump channel states (?location=PV1-3)
+//	POST   /api/medications     add a medication event to the timeline
+//	POST   /api/orders          send an ORM^O01 order to the order filler
+//	GET    /api/census          patients by bed from ADT messages (?location=PV1-3)
+//	GET    /api/patients/{id}/timeline                      vitals with medication events (?from=&to=, RFC 3339; &encounter=; &format=csv)
+//	GET    /api/patients/{id}/encounters                    visits of the patient from ADT messages
+//	GET    /api/patients/{id}/medications/{mid}/effect      before/after comparison (?reference_id=&window=seconds)
+//	POST   /api/sync            messages buffered at a remote site (signed by the site instead of the token)
+//	GET    /api/sync/sites      sync backlog and lag of the remote sites
+//	GET    /metrics             Prometheus metrics of both drivers
+type AdminServer struct {
+	server     *HL7Server
+	config     AdminConfig
+	mux        *http.ServeMux
+	httpServer *http.Server
+	logger     *log.Logger
+}
+
+// NewAdminServer creates an admin API for server
+func NewAdminServer(server *HL7Server, config AdminConfig) *AdminServer {
+	if config.Host == "" {
+		config.Host = ADMIN_DEFAULT_HOST
+	}
+	if config.Port == 0 {
+		config.Port = ADMIN_DEFAULT_PORT
+	}
+
+	a := &AdminServer{
+		server: server,
+		config: config,
+		mux:    http.NewServeMux(),
+		logger: log.New(os.Stdout, "[HL7-ADMIN] ", log.LstdFlags),
+	}
+	a.mux.HandleFunc("/api/status", a.handleStatus)
+	a.mux.HandleFunc("/api/clients", a.handleClients)
+	a.mux.HandleFunc("/api/clients/", a.handleClient)
+	a.mux.HandleFunc("/api/messages/stats", a.handleMessageStats)
+	a.mux.HandleFunc("/api/crash-reports", a.handleCrashReports)
+	a.mux.HandleFunc("/api/infusions", a.handleInfusions)
+	a.mux.HandleFunc("/api/medications", a.handleMedications)
+	a.mux.HandleFunc("/api/orders", a.handleOrders)
+	a.mux.HandleFunc("/api/census", a.handleCensus)
+	a.mux.HandleFunc("/api/sync/sites", a.handleSyncSites)
+	a.mux.HandleFunc("/api/observer/outputs", a.handleObserverOutputs)
+	a.mux.HandleFunc("/api/router", a.handleRouter)
+	a.mux.HandleFunc("/api/certificates", a.handleCertificates)
+	a.mux.HandleFunc("/api/proto", a.handleProto)
+	a.mux.HandleFunc("/api/proto/", a.handleProtoFile)
+	a.mux.HandleFunc("/api/patients/", a.handlePatient)
+	a.mux.Handle("/metrics", metrics.Handler())
+	return a
+}
+
+// SetLogger replaces the admin API logger
+func (a *AdminServer) SetLogger(logger *log.Logger) {
+	a.logger = logger
+}
+
+// Handle mounts an additional handler behind the admin API authentication,
+// e.g. a DRI diagnostics recorder. It must be called before Start.
+func (a *AdminServer) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// Start serves the admin API and blocks until ctx is canceled or Stop is called
+func (a *AdminServer) Start(ctx context.Context) error {
+	if a.config.Token == "" {
+		return fmt.Errorf("admin API token is not configured")
+	}
+
+	address := listenAddress(a.config.Host, a.config.Port)
+	var listenConfig net.ListenConfig
+	listener, err := listenConfig.Listen(ctx, listenNetwork(a.config.Network), address)
+	if err != nil {
+		return fmt.Errorf("failed to start admin API on %s: %v", address, err)
+	}
+
+	a.httpServer = &http.Server{
+		Handler:           a,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	a.logger.Printf("Admin API started on %s", address)
+
+	// Stop the admin API when the context is canceled
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.Stop()
+		case <-stopped:
+		}
+	}()
+
+	if err := a.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("admin API stopped: %v", err)
+	}
+	return nil
+}
+
+// Stop shuts down the admin API, waiting briefly for requests in progress
+func (a *AdminServer) Stop() error {
+	if a.httpServer == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return a.httpServer.Shutdown(ctx)
+}
+
+// ServeHTTP authenticates the request and dispatches it
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Remote sites sign their sync requests instead of using the token
+	if r.URL.Path == SYNC_PATH {
+		a.handleSync(w, r)
+		return
+	}
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="hl7-admin"`)
+		writeAdminError(w, http.StatusUnauthorized, "invalid or missing token")
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// authorized checks the bearer token in constant time
+func (a *AdminServer) authorized(r *http.Request) bool {
+	if a.config.Token == "" {
+		return false
+	}
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) == 1
+}
+
+// handleStatus returns the server status
+func (a *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, a.server.Status())
+}
+
+// handleClients lists the connected clients
+func (a *AdminServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	clients := a.server.Clients()
+	statuses := make([]ClientStatus, 0, len(clients))
+	for _, client := range clients {
+		statuses = append(statuses, ClientStatus{
+			ID:          client.ID,
+			Address:     client.Address,
+			ConnectedAt: client.ConnectedAt,
+			LastSeen:    client.LastSeen,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	writeAdminJSON(w, http.StatusOK, statuses)
+}
+
+// handleClient disconnects a client
+func (a *AdminServer) handleClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	clientID, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/clients/"))
+	if err != nil || clientID == "" {
+		writeAdminError(w, http.StatusBadRequest, "invalid client id")
+		return
+	}
+	if err := a.server.DisconnectClient(clientID); err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	a.logger.Printf("Client %s disconnected via admin API from %s", clientID, r.RemoteAddr)
+	writeAdminJSON(w, http.StatusOK, map[string]string{"disconnected": clientID})
+}
+
+// handleMessageStats returns the message counters
+func (a *AdminServer) handleMessageStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, a.server.Stats())
+}
+
+// handleCrashReports returns the recovered panics
+func (a *AdminServer) handleCrashReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, a.server.CrashReports())
+}
+
+// handleInfusions returns the latest infusion pump channel states
+func (a *AdminServer) handleInfusions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, a.server.Infusions().Channels(r.URL.Query().Get("location")))
+}
+
+// handleMedications adds a medication event posted as JSON
+func (a *AdminServer) handleMedications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	timeline := a.server.Timeline()
+	if timeline == nil {
+		writeAdminError(w, http.StatusNotFound, "timeline is not enabled")
+		return
+	}
+
+	var event MedicationEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&event); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid medication event: %v", err))
+		return
+	}
+	event.Source = MEDICATION_SOURCE_API
+	if err := timeline.AddMedication(&event); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, &event)
+}
+
+// handleCensus lists the patients of the patient registry
+func (a *AdminServer) handleCensus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	registry := a.server.Patients()
+	if registry == nil {
+		writeAdminError(w, http.StatusNotFound, "patient registry is not enabled")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, registry.Patients(r.URL.Query().Get("location")))
+}
+
+// handleSync receives the buffered messages of a remote site (see RemoteSyncer)
+func (a *AdminServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, SYNC_MAX_BODY))
+	if err != nil {
+		writeAdminError(w, http.StatusRequestEntityTooLarge, "request too large")
+		return
+	}
+	siteID, err := a.server.verifySync(r.Header, body)
+	if err != nil {
+		a.logger.Printf("Rejected sync request from %s: %v", r.RemoteAddr, err)
+		writeAdminError(w, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	var request SyncRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	if request.SiteID != siteID {
+		writeAdminError(w, http.StatusBadRequest, "site_id does not match the signing site")
+		return
+	}
+
+	response, err := a.server.ReceiveSync(siteID, &request)
+	if err != nil {
+		// The site keeps the records that were not accepted and retries
+		a.logger.Printf("Sync of site %s stopped: %v", siteID, err)
+		writeAdminJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+// handleSyncSites returns the sync state of the remote sites
+func (a *AdminServer) handleSyncSites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, a.server.SyncSites())
+}
+
+// handleObserverOutputs returns the most recent outputs recorded in observer mode
+func (a *AdminServer) handleObserverOutputs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	observer := a.server.Observer()
+	if observer == nil {
+		writeAdminError(w, http.StatusNotFound, "observer mode is not enabled")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, observer.Recent())
+}
+
+// handleRouter returns the delivery state of the router destinations
+func (a *AdminServer) handleRouter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	router := a.server.Router()
+	if router == nil {
+		writeAdminError(w, http.StatusNotFound, "router is not enabled")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, router.Status())
+}
+
+// handleCertificates returns the TLS certificates in use with their expiry
+func (a *AdminServer) handleCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, transport.Certificates())
+}
+
+// handleProto lists the services and files of the published Protobuf
+// definitions, as gRPC server reflection would
+func (a *AdminServer) handleProto(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	schema, err := proto.Load()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"services": schema.Services(),
+		"files":    schema.Files,
+	})
+}
+
+// handleProtoFile serves the source of a .proto file, e.g.
+// /api/proto/healthcare/hl7/v1/hl7.proto
+func (a *AdminServer) handleProtoFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/proto/")
+	source, err := proto.Files.ReadFile(name)
+	if err != nil || !strings.HasSuffix(name, ".proto") {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("proto file %s not found", name))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(source)
+}
+
+// handleOrders sends an order posted as JSON and returns its message control ID
+func (a *AdminServer) handleOrders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if a.server.settings().Orders.Destination == "" {
+		writeAdminError(w, http.StatusNotFound, "orders are not configured")
+		return
+	}
+
+	var order OrderRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&order); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid order: %v", err))
+		return
+	}
+	if err := order.Validate(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	controlID, err := a.server.SendOrder(order)
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, map[string]string{"control_id": controlID, "placer_order_number": order.PlacerOrderNumber})
+}
+
+// handlePatient serves /api/patients/{id}/timeline,
+// /api/patients/{id}/medications/{mid}/effect and /api/patients/{id}/encounters
+func (a *AdminServer) handlePatient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/patients/"), "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil || unescaped == "" {
+			writeAdminError(w, http.StatusBadRequest, "invalid path")
+			return
+		}
+		parts[i] = unescaped
+	}
+
+	if len(parts) == 2 && parts[1] == "encounters" {
+		encounters := a.server.Encounters()
+		if encounters == nil {
+			writeAdminError(w, http.StatusNotFound, "encounters are not enabled")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, encounters.Encounters(parts[0]))
+		return
+	}
+
+	timeline := a.server.Timeline()
+	if timeline == nil {
+		writeAdminError(w, http.StatusNotFound, "timeline is not enabled")
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "timeline":
+		a.handleTimeline(w, r, timeline, parts[0])
+	case len(parts) == 4 && parts[1] == "medications" && parts[3] == "effect":
+		a.handleDrugEffect(w, r, timeline, parts[0], parts[2])
+	default:
+		writeAdminError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleTimeline returns the timeline of a patient as JSON or CSV
+func (a *AdminServer) handleTimeline(w http.ResponseWriter, r *http.Request, timeline *Timeline, patientID string) {
+	query := r.URL.Query()
+	var from, to time.Time
+	for name, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if query.Get(name) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, query.Get(name))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: must be RFC 3339", name))
+			return
+		}
+		*value = t
+	}
+
+	// Limit the timeline to an encounter, by default the latest one so that
+	// the data of an earlier visit is not shown after a readmission
+	if encounters := a.server.Encounters(); encounters != nil && (query.Get("encounter") != "" || from.IsZero() && to.IsZero()) {
+		visit := query.Get("encounter")
+		if visit == ENCOUNTER_CURRENT {
+			visit = ""
+		}
+		encounter := encounters.Encounter(patientID, visit)
+		if encounter == nil && visit != "" {
+			writeAdminError(w, http.StatusNotFound, "encounter not found")
+			return
+		}
+		if encounter != nil {
+			if from.IsZero() || from.Before(encounter.Start) {
+				from = encounter.Start
+			}
+			if encounter.End != nil && (to.IsZero() || to.After(*encounter.End)) {
+				to = *encounter.End
+			}
+		}
+	}
+
+	result := timeline.Range(patientID, from, to)
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "timeline-"+patientID+".csv"))
+		writeTimelineCSV(w, result, precision.Formatter{DecimalSeparator: a.config.DecimalSeparator})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// handleDrugEffect compares an observation before and after a medication event
+func (a *AdminServer) handleDrugEffect(w http.ResponseWriter, r *http.Request, timeline *Timeline, patientID, medicationID string) {
+	query := r.URL.Query()
+	referenceID := query.Get("reference_id")
+	if referenceID == "" {
+		writeAdminError(w, http.StatusBadRequest, "reference_id is required")
+		return
+	}
+	var window time.Duration
+	if value := query.Get("window"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			writeAdminError(w, http.StatusBadRequest, "invalid window: must be a positive number of seconds")
+			return
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+
+	effect, err := timeline.Effect(patientID, medicationID, referenceID, window)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, effect)
+}
+
+// writeTimelineCSV writes the observations and medication events of a
+// timeline as one time-ordered table. Medication rows carry the drug name in
+// the reference_id column and the dose in the value column. Values are
+// formatted with the formatter's decimal separator and field delimiter.
+func writeTimelineCSV(w io.Writer, timeline *TimelineJSON, formatter precision.Formatter) {
+	writer := csv.NewWriter(w)
+	writer.Comma = formatter.CSVDelimiter()
+	writer.Write([]string{"time", "kind", "reference_id", "value", "unit", "medication_id", "route"})
+
+	medications := timeline.Medications
+	for _, point := range timeline.Observations {
+		for len(medications) > 0 && !medications[0].Time.After(point.Time) {
+			writeMedicationRow(writer, medications[0], formatter)
+			medications = medications[1:]
+		}
+		writer.Write([]string{point.Time.Format(time.RFC3339Nano), "observation", point.ReferenceID,
+			formatter.Format(point.Value), point.Unit, "", ""})
+	}
+	for _, event := range medications {
+		writeMedicationRow(writer, event, formatter)
+	}
+	writer.Flush()
+}
+
+// writeMedicationRow writes a medication event as a timeline CSV row
+func writeMedicationRow(writer *csv.Writer, event *MedicationEvent, formatter precision.Formatter) {
+	dose := ""
+	if event.Dose != nil {
+		dose = formatter.Format(*event.Dose)
+	}
+	writer.Write([]string{event.Time.Format(time.RFC3339Nano), "medication", firstNonEmpty(event.Name, event.Code),
+		dose, event.DoseUnit, event.ID, event.Route})
+}
+
+// writeAdminJSON writes a JSON response
+func writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// writeAdminError writes a JSON error response
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,40 @@
+package hl7
+
+import (
+	"context"
+)
+
+// APIVersion is the version (major.minor) of the public API of the driver
+// packages. Within a major version the interfaces below (Parser, Server,
+// Storage, publish.Publisher, stream.Publisher) and every exported name keep
+// their signatures, so code written against an earlier minor version still
+// builds. A name that is replaced stays as a wrapper marked "Deprecated:"
+// (see deprecated.go) until the next major version removes it.
+const APIVersion = "1.0"
+
+// Parser parses HL7 messages and batches; *HL7Parser implements it
+type Parser interface {
+	ParseMessage(rawMessage string) (*HL7Message, error)
+	ParseBatch(rawBatch string) (*HL7Batch, error)
+}
+
+// Server is a running HL7 receiver; *HL7Server and *HL7Driver implement it
+type Server interface {
+	Start(ctx context.Context) error
+	Stop() error
+	Status() map[string]interface{}
+	Clients() []*Client
+	DisconnectClient(clientID string) error
+	Stats() MessageStats
+	QueryMessages(filter MessageFilter) ([]*StoredMessage, error)
+}
+
+// The received messages go to sinks: the archive (Storage) and the event
+// bus (publish.Publisher). Observations are streamed to a stream.Publisher.
+var (
+	_ Parser  = (*HL7Parser)(nil)
+	_ Server  = (*HL7Server)(nil)
+	_ Server  = (*HL7Driver)(nil)
+	_ Storage = (*FileStorage)(nil)
+	_ Storage = (*SQLiteStorage)(nil)
+)
@@ -0,0 +1,357 @@
+package hl7
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// batchSequence numbers the generated batch control IDs
+var batchSequence uint64
+
+// HL7Batch is a batch of messages (BHS ... BTS) or a file of batches
+// (FHS ... FTS), as lab systems send the results of a run
+type HL7Batch struct {
+	Header   *HL7Segment   `json:"header,omitempty"`   // FHS or BHS; nil for messages of a file outside a BHS
+	Trailer  *HL7Segment   `json:"trailer,omitempty"`  // FTS or BTS
+	Batches  []*HL7Batch   `json:"batches,omitempty"`  // Batches of a file
+	Messages []*HL7Message `json:"messages,omitempty"` // Messages of a batch
+	Raw      string        `json:"raw_batch,omitempty"`
+}
+
+// IsFile reports whether the batch is a file (FHS ... FTS)
+func (b *HL7Batch) IsFile() bool {
+	return b.Header != nil && b.Header.Type == HL7_SEG_FHS
+}
+
+// ControlID returns the batch or file control ID (BHS-11/FHS-11)
+func (b *HL7Batch) ControlID() string {
+	if b.Header == nil {
+		return ""
+	}
+	return b.Header.FieldValue(11)
+}
+
+// AllMessages returns the messages of a batch, or of every batch of a file,
+// in the order they were sent
+func (b *HL7Batch) AllMessages() []*HL7Message {
+	if !b.IsFile() {
+		return b.Messages
+	}
+	var messages []*HL7Message
+	for _, batch := range b.Batches {
+		messages = append(messages, batch.Messages...)
+	}
+	return messages
+}
+
+// IsBatch reports whether raw is a batch or file rather than a single
+// message, i.e. starts with a BHS or FHS segment
+func IsBatch(raw string) bool {
+	raw = strings.TrimLeft(NewHL7Parser().removeMLLPWrapper(raw), " \t\r\n")
+	return strings.HasPrefix(raw, HL7_SEG_FHS) || strings.HasPrefix(raw, HL7_SEG_BHS)
+}
+
+// ParseBatch parses a batch (BHS, messages, BTS) or a file (FHS, batches,
+// FTS). Segments may be separated by CR or line breaks, as in files written
+// by lab systems. Messages of a file outside a BHS form a batch without a
+// header. The message and batch counts of the trailers (BTS-1, FTS-1) are
+// checked, so that a truncated batch is not taken for a complete one.
+func (p *HL7Parser) ParseBatch(rawBatch string) (*HL7Batch, error) {
+	lines := strings.FieldsFunc(p.removeMLLPWrapper(rawBatch), func(r rune) bool {
+		return r == '\r' || r == '\n'
+	})
+
+	var file, batch *HL7Batch
+	var message []string
+	// flush parses the message being collected into the current batch
+	flush := func() error {
+		if len(message) == 0 {
+			return nil
+		}
+		parsed, err := p.ParseMessage(strings.Join(message, "\r") + "\r")
+		message = nil
+		if err != nil {
+			return fmt.Errorf("message %d: %v", len(batch.Messages)+1, err)
+		}
+		batch.Messages = append(batch.Messages, parsed)
+		return nil
+	}
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if file != nil && file.Trailer != nil {
+			return nil, fmt.Errorf("segment after FTS")
+		}
+		segmentType := line
+		if len(segmentType) > 3 {
+			segmentType = segmentType[:3]
+		}
+
+		switch segmentType {
+		case HL7_SEG_FHS:
+			if file != nil || batch != nil {
+				return nil, fmt.Errorf("FHS must be the first segment")
+			}
+			header, err := p.withMessageEncoding(line).parseSegment(line)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse FHS: %v", err)
+			}
+			file = &HL7Batch{Header: header}
+
+		case HL7_SEG_BHS:
+			if err := closeBatch(batch, flush, false); err != nil {
+				return nil, err
+			}
+			if batch != nil && file == nil {
+				return nil, fmt.Errorf("BHS after the end of the batch; batches must be sent in a file (FHS)")
+			}
+			header, err := p.withMessageEncoding(line).parseSegment(line)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse BHS: %v", err)
+			}
+			batch = &HL7Batch{Header: header}
+			if file != nil {
+				file.Batches = append(file.Batches, batch)
+			}
+
+		case HL7_SEG_MSH:
+			if batch == nil || batch.Trailer != nil {
+				if file == nil {
+					return nil, fmt.Errorf("MSH outside a batch")
+				}
+				batch = &HL7Batch{}
+				file.Batches = append(file.Batches, batch)
+			}
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			message = []string{line}
+
+		case HL7_SEG_BTS:
+			if batch == nil || batch.Header == nil || batch.Trailer != nil {
+				return nil, fmt.Errorf("BTS without a BHS")
+			}
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			trailer, err := p.parseSegment(line)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse BTS: %v", err)
+			}
+			batch.Trailer = trailer
+			if err := checkCount("BTS-1", "messages", trailer.FieldValue(1), len(batch.Messages)); err != nil {
+				return nil, err
+			}
+
+		case HL7_SEG_FTS:
+			if file == nil {
+				return nil, fmt.Errorf("FTS without an FHS")
+			}
+			if err := closeBatch(batch, flush, true); err != nil {
+				return nil, err
+			}
+			trailer, err := p.parseSegment(line)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse FTS: %v", err)
+			}
+			file.Trailer = trailer
+			if err := checkCount("FTS-1", "batches", trailer.FieldValue(1), len(file.Batches)); err != nil {
+				return nil, err
+			}
+
+		default:
+			if len(message) == 0 {
+				return nil, fmt.Errorf("%s segment outside a message", segmentType)
+			}
+			message = append(message, line)
+		}
+	}
+
+	if file != nil {
+		if file.Trailer == nil {
+			return nil, fmt.Errorf("file has no FTS trailer")
+		}
+		file.Raw = rawBatch
+		return file, nil
+	}
+	if batch == nil {
+		return nil, fmt.Errorf("no FHS or BHS segment")
+	}
+	if batch.Trailer == nil {
+		return nil, fmt.Errorf("batch has no BTS trailer")
+	}
+	batch.Raw = rawBatch
+	return batch, nil
+}
+
+// closeBatch ends the current batch before the next BHS or the FTS. Only
+// batches without a header, which have no BTS, may end there without one.
+func closeBatch(batch *HL7Batch, flush func() error, end bool) error {
+	if batch == nil {
+		return nil
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if batch.Header != nil && batch.Trailer == nil {
+		if end {
+			return fmt.Errorf("batch before FTS has no BTS trailer")
+		}
+		return fmt.Errorf("BHS before the BTS of the previous batch")
+	}
+	return nil
+}
+
+// checkCount checks a count declared in a trailer field; an empty field is
+// not checked
+func checkCount(field, what, declared string, actual int) error {
+	if declared == "" {
+		return nil
+	}
+	count, err := strconv.Atoi(declared)
+	if err != nil {
+		return fmt.Errorf("%s: invalid count %q", field, declared)
+	}
+	if count != actual {
+		return fmt.Errorf("%s declares %d %s, received %d", field, count, what, actual)
+	}
+	return nil
+}
+
+// BatchHeader holds the fields of a generated BHS (and FHS)
+type BatchHeader struct {
+	SendingApplication   string // BHS-3
+	SendingFacility      string // BHS-4
+	ReceivingApplication string // BHS-5
+	ReceivingFacility    string // BHS-6
+	Name                 string // BHS-9
+	Comment              string // BHS-10
+	ReferenceControlID   string // BHS-12, control ID of the batch this one answers
+	File                 bool   // Wrap the batch in FHS/FTS
+}
+
+// BuildBatch generates a batch of messages, in a file if header.File is set,
+// and returns it with its batch control ID (BHS-11; the file uses the same
+// ID). The messages must already be complete HL7 messages; trailing CRs are
+// normalized.
+func BuildBatch(header BatchHeader, messages []string, now time.Time) (string, string, error) {
+	timestamp := now.Format("20060102150405")
+	controlID := fmt.Sprintf("BAT%s%04d", timestamp, atomic.AddUint64(&batchSequence, 1)%10000)
+
+	// headerSegment builds an FHS or BHS
+	headerSegment := func(segmentType string) string {
+		return strings.Join([]string{segmentType, "^~\\&",
+			escapeHL7(header.SendingApplication), escapeHL7(header.SendingFacility),
+			escapeHL7(header.ReceivingApplication), escapeHL7(header.ReceivingFacility),
+			timestamp, "", escapeHL7(header.Name), escapeHL7(header.Comment),
+			controlID, escapeHL7(header.ReferenceControlID)}, "|")
+	}
+
+	segments := []string{}
+	if header.File {
+		segments = append(segments, headerSegment(HL7_SEG_FHS))
+	}
+	segments = append(segments, headerSegment(HL7_SEG_BHS))
+	for i, message := range messages {
+		message = strings.Trim(message, "\r\n")
+		if !strings.HasPrefix(message, HL7_SEG_MSH) {
+			return "", "", fmt.Errorf("message %d does not start with MSH", i+1)
+		}
+		segments = append(segments, message)
+	}
+	segments = append(segments, fmt.Sprintf("%s|%d", HL7_SEG_BTS, len(messages)))
+	if header.File {
+		segments = append(segments, HL7_SEG_FTS+"|1")
+	}
+	batch := strings.Join(segments, "\r") + "\r"
+
+	if _, err := NewHL7Parser().ParseBatch(batch); err != nil {
+		return "", "", fmt.Errorf("generated batch is invalid: %v", err)
+	}
+	return batch, controlID, nil
+}
+
+// createBatchAcknowledgment creates the acknowledgment of a batch or file:
+// a batch (in a file if one was received) addressed back to the sender whose
+// BHS-12 refers to the received control ID, with the acknowledgments of the
+// messages in the order they were received
+func (s *HL7Server) createBatchAcknowledgment(batch *HL7Batch, acks []string) (string, error) {
+	header := BatchHeader{
+		SendingApplication: "HL7SERVER",
+		SendingFacility:    "HOSPITAL",
+		ReferenceControlID: batch.ControlID(),
+		File:               batch.IsFile(),
+	}
+	if received := batch.Header; received != nil {
+		header.ReceivingApplication = received.FieldValue(3)
+		header.ReceivingFacility = received.FieldValue(4)
+	}
+	ack, _, err := BuildBatch(header, acks, s.clock.Now())
+	return ack, err
+}
+
+// receiveBatch parses a batch or file from a client, ingests each of its
+// messages and sends one batch acknowledgment. It returns false if the
+// server is stopping.
+func (s *HL7Server) receiveBatch(conn net.Conn, clientID string, raw string, receivedAt time.Time) bool {
+	batch, err := s.parser.ParseBatch(raw)
+	if err != nil {
+		metricParseErrors.Inc()
+		s.recordParseError(clientID, err)
+		s.reportError("parse", clientID, fmt.Errorf("batch: %v", err))
+		return true
+	}
+	kind := "batch"
+	if batch.IsFile() {
+		kind = "file"
+	}
+	metricBatchesReceived.Inc(kind)
+
+	messages := batch.AllMessages()
+	acks := make([]string, 0, len(messages))
+	codes := make([]string, 0, len(messages))
+	send := true
+	for _, message := range messages {
+		message.Time = receivedAt
+		code, text, ok := s.ingest(message, clientID)
+		if !ok {
+			return false
+		}
+		// Observer mode acknowledges per its policy, or not at all
+		if s.observer != nil {
+			code, text, send = s.observedAck(code, text)
+		}
+		acks = append(acks, s.createAcknowledgmentCode(message, code, text))
+		codes = append(codes, code)
+	}
+	s.logf(LOG_LEVEL_INFO, "Received HL7 %s %s from %s: %d messages", kind, batch.ControlID(), clientID, len(messages))
+	if !send {
+		return true
+	}
+
+	ack, err := s.createBatchAcknowledgment(batch, acks)
+	if err != nil {
+		s.reportError("ack", clientID, err)
+		return true
+	}
+	if err := s.sendAcknowledgment(conn, ack); err != nil {
+		s.reportError("ack", clientID, err)
+	} else {
+		for i, message := range messages {
+			messageType := ""
+			if msh := message.MSH(); msh != nil {
+				messageType = msh.MessageType()
+			}
+			metricAcks.Inc(messageType, codes[i])
+		}
+		metricAckLatency.Observe(s.clock.Since(receivedAt).Seconds())
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package hl7
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Blood pressure cross-check defaults
+const (
+	BP_CHECK_THRESHOLD = 15.0 // mmHg difference of the mean pressures
+	BP_CHECK_WINDOW    = 120  // Seconds between readings that are still compared
+)
+
+// BP_ALERT_MISMATCH is the type of the alert raised when NIBP and the arterial line disagree
+const BP_ALERT_MISMATCH = "NIBP_ARTERIAL_MISMATCH"
+
+// HL7_ALERT_TOPIC is the event bus topic of derived alerts
+const HL7_ALERT_TOPIC = "hl7.alert"
+
+// Reference IDs of the compared observations (systolic, diastolic, mean)
+var (
+	nibpReferenceIDs = [][3]string{
+		{"MDC_PRESS_BLD_NONINV_SYS", "MDC_PRESS_BLD_NONINV_DIA", "MDC_PRESS_BLD_NONINV_MEAN"},
+		{"MDC_PRESS_CUFF_SYS", "MDC_PRESS_CUFF_DIA", "MDC_PRESS_CUFF_MEAN"},
+	}
+	arterialReferenceIDs = [][3]string{
+		{"MDC_PRESS_BLD_ART_SYS", "MDC_PRESS_BLD_ART_DIA", "MDC_PRESS_BLD_ART_MEAN"},
+		{"MDC_PRESS_BLD_ART_ABP_SYS", "MDC_PRESS_BLD_ART_ABP_DIA", "MDC_PRESS_BLD_ART_ABP_MEAN"},
+	}
+)
+
+// BPCheckConfig configures the NIBP to arterial line cross-check
+type BPCheckConfig struct {
+	Enabled   bool    `json:"enabled"`
+	Threshold float64 `json:"threshold"` // Largest accepted difference of the mean pressures in mmHg (0: 15)
+	Window    int     `json:"window"`    // Seconds between an NIBP and an arterial reading that are compared (0: 120)
+}
+
+// BPReading is a blood pressure measurement in mmHg
+type BPReading struct {
+	Systolic    float64   `json:"systolic,omitempty"`
+	Diastolic   float64   `json:"diastolic,omitempty"`
+	Mean        float64   `json:"mean"`
+	MeanDerived bool      `json:"mean_derived,omitempty"` // Mean calculated as diastolic + (systolic - diastolic) / 3
+	Time        time.Time `json:"time"`
+}
+
+// BPAlert is raised when an NIBP reading and a concurrent arterial line
+// reading diverge, which often indicates a wrongly levelled transducer or a
+// damped or kinked line
+type BPAlert struct {
+	Type       string    `json:"type"`
+	PatientID  string    `json:"patient_id"`
+	Time       time.Time `json:"time"` // Time of the NIBP reading
+	NIBP       BPReading `json:"nibp"`
+	Arterial   BPReading `json:"arterial"`
+	Difference float64   `json:"difference"` // Arterial mean minus NIBP mean
+	Threshold  float64   `json:"threshold"`
+	Message    string    `json:"message"`
+}
+
+// bpState holds the latest readings of one patient
+type bpState struct {
+	arterial *BPReading
+	pending  *BPReading // NIBP reading waiting for a concurrent arterial reading
+	lastNIBP *BPReading // Last NIBP reading seen, to skip repeated readings
+}
+
+// BPChecker compares NIBP readings with concurrent arterial line readings of
+// the same patient. Monitors repeat the latest NIBP reading in their periodic
+// results; each reading is compared once. It is safe for concurrent use.
+type BPChecker struct {
+	threshold float64
+	window    time.Duration
+	mutex     sync.Mutex
+	patients  map[string]*bpState
+}
+
+// NewBPChecker creates a cross-checker
+func NewBPChecker(config BPCheckConfig) *BPChecker {
+	threshold := config.Threshold
+	if threshold <= 0 {
+		threshold = BP_CHECK_THRESHOLD
+	}
+	window := config.Window
+	if window <= 0 {
+		window = BP_CHECK_WINDOW
+	}
+	return &BPChecker{
+		threshold: threshold,
+		window:    time.Duration(window) * time.Second,
+		patients:  make(map[string]*bpState),
+	}
+}
+
+// Check records the blood pressure readings of an observation set and
+// returns an alert if a new NIBP reading diverges from the arterial reading
+// closest to it, or nil
+func (c *BPChecker) Check(set *ObservationSet) *BPAlert {
+	nibp, nibpEquipment := findBPReading(set, nibpReferenceIDs)
+	arterial, arterialEquipment := findBPReading(set, arterialReferenceIDs)
+	if nibp == nil && arterial == nil {
+		return nil
+	}
+
+	// Readings of unidentified patients are kept per device
+	key := set.PatientID
+	if key == "" {
+		key = nibpEquipment + arterialEquipment
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state, exists := c.patients[key]
+	if !exists {
+		state = &bpState{}
+		c.patients[key] = state
+	}
+
+	if arterial != nil {
+		state.arterial = arterial
+	}
+	if nibp != nil && !c.isRepeat(state.lastNIBP, nibp) {
+		state.lastNIBP = nibp
+		state.pending = nibp
+	}
+	if state.pending == nil || state.arterial == nil {
+		return nil
+	}
+
+	pending := state.pending
+	if state.arterial.Time.Sub(pending.Time) > c.window {
+		// No arterial reading close enough to the NIBP reading
+		state.pending = nil
+		return nil
+	}
+	if pending.Time.Sub(state.arterial.Time) > c.window {
+		// Wait for a newer arterial reading
+		return nil
+	}
+	state.pending = nil
+
+	difference := state.arterial.Mean - pending.Mean
+	if math.Abs(difference) <= c.threshold {
+		return nil
+	}
+
+	return &BPAlert{
+		Type:       BP_ALERT_MISMATCH,
+		PatientID:  set.PatientID,
+		Time:       pending.Time,
+		NIBP:       *pending,
+		Arterial:   *state.arterial,
+		Difference: difference,
+		Threshold:  c.threshold,
+		Message: fmt.Sprintf("arterial mean %.0f mmHg differs from NIBP mean %.0f mmHg by %+.0f mmHg (threshold %.0f); check transducer height and line",
+			state.arterial.Mean, pending.Mean, difference, c.threshold),
+	}
+}
+
+// Forget discards the readings of a patient, e.g. after discharge
+func (c *BPChecker) Forget(patientID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.patients, patientID)
+}
+
+// isRepeat reports whether reading repeats the last NIBP reading. A reading
+// with the same time, or with the same values within the window, is a repeat.
+func (c *BPChecker) isRepeat(last, reading *BPReading) bool {
+	if last == nil {
+		return false
+	}
+	if last.Time.Equal(reading.Time) {
+		return true
+	}
+	sameValues := last.Systolic == reading.Systolic && last.Diastolic == reading.Diastolic && last.Mean == reading.Mean
+	return sameValues && reading.Time.Sub(last.Time) <= c.window
+}
+
+// findBPReading returns the first blood pressure reading of set coded with one
+// of the reference ID triples, and the equipment that measured it. The mean is
+// derived from systolic and diastolic pressure if it is not sent.
+func findBPReading(set *ObservationSet, referenceIDs [][3]string) (*BPReading, string) {
+	for _, ids := range referenceIDs {
+		systolic := set.FindByReferenceID(ids[0])
+		diastolic := set.FindByReferenceID(ids[1])
+		mean := set.FindByReferenceID(ids[2])
+
+		reading := &BPReading{}
+		var source *Observation
+		if systolic != nil && systolic.NumericValue != nil {
+			reading.Systolic = *systolic.NumericValue
+			source = systolic
+		}
+		if diastolic != nil && diastolic.NumericValue != nil {
+			reading.Diastolic = *diastolic.NumericValue
+			if source == nil {
+				source = diastolic
+			}
+		}
+
+		switch {
+		case mean != nil && mean.NumericValue != nil:
+			reading.Mean = *mean.NumericValue
+			source = mean
+		case reading.Systolic > 0 && reading.Diastolic > 0:
+			reading.Mean = reading.Diastolic + (reading.Systolic-reading.Diastolic)/3
+			reading.MeanDerived = true
+		default:
+			continue
+		}
+
+		reading.Time = source.Timestamp
+		return reading, source.EquipmentID
+	}
+	return nil, ""
+}
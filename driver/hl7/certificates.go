@@ -0,0 +1,64 @@
+package hl7
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// Certificate monitoring
+const (
+	CERTIFICATE_CHECK_INTERVAL = time.Minute // How often certificate files are checked for changes and expiry
+	CERTIFICATE_WARNING_DAYS   = 30          // Default days before expiry when a certificate is reported
+)
+
+// watchCertificates reloads renewed certificates and reports those close to
+// expiry until the server stops. Each certificate is reported at most once
+// a day.
+func (s *HL7Server) watchCertificates() {
+	ticker := s.clock.NewTicker(CERTIFICATE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	reported := make(map[string]time.Time)
+	for {
+		if err := transport.ReloadChangedCertificates(); err != nil {
+			s.reportError("certificate", "", err)
+		}
+		s.checkCertificateExpiry(reported)
+
+		select {
+		case <-ticker.C():
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// checkCertificateExpiry reports the certificates that expire within the
+// warning days, skipping those reported in the last day
+func (s *HL7Server) checkCertificateExpiry(reported map[string]time.Time) {
+	days := s.settings().CertificateWarningDays
+	if days <= 0 {
+		days = CERTIFICATE_WARNING_DAYS
+	}
+	now := s.clock.Now()
+	for _, certificate := range transport.Certificates() {
+		if certificate.NotAfter.IsZero() || certificate.NotAfter.Sub(now) > time.Duration(days)*24*time.Hour {
+			delete(reported, certificate.File)
+			continue
+		}
+		if last, ok := reported[certificate.File]; ok && now.Sub(last) < 24*time.Hour {
+			continue
+		}
+		reported[certificate.File] = now
+
+		if certificate.NotAfter.Before(now) {
+			s.reportError("certificate", "", fmt.Errorf("certificate %s (%s) expired on %s",
+				certificate.File, certificate.Subject, certificate.NotAfter.Format(time.RFC3339)))
+		} else {
+			s.reportError("certificate", "", fmt.Errorf("certificate %s (%s) expires in %d days on %s",
+				certificate.File, certificate.Subject, int(certificate.NotAfter.Sub(now).Hours()/24), certificate.NotAfter.Format(time.RFC3339)))
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Character sets (MSH-18, HL7 table 0211). Messages in another character set
+// are decoded to UTF-8 by the parser.
+const (
+	CHARSET_ASCII     = "ASCII"
+	CHARSET_LATIN1    = "8859/1"
+	CHARSET_UTF8      = "UNICODE UTF-8"
+	CHARSET_SHIFT_JIS = "SHIFT_JIS" // Not in table 0211, but sent by many Japanese systems
+	CHARSET_ISO_IR87  = "ISO IR87"  // JIS X 0208 switched with ISO 2022 escape sequences (ISO-2022-JP)
+)
+
+// charsetAliases maps the MSH-18 values seen in practice to the character sets
+var charsetAliases = map[string]string{
+	"ASCII":         CHARSET_ASCII,
+	"US-ASCII":      CHARSET_ASCII,
+	"ISO IR6":       CHARSET_ASCII,
+	"8859/1":        CHARSET_LATIN1,
+	"ISO-8859-1":    CHARSET_LATIN1,
+	"ISO8859-1":     CHARSET_LATIN1,
+	"ISO IR100":     CHARSET_LATIN1,
+	"LATIN1":        CHARSET_LATIN1,
+	"UNICODE UTF-8": CHARSET_UTF8,
+	"UTF-8":         CHARSET_UTF8,
+	"UTF8":          CHARSET_UTF8,
+	"SHIFT_JIS":     CHARSET_SHIFT_JIS,
+	"SHIFT-JIS":     CHARSET_SHIFT_JIS,
+	"SHIFT JIS":     CHARSET_SHIFT_JIS,
+	"SJIS":          CHARSET_SHIFT_JIS,
+	"MS932":         CHARSET_SHIFT_JIS,
+	"CP932":         CHARSET_SHIFT_JIS,
+	"WINDOWS-31J":   CHARSET_SHIFT_JIS,
+	"ISO IR87":      CHARSET_ISO_IR87,
+	"ISO 2022-1994": CHARSET_ISO_IR87,
+	"ISO-2022-JP":   CHARSET_ISO_IR87,
+}
+
+// Shift_JIS layout
+const (
+	SJIS_LEADS  = 60  // Lead bytes 0x81-0x9F and 0xE0-0xFC
+	SJIS_TRAILS = 189 // Trail bytes 0x40-0xFC (0x7F is not used)
+)
+
+// ISO 2022 escape sequences of ISO-2022-JP
+const (
+	iso2022ASCII    = "\x1b(B"
+	iso2022Roman    = "\x1b(J" // JIS X 0201 Roman, decoded as ASCII
+	iso2022Katakana = "\x1b(I" // JIS X 0201 katakana (ISO IR13)
+	iso2022JIS1978  = "\x1b$@"
+	iso2022JIS      = "\x1b$B" // JIS X 0208 (ISO IR87)
+	iso2022JIS1990  = "\x1b&@" // Announces a JIS X 0208-1990 ESC $ B
+	iso2022JIS0212  = "\x1b$(D"
+)
+
+// jisStandardChars are the JIS X 0208 codes that Windows maps to other
+// characters than the JIS standard. ISO IR87 is decoded to the JIS
+// characters; both are encoded.
+var jisStandardChars = map[uint16]rune{
+	0x2141: '〜', // WAVE DASH (Windows: FULLWIDTH TILDE)
+	0x2142: '‖', // DOUBLE VERTICAL LINE (Windows: PARALLEL TO)
+	0x215D: '−', // MINUS SIGN (Windows: FULLWIDTH HYPHEN-MINUS)
+	0x2171: '¢', // CENT SIGN (Windows: FULLWIDTH CENT SIGN)
+	0x2172: '£', // POUND SIGN (Windows: FULLWIDTH POUND SIGN)
+	0x224C: '¬', // NOT SIGN (Windows: FULLWIDTH NOT SIGN)
+}
+
+// Reverse tables of sjisTable, built on first use
+var (
+	sjisEncodeOnce   sync.Once
+	sjisEncode       map[rune]uint16 // Preferred code of a character, as Windows encodes it
+	sjisNECSelected  map[rune]uint16 // Codes of the NEC-selected IBM extensions (lead 0xED, 0xEE)
+	jisStandardCodes map[rune]uint16
+)
+
+// NormalizeCharset returns the character set of an MSH-18 value, empty if
+// it is not supported. An empty value is ASCII.
+func NormalizeCharset(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "" {
+		return CHARSET_ASCII
+	}
+	return charsetAliases[name]
+}
+
+// charsetOf returns the character set of a whole MSH-18 field. The first
+// repetition is the default character set; ISO IR87 in a later repetition
+// (e.g. "~ISO IR87" as used by SS-MIX2) switches to JIS X 0208 with escape
+// sequences, which is decoded as ISO-2022-JP.
+func charsetOf(field, repetitionSeparator string) string {
+	repetitions := []string{field}
+	if repetitionSeparator != "" {
+		repetitions = strings.Split(field, repetitionSeparator)
+	}
+	for _, repetition := range repetitions[1:] {
+		if NormalizeCharset(repetition) == CHARSET_ISO_IR87 {
+			return CHARSET_ISO_IR87
+		}
+	}
+	return NormalizeCharset(repetitions[0])
+}
+
+// DecodeCharset converts text in charset (an MSH-18 value) to UTF-8. Bytes
+// that are not valid in the character set become U+FFFD.
+func DecodeCharset(data string, charset string) (string, error) {
+	switch NormalizeCharset(charset) {
+	case CHARSET_ASCII, CHARSET_UTF8:
+		return strings.ToValidUTF8(strings.TrimPrefix(data, "\ufeff"), string(utf8.RuneError)), nil
+	case CHARSET_LATIN1:
+		runes := make([]rune, len(data))
+		for i := 0; i < len(data); i++ {
+			runes[i] = rune(data[i])
+		}
+		return string(runes), nil
+	case CHARSET_SHIFT_JIS:
+		return decodeShiftJIS(data), nil
+	case CHARSET_ISO_IR87:
+		return decodeISO2022JP(data), nil
+	}
+	return "", fmt.Errorf("unsupported character set %q", charset)
+}
+
+// EncodeCharset converts UTF-8 text to charset (an MSH-18 value). It fails
+// on the first character the character set cannot represent.
+func EncodeCharset(text string, charset string) (string, error) {
+	normalized := NormalizeCharset(charset)
+	var builder strings.Builder
+	var err error
+	switch normalized {
+	case CHARSET_UTF8:
+		return text, nil
+	case CHARSET_ASCII:
+		for _, r := range text {
+			if r >= utf8.RuneSelf {
+				return "", fmt.Errorf("character %q cannot be encoded in %s", r, normalized)
+			}
+		}
+		return text, nil
+	case CHARSET_LATIN1:
+		for _, r := range text {
+			if r > 0xFF {
+				return "", fmt.Errorf("character %q cannot be encoded in %s", r, normalized)
+			}
+			builder.WriteByte(byte(r))
+		}
+	case CHARSET_SHIFT_JIS:
+		err = encodeShiftJIS(&builder, text)
+	case CHARSET_ISO_IR87:
+		err = encodeISO2022JP(&builder, text)
+	default:
+		return "", fmt.Errorf("unsupported character set %q", charset)
+	}
+	if err != nil {
+		return "", err
+	}
+	return builder.String(), nil
+}
+
+// EncodeMessage converts a message built in UTF-8 to the character set its
+// MSH-18 declares, for sending. Messages without MSH-18 are returned as they
+// are.
+func EncodeMessage(message string) (string, error) {
+	field, repetitionSeparator, ok := mshCharsetField(message, false)
+	if !ok || strings.TrimSpace(field) == "" {
+		return message, nil
+	}
+	charset := charsetOf(field, repetitionSeparator)
+	if charset == "" {
+		return "", fmt.Errorf("unsupported character set %q", field)
+	}
+	return EncodeCharset(message, charset)
+}
+
+// decodeMessageCharset decodes a message in the character set declared by
+// MSH-18 to UTF-8 and sets MSH-18 to UNICODE UTF-8, so that the decoded
+// message is not decoded again when it is parsed from storage or
+// forwarded. It returns the MSH-18 value the message was received with,
+// empty if it was not decoded (ASCII, UTF-8, unsupported character sets).
+func decodeMessageCharset(message string) (string, string) {
+	field, repetitionSeparator, ok := mshCharsetField(message, false)
+	charset := ""
+	if ok {
+		charset = charsetOf(field, repetitionSeparator)
+	}
+	if charset == CHARSET_ASCII || charset == "" {
+		// Shift_JIS trail bytes can be field separators, which moves MSH-18
+		// when the header holds Japanese names; try again skipping them
+		if sjisField, sjisSeparator, found := mshCharsetField(message, true); found && charsetOf(sjisField, sjisSeparator) == CHARSET_SHIFT_JIS {
+			field, charset = sjisField, CHARSET_SHIFT_JIS
+		} else {
+			return message, ""
+		}
+	}
+	if charset == CHARSET_UTF8 {
+		return message, ""
+	}
+
+	decoded, err := DecodeCharset(message, charset)
+	if err != nil {
+		return message, ""
+	}
+	return setMSHCharset(decoded, CHARSET_UTF8), field
+}
+
+// mshCharsetField returns MSH-18 of the first segment of a message and the
+// repetition separator. Bytes between ISO 2022 escapes to and from JIS X
+// 0208 are never separators; with sjis, neither are Shift_JIS trail bytes.
+func mshCharsetField(message string, sjis bool) (string, string, bool) {
+	message = strings.TrimLeft(message, " \t\r\n")
+	if len(message) < 4 || message[:3] != HL7_SEG_MSH {
+		return "", "", false
+	}
+	separator := message[3]
+	repetitionSeparator := ""
+	if len(message) > 5 && message[5] != separator {
+		repetitionSeparator = message[5:6]
+	}
+
+	// MSH-1 is the separator itself, so the separators before MSH-18 are
+	// the 17th after the segment ID
+	count, start, doubleByte := 0, -1, false
+	for i := 3; i < len(message); i++ {
+		c := message[i]
+		switch {
+		case c == '\r' || c == '\n':
+			if start >= 0 {
+				return message[start:i], repetitionSeparator, true
+			}
+			return "", repetitionSeparator, false
+		case c == 0x1b:
+			if strings.HasPrefix(message[i:], iso2022JIS) || strings.HasPrefix(message[i:], iso2022JIS1978) {
+				doubleByte = true
+			} else if strings.HasPrefix(message[i:], iso2022ASCII) || strings.HasPrefix(message[i:], iso2022Roman) {
+				doubleByte = false
+			}
+		case doubleByte:
+		case sjis && isSJISLead(c) && i+1 < len(message) && isSJISTrail(message[i+1]):
+			i++
+		case c == separator:
+			count++
+			if count == 17 {
+				start = i + 1
+			} else if count == 18 {
+				return message[start:i], repetitionSeparator, true
+			}
+		}
+	}
+	if start >= 0 {
+		return message[start:], repetitionSeparator, true
+	}
+	return "", repetitionSeparator, false
+}
+
+// setMSHCharset replaces MSH-18 of a UTF-8 message. MSH-20 (alternate
+// character set handling, e.g. ISO 2022-1994) no longer applies and is
+// cleared.
+func setMSHCharset(message, charset string) string {
+	_, _, fields := splitMSH(message)
+	message = setMSHField(message, 18, charset)
+	if len(fields) >= 20 {
+		message = setMSHField(message, 20, "")
+	}
+	return message
+}
+
+// setMSHField replaces a field of the MSH segment starting a UTF-8 message,
+// by HL7 position (2 or higher), adding empty fields up to it
+func setMSHField(message string, position int, value string) string {
+	start, separator, fields := splitMSH(message)
+	if fields == nil || position < 2 {
+		return message
+	}
+	for len(fields) < position {
+		fields = append(fields, "")
+	}
+	fields[position-1] = value
+	end := strings.IndexAny(message, "\r\n")
+	if end < 0 {
+		end = len(message)
+	}
+	return message[:start] + strings.Join(fields, separator) + message[end:]
+}
+
+// splitMSH splits the MSH segment starting a message into its fields, the
+// segment ID first. It returns where the segment starts, and nil fields if
+// the message does not start with MSH.
+func splitMSH(message string) (int, string, []string) {
+	end := strings.IndexAny(message, "\r\n")
+	if end < 0 {
+		end = len(message)
+	}
+	header := message[:end]
+	if len(header) < 4 || !strings.HasPrefix(strings.TrimLeft(header, " \t"), HL7_SEG_MSH) {
+		return 0, "", nil
+	}
+	start := strings.Index(header, HL7_SEG_MSH)
+	if len(header) < start+4 {
+		return 0, "", nil
+	}
+	separator := header[start+3 : start+4]
+	return start, separator, strings.Split(header[start:], separator)
+}
+
+// isSJISLead reports whether b starts a double-byte Shift_JIS character
+func isSJISLead(b byte) bool {
+	return (b >= 0x81 && b <= 0x9F) || (b >= 0xE0 && b <= 0xFC)
+}
+
+// isSJISTrail reports whether b can end a double-byte Shift_JIS character
+func isSJISTrail(b byte) bool {
+	return b >= 0x40 && b <= 0xFC && b != 0x7F
+}
+
+// sjisIndex returns the position of a double-byte character in sjisTable
+func sjisIndex(lead, trail byte) int {
+	row := int(lead) - 0x81
+	if lead >= 0xE0 {
+		row = int(lead) - 0xC1
+	}
+	return row*SJIS_TRAILS + int(trail) - 0x40
+}
+
+// sjisToJIS converts a Shift_JIS code to its JIS X 0208 row and cell
+// (0x21-0x7E each for lead bytes up to 0xEF)
+func sjisToJIS(lead, trail byte) (byte, byte) {
+	if lead >= 0xE0 {
+		lead -= 0x40
+	}
+	row := (lead-0x81)*2 + 0x21
+	if trail >= 0x9F {
+		return row + 1, trail - 0x7E
+	}
+	if trail > 0x7F {
+		trail--
+	}
+	return row, trail - 0x1F
+}
+
+// jisToSJIS converts a JIS X 0208 row and cell to its Shift_JIS code
+func jisToSJIS(row, cell byte) (byte, byte) {
+	lead := (row+1)/2 + 0x70
+	if row > 0x5E {
+		lead += 0x40
+	}
+	if row%2 == 0 {
+		return lead, cell + 0x7E
+	}
+	if cell >= 0x60 {
+		return lead, cell + 0x20
+	}
+	return lead, cell + 0x1F
+}
+
+// buildSJISEncode builds the reverse tables of sjisTable. The first code of
+// a character wins, except that the NEC-selected IBM extensions are only
+// used where JIS X 0208 is required, like Windows does.
+func buildSJISEncode() {
+	sjisEncode = make(map[rune]uint16, SJIS_LEADS*SJIS_TRAILS)
+	sjisNECSelected = make(map[rune]uint16)
+	for i, value := range sjisTable {
+		if value == 0 {
+			continue
+		}
+		row := i / SJIS_TRAILS
+		lead := byte(row + 0x81)
+		if row >= 0x1F {
+			lead = byte(row + 0xC1)
+		}
+		code := uint16(lead)<<8 | uint16(i%SJIS_TRAILS+0x40)
+		target := sjisEncode
+		if lead == 0xED || lead == 0xEE {
+			target = sjisNECSelected
+		}
+		if _, exists := target[rune(value)]; !exists {
+			target[rune(value)] = code
+		}
+	}
+	jisStandardCodes = make(map[rune]uint16, len(jisStandardChars))
+	for code, r := range jisStandardChars {
+		jisStandardCodes[r] = code
+	}
+}
+
+// decodeShiftJIS converts Shift_JIS (Windows-31J) to UTF-8
+func decodeShiftJIS(data string) string {
+	var builder strings.Builder
+	builder.Grow(len(data) * 3 / 2)
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b < utf8.RuneSelf:
+			builder.WriteByte(b)
+		case b >= 0xA1 && b <= 0xDF:
+			builder.WriteRune(rune(0xFF61 + int(b) - 0xA1))
+		case isSJISLead(b) && i+1 < len(data) && isSJISTrail(data[i+1]):
+			if value := sjisTable[sjisIndex(b, data[i+1])]; value != 0 {
+				builder.WriteRune(rune(value))
+			} else {
+				builder.WriteRune(utf8.RuneError)
+			}
+			i++
+		default:
+			// A lead byte before an ASCII byte loses only itself
+			builder.WriteRune(utf8.RuneError)
+		}
+	}
+	return builder.String()
+}
+
+// encodeShiftJIS writes UTF-8 text as Shift_JIS (Windows-31J)
+func encodeShiftJIS(builder *strings.Builder, text string) error {
+	sjisEncodeOnce.Do(buildSJISEncode)
+	for _, r := range text {
+		switch {
+		case r < utf8.RuneSelf:
+			builder.WriteByte(byte(r))
+			continue
+		case r >= 0xFF61 && r <= 0xFF9F:
+			builder.WriteByte(byte(r - 0xFF61 + 0xA1))
+			continue
+		case r == '¥': // YEN SIGN
+			builder.WriteByte(0x5C)
+			continue
+		case r == '‾': // OVERLINE
+			builder.WriteByte(0x7E)
+			continue
+		}
+		code, exists := sjisEncode[r]
+		if !exists {
+			code, exists = sjisNECSelected[r]
+		}
+		if !exists {
+			jis, standard := jisStandardCodes[r]
+			if !standard {
+				return fmt.Errorf("character %q cannot be encoded in %s", r, CHARSET_SHIFT_JIS)
+			}
+			lead, trail := jisToSJIS(byte(jis>>8), byte(jis))
+			code = uint16(lead)<<8 | uint16(trail)
+		}
+		builder.WriteByte(byte(code >> 8))
+		builder.WriteByte(byte(code))
+	}
+	return nil
+}
+
+// decodeISO2022JP converts ISO-2022-JP (ASCII with JIS X 0208 and JIS X
+// 0201 katakana selected by escape sequences) to UTF-8. A segment or line
+// end returns to ASCII.
+func decodeISO2022JP(data string) string {
+	const (
+		modeASCII = iota
+		modeJIS
+		modeKatakana
+		modeJIS0212
+	)
+	var builder strings.Builder
+	builder.Grow(len(data))
+	mode, shifted := modeASCII, false
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if b == 0x1b {
+			rest := data[i:]
+			switch {
+			case strings.HasPrefix(rest, iso2022ASCII), strings.HasPrefix(rest, iso2022Roman):
+				mode, i = modeASCII, i+2
+				continue
+			case strings.HasPrefix(rest, iso2022JIS), strings.HasPrefix(rest, iso2022JIS1978):
+				mode, i = modeJIS, i+2
+				continue
+			case strings.HasPrefix(rest, iso2022Katakana):
+				mode, i = modeKatakana, i+2
+				continue
+			case strings.HasPrefix(rest, iso2022JIS1990):
+				i += 2
+				continue
+			case strings.HasPrefix(rest, iso2022JIS0212):
+				mode, i = modeJIS0212, i+3
+				continue
+			}
+		}
+		switch {
+		case b == '\r' || b == '\n':
+			mode, shifted = modeASCII, false
+			builder.WriteByte(b)
+		case b == 0x0e: // SO: JIS X 0201 katakana until SI
+			shifted = true
+		case b == 0x0f:
+			shifted = false
+		case b >= utf8.RuneSelf:
+			builder.WriteRune(utf8.RuneError)
+		case (shifted || mode == modeKatakana) && b >= 0x21 && b <= 0x5F:
+			builder.WriteRune(rune(0xFF61 + int(b) - 0x21))
+		case (mode == modeJIS || mode == modeJIS0212) && b >= 0x21 && b <= 0x7E:
+			if i+1 >= len(data) || data[i+1] < 0x21 || data[i+1] > 0x7E {
+				builder.WriteRune(utf8.RuneError)
+				continue
+			}
+			row, cell := b, data[i+1]
+			i++
+			if mode == modeJIS0212 {
+				builder.WriteRune(utf8.RuneError)
+			} else if r, standard := jisStandardChars[uint16(row)<<8|uint16(cell)]; standard {
+				builder.WriteRune(r)
+			} else if lead, trail := jisToSJIS(row, cell); sjisTable[sjisIndex(lead, trail)] != 0 {
+				builder.WriteRune(rune(sjisTable[sjisIndex(lead, trail)]))
+			} else {
+				builder.WriteRune(utf8.RuneError)
+			}
+		default:
+			builder.WriteByte(b)
+		}
+	}
+	return builder.String()
+}
+
+// encodeISO2022JP writes UTF-8 text as ISO-2022-JP with JIS X 0208, the
+// NEC special characters (row 13) and the NEC-selected IBM extensions.
+// Half-width katakana, which JIS X 0208 lacks, are written full-width.
+// Every segment ends in ASCII.
+func encodeISO2022JP(builder *strings.Builder, text string) error {
+	sjisEncodeOnce.Do(buildSJISEncode)
+	text = widenKatakana(text)
+	doubleByte := false
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			if doubleByte {
+				builder.WriteString(iso2022ASCII)
+				doubleByte = false
+			}
+			builder.WriteByte(byte(r))
+			continue
+		}
+
+		jis, standard := jisStandardCodes[r]
+		if !standard {
+			code, exists := sjisEncode[r]
+			if !exists || code>>8 >= 0xF0 {
+				code, exists = sjisNECSelected[r]
+			}
+			if !exists {
+				return fmt.Errorf("character %q cannot be encoded in %s", r, CHARSET_ISO_IR87)
+			}
+			row, cell := sjisToJIS(byte(code>>8), byte(code))
+			jis = uint16(row)<<8 | uint16(cell)
+		}
+		if !doubleByte {
+			builder.WriteString(iso2022JIS)
+			doubleByte = true
+		}
+		builder.WriteByte(byte(jis >> 8))
+		builder.WriteByte(byte(jis))
+	}
+	if doubleByte {
+		builder.WriteString(iso2022ASCII)
+	}
+	return nil
+}
+
+// fullWidthKatakana are the full-width forms of the half-width katakana
+// U+FF61 to U+FF9F
+var fullWidthKatakana = []rune("。「」、・ヲァィゥェォャュョッーアイウエオカキクケコサシスセソタチツテトナニヌネノハヒフヘホマミムメモヤユヨラリルレロワン゛゜")
+
+// widenKatakana replaces half-width katakana by full-width katakana,
+// combining a following (semi-)voiced sound mark where possible
+func widenKatakana(text string) string {
+	if strings.IndexFunc(text, isHalfWidthKatakana) < 0 {
+		return text
+	}
+	runes := []rune(text)
+	var builder strings.Builder
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if !isHalfWidthKatakana(r) {
+			builder.WriteRune(r)
+			continue
+		}
+		wide := fullWidthKatakana[r-0xFF61]
+		if i+1 < len(runes) {
+			switch mark := runes[i+1]; {
+			case mark == 0xFF9E && wide == 'ウ':
+				wide, i = 'ヴ', i+1
+			case mark == 0xFF9E && (wide >= 'カ' && wide <= 'ト' && wide != 'ッ' || wide >= 'ハ' && wide <= 'ホ'):
+				wide, i = wide+1, i+1
+			case mark == 0xFF9F && wide >= 'ハ' && wide <= 'ホ':
+				wide, i = wide+2, i+1
+			}
+		}
+		builder.WriteRune(wide)
+	}
+	return builder.String()
+}
+
+// isHalfWidthKatakana reports whether r is a half-width katakana or mark
+func isHalfWidthKatakana(r rune) bool {
+	return r >= 0xFF61 && r <= 0xFF9F
+}
@@ -0,0 +1,712 @@
+package hl7
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/harusin0516/healthcare/driver/memwatch"
+	"github.com/harusin0516/healthcare/driver/precision"
+	"github.com/harusin0516/healthcare/driver/publish"
+	"github.com/harusin0516/healthcare/driver/transport"
+	"github.com/harusin0516/healthcare/driver/ucum"
+)
+
+// Log levels
+const (
+	LOG_LEVEL_DEBUG = "debug"
+	LOG_LEVEL_INFO  = "info"
+	LOG_LEVEL_WARN  = "warn"
+	LOG_LEVEL_ERROR = "error"
+)
+
+// Environment variables that override the configuration file
+const (
+	ENV_PORT            = "HL7_PORT"            // Listen port
+	ENV_ALLOWED_IPS     = "HL7_ALLOWED_IPS"     // Comma separated allowed client addresses (empty: allow all)
+	ENV_DENIED_IPS      = "HL7_DENIED_IPS"      // Comma separated denied client addresses
+	ENV_DEIDENTIFY_SALT = "HL7_DEIDENTIFY_SALT" // Secret key of de-identified pseudonyms
+)
+
+// logLevelRanks orders the log levels; messages below the configured level are dropped
+var logLevelRanks = map[string]int{
+	LOG_LEVEL_DEBUG: 0,
+	LOG_LEVEL_INFO:  1,
+	LOG_LEVEL_WARN:  2,
+	LOG_LEVEL_ERROR: 3,
+}
+
+// ConfigError lists every problem found in a configuration
+type ConfigError struct {
+	Source   string // Configuration file, empty for configurations built in code
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	source := "configuration"
+	if e.Source != "" {
+		source = e.Source
+	}
+	return fmt.Sprintf("invalid %s:\n  - %s", source, strings.Join(e.Problems, "\n  - "))
+}
+
+// LoadConfig loads server configuration from file, applies environment
+// variable overrides (HL7_PORT, HL7_ALLOWED_IPS, HL7_DENIED_IPS) and validates the result
+func LoadConfig(filename string) (*ServerConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	return ParseConfig(data, filename)
+}
+
+// ParseConfig parses the contents of a configuration file like LoadConfig.
+// source names the configuration in validation errors.
+func ParseConfig(data []byte, source string) (*ServerConfig, error) {
+	var config struct {
+		Server  ServerConfig `json:"server"`
+		Logging struct {
+			Level string `json:"level"`
+		} `json:"logging"`
+		Security struct {
+			EnableTLS  bool     `json:"enable_tls"`
+			CertFile   string   `json:"cert_file"`
+			KeyFile    string   `json:"key_file"`
+			AllowedIPs []string `json:"allowed_ips"`
+			DeniedIPs  []string `json:"denied_ips"`
+		} `json:"security"`
+	}
+
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to decode config file: %v", err)
+	}
+
+	// The logging and security sections are accepted for compatibility
+	server := &config.Server
+	if server.LogLevel == "" {
+		server.LogLevel = config.Logging.Level
+	}
+	if len(server.AllowedIPs) == 0 {
+		server.AllowedIPs = config.Security.AllowedIPs
+	}
+	if len(server.DeniedIPs) == 0 {
+		server.DeniedIPs = config.Security.DeniedIPs
+	}
+	if !server.TLS.Enabled && config.Security.EnableTLS {
+		server.TLS.Enabled = true
+		server.TLS.CertFile = config.Security.CertFile
+		server.TLS.KeyFile = config.Security.KeyFile
+	}
+
+	if err := server.applyEnvOverrides(); err != nil {
+		return nil, err
+	}
+
+	if err := server.Validate(); err != nil {
+		if configErr, ok := err.(*ConfigError); ok {
+			configErr.Source = source
+		}
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// applyEnvOverrides replaces settings given in environment variables
+func (c *ServerConfig) applyEnvOverrides() error {
+	if value, exists := os.LookupEnv(ENV_PORT); exists {
+		port, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be a port number", ENV_PORT, value)
+		}
+		c.Port = port
+	}
+
+	if value, exists := os.LookupEnv(ENV_ALLOWED_IPS); exists {
+		c.AllowedIPs = splitList(value)
+	}
+	if value, exists := os.LookupEnv(ENV_DENIED_IPS); exists {
+		c.DeniedIPs = splitList(value)
+	}
+	if value, exists := os.LookupEnv(ENV_DEIDENTIFY_SALT); exists {
+		c.Deidentify.Salt = value
+	}
+
+	return nil
+}
+
+// Validate checks the configuration and returns a *ConfigError listing every
+// missing or invalid field
+func (c *ServerConfig) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case c.Port == 0:
+		addProblem("server.port is required (or set %s)", ENV_PORT)
+	case c.Port < 1 || c.Port > 65535:
+		addProblem("server.port must be between 1 and 65535, got %d", c.Port)
+	}
+	if !validNetwork(c.Network) {
+		addProblem("server.network must be tcp, tcp4 or tcp6, got %q", c.Network)
+	}
+
+	if c.Timeout <= 0 {
+		addProblem("server.timeout must be a positive number of seconds (idle time before a client is disconnected), got %d", c.Timeout)
+	}
+
+	if c.MaxConnections < 0 {
+		addProblem("server.max_connections must not be negative (0 means unlimited), got %d", c.MaxConnections)
+	}
+
+	if c.IdleTimeout < 0 {
+		addProblem("server.idle_timeout must not be negative (0 disables the idle check), got %d", c.IdleTimeout)
+	}
+
+	if c.ReadTimeout < 0 {
+		addProblem("server.read_timeout must not be negative (0 leaves a started message to timeout), got %d", c.ReadTimeout)
+	}
+
+	if c.MaxMessageSize < 0 {
+		addProblem("server.max_message_size must not be negative (0 means %d bytes), got %d", MLLP_DEFAULT_MAX_MESSAGE_SIZE, c.MaxMessageSize)
+	}
+
+	if c.MaxFramingErrors < 0 {
+		addProblem("server.max_framing_errors must not be negative (0 never closes a client for framing errors), got %d", c.MaxFramingErrors)
+	}
+
+	for i, entry := range c.AllowedIPs {
+		if _, err := parseAccessRule(entry); err != nil {
+			addProblem("server.allowed_ips[%d]: %v", i, err)
+		}
+	}
+	for i, entry := range c.DeniedIPs {
+		if _, err := parseAccessRule(entry); err != nil {
+			addProblem("server.denied_ips[%d]: %v", i, err)
+		}
+	}
+
+	if _, known := logLevelRanks[strings.ToLower(c.LogLevel)]; c.LogLevel != "" && !known {
+		addProblem("logging.level must be one of debug, info, warn, error, got %q", c.LogLevel)
+	}
+
+	switch c.Storage.Type {
+	case "":
+	case STORAGE_FILESYSTEM, STORAGE_SQLITE:
+		if c.Storage.Path == "" {
+			addProblem("server.storage.path is required for storage type %q", c.Storage.Type)
+		}
+	default:
+		addProblem("server.storage.type must be %q, %q or empty, got %q", STORAGE_FILESYSTEM, STORAGE_SQLITE, c.Storage.Type)
+	}
+	if c.Storage.SSMIX2.Enabled {
+		if c.Storage.SSMIX2.Root == "" {
+			addProblem("server.storage.ssmix2.root is required when the SS-MIX2 export is enabled")
+		}
+		if c.Storage.SSMIX2.Charset != "" && charsetOf(c.Storage.SSMIX2.Charset, "~") == "" {
+			addProblem("server.storage.ssmix2.charset is not a supported character set, got %q", c.Storage.SSMIX2.Charset)
+		}
+	}
+
+	switch c.Publisher.Type {
+	case "":
+	case publish.PUBLISHER_NATS, publish.PUBLISHER_KAFKA:
+		if c.Publisher.URL == "" {
+			addProblem("server.publisher.url is required for publisher type %q", c.Publisher.Type)
+		}
+	default:
+		addProblem("server.publisher.type must be %q, %q or empty, got %q", publish.PUBLISHER_NATS, publish.PUBLISHER_KAFKA, c.Publisher.Type)
+	}
+
+	if c.BPCheck.Threshold < 0 {
+		addProblem("server.bp_check.threshold must not be negative, got %g", c.BPCheck.Threshold)
+	}
+	if c.BPCheck.Window < 0 {
+		addProblem("server.bp_check.window must not be negative, got %d", c.BPCheck.Window)
+	}
+
+	if c.Timeline.Retention < 0 {
+		addProblem("server.timeline.retention must not be negative, got %d", c.Timeline.Retention)
+	}
+	switch strings.ToLower(c.Timeline.RespRateSource) {
+	case "", TIMELINE_SOURCE_VENTILATOR, TIMELINE_SOURCE_MONITOR, TIMELINE_SOURCE_BOTH:
+	default:
+		addProblem("server.timeline.resp_rate_source must be %q, %q or %q, got %q", TIMELINE_SOURCE_VENTILATOR, TIMELINE_SOURCE_MONITOR, TIMELINE_SOURCE_BOTH, c.Timeline.RespRateSource)
+	}
+	if c.Timeline.ConflictWindow < 0 {
+		addProblem("server.timeline.conflict_window must not be negative, got %d", c.Timeline.ConflictWindow)
+	}
+
+	if c.Processing.Workers < 0 {
+		addProblem("server.processing.workers must not be negative, got %d", c.Processing.Workers)
+	}
+	if c.Processing.QueueSize < 0 {
+		addProblem("server.processing.queue_size must not be negative, got %d", c.Processing.QueueSize)
+	}
+	switch c.Processing.Overflow {
+	case "", OVERFLOW_BLOCK, OVERFLOW_NAK:
+	case OVERFLOW_SPILL:
+		if c.Processing.SpillDir == "" {
+			addProblem("server.processing.spill_dir is required for overflow %q", OVERFLOW_SPILL)
+		}
+	default:
+		addProblem("server.processing.overflow must be %q, %q or %q, got %q", OVERFLOW_BLOCK, OVERFLOW_NAK, OVERFLOW_SPILL, c.Processing.Overflow)
+	}
+	if c.Processing.Timeout < 0 {
+		addProblem("server.processing.timeout must not be negative, got %d", c.Processing.Timeout)
+	}
+
+	if c.LabCritical.Enabled {
+		for i, rule := range c.LabCritical.Rules {
+			if rule.Code == "" {
+				addProblem("server.lab_critical.rules[%d].code is required", i)
+			}
+			if rule.Low == nil && rule.High == nil && len(rule.Values) == 0 {
+				addProblem("server.lab_critical.rules[%d] needs low, high or values", i)
+			}
+			if rule.Low != nil && rule.High != nil && *rule.Low >= *rule.High {
+				addProblem("server.lab_critical.rules[%d].low must be below high, got %g and %g", i, *rule.Low, *rule.High)
+			}
+		}
+		if webhook := c.LabCritical.WebhookURL; webhook != "" {
+			if parsed, err := url.Parse(webhook); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				addProblem("server.lab_critical.webhook_url must be an http or https URL, got %q", webhook)
+			}
+		}
+	}
+	if c.Duplicates.Window < 0 {
+		addProblem("server.duplicates.window must not be negative, got %d", c.Duplicates.Window)
+	}
+	if c.LabCritical.DedupWindow < 0 {
+		addProblem("server.lab_critical.dedup_window must not be negative, got %d", c.LabCritical.DedupWindow)
+	}
+	if c.LabCritical.Timeout < 0 {
+		addProblem("server.lab_critical.timeout must not be negative, got %d", c.LabCritical.Timeout)
+	}
+
+	if c.FHIR.URL != "" {
+		if parsed, err := url.Parse(c.FHIR.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			addProblem("server.fhir.url must be an http or https URL, got %q", c.FHIR.URL)
+		}
+	}
+	if c.FHIR.Timeout < 0 {
+		addProblem("server.fhir.timeout must not be negative, got %d", c.FHIR.Timeout)
+	}
+	from := make([]string, 0, len(c.FHIR.ConvertUnits))
+	for unit := range c.FHIR.ConvertUnits {
+		from = append(from, unit)
+	}
+	sort.Strings(from)
+	for _, unit := range from {
+		if !ucum.Commensurable(unit, c.FHIR.ConvertUnits[unit]) {
+			addProblem("server.fhir.convert_units[%q] must convert between commensurable UCUM units, got %q", unit, c.FHIR.ConvertUnits[unit])
+		}
+	}
+
+	if c.Orders.Destination != "" {
+		if _, port, err := net.SplitHostPort(c.Orders.Destination); err != nil || port == "" {
+			addProblem("server.orders.destination must be host:port, got %q", c.Orders.Destination)
+		}
+	}
+	if c.Orders.Charset != "" && charsetOf(c.Orders.Charset, "~") == "" {
+		addProblem("server.orders.charset is not a supported character set, got %q", c.Orders.Charset)
+	}
+	if c.Orders.Timeout < 0 {
+		addProblem("server.orders.timeout must not be negative, got %d", c.Orders.Timeout)
+	}
+
+	if c.Remote.Enabled {
+		if c.Remote.SiteID == "" {
+			addProblem("server.remote.site_id is required when remote mode is enabled")
+		}
+		if parsed, err := url.Parse(c.Remote.CentralURL); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			addProblem("server.remote.central_url must be an https URL, got %q", c.Remote.CentralURL)
+		}
+		if len(c.Remote.Key) < REMOTE_MIN_KEY_LENGTH {
+			addProblem("server.remote.key must be at least %d characters", REMOTE_MIN_KEY_LENGTH)
+		}
+		if c.Remote.BufferDir == "" {
+			addProblem("server.remote.buffer_dir is required when remote mode is enabled")
+		}
+	}
+	if c.Remote.Interval < 0 {
+		addProblem("server.remote.interval must not be negative, got %d", c.Remote.Interval)
+	}
+	if c.Remote.BatchSize < 0 {
+		addProblem("server.remote.batch_size must not be negative, got %d", c.Remote.BatchSize)
+	}
+	if c.Remote.ChunkSize < 0 {
+		addProblem("server.remote.chunk_size must not be negative, got %d", c.Remote.ChunkSize)
+	}
+	if c.Remote.WaveformMinBandwidth < 0 {
+		addProblem("server.remote.waveform_min_bandwidth must not be negative, got %d", c.Remote.WaveformMinBandwidth)
+	}
+	if c.Remote.Timeout < 0 {
+		addProblem("server.remote.timeout must not be negative, got %d", c.Remote.Timeout)
+	}
+	for _, lane := range syncLanes {
+		if dscp, found := c.Remote.LaneDSCP[lane]; found {
+			if _, err := transport.ParseDSCP(dscp); err != nil {
+				addProblem("server.remote.lane_dscp.%s: %v", lane, err)
+			}
+		}
+	}
+	for lane := range c.Remote.LaneDSCP {
+		if lane != SYNC_LANE_ALARM && lane != SYNC_LANE_DATA && lane != SYNC_LANE_WAVEFORM {
+			addProblem("server.remote.lane_dscp: unknown lane %q (alarm, data or waveform)", lane)
+		}
+	}
+
+	siteIDs := make(map[string]bool)
+	for i, site := range c.Sync.Sites {
+		if site.ID == "" {
+			addProblem("server.sync.sites[%d].id is required", i)
+		} else if siteIDs[site.ID] {
+			addProblem("server.sync.sites[%d].id %q is listed twice", i, site.ID)
+		}
+		siteIDs[site.ID] = true
+		if len(site.Key) < REMOTE_MIN_KEY_LENGTH {
+			addProblem("server.sync.sites[%d].key must be at least %d characters", i, REMOTE_MIN_KEY_LENGTH)
+		}
+	}
+	if len(c.Sync.Sites) > 0 && !c.Admin.Enabled {
+		addProblem("server.admin must be enabled to receive messages from server.sync.sites")
+	}
+
+	if c.Fleet.Enabled {
+		if parsed, err := url.Parse(c.Fleet.URL); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			addProblem("server.fleet.url must be an https URL, got %q", c.Fleet.URL)
+		}
+		if c.Fleet.GatewayID == "" {
+			addProblem("server.fleet.gateway_id is required when fleet management is enabled")
+		}
+		if len(c.Fleet.Key) < REMOTE_MIN_KEY_LENGTH {
+			addProblem("server.fleet.key must be at least %d characters", REMOTE_MIN_KEY_LENGTH)
+		}
+		if _, err := parseFleetPublicKey(c.Fleet.PublicKey); err != nil {
+			addProblem("server.fleet.public_key must be a base64 Ed25519 public key")
+		}
+		if c.Fleet.StateFile == "" {
+			addProblem("server.fleet.state_file is required when fleet management is enabled")
+		}
+	}
+	if c.Fleet.Interval < 0 {
+		addProblem("server.fleet.interval must not be negative, got %d", c.Fleet.Interval)
+	}
+	if c.Fleet.Timeout < 0 {
+		addProblem("server.fleet.timeout must not be negative, got %d", c.Fleet.Timeout)
+	}
+
+	switch c.Observer.AckPolicy {
+	case "", OBSERVER_ACK_NORMAL, OBSERVER_ACK_ACCEPT, OBSERVER_ACK_NONE:
+	default:
+		addProblem("server.observer.ack_policy must be normal, accept or none, got %q", c.Observer.AckPolicy)
+	}
+
+	if err := c.TLS.Validate(); err != nil {
+		addProblem("server.tls: %v", err)
+	}
+	if c.CertificateWarningDays < 0 {
+		addProblem("server.certificate_warning_days must not be negative, got %d", c.CertificateWarningDays)
+	}
+	transports := []struct {
+		name   string
+		config transport.Config
+	}{
+		{"publisher", c.Publisher.Transport},
+		{"lab_critical", c.LabCritical.Transport},
+		{"fhir", c.FHIR.Transport},
+		{"orders", c.Orders.Transport},
+		{"remote", c.Remote.Transport},
+		{"fleet", c.Fleet.Transport},
+	}
+	for _, t := range transports {
+		if err := t.config.Validate(); err != nil {
+			addProblem("server.%s.transport: %v", t.name, err)
+		}
+	}
+
+	if c.Router.Enabled {
+		names := make(map[string]bool)
+		for i, destination := range c.Router.Destinations {
+			switch {
+			case destination.Name == "":
+				addProblem("server.router.destinations[%d].name is required", i)
+			case names[destination.Name]:
+				addProblem("server.router.destinations[%d].name %q is used more than once", i, destination.Name)
+			}
+			names[destination.Name] = true
+			if _, port, err := net.SplitHostPort(destination.Address); err != nil || port == "" {
+				addProblem("server.router.destinations[%d].address must be host:port, got %q", i, destination.Address)
+			}
+			if err := destination.Transport.Validate(); err != nil {
+				addProblem("server.router.destinations[%d].transport: %v", i, err)
+			}
+			if destination.Timeout < 0 {
+				addProblem("server.router.destinations[%d].timeout must not be negative, got %d", i, destination.Timeout)
+			}
+			if destination.QueueSize < 0 {
+				addProblem("server.router.destinations[%d].queue_size must not be negative, got %d", i, destination.QueueSize)
+			}
+			if destination.RetryInterval < 0 {
+				addProblem("server.router.destinations[%d].retry_interval must not be negative, got %d", i, destination.RetryInterval)
+			}
+			if destination.Deidentify && !c.Deidentify.Enabled {
+				addProblem("server.router.destinations[%d].deidentify requires server.deidentify to be enabled", i)
+			}
+		}
+		for i, rule := range c.Router.Rules {
+			if len(rule.Destinations) == 0 {
+				addProblem("server.router.rules[%d].destinations must not be empty", i)
+			}
+			for _, name := range rule.Destinations {
+				if !names[name] {
+					addProblem("server.router.rules[%d] refers to unknown destination %q", i, name)
+				}
+			}
+			if _, err := parseFieldCriteria(rule.Fields); err != nil {
+				addProblem("server.router.rules[%d].fields: %v", i, err)
+			}
+		}
+	}
+
+	if c.Transform.Enabled && c.Transform.File == "" {
+		addProblem("server.transform.file is required when transformation is enabled")
+	}
+
+	if c.Deidentify.Enabled && c.Deidentify.Salt == "" {
+		addProblem("server.deidentify.salt is required when de-identification is enabled (or set %s)", ENV_DEIDENTIFY_SALT)
+	}
+	if c.Deidentify.DateShiftDays < 0 {
+		addProblem("server.deidentify.date_shift_days must not be negative, got %d", c.Deidentify.DateShiftDays)
+	}
+	for i, output := range c.Deidentify.Outputs {
+		if output != DEIDENTIFY_PUBLISH && output != DEIDENTIFY_LOG {
+			addProblem("server.deidentify.outputs[%d] must be publish or log, got %q", i, output)
+		}
+	}
+
+	for _, problem := range validateUnitMappings(c.Units.Mappings) {
+		addProblem("%s", problem)
+	}
+	parameters := make([]string, 0, len(c.Precision.Decimals))
+	for parameter := range c.Precision.Decimals {
+		parameters = append(parameters, parameter)
+	}
+	sort.Strings(parameters)
+	for _, parameter := range parameters {
+		if strings.TrimSpace(parameter) == "" {
+			addProblem("server.precision.decimals must not contain an empty parameter")
+		}
+		if decimals := c.Precision.Decimals[parameter]; decimals < 0 || decimals > precision.MAX_DECIMALS {
+			addProblem("server.precision.decimals[%q] must be between 0 and %d, got %d", parameter, precision.MAX_DECIMALS, decimals)
+		}
+	}
+
+	if c.Admin.Enabled {
+		if c.Admin.Token == "" {
+			addProblem("server.admin.token is required when the admin API is enabled")
+		}
+		if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+			addProblem("server.admin.port must be between 1 and 65535, got %d", c.Admin.Port)
+		}
+		if !validNetwork(c.Admin.Network) {
+			addProblem("server.admin.network must be tcp, tcp4 or tcp6, got %q", c.Admin.Network)
+		}
+		if !precision.ValidDecimalSeparator(c.Admin.DecimalSeparator) {
+			addProblem("server.admin.decimal_separator must be \".\" or \",\", got %q", c.Admin.DecimalSeparator)
+		}
+	}
+
+	if c.Memory.Enabled {
+		if c.Memory.Interval < 0 {
+			addProblem("server.memory.interval must not be negative (0 means %d seconds), got %d", memwatch.DEFAULT_INTERVAL, c.Memory.Interval)
+		}
+		if c.Memory.Window != 0 && c.Memory.Window < memwatch.WINDOW_SEGMENTS {
+			addProblem("server.memory.window must be at least %d samples (0 means %d), got %d", memwatch.WINDOW_SEGMENTS, memwatch.DEFAULT_WINDOW, c.Memory.Window)
+		}
+		if c.Memory.MinGrowth < 0 {
+			addProblem("server.memory.min_growth must not be negative (0 means %d%%), got %g", memwatch.DEFAULT_MIN_GROWTH, c.Memory.MinGrowth)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// Reload applies the settings of config that can change while the server is
+// running: allowed and denied IPs (host names are resolved again), timeouts
+// (including the processing timeout), maximum connections, log level, crash
+// report directory, the critical result webhook, the order destination,
+// the remote sites accepted by the sync API, the transformation rules
+// (the mapping file is read again) and the certificate warning days. TLS
+// certificates in use are read again. A
+// new timeout applies to each client from its next message. Changes to other settings are logged and take effect on restart.
+func (s *HL7Server) Reload(config *ServerConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	access, warnings, err := newAccessList(config.AllowedIPs, config.DeniedIPs)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		s.logf(LOG_LEVEL_WARN, "Access list: %s", warning)
+	}
+	var transformer *Transformer
+	if config.Transform.Enabled {
+		if transformer, err = LoadTransformer(config.Transform.File); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	current := *s.config
+	updated := current
+	updated.AllowedIPs = append([]string(nil), config.AllowedIPs...)
+	updated.DeniedIPs = append([]string(nil), config.DeniedIPs...)
+	updated.Timeout = config.Timeout
+	updated.MaxConnections = config.MaxConnections
+	updated.IdleTimeout = config.IdleTimeout
+	updated.ReadTimeout = config.ReadTimeout
+	updated.MaxMessageSize = config.MaxMessageSize
+	updated.MaxFramingErrors = config.MaxFramingErrors
+	updated.LogLevel = config.LogLevel
+	updated.CrashReportDir = config.CrashReportDir
+	updated.Processing.Timeout = config.Processing.Timeout
+	updated.LabCritical.WebhookURL = config.LabCritical.WebhookURL
+	updated.LabCritical.Timeout = config.LabCritical.Timeout
+	updated.LabCritical.Transport = config.LabCritical.Transport
+	updated.Orders = config.Orders
+	updated.Sync.Sites = append([]SyncSite(nil), config.Sync.Sites...)
+	updated.Transform = config.Transform
+	updated.CertificateWarningDays = config.CertificateWarningDays
+	s.config = &updated
+	s.access = access
+	s.transformer = transformer
+	s.mutex.Unlock()
+
+	// Certificates are read again even if their files look unchanged
+	if err := transport.ReloadCertificates(); err != nil {
+		s.reportError("certificate", "", err)
+	}
+
+	restart := make([]string, 0)
+	if config.Host != current.Host || config.Port != current.Port || config.Network != current.Network {
+		restart = append(restart, "host/port")
+	}
+	if config.TLS != current.TLS {
+		restart = append(restart, "tls")
+	}
+	if config.Storage != current.Storage {
+		restart = append(restart, "storage")
+	}
+	if config.Publisher != current.Publisher {
+		restart = append(restart, "publisher")
+	}
+	if config.Admin != current.Admin {
+		restart = append(restart, "admin")
+	}
+	if config.BPCheck != current.BPCheck {
+		restart = append(restart, "bp_check")
+	}
+	processing := config.Processing
+	processing.Timeout = current.Processing.Timeout
+	if processing != current.Processing {
+		restart = append(restart, "processing")
+	}
+	if config.Duplicates != current.Duplicates {
+		restart = append(restart, "duplicates")
+	}
+	if !reflect.DeepEqual(config.Timeline, current.Timeline) {
+		restart = append(restart, "timeline")
+	}
+	critical := config.LabCritical
+	critical.WebhookURL, critical.Timeout = current.LabCritical.WebhookURL, current.LabCritical.Timeout
+	critical.Transport = current.LabCritical.Transport
+	if !reflect.DeepEqual(critical, current.LabCritical) {
+		restart = append(restart, "lab_critical")
+	}
+	if !reflect.DeepEqual(config.FHIR, current.FHIR) {
+		restart = append(restart, "fhir")
+	}
+	if config.PatientRegistry != current.PatientRegistry {
+		restart = append(restart, "patient_registry")
+	}
+	if config.Encounters != current.Encounters {
+		restart = append(restart, "encounters")
+	}
+	if !reflect.DeepEqual(config.Remote, current.Remote) {
+		restart = append(restart, "remote")
+	}
+	if config.Fleet != current.Fleet {
+		restart = append(restart, "fleet")
+	}
+	if config.Observer.Enabled != current.Observer.Enabled || config.Observer.OutputFile != current.Observer.OutputFile {
+		restart = append(restart, "observer")
+	}
+	if !reflect.DeepEqual(config.Router, current.Router) {
+		restart = append(restart, "router")
+	}
+	if !reflect.DeepEqual(config.Deidentify, current.Deidentify) {
+		restart = append(restart, "deidentify")
+	}
+	if !reflect.DeepEqual(config.Units, current.Units) {
+		restart = append(restart, "units")
+	}
+	if !reflect.DeepEqual(config.Precision, current.Precision) {
+		restart = append(restart, "precision")
+	}
+	if config.Memory != current.Memory {
+		restart = append(restart, "memory")
+	}
+	if len(restart) > 0 {
+		s.logf(LOG_LEVEL_WARN, "Configuration reloaded; changes to %s take effect after restart", strings.Join(restart, ", "))
+	} else {
+		s.logf(LOG_LEVEL_INFO, "Configuration reloaded")
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated environment variable value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// settings returns the current configuration. Reload replaces it as a whole,
+// so the returned value must not be modified.
+func (s *HL7Server) settings() *ServerConfig {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.config
+}
+
+// logf logs a message if level is at or above the configured log level
+func (s *HL7Server) logf(level, format string, args ...interface{}) {
+	configured, known := logLevelRanks[strings.ToLower(s.settings().LogLevel)]
+	if !known {
+		configured = logLevelRanks[LOG_LEVEL_INFO]
+	}
+	if logLevelRanks[level] < configured {
+		return
+	}
+	s.logger.Printf(format, args...)
+}
@@ -0,0 +1,436 @@
+package hl7
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Conformance statement formats
+const (
+	CONFORMANCE_FORMAT_JSON     = "json"
+	CONFORMANCE_FORMAT_MARKDOWN = "markdown"
+)
+
+// Usage of segments and fields in the conformance statement
+const (
+	USAGE_REQUIRED = "R"  // Required for the message to be processed
+	USAGE_OPTIONAL = "O"  // Read if present
+	USAGE_IGNORED  = "X"  // Accepted but not read
+	USAGE_RE       = "RE" // Required but may be empty
+)
+
+// ConformanceStatement describes the inbound interface of a gateway as
+// configured: the messages, segments and fields it reads, how it
+// acknowledges messages and what it sends onwards
+type ConformanceStatement struct {
+	Generated      time.Time            `json:"generated"`
+	Interface      ConformanceInterface `json:"interface"`
+	Versions       []ConformanceVersion `json:"versions"`
+	Messages       []ConformanceMessage `json:"messages"`
+	Acknowledgment ConformanceAck       `json:"acknowledgment"`
+	Outputs        []ConformanceOutput  `json:"outputs"`
+}
+
+// ConformanceInterface describes the listener
+type ConformanceInterface struct {
+	Host           string   `json:"host"`
+	Port           int      `json:"port"`
+	Transport      string   `json:"transport"`
+	Framing        string   `json:"framing"`
+	MaxConnections int      `json:"max_connections,omitempty"` // 0: unlimited
+	IdleTimeout    int      `json:"idle_timeout,omitempty"`    // Seconds
+	ReadTimeout    int      `json:"read_timeout,omitempty"`    // Seconds
+	MaxMessageSize int      `json:"max_message_size"`          // Bytes
+	AllowedSenders []string `json:"allowed_senders,omitempty"` // Empty: all
+	DeniedSenders  []string `json:"denied_senders,omitempty"`
+	ObserverMode   bool     `json:"observer_mode"`
+}
+
+// ConformanceVersion describes how a supported HL7 version (MSH-12) is read
+type ConformanceVersion struct {
+	Version               string   `json:"version"`
+	Default               bool     `json:"default,omitempty"` // Used for messages without a version
+	PatientIDFields       []string `json:"patient_id_fields"`
+	ObservationTimeFields []string `json:"observation_time_fields"`
+	MessageStructure      bool     `json:"message_structure"` // MSH-9.3
+	MessageProfile        bool     `json:"message_profile"`   // MSH-21
+}
+
+// ConformanceMessage describes a supported message type
+type ConformanceMessage struct {
+	Type       string               `json:"type"`             // MSH-9.1
+	Events     []string             `json:"events,omitempty"` // MSH-9.2 values with specific processing; others are accepted
+	Processing string               `json:"processing"`
+	Segments   []ConformanceSegment `json:"segments"`
+}
+
+// ConformanceSegment describes a segment of a message
+type ConformanceSegment struct {
+	ID        string             `json:"id"`
+	Usage     string             `json:"usage"`
+	Repeating bool               `json:"repeating,omitempty"`
+	Fields    []ConformanceField `json:"fields,omitempty"`
+}
+
+// ConformanceField describes a field read by the gateway
+type ConformanceField struct {
+	Position    string `json:"position"` // e.g. "PID-3"
+	Name        string `json:"name"`
+	Usage       string `json:"usage"`
+	Description string `json:"description,omitempty"`
+}
+
+// ConformanceAck describes the acknowledgments sent to senders
+type ConformanceAck struct {
+	Mode    string            `json:"mode"`    // Original or enhanced mode
+	Message string            `json:"message"` // MSH-9 and MSH-12 of acknowledgments
+	Codes   []ConformanceCode `json:"codes"`
+	Policy  string            `json:"policy,omitempty"` // Observer mode acknowledgment policy
+}
+
+// ConformanceCode is an acknowledgment code and when it is sent
+type ConformanceCode struct {
+	Code      string `json:"code"`
+	Condition string `json:"condition"`
+}
+
+// ConformanceOutput is a system the gateway sends data to
+type ConformanceOutput struct {
+	Kind        string `json:"kind"`
+	Destination string `json:"destination"`
+	Content     string `json:"content"`
+}
+
+// Fields shared by several messages
+var (
+	conformanceMSH = ConformanceSegment{ID: HL7_SEG_MSH, Usage: USAGE_REQUIRED, Fields: []ConformanceField{
+		{Position: "MSH-3", Name: "Sending Application", Usage: USAGE_OPTIONAL, Description: "Receiving application of the acknowledgment; {sending_app} of event bus topics"},
+		{Position: "MSH-4", Name: "Sending Facility", Usage: USAGE_OPTIONAL, Description: "Receiving facility of the acknowledgment; {facility} of event bus topics"},
+		{Position: "MSH-7", Name: "Date/Time of Message", Usage: USAGE_OPTIONAL, Description: "Observation time when OBX and OBR carry none"},
+		{Position: "MSH-9", Name: "Message Type", Usage: USAGE_REQUIRED, Description: "Selects the processing of the message"},
+		{Position: "MSH-10", Name: "Message Control ID", Usage: USAGE_REQUIRED, Description: "Echoed in MSA-2"},
+		{Position: "MSH-12", Name: "Version ID", Usage: USAGE_RE, Description: "Selects the version profile"},
+	}}
+	conformancePID = ConformanceSegment{ID: HL7_SEG_PID, Usage: USAGE_REQUIRED, Fields: []ConformanceField{
+		{Position: "PID-3", Name: "Patient Identifier List", Usage: USAGE_REQUIRED, Description: "Every repetition is searched; PID-2 for versions before 2.5"},
+		{Position: "PID-5", Name: "Patient Name", Usage: USAGE_OPTIONAL},
+		{Position: "PID-7", Name: "Date/Time of Birth", Usage: USAGE_OPTIONAL},
+		{Position: "PID-8", Name: "Administrative Sex", Usage: USAGE_OPTIONAL},
+	}}
+	conformancePV1 = ConformanceSegment{ID: HL7_SEG_PV1, Usage: USAGE_OPTIONAL, Fields: []ConformanceField{
+		{Position: "PV1-3", Name: "Assigned Patient Location", Usage: USAGE_OPTIONAL, Description: "Bed (point of care^room^bed)"},
+		{Position: "PV1-19", Name: "Visit Number", Usage: USAGE_OPTIONAL, Description: "Encounter of the message"},
+		{Position: "PV1-44", Name: "Admit Date/Time", Usage: USAGE_OPTIONAL},
+		{Position: "PV1-45", Name: "Discharge Date/Time", Usage: USAGE_OPTIONAL},
+	}}
+)
+
+// conformanceMessages lists the message types processed by the server
+var conformanceMessages = []ConformanceMessage{
+	{
+		Type:       HL7_MSG_ADT,
+		Events:     []string{ADT_ADMIT, ADT_TRANSFER, ADT_DISCHARGE, ADT_REGISTER, ADT_UPDATE, ADT_MERGE},
+		Processing: "Patient registry, encounters and patient merges",
+		Segments: []ConformanceSegment{
+			conformanceMSH, conformancePID, conformancePV1,
+			{ID: HL7_SEG_MRG, Usage: USAGE_OPTIONAL, Repeating: true, Fields: []ConformanceField{
+				{Position: "MRG-1", Name: "Prior Patient Identifier List", Usage: USAGE_REQUIRED, Description: "Retired patient ID of A40 merges"},
+			}},
+			{ID: HL7_SEG_DG1, Usage: USAGE_OPTIONAL, Repeating: true, Fields: []ConformanceField{
+				{Position: "DG1-3", Name: "Diagnosis Code", Usage: USAGE_OPTIONAL},
+			}},
+			{ID: HL7_SEG_AL1, Usage: USAGE_OPTIONAL, Repeating: true, Fields: []ConformanceField{
+				{Position: "AL1-3", Name: "Allergen Code", Usage: USAGE_OPTIONAL},
+			}},
+		},
+	},
+	{
+		Type:       HL7_MSG_ORU,
+		Events:     []string{"R01"},
+		Processing: "Observations, infusion pump channels, critical results, NIBP cross-check, timeline and FHIR export",
+		Segments: []ConformanceSegment{
+			conformanceMSH, conformancePID, conformancePV1,
+			{ID: HL7_SEG_OBR, Usage: USAGE_OPTIONAL, Repeating: true, Fields: []ConformanceField{
+				{Position: "OBR-4", Name: "Universal Service Identifier", Usage: USAGE_OPTIONAL},
+				{Position: "OBR-7", Name: "Observation Date/Time", Usage: USAGE_OPTIONAL, Description: "Observation time when OBX carries none"},
+			}},
+			{ID: HL7_SEG_OBX, Usage: USAGE_REQUIRED, Repeating: true, Fields: []ConformanceField{
+				{Position: "OBX-2", Name: "Value Type", Usage: USAGE_RE, Description: "NM values are read as numbers"},
+				{Position: "OBX-3", Name: "Observation Identifier", Usage: USAGE_REQUIRED, Description: "MDC code^reference ID^coding system"},
+				{Position: "OBX-4", Name: "Observation Sub-ID", Usage: USAGE_OPTIONAL, Description: "IHE PCD containment (MDS.VMD.CHAN.METRIC)"},
+				{Position: "OBX-5", Name: "Observation Value", Usage: USAGE_RE},
+				{Position: "OBX-6", Name: "Units", Usage: USAGE_OPTIONAL},
+				{Position: "OBX-7", Name: "References Range", Usage: USAGE_OPTIONAL},
+				{Position: "OBX-8", Name: "Abnormal Flags", Usage: USAGE_OPTIONAL},
+				{Position: "OBX-11", Name: "Observation Result Status", Usage: USAGE_OPTIONAL},
+				{Position: "OBX-14", Name: "Date/Time of the Observation", Usage: USAGE_OPTIONAL},
+				{Position: "OBX-18", Name: "Equipment Instance Identifier", Usage: USAGE_OPTIONAL},
+				{Position: "OBX-19", Name: "Date/Time of the Analysis", Usage: USAGE_OPTIONAL, Description: "Version 2.5 and later, when OBX-14 is empty"},
+			}},
+		},
+	},
+	{
+		Type:       HL7_MSG_ORM,
+		Processing: "Logged",
+		Segments: []ConformanceSegment{
+			conformanceMSH, conformancePID,
+			{ID: HL7_SEG_ORC, Usage: USAGE_OPTIONAL, Repeating: true, Fields: []ConformanceField{
+				{Position: "ORC-2", Name: "Placer Order Number", Usage: USAGE_OPTIONAL},
+			}},
+		},
+	},
+	{
+		Type:       HL7_MSG_RAS,
+		Processing: "Medication administrations on the timeline",
+		Segments: []ConformanceSegment{
+			conformanceMSH, conformancePID,
+			{ID: HL7_SEG_RXA, Usage: USAGE_REQUIRED, Repeating: true, Fields: []ConformanceField{
+				{Position: "RXA-3", Name: "Date/Time Start of Administration", Usage: USAGE_OPTIONAL},
+				{Position: "RXA-4", Name: "Date/Time End of Administration", Usage: USAGE_OPTIONAL},
+				{Position: "RXA-5", Name: "Administered Code", Usage: USAGE_REQUIRED},
+				{Position: "RXA-6", Name: "Administered Amount", Usage: USAGE_OPTIONAL},
+				{Position: "RXA-7", Name: "Administered Units", Usage: USAGE_OPTIONAL},
+				{Position: "RXA-20", Name: "Completion Status", Usage: USAGE_OPTIONAL},
+			}},
+			{ID: HL7_SEG_RXR, Usage: USAGE_OPTIONAL, Repeating: true, Fields: []ConformanceField{
+				{Position: "RXR-1", Name: "Route", Usage: USAGE_OPTIONAL},
+			}},
+		},
+	},
+	{
+		Type:       HL7_MSG_RGV,
+		Processing: "Medication gives on the timeline",
+		Segments: []ConformanceSegment{
+			conformanceMSH, conformancePID,
+			{ID: HL7_SEG_RXG, Usage: USAGE_REQUIRED, Repeating: true, Fields: []ConformanceField{
+				{Position: "RXG-3", Name: "Quantity/Timing", Usage: USAGE_OPTIONAL, Description: "Give time from RXG-3.4"},
+				{Position: "RXG-4", Name: "Give Code", Usage: USAGE_REQUIRED},
+				{Position: "RXG-5", Name: "Give Amount", Usage: USAGE_OPTIONAL},
+				{Position: "RXG-7", Name: "Give Units", Usage: USAGE_OPTIONAL},
+			}},
+			{ID: HL7_SEG_RXR, Usage: USAGE_OPTIONAL, Repeating: true, Fields: []ConformanceField{
+				{Position: "RXR-1", Name: "Route", Usage: USAGE_OPTIONAL},
+			}},
+		},
+	},
+}
+
+// BuildConformanceStatement describes the interface of a server with config
+func BuildConformanceStatement(config *ServerConfig, now time.Time) *ConformanceStatement {
+	statement := &ConformanceStatement{
+		Generated: now.UTC(),
+		Interface: ConformanceInterface{
+			Host:           config.Host,
+			Port:           config.Port,
+			Transport:      "TCP",
+			Framing:        "MLLP (0x0B message 0x1C 0x0D); acknowledgments are MLLP framed",
+			MaxConnections: config.MaxConnections,
+			IdleTimeout:    config.IdleTimeout,
+			ReadTimeout:    config.ReadTimeout,
+			MaxMessageSize: maxMessageSize(config.MaxMessageSize),
+			AllowedSenders: config.AllowedIPs,
+			DeniedSenders:  config.DeniedIPs,
+			ObserverMode:   config.Observer.Enabled,
+		},
+		Messages: conformanceMessages,
+	}
+
+	for _, profile := range versionProfiles {
+		statement.Versions = append(statement.Versions, ConformanceVersion{
+			Version:               profile.Version,
+			Default:               profile.Version == HL7_DEFAULT_VERSION,
+			PatientIDFields:       fieldPositions(HL7_SEG_PID, profile.PatientIDFields),
+			ObservationTimeFields: fieldPositions(HL7_SEG_OBX, profile.ObservationTimeFields),
+			MessageStructure:      profile.MessageStructure,
+			MessageProfile:        profile.MessageProfile,
+		})
+	}
+
+	statement.Acknowledgment = conformanceAck(config)
+	statement.Outputs = conformanceOutputs(config)
+	return statement
+}
+
+// fieldPositions formats field numbers of a segment, e.g. "PID-3"
+func fieldPositions(segment string, fields []int) []string {
+	positions := make([]string, len(fields))
+	for i, field := range fields {
+		positions[i] = fmt.Sprintf("%s-%d", segment, field)
+	}
+	return positions
+}
+
+// conformanceAck describes the acknowledgments under config
+func conformanceAck(config *ServerConfig) ConformanceAck {
+	ack := ConformanceAck{
+		Mode:    "Original mode; MSH-15/MSH-16 are not evaluated",
+		Message: "ACK^A01, version 2.5, with MSA and ERR",
+		Codes: []ConformanceCode{
+			{Code: HL7_ACK_ACCEPT, Condition: "The message was parsed, archived (if storage is configured) and queued"},
+		},
+	}
+	switch config.Processing.Overflow {
+	case OVERFLOW_NAK:
+		ack.Codes = append(ack.Codes, ConformanceCode{Code: HL7_ACK_REJECT, Condition: "The processing queue is full; the sender retries (ERR-3 207)"})
+	case OVERFLOW_SPILL:
+		ack.Codes = append(ack.Codes, ConformanceCode{Code: HL7_ACK_REJECT, Condition: "The processing queue is full and the message cannot be spilled to disk (ERR-3 207)"})
+	default:
+		ack.Codes[0].Condition += "; when the processing queue is full the acknowledgment is delayed until there is room"
+	}
+	if config.Remote.Enabled {
+		ack.Codes = append(ack.Codes, ConformanceCode{Code: HL7_ACK_REJECT, Condition: "The message could not be written to the remote site buffer (ERR-3 207)"})
+	}
+	if config.Storage.Type != "" {
+		ack.Codes = append(ack.Codes, ConformanceCode{Code: HL7_ACK_ERROR, Condition: "The message could not be archived to storage; it is not queued (ERR-3 207)"})
+	}
+	ack.Codes = append(ack.Codes, ConformanceCode{Code: "none", Condition: "The message cannot be parsed (no MSH segment); the connection stays open"})
+
+	if config.Observer.Enabled {
+		switch config.Observer.AckPolicy {
+		case OBSERVER_ACK_ACCEPT:
+			ack.Policy = "Observer mode: every parsed message is acknowledged with AA"
+		case OBSERVER_ACK_NONE:
+			ack.Policy = "Observer mode: no acknowledgments are sent"
+		default:
+			ack.Policy = "Observer mode: acknowledgments as above"
+		}
+	}
+	return ack
+}
+
+// conformanceOutputs lists the systems the server sends data to under config
+func conformanceOutputs(config *ServerConfig) []ConformanceOutput {
+	outputs := make([]ConformanceOutput, 0)
+	if config.Publisher.Type != "" {
+		outputs = append(outputs, ConformanceOutput{Kind: "event_bus", Destination: config.Publisher.Type,
+			Content: "Every processed message as JSON, infusion states, alerts, critical results and merge audits"})
+	}
+	if config.FHIR.URL != "" {
+		outputs = append(outputs, ConformanceOutput{Kind: "fhir", Destination: config.FHIR.URL,
+			Content: "Observations of ORU messages as FHIR R4 transaction bundles"})
+	}
+	if config.LabCritical.Enabled && config.LabCritical.WebhookURL != "" {
+		outputs = append(outputs, ConformanceOutput{Kind: "webhook", Destination: config.LabCritical.WebhookURL,
+			Content: "Critical lab results as JSON"})
+	}
+	if config.Orders.Destination != "" {
+		outputs = append(outputs, ConformanceOutput{Kind: "mllp", Destination: config.Orders.Destination,
+			Content: "ORM^O01 orders placed through the admin API"})
+	}
+	if config.Remote.Enabled {
+		outputs = append(outputs, ConformanceOutput{Kind: "remote_sync", Destination: config.Remote.CentralURL,
+			Content: "Every received message, encrypted, to the central deployment"})
+	}
+	if config.Observer.Enabled {
+		for i := range outputs {
+			outputs[i].Content += " (observer mode: recorded, not sent)"
+		}
+	}
+	return outputs
+}
+
+// Markdown renders the statement as a document for integration governance
+func (c *ConformanceStatement) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HL7 v2 Conformance Statement\n\n")
+	fmt.Fprintf(&b, "Generated %s from the active configuration.\n\n", c.Generated.Format(time.RFC3339))
+
+	fmt.Fprintf(&b, "## Interface\n\n")
+	fmt.Fprintf(&b, "| Item | Value |\n|------|-------|\n")
+	fmt.Fprintf(&b, "| Listener | %s |\n", listenAddress(c.Interface.Host, c.Interface.Port))
+	fmt.Fprintf(&b, "| Transport | %s, %s |\n", c.Interface.Transport, c.Interface.Framing)
+	fmt.Fprintf(&b, "| Max connections | %s |\n", unlimited(c.Interface.MaxConnections))
+	fmt.Fprintf(&b, "| Idle timeout | %s |\n", disabledSeconds(c.Interface.IdleTimeout))
+	fmt.Fprintf(&b, "| Read timeout | %s |\n", disabledSeconds(c.Interface.ReadTimeout))
+	fmt.Fprintf(&b, "| Max message size | %d bytes |\n", c.Interface.MaxMessageSize)
+	fmt.Fprintf(&b, "| Allowed senders | %s |\n", listOrDefault(c.Interface.AllowedSenders, "all"))
+	fmt.Fprintf(&b, "| Denied senders | %s |\n", listOrDefault(c.Interface.DeniedSenders, "none"))
+	fmt.Fprintf(&b, "| Observer mode | %t |\n\n", c.Interface.ObserverMode)
+
+	fmt.Fprintf(&b, "## Versions\n\n")
+	fmt.Fprintf(&b, "| MSH-12 | Patient ID | Observation time | MSH-9.3 | MSH-21 |\n|--------|------------|------------------|---------|--------|\n")
+	for _, version := range c.Versions {
+		name := version.Version
+		if version.Default {
+			name += " (default)"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", name, strings.Join(version.PatientIDFields, ", "),
+			strings.Join(version.ObservationTimeFields, ", "), yesNo(version.MessageStructure), yesNo(version.MessageProfile))
+	}
+	fmt.Fprintf(&b, "\nOther versions use the profile of their major.minor version, the oldest or newest profile, or the default.\n\n")
+
+	fmt.Fprintf(&b, "## Messages\n\n")
+	for _, message := range c.Messages {
+		fmt.Fprintf(&b, "### %s\n\n", message.Type)
+		if len(message.Events) > 0 {
+			events := append([]string(nil), message.Events...)
+			sort.Strings(events)
+			fmt.Fprintf(&b, "Events with specific processing: %s. Other events are accepted.\n\n", strings.Join(events, ", "))
+		}
+		fmt.Fprintf(&b, "Processing: %s.\n\n", message.Processing)
+		fmt.Fprintf(&b, "| Segment | Field | Name | Usage | Notes |\n|---------|-------|------|-------|-------|\n")
+		for _, segment := range message.Segments {
+			id := segment.ID
+			if segment.Repeating {
+				id += " (repeating)"
+			}
+			fmt.Fprintf(&b, "| %s | | | %s | |\n", id, segment.Usage)
+			for _, field := range segment.Fields {
+				fmt.Fprintf(&b, "| | %s | %s | %s | %s |\n", field.Position, field.Name, field.Usage, field.Description)
+			}
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	fmt.Fprintf(&b, "Other message types are acknowledged and logged. Segments not listed are accepted and not read. Usage: R required, RE required but may be empty, O optional.\n\n")
+
+	fmt.Fprintf(&b, "## Acknowledgments\n\n")
+	fmt.Fprintf(&b, "%s. Acknowledgments are %s.\n\n", c.Acknowledgment.Mode, c.Acknowledgment.Message)
+	fmt.Fprintf(&b, "| MSA-1 | Sent when |\n|-------|-----------|\n")
+	for _, code := range c.Acknowledgment.Codes {
+		fmt.Fprintf(&b, "| %s | %s |\n", code.Code, code.Condition)
+	}
+	if c.Acknowledgment.Policy != "" {
+		fmt.Fprintf(&b, "\n%s.\n", c.Acknowledgment.Policy)
+	}
+
+	fmt.Fprintf(&b, "\n## Outputs\n\n")
+	if len(c.Outputs) == 0 {
+		fmt.Fprintf(&b, "None configured.\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "| Kind | Destination | Content |\n|------|-------------|---------|\n")
+	for _, output := range c.Outputs {
+		fmt.Fprintf(&b, "| %s | %s | %s |\n", output.Kind, output.Destination, output.Content)
+	}
+	return b.String()
+}
+
+func unlimited(value int) string {
+	if value <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+func disabledSeconds(value int) string {
+	if value <= 0 {
+		return "disabled"
+	}
+	return fmt.Sprintf("%d s", value)
+}
+
+func listOrDefault(values []string, empty string) string {
+	if len(values) == 0 {
+		return empty
+	}
+	return strings.Join(values, ", ")
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,194 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HL7 continuation segments
+const (
+	HL7_SEG_DSC = "DSC" // Continuation Pointer
+	HL7_SEG_ADD = "ADD" // Addendum, the rest of the last segment of the previous fragment
+)
+
+// CONTINUATION_TIMEOUT is how long the fragments of a message are kept
+// waiting for the next fragment
+const CONTINUATION_TIMEOUT = 5 * time.Minute
+
+// DSC_STYLE_INTERACTIVE is the continuation style (DSC-2) of query
+// responses continued on request, which are not reassembled
+const DSC_STYLE_INTERACTIVE = "I"
+
+// continuation is a message whose fragments are being received
+type continuation struct {
+	segments []string // Segments received so far, without DSC
+	size     int
+	updated  time.Time
+}
+
+// continuationBuffer reassembles messages sent in fragments: a fragment ends
+// with a DSC segment whose continuation pointer (DSC-1) the next fragment
+// repeats in MSH-14. The next fragment's MSH is dropped, and an ADD segment
+// at its start continues the last segment of the previous fragment. It is
+// safe for concurrent use.
+type continuationBuffer struct {
+	mutex   sync.Mutex
+	pending map[string]*continuation // By client and continuation pointer
+}
+
+// newContinuationBuffer creates an empty buffer
+func newContinuationBuffer() *continuationBuffer {
+	return &continuationBuffer{pending: make(map[string]*continuation)}
+}
+
+// isFragment reports whether a message is a fragment of a continued message:
+// it continues an earlier fragment (MSH-14) or is continued (DSC-1)
+func isFragment(message *HL7Message) bool {
+	if msh := message.MSH(); msh != nil && msh.ContinuationPointer() != "" {
+		return true
+	}
+	pointer, style := continuationPointer(message)
+	return pointer != "" && style != DSC_STYLE_INTERACTIVE
+}
+
+// continuationPointer returns DSC-1 and DSC-2 of the last segment of a
+// message, if it is a DSC
+func continuationPointer(message *HL7Message) (string, string) {
+	if len(message.Segments) == 0 {
+		return "", ""
+	}
+	last := &message.Segments[len(message.Segments)-1]
+	if last.Type != HL7_SEG_DSC {
+		return "", ""
+	}
+	return last.FieldValue(1), last.FieldValue(2)
+}
+
+// add adds a fragment received from a client. It returns the reassembled
+// message text once the last fragment (without DSC) has arrived, or "" while
+// more fragments are expected. maxSize limits the reassembled message.
+func (b *continuationBuffer) add(clientID string, fragment *HL7Message, maxSize int, now time.Time) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expire(now)
+
+	msh := fragment.MSH()
+	if msh == nil {
+		return "", fmt.Errorf("fragment has no MSH segment")
+	}
+	fieldSeparator, _ := messageSeparators(fragment)
+	segments := rawSegments(fragment)
+	pointer, _ := continuationPointer(fragment)
+	if pointer != "" {
+		segments = segments[:len(segments)-1]
+	}
+
+	var message *continuation
+	if previous := msh.ContinuationPointer(); previous != "" {
+		key := clientID + "\x00" + previous
+		message = b.pending[key]
+		if message == nil {
+			return "", fmt.Errorf("no message is waiting for continuation pointer %q", previous)
+		}
+		delete(b.pending, key)
+
+		// The MSH of a following fragment only carries the pointer
+		segments = segments[1:]
+		if len(segments) > 0 && strings.HasPrefix(segments[0], HL7_SEG_ADD+fieldSeparator) && len(message.segments) > 0 {
+			last := len(message.segments) - 1
+			message.segments[last] += strings.TrimPrefix(segments[0], HL7_SEG_ADD+fieldSeparator)
+			segments = segments[1:]
+		}
+	} else {
+		message = &continuation{}
+	}
+
+	for _, segment := range segments {
+		message.segments = append(message.segments, segment)
+		message.size += len(segment) + 1
+	}
+	if message.size > maxSize {
+		return "", fmt.Errorf("continued message exceeds %d bytes", maxSize)
+	}
+	message.updated = now
+
+	if pointer != "" {
+		key := clientID + "\x00" + pointer
+		if _, exists := b.pending[key]; exists {
+			return "", fmt.Errorf("continuation pointer %q is already waiting for a fragment", pointer)
+		}
+		b.pending[key] = message
+		return "", nil
+	}
+	return strings.Join(message.segments, "\r") + "\r", nil
+}
+
+// reassemble adds a fragment received from a client and returns the
+// reassembled message once it is complete. While fragments are expected it
+// returns nil and the acknowledgment of the fragment.
+func (s *HL7Server) reassemble(clientID string, fragment *HL7Message) (*HL7Message, string, string) {
+	raw, err := s.continuations.add(clientID, fragment, maxMessageSize(s.settings().MaxMessageSize), fragment.Time)
+	if err != nil {
+		s.reportError("parse", clientID, err)
+		return nil, HL7_ACK_ERROR, err.Error()
+	}
+	if raw == "" {
+		metricFragmentsReceived.Inc()
+		return nil, HL7_ACK_ACCEPT, ""
+	}
+	message, err := s.parser.ParseMessage(raw)
+	if err != nil {
+		metricParseErrors.Inc()
+		s.recordParseError(clientID, err)
+		s.reportError("parse", clientID, err)
+		return nil, HL7_ACK_ERROR, err.Error()
+	}
+	metricFragmentsReceived.Inc()
+	message.Time = fragment.Time
+	return message, "", ""
+}
+
+// count returns the number of messages waiting for a fragment, for the
+// memory monitor
+func (b *continuationBuffer) count() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.pending)
+}
+
+// drop discards the fragments of a client, e.g. after it disconnected
+func (b *continuationBuffer) drop(clientID string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key := range b.pending {
+		if strings.HasPrefix(key, clientID+"\x00") {
+			delete(b.pending, key)
+		}
+	}
+}
+
+// expire discards messages whose next fragment did not arrive in time. The
+// caller holds the mutex.
+func (b *continuationBuffer) expire(now time.Time) {
+	for key, message := range b.pending {
+		if now.Sub(message.updated) > CONTINUATION_TIMEOUT {
+			delete(b.pending, key)
+		}
+	}
+}
+
+// rawSegments returns the segments of a message as sent. Unlike the
+// parsed segments, trailing spaces are kept: text continued by an ADD
+// segment may be split anywhere.
+func rawSegments(message *HL7Message) []string {
+	var segments []string
+	for _, segment := range strings.Split(NewHL7Parser().removeMLLPWrapper(message.Raw), "\r") {
+		segment = strings.Trim(segment, "\n")
+		if strings.TrimSpace(segment) != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,151 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MAX_CRASH_REPORTS is the number of crash reports kept in memory by the server
+const MAX_CRASH_REPORTS = 50
+
+// CrashReport records a panic recovered while processing data from one source
+type CrashReport struct {
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id,omitempty"` // Remote address of the sender
+	Stage    string    `json:"stage"`               // "parse" or "handle"
+	Panic    string    `json:"panic"`
+	Stack    string    `json:"stack"`
+	Message  string    `json:"message"` // Offending message with PHI scrubbed
+}
+
+// phiSegments lists segments carrying patient identifying data and the
+// fields of each that are kept as received (all other fields are scrubbed)
+var phiSegments = map[string]map[int]bool{
+	"PID": {1: true},
+	"PD1": {},
+	"PV1": {1: true, 2: true},
+	"PV2": {},
+	"NK1": {1: true},
+	"MRG": {},
+	"GT1": {1: true},
+	"IN1": {1: true},
+	"IN2": {},
+	"ACC": {},
+	"NTE": {1: true},
+}
+
+// ScrubPHI returns a copy of a raw HL7 message in which the fields of patient
+// identifying segments (PID, NK1, PV1, ...) are masked. Letters become "X" and
+// digits become "9" while delimiters are kept, so the masked message still
+// reproduces parser failures caused by its structure.
+func ScrubPHI(message string) string {
+	delimiters := "|^~\\&"
+	if trimmed := strings.TrimLeft(message, " \t\r\n"); strings.HasPrefix(trimmed, HL7_SEG_MSH) && len(trimmed) >= 8 {
+		delimiters = trimmed[3:8]
+	}
+	fieldSeparator := delimiters[:1]
+
+	lines := strings.FieldsFunc(message, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	})
+	for i, line := range lines {
+		if len(line) < 3 {
+			continue
+		}
+		kept, exists := phiSegments[line[:3]]
+		if !exists {
+			continue
+		}
+
+		fields := strings.Split(line, fieldSeparator)
+		for position := 1; position < len(fields); position++ {
+			if kept[position] {
+				continue
+			}
+			fields[position] = maskValue(fields[position], delimiters)
+		}
+		lines[i] = strings.Join(fields, fieldSeparator)
+	}
+
+	return strings.Join(lines, "\r")
+}
+
+// maskValue replaces letters and digits in a field, keeping HL7 delimiters
+func maskValue(value, delimiters string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case strings.ContainsRune(delimiters, r):
+			return r
+		case unicode.IsDigit(r):
+			return '9'
+		case unicode.IsSpace(r):
+			return r
+		default:
+			return 'X'
+		}
+	}, value)
+}
+
+// recoverPanic converts a panic into a crash report. It must be called
+// directly by a deferred function; it returns true if a panic was recovered.
+func (s *HL7Server) recoverPanic(recovered interface{}, stage, clientID, message string) bool {
+	if recovered == nil {
+		return false
+	}
+
+	report := &CrashReport{
+		Time:     s.clock.Now(),
+		ClientID: clientID,
+		Stage:    stage,
+		Panic:    fmt.Sprint(recovered),
+		Stack:    string(debug.Stack()),
+		Message:  ScrubPHI(message),
+	}
+
+	s.mutex.Lock()
+	s.crashReports = append(s.crashReports, report)
+	if len(s.crashReports) > MAX_CRASH_REPORTS {
+		s.crashReports = s.crashReports[len(s.crashReports)-MAX_CRASH_REPORTS:]
+	}
+	s.mutex.Unlock()
+
+	if dir := s.settings().CrashReportDir; dir != "" {
+		if err := writeCrashReport(dir, report); err != nil {
+			s.logf(LOG_LEVEL_ERROR, "Failed to write crash report: %v", err)
+		}
+	}
+
+	s.reportError("panic", clientID, fmt.Errorf("recovered panic while %s message: %s", stage, report.Panic))
+	return true
+}
+
+// writeCrashReport saves a crash report as a JSON file in dir
+func writeCrashReport(dir string, report *CrashReport) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("hl7-crash-%s-%s.json", report.Time.Format("20060102T150405.000000000"), report.Stage)
+	return os.WriteFile(filepath.Join(dir, filename), data, 0600)
+}
+
+// CrashReports returns the most recent crash reports (oldest first)
+func (s *HL7Server) CrashReports() []*CrashReport {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	reports := make([]*CrashReport, len(s.crashReports))
+	copy(reports, s.crashReports)
+	return reports
+}
@@ -0,0 +1,274 @@
+package hl7
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+	"github.com/harusin0516/healthcare/driver/precision"
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// LAB_ALERT_CRITICAL is the type of the alert raised for a critical lab result
+const LAB_ALERT_CRITICAL = "LAB_CRITICAL"
+
+// HL7_CRITICAL_TOPIC is the event bus topic of critical lab results
+const HL7_CRITICAL_TOPIC = "hl7.critical"
+
+// Critical result notification defaults
+const (
+	CRITICAL_DEDUP_WINDOW   = 3600 // Seconds a notified result is not notified again
+	CRITICAL_QUEUE_SIZE     = 100  // Alerts waiting for notification
+	CRITICAL_NOTIFY_TIMEOUT = 5    // Seconds to wait for the webhook
+)
+
+// criticalIgnoredStatuses are result statuses (OBX-11) that are never critical:
+// deleted, wrong and results that could not be obtained
+var criticalIgnoredStatuses = map[string]bool{"D": true, "W": true, "X": true}
+
+// CriticalRule marks results of one observation code as critical
+type CriticalRule struct {
+	Code   string   `json:"code"`   // OBX-3.1, e.g. LOINC "2823-3"
+	Name   string   `json:"name"`   // Name used in notifications (default: OBX-3.2)
+	Low    *float64 `json:"low"`    // Critical at or below this value
+	High   *float64 `json:"high"`   // Critical at or above this value
+	Values []string `json:"values"` // Critical coded or text values, e.g. "POS"
+}
+
+// LabCriticalConfig configures the detection of critical lab results
+type LabCriticalConfig struct {
+	Enabled       bool             `json:"enabled"`
+	Rules         []CriticalRule   `json:"rules"`
+	AbnormalFlags []string         `json:"abnormal_flags"` // OBX-8 flags that are critical for any code, e.g. "LL", "HH", "AA"
+	DedupWindow   int              `json:"dedup_window"`   // Seconds a notified result is not notified again (0: 3600)
+	WebhookURL    string           `json:"webhook_url"`    // Alerts are POSTed here as JSON (empty: disabled)
+	Timeout       int              `json:"timeout"`        // Webhook timeout in seconds (0: 5)
+	Transport     transport.Config `json:"transport"`      // TLS and proxy of the webhook
+}
+
+// LabCriticalAlert is raised for an observation that matches a critical rule
+type LabCriticalAlert struct {
+	Type           string    `json:"type"`
+	PatientID      string    `json:"patient_id"`
+	Location       string    `json:"location,omitempty"`
+	ControlID      string    `json:"control_id"`
+	Code           string    `json:"code"`
+	Name           string    `json:"name"`
+	Value          string    `json:"value"`
+	Unit           string    `json:"unit,omitempty"`
+	ReferenceRange string    `json:"reference_range,omitempty"`
+	AbnormalFlags  string    `json:"abnormal_flags,omitempty"`
+	Time           time.Time `json:"time"`        // Observation time
+	ReceivedAt     time.Time `json:"received_at"` // Time the message was received
+	Reason         string    `json:"reason"`
+	Message        string    `json:"message"`
+}
+
+// CriticalDetector finds critical results in observation sets. A result is
+// notified once; resent and repeated results within the dedup window are
+// skipped. It is safe for concurrent use.
+type CriticalDetector struct {
+	rules  map[string]CriticalRule
+	flags  map[string]bool
+	window time.Duration
+	mutex  sync.Mutex
+	seen   map[string]time.Time
+}
+
+// NewCriticalDetector creates a detector for the configured rules
+func NewCriticalDetector(config LabCriticalConfig) *CriticalDetector {
+	window := config.DedupWindow
+	if window <= 0 {
+		window = CRITICAL_DEDUP_WINDOW
+	}
+	detector := &CriticalDetector{
+		rules:  make(map[string]CriticalRule),
+		flags:  make(map[string]bool),
+		window: time.Duration(window) * time.Second,
+		seen:   make(map[string]time.Time),
+	}
+	for _, rule := range config.Rules {
+		detector.rules[rule.Code] = rule
+	}
+	for _, flag := range config.AbnormalFlags {
+		detector.flags[strings.ToUpper(flag)] = true
+	}
+	return detector
+}
+
+// Check returns an alert for every critical result of a set that has not
+// been notified within the dedup window. Abnormal flags are only applied to
+// results that are not MDC coded; monitor vitals are alarmed by the monitors.
+func (d *CriticalDetector) Check(set *ObservationSet, now time.Time) []*LabCriticalAlert {
+	alerts := make([]*LabCriticalAlert, 0)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.prune(now)
+
+	for i := range set.Observations {
+		observation := &set.Observations[i]
+		if criticalIgnoredStatuses[observation.ResultStatus] {
+			continue
+		}
+		reason, name := d.match(observation)
+		if reason == "" {
+			continue
+		}
+
+		key := strings.Join([]string{set.PatientID, observation.Code, observation.SubID, observation.Value, observation.Timestamp.Format(time.RFC3339)}, "|")
+		if _, notified := d.seen[key]; notified {
+			continue
+		}
+		d.seen[key] = now
+
+		alert := &LabCriticalAlert{
+			Type:           LAB_ALERT_CRITICAL,
+			PatientID:      set.PatientID,
+			Location:       set.Location,
+			ControlID:      set.MessageControlID,
+			Code:           observation.Code,
+			Name:           name,
+			Value:          observation.Value,
+			Unit:           observation.Unit,
+			ReferenceRange: observation.ReferenceRange,
+			AbnormalFlags:  observation.AbnormalFlags,
+			Time:           observation.Timestamp,
+			ReceivedAt:     now,
+			Reason:         reason,
+		}
+		alert.Message = fmt.Sprintf("Critical %s %s %s for patient %s (%s)", name, observation.Value, observation.Unit, set.PatientID, reason)
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
+
+// match returns why an observation is critical (empty if it is not) and its name
+func (d *CriticalDetector) match(observation *Observation) (string, string) {
+	name := firstNonEmpty(observation.ReferenceID, observation.Code)
+	if rule, exists := d.rules[observation.Code]; exists {
+		name = firstNonEmpty(rule.Name, name)
+		if value := observation.NumericValue; value != nil {
+			if rule.Low != nil && *value <= *rule.Low {
+				return fmt.Sprintf("%s at or below %s", precision.Format(*value), precision.Format(*rule.Low)), name
+			}
+			if rule.High != nil && *value >= *rule.High {
+				return fmt.Sprintf("%s at or above %s", precision.Format(*value), precision.Format(*rule.High)), name
+			}
+		}
+		for _, critical := range rule.Values {
+			if strings.EqualFold(strings.TrimSpace(observation.Value), critical) {
+				return fmt.Sprintf("value %s", critical), name
+			}
+		}
+	}
+
+	if observation.CodingSystem != mdc.CODING_SYSTEM {
+		for _, flag := range strings.Split(observation.AbnormalFlags, "~") {
+			if d.flags[strings.ToUpper(flag)] {
+				return fmt.Sprintf("abnormal flag %s", flag), name
+			}
+		}
+	}
+	return "", name
+}
+
+// prune forgets notified results older than the dedup window
+func (d *CriticalDetector) prune(now time.Time) {
+	for key, notified := range d.seen {
+		if now.Sub(notified) > d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// checkCritical looks for critical results in an ORU message as soon as it is
+// received, before it waits in the processing queue, and hands them to the
+// notifier. It returns false if the server is stopping.
+func (s *HL7Server) checkCritical(message *HL7Message) bool {
+	if s.critical == nil {
+		return true
+	}
+	if msh := message.MSH(); msh == nil || msh.MessageType() != HL7_MSG_ORU {
+		return true
+	}
+
+	for _, alert := range s.critical.Check(ExtractObservations(message), message.Time) {
+		metricCriticalResults.Inc(alert.Code)
+		select {
+		case s.criticalChan <- alert:
+		case <-s.stopChan:
+			return false
+		}
+	}
+	return true
+}
+
+// notifyCritical sends critical result alerts until the server stops. It
+// runs apart from message processing and the routine event bus publishing so
+// that a backlog there does not delay notifications.
+func (s *HL7Server) notifyCritical() {
+	for {
+		select {
+		case alert := <-s.criticalChan:
+			s.sendCritical(alert)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// sendCritical logs a critical result alert, publishes it, posts it to the
+// webhook and passes it to the critical result handler
+func (s *HL7Server) sendCritical(alert *LabCriticalAlert) {
+	s.logf(LOG_LEVEL_WARN, "Alert %s for patient %s: %s", alert.Type, s.loggedPatientID(alert.PatientID), alert.Message)
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		s.reportError("notify", "", err)
+		return
+	}
+	if s.publisher != nil {
+		if err := s.publisher.Publish(HL7_CRITICAL_TOPIC, alert.PatientID, payload); err != nil {
+			s.reportError("publish", "", err)
+		}
+	}
+
+	config := s.settings().LabCritical
+	if config.WebhookURL != "" && s.observer != nil {
+		s.observe(OBSERVER_OUTPUT_WEBHOOK, config.WebhookURL, alert.PatientID, "", payload)
+	} else if config.WebhookURL != "" {
+		if err := postWebhook(config.WebhookURL, config.Timeout, config.Transport, payload); err != nil {
+			s.reportError("notify", "", err)
+		}
+	}
+
+	if s.onCritical != nil {
+		s.onCritical(alert)
+	}
+}
+
+// postWebhook POSTs a JSON payload and expects a 2xx response
+func postWebhook(url string, timeout int, settings transport.Config, payload []byte) error {
+	if timeout <= 0 {
+		timeout = CRITICAL_NOTIFY_TIMEOUT
+	}
+	client, err := settings.HTTPClient(time.Duration(timeout) * time.Second)
+	if err != nil {
+		return fmt.Errorf("webhook failed: %v", err)
+	}
+	response, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("webhook failed: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cutover comparison defaults
+const (
+	CUTOVER_TIME_TOLERANCE = 5 * time.Second // Largest difference of observation times that still match
+)
+
+// Kinds of discrepancies between the legacy engine and the gateway
+const (
+	DISCREPANCY_MISSING = "missing" // Sent by the legacy engine only
+	DISCREPANCY_EXTRA   = "extra"   // Sent by the gateway only
+	DISCREPANCY_VALUE   = "value"   // Different values
+	DISCREPANCY_UNIT    = "unit"    // Different units
+	DISCREPANCY_STATUS  = "status"  // Different result status (OBX-11)
+)
+
+// CutoverConfig configures a CutoverComparator
+type CutoverConfig struct {
+	TimeTolerance  time.Duration // CUTOVER_TIME_TOLERANCE if 0
+	ValueTolerance float64       // Largest absolute difference of numeric values that still match
+}
+
+// CutoverObservation is an observation sent by one of the systems
+type CutoverObservation struct {
+	MessageID    string    `json:"message_id"`
+	PatientID    string    `json:"patient_id"`
+	Parameter    string    `json:"parameter"` // OBX-3.1, or OBX-3.2 if there is no code
+	Time         time.Time `json:"time"`
+	Value        string    `json:"value"`
+	NumericValue *float64  `json:"numeric_value,omitempty"`
+	Unit         string    `json:"unit"` // OBX-6.1, or OBX-6.2 if there is no code
+	ResultStatus string    `json:"result_status,omitempty"`
+}
+
+// CutoverDiscrepancy is a difference between the outputs of the two systems
+type CutoverDiscrepancy struct {
+	Kind      string              `json:"kind"`
+	PatientID string              `json:"patient_id"`
+	Parameter string              `json:"parameter"`
+	Time      time.Time           `json:"time"`
+	Legacy    *CutoverObservation `json:"legacy,omitempty"`
+	Gateway   *CutoverObservation `json:"gateway,omitempty"`
+}
+
+// CutoverReport is the result of a comparison
+type CutoverReport struct {
+	LegacyObservations  int                  `json:"legacy_observations"`
+	GatewayObservations int                  `json:"gateway_observations"`
+	Matched             int                  `json:"matched"` // Pairs of observations that match, including pairs with value, unit or status discrepancies
+	ByKind              map[string]int       `json:"by_kind"`
+	ByParameter         map[string]int       `json:"by_parameter"` // Discrepancies per parameter
+	Discrepancies       []CutoverDiscrepancy `json:"discrepancies"`
+}
+
+// Equivalent reports whether the two systems sent the same observations
+func (r *CutoverReport) Equivalent() bool {
+	return len(r.Discrepancies) == 0
+}
+
+// cutoverKey groups the observations that may match
+type cutoverKey struct {
+	patientID string
+	parameter string
+}
+
+// CutoverComparator compares the outbound messages of a legacy interface
+// engine and of the gateway, run in parallel during a migration. The
+// observations of both are matched by patient, parameter and time; pairs
+// are then compared by value, unit and result status, and observations
+// without a counterpart are reported as missing or extra.
+type CutoverComparator struct {
+	config  CutoverConfig
+	legacy  []CutoverObservation
+	gateway []CutoverObservation
+}
+
+// NewCutoverComparator creates a comparator
+func NewCutoverComparator(config CutoverConfig) *CutoverComparator {
+	if config.TimeTolerance <= 0 {
+		config.TimeTolerance = CUTOVER_TIME_TOLERANCE
+	}
+	return &CutoverComparator{config: config}
+}
+
+// AddLegacy adds the observations of a message sent by the legacy engine
+func (c *CutoverComparator) AddLegacy(message *HL7Message) {
+	c.legacy = append(c.legacy, cutoverObservations(message)...)
+}
+
+// AddGateway adds the observations of a message sent by the gateway
+func (c *CutoverComparator) AddGateway(message *HL7Message) {
+	c.gateway = append(c.gateway, cutoverObservations(message)...)
+}
+
+// cutoverObservations returns the observations of a message
+func cutoverObservations(message *HL7Message) []CutoverObservation {
+	set := ExtractObservations(message)
+	observations := make([]CutoverObservation, 0, len(set.Observations))
+	for _, observation := range set.Observations {
+		parameter := observation.Code
+		if parameter == "" {
+			parameter = observation.ReferenceID
+		}
+		unit := observation.UnitCode
+		if unit == "" {
+			unit = observation.Unit
+		}
+		observations = append(observations, CutoverObservation{
+			MessageID:    set.MessageControlID,
+			PatientID:    set.PatientID,
+			Parameter:    parameter,
+			Time:         observation.Timestamp,
+			Value:        observation.Value,
+			NumericValue: observation.NumericValue,
+			Unit:         unit,
+			ResultStatus: observation.ResultStatus,
+		})
+	}
+	return observations
+}
+
+// Compare matches the observations added so far and reports the discrepancies
+func (c *CutoverComparator) Compare() *CutoverReport {
+	report := &CutoverReport{
+		LegacyObservations:  len(c.legacy),
+		GatewayObservations: len(c.gateway),
+		ByKind:              make(map[string]int),
+		ByParameter:         make(map[string]int),
+		Discrepancies:       make([]CutoverDiscrepancy, 0),
+	}
+
+	legacy := groupCutoverObservations(c.legacy)
+	gateway := groupCutoverObservations(c.gateway)
+	keys := make([]cutoverKey, 0, len(legacy)+len(gateway))
+	for key := range legacy {
+		keys = append(keys, key)
+	}
+	for key := range gateway {
+		if _, ok := legacy[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].patientID != keys[j].patientID {
+			return keys[i].patientID < keys[j].patientID
+		}
+		return keys[i].parameter < keys[j].parameter
+	})
+
+	for _, key := range keys {
+		c.compareGroup(report, legacy[key], gateway[key])
+	}
+
+	sort.SliceStable(report.Discrepancies, func(i, j int) bool {
+		return report.Discrepancies[i].Time.Before(report.Discrepancies[j].Time)
+	})
+	return report
+}
+
+// groupCutoverObservations groups observations by patient and parameter, in time order
+func groupCutoverObservations(observations []CutoverObservation) map[cutoverKey][]*CutoverObservation {
+	groups := make(map[cutoverKey][]*CutoverObservation)
+	for i := range observations {
+		observation := &observations[i]
+		key := cutoverKey{patientID: observation.PatientID, parameter: observation.Parameter}
+		groups[key] = append(groups[key], observation)
+	}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Time.Before(group[j].Time)
+		})
+	}
+	return groups
+}
+
+// compareGroup matches the observations of one patient and parameter. Both
+// are in time order; each legacy observation is paired with the earliest
+// unpaired gateway observation within the time tolerance.
+func (c *CutoverComparator) compareGroup(report *CutoverReport, legacy, gateway []*CutoverObservation) {
+	next := 0
+	for _, old := range legacy {
+		// Gateway observations too early for this legacy one have no counterpart
+		for next < len(gateway) && old.Time.Sub(gateway[next].Time) > c.config.TimeTolerance {
+			c.addDiscrepancy(report, DISCREPANCY_EXTRA, nil, gateway[next])
+			next++
+		}
+		if next == len(gateway) || gateway[next].Time.Sub(old.Time) > c.config.TimeTolerance {
+			c.addDiscrepancy(report, DISCREPANCY_MISSING, old, nil)
+			continue
+		}
+
+		current := gateway[next]
+		next++
+		report.Matched++
+		switch {
+		case !c.sameValue(old, current):
+			c.addDiscrepancy(report, DISCREPANCY_VALUE, old, current)
+		case old.Unit != current.Unit:
+			c.addDiscrepancy(report, DISCREPANCY_UNIT, old, current)
+		case old.ResultStatus != current.ResultStatus:
+			c.addDiscrepancy(report, DISCREPANCY_STATUS, old, current)
+		}
+	}
+	for ; next < len(gateway); next++ {
+		c.addDiscrepancy(report, DISCREPANCY_EXTRA, nil, gateway[next])
+	}
+}
+
+// sameValue compares numeric values within the tolerance and other values as text
+func (c *CutoverComparator) sameValue(legacy, gateway *CutoverObservation) bool {
+	if legacy.NumericValue != nil && gateway.NumericValue != nil {
+		return math.Abs(*legacy.NumericValue-*gateway.NumericValue) <= c.config.ValueTolerance
+	}
+	return strings.TrimSpace(legacy.Value) == strings.TrimSpace(gateway.Value)
+}
+
+// addDiscrepancy adds a discrepancy to the report
+func (c *CutoverComparator) addDiscrepancy(report *CutoverReport, kind string, legacy, gateway *CutoverObservation) {
+	observation := legacy
+	if observation == nil {
+		observation = gateway
+	}
+	report.Discrepancies = append(report.Discrepancies, CutoverDiscrepancy{
+		Kind:      kind,
+		PatientID: observation.PatientID,
+		Parameter: observation.Parameter,
+		Time:      observation.Time,
+		Legacy:    legacy,
+		Gateway:   gateway,
+	})
+	report.ByKind[kind]++
+	report.ByParameter[observation.Parameter]++
+}
+
+// ReadHL7Messages reads the messages of a capture of outbound traffic:
+// MLLP framed messages, messages separated by line breaks (each starting
+// with MSH) or JSON lines of observer mode outputs (see ObserverOutput),
+// of which the published messages and the messages buffered for sync are
+// returned once each
+func ReadHL7Messages(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages: %v", err)
+	}
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) == 0:
+		return nil, nil
+	case trimmed[0] == MLLP_START_BLOCK:
+		return readMLLPMessages(trimmed), nil
+	case trimmed[0] == '{':
+		return readObserverMessages(trimmed)
+	}
+	return readLineMessages(trimmed), nil
+}
+
+// readMLLPMessages splits MLLP framed messages
+func readMLLPMessages(data []byte) []string {
+	messages := make([]string, 0)
+	for _, block := range bytes.Split(data, []byte{MLLP_START_BLOCK}) {
+		if end := bytes.IndexByte(block, MLLP_END_BLOCK); end >= 0 {
+			block = block[:end]
+		}
+		if message := strings.TrimSpace(string(block)); message != "" {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// readLineMessages splits messages whose segments are separated by CR, LF
+// or CRLF; every MSH segment starts a new message
+func readLineMessages(data []byte) []string {
+	messages := make([]string, 0)
+	var segments []string
+	flush := func() {
+		if len(segments) > 0 {
+			messages = append(messages, strings.Join(segments, "\r"))
+			segments = nil
+		}
+	}
+	normalized := strings.ReplaceAll(strings.ReplaceAll(string(data), "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(normalized, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, HL7_SEG_MSH+"|") {
+			flush()
+		}
+		segments = append(segments, line)
+	}
+	flush()
+	return messages
+}
+
+// readObserverMessages returns the HL7 messages of observer mode outputs
+func readObserverMessages(data []byte) ([]string, error) {
+	messages := make([]string, 0)
+	seen := make(map[string]bool) // A message is both published and buffered for sync
+	add := func(raw string) {
+		if raw != "" && !seen[raw] {
+			seen[raw] = true
+			messages = append(messages, raw)
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var output ObserverOutput
+		if err := json.Unmarshal(scanner.Bytes(), &output); err != nil {
+			return nil, fmt.Errorf("invalid observer output on line %d: %v", line, err)
+		}
+		switch output.Kind {
+		case OBSERVER_OUTPUT_PUBLISH:
+			var message struct {
+				Raw string `json:"raw_message"`
+			}
+			if json.Unmarshal(output.Payload, &message) == nil {
+				add(message.Raw)
+			}
+		case OBSERVER_OUTPUT_REMOTE:
+			var raw string
+			if json.Unmarshal(output.Payload, &raw) == nil {
+				add(raw)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read observer outputs: %v", err)
+	}
+	return messages, nil
+}
@@ -0,0 +1,188 @@
+package hl7
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Outputs that receive de-identified messages
+const (
+	DEIDENTIFY_PUBLISH = "publish" // Messages published to the event bus, keyed by the pseudonym
+	DEIDENTIFY_LOG     = "log"     // Message dumps and patient IDs in the server log
+)
+
+// DEIDENTIFY_DATE_SHIFT_DAYS is the default largest shift of dates of birth and death
+const DEIDENTIFY_DATE_SHIFT_DAYS = 180
+
+// DEIDENTIFY_HASH_LENGTH is the number of hex digits of a pseudonym
+const DEIDENTIFY_HASH_LENGTH = 16
+
+// DeidentifyConfig configures the de-identification of messages sent to
+// research feeds. Identifiers are replaced by keyed hashes, so that the
+// messages of one patient can still be linked without revealing who it is.
+type DeidentifyConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Salt          string   `json:"salt"`            // Secret key of the hashes (or set HL7_DEIDENTIFY_SALT); changing it changes every pseudonym
+	DateShiftDays int      `json:"date_shift_days"` // Largest shift of dates of birth and death, the same for every message of a patient (0: 180)
+	Outputs       []string `json:"outputs"`         // publish and/or log (empty: both); router destinations set deidentify themselves
+}
+
+// deidentifyRule lists what is done to the fields of a segment
+type deidentifyRule struct {
+	hash  []int // Identifiers (CX): the ID of every repetition is replaced by its pseudonym
+	clear []int // Names, addresses, phone numbers and other identifiers are removed
+	shift []int // Dates (TS) are shifted by the offset of the patient
+}
+
+// deidentifyRules are the identifying fields of PID, NK1 and PV1 (HL7 v2.5)
+var deidentifyRules = map[string]deidentifyRule{
+	HL7_SEG_PID: {
+		hash:  []int{2, 3, 4, 18, 21},
+		clear: []int{5, 6, 9, 11, 12, 13, 14, 19, 20, 23},
+		shift: []int{7, 29},
+	},
+	"NK1": {
+		hash:  []int{33},
+		clear: []int{2, 4, 5, 6, 30, 31, 32, 37},
+		shift: []int{16},
+	},
+	HL7_SEG_PV1: {
+		hash:  []int{19, 50},
+		clear: []int{7, 8, 9, 17, 52},
+	},
+}
+
+// Deidentifier removes the patient identifying fields of PID, NK1 and PV1
+// segments. It is safe for concurrent use.
+type Deidentifier struct {
+	salt      []byte
+	shiftDays int
+	parser    *HL7Parser
+}
+
+// NewDeidentifier creates a de-identifier
+func NewDeidentifier(config DeidentifyConfig) *Deidentifier {
+	shiftDays := config.DateShiftDays
+	if shiftDays <= 0 {
+		shiftDays = DEIDENTIFY_DATE_SHIFT_DAYS
+	}
+	return &Deidentifier{salt: []byte(config.Salt), shiftDays: shiftDays, parser: NewHL7Parser()}
+}
+
+// Pseudonym returns the keyed hash that replaces an identifier. The same
+// identifier always gets the same pseudonym; empty stays empty.
+func (d *Deidentifier) Pseudonym(id string) string {
+	if id == "" {
+		return ""
+	}
+	return hex.EncodeToString(d.digest(id))[:DEIDENTIFY_HASH_LENGTH]
+}
+
+// digest returns the HMAC-SHA256 of a value with the salt
+func (d *Deidentifier) digest(value string) []byte {
+	mac := hmac.New(sha256.New, d.salt)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// DateShift returns the number of days the dates of a patient are moved:
+// between 1 and the configured maximum, earlier or later, derived from the
+// patient ID so that it is the same in every message
+func (d *Deidentifier) DateShift(patientID string) int {
+	value := binary.BigEndian.Uint32(d.digest("date-shift:" + patientID)[:4])
+	days := int(value%uint32(d.shiftDays)) + 1
+	if value&1 == 1 {
+		days = -days
+	}
+	return days
+}
+
+// Apply returns a de-identified copy of a message. The message itself is
+// not changed. The visit number assigned by the server is replaced by its
+// pseudonym too.
+func (d *Deidentifier) Apply(message *HL7Message) (*HL7Message, error) {
+	working, err := d.parser.ParseMessage(message.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy message %s: %v", message.ID, err)
+	}
+	shift := d.DateShift(message.GetPatientID())
+
+	for i := range working.Segments {
+		segment := &working.Segments[i]
+		rule, found := deidentifyRules[segment.Type]
+		if !found {
+			continue
+		}
+		for _, position := range rule.hash {
+			for _, repetition := range segment.Repetitions(position) {
+				if id := repetition.ComponentValue(1); id != "" {
+					repetition.SetComponentValue(1, d.Pseudonym(id))
+				}
+			}
+		}
+		for _, position := range rule.clear {
+			if segment.Field(position) != nil {
+				segment.SetFieldValue(position, "")
+			}
+		}
+		for _, position := range rule.shift {
+			if value := segment.Component(position, 1); value != "" {
+				segment.SetFieldValue(position, shiftHL7Date(value, shift))
+			}
+		}
+	}
+
+	deidentified, err := d.parser.ParseMessage(working.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("de-identified message %s is invalid: %v", message.ID, err)
+	}
+	deidentified.Time = message.Time
+	deidentified.VisitNumber = d.Pseudonym(message.VisitNumber)
+	return deidentified, nil
+}
+
+// shiftHL7Date moves the date of an HL7 timestamp by days, keeping the time
+// of day and the offset. A value without a full date keeps only its year.
+func shiftHL7Date(value string, days int) string {
+	if len(value) < 8 {
+		if len(value) > 4 {
+			return value[:4]
+		}
+		return value
+	}
+	date, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return ""
+	}
+	return date.AddDate(0, 0, days).Format("20060102") + value[8:]
+}
+
+// deidentifies reports whether an output receives de-identified messages
+func (s *HL7Server) deidentifies(output string) bool {
+	if s.deidentifier == nil {
+		return false
+	}
+	outputs := s.settings().Deidentify.Outputs
+	if len(outputs) == 0 {
+		return true
+	}
+	for _, name := range outputs {
+		if name == output {
+			return true
+		}
+	}
+	return false
+}
+
+// loggedPatientID returns the patient ID to write to the log: its pseudonym
+// if the log is de-identified
+func (s *HL7Server) loggedPatientID(patientID string) string {
+	if s.deidentifies(DEIDENTIFY_LOG) {
+		return s.deidentifier.Pseudonym(patientID)
+	}
+	return patientID
+}
@@ -0,0 +1,113 @@
+package hl7
+
+import (
+	"github.com/harusin0516/healthcare/driver/stream"
+)
+
+// Names replaced in API version 1.0, kept until version 2.0 (see APIVersion)
+
+// GetFieldValue returns the value of a field of the first segment of a
+// type by index into Fields (0-based; for MSH, index 0 is MSH-2).
+//
+// Deprecated: use GetSegmentByType(segmentType).FieldValue(position), which
+// takes the HL7 position.
+func (m *HL7Message) GetFieldValue(segmentType string, fieldIndex int) string {
+	segment := m.GetSegmentByType(segmentType)
+	if segment == nil || fieldIndex >= len(segment.Fields) {
+		return ""
+	}
+	return segment.Fields[fieldIndex].Value
+}
+
+// GetComponentValue returns the value of a component of a field of the
+// first segment of a type, by 0-based indexes.
+//
+// Deprecated: use GetSegmentByType(segmentType).Component(position,
+// component), which takes HL7 positions and handles repetitions.
+func (m *HL7Message) GetComponentValue(segmentType string, fieldIndex, componentIndex int) string {
+	segment := m.GetSegmentByType(segmentType)
+	if segment == nil || fieldIndex >= len(segment.Fields) {
+		return ""
+	}
+
+	field := segment.Fields[fieldIndex]
+	if componentIndex >= len(field.Components) {
+		return ""
+	}
+
+	return field.Components[componentIndex].Value
+}
+
+// GetServerStatus returns the server status information.
+//
+// Deprecated: use Status.
+func (s *HL7Server) GetServerStatus() map[string]interface{} {
+	return s.Status()
+}
+
+// GetConnectedClients returns the list of connected clients.
+//
+// Deprecated: use Clients.
+func (s *HL7Server) GetConnectedClients() []*Client {
+	return s.Clients()
+}
+
+// GetClientCount returns the number of connected clients.
+//
+// Deprecated: use ClientCount.
+func (s *HL7Server) GetClientCount() int {
+	return s.ClientCount()
+}
+
+// GetMessageStats returns the message counters and the most recent messages.
+//
+// Deprecated: use Stats.
+func (s *HL7Server) GetMessageStats() MessageStats {
+	return s.Stats()
+}
+
+// GetCrashReports returns the most recent crash reports (oldest first).
+//
+// Deprecated: use CrashReports.
+func (s *HL7Server) GetCrashReports() []*CrashReport {
+	return s.CrashReports()
+}
+
+// SetStreamHub streams observations and infusion pump states to hub.
+//
+// Deprecated: use SetStream, which accepts any stream.Publisher.
+func (s *HL7Server) SetStreamHub(hub *stream.Hub) {
+	if hub == nil {
+		s.SetStream(nil)
+		return
+	}
+	s.SetStream(hub)
+}
+
+// GetStatus returns the current status of the HL7 driver.
+//
+// Deprecated: use Status.
+func (d *HL7Driver) GetStatus() map[string]interface{} {
+	return d.Status()
+}
+
+// GetConnectedClients returns the list of connected clients.
+//
+// Deprecated: use Clients.
+func (d *HL7Driver) GetConnectedClients() []*Client {
+	return d.Clients()
+}
+
+// GetMessageStats returns the message counters and the most recent messages.
+//
+// Deprecated: use Stats.
+func (d *HL7Driver) GetMessageStats() MessageStats {
+	return d.Stats()
+}
+
+// SetStreamHub streams observations and infusion pump states to hub.
+//
+// Deprecated: use SetStream.
+func (d *HL7Driver) SetStreamHub(hub *stream.Hub) {
+	d.server.SetStreamHub(hub)
+}
@@ -0,0 +1,200 @@
+package hl7
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EUI-64 formatting
+const (
+	EUI64_TYPE   = "EUI-64" // Universal ID type of device identifiers (MSH-3.3, OBR-2.4)
+	EUI64_MAC_ID = "FFFE"   // Inserted between the OUI and the NIC part of a MAC address
+)
+
+// DeviceIdentity identifies a monitor in the HL7 messages generated for it:
+// its EUI-64 (MSH-3, OBR-2/OBR-3, OBX-18), its model (OBX-18) and its bed
+type DeviceIdentity struct {
+	PlugID int    `json:"plug_id"`       // DRI plug ID of the monitor
+	EUI64  string `json:"eui64"`         // 16 hexadecimal digits (empty: derived from MAC)
+	MAC    string `json:"mac,omitempty"` // MAC address the EUI-64 is derived from
+	Model  string `json:"model"`         // e.g. B1X5_GE
+	Bed    string `json:"bed"`           // PV1-3 as point of care^room^bed
+}
+
+// ParseEUI64 returns an EUI-64 as 16 upper-case hexadecimal digits. Colons,
+// hyphens and spaces between the digits are ignored.
+func ParseEUI64(value string) (string, error) {
+	digits := strings.NewReplacer(":", "", "-", "", " ", "").Replace(strings.TrimSpace(value))
+	if len(digits) != 16 {
+		return "", fmt.Errorf("EUI-64 must have 16 hexadecimal digits, got %q", value)
+	}
+	if _, err := hex.DecodeString(digits); err != nil {
+		return "", fmt.Errorf("EUI-64 must have 16 hexadecimal digits, got %q", value)
+	}
+	return strings.ToUpper(digits), nil
+}
+
+// EUI64FromMAC derives the EUI-64 of a device from its MAC address by
+// inserting FFFE between the OUI and the rest, as the GE monitors do
+// (08:00:19:13:45:35 becomes 080019FFFE134535). The address can be written
+// with colons, hyphens, dots or as 12 digits.
+func EUI64FromMAC(mac string) (string, error) {
+	mac = strings.TrimSpace(mac)
+	var address net.HardwareAddr
+	if len(mac) == 12 {
+		decoded, err := hex.DecodeString(mac)
+		if err != nil {
+			return "", fmt.Errorf("invalid MAC address %q", mac)
+		}
+		address = decoded
+	} else {
+		parsed, err := net.ParseMAC(mac)
+		if err != nil {
+			return "", fmt.Errorf("invalid MAC address %q", mac)
+		}
+		address = parsed
+	}
+	digits := strings.ToUpper(hex.EncodeToString(address))
+	switch len(address) {
+	case 6:
+		return digits[:6] + EUI64_MAC_ID + digits[6:], nil
+	case 8:
+		return digits, nil
+	default:
+		return "", fmt.Errorf("MAC address %q is neither 48 nor 64 bits", mac)
+	}
+}
+
+// Normalize derives the EUI-64 from the MAC address if it is not set and
+// formats it as 16 upper-case digits
+func (d *DeviceIdentity) Normalize() error {
+	if d.EUI64 == "" {
+		if d.MAC == "" {
+			return fmt.Errorf("device %d: eui64 or mac is required", d.PlugID)
+		}
+		eui64, err := EUI64FromMAC(d.MAC)
+		if err != nil {
+			return fmt.Errorf("device %d: %v", d.PlugID, err)
+		}
+		d.EUI64 = eui64
+		return nil
+	}
+	eui64, err := ParseEUI64(d.EUI64)
+	if err != nil {
+		return fmt.Errorf("device %d: %v", d.PlugID, err)
+	}
+	d.EUI64 = eui64
+	return nil
+}
+
+// SendingApplication returns MSH-3 of the messages of the device: the
+// application, the EUI-64 and its type (VSP^080019FFFE134535^EUI-64)
+func (d DeviceIdentity) SendingApplication(application string) string {
+	return escapeHL7(application) + "^" + escapeHL7(d.EUI64) + "^" + EUI64_TYPE
+}
+
+// EquipmentIdentifier returns OBX-18 of the observations of the device:
+// the EUI-64 and the model (080019FFFE134535^B1X5_GE)
+func (d DeviceIdentity) EquipmentIdentifier() string {
+	if d.Model == "" {
+		return escapeHL7(d.EUI64)
+	}
+	return escapeHL7(d.EUI64) + "^" + escapeHL7(d.Model)
+}
+
+// PCDDevice returns the device of a PCD-01 report with the given channels
+func (d DeviceIdentity) PCDDevice(channels []PCDChannel) PCDDevice {
+	return PCDDevice{EUI64: d.EUI64, Model: d.Model, Channels: channels}
+}
+
+// DeviceRegistry maps the DRI plug IDs of the monitors of a deployment to
+// their identities, so that the HL7 messages generated from DRI data are
+// attributed to the right device and bed. It is safe for concurrent use.
+type DeviceRegistry struct {
+	mutex   sync.RWMutex
+	devices map[int]DeviceIdentity
+}
+
+// NewDeviceRegistry creates an empty registry
+func NewDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{devices: make(map[int]DeviceIdentity)}
+}
+
+// LoadDeviceRegistry reads a registry from a JSON file holding a list of
+// device identities
+func LoadDeviceRegistry(filename string) (*DeviceRegistry, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device registry: %v", err)
+	}
+	var identities []DeviceIdentity
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return nil, fmt.Errorf("failed to decode device registry: %v", err)
+	}
+	registry := NewDeviceRegistry()
+	for _, identity := range identities {
+		if err := registry.Register(identity); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return registry, nil
+}
+
+// Register adds or replaces the identity of the monitor with its plug ID.
+// An EUI-64 can belong to one plug ID only.
+func (r *DeviceRegistry) Register(identity DeviceIdentity) error {
+	if err := identity.Normalize(); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for plugID, existing := range r.devices {
+		if plugID != identity.PlugID && existing.EUI64 == identity.EUI64 {
+			return fmt.Errorf("device %d: EUI-64 %s is already registered for device %d", identity.PlugID, identity.EUI64, plugID)
+		}
+	}
+	r.devices[identity.PlugID] = identity
+	return nil
+}
+
+// Lookup returns the identity of the monitor with a plug ID
+func (r *DeviceRegistry) Lookup(plugID int) (DeviceIdentity, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	identity, exists := r.devices[plugID]
+	return identity, exists
+}
+
+// ByEUI64 returns the identity of the monitor with an EUI-64
+func (r *DeviceRegistry) ByEUI64(eui64 string) (DeviceIdentity, bool) {
+	eui64, err := ParseEUI64(eui64)
+	if err != nil {
+		return DeviceIdentity{}, false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, identity := range r.devices {
+		if identity.EUI64 == eui64 {
+			return identity, true
+		}
+	}
+	return DeviceIdentity{}, false
+}
+
+// Devices returns the registered identities ordered by plug ID
+func (r *DeviceRegistry) Devices() []DeviceIdentity {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	devices := make([]DeviceIdentity, 0, len(r.devices))
+	for _, identity := range r.devices {
+		devices = append(devices, identity)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].PlugID < devices[j].PlugID })
+	return devices
+}
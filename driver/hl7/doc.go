@@ -0,0 +1,4 @@
+// Package hl7 receives HL7 v2 messages from GE Healthcare vital monitors
+// over MLLP, parses them to JSON and routes them to storage, publishers and
+// FHIR. The server binary is cmd/hl7-server.
+package hl7
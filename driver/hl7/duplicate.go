@@ -0,0 +1,116 @@
+package hl7
+
+import (
+	"sync"
+	"time"
+)
+
+// Duplicate detection defaults
+const (
+	DUPLICATE_WINDOW         = 600         // Seconds a control ID is remembered
+	DUPLICATE_PRUNE_INTERVAL = time.Second // Shortest time between two prunes of the seen control IDs
+)
+
+// DuplicateConfig configures the detection of retransmitted messages
+type DuplicateConfig struct {
+	Enabled bool `json:"enabled"`
+	Window  int  `json:"window"` // Seconds a control ID (MSH-10) is remembered per sending application (0: 600)
+}
+
+// DuplicateDetector remembers the control IDs (MSH-10) of recently accepted
+// messages per sending application (MSH-3 and MSH-4), so that a message a
+// sender retransmits, e.g. because the acknowledgment was lost, is not
+// processed twice. It is safe for concurrent use.
+type DuplicateDetector struct {
+	window time.Duration
+	mutex  sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// NewDuplicateDetector creates a detector for the configured window
+func NewDuplicateDetector(config DuplicateConfig) *DuplicateDetector {
+	window := config.Window
+	if window <= 0 {
+		window = DUPLICATE_WINDOW
+	}
+	return &DuplicateDetector{
+		window: time.Duration(window) * time.Second,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// duplicateKey identifies a message by its sender and control ID; empty if
+// the message has no control ID
+func duplicateKey(message *HL7Message) string {
+	msh := message.MSH()
+	if msh == nil || msh.ControlID() == "" {
+		return ""
+	}
+	return msh.SendingApplication() + "^" + msh.SendingFacility() + "|" + msh.ControlID()
+}
+
+// Seen reports whether the control ID of a message was seen within the
+// window, and remembers it if it was not. Messages without a control ID are
+// never duplicates.
+func (d *DuplicateDetector) Seen(message *HL7Message, now time.Time) bool {
+	key := duplicateKey(message)
+	if key == "" {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if now.Sub(d.pruned) >= DUPLICATE_PRUNE_INTERVAL {
+		d.prune(now)
+		d.pruned = now
+	}
+	if seen, exists := d.seen[key]; exists && now.Sub(seen) <= d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// Forget removes the control ID of a message that was not accepted, so that
+// its retransmission is processed
+func (d *DuplicateDetector) Forget(message *HL7Message) {
+	key := duplicateKey(message)
+	if key == "" {
+		return
+	}
+	d.mutex.Lock()
+	delete(d.seen, key)
+	d.mutex.Unlock()
+}
+
+// Count returns the number of control IDs remembered
+func (d *DuplicateDetector) Count() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.seen)
+}
+
+// prune forgets control IDs older than the window
+func (d *DuplicateDetector) prune(now time.Time) {
+	for key, seen := range d.seen {
+		if now.Sub(seen) > d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// checkDuplicate reports whether a message is a retransmission of a message
+// accepted within the duplicate window
+func (s *HL7Server) checkDuplicate(message *HL7Message, clientID string) bool {
+	if s.duplicates == nil || !s.duplicates.Seen(message, s.clock.Now()) {
+		return false
+	}
+	messageType := ""
+	if msh := message.MSH(); msh != nil {
+		messageType = msh.MessageType()
+	}
+	metricDuplicateMessages.Inc(messageType)
+	s.logf(LOG_LEVEL_INFO, "Duplicate HL7 message %s from %s acknowledged without processing", message.ID, clientID)
+	return true
+}
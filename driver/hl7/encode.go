@@ -0,0 +1,139 @@
+package hl7
+
+import (
+	"strings"
+)
+
+// Encode regenerates the message in HL7 wire format from its segments, with
+// the encoding characters declared in MSH-1 and MSH-2 (the defaults if the
+// message has no MSH). Every segment is terminated by a carriage return.
+// Fields can be changed with the segment setters before the message is
+// forwarded. An unchanged message parsed from segments terminated by a
+// single CR encodes to its raw message without the MLLP wrapper; ParseMessage
+// splits segments on CR only and trims the white space around them, so LF
+// and CRLF line ends are not reproduced.
+func (m *HL7Message) Encode() string {
+	config := m.EncodingConfig()
+	var builder strings.Builder
+	for i := range m.Segments {
+		builder.WriteString(m.Segments[i].Encode(config))
+		builder.WriteString("\r")
+	}
+	return builder.String()
+}
+
+// EncodingConfig returns the default parser configuration with the encoding
+// characters declared by the message header (MSH-1, MSH-2)
+func (m *HL7Message) EncodingConfig() HL7Config {
+	config := DefaultHL7Config()
+	msh := m.MSH()
+	if msh == nil {
+		return config
+	}
+	if separator := msh.FieldValue(1); separator != "" {
+		config.FieldSeparator = separator
+	}
+	separators := []*string{
+		&config.ComponentSeparator,
+		&config.RepetitionSeparator,
+		&config.EscapeCharacter,
+		&config.SubcomponentSeparator,
+	}
+	encoding := msh.EncodingCharacters()
+	for i, separator := range separators {
+		if i < len(encoding) {
+			*separator = encoding[i : i+1]
+		}
+	}
+	if msh.Version() != "" {
+		config.Version = msh.Version()
+	}
+	return config
+}
+
+// Encode serializes the segment with the separators of config. MSH-2 (and
+// FHS-2, BHS-2) is written as stored, since it holds the encoding characters.
+func (s *HL7Segment) Encode(config HL7Config) string {
+	var builder strings.Builder
+	builder.WriteString(s.Type)
+	for i := range s.Fields {
+		builder.WriteString(config.FieldSeparator)
+		if i == 0 && isHeaderSegment(s.Type) {
+			builder.WriteString(s.Fields[i].Value)
+			continue
+		}
+		builder.WriteString(s.Fields[i].Encode(config))
+	}
+	return builder.String()
+}
+
+// Encode serializes the field (every repetition, component and subcomponent)
+// back to raw HL7 with the separators of config. Received values are written
+// as they are, with their escape sequences. A value set by the application
+// (SetFieldValue, SetComponentValue and the typed setters) is plain text:
+// its escape character and delimiters are escaped (\E\, \F\, \S\, \R\, \T\).
+// When the field or a component has parts, Value is not used.
+func (f *HL7Field) Encode(config HL7Config) string {
+	repetitions := make([]string, 0, 1+len(f.Repetitions))
+	repetitions = append(repetitions, f.encodeRepetition(config))
+	for i := range f.Repetitions {
+		repetitions = append(repetitions, f.Repetitions[i].encodeRepetition(config))
+	}
+	return strings.Join(repetitions, config.RepetitionSeparator)
+}
+
+// encodeRepetition serializes one repetition, ignoring Repetitions
+func (f *HL7Field) encodeRepetition(config HL7Config) string {
+	if len(f.Components) == 0 {
+		return escapeValue(f.Value, f.set, config)
+	}
+	components := make([]string, len(f.Components))
+	for i := range f.Components {
+		components[i] = f.Components[i].Encode(config)
+	}
+	return strings.Join(components, config.ComponentSeparator)
+}
+
+// Encode serializes the component and its subcomponents back to raw HL7
+func (c *HL7Component) Encode(config HL7Config) string {
+	if len(c.Subcomponents) == 0 {
+		return escapeValue(c.Value, c.set, config)
+	}
+	subcomponents := make([]string, len(c.Subcomponents))
+	for i, subcomponent := range c.Subcomponents {
+		subcomponents[i] = escapeValue(subcomponent.Value, false, config)
+	}
+	return strings.Join(subcomponents, config.SubcomponentSeparator)
+}
+
+// escapeValue escapes a value for the wire. A value set by the application
+// is plain text, so its escape character is escaped too (\E\); a received
+// value already holds escape sequences and only a delimiter or line break
+// put into it (the parser never stores one) is escaped.
+func escapeValue(value string, set bool, config HL7Config) string {
+	escape := config.EscapeCharacter
+	delimiters := config.FieldSeparator + config.ComponentSeparator +
+		config.RepetitionSeparator + config.SubcomponentSeparator + "\r\n"
+	if set && escape != "" {
+		delimiters += escape
+	}
+	if !strings.ContainsAny(value, delimiters) {
+		return value
+	}
+	var pairs []string
+	if set && escape != "" {
+		pairs = append(pairs, escape, escape+"E"+escape)
+	}
+	for _, delimiter := range []struct{ separator, code string }{
+		{config.FieldSeparator, "F"},
+		{config.ComponentSeparator, "S"},
+		{config.RepetitionSeparator, "R"},
+		{config.SubcomponentSeparator, "T"},
+	} {
+		if delimiter.separator != "" {
+			pairs = append(pairs, delimiter.separator, escape+delimiter.code+escape)
+		}
+	}
+	pairs = append(pairs, "\r", escape+"X0D"+escape, "\n", escape+"X0A"+escape)
+	return strings.NewReplacer(pairs...).Replace(value)
+}
@@ -0,0 +1,85 @@
+package hl7
+
+import (
+	"strings"
+	"testing"
+)
+
+// customEncodingMessage declares MSH-1 '#' and MSH-2 '$*\@' and holds an
+// escape sequence and a repeated field
+const customEncodingMessage = "MSH#$*\\@#MONITOR#ICU#GATEWAY#HOSP#20240601120000##ORU$R01$ORU_R01#CTRL-0042#P#2.5.1\r" +
+	"PID#1##12345$$$HOSP$MR*67890$$$HOSP@1.2@ISO$PI##DOE$JOHN\r" +
+	"OBX#1#ST#8867-4$Heart rate$LN##72\\F\\80#/min###N\r"
+
+func TestEncodeRoundTrip(t *testing.T) {
+	messages := NewSampleHL7Messages().GetAllSampleMessages()
+	messages["Custom_Encoding"] = customEncodingMessage
+
+	parser := NewHL7Parser()
+	for name, raw := range messages {
+		t.Run(name, func(t *testing.T) {
+			message, err := parser.ParseMessage(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.TrimRight(parser.removeMLLPWrapper(raw), "\r") + "\r"
+			if encoded := message.Encode(); encoded != want {
+				t.Errorf("Encode() = %q, want %q", encoded, want)
+			}
+		})
+	}
+}
+
+func TestEncodeSetValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		family  string
+		given   string
+		wantPID string // PID-5 on the wire
+	}{
+		{
+			name:    "default encoding",
+			raw:     NewSampleHL7Messages().GetADTMessage(),
+			family:  `Smith\Jr`,
+			given:   "A|B^C~D&E",
+			wantPID: `Smith\E\Jr^A\F\B\S\C\R\D\T\E`,
+		},
+		{
+			name:    "custom encoding",
+			raw:     customEncodingMessage,
+			family:  `Smith\Jr`,
+			given:   "A#B$C*D@E|^",
+			wantPID: `Smith\E\Jr$A\F\B\S\C\R\D\T\E|^`,
+		},
+	}
+
+	parser := NewHL7Parser()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := parser.ParseMessage(test.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message.PID().SetPatientName(test.family, test.given)
+
+			encoded := message.Encode()
+			reparsed, err := parser.ParseMessage(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pid := reparsed.PID()
+			config := reparsed.EncodingConfig()
+			if got := pid.Field(5).Encode(config); got != test.wantPID {
+				t.Errorf("PID-5 = %q, want %q", got, test.wantPID)
+			}
+			if len(reparsed.Segments) != len(message.Segments) {
+				t.Errorf("reparsed message has %d segments, want %d", len(reparsed.Segments), len(message.Segments))
+			}
+			// The escape sequences received are written unchanged
+			if again := reparsed.Encode(); again != encoded {
+				t.Errorf("re-encoded message = %q, want %q", again, encoded)
+			}
+		})
+	}
+}
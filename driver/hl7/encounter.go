@@ -0,0 +1,298 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Encounter tracking defaults
+const (
+	ENCOUNTER_HISTORY = 20        // Encounters kept per patient
+	ENCOUNTER_CURRENT = "current" // Selects the latest encounter of a patient in the admin API
+)
+
+// EncounterConfig configures the encounter (visit) tracking
+type EncounterConfig struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"` // JSON file the encounters are kept in across restarts (empty: memory only)
+}
+
+// Encounter is one visit of a patient (PV1-19) and the time it was open
+type Encounter struct {
+	PatientID    string     `json:"patient_id"`
+	VisitNumber  string     `json:"visit_number"`
+	PatientClass string     `json:"patient_class,omitempty"` // PV1-2
+	Location     string     `json:"location,omitempty"`      // PV1-3 as point of care^room^bed
+	Start        time.Time  `json:"start"`                   // Admission or registration (MSH-7)
+	End          *time.Time `json:"end,omitempty"`           // Discharge (MSH-7), nil while open
+}
+
+// EncounterTracker follows the encounters of patients from ADT messages so
+// that messages without a visit number (PV1-19), such as monitor results,
+// can be assigned to the encounter open when they were sent. It is safe for
+// concurrent use.
+type EncounterTracker struct {
+	mutex      sync.RWMutex
+	encounters map[string][]*Encounter // By patient ID, oldest first
+	file       string
+	saveMutex  sync.Mutex
+}
+
+// NewEncounterTracker creates a tracker kept in file (memory only if empty),
+// loading the encounters saved by a previous run
+func NewEncounterTracker(file string) (*EncounterTracker, error) {
+	t := &EncounterTracker{
+		encounters: make(map[string][]*Encounter),
+		file:       file,
+	}
+	if file == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return t, fmt.Errorf("failed to read encounters: %v", err)
+	}
+	var encounters []*Encounter
+	if err := json.Unmarshal(data, &encounters); err != nil {
+		return t, fmt.Errorf("invalid encounters %s: %v", file, err)
+	}
+	for _, encounter := range encounters {
+		t.encounters[encounter.PatientID] = append(t.encounters[encounter.PatientID], encounter)
+	}
+	for _, list := range t.encounters {
+		sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	}
+	return t, nil
+}
+
+// Apply updates the encounters from an ADT message sent at t and saves them.
+// Admissions and registrations open an encounter, closing the previous open
+// encounter of the patient; transfers and updates change its class and bed
+// (opening it if it is not known yet); discharges close it. Messages without
+// a patient ID or visit number are ignored. It returns false for messages
+// that do not change the encounters.
+func (t *EncounterTracker) Apply(message *HL7Message, at time.Time) (bool, error) {
+	msh := message.MSH()
+	pv1 := message.PV1()
+	patientID := message.GetPatientID()
+	if msh == nil || msh.MessageType() != HL7_MSG_ADT || pv1 == nil || patientID == "" || pv1.VisitNumber() == "" {
+		return false, nil
+	}
+	visit := pv1.VisitNumber()
+	location := ""
+	if pv1.PointOfCare() != "" || pv1.Room() != "" || pv1.Bed() != "" {
+		location = pv1.PointOfCare() + "^" + pv1.Room() + "^" + pv1.Bed()
+	}
+
+	t.mutex.Lock()
+	changed := false
+	encounter := t.find(patientID, visit)
+	switch msh.TriggerEvent() {
+	case ADT_ADMIT, ADT_REGISTER, ADT_TRANSFER, ADT_UPDATE:
+		if encounter == nil {
+			for _, open := range t.encounters[patientID] {
+				if open.End == nil {
+					end := at
+					open.End = &end
+				}
+			}
+			encounter = &Encounter{PatientID: patientID, VisitNumber: visit, Start: at}
+			list := append(t.encounters[patientID], encounter)
+			if len(list) > ENCOUNTER_HISTORY {
+				list = list[len(list)-ENCOUNTER_HISTORY:]
+			}
+			t.encounters[patientID] = list
+		}
+		encounter.PatientClass = firstNonEmpty(pv1.PatientClass(), encounter.PatientClass)
+		encounter.Location = firstNonEmpty(location, encounter.Location)
+		changed = true
+	case ADT_DISCHARGE:
+		if encounter != nil && encounter.End == nil {
+			end := at
+			encounter.End = &end
+			changed = true
+		}
+	}
+	t.mutex.Unlock()
+
+	if !changed {
+		return false, nil
+	}
+	return true, t.save()
+}
+
+// find returns the encounter of a patient with a visit number, or nil. The caller must hold the lock.
+func (t *EncounterTracker) find(patientID, visit string) *Encounter {
+	for _, encounter := range t.encounters[patientID] {
+		if encounter.VisitNumber == visit {
+			return encounter
+		}
+	}
+	return nil
+}
+
+// VisitFor returns the visit number of the encounter of a patient open at
+// at, or an empty string if the patient had no open encounter then
+func (t *EncounterTracker) VisitFor(patientID string, at time.Time) string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	list := t.encounters[patientID]
+	for i := len(list) - 1; i >= 0; i-- {
+		if !at.Before(list[i].Start) && (list[i].End == nil || at.Before(*list[i].End)) {
+			return list[i].VisitNumber
+		}
+	}
+	return ""
+}
+
+// Encounter returns a copy of the encounter of a patient with a visit
+// number, or of the latest encounter if visit is empty. It returns nil if
+// there is no such encounter.
+func (t *EncounterTracker) Encounter(patientID, visit string) *Encounter {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	encounter := t.find(patientID, visit)
+	if list := t.encounters[patientID]; visit == "" && len(list) > 0 {
+		encounter = list[len(list)-1]
+	}
+	if encounter == nil {
+		return nil
+	}
+	result := *encounter
+	return &result
+}
+
+// count returns the number of encounters held, for the memory monitor
+func (t *EncounterTracker) count() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	count := 0
+	for _, encounters := range t.encounters {
+		count += len(encounters)
+	}
+	return count
+}
+
+// Encounters returns copies of the encounters of a patient, oldest first
+// (all patients if patientID is empty)
+func (t *EncounterTracker) Encounters(patientID string) []*Encounter {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	encounters := make([]*Encounter, 0)
+	for id, list := range t.encounters {
+		if patientID != "" && id != patientID {
+			continue
+		}
+		for _, encounter := range list {
+			result := *encounter
+			encounters = append(encounters, &result)
+		}
+	}
+	sort.Slice(encounters, func(i, j int) bool {
+		if encounters[i].PatientID != encounters[j].PatientID {
+			return encounters[i].PatientID < encounters[j].PatientID
+		}
+		return encounters[i].Start.Before(encounters[j].Start)
+	})
+	return encounters
+}
+
+// Merge moves the encounters of a retired patient ID to the surviving
+// patient ID (A40) and returns the number of encounters moved
+func (t *EncounterTracker) Merge(retiredID, survivingID string) (int, error) {
+	t.mutex.Lock()
+	retired := t.encounters[retiredID]
+	if len(retired) == 0 || retiredID == survivingID {
+		t.mutex.Unlock()
+		return 0, nil
+	}
+	delete(t.encounters, retiredID)
+	list := t.encounters[survivingID]
+	for _, encounter := range retired {
+		encounter.PatientID = survivingID
+		list = append(list, encounter)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	if len(list) > ENCOUNTER_HISTORY {
+		list = list[len(list)-ENCOUNTER_HISTORY:]
+	}
+	t.encounters[survivingID] = list
+	t.mutex.Unlock()
+
+	return len(retired), t.save()
+}
+
+// save writes the encounters to their file under a temporary name and
+// renames it so that a crash never leaves a partial file
+func (t *EncounterTracker) save() error {
+	if t.file == "" {
+		return nil
+	}
+	t.saveMutex.Lock()
+	defer t.saveMutex.Unlock()
+
+	data, err := json.MarshalIndent(t.Encounters(""), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.file), 0700); err != nil {
+		return fmt.Errorf("failed to save encounters: %v", err)
+	}
+	temporary := t.file + ".tmp"
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		return fmt.Errorf("failed to save encounters: %v", err)
+	}
+	if err := os.Rename(temporary, t.file); err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("failed to save encounters: %v", err)
+	}
+	return nil
+}
+
+// assignEncounter records the encounters of ADT messages and sets the visit
+// number of messages without PV1-19 to the encounter of their patient (or
+// of the patient in their bed) open when the message was sent. It runs
+// before the message is stored.
+func (s *HL7Server) assignEncounter(message *HL7Message) {
+	if s.encounters == nil {
+		return
+	}
+	msh := message.MSH()
+	if msh == nil {
+		return
+	}
+	at := message.Time
+	if t, err := ParseHL7Time(msh.DateTime()); err == nil {
+		at = t
+	}
+
+	if msh.MessageType() == HL7_MSG_ADT {
+		if _, err := s.encounters.Apply(message, at); err != nil {
+			s.reportError("encounter", "", err)
+		}
+	}
+
+	pv1 := message.PV1()
+	if pv1 != nil && pv1.VisitNumber() != "" {
+		return
+	}
+	patientID := message.GetPatientID()
+	if patientID == "" && pv1 != nil && s.registry != nil {
+		location := pv1.PointOfCare() + "^" + pv1.Room() + "^" + pv1.Bed()
+		if patient := s.registry.ByLocation(location); patient != nil {
+			patientID = patient.PatientID
+		}
+	}
+	if patientID != "" {
+		message.VisitNumber = s.encounters.VisitFor(patientID, at)
+	}
+}
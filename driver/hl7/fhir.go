@@ -0,0 +1,132 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/harusin0516/healthcare/driver/fhir"
+	"github.com/harusin0516/healthcare/driver/mdc"
+)
+
+// FHIR export results (hl7_fhir_exports_total)
+const (
+	FHIR_EXPORT_OK    = "ok"
+	FHIR_EXPORT_ERROR = "error"
+)
+
+// FHIRMeasurements converts the observations of a set for the FHIR export.
+// Observations are identified by message control ID, OBR set ID and OBX set
+// ID so that a resent message does not create the observations again.
+// Monitor vitals are categorized as vital signs and LOINC coded results as
+// laboratory; infusion pump values have no category. Observations without a
+// value are skipped.
+func FHIRMeasurements(set *ObservationSet) []fhir.Measurement {
+	measurements := make([]fhir.Measurement, 0, len(set.Observations))
+	for i := range set.Observations {
+		observation := &set.Observations[i]
+		if observation.Value == "" {
+			continue
+		}
+
+		id := ""
+		if set.MessageControlID != "" {
+			id = set.MessageControlID
+			if observation.RequestSetID != "" {
+				id += "-" + observation.RequestSetID
+			}
+			id += "-" + observation.SetID
+		}
+
+		category := ""
+		switch {
+		case observation.CodingSystem == "LN":
+			category = fhir.CATEGORY_LABORATORY
+		case observation.CodingSystem == mdc.CODING_SYSTEM && !IsInfusionObservation(observation):
+			category = fhir.CATEGORY_VITAL_SIGNS
+		}
+
+		measurements = append(measurements, fhir.Measurement{
+			ID:             id,
+			Code:           observation.Code,
+			CodingSystem:   observation.CodingSystem,
+			Display:        observation.ReferenceID,
+			Value:          observation.Value,
+			NumericValue:   observation.NumericValue,
+			Unit:           firstNonEmpty(observation.Unit, observation.UnitCode),
+			Time:           observation.Timestamp,
+			Status:         observation.ResultStatus,
+			AbnormalFlags:  observation.AbnormalFlags,
+			ReferenceRange: observation.ReferenceRange,
+			DeviceID:       observation.EquipmentID,
+			Category:       category,
+		})
+	}
+	return measurements
+}
+
+// FHIRDevices returns the devices (OBX-18) that produced the observations of
+// a set, typed by the MDS of their containment
+func FHIRDevices(set *ObservationSet) []fhir.DeviceInfo {
+	devices := make([]fhir.DeviceInfo, 0)
+	seen := make(map[string]bool)
+	for _, observation := range set.Observations {
+		if observation.EquipmentID == "" || seen[observation.EquipmentID] {
+			continue
+		}
+		seen[observation.EquipmentID] = true
+		device := fhir.DeviceInfo{ID: observation.EquipmentID}
+		if len(observation.DevicePath) > 0 {
+			device.Type = observation.DevicePath[0].ReferenceID
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// FHIRPatient returns the patient of a message for the FHIR export, or nil if
+// the message has no patient ID
+func FHIRPatient(message *HL7Message) *fhir.PatientInfo {
+	id := message.GetPatientID()
+	if id == "" {
+		return nil
+	}
+	patient := &fhir.PatientInfo{ID: id}
+	if pid := message.PID(); pid != nil {
+		patient.Family = pid.FamilyName()
+		patient.Given = pid.GivenName()
+		patient.Sex = pid.Sex()
+		if birthDate, err := ParseHL7Time(pid.DateOfBirth()); err == nil {
+			patient.BirthDate = birthDate
+		}
+	}
+	return patient
+}
+
+// exportFHIR sends the observations of an ORU message to the FHIR server
+func (s *HL7Server) exportFHIR(message *HL7Message, observations *ObservationSet) {
+	if s.fhirClient == nil {
+		return
+	}
+	measurements := FHIRMeasurements(observations)
+	if len(measurements) == 0 {
+		return
+	}
+
+	bundle := s.fhirConverter.Bundle(FHIRPatient(message), FHIRDevices(observations), measurements)
+	if s.observer != nil {
+		payload, err := json.Marshal(bundle)
+		if err != nil {
+			s.reportError("fhir", "", fmt.Errorf("message %s: %v", observations.MessageControlID, err))
+			return
+		}
+		s.observe(OBSERVER_OUTPUT_FHIR, s.settings().FHIR.URL, observations.PatientID, observations.MessageControlID, payload)
+		return
+	}
+	if _, err := s.fhirClient.Send(bundle); err != nil {
+		metricFHIRExports.Inc(FHIR_EXPORT_ERROR)
+		s.reportError("fhir", "", fmt.Errorf("message %s: %v", observations.MessageControlID, err))
+		return
+	}
+	metricFHIRExports.Inc(FHIR_EXPORT_OK)
+	s.logf(LOG_LEVEL_DEBUG, "Exported %d observations of message %s to FHIR", len(measurements), observations.MessageControlID)
+}
@@ -0,0 +1,425 @@
+package hl7
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// BuildVersion identifies the build reported to the fleet management
+// service (set with -ldflags "-X driver/hl7.BuildVersion=...")
+var BuildVersion = "dev"
+
+// Fleet management defaults
+const (
+	FLEET_INTERVAL    = 60              // Seconds between heartbeats
+	FLEET_TIMEOUT     = 30              // Seconds per request
+	FLEET_MAX_BACKOFF = 5 * time.Minute // Longest wait after failed requests
+)
+
+// Fleet management API of the control plane
+const (
+	FLEET_REGISTER_PATH    = "/api/gateways/register"
+	FLEET_HEARTBEAT_PATH   = "/api/gateways/%s/heartbeat" // Gateway ID (path escaped)
+	FLEET_HEADER_GATEWAY   = "X-HL7-Gateway"              // Gateway ID
+	FLEET_HEADER_TIMESTAMP = "X-HL7-Timestamp"            // Unix seconds when the request was signed
+	FLEET_HEADER_SIGNATURE = "X-HL7-Signature"            // Hex HMAC-SHA256 of the timestamp, a newline and the body
+)
+
+// Kinds of fleet updates
+const (
+	FLEET_UPDATE_CONFIG = "config" // Payload is a complete configuration file
+	FLEET_UPDATE_FLAGS  = "flags"  // Payload is a JSON object of feature flags replacing the current ones
+)
+
+// FLEET_TARGET_ALL addresses an update to every gateway of the fleet
+const FLEET_TARGET_ALL = "*"
+
+// fleetKeySignature is the purpose of the key signing fleet requests
+const fleetKeySignature = "hl7-fleet"
+
+// FleetConfig configures the control-plane client that registers the
+// gateway with a fleet management service, reports its health and applies
+// the configuration and feature flag updates signed by the service
+type FleetConfig struct {
+	Enabled   bool             `json:"enabled"`
+	URL       string           `json:"url"`        // HTTPS base URL of the fleet management service
+	GatewayID string           `json:"gateway_id"` // Identifies the gateway to the service
+	Key       string           `json:"key"`        // Secret shared with the service for signing requests (32 characters or more)
+	PublicKey string           `json:"public_key"` // Base64 Ed25519 public key the updates are signed with
+	StateFile string           `json:"state_file"` // JSON file of the applied update versions and feature flags
+	Interval  int              `json:"interval"`   // Seconds between heartbeats (0: 60)
+	Timeout   int              `json:"timeout"`    // Seconds per request (0: 30)
+	Transport transport.Config `json:"transport"`  // TLS and proxy to the service
+}
+
+// FleetUpdate is a configuration or feature flag update signed by the fleet
+// management service. Versions increase with every update of a kind; a
+// gateway applies only versions newer than the last one it applied.
+type FleetUpdate struct {
+	Kind      string          `json:"kind"`    // config or flags
+	Version   int64           `json:"version"` // Increases with every update of the kind
+	Target    string          `json:"target"`  // Gateway ID, or * for every gateway
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"` // Base64 Ed25519 signature (see FleetUpdate.SignedData)
+}
+
+// SignedData returns the bytes the signature of an update covers: the kind,
+// version and target each followed by a newline, then the payload
+func (u *FleetUpdate) SignedData() []byte {
+	data := []byte(u.Kind + "\n" + strconv.FormatInt(u.Version, 10) + "\n" + u.Target + "\n")
+	return append(data, u.Payload...)
+}
+
+// FleetReport is the body of the register and heartbeat requests
+type FleetReport struct {
+	GatewayID     string                 `json:"gateway_id"`
+	Hostname      string                 `json:"hostname"`
+	Version       string                 `json:"version"` // BuildVersion
+	StartedAt     time.Time              `json:"started_at"`
+	ConfigVersion int64                  `json:"config_version"` // Last configuration update applied (0: none)
+	ConfigHash    string                 `json:"config_hash"`    // Hex SHA-256 of the running configuration
+	FlagsVersion  int64                  `json:"flags_version"`  // Last feature flag update applied (0: none)
+	Flags         map[string]bool        `json:"flags"`
+	Status        map[string]interface{} `json:"status"` // HL7Server.Status
+	Errors        []string               `json:"errors,omitempty"`
+}
+
+// FleetResponse is the response of the fleet management service
+type FleetResponse struct {
+	Updates []FleetUpdate `json:"updates"`
+}
+
+// fleetState is kept in the state file across restarts
+type fleetState struct {
+	ConfigVersion int64           `json:"config_version"`
+	FlagsVersion  int64           `json:"flags_version"`
+	Flags         map[string]bool `json:"flags"`
+}
+
+// FleetClient registers the gateway with a fleet management service and
+// sends a heartbeat with its health and configuration versions every
+// interval. Configuration updates are verified, reloaded and written to the
+// configuration file; settings that cannot be reloaded take
+// effect on the next restart. Feature flag updates replace the flags of the
+// server (see HL7Server.FeatureEnabled).
+type FleetClient struct {
+	server     *HL7Server
+	config     FleetConfig
+	configFile string
+	publicKey  ed25519.PublicKey
+	client     *http.Client
+	hostname   string
+	startedAt  time.Time
+	mutex      sync.Mutex
+	state      fleetState
+	errors     []string  // Updates rejected since the last heartbeat
+	manifest   *Manifest // Configuration updates must match it if set
+}
+
+// NewFleetClient creates the fleet client of server. Configuration updates
+// are written to configFile, the file the configuration was loaded from.
+// The versions and flags of a previous run are loaded from the state file
+// and the flags applied to the server.
+func NewFleetClient(server *HL7Server, config FleetConfig, configFile string) (*FleetClient, error) {
+	publicKey, err := parseFleetPublicKey(config.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if config.Interval <= 0 {
+		config.Interval = FLEET_INTERVAL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = FLEET_TIMEOUT
+	}
+	client, err := config.Transport.HTTPClient(time.Duration(config.Timeout) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	f := &FleetClient{
+		server:     server,
+		config:     config,
+		configFile: configFile,
+		publicKey:  publicKey,
+		client:     client,
+		hostname:   hostname,
+		startedAt:  server.clock.Now(),
+		state:      fleetState{Flags: make(map[string]bool)},
+	}
+	data, err := os.ReadFile(config.StateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read fleet state: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &f.state); err != nil {
+			return nil, fmt.Errorf("invalid fleet state %s: %v", config.StateFile, err)
+		}
+	}
+	server.SetFeatureFlags(f.state.Flags)
+	return f, nil
+}
+
+// parseFleetPublicKey decodes the base64 Ed25519 public key of the fleet management service
+func parseFleetPublicKey(key string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("fleet public_key must be a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// Start registers the gateway and sends heartbeats until ctx is canceled.
+// Failed requests are retried with exponential backoff.
+func (f *FleetClient) Start(ctx context.Context) error {
+	interval := time.Duration(f.config.Interval) * time.Second
+	wait, backoff := time.Duration(0), interval
+	registered := false
+
+	for {
+		select {
+		case <-f.server.clock.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+
+		path := FLEET_REGISTER_PATH
+		if registered {
+			path = fmt.Sprintf(FLEET_HEARTBEAT_PATH, url.PathEscape(f.config.GatewayID))
+		}
+		if err := f.report(path); err != nil {
+			metricFleetRequests.Inc("error")
+			f.server.reportError("fleet", "", err)
+			wait = backoff
+			if backoff *= 2; backoff > FLEET_MAX_BACKOFF {
+				backoff = FLEET_MAX_BACKOFF
+			}
+			continue
+		}
+		metricFleetRequests.Inc("ok")
+		if !registered {
+			f.server.logf(LOG_LEVEL_INFO, "Registered gateway %s with %s", f.config.GatewayID, f.config.URL)
+			registered = true
+		}
+		wait, backoff = interval, interval
+	}
+}
+
+// Report returns the health and configuration versions reported in the next heartbeat
+func (f *FleetClient) Report() *FleetReport {
+	config := f.server.settings()
+	data, _ := json.Marshal(config)
+	hash := sha256.Sum256(data)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return &FleetReport{
+		GatewayID:     f.config.GatewayID,
+		Hostname:      f.hostname,
+		Version:       BuildVersion,
+		StartedAt:     f.startedAt,
+		ConfigVersion: f.state.ConfigVersion,
+		ConfigHash:    hex.EncodeToString(hash[:]),
+		FlagsVersion:  f.state.FlagsVersion,
+		Flags:         f.server.FeatureFlags(),
+		Status:        f.server.Status(),
+		Errors:        append([]string(nil), f.errors...),
+	}
+}
+
+// report sends the report to path and applies the updates in the response
+func (f *FleetClient) report(path string) error {
+	report := f.Report()
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, strings.TrimRight(f.config.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(f.server.clock.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, deriveKey(f.config.Key, fleetKeySignature))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(FLEET_HEADER_GATEWAY, f.config.GatewayID)
+	request.Header.Set(FLEET_HEADER_TIMESTAMP, timestamp)
+	request.Header.Set(FLEET_HEADER_SIGNATURE, hex.EncodeToString(mac.Sum(nil)))
+
+	response, err := f.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to reach fleet management service %s: %v", f.config.URL, err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(response.Body, SYNC_MAX_BODY))
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("fleet management service rejected the report: %s: %s", response.Status, strings.TrimSpace(string(data)))
+	}
+	var result FleetResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("invalid response from fleet management service: %v", err)
+	}
+
+	// The errors were delivered with this report
+	f.mutex.Lock()
+	f.errors = f.errors[len(report.Errors):]
+	f.mutex.Unlock()
+
+	// Apply the updates of a kind in version order
+	sort.SliceStable(result.Updates, func(i, j int) bool { return result.Updates[i].Version < result.Updates[j].Version })
+	for i := range result.Updates {
+		update := &result.Updates[i]
+		applied, err := f.Apply(update)
+		switch {
+		case err != nil:
+			metricFleetUpdates.Inc(update.Kind, "rejected")
+			f.mutex.Lock()
+			f.errors = append(f.errors, fmt.Sprintf("%s update %d: %v", update.Kind, update.Version, err))
+			f.mutex.Unlock()
+			f.server.reportError("fleet", "", fmt.Errorf("%s update %d rejected: %v", update.Kind, update.Version, err))
+		case applied:
+			metricFleetUpdates.Inc(update.Kind, "applied")
+		}
+	}
+	return nil
+}
+
+// Apply verifies an update and applies it. It returns false without an
+// error for updates whose version was already applied.
+func (f *FleetClient) Apply(update *FleetUpdate) (bool, error) {
+	signature, err := base64.StdEncoding.DecodeString(update.Signature)
+	if err != nil || !ed25519.Verify(f.publicKey, update.SignedData(), signature) {
+		return false, fmt.Errorf("invalid signature")
+	}
+	if update.Target != FLEET_TARGET_ALL && update.Target != f.config.GatewayID {
+		return false, fmt.Errorf("addressed to gateway %s", update.Target)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	state := f.state
+	switch update.Kind {
+	case FLEET_UPDATE_CONFIG:
+		if update.Version <= state.ConfigVersion {
+			return false, nil
+		}
+		if err := f.applyConfig(update.Payload); err != nil {
+			return false, err
+		}
+		state.ConfigVersion = update.Version
+	case FLEET_UPDATE_FLAGS:
+		if update.Version <= state.FlagsVersion {
+			return false, nil
+		}
+		var flags map[string]bool
+		if err := json.Unmarshal(update.Payload, &flags); err != nil {
+			return false, fmt.Errorf("invalid feature flags: %v", err)
+		}
+		f.server.SetFeatureFlags(flags)
+		state.FlagsVersion, state.Flags = update.Version, flags
+		f.server.logf(LOG_LEVEL_INFO, "Applied feature flags version %d", update.Version)
+	default:
+		return false, fmt.Errorf("unknown kind %q", update.Kind)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileSync(f.config.StateFile, data)
+	}
+	if err != nil {
+		return true, fmt.Errorf("applied but failed to save fleet state: %v", err)
+	}
+	f.state = state
+	return true, nil
+}
+
+// SetManifest makes configuration updates match the signed manifest, so
+// that a configuration reaches the gateway only after the manifest listing
+// it was deployed. Set before Start.
+func (f *FleetClient) SetManifest(manifest *Manifest) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.manifest = manifest
+}
+
+// applyConfig validates a configuration update, reloads it and writes it to
+// the configuration file. Updates that would disable fleet
+// management are rejected so that the gateway stays reachable. The caller
+// must hold the lock.
+func (f *FleetClient) applyConfig(payload []byte) error {
+	if f.manifest != nil {
+		if err := f.manifest.VerifyConfig(f.configFile, payload); err != nil {
+			return err
+		}
+	}
+	config, err := ParseConfig(payload, "configuration update")
+	if err != nil {
+		return err
+	}
+	if !config.Fleet.Enabled {
+		return fmt.Errorf("configuration update disables fleet management")
+	}
+
+	if err := f.server.Reload(config); err != nil {
+		return err
+	}
+
+	// Keep the previous configuration to roll back by hand
+	if previous, err := os.ReadFile(f.configFile); err == nil {
+		if err := writeFileSync(f.configFile+".previous", previous); err != nil {
+			return fmt.Errorf("failed to keep previous configuration: %v", err)
+		}
+	}
+	if err := writeFileSync(f.configFile, payload); err != nil {
+		return fmt.Errorf("failed to write configuration: %v", err)
+	}
+	return nil
+}
+
+// SetFeatureFlags replaces the feature flags of the server
+func (s *HL7Server) SetFeatureFlags(flags map[string]bool) {
+	copied := make(map[string]bool, len(flags))
+	for name, enabled := range flags {
+		copied[name] = enabled
+	}
+	s.mutex.Lock()
+	s.features = copied
+	s.mutex.Unlock()
+}
+
+// FeatureEnabled reports whether a feature flag is set (false if it is unknown)
+func (s *HL7Server) FeatureEnabled(name string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.features[name]
+}
+
+// FeatureFlags returns a copy of the feature flags of the server
+func (s *HL7Server) FeatureFlags() map[string]bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	flags := make(map[string]bool, len(s.features))
+	for name, enabled := range s.features {
+		flags[name] = enabled
+	}
+	return flags
+}
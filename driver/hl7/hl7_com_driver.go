@@ -1,16 +1,27 @@
 package hl7
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+	"github.com/harusin0516/healthcare/driver/fhir"
+	"github.com/harusin0516/healthcare/driver/publish"
+	"github.com/harusin0516/healthcare/driver/stream"
 )
 
 // HL7Driver represents the main HL7 communication driver
 type HL7Driver struct {
-	server *HL7Server
-	config *ServerConfig
-	logger *log.Logger
+	server  *HL7Server
+	config  *ServerConfig
+	configFile string
+	storage   Storage
+	publisher publish.Publisher
+	fhirClient *fhir.Client
+	admin     *AdminServer
+	logger    *log.Logger
 }
 
 // NewHL7Driver creates a new HL7 driver
@@ -24,26 +35,134 @@ func NewHL7Driver(configFile string) (*HL7Driver, error) {
 	// Create server
 	server := NewHL7Server(config)
 
+	// Open message storage
+	storage, err := NewStorage(config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message storage: %v", err)
+	}
+	server.SetStorage(storage)
+
+	// Connect to the event bus
+	publisher, err := publish.New(config.Publisher)
+	if err != nil {
+		if storage != nil {
+			storage.Close()
+		}
+		return nil, fmt.Errorf("failed to create publisher: %v", err)
+	}
+	server.SetPublisher(publisher, config.Publisher.TopicTemplate)
+
+	// Export observations to the FHIR server
+	fhirClient, err := fhir.New(config.FHIR)
+	if err != nil {
+		if storage != nil {
+			storage.Close()
+		}
+		if publisher != nil {
+			publisher.Close()
+		}
+		return nil, fmt.Errorf("failed to create FHIR client: %v", err)
+	}
+	server.SetFHIRClient(fhirClient)
+
 	// Create logger
 	logger := log.New(os.Stdout, "[HL7-DRIVER] ", log.LstdFlags)
 
-	return &HL7Driver{
-		server: server,
-		config: config,
-		logger: logger,
-	}, nil
+	driver := &HL7Driver{
+		server:    server,
+		config:    config,
+		configFile: configFile,
+		storage:   storage,
+		publisher: publisher,
+		fhirClient: fhirClient,
+		logger:    logger,
+	}
+
+	// Create the admin API
+	if config.Admin.Enabled {
+		driver.admin = NewAdminServer(server, config.Admin)
+	}
+
+	return driver, nil
+}
+
+// SetLogger replaces the driver and server loggers (use io.Discard to silence output)
+func (d *HL7Driver) SetLogger(logger *log.Logger) {
+	d.logger = logger
+	d.server.SetLogger(logger)
+	if d.admin != nil {
+		d.admin.SetLogger(logger)
+	}
+}
+
+// SetClock sets the clock used by the server (see HL7Server.SetClock)
+func (d *HL7Driver) SetClock(c clock.Clock) {
+	d.server.SetClock(c)
+}
+
+// SetErrorHandler registers a callback for errors reported by the server
+func (d *HL7Driver) SetErrorHandler(handler func(error)) {
+	d.server.SetErrorHandler(handler)
+}
+
+// SetAlertHandler registers a callback for derived alerts (see HL7Server.SetAlertHandler)
+func (d *HL7Driver) SetAlertHandler(handler func(*BPAlert)) {
+	d.server.SetAlertHandler(handler)
+}
+
+// SendOrder sends an ORM^O01 order to the configured order filler (see HL7Server.SendOrder)
+func (d *HL7Driver) SendOrder(order OrderRequest) (string, error) {
+	return d.server.SendOrder(order)
+}
+
+// SetCriticalHandler registers a callback for critical lab results (see HL7Server.SetCriticalHandler)
+func (d *HL7Driver) SetCriticalHandler(handler func(*LabCriticalAlert)) {
+	d.server.SetCriticalHandler(handler)
+}
+
+// SetAuditHandler registers a callback for patient merge audit records (see HL7Server.SetAuditHandler)
+func (d *HL7Driver) SetAuditHandler(handler func(*PatientMergeAudit)) {
+	d.server.SetAuditHandler(handler)
+}
+
+// Patients returns the patient registry, or nil if it is not enabled
+func (d *HL7Driver) Patients() *PatientRegistry {
+	return d.server.Patients()
+}
+
+// Encounters returns the encounter tracker, or nil if it is not enabled
+func (d *HL7Driver) Encounters() *EncounterTracker {
+	return d.server.Encounters()
+}
+
+// Timeline returns the vitals and medication timeline, or nil if it is not enabled
+func (d *HL7Driver) Timeline() *Timeline {
+	return d.server.Timeline()
 }
 
-// Start starts the HL7 driver
-func (d *HL7Driver) Start() error {
-	d.logger.Printf("Starting HL7 Driver on %s:%d", d.config.Host, d.config.Port)
+// SetStream streams observations and infusion pump states to publisher (see HL7Server.SetStream)
+func (d *HL7Driver) SetStream(publisher stream.Publisher) {
+	d.server.SetStream(publisher)
+}
+
+// Start starts the HL7 driver and blocks until ctx is canceled or Stop is called
+func (d *HL7Driver) Start(ctx context.Context) error {
+	d.logger.Printf("Starting HL7 Driver on %s", listenAddress(d.config.Host, d.config.Port))
+	
+	// Start the admin API; a failure is reported without stopping the server
+	if d.admin != nil {
+		go func() {
+			if err := d.admin.Start(ctx); err != nil {
+				d.server.reportError("admin", "", err)
+			}
+		}()
+	}
 	
 	// Start the server
-	if err := d.server.Start(); err != nil {
+	if err := d.server.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start HL7 server: %v", err)
 	}
 
-	d.logger.Println("HL7 Driver started successfully")
 	return nil
 }
 
@@ -51,23 +170,73 @@ func (d *HL7Driver) Start() error {
 func (d *HL7Driver) Stop() error {
 	d.logger.Println("Stopping HL7 Driver...")
 	
+	// Stop the admin API
+	if d.admin != nil {
+		if err := d.admin.Stop(); err != nil {
+			return fmt.Errorf("failed to stop admin API: %v", err)
+		}
+	}
+	
 	// Stop the server
 	if err := d.server.Stop(); err != nil {
 		return fmt.Errorf("failed to stop HL7 server: %v", err)
 	}
 
+	// Disconnect from the event bus
+	if d.publisher != nil {
+		if err := d.publisher.Close(); err != nil {
+			return fmt.Errorf("failed to close publisher: %v", err)
+		}
+	}
+	if d.fhirClient != nil {
+		d.fhirClient.Close()
+	}
+	
+	// Close message storage
+	if d.storage != nil {
+		if err := d.storage.Close(); err != nil {
+			return fmt.Errorf("failed to close message storage: %v", err)
+		}
+	}
+
 	d.logger.Println("HL7 Driver stopped successfully")
 	return nil
 }
 
-// GetStatus returns the current status of the HL7 driver
-func (d *HL7Driver) GetStatus() map[string]interface{} {
-	return d.server.GetServerStatus()
+// Reload re-reads the configuration file and applies the settings that can
+// change while running (see HL7Server.Reload)
+func (d *HL7Driver) Reload() error {
+	config, err := LoadConfig(d.configFile)
+	if err != nil {
+		return fmt.Errorf("failed to reload configuration: %v", err)
+	}
+	return d.server.Reload(config)
+}
+
+// Status returns the current status of the HL7 driver
+func (d *HL7Driver) Status() map[string]interface{} {
+	return d.server.Status()
+}
+
+// Clients returns the list of connected clients
+func (d *HL7Driver) Clients() []*Client {
+	return d.server.Clients()
+}
+
+// QueryMessages returns archived messages matching filter
+func (d *HL7Driver) QueryMessages(filter MessageFilter) ([]*StoredMessage, error) {
+	return d.server.QueryMessages(filter)
+}
+
+// Stats returns the message counters and the most recent messages
+func (d *HL7Driver) Stats() MessageStats {
+	return d.server.Stats()
 }
 
-// GetConnectedClients returns the list of connected clients
-func (d *HL7Driver) GetConnectedClients() []*Client {
-	return d.server.GetConnectedClients()
+// AdminServer returns the admin API, or nil if it is disabled. Additional
+// handlers can be mounted with AdminServer.Handle before Start.
+func (d *HL7Driver) AdminServer() *AdminServer {
+	return d.admin
 }
 
 // DisconnectClient disconnects a specific client
@@ -0,0 +1,217 @@
+package hl7
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HL7_INFUSION_TOPIC is the event bus topic of infusion pump channel states
+const HL7_INFUSION_TOPIC = "hl7.infusion"
+
+// infusionDevicePrefix identifies infusion pump containers in IHE PCD containment
+const infusionDevicePrefix = "MDC_DEV_PUMP_INFUS"
+
+// Reference IDs of infusion pump metrics (IHE PCD PIV/DEC)
+const (
+	mdcInfusionRate      = "MDC_FLOW_FLUID_PUMP"
+	mdcDoseRate          = "MDC_RATE_DOSE"
+	mdcVTBI              = "MDC_VOL_FLUID_TBI"
+	mdcVolumeRemaining   = "MDC_VOL_FLUID_TBI_REMAIN"
+	mdcVolumeDelivered   = "MDC_VOL_FLUID_DELIV_TOTAL"
+	mdcTimeRemaining     = "MDC_TIME_PD_REMAIN"
+	mdcDrugName          = "MDC_DRUG_NAME_TYPE"
+	mdcDrugConcentration = "MDC_CONC_DRUG"
+	mdcPumpStatus        = "MDC_PUMP_STAT"
+	mdcPumpMode          = "MDC_PUMP_MODE"
+)
+
+// infusionReferenceIDs identifies pump observations sent without containment
+var infusionReferenceIDs = map[string]bool{
+	mdcInfusionRate:      true,
+	mdcDoseRate:          true,
+	mdcVTBI:              true,
+	mdcVolumeRemaining:   true,
+	mdcVolumeDelivered:   true,
+	mdcTimeRemaining:     true,
+	mdcDrugName:          true,
+	mdcDrugConcentration: true,
+	mdcPumpStatus:        true,
+	mdcPumpMode:          true,
+}
+
+// InfusionValue is a numeric pump setting or measurement
+type InfusionValue struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+// InfusionChannel is the state of one delivery channel of an infusion pump
+type InfusionChannel struct {
+	PatientID       string         `json:"patient_id,omitempty"`
+	Location        string         `json:"location,omitempty"`
+	EquipmentID     string         `json:"equipment_id,omitempty"` // OBX-18 of the pump
+	Channel         string         `json:"channel"`                // MDS.VMD.CHAN part of OBX-4, e.g. "1.1.1"
+	Time            time.Time      `json:"time"`
+	DrugName        string         `json:"drug_name,omitempty"`
+	Concentration   *InfusionValue `json:"concentration,omitempty"`
+	Rate            *InfusionValue `json:"rate,omitempty"`      // Fluid rate, e.g. mL/h
+	DoseRate        *InfusionValue `json:"dose_rate,omitempty"` // Drug dose rate, e.g. ug/kg/min
+	VTBI            *InfusionValue `json:"vtbi,omitempty"`
+	VolumeRemaining *InfusionValue `json:"volume_remaining,omitempty"`
+	VolumeDelivered *InfusionValue `json:"volume_delivered,omitempty"`
+	TimeRemaining   *InfusionValue `json:"time_remaining,omitempty"`
+	Status          string         `json:"status,omitempty"` // e.g. "pump-status-infusing"
+	Mode            string         `json:"mode,omitempty"`
+}
+
+// IsInfusionObservation reports whether an observation was sent by an
+// infusion pump, by its containment or its reference ID
+func IsInfusionObservation(observation *Observation) bool {
+	for _, device := range observation.DevicePath {
+		if strings.HasPrefix(device.ReferenceID, infusionDevicePrefix) {
+			return true
+		}
+	}
+	return infusionReferenceIDs[observation.ReferenceID]
+}
+
+// ExtractInfusions groups the infusion pump observations of a set by pump
+// and delivery channel
+func ExtractInfusions(set *ObservationSet) []*InfusionChannel {
+	channels := make([]*InfusionChannel, 0)
+	byKey := make(map[string]*InfusionChannel)
+
+	for i := range set.Observations {
+		observation := &set.Observations[i]
+		if !IsInfusionObservation(observation) {
+			continue
+		}
+
+		channelID := infusionChannelID(observation.SubID)
+		key := observation.EquipmentID + "/" + channelID
+		channel, exists := byKey[key]
+		if !exists {
+			channel = &InfusionChannel{
+				PatientID:   set.PatientID,
+				Location:    set.Location,
+				EquipmentID: observation.EquipmentID,
+				Channel:     channelID,
+			}
+			byKey[key] = channel
+			channels = append(channels, channel)
+		}
+		if observation.Timestamp.After(channel.Time) {
+			channel.Time = observation.Timestamp
+		}
+
+		switch observation.ReferenceID {
+		case mdcDrugName:
+			channel.DrugName = observation.Value
+		case mdcPumpStatus:
+			channel.Status = observation.Value
+		case mdcPumpMode:
+			channel.Mode = observation.Value
+		case mdcDrugConcentration:
+			channel.Concentration = infusionValue(observation)
+		case mdcInfusionRate:
+			channel.Rate = infusionValue(observation)
+		case mdcDoseRate:
+			channel.DoseRate = infusionValue(observation)
+		case mdcVTBI:
+			channel.VTBI = infusionValue(observation)
+		case mdcVolumeRemaining:
+			channel.VolumeRemaining = infusionValue(observation)
+		case mdcVolumeDelivered:
+			channel.VolumeDelivered = infusionValue(observation)
+		case mdcTimeRemaining:
+			channel.TimeRemaining = infusionValue(observation)
+		}
+	}
+
+	return channels
+}
+
+// infusionChannelID returns the MDS.VMD.CHAN part of an OBX-4 sub-ID, or the
+// sub-ID if it is not in IHE PCD form
+func infusionChannelID(subID string) string {
+	if parts := strings.Split(subID, "."); len(parts) == 4 {
+		return strings.Join(parts[:3], ".")
+	}
+	return subID
+}
+
+// infusionValue returns the numeric value of an observation, or nil
+func infusionValue(observation *Observation) *InfusionValue {
+	if observation.NumericValue == nil {
+		return nil
+	}
+	return &InfusionValue{Value: *observation.NumericValue, Unit: observation.Unit}
+}
+
+// InfusionRegistry keeps the latest state of every infusion pump channel for
+// dashboards. It is safe for concurrent use.
+type InfusionRegistry struct {
+	mutex    sync.RWMutex
+	channels map[string]*InfusionChannel
+}
+
+// NewInfusionRegistry creates an empty registry
+func NewInfusionRegistry() *InfusionRegistry {
+	return &InfusionRegistry{channels: make(map[string]*InfusionChannel)}
+}
+
+// Update records the state of a channel, replacing an older state
+func (r *InfusionRegistry) Update(channel *InfusionChannel) {
+	key := channel.EquipmentID + "/" + channel.Channel
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, exists := r.channels[key]; exists && existing.Time.After(channel.Time) {
+		return
+	}
+	r.channels[key] = channel
+}
+
+// Channels returns the channels at location (all if empty), ordered by
+// location, pump and channel
+func (r *InfusionRegistry) Channels(location string) []*InfusionChannel {
+	r.mutex.RLock()
+	channels := make([]*InfusionChannel, 0, len(r.channels))
+	for _, channel := range r.channels {
+		if location == "" || channel.Location == location {
+			channels = append(channels, channel)
+		}
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(channels, func(i, j int) bool {
+		a, b := channels[i], channels[j]
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		if a.EquipmentID != b.EquipmentID {
+			return a.EquipmentID < b.EquipmentID
+		}
+		return a.Channel < b.Channel
+	})
+	return channels
+}
+
+// count returns the number of channels held, for the memory monitor
+func (r *InfusionRegistry) count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.channels)
+}
+
+// Remove discards the channels of a pump, e.g. when it is taken out of service
+func (r *InfusionRegistry) Remove(equipmentID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, channel := range r.channels {
+		if channel.EquipmentID == equipmentID {
+			delete(r.channels, key)
+		}
+	}
+}
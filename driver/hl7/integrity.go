@@ -0,0 +1,215 @@
+package hl7
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestPublicKey is the base64 Ed25519 public key that signs release
+// manifests (set with -ldflags "-X driver/hl7.ManifestPublicKey=..."). A key
+// built into the binary cannot be replaced by editing files on the gateway.
+var ManifestPublicKey = ""
+
+// Integrity policies
+const (
+	INTEGRITY_POLICY_OFF     = "off"     // No verification
+	INTEGRITY_POLICY_WARN    = "warn"    // Log problems and start anyway
+	INTEGRITY_POLICY_ENFORCE = "enforce" // Refuse to start (or to reload) on any problem
+)
+
+// MANIFEST_SIGNATURE_SUFFIX names the detached signature of a manifest
+// (base64 Ed25519 signature of the manifest file contents)
+const MANIFEST_SIGNATURE_SUFFIX = ".sig"
+
+// Manifest lists the SHA-256 hashes of a release: the gateway binary and
+// the files of the configuration bundle
+type Manifest struct {
+	Version string            `json:"version"`
+	Binary  []string          `json:"binary,omitempty"` // Hex hashes of the allowed binaries (one per platform); empty skips the binary check
+	Files   map[string]string `json:"files"`            // Hex hash by path relative to the manifest
+	dir     string
+}
+
+// IntegrityError lists every problem found when verifying a release
+type IntegrityError struct {
+	Problems []string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// ValidIntegrityPolicy reports whether policy is a known integrity policy
+func ValidIntegrityPolicy(policy string) bool {
+	switch policy {
+	case INTEGRITY_POLICY_OFF, INTEGRITY_POLICY_WARN, INTEGRITY_POLICY_ENFORCE:
+		return true
+	}
+	return false
+}
+
+// LoadManifest reads a manifest and verifies its detached signature
+// (filename + ".sig") with publicKey, a base64 Ed25519 public key
+func LoadManifest(filename, publicKey string) (*Manifest, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("manifest public key must be a base64 Ed25519 public key")
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	encoded, err := os.ReadFile(filename + MANIFEST_SIGNATURE_SUFFIX)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest signature: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), data, signature) {
+		metricIntegrityFailures.Inc("signature")
+		return nil, fmt.Errorf("invalid manifest signature: %s", filename)
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", filename, err)
+	}
+	manifest.dir = filepath.Dir(filename)
+	return manifest, nil
+}
+
+// Verify checks every file of the manifest and, if the manifest lists
+// binary hashes, the running executable. configFile must be one of the
+// files so that an unlisted configuration is not accepted.
+func (m *Manifest) Verify(configFile string) error {
+	var problems []string
+	if len(m.Binary) > 0 {
+		if err := m.VerifyBinary(); err != nil {
+			metricIntegrityFailures.Inc("binary")
+			problems = append(problems, err.Error())
+		}
+	}
+
+	listed := false
+	for _, name := range m.fileNames() {
+		if m.sameFile(name, configFile) {
+			listed = true
+		}
+		if err := m.verifyFile(name, m.Files[name]); err != nil {
+			metricIntegrityFailures.Inc("file")
+			problems = append(problems, err.Error())
+		}
+	}
+	if configFile != "" && !listed {
+		metricIntegrityFailures.Inc("file")
+		problems = append(problems, fmt.Sprintf("%s is not listed in the manifest", configFile))
+	}
+
+	if len(problems) > 0 {
+		return &IntegrityError{Problems: problems}
+	}
+	return nil
+}
+
+// VerifyConfig checks the contents of a configuration file about to be
+// loaded (e.g. on reload) against the manifest
+func (m *Manifest) VerifyConfig(configFile string, data []byte) error {
+	for _, name := range m.fileNames() {
+		if !m.sameFile(name, configFile) {
+			continue
+		}
+		if hashHex(data) != strings.ToLower(m.Files[name]) {
+			metricIntegrityFailures.Inc("file")
+			return &IntegrityError{Problems: []string{fmt.Sprintf("%s does not match the manifest", configFile)}}
+		}
+		return nil
+	}
+	metricIntegrityFailures.Inc("file")
+	return &IntegrityError{Problems: []string{fmt.Sprintf("%s is not listed in the manifest", configFile)}}
+}
+
+// VerifyBinary checks the hash of the running executable
+func (m *Manifest) VerifyBinary() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the executable: %v", err)
+	}
+	hash, err := hashFile(executable)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range m.Binary {
+		if strings.EqualFold(hash, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("executable %s (sha256 %s) does not match the manifest", executable, hash)
+}
+
+// fileNames returns the files of the manifest in a stable order
+func (m *Manifest) fileNames() []string {
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// path resolves a file of the manifest
+func (m *Manifest) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(m.dir, filepath.FromSlash(name))
+}
+
+// sameFile reports whether the manifest entry name is filename
+func (m *Manifest) sameFile(name, filename string) bool {
+	if filename == "" {
+		return false
+	}
+	a, errA := filepath.Abs(m.path(name))
+	b, errB := filepath.Abs(filename)
+	return errA == nil && errB == nil && a == b
+}
+
+// verifyFile checks one file of the manifest
+func (m *Manifest) verifyFile(name, expected string) error {
+	hash, err := hashFile(m.path(name))
+	if err != nil {
+		return err
+	}
+	if hash != strings.ToLower(expected) {
+		return fmt.Errorf("%s does not match the manifest", name)
+	}
+	return nil
+}
+
+// hashFile returns the hex SHA-256 hash of a file
+func hashFile(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %v", filename, err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %v", filename, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashHex returns the hex SHA-256 hash of data
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,156 @@
+package hl7
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of medication events
+const (
+	MEDICATION_SOURCE_RAS = "RAS" // Pharmacy/treatment administration message (RXA)
+	MEDICATION_SOURCE_RGV = "RGV" // Pharmacy/treatment give message (RXG)
+	MEDICATION_SOURCE_API = "api" // Posted to the admin API
+)
+
+// MedicationEvent is the administration (or scheduled give) of a drug to a patient
+type MedicationEvent struct {
+	ID           string     `json:"id"` // Control ID and segment number, or set by the API client
+	PatientID    string     `json:"patient_id"`
+	Time         time.Time  `json:"time"`                    // Start of administration
+	EndTime      *time.Time `json:"end_time,omitempty"`      // End of administration (infusions)
+	Code         string     `json:"code"`                    // Drug code (RXA-5.1 / RXG-4.1)
+	Name         string     `json:"name"`                    // Drug name (RXA-5.2 / RXG-4.2)
+	CodingSystem string     `json:"coding_system,omitempty"` // e.g. "NDC", "YJ" (YJコード)
+	Dose         *float64   `json:"dose,omitempty"`
+	DoseUnit     string     `json:"dose_unit,omitempty"`
+	Route        string     `json:"route,omitempty"`  // RXR-1, e.g. "IV"
+	Status       string     `json:"status,omitempty"` // RXA-20: CP (complete), PA (partial), NA, RE (refused)
+	Source       string     `json:"source"`
+	Note         string     `json:"note,omitempty"`
+}
+
+// ExtractMedicationEvents returns the medication events of an RAS (RXA
+// segments) or RGV (RXG segments) message. The route of each event is taken
+// from the RXR segment that follows it.
+func ExtractMedicationEvents(message *HL7Message) []*MedicationEvent {
+	events := make([]*MedicationEvent, 0)
+
+	controlID := ""
+	var messageTime time.Time
+	if msh := message.MSH(); msh != nil {
+		controlID = msh.ControlID()
+		messageTime, _ = ParseHL7Time(msh.DateTime())
+	}
+	if messageTime.IsZero() {
+		messageTime = message.Time
+	}
+	patientID := message.GetPatientID()
+
+	var last *MedicationEvent
+	for i := range message.Segments {
+		segment := &message.Segments[i]
+		switch segment.Type {
+		case HL7_SEG_RXA:
+			last = newAdministrationEvent(segment, messageTime)
+		case HL7_SEG_RXG:
+			last = newGiveEvent(segment, messageTime)
+		case HL7_SEG_RXR:
+			if last != nil && last.Route == "" {
+				last.Route = firstNonEmpty(segment.Component(1, 1), segment.Component(1, 2))
+			}
+			continue
+		default:
+			continue
+		}
+
+		last.ID = fmt.Sprintf("%s-%d", controlID, len(events)+1)
+		last.PatientID = patientID
+		events = append(events, last)
+	}
+
+	return events
+}
+
+// newAdministrationEvent converts an RXA (Pharmacy/Treatment Administration) segment
+func newAdministrationEvent(rxa *HL7Segment, defaultTime time.Time) *MedicationEvent {
+	event := &MedicationEvent{
+		Time:         defaultTime,
+		Code:         rxa.Component(5, 1),
+		Name:         rxa.Component(5, 2),
+		CodingSystem: rxa.Component(5, 3),
+		Dose:         parseDose(rxa.FieldValue(6)),
+		DoseUnit:     firstNonEmpty(rxa.Component(7, 1), rxa.Component(7, 2)),
+		Status:       rxa.FieldValue(20),
+		Source:       MEDICATION_SOURCE_RAS,
+	}
+	if t, err := ParseHL7Time(rxa.Component(3, 1)); err == nil {
+		event.Time = t
+	}
+	if t, err := ParseHL7Time(rxa.Component(4, 1)); err == nil {
+		event.EndTime = &t
+	}
+	return event
+}
+
+// newGiveEvent converts an RXG (Pharmacy/Treatment Give) segment. The give
+// time is the start of the quantity/timing (RXG-3.4).
+func newGiveEvent(rxg *HL7Segment, defaultTime time.Time) *MedicationEvent {
+	event := &MedicationEvent{
+		Time:         defaultTime,
+		Code:         rxg.Component(4, 1),
+		Name:         rxg.Component(4, 2),
+		CodingSystem: rxg.Component(4, 3),
+		Dose:         parseDose(rxg.FieldValue(5)),
+		DoseUnit:     firstNonEmpty(rxg.Component(7, 1), rxg.Component(7, 2)),
+		Source:       MEDICATION_SOURCE_RGV,
+	}
+	if t, err := ParseHL7Time(rxg.Component(3, 4)); err == nil {
+		event.Time = t
+	}
+	return event
+}
+
+// Validate checks an event posted to the API
+func (e *MedicationEvent) Validate() error {
+	var problems []string
+	if e.PatientID == "" {
+		problems = append(problems, "patient_id is required")
+	}
+	if e.Time.IsZero() {
+		problems = append(problems, "time is required")
+	}
+	if e.Code == "" && e.Name == "" {
+		problems = append(problems, "code or name is required")
+	}
+	if e.EndTime != nil && e.EndTime.Before(e.Time) {
+		problems = append(problems, "end_time is before time")
+	}
+	if e.Dose != nil && *e.Dose < 0 {
+		problems = append(problems, "dose must not be negative")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid medication event: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseDose parses an amount field, returning nil if it is empty or not numeric
+func parseDose(value string) *float64 {
+	dose, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return nil
+	}
+	return &dose
+}
+
+// firstNonEmpty returns the first non-empty value
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package hl7
+
+import (
+	"github.com/harusin0516/healthcare/driver/memwatch"
+)
+
+// watchMemory registers the channel depths and object counts of the
+// server's subsystems with the memory monitor. Subsystems that are not
+// enabled are not registered.
+func (s *HL7Server) watchMemory(monitor *memwatch.Monitor) {
+	monitor.Register("hl7_queue", s.queuedMessages)
+	monitor.Register("hl7_clients", s.ClientCount)
+	monitor.Register("hl7_crash_reports", func() int { return len(s.CrashReports()) })
+	monitor.Register("hl7_continuations", s.continuations.count)
+	monitor.Register("hl7_infusion_channels", s.infusions.count)
+	if s.duplicates != nil {
+		monitor.Register("hl7_duplicate_control_ids", s.duplicates.Count)
+	}
+	if s.criticalChan != nil {
+		monitor.Register("hl7_critical_queue", func() int { return len(s.criticalChan) })
+	}
+	if s.timeline != nil {
+		monitor.Register("hl7_timeline_objects", s.timeline.objectCount)
+	}
+	if s.registry != nil {
+		monitor.Register("hl7_registry_patients", s.registry.Count)
+	}
+	if s.encounters != nil {
+		monitor.Register("hl7_encounters", s.encounters.count)
+	}
+
+	monitor.OnSuspect(func(suspect memwatch.Suspect) {
+		s.logf(LOG_LEVEL_WARN, "Suspected leak: %s grew monotonically by %.0f%% (%.0f to %.0f) since %s",
+			suspect.Source, suspect.Growth, suspect.First, suspect.Last, suspect.Since.Format("2006-01-02 15:04"))
+	})
+}
+
+// memoryStatus returns the status of the memory monitor, nil if disabled
+func (s *HL7Server) memoryStatus() map[string]interface{} {
+	if s.memory == nil {
+		return nil
+	}
+	return s.memory.GetStatus()
+}
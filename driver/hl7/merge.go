@@ -0,0 +1,132 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// HL7_AUDIT_TOPIC is the event bus topic of patient merge audit records
+const HL7_AUDIT_TOPIC = "hl7.audit"
+
+// Patient merge results (hl7_patient_merges_total)
+const (
+	PATIENT_MERGE_OK    = "ok"
+	PATIENT_MERGE_ERROR = "error"
+)
+
+// PatientMerge is a retired patient ID (MRG-1) merged into a surviving one (PID-3)
+type PatientMerge struct {
+	SurvivingID string `json:"surviving_id"`
+	RetiredID   string `json:"retired_id"`
+}
+
+// PatientMerger is implemented by storage backends that can re-key the
+// stored messages of a retired patient ID to the surviving one. Messages of
+// the retired ID saved after the merge are stored under the surviving ID.
+type PatientMerger interface {
+	// MergePatient re-keys the messages of retiredID and returns how many were re-keyed
+	MergePatient(retiredID, survivingID string) (int, error)
+}
+
+// PatientMergeAudit records what a patient merge changed
+type PatientMergeAudit struct {
+	Time               time.Time       `json:"time"`
+	ControlID          string          `json:"control_id"`          // MSH-10 of the A40 message
+	SendingApplication string          `json:"sending_application"` // MSH-3
+	SurvivingID        string          `json:"surviving_id"`
+	RetiredID          string          `json:"retired_id"`
+	Patient            *PatientContext `json:"patient,omitempty"` // Surviving patient in the registry after the merge
+	StoredMessages     int             `json:"stored_messages"`   // Stored messages re-keyed
+	TimelineEntries    int             `json:"timeline_entries"`  // Observations and medication events moved
+	Encounters         int             `json:"encounters"`        // Encounters moved
+	Errors             []string        `json:"errors,omitempty"`
+}
+
+// ExtractMerges returns the PID/MRG pairs of an A40 message. Pairs without
+// an ID or merging a patient into itself are skipped.
+func ExtractMerges(message *HL7Message) []PatientMerge {
+	merges := make([]PatientMerge, 0)
+	survivingID := ""
+	for i := range message.Segments {
+		segment := &message.Segments[i]
+		switch segment.Type {
+		case HL7_SEG_PID:
+			survivingID = message.Profile().PatientID(&PIDSegment{segment})
+		case HL7_SEG_MRG:
+			retiredID := segment.Component(1, 1)
+			if survivingID != "" && retiredID != "" && retiredID != survivingID {
+				merges = append(merges, PatientMerge{SurvivingID: survivingID, RetiredID: retiredID})
+			}
+		}
+	}
+	return merges
+}
+
+// mergePatients moves the stored messages, timeline and encounters of the retired
+// patients of an A40 message to the surviving patients and emits an audit
+// record for every merge. The registry is updated by handleADTMessage.
+func (s *HL7Server) mergePatients(message *HL7Message) {
+	msh := message.MSH()
+	for _, merge := range ExtractMerges(message) {
+		audit := &PatientMergeAudit{
+			Time:        s.clock.Now(),
+			SurvivingID: merge.SurvivingID,
+			RetiredID:   merge.RetiredID,
+		}
+		if msh != nil {
+			audit.ControlID = msh.ControlID()
+			audit.SendingApplication = msh.SendingApplication()
+		}
+		if s.registry != nil {
+			audit.Patient = s.registry.ByPatientID(merge.SurvivingID)
+		}
+
+		if merger, ok := s.storage.(PatientMerger); ok {
+			count, err := merger.MergePatient(merge.RetiredID, merge.SurvivingID)
+			audit.StoredMessages = count
+			if err != nil {
+				audit.Errors = append(audit.Errors, err.Error())
+				s.reportError("merge", "", fmt.Errorf("patient %s into %s: %v", merge.RetiredID, merge.SurvivingID, err))
+			}
+		}
+		if s.timeline != nil {
+			audit.TimelineEntries = s.timeline.Merge(merge.RetiredID, merge.SurvivingID)
+		}
+		if s.encounters != nil {
+			count, err := s.encounters.Merge(merge.RetiredID, merge.SurvivingID)
+			audit.Encounters = count
+			if err != nil {
+				audit.Errors = append(audit.Errors, err.Error())
+				s.reportError("merge", "", fmt.Errorf("encounters of patient %s into %s: %v", merge.RetiredID, merge.SurvivingID, err))
+			}
+		}
+
+		result := PATIENT_MERGE_OK
+		if len(audit.Errors) > 0 {
+			result = PATIENT_MERGE_ERROR
+		}
+		metricPatientMerges.Inc(result)
+		s.emitAudit(audit)
+	}
+}
+
+// emitAudit logs a patient merge audit record, publishes it and passes it to the audit handler
+func (s *HL7Server) emitAudit(audit *PatientMergeAudit) {
+	s.logf(LOG_LEVEL_INFO, "Merged patient %s into %s (message %s): %d stored messages, %d timeline entries re-keyed",
+		audit.RetiredID, audit.SurvivingID, audit.ControlID, audit.StoredMessages, audit.TimelineEntries)
+
+	if s.publisher != nil {
+		payload, err := json.Marshal(audit)
+		if err == nil {
+			err = s.publisher.Publish(HL7_AUDIT_TOPIC, audit.SurvivingID, payload)
+		}
+		if err != nil {
+			s.reportError("publish", "", err)
+		}
+	}
+
+	if s.onAudit != nil {
+		s.onAudit(audit)
+	}
+}
@@ -0,0 +1,89 @@
+package hl7
+
+import (
+	"github.com/harusin0516/healthcare/driver/metrics"
+)
+
+// Reasons a connection was rejected
+const (
+	REJECT_NOT_ALLOWED = "not_allowed" // Client address not in allowed_ips
+	REJECT_LIMIT       = "limit"       // max_connections reached
+)
+
+// HL7 server metrics, exported on the default metrics registry
+var (
+	metricMessagesReceived = metrics.Default.NewCounter("hl7_messages_received_total",
+		"HL7 messages received and parsed, by message type (MSH-9.1)", "type")
+	metricAcks = metrics.Default.NewCounter("hl7_acks_total",
+		"HL7 acknowledgments sent, by message type and acknowledgment code (AA, AE, AR)", "type", "code")
+	metricDuplicateMessages = metrics.Default.NewCounter("hl7_duplicate_messages_total",
+		"Retransmitted HL7 messages acknowledged without processing, by message type", "type")
+	metricParseErrors = metrics.Default.NewCounter("hl7_parse_errors_total",
+		"HL7 messages that could not be parsed")
+	metricConnections = metrics.Default.NewGauge("hl7_mllp_connections",
+		"Open MLLP client connections")
+	metricRejectedConnections = metrics.Default.NewCounter("hl7_rejected_connections_total",
+		"MLLP connections rejected, by reason (not_allowed, limit)", "reason")
+	metricAckLatency = metrics.Default.NewHistogram("hl7_ack_latency_seconds",
+		"Time from receiving a message to sending its acknowledgment", nil)
+	metricQueueDepth = metrics.Default.NewGauge("hl7_queue_depth",
+		"Messages waiting in the processing queues")
+	metricQueueOverflows = metrics.Default.NewCounter("hl7_queue_overflows_total",
+		"Messages that found their processing queue full, by action taken (block, nak, spill)", "action")
+	metricSpilledMessages = metrics.Default.NewGauge("hl7_spilled_messages",
+		"Messages in the spill directory waiting to be processed")
+	metricProcessingDuration = metrics.Default.NewHistogram("hl7_processing_seconds",
+		"Time to process a message after it leaves the queue", nil)
+	metricProcessingTimeouts = metrics.Default.NewCounter("hl7_processing_timeouts_total",
+		"Messages whose processing exceeded the processing timeout")
+	metricCriticalResults = metrics.Default.NewCounter("hl7_critical_results_total",
+		"Critical lab results notified, by observation code (OBX-3.1)", "code")
+	metricRegistryPatients = metrics.Default.NewGauge("hl7_registry_patients",
+		"Patients in the patient registry (patients with a bed)")
+	metricFHIRExports = metrics.Default.NewCounter("hl7_fhir_exports_total",
+		"ORU messages exported to the FHIR server, by result (ok, error)", "result")
+	metricPatientMerges = metrics.Default.NewCounter("hl7_patient_merges_total",
+		"Patient merges (A40) applied to stored data, by result (ok, error)", "result")
+	metricRemoteBuffered = metrics.Default.NewGauge("hl7_remote_buffered",
+		"Messages in the encrypted buffer of a remote site waiting to be synced")
+	metricRemoteSynced = metrics.Default.NewCounter("hl7_remote_synced_total",
+		"Messages of a remote site accepted by the central deployment")
+	metricRemoteSyncErrors = metrics.Default.NewCounter("hl7_remote_sync_errors_total",
+		"Failed sync attempts of a remote site")
+	metricRemoteBandwidth = metrics.Default.NewGauge("hl7_remote_bandwidth_bytes",
+		"Measured bandwidth of the link of a remote site to the central deployment in bytes per second")
+	metricFleetRequests = metrics.Default.NewCounter("hl7_fleet_requests_total",
+		"Register and heartbeat requests to the fleet management service, by result (ok, error)", "result")
+	metricFleetUpdates = metrics.Default.NewCounter("hl7_fleet_updates_total",
+		"Updates from the fleet management service, by kind (config, flags) and result (applied, rejected)", "kind", "result")
+	metricIntegrityFailures = metrics.Default.NewCounter("hl7_integrity_failures_total",
+		"Failed integrity checks against the signed release manifest, by check (signature, binary, file)", "check")
+	metricObserverOutputs = metrics.Default.NewCounter("hl7_observer_outputs_total",
+		"Outputs recorded instead of sent in observer mode, by kind (publish, fhir, webhook, order, remote, route)", "kind")
+	metricSyncReceived = metrics.Default.NewCounter("hl7_sync_received_total",
+		"Messages received from remote sites by the central deployment, by site", "site")
+	metricSyncBacklog = metrics.Default.NewGauge("hl7_sync_backlog",
+		"Messages buffered at a remote site at its last sync request, by site", "site")
+	metricSyncLag = metrics.Default.NewGauge("hl7_sync_lag_seconds",
+		"Age of the oldest message buffered at a remote site at its last sync request, by site", "site")
+	metricUnmappedUnits = metrics.Default.NewCounter("hl7_unmapped_units_total",
+		"OBX units (OBX-6) received without a normalization mapping, by unit", "unit")
+	metricFramingErrors = metrics.Default.NewCounter("hl7_framing_errors_total",
+		"MLLP framing errors, by reason (outside_block, unterminated, too_large)", "reason")
+	metricSessionsClosed = metrics.Default.NewCounter("hl7_sessions_closed_total",
+		"MLLP sessions closed by the server, by reason (timeout, read_timeout, idle, framing_errors)", "reason")
+	metricBatchesReceived = metrics.Default.NewCounter("hl7_batches_received_total",
+		"HL7 batches (BHS) and files (FHS) received, by kind (batch, file)", "kind")
+	metricFragmentsReceived = metrics.Default.NewCounter("hl7_fragments_received_total",
+		"Fragments of messages continued with DSC segments that were added to their message")
+	metricQueries = metrics.Default.NewCounter("hl7_queries_total",
+		"Patient demographics queries (QBP^Q22) answered, by status (OK, NF, AE, AR)", "status")
+	metricRoutedMessages = metrics.Default.NewCounter("hl7_routed_messages_total",
+		"Messages forwarded by the router, by destination and result (sent, retried, rejected, dropped)", "destination", "result")
+	metricRouteQueued = metrics.Default.NewGauge("hl7_route_queued",
+		"Messages waiting to be forwarded, by destination", "destination")
+	metricSendQueued = metrics.Default.NewGauge("hl7_send_queued",
+		"Messages waiting in durable send queues, by queue", "queue")
+	metricTransformedMessages = metrics.Default.NewCounter("hl7_transformed_messages_total",
+		"Messages changed by a transformation rule, by rule", "rule")
+)
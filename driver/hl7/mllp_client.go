@@ -0,0 +1,94 @@
+package hl7
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// MLLP frame bytes
+const (
+	MLLP_START_BLOCK = 0x0B
+	MLLP_END_BLOCK   = 0x1C
+	MLLP_CR          = 0x0D
+)
+
+// Acknowledgment codes (MSA-1) that accept a message
+var acceptedAckCodes = map[string]bool{"AA": true, "CA": true}
+
+// MLLPClient sends messages to another system's MLLP listener and waits for
+// their acknowledgment. Every message is sent on a new connection.
+type MLLPClient struct {
+	address string
+	timeout time.Duration
+	parser  *HL7Parser
+	dialer  *transport.Dialer // nil: plain TCP without a proxy
+}
+
+// NewMLLPClient creates a client for the listener at address (host:port).
+// timeout limits connecting, sending and waiting for the acknowledgment.
+func NewMLLPClient(address string, timeout time.Duration) *MLLPClient {
+	return &MLLPClient{
+		address: address,
+		timeout: timeout,
+		parser:  NewHL7Parser(),
+	}
+}
+
+// SetTransport connects to the listener with the TLS and proxy settings of
+// config. It fails if the certificates cannot be loaded.
+func (c *MLLPClient) SetTransport(config transport.Config) error {
+	dialer, err := config.NewDialer(c.timeout)
+	if err != nil {
+		return err
+	}
+	c.dialer = dialer
+	return nil
+}
+
+// Send sends a message and returns its acknowledgment. A rejected message
+// (MSA-1 other than AA or CA) is returned with an error that carries MSA-3.
+func (c *MLLPClient) Send(message string) (*HL7Message, error) {
+	var conn net.Conn
+	var err error
+	if c.dialer != nil {
+		conn, err = c.dialer.Dial(c.address)
+	} else {
+		conn, err = net.DialTimeout("tcp", c.address, c.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", c.address, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	frame := fmt.Sprintf("%c%s%c%c", MLLP_START_BLOCK, message, MLLP_END_BLOCK, MLLP_CR)
+	if _, err := conn.Write([]byte(frame)); err != nil {
+		return nil, fmt.Errorf("failed to send message to %s: %v", c.address, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString(MLLP_START_BLOCK); err != nil {
+		return nil, fmt.Errorf("failed to read acknowledgment from %s: %v", c.address, err)
+	}
+	response, err := reader.ReadString(MLLP_END_BLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read acknowledgment from %s: %v", c.address, err)
+	}
+
+	ack, err := c.parser.ParseMessage(response[:len(response)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid acknowledgment from %s: %v", c.address, err)
+	}
+	msa := ack.GetSegmentByType(HL7_SEG_MSA)
+	if msa == nil {
+		return ack, fmt.Errorf("acknowledgment from %s has no MSA segment", c.address)
+	}
+	if code := msa.FieldValue(1); !acceptedAckCodes[code] {
+		return ack, fmt.Errorf("message rejected by %s (%s): %s", c.address, code, msa.FieldValue(3))
+	}
+	return ack, nil
+}
@@ -0,0 +1,284 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+)
+
+// Observation represents a single result extracted from an OBX segment
+type Observation struct {
+	SetID          string      `json:"set_id"`
+	ValueType      string      `json:"value_type"`
+	Code           string      `json:"code"`                    // OBX-3.1 (MDC code, e.g. "150033")
+	ReferenceID    string      `json:"reference_id"`            // OBX-3.2 (e.g. "MDC_PRESS_BLD_ART_SYS")
+	CodingSystem   string      `json:"coding_system"`           // OBX-3.3 (e.g. "MDC")
+	Description    string      `json:"description,omitempty"`   // From the MDC code table
+	SubID          string      `json:"sub_id"`                  // OBX-4 (e.g. "1.13.1.1")
+	Value          string      `json:"value"`                   // OBX-5 as received
+	NumericValue   *float64    `json:"numeric_value,omitempty"` // OBX-5 for NM values
+	UnitCode       string      `json:"unit_code"`               // OBX-6.1 (e.g. "266016")
+	Unit           string      `json:"unit"`                    // OBX-6.2 (e.g. "MDC_DIM_MMHG")
+	ReferenceRange string      `json:"reference_range,omitempty"`
+	AbnormalFlags  string      `json:"abnormal_flags,omitempty"`
+	ResultStatus   string      `json:"result_status"`
+	Timestamp      time.Time   `json:"timestamp"`
+	EquipmentID    string      `json:"equipment_id,omitempty"` // OBX-18
+	DevicePath     []DeviceRef `json:"device_path,omitempty"`  // MDS -> VMD -> CHAN containment
+	RequestSetID   string      `json:"request_set_id,omitempty"`
+	RequestCode    string      `json:"request_code,omitempty"` // OBR-4.1
+}
+
+// DeviceRef identifies a device containment level (MDS, VMD or CHAN)
+// declared by a valueless OBX segment in IHE PCD messages
+type DeviceRef struct {
+	SubID       string `json:"sub_id"`
+	Code        string `json:"code"`
+	ReferenceID string `json:"reference_id"`
+}
+
+// ObservationSet holds the observations extracted from one message
+type ObservationSet struct {
+	MessageControlID   string        `json:"message_control_id"`
+	SendingApplication string        `json:"sending_application,omitempty"` // MSH-3
+	PatientID          string        `json:"patient_id"`
+	Location           string        `json:"location,omitempty"` // PV1-3 as point of care^room^bed
+	Observations       []Observation `json:"observations"`
+}
+
+// ExtractObservations walks the OBR/OBX hierarchy of a message and returns its
+// observations. Valueless OBX segments whose OBX-4 sub-ID ends in ".0" (the
+// MDS/VMD/CHAN containment used by IHE PCD devices) are not returned as
+// observations; they populate the DevicePath of the metrics they contain.
+func ExtractObservations(message *HL7Message) *ObservationSet {
+	set := &ObservationSet{
+		Observations: make([]Observation, 0),
+	}
+
+	// Fallback timestamp when neither the OBX time (OBX-14/OBX-19) nor OBR-7 is present
+	var messageTime time.Time
+	if msh := message.MSH(); msh != nil {
+		set.MessageControlID = msh.ControlID()
+		set.SendingApplication = msh.SendingApplication()
+		messageTime, _ = ParseHL7Time(msh.DateTime())
+	}
+	set.PatientID = message.GetPatientID()
+	profile := message.Profile()
+	config := message.EncodingConfig()
+	if pv1 := message.PV1(); pv1 != nil && (pv1.PointOfCare() != "" || pv1.Room() != "" || pv1.Bed() != "") {
+		set.Location = pv1.PointOfCare() + "^" + pv1.Room() + "^" + pv1.Bed()
+	}
+
+	requestSetID, requestCode := "", ""
+	requestTime := messageTime
+	devices := make(map[string]DeviceRef)
+
+	for i := range message.Segments {
+		segment := &message.Segments[i]
+		switch segment.Type {
+		case HL7_SEG_OBR:
+			// Each OBR starts a new observation group with its own containment tree
+			requestSetID = segment.FieldValue(1)
+			requestCode = segment.Component(4, 1)
+			requestTime = messageTime
+			if t, err := ParseHL7Time(segment.FieldValue(7)); err == nil {
+				requestTime = t
+			}
+			devices = make(map[string]DeviceRef)
+		case HL7_SEG_OBX:
+			obx := &OBXSegment{segment}
+			if isDeviceContainer(obx) {
+				devices[obx.ObservationSubID()] = DeviceRef{
+					SubID:       obx.ObservationSubID(),
+					Code:        obx.ObservationCode(),
+					ReferenceID: obx.ObservationText(),
+				}
+				continue
+			}
+
+			observation := newObservation(obx, profile, config, requestTime)
+			observation.RequestSetID = requestSetID
+			observation.RequestCode = requestCode
+			observation.DevicePath = devicePath(obx.ObservationSubID(), devices)
+			set.Observations = append(set.Observations, observation)
+		}
+	}
+
+	return set
+}
+
+// newObservation converts an OBX segment into an Observation, reading the
+// observation time from the fields of the message's version profile. config
+// holds the encoding characters of the message, to keep OBX-5 as received.
+func newObservation(obx *OBXSegment, profile *VersionProfile, config HL7Config, defaultTime time.Time) Observation {
+	observation := Observation{
+		SetID:          obx.ObservationSetID(),
+		ValueType:      obx.ValueType(),
+		Code:           obx.ObservationCode(),
+		ReferenceID:    obx.ObservationText(),
+		CodingSystem:   obx.ObservationCodingSystem(),
+		SubID:          obx.ObservationSubID(),
+		UnitCode:       obx.UnitCode(),
+		Unit:           obx.UnitText(),
+		ReferenceRange: obx.ReferenceRange(),
+		AbnormalFlags:  obx.AbnormalFlags(),
+		ResultStatus:   obx.ResultStatus(),
+		Timestamp:      defaultTime,
+		EquipmentID:    obx.EquipmentInstanceIdentifier(),
+	}
+
+	if value := obx.ObservationValueField(); value != nil {
+		observation.Value = value.Encode(config)
+	}
+
+	// Resolve MDC codes sent without a reference ID
+	if observation.CodingSystem == mdc.CODING_SYSTEM {
+		resolveMDC(&observation)
+	}
+
+	// Free-text units ("K/uL") have no separate unit code
+	if observation.Unit == "" && obx.Units() != nil && len(obx.Units().Components) == 0 {
+		observation.Unit = observation.UnitCode
+	}
+
+	if observation.ValueType == "NM" {
+		if value, err := strconv.ParseFloat(strings.TrimSpace(observation.Value), 64); err == nil {
+			observation.NumericValue = &value
+		}
+	}
+
+	if t, err := profile.ObservationTime(obx); err == nil {
+		observation.Timestamp = t
+	}
+
+	return observation
+}
+
+// resolveMDC fills the description and any missing reference IDs of an
+// MDC coded observation from the code table
+func resolveMDC(observation *Observation) {
+	if code, err := mdc.ParseCE(observation.Code+"^"+observation.ReferenceID, "^"); err == nil {
+		observation.Description = code.Description
+		if observation.ReferenceID == "" {
+			observation.ReferenceID = code.ReferenceID
+		}
+	}
+	if observation.Unit == "" && observation.UnitCode != "" {
+		if unit, err := mdc.ParseCE(observation.UnitCode, "^"); err == nil {
+			observation.Unit = unit.ReferenceID
+		}
+	}
+}
+
+// isDeviceContainer returns true for valueless OBX segments that declare an
+// MDS, VMD or CHAN level (sub-ID such as "1.13.0.0" or "1.13.1.0")
+func isDeviceContainer(obx *OBXSegment) bool {
+	if obx.ValueType() != "" || obx.ObservationValue() != "" {
+		return false
+	}
+	parts := strings.Split(obx.ObservationSubID(), ".")
+	return len(parts) == 4 && parts[3] == "0"
+}
+
+// devicePath resolves the MDS, VMD and CHAN containers of a metric sub-ID.
+// For "1.13.1.1" it looks up "1.0.0.0", "1.13.0.0" and "1.13.1.0".
+func devicePath(subID string, devices map[string]DeviceRef) []DeviceRef {
+	parts := strings.Split(subID, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+
+	var path []DeviceRef
+	for level := 1; level <= 3; level++ {
+		prefix := make([]string, 4)
+		for i := range prefix {
+			if i < level {
+				prefix[i] = parts[i]
+			} else {
+				prefix[i] = "0"
+			}
+		}
+		if device, exists := devices[strings.Join(prefix, ".")]; exists {
+			path = append(path, device)
+		}
+	}
+	return path
+}
+
+// ParseHL7Time parses an HL7 TS/DTM value (YYYY[MM[DD[HH[MM[SS[.S+]]]]]][+/-ZZZZ]).
+// Values without a UTC offset are interpreted in the local time zone.
+func ParseHL7Time(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty HL7 timestamp")
+	}
+
+	// Split off the UTC offset
+	offset := ""
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value, offset = value[:i], value[i:]
+	}
+
+	// Split off fractional seconds
+	fraction := ""
+	if i := strings.Index(value, "."); i >= 0 {
+		value, fraction = value[:i], value[i+1:]
+	}
+
+	layouts := map[int]string{
+		4:  "2006",
+		6:  "200601",
+		8:  "20060102",
+		10: "2006010215",
+		12: "200601021504",
+		14: "20060102150405",
+	}
+	layout, exists := layouts[len(value)]
+	if !exists {
+		return time.Time{}, fmt.Errorf("invalid HL7 timestamp: %s", value)
+	}
+	if fraction != "" {
+		layout += "." + strings.Repeat("0", len(fraction))
+		value += "." + fraction
+	}
+
+	if offset != "" {
+		return time.Parse(layout+"-0700", value+offset)
+	}
+	return time.ParseInLocation(layout, value, time.Local)
+}
+
+// FindByReferenceID returns the first observation with the given reference ID
+// (e.g. "MDC_ECG_HEART_RATE"), or nil if none exists
+func (s *ObservationSet) FindByReferenceID(referenceID string) *Observation {
+	for i := range s.Observations {
+		if s.Observations[i].ReferenceID == referenceID {
+			return &s.Observations[i]
+		}
+	}
+	return nil
+}
+
+// FindByCode returns all observations with the given code (OBX-3.1)
+func (s *ObservationSet) FindByCode(code string) []Observation {
+	var observations []Observation
+	for _, observation := range s.Observations {
+		if observation.Code == code {
+			observations = append(observations, observation)
+		}
+	}
+	return observations
+}
+
+// ToJSON converts the ObservationSet to JSON format
+func (s *ObservationSet) ToJSON() (string, error) {
+	jsonBytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(jsonBytes), nil
+}
@@ -0,0 +1,176 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Acknowledgment policies of observer mode
+const (
+	OBSERVER_ACK_NORMAL = "normal" // The acknowledgment the gateway would send live (default)
+	OBSERVER_ACK_ACCEPT = "accept" // Always AA, so that shadowing never makes the sender retry
+	OBSERVER_ACK_NONE   = "none"   // No acknowledgment, for passive taps whose sender ignores them
+)
+
+// Kinds of outputs recorded instead of sent in observer mode
+const (
+	OBSERVER_OUTPUT_PUBLISH = "publish" // Event bus message (messages, infusions, alerts, audits)
+	OBSERVER_OUTPUT_FHIR    = "fhir"    // FHIR transaction bundle
+	OBSERVER_OUTPUT_WEBHOOK = "webhook" // Critical result webhook
+	OBSERVER_OUTPUT_ORDER   = "order"   // ORM^O01 to the order filler
+	OBSERVER_OUTPUT_REMOTE  = "remote"  // Message buffered for the central deployment
+	OBSERVER_OUTPUT_ROUTE   = "route"   // Message forwarded to a router destination
+)
+
+// OBSERVER_RECENT is the number of recorded outputs kept for the admin API
+const OBSERVER_RECENT = 100
+
+// ObserverConfig configures observer mode: the gateway parses, validates,
+// archives and acknowledges all traffic and records metrics, but records
+// what it would send downstream instead of sending it. It is used to shadow
+// an existing interface engine before cutover.
+type ObserverConfig struct {
+	Enabled    bool   `json:"enabled"`
+	AckPolicy  string `json:"ack_policy"`  // normal (default), accept or none
+	OutputFile string `json:"output_file"` // Would-be outputs as JSON lines (empty: metrics and admin API only)
+}
+
+// ObserverOutput is an output that observer mode did not send
+type ObserverOutput struct {
+	Time      time.Time       `json:"time"`
+	Kind      string          `json:"kind"`
+	Target    string          `json:"target"`               // Topic, URL, destination or sync lane
+	Key       string          `json:"key,omitempty"`        // Partition key (usually the patient ID)
+	MessageID string          `json:"message_id,omitempty"` // Control ID of the message that caused the output
+	Payload   json.RawMessage `json:"payload"`              // JSON payloads as is, HL7 messages as a string
+}
+
+// Observer records the would-be outputs of observer mode. It is safe for
+// concurrent use.
+type Observer struct {
+	mutex  sync.Mutex
+	file   *os.File
+	recent []ObserverOutput
+}
+
+// NewObserver creates an observer appending to config.OutputFile if set
+func NewObserver(config ObserverConfig) (*Observer, error) {
+	o := &Observer{}
+	if config.OutputFile == "" {
+		return o, nil
+	}
+	file, err := os.OpenFile(config.OutputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return o, fmt.Errorf("failed to open observer output file: %v", err)
+	}
+	o.file = file
+	return o, nil
+}
+
+// Record counts an output, keeps it for Recent and appends it to the output file
+func (o *Observer) Record(output ObserverOutput) error {
+	metricObserverOutputs.Inc(output.Kind)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.recent = append(o.recent, output)
+	if len(o.recent) > OBSERVER_RECENT {
+		o.recent = o.recent[len(o.recent)-OBSERVER_RECENT:]
+	}
+	if o.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write observer output: %v", err)
+	}
+	return nil
+}
+
+// Recent returns the most recent outputs, oldest first
+func (o *Observer) Recent() []ObserverOutput {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]ObserverOutput(nil), o.recent...)
+}
+
+// Close closes the output file
+func (o *Observer) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
+
+// observerPayload keeps JSON payloads as they are and encodes anything else
+// (HL7 messages) as a JSON string
+func observerPayload(data []byte) json.RawMessage {
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	encoded, _ := json.Marshal(string(data))
+	return encoded
+}
+
+// observerPublisher stands in for the event bus publisher in observer mode
+type observerPublisher struct {
+	server *HL7Server
+}
+
+func (p *observerPublisher) Publish(topic, key string, payload []byte) error {
+	p.server.observe(OBSERVER_OUTPUT_PUBLISH, topic, key, "", payload)
+	return nil
+}
+
+func (p *observerPublisher) Close() error {
+	return nil
+}
+
+// Observing reports whether the server runs in observer mode
+func (s *HL7Server) Observing() bool {
+	return s.observer != nil
+}
+
+// Observer returns the recorder of observer mode, nil if the server is live
+func (s *HL7Server) Observer() *Observer {
+	return s.observer
+}
+
+// observe records an output that observer mode did not send
+func (s *HL7Server) observe(kind, target, key, messageID string, payload []byte) {
+	output := ObserverOutput{
+		Time:      s.clock.Now(),
+		Kind:      kind,
+		Target:    target,
+		Key:       key,
+		MessageID: messageID,
+		Payload:   observerPayload(payload),
+	}
+	if err := s.observer.Record(output); err != nil {
+		s.reportError("observer", "", err)
+	}
+	s.logf(LOG_LEVEL_DEBUG, "Observer mode: %s to %s not sent", kind, target)
+}
+
+// observedAck applies the acknowledgment policy of observer mode to the
+// acknowledgment code of a message. It returns false if no acknowledgment
+// is sent.
+func (s *HL7Server) observedAck(code, text string) (string, string, bool) {
+	switch s.settings().Observer.AckPolicy {
+	case OBSERVER_ACK_ACCEPT:
+		return HL7_ACK_ACCEPT, "", true
+	case OBSERVER_ACK_NONE:
+		return code, text, false
+	}
+	return code, text, true
+}
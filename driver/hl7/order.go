@@ -0,0 +1,216 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// Order control codes (ORC-1)
+const (
+	ORDER_CONTROL_NEW    = "NW" // New order
+	ORDER_CONTROL_CANCEL = "CA" // Cancel order request
+)
+
+// Order priorities (ORC-7.6, OBR-27.6)
+const (
+	ORDER_PRIORITY_ROUTINE = "R"
+	ORDER_PRIORITY_STAT    = "S"
+)
+
+// Orders defaults
+const (
+	ORDER_DEFAULT_SENDING_APP = "HL7SERVER"
+	ORDER_DEFAULT_FACILITY    = "HOSPITAL"
+	ORDER_DEFAULT_TIMEOUT     = 10 // Seconds to wait for the acknowledgment
+)
+
+// ORDER_SERVICE_ECG_12_LEAD is the universal service ID (OBR-4) of a 12-lead ECG
+var ORDER_SERVICE_ECG_12_LEAD = OrderService{Code: "11524-6", Name: "EKG study", CodingSystem: "LN"}
+
+// OrderConfig configures the orders generated by internal applications and
+// the system they are sent to
+type OrderConfig struct {
+	Destination          string           `json:"destination"`           // host:port of the order filler's MLLP listener (empty: orders are disabled)
+	SendingApplication   string           `json:"sending_application"`   // MSH-3 (default HL7SERVER)
+	SendingFacility      string           `json:"sending_facility"`      // MSH-4 (default HOSPITAL)
+	ReceivingApplication string           `json:"receiving_application"` // MSH-5
+	ReceivingFacility    string           `json:"receiving_facility"`    // MSH-6
+	Charset              string           `json:"charset"`               // MSH-18, e.g. "SHIFT_JIS" or "~ISO IR87" (empty: UTF-8 without MSH-18)
+	Timeout              int              `json:"timeout"`               // Seconds to wait for the acknowledgment (0: 10)
+	Transport            transport.Config `json:"transport"`             // TLS and proxy
+}
+
+// OrderService identifies what is ordered (OBR-4)
+type OrderService struct {
+	Code         string `json:"code"`
+	Name         string `json:"name"`
+	CodingSystem string `json:"coding_system"` // e.g. "LN"
+}
+
+// OrderRequest is an order placed by an internal application
+type OrderRequest struct {
+	Control           string       `json:"control"`             // ORC-1: NW (default) or CA
+	PlacerOrderNumber string       `json:"placer_order_number"` // ORC-2/OBR-2, unique per order
+	PatientID         string       `json:"patient_id"`          // PID-3
+	FamilyName        string       `json:"family_name"`         // PID-5.1
+	GivenName         string       `json:"given_name"`          // PID-5.2
+	DateOfBirth       string       `json:"date_of_birth"`       // PID-7, YYYYMMDD
+	Sex               string       `json:"sex"`                 // PID-8: M, F, O, U
+	PatientClass      string       `json:"patient_class"`       // PV1-2, e.g. "I" (default "U")
+	Location          string       `json:"location"`            // PV1-3 as point of care^room^bed
+	Service           OrderService `json:"service"`             // OBR-4
+	Priority          string       `json:"priority"`            // R (default) or S
+	OrderingProvider  string       `json:"ordering_provider"`   // ORC-12/OBR-16 as ID^family^given
+	Reason            string       `json:"reason"`              // OBR-31 reason for study (text)
+	RequestedTime     time.Time    `json:"requested_time"`      // OBR-6/ORC-7.4 (default: now)
+}
+
+// orderSequence numbers the orders generated within the same second
+var orderSequence uint64
+
+// Validate checks the fields an order filler requires
+func (o *OrderRequest) Validate() error {
+	problems := make([]string, 0)
+	if o.PlacerOrderNumber == "" {
+		problems = append(problems, "placer_order_number is required")
+	}
+	if o.PatientID == "" {
+		problems = append(problems, "patient_id is required")
+	}
+	if o.Service.Code == "" {
+		problems = append(problems, "service.code is required")
+	}
+	switch o.Control {
+	case "", ORDER_CONTROL_NEW, ORDER_CONTROL_CANCEL:
+	default:
+		problems = append(problems, fmt.Sprintf("control must be %s or %s, got %q", ORDER_CONTROL_NEW, ORDER_CONTROL_CANCEL, o.Control))
+	}
+	switch o.Priority {
+	case "", ORDER_PRIORITY_ROUTINE, ORDER_PRIORITY_STAT:
+	default:
+		problems = append(problems, fmt.Sprintf("priority must be %s or %s, got %q", ORDER_PRIORITY_ROUTINE, ORDER_PRIORITY_STAT, o.Priority))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid order: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// BuildORM generates an ORM^O01 message (HL7 2.5) for an order and returns it
+// with its message control ID. Values are escaped, so they may contain the
+// HL7 delimiters. The message is parsed again before it is returned, then
+// encoded in the configured character set.
+func BuildORM(config OrderConfig, order OrderRequest, now time.Time) (string, string, error) {
+	if err := order.Validate(); err != nil {
+		return "", "", err
+	}
+
+	control := firstNonEmpty(order.Control, ORDER_CONTROL_NEW)
+	priority := firstNonEmpty(order.Priority, ORDER_PRIORITY_ROUTINE)
+	requested := order.RequestedTime
+	if requested.IsZero() {
+		requested = now
+	}
+	timestamp := now.Format("20060102150405")
+	requestedTime := requested.Format("20060102150405")
+	controlID := fmt.Sprintf("ORM%s%04d", timestamp, atomic.AddUint64(&orderSequence, 1)%10000)
+
+	location := strings.Split(order.Location, "^")
+	for i := range location {
+		location[i] = escapeHL7(location[i])
+	}
+	provider := strings.Split(order.OrderingProvider, "^")
+	for i := range provider {
+		provider[i] = escapeHL7(provider[i])
+	}
+	service := escapeHL7(order.Service.Code) + "^" + escapeHL7(order.Service.Name) + "^" + escapeHL7(order.Service.CodingSystem)
+	timing := "^^^" + requestedTime + "^^" + priority
+
+	header := []string{"MSH", "^~\\&",
+		escapeHL7(firstNonEmpty(config.SendingApplication, ORDER_DEFAULT_SENDING_APP)),
+		escapeHL7(firstNonEmpty(config.SendingFacility, ORDER_DEFAULT_FACILITY)),
+		escapeHL7(config.ReceivingApplication), escapeHL7(config.ReceivingFacility),
+		timestamp, "", "ORM^O01^ORM_O01", controlID, "P", HL7_DEFAULT_VERSION}
+	if config.Charset != "" {
+		header = append(header, "", "", "", "", "", config.Charset)
+	}
+	segments := []string{
+		strings.Join(header, "|"),
+		strings.Join([]string{"PID", "1", "", escapeHL7(order.PatientID), "",
+			escapeHL7(order.FamilyName) + "^" + escapeHL7(order.GivenName), "",
+			escapeHL7(order.DateOfBirth), escapeHL7(order.Sex)}, "|"),
+		strings.Join([]string{"PV1", "1", escapeHL7(firstNonEmpty(order.PatientClass, "U")), strings.Join(location, "^")}, "|"),
+		strings.Join([]string{"ORC", control, escapeHL7(order.PlacerOrderNumber), "", "", "", "", timing, "",
+			timestamp, "", "", strings.Join(provider, "^")}, "|"),
+		strings.Join([]string{"OBR", "1", escapeHL7(order.PlacerOrderNumber), "", service, "", requestedTime,
+			"", "", "", "", "", "", "", "", "", strings.Join(provider, "^"), "", "", "", "", "", "", "", "", "", "",
+			timing, "", "", "", escapeHL7(order.Reason)}, "|"),
+	}
+	message := strings.Join(segments, "\r") + "\r"
+
+	if _, err := NewHL7Parser().ParseMessage(message); err != nil {
+		return "", "", fmt.Errorf("generated ORM message is invalid: %v", err)
+	}
+	encoded, err := EncodeMessage(message)
+	if err != nil {
+		return "", "", fmt.Errorf("order cannot be sent in %s: %v", config.Charset, err)
+	}
+	return encoded, controlID, nil
+}
+
+// SendOrder generates an ORM^O01 message for an order and sends it to the
+// configured order filler. It returns the message control ID once the order
+// filler has accepted the message.
+func (s *HL7Server) SendOrder(order OrderRequest) (string, error) {
+	config := s.settings().Orders
+	if config.Destination == "" {
+		return "", fmt.Errorf("orders are not configured")
+	}
+
+	message, controlID, err := BuildORM(config, order, s.clock.Now())
+	if err != nil {
+		return "", err
+	}
+
+	if s.observer != nil {
+		s.observe(OBSERVER_OUTPUT_ORDER, config.Destination, order.PatientID, controlID, []byte(message))
+		return controlID, nil
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = ORDER_DEFAULT_TIMEOUT
+	}
+	client := NewMLLPClient(config.Destination, time.Duration(timeout)*time.Second)
+	if err := client.SetTransport(config.Transport); err != nil {
+		s.reportError("order", "", fmt.Errorf("order %s: %v", order.PlacerOrderNumber, err))
+		return controlID, err
+	}
+	if _, err := client.Send(message); err != nil {
+		s.reportError("order", "", fmt.Errorf("order %s: %v", order.PlacerOrderNumber, err))
+		return controlID, err
+	}
+
+	s.logf(LOG_LEVEL_INFO, "Sent order %s (%s) for patient %s to %s", order.PlacerOrderNumber, order.Service.Code, s.loggedPatientID(order.PatientID), config.Destination)
+	return controlID, nil
+}
+
+// escapeHL7 escapes the default HL7 delimiters in a value
+func escapeHL7(value string) string {
+	return hl7Escaper.Replace(value)
+}
+
+// hl7Escaper replaces the default delimiters with their escape sequences
+var hl7Escaper = strings.NewReplacer(
+	"\\", "\\E\\",
+	"|", "\\F\\",
+	"^", "\\S\\",
+	"&", "\\T\\",
+	"~", "\\R\\",
+	"\r", " ",
+	"\n", " ",
+)
@@ -0,0 +1,239 @@
+package hl7
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+)
+
+// IHE PCD-01 (Communicate PCD Data) message identifiers
+const (
+	PCD01_PROFILE_ID   = "PCD_DEC_001"                                                 // MSH-21.1
+	PCD01_PROFILE      = PCD01_PROFILE_ID + "^IHE PCD^1.3.6.1.4.1.19376.1.6.1.1.1^ISO" // MSH-21
+	PCD01_VERSION      = "2.6"                                                         // MSH-12
+	PCD01_MESSAGE_TYPE = "ORU^R01^ORU_R01"                                             // MSH-9
+	PCD01_OBR_CODE     = "182777000^monitoring of patient^SCT"                         // OBR-4
+	PCD01_DEFAULT_APP  = "VSP"                                                         // MSH-3.1
+	PCD01_MDS          = "MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS"                          // Default device (MDS) code
+)
+
+// PCDConfig identifies the sender and receiver of PCD-01 messages
+type PCDConfig struct {
+	SendingApplication   string `json:"sending_application"`   // MSH-3.1 (default VSP)
+	SendingFacility      string `json:"sending_facility"`      // MSH-4 (default HOSPITAL)
+	ReceivingApplication string `json:"receiving_application"` // MSH-5
+	ReceivingFacility    string `json:"receiving_facility"`    // MSH-6
+}
+
+// PCDDevice describes a device as an IHE PCD containment tree: the device
+// (MDS) contains virtual medical devices (VMD), which contain channels
+// (CHAN), which contain the metrics. Codes are MDC reference IDs (e.g.
+// MDC_DEV_ECG_VMD) or coded elements (69798^MDC_DEV_ECG_VMD^MDC).
+type PCDDevice struct {
+	EUI64    string       `json:"eui64"`    // MSH-3.2, OBR-2/OBR-3 and OBX-18.1
+	Model    string       `json:"model"`    // OBX-18.2 (e.g. B1X5_GE)
+	MDS      string       `json:"mds"`      // OBX-3 of the device (default MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS)
+	Channels []PCDChannel `json:"channels"` // In the order of the message
+}
+
+// PCDChannel is a channel of a device. Channels of the same VMD are
+// numbered in their order (OBX-4 MDS.VMD.CHAN.metric).
+type PCDChannel struct {
+	ID     string `json:"id"`      // Name of the channel in the metrics (e.g. "ART", "CVP")
+	VMD    string `json:"vmd"`     // OBX-3 of the VMD (e.g. MDC_DEV_METER_PRESS_BLD_VMD)
+	VMDNum int    `json:"vmd_num"` // VMD number of OBX-4 (e.g. 13 for blood pressure)
+	Code   string `json:"code"`    // OBX-3 of the channel (empty: no channel OBX, as for ECG)
+}
+
+// PCDMetric is a measured value of a channel
+type PCDMetric struct {
+	Channel   string    `json:"channel"`    // ID of the channel
+	Code      string    `json:"code"`       // OBX-3 (e.g. MDC_ECG_HEART_RATE)
+	Value     string    `json:"value"`      // OBX-5
+	ValueType string    `json:"value_type"` // OBX-2 (default NM)
+	Unit      string    `json:"unit"`       // OBX-6 (default: the default unit of an MDC code)
+	Time      time.Time `json:"time"`       // OBX-14 (optional)
+}
+
+// PCDReport is one PCD-01 observation report of a device
+type PCDReport struct {
+	Device       PCDDevice   `json:"device"`
+	Metrics      []PCDMetric `json:"metrics"`
+	Time         time.Time   `json:"time"`          // OBR-7 (default: the time of the message)
+	PatientID    string      `json:"patient_id"`    // PID-3
+	FamilyName   string      `json:"family_name"`   // PID-5.1
+	GivenName    string      `json:"given_name"`    // PID-5.2
+	PatientClass string      `json:"patient_class"` // PV1-2 (default "E")
+	Location     string      `json:"location"`      // PV1-3 as point of care^room^bed
+}
+
+// pcdSequence numbers the PCD-01 messages generated within the same second
+var pcdSequence uint64
+
+// Validate checks that the report can be built: known channels with VMD
+// numbers, and a code and value for every metric
+func (r *PCDReport) Validate() error {
+	problems := make([]string, 0)
+	if r.Device.EUI64 == "" {
+		problems = append(problems, "device.eui64 is required")
+	}
+	channels := make(map[string]bool, len(r.Device.Channels))
+	for i, channel := range r.Device.Channels {
+		if channel.ID == "" || channels[channel.ID] {
+			problems = append(problems, fmt.Sprintf("device.channels[%d]: id must be set and unique, got %q", i, channel.ID))
+		}
+		if channel.VMD == "" || channel.VMDNum <= 0 {
+			problems = append(problems, fmt.Sprintf("device.channels[%d]: vmd and a positive vmd_num are required", i))
+		}
+		channels[channel.ID] = true
+	}
+	if len(r.Metrics) == 0 {
+		problems = append(problems, "metrics are required")
+	}
+	for i, metric := range r.Metrics {
+		if !channels[metric.Channel] {
+			problems = append(problems, fmt.Sprintf("metrics[%d]: unknown channel %q", i, metric.Channel))
+		}
+		if metric.Code == "" || metric.Value == "" {
+			problems = append(problems, fmt.Sprintf("metrics[%d]: code and value are required", i))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid PCD-01 report: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// BuildPCD01 generates an IHE PCD-01 ORU^R01 message (HL7 2.6) for a report
+// and returns it with its message control ID. The OBX segments follow the
+// containment tree of the device as the GE monitors send it: the MDS
+// (1.0.0.0), then per VMD its OBX (1.v.0.0) and per channel its OBX
+// (1.v.c.0) followed by the metrics of the channel (1.v.c.m). The message
+// is parsed again before it is returned.
+func BuildPCD01(config PCDConfig, report PCDReport, now time.Time) (string, string, error) {
+	if err := report.Validate(); err != nil {
+		return "", "", err
+	}
+
+	timestamp := now.Format("20060102150405")
+	reportTime := timestamp
+	if !report.Time.IsZero() {
+		reportTime = report.Time.Format("20060102150405")
+	}
+	controlID := fmt.Sprintf("PCD%s%04d", timestamp, atomic.AddUint64(&pcdSequence, 1)%10000)
+	identity := DeviceIdentity{EUI64: report.Device.EUI64, Model: report.Device.Model}
+	sendingApp := identity.SendingApplication(firstNonEmpty(config.SendingApplication, PCD01_DEFAULT_APP))
+	equipment := identity.EquipmentIdentifier()
+	fillerOrder := escapeHL7(identity.EUI64) + reportTime + "^" + sendingApp
+
+	segments := []string{
+		strings.Join([]string{"MSH", "^~\\&", sendingApp,
+			escapeHL7(firstNonEmpty(config.SendingFacility, ORDER_DEFAULT_FACILITY)),
+			escapeHL7(config.ReceivingApplication), escapeHL7(config.ReceivingFacility),
+			timestamp, "", PCD01_MESSAGE_TYPE, controlID, "P", PCD01_VERSION,
+			"", "", "NE", "AL", "", "UNICODE UTF-8", "", "", PCD01_PROFILE}, "|"),
+	}
+	if report.PatientID != "" || report.Location != "" {
+		location := strings.Split(report.Location, "^")
+		for i := range location {
+			location[i] = escapeHL7(location[i])
+		}
+		segments = append(segments,
+			strings.Join([]string{"PID", "", "", escapeHL7(report.PatientID) + "^^^PID^MR", "",
+				escapeHL7(report.FamilyName) + "^" + escapeHL7(report.GivenName) + "^^^^^L"}, "|"),
+			strings.Join([]string{"PV1", "", escapeHL7(firstNonEmpty(report.PatientClass, "E")), strings.Join(location, "^")}, "|"))
+	}
+	segments = append(segments,
+		strings.Join([]string{"OBR", "1", fillerOrder, fillerOrder, PCD01_OBR_CODE, "", "", reportTime}, "|"))
+
+	setID := 0
+	addOBX := func(valueType, code, subID, value, unit, status, observed string) {
+		setID++
+		segments = append(segments, strings.Join([]string{"OBX", strconv.Itoa(setID), valueType, code, subID,
+			value, unit, "", "", "", "", status, "", "", observed, "", "", "", equipment}, "|"))
+	}
+
+	mds, err := pcdCode(firstNonEmpty(report.Device.MDS, PCD01_MDS))
+	if err != nil {
+		return "", "", fmt.Errorf("device.mds: %v", err)
+	}
+	addOBX("", mds, "1.0.0.0", "", "", "X", "")
+
+	vmds := make(map[int]bool)
+	channelNums := make(map[int]int)
+	for _, channel := range report.Device.Channels {
+		if !vmds[channel.VMDNum] {
+			vmds[channel.VMDNum] = true
+			code, err := pcdCode(channel.VMD)
+			if err != nil {
+				return "", "", fmt.Errorf("channel %s: vmd: %v", channel.ID, err)
+			}
+			addOBX("", code, fmt.Sprintf("1.%d.0.0", channel.VMDNum), "", "", "X", "")
+		}
+		channelNums[channel.VMDNum]++
+		channelNum := channelNums[channel.VMDNum]
+		if channel.Code != "" {
+			code, err := pcdCode(channel.Code)
+			if err != nil {
+				return "", "", fmt.Errorf("channel %s: %v", channel.ID, err)
+			}
+			addOBX("", code, fmt.Sprintf("1.%d.%d.0", channel.VMDNum, channelNum), "", "", "X", "")
+		}
+
+		metricNum := 0
+		for _, metric := range report.Metrics {
+			if metric.Channel != channel.ID {
+				continue
+			}
+			metricNum++
+			code, err := pcdCode(metric.Code)
+			if err != nil {
+				return "", "", fmt.Errorf("channel %s: metric: %v", channel.ID, err)
+			}
+			unit := metric.Unit
+			if unit == "" {
+				if entry, err := mdc.ParseCE(code, "^"); err == nil {
+					if unitCode, found := entry.Unit(); found {
+						unit = unitCode.CE()
+					}
+				}
+			} else if unit, err = pcdCode(unit); err != nil {
+				return "", "", fmt.Errorf("channel %s: unit: %v", channel.ID, err)
+			}
+			observed := ""
+			if !metric.Time.IsZero() {
+				observed = metric.Time.Format("20060102150405")
+			}
+			addOBX(firstNonEmpty(metric.ValueType, "NM"), code,
+				fmt.Sprintf("1.%d.%d.%d", channel.VMDNum, channelNum, metricNum),
+				escapeHL7(metric.Value), unit, "R", observed)
+		}
+	}
+	message := strings.Join(segments, "\r") + "\r"
+
+	parsed, err := NewHL7Parser().ParseMessage(message)
+	if err != nil {
+		return "", "", fmt.Errorf("generated ORU^R01 message is invalid: %v", err)
+	}
+	if msh := parsed.MSH(); msh == nil || msh.MessageProfileID() != PCD01_PROFILE_ID {
+		return "", "", fmt.Errorf("generated ORU^R01 message has no %s profile", PCD01_PROFILE_ID)
+	}
+	return message, controlID, nil
+}
+
+// pcdCode returns a code as coded element: MDC reference IDs are looked up
+// in the code table, coded elements are used as they are
+func pcdCode(value string) (string, error) {
+	if strings.Contains(value, "^") {
+		return value, nil
+	}
+	code, found := mdc.LookupReferenceID(value)
+	if !found {
+		return "", fmt.Errorf("unknown MDC reference ID %q", value)
+	}
+	return code.CE(), nil
+}
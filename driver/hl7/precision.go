@@ -0,0 +1,99 @@
+package hl7
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+	"github.com/harusin0516/healthcare/driver/precision"
+)
+
+// PrecisionConfig configures the display precision of numeric observation
+// values
+type PrecisionConfig struct {
+	Enabled  bool           `json:"enabled"`
+	Decimals map[string]int `json:"decimals"` // Decimals per parameter or unit (MDC reference ID, or OBX-3.2 of other coding systems), added to or replacing the built-in table
+}
+
+// RoundObservationValues rounds the numeric values (OBX-5 of NM segments)
+// of a message to the decimals of their parameter, so that the stored and
+// forwarded message, its JSON and the reports built from it show the same
+// value. Values with no more decimals than allowed are left as sent ("37.0"
+// stays "37.0"). The parsed fields, the segment and the raw message are
+// updated. It returns the number of values rounded.
+func RoundObservationValues(message *HL7Message, policy *precision.Policy) int {
+	rounded := 0
+	for _, obx := range message.OBXSegments() {
+		if obx.ValueType() != "NM" {
+			continue
+		}
+		value := strings.TrimSpace(obx.ObservationValue())
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		parameter, unit := observationParameter(obx)
+		decimals, exists := policy.Decimals(parameter, unit)
+		if !exists {
+			continue
+		}
+		if dot := strings.IndexByte(value, '.'); dot < 0 || len(value)-dot-1 <= decimals {
+			continue
+		}
+
+		formatted := precision.FormatDecimals(number, decimals)
+		obx.SetObservationValue(formatted)
+		setRawField(message, obx.HL7Segment, 5, formatted)
+		rounded++
+	}
+	return rounded
+}
+
+// observationParameter returns the key of an OBX segment in the precision
+// table: the MDC reference IDs of OBX-3 and OBX-6, or their text for other
+// coding systems
+func observationParameter(obx *OBXSegment) (string, string) {
+	parameter := firstNonEmpty(obx.ObservationText(), obx.ObservationCode())
+	if obx.ObservationCodingSystem() == mdc.CODING_SYSTEM {
+		if code, err := mdc.ParseCE(obx.ObservationCode()+"^"+obx.ObservationText(), "^"); err == nil {
+			parameter = code.ReferenceID
+		}
+	}
+	unit := firstNonEmpty(obx.UnitText(), obx.UnitCode())
+	if units := obx.Units(); units != nil && units.ComponentValue(3) == mdc.CODING_SYSTEM {
+		if code, err := mdc.ParseCE(obx.UnitCode()+"^"+obx.UnitText(), "^"); err == nil {
+			unit = code.ReferenceID
+		}
+	}
+	return parameter, unit
+}
+
+// setRawField replaces a field of a segment in the segment's and the
+// message's raw text with value, which must already use the message's
+// separators
+func setRawField(message *HL7Message, segment *HL7Segment, position int, value string) {
+	fieldSeparator, _ := messageSeparators(message)
+	fields := strings.Split(segment.Raw, fieldSeparator)
+	if len(fields) <= position {
+		return
+	}
+	raw := segment.Raw
+	fields[position] = value
+	segment.Raw = strings.Join(fields, fieldSeparator)
+	message.Raw = strings.Replace(message.Raw, raw, segment.Raw, 1)
+}
+
+// messageSeparators returns the field and component separators of a
+// message ("|" and "^" if the MSH does not declare them)
+func messageSeparators(message *HL7Message) (string, string) {
+	fieldSeparator, componentSeparator := "|", "^"
+	if msh := message.MSH(); msh != nil {
+		if separator := msh.FieldValue(1); separator != "" {
+			fieldSeparator = separator
+		}
+		if encoding := msh.EncodingCharacters(); encoding != "" {
+			componentSeparator = encoding[:1]
+		}
+	}
+	return fieldSeparator, componentSeparator
+}
@@ -0,0 +1,131 @@
+package hl7
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HL7_DEFAULT_VERSION is the profile used for messages without a version (MSH-12)
+const HL7_DEFAULT_VERSION = "2.5"
+
+// VersionProfile describes where the fields read by this driver are located
+// in one HL7 version, and which optional fields the version defines
+type VersionProfile struct {
+	Version               string
+	PatientIDFields       []int // PID fields searched for the patient ID, in order
+	ObservationTimeFields []int // OBX fields searched for the observation time, in order
+	MessageStructure      bool  // MSH-9.3 is defined (2.3.1 and later)
+	MessageProfile        bool  // MSH-21 is defined (2.5 and later)
+}
+
+// versionProfiles lists the supported versions, oldest first.
+// PID-2 (Patient ID, external) is deprecated from 2.3.1 but still sent by
+// older devices in place of PID-3; OBX-19 (Date/Time of the Analysis) was
+// added in 2.5 and is used when OBX-14 is empty.
+var versionProfiles = []*VersionProfile{
+	{Version: "2.3", PatientIDFields: []int{3, 2}, ObservationTimeFields: []int{14}},
+	{Version: "2.3.1", PatientIDFields: []int{3, 2}, ObservationTimeFields: []int{14}, MessageStructure: true},
+	{Version: "2.4", PatientIDFields: []int{3, 2}, ObservationTimeFields: []int{14}, MessageStructure: true},
+	{Version: "2.5", PatientIDFields: []int{3}, ObservationTimeFields: []int{14, 19}, MessageStructure: true, MessageProfile: true},
+	{Version: "2.5.1", PatientIDFields: []int{3}, ObservationTimeFields: []int{14, 19}, MessageStructure: true, MessageProfile: true},
+	{Version: "2.6", PatientIDFields: []int{3}, ObservationTimeFields: []int{14, 19}, MessageStructure: true, MessageProfile: true},
+}
+
+// ProfileFor returns the profile of an HL7 version (MSH-12). A version
+// without its own profile uses the profile of its major.minor version
+// ("2.4.1" uses "2.4"); versions older than 2.3 use the 2.3 profile, newer
+// than 2.6 the 2.6 profile and anything else (including no version) the 2.5
+// profile.
+func ProfileFor(version string) *VersionProfile {
+	version = strings.TrimSpace(version)
+	for _, candidate := range []string{version, majorMinor(version)} {
+		for _, profile := range versionProfiles {
+			if profile.Version == candidate {
+				return profile
+			}
+		}
+	}
+
+	oldest, latest := versionProfiles[0], versionProfiles[len(versionProfiles)-1]
+	switch {
+	case strings.Trim(version, "0123456789.") != "", version == "":
+		// No version, or not a version number
+	case compareVersions(version, latest.Version) > 0:
+		return latest
+	case compareVersions(version, oldest.Version) < 0:
+		return oldest
+	}
+	for _, profile := range versionProfiles {
+		if profile.Version == HL7_DEFAULT_VERSION {
+			return profile
+		}
+	}
+	return latest
+}
+
+// Profile returns the version profile of a message by its MSH-12
+func (m *HL7Message) Profile() *VersionProfile {
+	if msh := m.MSH(); msh != nil {
+		return ProfileFor(msh.Version())
+	}
+	return ProfileFor("")
+}
+
+// PatientID returns the first non-empty patient ID of a PID segment. Every
+// repetition of PID-3 is searched before the fields used by older versions.
+func (p *VersionProfile) PatientID(pid *PIDSegment) string {
+	if pid == nil {
+		return ""
+	}
+	for _, position := range p.PatientIDFields {
+		for _, identifier := range pid.Repetitions(position) {
+			if id := identifier.ComponentValue(1); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// ObservationTime returns the observation time of an OBX segment
+func (p *VersionProfile) ObservationTime(obx *OBXSegment) (time.Time, error) {
+	for _, position := range p.ObservationTimeFields {
+		if value := obx.FieldValue(position); value != "" {
+			return ParseHL7Time(value)
+		}
+	}
+	return time.Time{}, fmt.Errorf("no observation time")
+}
+
+// majorMinor returns the major.minor part of a version ("2.5.1" -> "2.5")
+func majorMinor(version string) string {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// compareVersions compares dotted version numbers, returning -1, 0 or 1.
+// Parts that are not numbers compare as 0.
+func compareVersions(a, b string) int {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			y, _ = strconv.Atoi(partsB[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
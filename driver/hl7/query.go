@@ -0,0 +1,253 @@
+package hl7
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query message types and segments
+const (
+	HL7_MSG_QBP = "QBP" // Query by Parameter
+	HL7_MSG_RSP = "RSP" // Segment Pattern Response
+	HL7_SEG_QPD = "QPD" // Query Parameter Definition
+	HL7_SEG_RCP = "RCP" // Response Control Parameter
+	HL7_SEG_QAK = "QAK" // Query Acknowledgment
+)
+
+// QUERY_PDQ is the trigger event (MSH-9.2) of patient demographics queries
+const QUERY_PDQ = "Q22"
+
+// QUERY_PDQ_NAME is the query name (QPD-1.1) of IHE PDQ queries
+const QUERY_PDQ_NAME = "IHE PDQ Query"
+
+// Query response status (QAK-2)
+const (
+	QUERY_STATUS_OK        = "OK" // Data found
+	QUERY_STATUS_NOT_FOUND = "NF" // No data found
+	QUERY_STATUS_ERROR     = "AE" // Application error, e.g. an unsupported parameter
+	QUERY_STATUS_REJECTED  = "AR" // Application reject, e.g. no responder
+)
+
+// Demographics query parameters (QPD-3.1), as IHE PDQ names them
+const (
+	QUERY_PARAM_PATIENT_ID  = "@PID.3.1"
+	QUERY_PARAM_FAMILY_NAME = "@PID.5.1.1"
+	QUERY_PARAM_GIVEN_NAME  = "@PID.5.2"
+	QUERY_PARAM_BIRTH_DATE  = "@PID.7.1"
+	QUERY_PARAM_SEX         = "@PID.8"
+	QUERY_PARAM_LOCATION    = "@PV1.3"
+)
+
+// queryParameterAliases maps the shorter forms senders use to the names above
+var queryParameterAliases = map[string]string{
+	"@PID.3":   QUERY_PARAM_PATIENT_ID,
+	"@PID.5.1": QUERY_PARAM_FAMILY_NAME,
+	"@PID.7":   QUERY_PARAM_BIRTH_DATE,
+}
+
+// PatientQuery is a patient demographics query (QBP^Q22)
+type PatientQuery struct {
+	Name       string            `json:"name"`       // QPD-1.1
+	Tag        string            `json:"tag"`        // QPD-2, echoed in QAK-1
+	Parameters map[string]string `json:"parameters"` // QPD-3 by QUERY_PARAM_* name
+	Limit      int               `json:"limit"`      // RCP-2.1, most patients returned (0: all)
+}
+
+// QueryResponder answers patient demographics queries. A trailing "*" in a
+// name parameter matches any suffix. An error is answered with
+// QUERY_STATUS_ERROR and its text.
+type QueryResponder interface {
+	FindPatients(query *PatientQuery) ([]*PatientContext, error)
+}
+
+// ParsePatientQuery reads the query of a QBP^Q22 message
+func ParsePatientQuery(message *HL7Message) (*PatientQuery, error) {
+	msh := message.MSH()
+	if msh == nil || msh.MessageType() != HL7_MSG_QBP || msh.TriggerEvent() != QUERY_PDQ {
+		return nil, fmt.Errorf("not a QBP^%s message", QUERY_PDQ)
+	}
+	qpd := message.GetSegmentByType(HL7_SEG_QPD)
+	if qpd == nil {
+		return nil, fmt.Errorf("QBP^%s message has no QPD segment", QUERY_PDQ)
+	}
+
+	query := &PatientQuery{
+		Name:       qpd.Component(1, 1),
+		Tag:        qpd.FieldValue(2),
+		Parameters: make(map[string]string),
+	}
+	for _, parameter := range qpd.Repetitions(3) {
+		name := strings.ToUpper(strings.TrimSpace(parameter.ComponentValue(1)))
+		if name == "" {
+			continue
+		}
+		if alias, exists := queryParameterAliases[name]; exists {
+			name = alias
+		}
+		query.Parameters[name] = parameter.ComponentValue(2)
+	}
+	if rcp := message.GetSegmentByType(HL7_SEG_RCP); rcp != nil {
+		if limit := rcp.Component(2, 1); limit != "" {
+			value, err := strconv.Atoi(limit)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("RCP-2: invalid quantity %q", limit)
+			}
+			query.Limit = value
+		}
+	}
+	return query, nil
+}
+
+// FindPatients answers a demographics query with the registered patients,
+// ordered by location and patient ID. Names match without regard to case.
+func (r *PatientRegistry) FindPatients(query *PatientQuery) ([]*PatientContext, error) {
+	for name := range query.Parameters {
+		switch name {
+		case QUERY_PARAM_PATIENT_ID, QUERY_PARAM_FAMILY_NAME, QUERY_PARAM_GIVEN_NAME,
+			QUERY_PARAM_BIRTH_DATE, QUERY_PARAM_SEX, QUERY_PARAM_LOCATION:
+		default:
+			return nil, fmt.Errorf("unsupported query parameter %s", name)
+		}
+	}
+
+	var found []*PatientContext
+	for _, patient := range r.Patients("") {
+		if matchQuery(query.Parameters[QUERY_PARAM_PATIENT_ID], patient.PatientID, false) &&
+			matchQuery(query.Parameters[QUERY_PARAM_FAMILY_NAME], patient.FamilyName, true) &&
+			matchQuery(query.Parameters[QUERY_PARAM_GIVEN_NAME], patient.GivenName, true) &&
+			matchQuery(query.Parameters[QUERY_PARAM_BIRTH_DATE], patient.DateOfBirth, false) &&
+			matchQuery(query.Parameters[QUERY_PARAM_SEX], patient.Sex, false) &&
+			matchQuery(query.Parameters[QUERY_PARAM_LOCATION], patient.Location, false) {
+			found = append(found, patient)
+		}
+	}
+	return found, nil
+}
+
+// matchQuery reports whether a value matches a query parameter (empty
+// matches all). Names may end with the wildcard "*" and ignore case.
+func matchQuery(parameter, value string, name bool) bool {
+	if parameter == "" {
+		return true
+	}
+	if !name {
+		return parameter == value
+	}
+	parameter, value = strings.ToUpper(parameter), strings.ToUpper(value)
+	if prefix := strings.TrimSuffix(parameter, "*"); prefix != parameter {
+		return strings.HasPrefix(value, prefix)
+	}
+	return parameter == value
+}
+
+// BuildRSPK22 generates the RSP^K22 response to a QBP^Q22 query with the
+// patients found (at most query.Limit), addressed back to the sender. The
+// query (QPD) is echoed as sent; status is QUERY_STATUS_* and text the
+// error of an AE or AR response.
+func BuildRSPK22(message *HL7Message, query *PatientQuery, patients []*PatientContext, status, text string, now time.Time) string {
+	msh := message.MSH()
+	sendingApplication, sendingFacility, controlID := "", "", ""
+	if msh != nil {
+		sendingApplication, sendingFacility, controlID = msh.SendingApplication(), msh.SendingFacility(), msh.ControlID()
+	}
+	if status == QUERY_STATUS_OK && len(patients) == 0 {
+		status = QUERY_STATUS_NOT_FOUND
+	}
+	if query != nil && query.Limit > 0 && len(patients) > query.Limit {
+		patients = patients[:query.Limit]
+	}
+
+	ackCode := HL7_ACK_ACCEPT
+	switch status {
+	case QUERY_STATUS_ERROR:
+		ackCode = HL7_ACK_ERROR
+	case QUERY_STATUS_REJECTED:
+		ackCode = HL7_ACK_REJECT
+	}
+	timestamp := now.Format("20060102150405")
+	segments := []string{
+		strings.Join([]string{"MSH", "^~\\&", "HL7SERVER", "HOSPITAL", escapeHL7(sendingApplication), escapeHL7(sendingFacility),
+			timestamp, "", "RSP^K22^RSP_K21", "RSP" + controlID, "P", HL7_DEFAULT_VERSION}, "|"),
+		strings.TrimRight(strings.Join([]string{HL7_SEG_MSA, ackCode, escapeHL7(controlID), escapeHL7(text)}, "|"), "|"),
+	}
+	if ackCode != HL7_ACK_ACCEPT {
+		// ERR-3 207 = application internal error, ERR-4 E = error
+		segments = append(segments, "ERR|||207^Application internal error^HL70357|E||||"+escapeHL7(text))
+	}
+	tag := ""
+	if query != nil {
+		tag = query.Tag
+	}
+	segments = append(segments, strings.Join([]string{HL7_SEG_QAK, escapeHL7(tag), status}, "|"))
+	if qpd := message.GetSegmentByType(HL7_SEG_QPD); qpd != nil {
+		segments = append(segments, qpd.Raw)
+	}
+	for i, patient := range patients {
+		segments = append(segments, strings.TrimRight(strings.Join([]string{HL7_SEG_PID, strconv.Itoa(i + 1), "",
+			escapeHL7(patient.PatientID), "", escapeHL7(patient.FamilyName) + "^" + escapeHL7(patient.GivenName), "",
+			escapeHL7(patient.DateOfBirth), escapeHL7(patient.Sex)}, "|"), "|"))
+		if patient.Location != "" || patient.PatientClass != "" || patient.VisitNumber != "" {
+			location := strings.Split(patient.Location, "^")
+			for j := range location {
+				location[j] = escapeHL7(location[j])
+			}
+			pv1 := []string{HL7_SEG_PV1, "1", escapeHL7(patient.PatientClass), strings.Join(location, "^")}
+			for len(pv1) < 20 {
+				pv1 = append(pv1, "")
+			}
+			pv1[19] = escapeHL7(patient.VisitNumber)
+			segments = append(segments, strings.TrimRight(strings.Join(pv1, "|"), "|"))
+		}
+	}
+	return strings.Join(segments, "\r") + "\r"
+}
+
+// SetQueryResponder answers patient demographics queries (QBP^Q22) with
+// responder (nil: queries are rejected). The patient registry answers them
+// when it is enabled.
+func (s *HL7Server) SetQueryResponder(responder QueryResponder) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queryResponder = responder
+}
+
+// answerQuery answers a query message with an RSP^K22 response. Queries
+// are not stored, forwarded or counted as received messages.
+func (s *HL7Server) answerQuery(conn net.Conn, clientID string, message *HL7Message) {
+	s.mutex.RLock()
+	responder := s.queryResponder
+	s.mutex.RUnlock()
+
+	status, text := QUERY_STATUS_OK, ""
+	var patients []*PatientContext
+	query, err := ParsePatientQuery(message)
+	switch {
+	case err != nil:
+		status, text = QUERY_STATUS_ERROR, err.Error()
+	case responder == nil:
+		status, text = QUERY_STATUS_REJECTED, "patient queries are not supported"
+	default:
+		if patients, err = responder.FindPatients(query); err != nil {
+			status, text = QUERY_STATUS_ERROR, err.Error()
+		}
+	}
+	if status == QUERY_STATUS_OK && len(patients) == 0 {
+		status = QUERY_STATUS_NOT_FOUND
+	}
+	metricQueries.Inc(status)
+
+	// Observer mode records nothing for queries; it only answers them if
+	// it acknowledges messages
+	if s.observer != nil && s.settings().Observer.AckPolicy == OBSERVER_ACK_NONE {
+		return
+	}
+	response := BuildRSPK22(message, query, patients, status, text, s.clock.Now())
+	if err := s.sendAcknowledgment(conn, response); err != nil {
+		s.reportError("ack", clientID, err)
+		return
+	}
+	s.logf(LOG_LEVEL_INFO, "Answered query from %s: %s, %d patients", clientID, status, len(patients))
+}
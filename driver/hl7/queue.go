@@ -0,0 +1,289 @@
+package hl7
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies of the processing queues
+const (
+	OVERFLOW_BLOCK = "block" // Wait for room; the acknowledgment is delayed (default)
+	OVERFLOW_NAK   = "nak"   // Reject the message with an AR acknowledgment so the sender retries
+	OVERFLOW_SPILL = "spill" // Write the message to spill_dir and process it when there is room
+)
+
+// Processing defaults
+const (
+	PROCESSING_WORKERS    = 1
+	PROCESSING_QUEUE_SIZE = 100
+	SPILL_DRAIN_INTERVAL  = time.Second
+	SPILL_FILE_EXT        = ".hl7"
+	SPILL_FAILED_EXT      = ".failed" // Spilled messages that could not be parsed again
+)
+
+// Errors returned by enqueue
+var (
+	errQueueFull      = errors.New("processing queue full")
+	errServerStopping = errors.New("server stopping")
+)
+
+// ProcessingConfig configures the workers that handle received messages.
+// Messages are distributed by patient ID, so the messages of one patient are
+// handled in order by the same worker. A message that exceeds the timeout
+// is the exception: its handler keeps running while the worker starts the
+// next message, which may be of the same patient.
+type ProcessingConfig struct {
+	Workers   int    `json:"workers"`    // Messages handled in parallel (0: 1)
+	QueueSize int    `json:"queue_size"` // Messages queued per worker (0: 100)
+	Overflow  string `json:"overflow"`   // Policy when a queue is full: block (default), nak or spill
+	SpillDir  string `json:"spill_dir"`  // Directory for spilled messages (overflow spill)
+	Timeout   int    `json:"timeout"`    // Seconds a message may take before its worker moves on, out of order (0: no limit)
+}
+
+// newQueues creates the queue of every worker
+func newQueues(config ProcessingConfig) []chan *HL7Message {
+	workers := config.Workers
+	if workers <= 0 {
+		workers = PROCESSING_WORKERS
+	}
+	size := config.QueueSize
+	if size <= 0 {
+		size = PROCESSING_QUEUE_SIZE
+	}
+	queues := make([]chan *HL7Message, workers)
+	for i := range queues {
+		queues[i] = make(chan *HL7Message, size)
+	}
+	return queues
+}
+
+// queueFor returns the queue of the worker that handles the patient of a
+// message. Messages without a patient ID are distributed by sender.
+func (s *HL7Server) queueFor(message *HL7Message) chan *HL7Message {
+	if len(s.queues) == 1 {
+		return s.queues[0]
+	}
+	key := message.GetPatientID()
+	if key == "" {
+		if msh := message.MSH(); msh != nil {
+			key = msh.SendingApplication()
+		}
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return s.queues[hash.Sum32()%uint32(len(s.queues))]
+}
+
+// enqueue queues a message for processing, applying the overflow policy if
+// the queue of its worker is full. It returns errQueueFull if the message
+// must be rejected and errServerStopping if the server is stopping.
+func (s *HL7Server) enqueue(message *HL7Message) error {
+	queue := s.queueFor(message)
+	if err := s.sendToQueue(queue, message, false); err != errQueueFull {
+		return err
+	}
+
+	processing := s.settings().Processing
+	switch processing.Overflow {
+	case OVERFLOW_NAK:
+		metricQueueOverflows.Inc(OVERFLOW_NAK)
+		return errQueueFull
+	case OVERFLOW_SPILL:
+		if err := s.spill(processing.SpillDir, message); err != nil {
+			s.reportError("spill", "", err)
+			metricQueueOverflows.Inc(OVERFLOW_NAK)
+			return errQueueFull
+		}
+		metricQueueOverflows.Inc(OVERFLOW_SPILL)
+		return nil
+	default:
+		metricQueueOverflows.Inc(OVERFLOW_BLOCK)
+		return s.sendToQueue(queue, message, true)
+	}
+}
+
+// sendToQueue adds a message to a worker queue, waiting for room if wait is
+// set. It returns errQueueFull if the queue is full and errServerStopping
+// once the server is stopping. Stop closes the queues only while no message
+// is being sent, so that every queued message is processed.
+func (s *HL7Server) sendToQueue(queue chan *HL7Message, message *HL7Message, wait bool) error {
+	s.queueMutex.RLock()
+	defer s.queueMutex.RUnlock()
+	select {
+	case <-s.stopChan:
+		return errServerStopping
+	default:
+	}
+
+	if !wait {
+		select {
+		case queue <- message:
+			metricQueueDepth.Inc()
+			return nil
+		default:
+			return errQueueFull
+		}
+	}
+	select {
+	case queue <- message:
+		metricQueueDepth.Inc()
+		return nil
+	case <-s.stopChan:
+		return errServerStopping
+	}
+}
+
+// closeQueues closes the worker queues once the server is stopping, after
+// the messages being sent have been queued or rejected
+func (s *HL7Server) closeQueues() {
+	s.queueMutex.Lock()
+	defer s.queueMutex.Unlock()
+	for _, queue := range s.queues {
+		close(queue)
+	}
+}
+
+// processMessages handles the messages of one worker queue until Stop
+// closes it, including the messages still queued at that time
+func (s *HL7Server) processMessages(queue chan *HL7Message) {
+	defer s.workers.Done()
+	for message := range queue {
+		metricQueueDepth.Dec()
+		s.processMessage(message)
+	}
+}
+
+// processMessage handles a message. If processing takes longer than the
+// configured timeout the error is reported and the worker continues with the
+// next message; the stalled handler finishes in the background, concurrently
+// with the following messages of the worker (possibly of the same patient).
+func (s *HL7Server) processMessage(message *HL7Message) {
+	start := s.clock.Now()
+	defer func() {
+		metricProcessingDuration.Observe(s.clock.Since(start).Seconds())
+	}()
+
+	timeout := time.Duration(s.settings().Processing.Timeout) * time.Second
+	if timeout <= 0 {
+		s.safeHandleMessage(message)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.safeHandleMessage(message)
+	}()
+
+	select {
+	case <-done:
+	case <-s.clock.After(timeout):
+		metricProcessingTimeouts.Inc()
+		controlID := ""
+		if msh := message.MSH(); msh != nil {
+			controlID = msh.ControlID()
+		}
+		s.reportError("timeout", "", fmt.Errorf("message %s not processed within %s, continuing with the next message", controlID, timeout))
+	}
+}
+
+// queuedMessages returns the number of messages waiting in the worker queues
+func (s *HL7Server) queuedMessages() int {
+	count := 0
+	for _, queue := range s.queues {
+		count += len(queue)
+	}
+	return count
+}
+
+// spillSequence orders spill files written within the same clock tick
+var spillSequence uint64
+
+// spill writes a message that does not fit in its queue to dir. The file is
+// written under a temporary name and renamed so that the drain never reads a
+// partial message.
+func (s *HL7Server) spill(dir string, message *HL7Message) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create spill directory: %v", err)
+	}
+
+	name := fmt.Sprintf("%s-%08d", s.clock.Now().UTC().Format("20060102T150405.000000000"), atomic.AddUint64(&spillSequence, 1))
+	temporary := filepath.Join(dir, name+".tmp")
+	if err := os.WriteFile(temporary, []byte(message.Raw), 0600); err != nil {
+		return fmt.Errorf("failed to spill message: %v", err)
+	}
+	if err := os.Rename(temporary, filepath.Join(dir, name+SPILL_FILE_EXT)); err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("failed to spill message: %v", err)
+	}
+	return nil
+}
+
+// drainSpill queues spilled messages for processing in the order they were
+// spilled, including messages left over from a previous run, until the
+// server stops. Spilled messages are processed after messages received
+// later, so the order of one patient's messages is not preserved.
+func (s *HL7Server) drainSpill(dir string) {
+	ticker := s.clock.NewTicker(SPILL_DRAIN_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+SPILL_FILE_EXT))
+		if err != nil {
+			s.reportError("spill", "", err)
+		}
+		sort.Strings(files)
+		metricSpilledMessages.Set(float64(len(files)))
+
+		for _, file := range files {
+			if !s.requeueSpilled(file) {
+				return
+			}
+			metricSpilledMessages.Dec()
+		}
+
+		select {
+		case <-ticker.C():
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// requeueSpilled queues one spilled message, waiting for room in its queue,
+// and removes the file. It returns false if the server is stopping.
+func (s *HL7Server) requeueSpilled(file string) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		s.reportError("spill", "", err)
+		return true
+	}
+
+	message, err := s.parser.ParseMessage(string(data))
+	if err != nil {
+		s.reportError("spill", "", fmt.Errorf("spilled message %s: %v", filepath.Base(file), err))
+		os.Rename(file, strings.TrimSuffix(file, SPILL_FILE_EXT)+SPILL_FAILED_EXT)
+		return true
+	}
+	// Spill file names start with the time the message was received
+	message.Time = s.clock.Now()
+	if received, err := time.Parse("20060102T150405.000000000", strings.SplitN(filepath.Base(file), "-", 2)[0]); err == nil {
+		message.Time = received
+	}
+
+	if err := s.sendToQueue(s.queueFor(message), message, true); err != nil {
+		return false
+	}
+
+	if err := os.Remove(file); err != nil {
+		s.reportError("spill", "", err)
+	}
+	return true
+}
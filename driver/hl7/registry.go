@@ -0,0 +1,317 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ADT trigger events (MSH-9.2) applied to the patient registry
+const (
+	ADT_ADMIT     = "A01"
+	ADT_TRANSFER  = "A02"
+	ADT_DISCHARGE = "A03"
+	ADT_REGISTER  = "A04"
+	ADT_UPDATE    = "A08"
+	ADT_MERGE     = "A40"
+)
+
+// HL7_SEG_MRG is the merge patient information segment of A40 messages
+const HL7_SEG_MRG = "MRG"
+
+// PatientRegistryConfig configures the patient registry
+type PatientRegistryConfig struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"` // JSON file the registry is kept in across restarts (empty: memory only)
+}
+
+// PatientContext is the current demographics and location of a patient
+type PatientContext struct {
+	PatientID    string    `json:"patient_id"`
+	FamilyName   string    `json:"family_name,omitempty"`
+	GivenName    string    `json:"given_name,omitempty"`
+	DateOfBirth  string    `json:"date_of_birth,omitempty"` // PID-7 as received
+	Sex          string    `json:"sex,omitempty"`
+	PatientClass string    `json:"patient_class,omitempty"` // PV1-2
+	VisitNumber  string    `json:"visit_number,omitempty"`  // PV1-19
+	Location     string    `json:"location"`                // PV1-3 as point of care^room^bed
+	Event        string    `json:"event"`                   // Last ADT event applied
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// PatientRegistry keeps the patient in every bed from ADT messages so that
+// observations without patient identification (monitor and DRI data keyed by
+// bed) can be assigned to a patient. It is safe for concurrent use.
+type PatientRegistry struct {
+	mutex     sync.RWMutex
+	patients  map[string]*PatientContext // By patient ID
+	locations map[string]string          // Location to patient ID
+	file      string
+	saveMutex sync.Mutex // Orders concurrent saves
+}
+
+// NewPatientRegistry creates a registry kept in file (memory only if empty),
+// loading the patients saved by a previous run
+func NewPatientRegistry(file string) (*PatientRegistry, error) {
+	r := &PatientRegistry{
+		patients:  make(map[string]*PatientContext),
+		locations: make(map[string]string),
+		file:      file,
+	}
+	if file == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, fmt.Errorf("failed to read patient registry: %v", err)
+	}
+	var patients []*PatientContext
+	if err := json.Unmarshal(data, &patients); err != nil {
+		return r, fmt.Errorf("invalid patient registry %s: %v", file, err)
+	}
+	for _, patient := range patients {
+		r.put(patient)
+	}
+	return r, nil
+}
+
+// Apply updates the registry from an ADT message and saves it. Admissions,
+// registrations and updates set the demographics and bed of the patient,
+// transfers move the patient, discharges remove the patient and merges
+// replace the retired patient ID (MRG-1) with the surviving one. It returns
+// false for messages that do not change the registry.
+func (r *PatientRegistry) Apply(message *HL7Message) (bool, error) {
+	msh := message.MSH()
+	if msh == nil || msh.MessageType() != HL7_MSG_ADT {
+		return false, nil
+	}
+	event := msh.TriggerEvent()
+	updatedAt := message.Time
+	if t, err := ParseHL7Time(msh.DateTime()); err == nil {
+		updatedAt = t
+	}
+
+	r.mutex.Lock()
+	changed := false
+	switch event {
+	case ADT_ADMIT, ADT_TRANSFER, ADT_REGISTER, ADT_UPDATE:
+		if patient := patientContext(message, event, updatedAt); patient != nil {
+			if existing := r.patients[patient.PatientID]; existing != nil && patient.Location == "" && event != ADT_TRANSFER {
+				// Updates without PV1-3 keep the bed and visit
+				patient.Location = existing.Location
+				patient.PatientClass = firstNonEmpty(patient.PatientClass, existing.PatientClass)
+				patient.VisitNumber = firstNonEmpty(patient.VisitNumber, existing.VisitNumber)
+			}
+			r.put(patient)
+			changed = true
+		}
+	case ADT_DISCHARGE:
+		if id := message.GetPatientID(); r.patients[id] != nil {
+			r.remove(id)
+			changed = true
+		}
+	case ADT_MERGE:
+		changed = r.merge(message, updatedAt)
+	}
+	r.mutex.Unlock()
+
+	if !changed {
+		return false, nil
+	}
+	return true, r.save()
+}
+
+// merge applies the PID/MRG pairs of an A40 message
+func (r *PatientRegistry) merge(message *HL7Message, updatedAt time.Time) bool {
+	changed := false
+	var surviving *PatientContext
+	for i := range message.Segments {
+		segment := &message.Segments[i]
+		switch segment.Type {
+		case HL7_SEG_PID:
+			pid := &PIDSegment{segment}
+			surviving = nil
+			if id := message.Profile().PatientID(pid); id != "" {
+				surviving = &PatientContext{
+					PatientID:   id,
+					FamilyName:  pid.FamilyName(),
+					GivenName:   pid.GivenName(),
+					DateOfBirth: pid.DateOfBirth(),
+					Sex:         pid.Sex(),
+					Event:       ADT_MERGE,
+					UpdatedAt:   updatedAt,
+				}
+			}
+		case HL7_SEG_MRG:
+			retiredID := segment.Component(1, 1)
+			if surviving == nil || retiredID == "" || retiredID == surviving.PatientID {
+				continue
+			}
+			retired := r.patients[retiredID]
+			r.remove(retiredID)
+			if existing := r.patients[surviving.PatientID]; existing != nil {
+				surviving.Location = existing.Location
+				surviving.PatientClass = existing.PatientClass
+				surviving.VisitNumber = existing.VisitNumber
+			}
+			if surviving.Location == "" && retired != nil {
+				surviving.Location = retired.Location
+				surviving.PatientClass = retired.PatientClass
+				surviving.VisitNumber = retired.VisitNumber
+			}
+			r.put(surviving)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// patientContext reads the patient of an ADT message, or nil if it has no patient ID
+func patientContext(message *HL7Message, event string, updatedAt time.Time) *PatientContext {
+	pid := message.PID()
+	id := message.GetPatientID()
+	if pid == nil || id == "" {
+		return nil
+	}
+	patient := &PatientContext{
+		PatientID:   id,
+		FamilyName:  pid.FamilyName(),
+		GivenName:   pid.GivenName(),
+		DateOfBirth: pid.DateOfBirth(),
+		Sex:         pid.Sex(),
+		Event:       event,
+		UpdatedAt:   updatedAt,
+	}
+	if pv1 := message.PV1(); pv1 != nil {
+		patient.PatientClass = pv1.PatientClass()
+		patient.VisitNumber = pv1.VisitNumber()
+		if pv1.PointOfCare() != "" || pv1.Room() != "" || pv1.Bed() != "" {
+			patient.Location = pv1.PointOfCare() + "^" + pv1.Room() + "^" + pv1.Bed()
+		}
+	}
+	return patient
+}
+
+// put stores a patient, freeing its previous bed and removing any other
+// patient still registered in its new bed. Patients without a bed are not kept.
+func (r *PatientRegistry) put(patient *PatientContext) {
+	r.remove(patient.PatientID)
+	if patient.Location == "" {
+		return
+	}
+	if previous, occupied := r.locations[patient.Location]; occupied {
+		r.remove(previous)
+	}
+	r.locations[patient.Location] = patient.PatientID
+	r.patients[patient.PatientID] = patient
+}
+
+// remove deletes a patient and frees its bed
+func (r *PatientRegistry) remove(patientID string) {
+	if existing := r.patients[patientID]; existing != nil && existing.Location != "" {
+		if r.locations[existing.Location] == patientID {
+			delete(r.locations, existing.Location)
+		}
+	}
+	delete(r.patients, patientID)
+}
+
+// ByLocation returns a copy of the patient in a bed (point of care^room^bed), or nil
+func (r *PatientRegistry) ByLocation(location string) *PatientContext {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if patient := r.patients[r.locations[location]]; patient != nil {
+		result := *patient
+		return &result
+	}
+	return nil
+}
+
+// ByPatientID returns a copy of a patient, or nil if the patient is unknown
+func (r *PatientRegistry) ByPatientID(patientID string) *PatientContext {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if patient := r.patients[patientID]; patient != nil {
+		result := *patient
+		return &result
+	}
+	return nil
+}
+
+// Patients returns copies of the patients at location (all if empty),
+// ordered by location and patient ID
+func (r *PatientRegistry) Patients(location string) []*PatientContext {
+	r.mutex.RLock()
+	patients := make([]*PatientContext, 0, len(r.patients))
+	for _, patient := range r.patients {
+		if location == "" || patient.Location == location {
+			result := *patient
+			patients = append(patients, &result)
+		}
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(patients, func(i, j int) bool {
+		if patients[i].Location != patients[j].Location {
+			return patients[i].Location < patients[j].Location
+		}
+		return patients[i].PatientID < patients[j].PatientID
+	})
+	return patients
+}
+
+// PIDSegment returns a PID segment for the patient in a bed, for ORU messages
+// generated from data that identifies the bed only (e.g. DRI monitors)
+func (r *PatientRegistry) PIDSegment(location string) (string, bool) {
+	patient := r.ByLocation(location)
+	if patient == nil {
+		return "", false
+	}
+	fields := []string{HL7_SEG_PID, "1", "", escapeHL7(patient.PatientID), "",
+		escapeHL7(patient.FamilyName) + "^" + escapeHL7(patient.GivenName), "",
+		escapeHL7(patient.DateOfBirth), escapeHL7(patient.Sex)}
+	return strings.TrimRight(strings.Join(fields, "|"), "|"), true
+}
+
+// Count returns the number of registered patients
+func (r *PatientRegistry) Count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.patients)
+}
+
+// save writes the registry to its file under a temporary name and renames it
+// so that a crash never leaves a partial file
+func (r *PatientRegistry) save() error {
+	if r.file == "" {
+		return nil
+	}
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+
+	data, err := json.MarshalIndent(r.Patients(""), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.file), 0700); err != nil {
+		return fmt.Errorf("failed to save patient registry: %v", err)
+	}
+	temporary := r.file + ".tmp"
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		return fmt.Errorf("failed to save patient registry: %v", err)
+	}
+	if err := os.Rename(temporary, r.file); err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("failed to save patient registry: %v", err)
+	}
+	return nil
+}
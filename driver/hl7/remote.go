@@ -0,0 +1,884 @@
+package hl7
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// Remote site defaults
+const (
+	REMOTE_SYNC_INTERVAL  = 10              // Seconds between syncs while there is nothing new
+	REMOTE_MAX_BACKOFF    = 5 * time.Minute // Longest wait after failed syncs
+	REMOTE_BATCH_SIZE     = 100             // Messages per sync request
+	REMOTE_CHUNK_SIZE     = 256 << 10       // Bytes; larger messages are sent in chunks
+	REMOTE_TIMEOUT        = 30              // Seconds per sync request
+	REMOTE_MIN_KEY_LENGTH = 32              // Characters of the shared secret of a site
+	REMOTE_BUFFER_EXT     = ".msg"          // Encrypted buffered messages
+	REMOTE_FAILED_EXT     = ".failed"       // Buffered messages that could not be decrypted
+	REMOTE_SEQUENCE_FILE  = "sequence"      // Last sequence number accepted by the central deployment
+	REMOTE_REQUEST_TARGET = 5 * time.Second // Sync requests are sized to take about this long on the measured link
+	REMOTE_MIN_SAMPLE     = 16 << 10        // Bytes; smaller requests measure latency rather than bandwidth
+)
+
+// Sync API of the central deployment
+const (
+	SYNC_PATH             = "/api/sync"
+	SYNC_HEADER_SITE      = "X-HL7-Site"      // Site ID
+	SYNC_HEADER_TIMESTAMP = "X-HL7-Timestamp" // Unix seconds when the request was signed
+	SYNC_HEADER_SIGNATURE = "X-HL7-Signature" // Hex HMAC-SHA256 of the timestamp, a newline and the body
+	SYNC_MAX_SKEW         = 5 * time.Minute   // Requests signed further from the central clock are rejected
+	SYNC_MAX_BODY         = 64 << 20          // Bytes
+)
+
+// Sync lanes of a remote site, in the order they are sent
+const (
+	SYNC_LANE_ALARM    = "alarm"    // Alert messages (ORU^R40)
+	SYNC_LANE_DATA     = "data"     // Numerics, ADT and every other message
+	SYNC_LANE_WAVEFORM = "waveform" // Results carrying waveforms (OBX-2 NA or MA)
+)
+
+// syncLanes lists the lanes from the highest priority
+var syncLanes = []string{SYNC_LANE_ALARM, SYNC_LANE_DATA, SYNC_LANE_WAVEFORM}
+
+// Purposes of the keys derived from the shared secret of a site
+const (
+	remoteKeyBuffer    = "hl7-remote-buffer"
+	remoteKeySignature = "hl7-remote-sync"
+)
+
+// errRemoteUnavailable is returned for messages received while the buffer of a remote site cannot be used
+var errRemoteUnavailable = errors.New("remote buffer is not available")
+
+// RemoteConfig configures a gateway at a remote site (e.g. a patient's home).
+// Every received message is kept in an encrypted buffer before it is
+// acknowledged and forwarded to the central deployment whenever it is
+// reachable.
+type RemoteConfig struct {
+	Enabled              bool              `json:"enabled"`
+	SiteID               string            `json:"site_id"`                // Identifies the site to the central deployment
+	CentralURL           string            `json:"central_url"`            // HTTPS base URL of the admin API of the central deployment
+	Key                  string            `json:"key"`                    // Secret shared with the central deployment (32 characters or more)
+	BufferDir            string            `json:"buffer_dir"`             // Directory of the encrypted buffer
+	Interval             int               `json:"interval"`               // Seconds between syncs while there is nothing new (0: 10)
+	BatchSize            int               `json:"batch_size"`             // Maximum messages per sync request (0: 100)
+	ChunkSize            int               `json:"chunk_size"`             // Bytes; larger messages are sent in resumable chunks (0: 256 KiB)
+	WaveformMinBandwidth int               `json:"waveform_min_bandwidth"` // Bytes per second below which waveforms are sent one request per sync (0: no limit)
+	Timeout              int               `json:"timeout"`                // Seconds per sync request (0: 30)
+	Transport            transport.Config  `json:"transport"`              // TLS, proxy and DSCP to the central deployment
+	LaneDSCP             map[string]string `json:"lane_dscp"`              // DSCP by lane (alarm, data, waveform) overriding transport.dscp
+}
+
+// SyncConfig configures the remote sites the central deployment accepts messages from
+type SyncConfig struct {
+	Sites []SyncSite `json:"sites"`
+}
+
+// SyncSite is a remote site and the secret it shares with the central deployment
+type SyncSite struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// SyncRecord is a message buffered at a remote site. Messages larger than
+// the chunk size are sent as several records carrying Chunk, Offset and
+// Size instead of Raw.
+type SyncRecord struct {
+	Sequence   uint64    `json:"sequence"` // Increases with every message of the site, across restarts
+	Lane       string    `json:"lane"`     // alarm, data or waveform
+	ReceivedAt time.Time `json:"received_at"`
+	Source     string    `json:"source"` // Client the site received the message from
+	Raw        string    `json:"raw,omitempty"`
+	Chunk      []byte    `json:"chunk,omitempty"`  // Part of the message starting at Offset
+	Offset     int       `json:"offset,omitempty"` // Byte offset of Chunk
+	Size       int       `json:"size,omitempty"`   // Bytes of the whole message (chunks only)
+}
+
+// SyncRequest is the body of a sync request
+type SyncRequest struct {
+	SiteID  string       `json:"site_id"`
+	Records []SyncRecord `json:"records"`
+	Backlog int          `json:"backlog"`          // Messages buffered at the site, including these records
+	Oldest  *time.Time   `json:"oldest,omitempty"` // Receipt time of the oldest buffered message
+}
+
+// SyncResponse tells a remote site which records it may discard
+type SyncResponse struct {
+	Accepted map[string]uint64 `json:"accepted"`          // By lane: records up to this sequence number were received
+	Partial  *SyncPartial      `json:"partial,omitempty"` // Message received in part
+	Skipped  int               `json:"skipped"`           // Records that could not be parsed
+}
+
+// SyncPartial is the progress of a message sent in chunks
+type SyncPartial struct {
+	Sequence uint64 `json:"sequence"`
+	Received int    `json:"received"` // Bytes received; the next chunk starts here
+}
+
+// SyncSiteStatus is the sync state of a remote site at the central deployment
+type SyncSiteStatus struct {
+	ID         string            `json:"id"`
+	LastSync   *time.Time        `json:"last_sync,omitempty"` // Last sync request (nil: none since start)
+	Backlog    int               `json:"backlog"`             // Messages left at the site after the last sync request
+	LagSeconds float64           `json:"lag_seconds"`         // Age of the oldest message left at the site (0: none)
+	Accepted   map[string]uint64 `json:"accepted"`            // Last sequence number received, by lane
+	Partial    *SyncPartial      `json:"partial,omitempty"`
+}
+
+// deriveKey derives a key for one purpose from the shared secret of a site
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// signSync returns the signature of a sync request body signed at timestamp
+func signSync(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, deriveKey(secret, remoteKeySignature))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RemoteBuffer keeps the messages of a remote site in a directory per
+// lane, one file per message encrypted with AES-256-GCM, until the central
+// deployment has received them. It is safe for concurrent use.
+type RemoteBuffer struct {
+	dir      string
+	aead     cipher.AEAD
+	mutex    sync.Mutex
+	sequence uint64         // Last sequence number assigned
+	counts   map[string]int // Buffered messages by lane
+}
+
+// NewRemoteBuffer opens the buffer in dir with a key derived from secret,
+// continuing the sequence numbers of a previous run
+func NewRemoteBuffer(dir, secret string) (*RemoteBuffer, error) {
+	block, err := aes.NewCipher(deriveKey(secret, remoteKeyBuffer))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	for _, lane := range syncLanes {
+		if err := os.MkdirAll(filepath.Join(dir, lane), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create remote buffer: %v", err)
+		}
+	}
+
+	b := &RemoteBuffer{dir: dir, aead: aead, counts: make(map[string]int)}
+	data, err := os.ReadFile(filepath.Join(dir, REMOTE_SEQUENCE_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read remote buffer sequence: %v", err)
+	}
+	if err == nil {
+		if b.sequence, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid remote buffer sequence: %v", err)
+		}
+	}
+
+	// Buffers written before lanes were introduced hold data messages
+	unlaned, _ := filepath.Glob(filepath.Join(dir, "*"+REMOTE_BUFFER_EXT))
+	for _, file := range unlaned {
+		if err := os.Rename(file, filepath.Join(dir, SYNC_LANE_DATA, filepath.Base(file))); err != nil {
+			return nil, fmt.Errorf("failed to move buffered message: %v", err)
+		}
+	}
+
+	for _, lane := range syncLanes {
+		files, err := b.files(lane)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if sequence, err := bufferSequence(file); err == nil && sequence > b.sequence {
+				b.sequence = sequence
+			}
+		}
+		b.counts[lane] = len(files)
+	}
+	return b, nil
+}
+
+// files returns the buffered message files of a lane, oldest first
+func (b *RemoteBuffer) files(lane string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(b.dir, lane, "*"+REMOTE_BUFFER_EXT))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote buffer: %v", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// bufferSequence returns the sequence number in the name of a buffered message file
+func bufferSequence(file string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), REMOTE_BUFFER_EXT), 10, 64)
+}
+
+// Append assigns the next sequence number to a record and writes it to the
+// buffer of its lane (data if the lane is unknown). The record is on disk
+// when Append returns.
+func (b *RemoteBuffer) Append(record SyncRecord) (uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, known := b.counts[record.Lane]; !known {
+		record.Lane = SYNC_LANE_DATA
+	}
+	record.Sequence = b.sequence + 1
+	name := fmt.Sprintf("%020d%s", record.Sequence, REMOTE_BUFFER_EXT)
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	// The file name is authenticated so that files cannot be swapped
+	data := b.aead.Seal(nonce, nonce, plaintext, []byte(name))
+
+	if err := writeFileSync(filepath.Join(b.dir, record.Lane, name), data); err != nil {
+		return 0, fmt.Errorf("failed to buffer message: %v", err)
+	}
+	b.sequence = record.Sequence
+	b.counts[record.Lane]++
+	return record.Sequence, nil
+}
+
+// Pending returns up to limit buffered records of a lane, oldest first.
+// Files that cannot be decrypted are renamed to .failed and returned as
+// unreadable with the reason.
+func (b *RemoteBuffer) Pending(lane string, limit int) (records []SyncRecord, unreadable []string, err error) {
+	files, err := b.files(lane)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records = make([]SyncRecord, 0, limit)
+	for _, file := range files {
+		if len(records) >= limit {
+			break
+		}
+		record, err := b.read(file)
+		if err != nil {
+			os.Rename(file, strings.TrimSuffix(file, REMOTE_BUFFER_EXT)+REMOTE_FAILED_EXT)
+			unreadable = append(unreadable, fmt.Sprintf("%s/%s: %v", lane, filepath.Base(file), err))
+			b.mutex.Lock()
+			b.counts[lane]--
+			b.mutex.Unlock()
+			continue
+		}
+		record.Lane = lane
+		records = append(records, *record)
+	}
+	return records, unreadable, nil
+}
+
+// read decrypts a buffered message file
+func (b *RemoteBuffer) read(file string) (*SyncRecord, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	size := b.aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("file too short")
+	}
+	plaintext, err := b.aead.Open(nil, data[:size], data[size:], []byte(filepath.Base(file)))
+	if err != nil {
+		return nil, err
+	}
+	var record SyncRecord
+	if err := json.Unmarshal(plaintext, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Oldest returns the receipt time of the oldest buffered message, or false
+// if the buffer is empty
+func (b *RemoteBuffer) Oldest() (time.Time, bool) {
+	var oldest time.Time
+	found := false
+	for _, lane := range syncLanes {
+		files, err := b.files(lane)
+		if err != nil || len(files) == 0 {
+			continue
+		}
+		if record, err := b.read(files[0]); err == nil && (!found || record.ReceivedAt.Before(oldest)) {
+			oldest, found = record.ReceivedAt, true
+		}
+	}
+	return oldest, found
+}
+
+// Remove discards the records of a lane up to a sequence number once the
+// central deployment has received them. The sequence number is kept so that
+// the numbering continues after a restart with an empty buffer.
+func (b *RemoteBuffer) Remove(lane string, sequence uint64) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := writeFileSync(filepath.Join(b.dir, REMOTE_SEQUENCE_FILE), []byte(strconv.FormatUint(b.sequence, 10))); err != nil {
+		return 0, fmt.Errorf("failed to save remote buffer sequence: %v", err)
+	}
+	files, err := b.files(lane)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		if current, err := bufferSequence(file); err != nil || current > sequence {
+			break
+		}
+		if err := os.Remove(file); err != nil {
+			return removed, fmt.Errorf("failed to remove buffered message: %v", err)
+		}
+		removed++
+		b.counts[lane]--
+	}
+	return removed, nil
+}
+
+// Count returns the number of buffered messages of a lane (all lanes if empty)
+func (b *RemoteBuffer) Count(lane string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if lane != "" {
+		return b.counts[lane]
+	}
+	count := 0
+	for _, laneCount := range b.counts {
+		count += laneCount
+	}
+	return count
+}
+
+// writeFileSync writes a file under a temporary name, flushes it to disk and
+// renames it so that a crash never leaves a partial file
+func writeFileSync(file string, data []byte) error {
+	temporary := file + ".tmp"
+	f, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(temporary)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(temporary)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	if err := os.Rename(temporary, file); err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return nil
+}
+
+// RemoteSyncer buffers the messages of a remote site and sends them to the
+// central deployment in signed requests. Alarms are sent before data and
+// data before waveforms; requests are sized to the measured bandwidth of the
+// link, and messages larger than the chunk size are sent in chunks that
+// resume where the central deployment stopped receiving.
+type RemoteSyncer struct {
+	config    RemoteConfig
+	buffer    *RemoteBuffer           // nil if the buffer could not be opened
+	clients   map[string]*http.Client // By lane
+	wake      chan struct{}
+	mutex     sync.Mutex
+	bandwidth float64      // Bytes per second of recent requests (0: not measured yet)
+	partial   *SyncPartial // Progress of the message being sent in chunks
+}
+
+// NewRemoteSyncer opens the buffer of a remote site. If the buffer cannot be
+// opened the syncer is returned with the error and rejects every message, so
+// that the devices keep them until the problem is fixed.
+func NewRemoteSyncer(config RemoteConfig) (*RemoteSyncer, error) {
+	if config.Interval <= 0 {
+		config.Interval = REMOTE_SYNC_INTERVAL
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = REMOTE_BATCH_SIZE
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = REMOTE_CHUNK_SIZE
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = REMOTE_TIMEOUT
+	}
+	r := &RemoteSyncer{
+		config: config,
+		wake:   make(chan struct{}, 1),
+	}
+	clients, err := laneClients(config)
+	if err != nil {
+		return r, err
+	}
+	r.clients = clients
+	buffer, err := NewRemoteBuffer(config.BufferDir, config.Key)
+	if err != nil {
+		return r, err
+	}
+	r.buffer = buffer
+	return r, nil
+}
+
+// laneClients creates the HTTP client of every lane. The lanes without a
+// DSCP of their own share the client of the transport settings.
+func laneClients(config RemoteConfig) (map[string]*http.Client, error) {
+	timeout := time.Duration(config.Timeout) * time.Second
+	shared, err := config.Transport.HTTPClient(timeout)
+	if err != nil {
+		return nil, err
+	}
+	clients := make(map[string]*http.Client, len(syncLanes))
+	for _, lane := range syncLanes {
+		dscp, found := config.LaneDSCP[lane]
+		if !found {
+			clients[lane] = shared
+			continue
+		}
+		settings := config.Transport
+		settings.DSCP = dscp
+		client, err := settings.HTTPClient(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s lane: %v", lane, err)
+		}
+		clients[lane] = client
+	}
+	return clients, nil
+}
+
+// SyncLane returns the lane a message is synced in: alerts (ORU^R40) before
+// everything else, results carrying waveforms (OBX-2 NA or MA) last
+func SyncLane(message *HL7Message) string {
+	msh := message.MSH()
+	if msh != nil && msh.MessageType() == HL7_MSG_ORU && msh.TriggerEvent() == "R40" {
+		return SYNC_LANE_ALARM
+	}
+	for _, obx := range message.OBXSegments() {
+		if valueType := obx.ValueType(); valueType == "NA" || valueType == "MA" {
+			return SYNC_LANE_WAVEFORM
+		}
+	}
+	return SYNC_LANE_DATA
+}
+
+// Buffer writes a received message to the buffer and wakes the sync
+func (r *RemoteSyncer) Buffer(message *HL7Message, source string) error {
+	if r.buffer == nil {
+		return errRemoteUnavailable
+	}
+	record := SyncRecord{Lane: SyncLane(message), ReceivedAt: message.Time, Source: source, Raw: message.Raw}
+	if _, err := r.buffer.Append(record); err != nil {
+		return err
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the number of messages waiting to be synced
+func (r *RemoteSyncer) Pending() int {
+	if r.buffer == nil {
+		return 0
+	}
+	return r.buffer.Count("")
+}
+
+// Bandwidth returns the measured bandwidth of the link in bytes per second (0: not measured yet)
+func (r *RemoteSyncer) Bandwidth() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.bandwidth
+}
+
+// budget returns the bytes of records to put in one request
+func (r *RemoteSyncer) budget() int {
+	budget := int(r.Bandwidth() * REMOTE_REQUEST_TARGET.Seconds())
+	if budget < r.config.ChunkSize {
+		budget = r.config.ChunkSize
+	}
+	if budget > SYNC_MAX_BODY/2 {
+		budget = SYNC_MAX_BODY / 2
+	}
+	return budget
+}
+
+// constrained reports whether the link is too slow to send waveforms continuously
+func (r *RemoteSyncer) constrained() bool {
+	bandwidth := r.Bandwidth()
+	return r.config.WaveformMinBandwidth > 0 && bandwidth > 0 && bandwidth < float64(r.config.WaveformMinBandwidth)
+}
+
+// Sync sends the buffered messages to the central deployment, signing the
+// requests at now, and discards the messages it received. After every
+// request it continues with the highest lane that has messages, so alarms
+// buffered during a long transfer go next. On a constrained link waveforms
+// are sent one request per sync. It returns the number of messages synced.
+func (r *RemoteSyncer) Sync(now time.Time) (int, error) {
+	if r.buffer == nil {
+		return 0, errRemoteUnavailable
+	}
+
+	synced := 0
+	failed := make([]string, 0)
+	waveformSent := false
+	for {
+		lane, records := "", []SyncRecord(nil)
+		for _, candidate := range syncLanes {
+			if candidate == SYNC_LANE_WAVEFORM && waveformSent && r.constrained() {
+				continue
+			}
+			pending, unreadable, err := r.buffer.Pending(candidate, r.config.BatchSize)
+			if err != nil {
+				return synced, err
+			}
+			failed = append(failed, unreadable...)
+			if len(pending) > 0 {
+				lane, records = candidate, pending
+				break
+			}
+		}
+		if len(records) == 0 {
+			if len(failed) > 0 {
+				return synced, fmt.Errorf("unreadable buffered messages moved aside: %s", strings.Join(failed, "; "))
+			}
+			return synced, nil
+		}
+		if lane == SYNC_LANE_WAVEFORM {
+			waveformSent = true
+		}
+
+		removed, err := r.sendLane(lane, records, now)
+		synced += removed
+		if err != nil {
+			return synced, err
+		}
+	}
+}
+
+// sendLane sends the first records of a lane in one request, or the next
+// chunk of the first record if it is larger than the chunk size, and removes
+// the records the central deployment received
+func (r *RemoteSyncer) sendLane(lane string, records []SyncRecord, now time.Time) (int, error) {
+	batch := make([]SyncRecord, 0, len(records))
+	var offset int
+	if first := records[0]; len(first.Raw) > r.config.ChunkSize {
+		r.mutex.Lock()
+		if r.partial != nil && r.partial.Sequence == first.Sequence {
+			offset = r.partial.Received
+		}
+		r.mutex.Unlock()
+		end := offset + r.config.ChunkSize
+		if end > len(first.Raw) {
+			end = len(first.Raw)
+		}
+		chunk := first
+		chunk.Raw, chunk.Chunk, chunk.Offset, chunk.Size = "", []byte(first.Raw[offset:end]), offset, len(first.Raw)
+		batch = append(batch, chunk)
+	} else {
+		budget, size := r.budget(), 0
+		for _, record := range records {
+			if len(record.Raw) > r.config.ChunkSize || (len(batch) > 0 && size+len(record.Raw) > budget) {
+				break
+			}
+			batch = append(batch, record)
+			size += len(record.Raw)
+		}
+	}
+
+	response, err := r.send(lane, batch, now)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mutex.Lock()
+	r.partial = response.Partial
+	r.mutex.Unlock()
+	removed, err := r.buffer.Remove(lane, response.Accepted[lane])
+	if err != nil {
+		return removed, err
+	}
+	last := batch[len(batch)-1]
+	switch {
+	case last.Size > 0 && response.Partial != nil && response.Partial.Sequence == last.Sequence:
+		// The central deployment may restart the message from an earlier byte, but must take the chunk
+		if response.Partial.Received == offset {
+			return removed, fmt.Errorf("central deployment expects message %d from byte %d, sent from %d", last.Sequence, response.Partial.Received, offset)
+		}
+	case response.Accepted[lane] < last.Sequence:
+		return removed, fmt.Errorf("central deployment accepted %s messages up to %d of %d", lane, response.Accepted[lane], last.Sequence)
+	}
+	return removed, nil
+}
+
+// send posts the records of a lane with the state of the buffer, measures
+// the bandwidth and returns the response of the central deployment
+func (r *RemoteSyncer) send(lane string, records []SyncRecord, now time.Time) (*SyncResponse, error) {
+	request := SyncRequest{SiteID: r.config.SiteID, Records: records, Backlog: r.buffer.Count("")}
+	if oldest, found := r.buffer.Oldest(); found {
+		request.Oldest = &oldest
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, strings.TrimRight(r.config.CentralURL, "/")+SYNC_PATH, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set(SYNC_HEADER_SITE, r.config.SiteID)
+	httpRequest.Header.Set(SYNC_HEADER_TIMESTAMP, timestamp)
+	httpRequest.Header.Set(SYNC_HEADER_SIGNATURE, signSync(r.config.Key, timestamp, body))
+
+	// The link is timed with the wall clock, whatever clock signs the request
+	started := time.Now()
+	response, err := r.clients[lane].Do(httpRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync with %s: %v", r.config.CentralURL, err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if elapsed := time.Since(started).Seconds(); len(body) >= REMOTE_MIN_SAMPLE && elapsed > 0 {
+		r.mutex.Lock()
+		if sample := float64(len(body)) / elapsed; r.bandwidth == 0 {
+			r.bandwidth = sample
+		} else {
+			r.bandwidth = 0.7*r.bandwidth + 0.3*sample
+		}
+		r.mutex.Unlock()
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sync rejected by %s: %s: %s", r.config.CentralURL, response.Status, strings.TrimSpace(string(data)))
+	}
+	var result SyncResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid sync response from %s: %v", r.config.CentralURL, err)
+	}
+	return &result, nil
+}
+
+// syncRemote forwards the buffer of a remote site to the central deployment
+// as soon as messages are buffered, and every interval otherwise. After a
+// failure it waits with exponential backoff, ignoring new messages, so that
+// an unreachable central deployment is not retried for every message.
+func (s *HL7Server) syncRemote() {
+	interval := time.Duration(s.remote.config.Interval) * time.Second
+	wait, backoff := time.Duration(0), interval
+	wake := s.remote.wake
+	metricRemoteBuffered.Set(float64(s.remote.Pending()))
+
+	for {
+		select {
+		case <-s.clock.After(wait):
+		case <-wake:
+		case <-s.stopChan:
+			return
+		}
+
+		synced, err := s.remote.Sync(s.clock.Now())
+		metricRemoteSynced.Add(float64(synced))
+		metricRemoteBuffered.Set(float64(s.remote.Pending()))
+		metricRemoteBandwidth.Set(s.remote.Bandwidth())
+		if synced > 0 {
+			s.logf(LOG_LEVEL_INFO, "Synced %d messages with the central deployment, %d buffered", synced, s.remote.Pending())
+		}
+		if err != nil {
+			metricRemoteSyncErrors.Inc()
+			s.reportError("remote", "", err)
+			wait, wake = backoff, nil
+			if backoff *= 2; backoff > REMOTE_MAX_BACKOFF {
+				backoff = REMOTE_MAX_BACKOFF
+			}
+			continue
+		}
+		wait, backoff, wake = interval, interval, s.remote.wake
+	}
+}
+
+// verifySync checks the signature and timestamp of a sync request and
+// returns the site that sent it
+func (s *HL7Server) verifySync(header http.Header, body []byte) (string, error) {
+	siteID := header.Get(SYNC_HEADER_SITE)
+	key := ""
+	for _, site := range s.settings().Sync.Sites {
+		if site.ID == siteID {
+			key = site.Key
+		}
+	}
+	if siteID == "" || key == "" {
+		return "", fmt.Errorf("unknown site %q", siteID)
+	}
+
+	timestamp := header.Get(SYNC_HEADER_TIMESTAMP)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if skew := s.clock.Now().Sub(time.Unix(seconds, 0)); skew > SYNC_MAX_SKEW || skew < -SYNC_MAX_SKEW {
+		return "", fmt.Errorf("timestamp of site %s is %v off", siteID, skew.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(header.Get(SYNC_HEADER_SIGNATURE)), []byte(signSync(key, timestamp, body))) {
+		return "", fmt.Errorf("invalid signature from site %s", siteID)
+	}
+	return siteID, nil
+}
+
+// syncSiteState is what the central deployment keeps about a remote site
+type syncSiteState struct {
+	sequences map[string]uint64 // Last sequence number received, by lane
+	partial   *syncPartial
+	status    SyncSiteStatus
+}
+
+// syncPartial is a message of a remote site received in part
+type syncPartial struct {
+	sequence uint64
+	data     []byte
+}
+
+// ReceiveSync handles the records of a remote site in order like messages
+// received over MLLP. Records the site already sent are skipped, records
+// that cannot be parsed are reported and skipped, and chunks are collected
+// until their message is complete. It stops at the first record that cannot
+// be queued; the response tells the site which records it may discard.
+func (s *HL7Server) ReceiveSync(siteID string, request *SyncRequest) (*SyncResponse, error) {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+	if s.syncSites == nil {
+		s.syncSites = make(map[string]*syncSiteState)
+	}
+	state := s.syncSites[siteID]
+	if state == nil {
+		state = &syncSiteState{sequences: make(map[string]uint64)}
+		s.syncSites[siteID] = state
+	}
+
+	response := &SyncResponse{}
+	var failure error
+	handled := 0
+	for _, record := range request.Records {
+		lane := firstNonEmpty(record.Lane, SYNC_LANE_DATA)
+		if record.Sequence <= state.sequences[lane] {
+			handled++
+			continue
+		}
+
+		if record.Size > 0 {
+			partial := state.partial
+			if partial == nil || partial.sequence != record.Sequence {
+				partial = &syncPartial{sequence: record.Sequence}
+				state.partial = partial
+			}
+			if record.Offset == len(partial.data) {
+				partial.data = append(partial.data, record.Chunk...)
+			}
+			if len(partial.data) > record.Size {
+				partial.data = nil
+			}
+			if len(partial.data) < record.Size {
+				response.Partial = &SyncPartial{Sequence: record.Sequence, Received: len(partial.data)}
+				continue
+			}
+			record.Raw = string(partial.data)
+			state.partial = nil
+		}
+
+		clientID := "sync:" + siteID + "/" + record.Source
+		message, err := s.parser.ParseMessage(record.Raw)
+		if err != nil {
+			metricParseErrors.Inc()
+			s.recordParseError(clientID, err)
+			s.reportError("parse", clientID, err)
+			response.Skipped++
+		} else {
+			message.Time = record.ReceivedAt
+			code, text, ok := s.ingest(message, clientID)
+			if !ok {
+				failure = errServerStopping
+				break
+			}
+			if code != HL7_ACK_ACCEPT {
+				failure = fmt.Errorf("message %d of site %s: %s", record.Sequence, siteID, text)
+				break
+			}
+			metricSyncReceived.Inc(siteID)
+		}
+		state.sequences[lane] = record.Sequence
+		handled++
+	}
+
+	// The site discards the records handled here, so they no longer count as backlog
+	now := s.clock.Now()
+	response.Accepted = make(map[string]uint64, len(state.sequences))
+	for lane, sequence := range state.sequences {
+		response.Accepted[lane] = sequence
+	}
+	state.status = SyncSiteStatus{
+		ID:       siteID,
+		LastSync: &now,
+		Backlog:  request.Backlog - handled,
+		Accepted: response.Accepted,
+		Partial:  response.Partial,
+	}
+	if state.status.Backlog < 0 {
+		state.status.Backlog = 0
+	}
+	if request.Oldest != nil && state.status.Backlog > 0 {
+		state.status.LagSeconds = now.Sub(*request.Oldest).Seconds()
+	}
+	metricSyncBacklog.Set(float64(state.status.Backlog), siteID)
+	metricSyncLag.Set(state.status.LagSeconds, siteID)
+	return response, failure
+}
+
+// SyncSites returns the sync state of the configured remote sites, ordered by ID
+func (s *HL7Server) SyncSites() []SyncSiteStatus {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+
+	sites := make([]SyncSiteStatus, 0)
+	for _, site := range s.settings().Sync.Sites {
+		status := SyncSiteStatus{ID: site.ID, Accepted: map[string]uint64{}}
+		if state := s.syncSites[site.ID]; state != nil {
+			status = state.status
+		}
+		sites = append(sites, status)
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].ID < sites[j].ID })
+	return sites
+}
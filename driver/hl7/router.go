@@ -0,0 +1,608 @@
+package hl7
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// Router defaults
+const (
+	ROUTER_QUEUE_SIZE     = 1000            // Messages queued in memory per destination
+	ROUTER_TIMEOUT        = 10              // Seconds to connect, send and wait for the acknowledgment
+	ROUTER_RETRY_INTERVAL = 5               // Seconds before the first retry after a failed delivery
+	ROUTER_MAX_BACKOFF    = 5 * time.Minute // Longest wait between retries
+	ROUTER_STORE_EXT      = ".hl7"          // Messages waiting in the store of a destination
+	ROUTER_FAILED_EXT     = ".failed"       // Stored messages the destination refused with AE or CE
+)
+
+// Delivery results counted per destination
+const (
+	ROUTE_RESULT_SENT     = "sent"     // Accepted by the destination
+	ROUTE_RESULT_RETRIED  = "retried"  // Connection failure or AR/CR; sent again after a backoff
+	ROUTE_RESULT_REJECTED = "rejected" // Refused with AE or CE; resending it unchanged does not help
+	ROUTE_RESULT_DROPPED  = "dropped"  // Not queued because the memory queue was full
+)
+
+// RouterConfig configures interface-engine mode: received messages that
+// match a rule are forwarded to downstream MLLP listeners. Every
+// destination has its own queue, so that one that is down does not hold
+// back the others.
+type RouterConfig struct {
+	Enabled      bool               `json:"enabled"`
+	Destinations []RouteDestination `json:"destinations"`
+	Rules        []RouteRule        `json:"rules"` // Every matching rule applies; messages matching none are not forwarded
+}
+
+// RouteDestination is a downstream system messages are forwarded to.
+// Messages are sent one at a time in the order they were routed; a failed
+// message is retried with exponential backoff before the next one is sent.
+type RouteDestination struct {
+	Name          string           `json:"name"`           // Referenced by rules, metrics and the admin API
+	Address       string           `json:"address"`        // host:port of the MLLP listener
+	Transport     transport.Config `json:"transport"`      // TLS and proxy
+	Timeout       int              `json:"timeout"`        // Seconds per delivery attempt (0: 10)
+	QueueSize     int              `json:"queue_size"`     // Messages queued in memory (0: 1000); not used with store_dir
+	StoreDir      string           `json:"store_dir"`      // Directory keeping queued messages across outages and restarts (empty: memory queue)
+	RetryInterval int              `json:"retry_interval"` // Seconds before the first retry, doubled up to 5 minutes (0: 5)
+	Deidentify    bool             `json:"deidentify"`     // Forward a copy without patient identifiers (requires a de-identifier)
+}
+
+// RouteRule selects the messages forwarded to destinations. Empty criteria
+// match every message; all criteria that are set must match.
+type RouteRule struct {
+	Name            string            `json:"name"`
+	MessageType     string            `json:"message_type"`     // MSH-9.1, or MSH-9.1^MSH-9.2 such as "ADT^A01"
+	SendingFacility string            `json:"sending_facility"` // MSH-4.1
+	Fields          map[string]string `json:"fields"`           // Values by position such as "PV1-3.1" ("PID-3" is PID-3.1); any segment and repetition may match
+	Destinations    []string          `json:"destinations"`     // Names of the destinations
+}
+
+// RouteDestinationStatus is the delivery state of a destination
+type RouteDestinationStatus struct {
+	Name      string     `json:"name"`
+	Address   string     `json:"address"`
+	Queued    int        `json:"queued"`   // Messages waiting, including the one being sent
+	Sent      int        `json:"sent"`     // Since start
+	Rejected  int        `json:"rejected"` // Since start
+	Dropped   int        `json:"dropped"`  // Since start
+	LastSent  *time.Time `json:"last_sent,omitempty"`
+	LastError string     `json:"last_error,omitempty"` // Error of the last failed attempt, cleared by the next delivery
+}
+
+// fieldCriterion is a value a rule requires at a position
+type fieldCriterion struct {
+	segment   string
+	field     int
+	component int // 0: the value of the field (its first component)
+	value     string
+}
+
+// messageMatcher holds the criteria of a routing or transformation rule
+type messageMatcher struct {
+	messageType     string // MSH-9.1, optionally ^MSH-9.2
+	sendingFacility string
+	fields          []fieldCriterion
+}
+
+// routeRule is a rule with its criteria parsed
+type routeRule struct {
+	RouteRule
+	matcher messageMatcher
+}
+
+// Router forwards messages to the destinations of the rules they match. It
+// is safe for concurrent use.
+type Router struct {
+	rules        []routeRule
+	destinations []*routeDestination
+	byName       map[string]*routeDestination
+	clock        clock.Clock
+	onError      func(error)
+	deidentifier *Deidentifier
+	stopChan     chan struct{}
+	stopOnce     sync.Once
+	wg           sync.WaitGroup
+}
+
+// routeDestination is the queue and delivery state of a destination
+type routeDestination struct {
+	config RouteDestination
+	client *MLLPClient
+	queue  chan string   // Memory queue, nil with a store
+	wake   chan struct{} // Signals a stored message
+	queued int64         // Messages waiting, updated atomically
+
+	mutex     sync.Mutex
+	sent      int
+	rejected  int
+	dropped   int
+	lastSent  time.Time
+	lastError string
+}
+
+// routeSequence orders the stored messages routed within the same clock tick
+var routeSequence uint64
+
+// NewRouter creates a router for config. Stored messages left over from a
+// previous run are counted and sent once the router is started.
+func NewRouter(config RouterConfig) (*Router, error) {
+	r := &Router{
+		byName:   make(map[string]*routeDestination),
+		clock:    clock.Real,
+		stopChan: make(chan struct{}),
+	}
+	for _, destination := range config.Destinations {
+		if _, exists := r.byName[destination.Name]; exists {
+			return nil, fmt.Errorf("duplicate route destination %q", destination.Name)
+		}
+		d, err := newRouteDestination(destination)
+		if err != nil {
+			return nil, fmt.Errorf("route destination %s: %v", destination.Name, err)
+		}
+		r.destinations = append(r.destinations, d)
+		r.byName[destination.Name] = d
+	}
+	for i, rule := range config.Rules {
+		matcher, err := newMessageMatcher(rule.MessageType, rule.SendingFacility, rule.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("route rule %d: %v", i+1, err)
+		}
+		for _, name := range rule.Destinations {
+			if _, exists := r.byName[name]; !exists {
+				return nil, fmt.Errorf("route rule %d: unknown destination %q", i+1, name)
+			}
+		}
+		r.rules = append(r.rules, routeRule{RouteRule: rule, matcher: matcher})
+	}
+	return r, nil
+}
+
+// newRouteDestination creates the client and queue of a destination
+func newRouteDestination(config RouteDestination) (*routeDestination, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = ROUTER_TIMEOUT
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = ROUTER_QUEUE_SIZE
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = ROUTER_RETRY_INTERVAL
+	}
+
+	d := &routeDestination{
+		config: config,
+		client: NewMLLPClient(config.Address, time.Duration(config.Timeout)*time.Second),
+		wake:   make(chan struct{}, 1),
+	}
+	if err := d.client.SetTransport(config.Transport); err != nil {
+		return nil, err
+	}
+
+	if config.StoreDir == "" {
+		d.queue = make(chan string, config.QueueSize)
+		return d, nil
+	}
+	if err := os.MkdirAll(config.StoreDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create route store: %v", err)
+	}
+	files, err := d.stored()
+	if err != nil {
+		return nil, err
+	}
+	d.queued = int64(len(files))
+	metricRouteQueued.Set(float64(d.queued), config.Name)
+	return d, nil
+}
+
+// parseFieldCriteria parses the field values of a rule, ordered by position
+func parseFieldCriteria(fields map[string]string) ([]fieldCriterion, error) {
+	positions := make([]string, 0, len(fields))
+	for position := range fields {
+		positions = append(positions, position)
+	}
+	sort.Strings(positions)
+
+	criteria := make([]fieldCriterion, 0, len(positions))
+	for _, position := range positions {
+		criterion, err := parseFieldPosition(position)
+		if err != nil {
+			return nil, err
+		}
+		criterion.value = fields[position]
+		criteria = append(criteria, criterion)
+	}
+	return criteria, nil
+}
+
+// parseFieldPosition parses a position such as "PID-3" or "PV1-3.1"
+func parseFieldPosition(position string) (fieldCriterion, error) {
+	segment, rest, found := strings.Cut(strings.TrimSpace(position), "-")
+	if !found || len(segment) != 3 {
+		return fieldCriterion{}, fmt.Errorf("invalid field position %q (e.g. PID-3 or PV1-3.1)", position)
+	}
+	criterion := fieldCriterion{segment: strings.ToUpper(segment)}
+	field, component, hasComponent := strings.Cut(rest, ".")
+	var err error
+	if criterion.field, err = strconv.Atoi(field); err != nil || criterion.field < 1 {
+		return fieldCriterion{}, fmt.Errorf("invalid field position %q (e.g. PID-3 or PV1-3.1)", position)
+	}
+	if hasComponent {
+		if criterion.component, err = strconv.Atoi(component); err != nil || criterion.component < 1 {
+			return fieldCriterion{}, fmt.Errorf("invalid field position %q (e.g. PID-3 or PV1-3.1)", position)
+		}
+	}
+	return criterion, nil
+}
+
+// SetClock replaces the clock used for retry backoff (nil: the real clock).
+// It must be called before Start.
+func (r *Router) SetClock(c clock.Clock) {
+	r.clock = clock.OrReal(c)
+}
+
+// SetErrorHandler registers a callback for failed deliveries and routing
+// errors. The handler must not block.
+func (r *Router) SetErrorHandler(handler func(error)) {
+	r.onError = handler
+}
+
+// SetDeidentifier sets the de-identifier of the destinations that forward
+// de-identified messages. Without it they receive nothing. It must be called
+// before Route.
+func (r *Router) SetDeidentifier(deidentifier *Deidentifier) {
+	r.deidentifier = deidentifier
+}
+
+// reportError passes an error to the error handler
+func (r *Router) reportError(err error) {
+	if r.onError != nil {
+		r.onError(err)
+	}
+}
+
+// Match returns the names of the destinations a message is routed to, in
+// the order of the configuration
+func (r *Router) Match(message *HL7Message) []string {
+	selected := make(map[string]bool)
+	for _, rule := range r.rules {
+		if rule.matcher.matches(message) {
+			for _, name := range rule.Destinations {
+				selected[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(selected))
+	for _, d := range r.destinations {
+		if selected[d.config.Name] {
+			names = append(names, d.config.Name)
+		}
+	}
+	return names
+}
+
+// newMessageMatcher parses the criteria of a rule
+func newMessageMatcher(messageType, sendingFacility string, fields map[string]string) (messageMatcher, error) {
+	criteria, err := parseFieldCriteria(fields)
+	if err != nil {
+		return messageMatcher{}, err
+	}
+	return messageMatcher{messageType: messageType, sendingFacility: sendingFacility, fields: criteria}, nil
+}
+
+// matches reports whether a message meets every criterion; empty criteria
+// match every message
+func (m *messageMatcher) matches(message *HL7Message) bool {
+	msh := message.MSH()
+	if m.messageType != "" {
+		if msh == nil {
+			return false
+		}
+		messageType, triggerEvent, hasTrigger := strings.Cut(m.messageType, "^")
+		if msh.MessageType() != messageType || (hasTrigger && msh.TriggerEvent() != triggerEvent) {
+			return false
+		}
+	}
+	if m.sendingFacility != "" && (msh == nil || msh.SendingFacility() != m.sendingFacility) {
+		return false
+	}
+	for _, criterion := range m.fields {
+		if !criterion.matches(message) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether any segment of the type holds the value in any
+// repetition of the field
+func (c *fieldCriterion) matches(message *HL7Message) bool {
+	for i := range message.Segments {
+		segment := &message.Segments[i]
+		if segment.Type != c.segment {
+			continue
+		}
+		for _, repetition := range segment.Repetitions(c.field) {
+			value := repetition.Value
+			if c.component > 0 {
+				value = repetition.ComponentValue(c.component)
+			}
+			if value == c.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Route queues a message for the destinations of the rules it matches and
+// returns their names. A message that cannot be queued for a destination
+// (memory queue full, store not writable) is reported in the error; it is
+// still queued for the other destinations.
+func (r *Router) Route(message *HL7Message) ([]string, error) {
+	names := r.Match(message)
+	var problems []string
+	var deidentified *HL7Message
+	for _, name := range names {
+		d := r.byName[name]
+		raw := message.Raw
+		if d.config.Deidentify {
+			if r.deidentifier == nil {
+				problems = append(problems, fmt.Sprintf("%s: de-identification is not enabled", name))
+				continue
+			}
+			if deidentified == nil {
+				var err error
+				if deidentified, err = r.deidentifier.Apply(message); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+					continue
+				}
+			}
+			raw = deidentified.Raw
+		}
+		if err := d.enqueue(raw, r.clock.Now()); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return names, fmt.Errorf("message %s not routed to %s", message.ID, strings.Join(problems, "; "))
+	}
+	return names, nil
+}
+
+// Start delivers the queued messages of every destination until Stop is called
+func (r *Router) Start() {
+	for _, d := range r.destinations {
+		r.wg.Add(1)
+		go func(d *routeDestination) {
+			defer r.wg.Done()
+			r.deliver(d)
+		}(d)
+	}
+}
+
+// Stop stops delivering and waits for the attempts in progress. Stored
+// messages are sent after the next start; messages in memory queues are
+// lost. It is safe to call Stop more than once.
+func (r *Router) Stop() {
+	r.stopOnce.Do(func() { close(r.stopChan) })
+	r.wg.Wait()
+}
+
+// Status returns the delivery state of every destination
+func (r *Router) Status() []RouteDestinationStatus {
+	statuses := make([]RouteDestinationStatus, 0, len(r.destinations))
+	for _, d := range r.destinations {
+		d.mutex.Lock()
+		status := RouteDestinationStatus{
+			Name:      d.config.Name,
+			Address:   d.config.Address,
+			Queued:    int(atomic.LoadInt64(&d.queued)),
+			Sent:      d.sent,
+			Rejected:  d.rejected,
+			Dropped:   d.dropped,
+			LastError: d.lastError,
+		}
+		if !d.lastSent.IsZero() {
+			lastSent := d.lastSent
+			status.LastSent = &lastSent
+		}
+		d.mutex.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// enqueue queues a message in memory or writes it to the store
+func (d *routeDestination) enqueue(raw string, now time.Time) error {
+	if d.queue != nil {
+		select {
+		case d.queue <- raw:
+			d.setQueued(1)
+			return nil
+		default:
+			d.mutex.Lock()
+			d.dropped++
+			d.mutex.Unlock()
+			metricRoutedMessages.Inc(d.config.Name, ROUTE_RESULT_DROPPED)
+			return fmt.Errorf("queue full (%d messages)", cap(d.queue))
+		}
+	}
+
+	name := fmt.Sprintf("%s-%08d%s", now.UTC().Format("20060102T150405.000000000"), atomic.AddUint64(&routeSequence, 1), ROUTER_STORE_EXT)
+	if err := writeFileSync(filepath.Join(d.config.StoreDir, name), []byte(raw)); err != nil {
+		return fmt.Errorf("failed to store message: %v", err)
+	}
+	d.setQueued(1)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// setQueued adds delta to the messages waiting for the destination
+func (d *routeDestination) setQueued(delta int64) {
+	metricRouteQueued.Set(float64(atomic.AddInt64(&d.queued, delta)), d.config.Name)
+}
+
+// stored returns the files of the store, oldest first
+func (d *routeDestination) stored() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(d.config.StoreDir, "*"+ROUTER_STORE_EXT))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list route store: %v", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// next waits for the oldest queued message of a destination. It returns
+// the file of a stored message, empty for a memory queue, and false once
+// the router stops.
+func (r *Router) next(d *routeDestination) (string, string, bool) {
+	if d.queue != nil {
+		select {
+		case raw := <-d.queue:
+			return raw, "", true
+		case <-r.stopChan:
+			return "", "", false
+		}
+	}
+
+	for {
+		files, err := d.stored()
+		if err != nil {
+			r.reportError(fmt.Errorf("route destination %s: %v", d.config.Name, err))
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err == nil {
+				return string(data), file, true
+			}
+			r.reportError(fmt.Errorf("route destination %s: %v", d.config.Name, err))
+			os.Rename(file, strings.TrimSuffix(file, ROUTER_STORE_EXT)+ROUTER_FAILED_EXT)
+			d.setQueued(-1)
+		}
+		select {
+		case <-d.wake:
+		case <-r.clock.After(time.Duration(d.config.RetryInterval) * time.Second):
+		case <-r.stopChan:
+			return "", "", false
+		}
+	}
+}
+
+// deliver sends the messages of a destination in order until the router
+// stops. A message is retried with exponential backoff until it is accepted
+// or refused with AE or CE.
+func (r *Router) deliver(d *routeDestination) {
+	interval := time.Duration(d.config.RetryInterval) * time.Second
+	for {
+		raw, file, ok := r.next(d)
+		if !ok {
+			return
+		}
+
+		backoff := interval
+		for {
+			ack, err := d.client.Send(raw)
+			if err == nil {
+				d.done(file, ROUTE_RESULT_SENT, r.clock.Now(), "")
+				break
+			}
+			if ack != nil && !retryableAck(ack) {
+				d.done(file, ROUTE_RESULT_REJECTED, time.Time{}, err.Error())
+				r.reportError(fmt.Errorf("route destination %s: %v", d.config.Name, err))
+				break
+			}
+
+			metricRoutedMessages.Inc(d.config.Name, ROUTE_RESULT_RETRIED)
+			d.mutex.Lock()
+			d.lastError = err.Error()
+			d.mutex.Unlock()
+			r.reportError(fmt.Errorf("route destination %s, retrying in %s: %v", d.config.Name, backoff, err))
+			select {
+			case <-r.clock.After(backoff):
+			case <-r.stopChan:
+				if d.queue != nil {
+					d.setQueued(-1)
+				}
+				return
+			}
+			if backoff *= 2; backoff > ROUTER_MAX_BACKOFF {
+				backoff = ROUTER_MAX_BACKOFF
+			}
+		}
+	}
+}
+
+// retryableAck reports whether a negative acknowledgment asks the sender to
+// retry (AR, CR) rather than refusing the message (AE, CE)
+func retryableAck(ack *HL7Message) bool {
+	msa := ack.GetSegmentByType(HL7_SEG_MSA)
+	if msa == nil {
+		return true
+	}
+	code := msa.FieldValue(1)
+	return code == HL7_ACK_REJECT || code == "CR"
+}
+
+// done removes a delivered or refused message from the queue. A refused
+// stored message is kept as .failed for inspection.
+func (d *routeDestination) done(file, result string, sent time.Time, lastError string) {
+	if file != "" {
+		var err error
+		if result == ROUTE_RESULT_SENT {
+			err = os.Remove(file)
+		} else {
+			err = os.Rename(file, strings.TrimSuffix(file, ROUTER_STORE_EXT)+ROUTER_FAILED_EXT)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			lastError = err.Error()
+		}
+	}
+	d.setQueued(-1)
+	metricRoutedMessages.Inc(d.config.Name, result)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if result == ROUTE_RESULT_SENT {
+		d.sent++
+		d.lastSent = sent
+	} else {
+		d.rejected++
+	}
+	d.lastError = lastError
+}
+
+// Router returns the router of interface-engine mode, nil if it is disabled
+func (s *HL7Server) Router() *Router {
+	return s.router
+}
+
+// routeMessage forwards a processed message to the destinations of the
+// rules it matches. Observer mode records the messages instead.
+func (s *HL7Server) routeMessage(message *HL7Message) {
+	if s.observer != nil {
+		for _, name := range s.router.Match(message) {
+			s.observe(OBSERVER_OUTPUT_ROUTE, name, message.GetPatientID(), message.ID, []byte(message.Raw))
+		}
+		return
+	}
+	names, err := s.router.Route(message)
+	if err != nil {
+		s.reportError("route", "", err)
+	}
+	if len(names) > 0 {
+		s.logf(LOG_LEVEL_DEBUG, "Routed message %s to %s", message.ID, strings.Join(names, ", "))
+	}
+}
@@ -223,6 +223,31 @@ func (s *SampleHL7Messages) GetTransferMessage() string {
 	return s.addMLLPWrapper(message)
 }
 
+// GetInfusionPumpMessage returns a sample IHE PCD infusion pump ORU message
+func (s *SampleHL7Messages) GetInfusionPumpMessage() string {
+	// ORU^R01 - Infusion pump status (PCD DEC)
+	now := time.Now().Format("20060102150405")
+	pumpID := "00A037009A0B1C2D"
+	
+	message := fmt.Sprintf("MSH|^~\\&|PUMP_GATEWAY^%s^EUI-64|HOSPITAL|||%s||ORU^R01^ORU_R01|PUMP%s|P|2.6|||NE|AL||UNICODE UTF-8|||PCD_DEC_001^IHE PCD^1.3.6.1.4.1.19376.1.6.1.1.1^ISO\r"+
+		"PID|||HED12^^^PID^MR||LAZY^KITTY^^^^^L|||\r"+
+		"PV1||E|ICU^^79874\r"+
+		"OBR|1|PUMP%s^PUMP_GATEWAY|PUMP%s^PUMP_GATEWAY|182777000^monitoring ofpatient^SCT|||%s\r"+
+		"OBX|1||69985^MDC_DEV_PUMP_INFUS_MDS^MDC|1.0.0.0|||||||X|||||||%s\r"+
+		"OBX|2||69986^MDC_DEV_PUMP_INFUS_VMD^MDC|1.1.0.0|||||||X|||||||%s\r"+
+		"OBX|3||126978^MDC_DEV_PUMP_INFUS_CHAN_DELIVERY^MDC|1.1.1.0|||||||X|||||||%s\r"+
+		"OBX|4|ST|184330^MDC_DRUG_NAME_TYPE^MDC|1.1.1.1|Noradrenaline||||||R|||%s||||%s\r"+
+		"OBX|5|NM|157784^MDC_FLOW_FLUID_PUMP^MDC|1.1.1.2|4.5|265266^MDC_DIM_MILLI_L_PER_HR^MDC|||||R|||%s||||%s\r"+
+		"OBX|6|NM|166504^MDC_VOL_FLUID_TBI^MDC|1.1.1.3|50|263762^MDC_DIM_MILLI_L^MDC|||||R|||%s||||%s\r"+
+		"OBX|7|NM|157872^MDC_VOL_FLUID_TBI_REMAIN^MDC|1.1.1.4|32.4|263762^MDC_DIM_MILLI_L^MDC|||||R|||%s||||%s\r"+
+		"OBX|8|ST|184504^MDC_PUMP_STAT^MDC|1.1.1.5|pump-status-infusing||||||R|||%s||||%s",
+		pumpID, now, now, now, now, now,
+		pumpID, pumpID, pumpID,
+		now, pumpID, now, pumpID, now, pumpID, now, pumpID, now, pumpID)
+	
+	return s.addMLLPWrapper(message)
+}
+
 // addMLLPWrapper adds MLLP framing to the HL7 message
 func (s *SampleHL7Messages) addMLLPWrapper(message string) string {
 	// MLLP wrapper: 0x0B (VT) + message + 0x1C (FS) + 0x0D (CR)
@@ -242,6 +267,7 @@ func (s *SampleHL7Messages) GetAllSampleMessages() map[string]string {
 		"ORM_Order":           s.GetORMMessage(),
 		"ADT_Discharge":       s.GetDischargeMessage(),
 		"ADT_Transfer":        s.GetTransferMessage(),
+		"ORU_InfusionPump":    s.GetInfusionPumpMessage(),
 	}
 }
 
@@ -258,6 +284,7 @@ func (s *SampleHL7Messages) GetMessageDescription(messageType string) string {
 		"ORM_Order":         "Medical Order (ORM^O01)",
 		"ADT_Discharge":     "Patient Discharge (ADT^A03)",
 		"ADT_Transfer":      "Patient Transfer (ADT^A02)",
+		"ORU_InfusionPump":  "Infusion Pump Status (IHE PCD DEC)",
 	}
 	
 	if desc, exists := descriptions[messageType]; exists {
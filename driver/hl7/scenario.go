@@ -0,0 +1,428 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+	"github.com/harusin0516/healthcare/driver/precision"
+)
+
+// Scenario event kinds
+const (
+	SCENARIO_EVENT_ADMIT     = "admit"     // ADT^A01 at the start
+	SCENARIO_EVENT_VITALS    = "vitals"    // ORU^R01 every interval
+	SCENARIO_EVENT_ALARM     = "alarm"     // ORU^R40 when an alarm starts or ends
+	SCENARIO_EVENT_DISCHARGE = "discharge" // ADT^A03 at the end
+)
+
+// Scenario defaults
+const (
+	SCENARIO_DEFAULT_INTERVAL = 60    // Seconds between ORU^R01 messages
+	SCENARIO_DEFAULT_APP      = "VSP" // MSH-3 of the generated messages
+	SCENARIO_CONTROL_PREFIX   = "SCN" // Prefix of the generated message control IDs
+	SCENARIO_VERSION          = "2.6" // MSH-12 of the generated messages
+	SCENARIO_PROFILE          = "PCD_DEC_001^IHE PCD^1.3.6.1.4.1.19376.1.6.1.1.1^ISO"
+	SCENARIO_OBR_CODE         = "182777000^monitoring of patient^SCT"
+)
+
+// ScenarioPatient is the patient of a scenario
+type ScenarioPatient struct {
+	ID          string `json:"id"`            // PID-3
+	FamilyName  string `json:"family_name"`   // PID-5.1
+	GivenName   string `json:"given_name"`    // PID-5.2
+	DateOfBirth string `json:"date_of_birth"` // PID-7 (YYYYMMDD)
+	Sex         string `json:"sex"`           // PID-8
+}
+
+// ScenarioPoint is the value of a vital sign at an offset of the scenario
+type ScenarioPoint struct {
+	At    int     `json:"at"` // Seconds after the start
+	Value float64 `json:"value"`
+}
+
+// VitalTrajectory is the course of one vital sign. The value is
+// interpolated linearly between the points and held before the first and
+// after the last one.
+type VitalTrajectory struct {
+	Parameter string          `json:"parameter"` // MDC reference ID (e.g. MDC_ECG_HEART_RATE)
+	Points    []ScenarioPoint `json:"points"`
+	Noise     float64         `json:"noise"`    // Largest random deviation added to the value
+	Decimals  int             `json:"decimals"` // Decimals of the reported value
+}
+
+// ScenarioAlarm is an alarm raised by the monitor during a scenario
+type ScenarioAlarm struct {
+	At        int    `json:"at"`         // Seconds after the start
+	Duration  int    `json:"duration"`   // Seconds until the alarm ends (0: until the end of the scenario)
+	Text      string `json:"text"`       // Alarm text shown by the monitor
+	Priority  string `json:"priority"`   // PH, PM or PL
+	Kind      string `json:"kind"`       // SP (default) or ST
+	EventCode string `json:"event_code"` // OBX-3 of the event identification (default MDC_EVT_ALARM)
+}
+
+// Scenario scripts a clinical course of one monitored patient for QA: the
+// admission, the vital signs trajectories, the alarms and the discharge.
+// Generate turns it into the HL7 messages the gateway would receive; the
+// same scenario (including Seed) always generates the same messages.
+type Scenario struct {
+	Name               string            `json:"name"`
+	Start              time.Time         `json:"start"`
+	Duration           int               `json:"duration"`            // Seconds
+	Interval           int               `json:"interval"`            // Seconds between ORU^R01 messages (0: 60)
+	Seed               int64             `json:"seed"`                // Seed of the vital signs noise
+	SendingApplication string            `json:"sending_application"` // MSH-3 (default VSP)
+	SendingFacility    string            `json:"sending_facility"`    // MSH-4 (default HOSPITAL)
+	DeviceID           string            `json:"device_id"`           // EUI-64 of the monitor (OBX-18)
+	Patient            ScenarioPatient   `json:"patient"`
+	Bed                string            `json:"bed"` // PV1-3 as point of care^room^bed
+	Vitals             []VitalTrajectory `json:"vitals"`
+	Alarms             []ScenarioAlarm   `json:"alarms"`
+	Discharge          bool              `json:"discharge"` // Send ADT^A03 at the end
+}
+
+// ScenarioEvent is one generated message of a scenario
+type ScenarioEvent struct {
+	Time      time.Time          `json:"time"`
+	Kind      string             `json:"kind"`
+	ControlID string             `json:"control_id"`
+	Message   string             `json:"message"` // Segments separated by \r, without MLLP framing
+	Vitals    map[string]float64 `json:"vitals,omitempty"`
+	Alert     *ACMAlert          `json:"alert,omitempty"`
+}
+
+// LoadScenario reads a scenario from a JSON file
+func LoadScenario(filename string) (*Scenario, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scenario file: %v", err)
+	}
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("failed to decode scenario file: %v", err)
+	}
+	if err := scenario.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &scenario, nil
+}
+
+// Validate checks that the scenario can be generated
+func (s *Scenario) Validate() error {
+	problems := make([]string, 0)
+	if s.Start.IsZero() {
+		problems = append(problems, "start is required")
+	}
+	if s.Duration <= 0 {
+		problems = append(problems, "duration must be positive")
+	}
+	if s.Interval < 0 {
+		problems = append(problems, "interval must not be negative")
+	}
+	if s.Patient.ID == "" {
+		problems = append(problems, "patient.id is required")
+	}
+	for i, vital := range s.Vitals {
+		if code, found := mdc.LookupReferenceID(vital.Parameter); !found || code.Kind != mdc.KindMetric {
+			problems = append(problems, fmt.Sprintf("vitals[%d]: %q is not an MDC metric", i, vital.Parameter))
+		}
+		if len(vital.Points) == 0 {
+			problems = append(problems, fmt.Sprintf("vitals[%d]: points are required", i))
+		}
+		for j := 1; j < len(vital.Points); j++ {
+			if vital.Points[j].At < vital.Points[j-1].At {
+				problems = append(problems, fmt.Sprintf("vitals[%d]: points must be in time order", i))
+				break
+			}
+		}
+	}
+	for i, alarm := range s.Alarms {
+		if alarm.At < 0 || alarm.At > s.Duration {
+			problems = append(problems, fmt.Sprintf("alarms[%d]: at must be within the duration", i))
+		}
+		if alarm.Duration < 0 {
+			problems = append(problems, fmt.Sprintf("alarms[%d]: duration must not be negative", i))
+		}
+		switch alarm.Priority {
+		case ACM_PRIORITY_HIGH, ACM_PRIORITY_MEDIUM, ACM_PRIORITY_LOW:
+		default:
+			problems = append(problems, fmt.Sprintf("alarms[%d]: priority must be %s, %s or %s, got %q",
+				i, ACM_PRIORITY_HIGH, ACM_PRIORITY_MEDIUM, ACM_PRIORITY_LOW, alarm.Priority))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid scenario: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// VitalsAt returns the value of every vital sign at an offset of the
+// scenario, rounded to the decimals of its trajectory. The noise depends on
+// the seed, the parameter and the offset only, so the value at an offset
+// is the same however often it is asked for.
+func (s *Scenario) VitalsAt(offset time.Duration) map[string]float64 {
+	vitals := make(map[string]float64, len(s.Vitals))
+	for _, vital := range s.Vitals {
+		if len(vital.Points) == 0 {
+			continue
+		}
+		value := vital.valueAt(offset.Seconds())
+		if vital.Noise > 0 {
+			value += vital.Noise * scenarioNoise(s.Seed, vital.Parameter, offset)
+		}
+		vitals[vital.Parameter] = precision.Round(value, vital.Decimals)
+	}
+	return vitals
+}
+
+// AlarmsAt returns the alarms active at an offset of the scenario
+func (s *Scenario) AlarmsAt(offset time.Duration) []ScenarioAlarm {
+	var active []ScenarioAlarm
+	for _, alarm := range s.Alarms {
+		if offset < time.Duration(alarm.At)*time.Second {
+			continue
+		}
+		if alarm.Duration > 0 && offset >= time.Duration(alarm.At+alarm.Duration)*time.Second {
+			continue
+		}
+		active = append(active, alarm)
+	}
+	return active
+}
+
+// Generate returns the messages of the scenario in time order: ADT^A01 at
+// the start, ORU^R01 with the vital signs every interval, ORU^R40 when an
+// alarm starts and ends, and ADT^A03 at the end if Discharge is set.
+// Messages at the same time keep that order. Control IDs are numbered
+// from SCN000001, so the output is reproducible.
+func (s *Scenario) Generate() ([]ScenarioEvent, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	interval := s.Interval
+	if interval == 0 {
+		interval = SCENARIO_DEFAULT_INTERVAL
+	}
+
+	events := []ScenarioEvent{{Time: s.Start, Kind: SCENARIO_EVENT_ADMIT}}
+	if len(s.Vitals) > 0 {
+		for at := 0; at <= s.Duration; at += interval {
+			offset := time.Duration(at) * time.Second
+			events = append(events, ScenarioEvent{Time: s.Start.Add(offset), Kind: SCENARIO_EVENT_VITALS, Vitals: s.VitalsAt(offset)})
+		}
+	}
+	for i, alarm := range s.Alarms {
+		alert := ACMAlert{
+			AlertID:      fmt.Sprintf("%s%d", firstNonEmpty(s.Name, "ALARM"), i+1),
+			EventCode:    alarm.EventCode,
+			Text:         alarm.Text,
+			Priority:     alarm.Priority,
+			Kind:         alarm.Kind,
+			Phase:        ACM_PHASE_START,
+			State:        ACM_STATE_ACTIVE,
+			Time:         s.Start.Add(time.Duration(alarm.At) * time.Second),
+			DeviceID:     s.DeviceID,
+			PatientID:    s.Patient.ID,
+			FamilyName:   s.Patient.FamilyName,
+			GivenName:    s.Patient.GivenName,
+			DateOfBirth:  s.Patient.DateOfBirth,
+			Sex:          s.Patient.Sex,
+			PatientClass: "I",
+			Location:     s.Bed,
+		}
+		start := alert
+		events = append(events, ScenarioEvent{Time: start.Time, Kind: SCENARIO_EVENT_ALARM, Alert: &start})
+		if alarm.Duration > 0 && alarm.At+alarm.Duration <= s.Duration {
+			end := alert
+			end.Phase = ACM_PHASE_END
+			end.State = ACM_STATE_INACTIVE
+			end.Time = s.Start.Add(time.Duration(alarm.At+alarm.Duration) * time.Second)
+			events = append(events, ScenarioEvent{Time: end.Time, Kind: SCENARIO_EVENT_ALARM, Alert: &end})
+		}
+	}
+	if s.Discharge {
+		events = append(events, ScenarioEvent{Time: s.Start.Add(time.Duration(s.Duration) * time.Second), Kind: SCENARIO_EVENT_DISCHARGE})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+
+	for i := range events {
+		event := &events[i]
+		event.ControlID = fmt.Sprintf("%s%06d", SCENARIO_CONTROL_PREFIX, i+1)
+		var err error
+		switch event.Kind {
+		case SCENARIO_EVENT_ADMIT:
+			event.Message = s.adt(event, "A01", "ADT_A01")
+		case SCENARIO_EVENT_DISCHARGE:
+			event.Message = s.adt(event, "A03", "ADT_A03")
+		case SCENARIO_EVENT_VITALS:
+			event.Message = s.oru(event)
+		case SCENARIO_EVENT_ALARM:
+			event.Message, err = s.acm(event)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s message at %s: %v", event.Kind, event.Time.Format(time.RFC3339), err)
+		}
+		parsed, err := NewHL7Parser().ParseMessage(event.Message)
+		if err != nil {
+			return nil, fmt.Errorf("generated %s message is invalid: %v", event.Kind, err)
+		}
+		if problems := ValidateUnits(parsed); len(problems) > 0 {
+			return nil, fmt.Errorf("generated %s message has invalid units: %s", event.Kind, strings.Join(problems, "; "))
+		}
+	}
+	return events, nil
+}
+
+// GetScenarioMessages returns the MLLP framed messages of a scenario
+func (s *SampleHL7Messages) GetScenarioMessages(scenario *Scenario) ([]string, error) {
+	events, err := scenario.Generate()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]string, len(events))
+	for i, event := range events {
+		messages[i] = s.addMLLPWrapper(event.Message)
+	}
+	return messages, nil
+}
+
+// GetDeteriorationScenario returns a sample scenario of a patient who
+// desaturates and becomes tachycardic one hour after admission
+func (s *SampleHL7Messages) GetDeteriorationScenario(start time.Time) *Scenario {
+	return &Scenario{
+		Name:     "DETERIORATION",
+		Start:    start,
+		Duration: 2 * 3600,
+		Interval: 60,
+		Seed:     1,
+		DeviceID: "080019FFFE134535",
+		Patient:  ScenarioPatient{ID: "HED12", FamilyName: "LAZY", GivenName: "KITTY", DateOfBirth: "19800101", Sex: "F"},
+		Bed:      "ICU^01^79874",
+		Vitals: []VitalTrajectory{
+			{Parameter: "MDC_ECG_HEART_RATE", Points: []ScenarioPoint{{0, 75}, {3600, 78}, {4500, 128}, {5400, 95}}, Noise: 2},
+			{Parameter: "MDC_PULS_OXIM_SAT_O2", Points: []ScenarioPoint{{0, 98}, {3600, 97}, {4500, 86}, {5400, 95}}, Noise: 0.5},
+			{Parameter: "MDC_RESP_RATE", Points: []ScenarioPoint{{0, 14}, {3600, 15}, {4500, 28}, {5400, 18}}, Noise: 1},
+			{Parameter: "MDC_TEMP", Points: []ScenarioPoint{{0, 36.8}, {7200, 37.6}}, Noise: 0.05, Decimals: 1},
+		},
+		Alarms: []ScenarioAlarm{
+			{At: 4200, Duration: 900, Text: "SpO2 LOW", Priority: ACM_PRIORITY_HIGH},
+			{At: 4380, Duration: 600, Text: "HR HIGH", Priority: ACM_PRIORITY_MEDIUM},
+		},
+		Discharge: true,
+	}
+}
+
+// adt generates an ADT message of the scenario patient
+func (s *Scenario) adt(event *ScenarioEvent, trigger, structure string) string {
+	timestamp := event.Time.Format("20060102150405")
+	return strings.Join([]string{
+		s.msh(event, "ADT^"+trigger+"^"+structure, ""),
+		"EVN|" + trigger + "|" + timestamp,
+		s.pid(),
+		"PV1|1|I|" + s.location(),
+	}, "\r") + "\r"
+}
+
+// oru generates an ORU^R01 message with the vital signs of an event
+func (s *Scenario) oru(event *ScenarioEvent) string {
+	timestamp := event.Time.Format("20060102150405")
+	app := escapeHL7(firstNonEmpty(s.SendingApplication, SCENARIO_DEFAULT_APP))
+	device := escapeHL7(s.DeviceID)
+	segments := []string{
+		s.msh(event, "ORU^R01^ORU_R01", SCENARIO_PROFILE),
+		s.pid(),
+		"PV1|1|I|" + s.location(),
+		strings.Join([]string{"OBR", "1", event.ControlID + "^" + app, event.ControlID + "^" + app,
+			SCENARIO_OBR_CODE, "", "", timestamp}, "|"),
+	}
+	setID := 0
+	for i, vital := range s.Vitals {
+		value, exists := event.Vitals[vital.Parameter]
+		if !exists {
+			continue
+		}
+		setID++
+		code, _ := mdc.LookupReferenceID(vital.Parameter)
+		unit := ""
+		if unitCode, found := code.Unit(); found {
+			unit = unitCode.CE()
+		}
+		segments = append(segments, strings.Join([]string{"OBX", strconv.Itoa(setID), "NM",
+			code.CE(), fmt.Sprintf("1.0.0.%d", i+1), precision.FormatDecimals(value, vital.Decimals),
+			unit, "", "", "", "", "R", "", "", timestamp, "", "", "", device}, "|"))
+	}
+	return strings.Join(segments, "\r") + "\r"
+}
+
+// acm generates the ORU^R40 message of an alarm event
+func (s *Scenario) acm(event *ScenarioEvent) (string, error) {
+	config := ACMConfig{
+		SendingApplication: firstNonEmpty(s.SendingApplication, SCENARIO_DEFAULT_APP),
+		SendingFacility:    s.SendingFacility,
+	}
+	message, controlID, err := BuildACM(config, *event.Alert, event.Time)
+	if err != nil {
+		return "", err
+	}
+	// BuildACM numbers control IDs per process; use the scenario's own
+	return strings.Replace(message, "|"+controlID+"|", "|"+event.ControlID+"|", 1), nil
+}
+
+// msh generates the MSH segment of an event with a message profile (MSH-21)
+func (s *Scenario) msh(event *ScenarioEvent, messageType, profile string) string {
+	return strings.TrimRight(strings.Join([]string{"MSH", "^~\\&",
+		escapeHL7(firstNonEmpty(s.SendingApplication, SCENARIO_DEFAULT_APP)),
+		escapeHL7(firstNonEmpty(s.SendingFacility, ORDER_DEFAULT_FACILITY)), "", "",
+		event.Time.Format("20060102150405"), "", messageType, event.ControlID, "P", SCENARIO_VERSION,
+		"", "", "NE", "AL", "", "UNICODE UTF-8", "", "", profile}, "|"), "|")
+}
+
+// pid generates the PID segment of the scenario patient
+func (s *Scenario) pid() string {
+	patient := s.Patient
+	return strings.Join([]string{"PID", "1", "", escapeHL7(patient.ID) + "^^^^MR", "",
+		escapeHL7(patient.FamilyName) + "^" + escapeHL7(patient.GivenName), "",
+		escapeHL7(patient.DateOfBirth), escapeHL7(patient.Sex)}, "|")
+}
+
+// location returns PV1-3 of the scenario bed
+func (s *Scenario) location() string {
+	location := strings.Split(s.Bed, "^")
+	for i := range location {
+		location[i] = escapeHL7(location[i])
+	}
+	return strings.Join(location, "^")
+}
+
+// valueAt interpolates the trajectory at seconds after the start
+func (v *VitalTrajectory) valueAt(seconds float64) float64 {
+	points := v.Points
+	if seconds <= float64(points[0].At) {
+		return points[0].Value
+	}
+	for i := 1; i < len(points); i++ {
+		if seconds <= float64(points[i].At) {
+			from, to := points[i-1], points[i]
+			if to.At == from.At {
+				return to.Value
+			}
+			fraction := (seconds - float64(from.At)) / float64(to.At-from.At)
+			return from.Value + fraction*(to.Value-from.Value)
+		}
+	}
+	return points[len(points)-1].Value
+}
+
+// scenarioNoise returns a deterministic value in [-1, 1] for a parameter
+// at an offset of a scenario
+func scenarioNoise(seed int64, parameter string, offset time.Duration) float64 {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d/%s/%d", seed, parameter, offset)
+	return float64(hash.Sum64()%2001)/1000 - 1
+}
@@ -0,0 +1,542 @@
+package hl7
+
+// Typed accessors for common segments.
+//
+// HL7 numbers fields from 1 (PID-3, OBX-5). HL7Segment.Fields skips the segment
+// name, so Fields[0] normally holds field 1. MSH is the exception: MSH-1 is the
+// field separator itself and is never stored, so Fields[0] holds MSH-2. The
+// same holds for the FHS and BHS headers of files and batches.
+// Field/FieldValue/Component hide this difference.
+
+// Field returns the field at the given HL7 position (1-based), or nil if absent
+func (s *HL7Segment) Field(position int) *HL7Field {
+	index := s.fieldIndex(position)
+	if index < 0 || index >= len(s.Fields) {
+		return nil
+	}
+	return &s.Fields[index]
+}
+
+// FieldValue returns the value of the field at the given HL7 position (1-based)
+func (s *HL7Segment) FieldValue(position int) string {
+	if isHeaderSegment(s.Type) && position == 1 {
+		// MSH-1 is the character following the segment name
+		if len(s.Raw) > 3 {
+			return s.Raw[3:4]
+		}
+		return ""
+	}
+	field := s.Field(position)
+	if field == nil {
+		return ""
+	}
+	return field.Value
+}
+
+// Component returns a component (1-based) of the field at the given HL7
+// position. For a repeating field the first repetition is used.
+func (s *HL7Segment) Component(position, component int) string {
+	field := s.Field(position)
+	if field == nil {
+		return ""
+	}
+	return field.ComponentValue(component)
+}
+
+// Repetitions returns every repetition of the field at the given HL7 position,
+// starting with the field itself, or nil if it is absent
+func (s *HL7Segment) Repetitions(position int) []*HL7Field {
+	field := s.Field(position)
+	if field == nil {
+		return nil
+	}
+	repetitions := make([]*HL7Field, 0, 1+len(field.Repetitions))
+	repetitions = append(repetitions, field)
+	for i := range field.Repetitions {
+		repetitions = append(repetitions, &field.Repetitions[i])
+	}
+	return repetitions
+}
+
+// ComponentValue returns a component (1-based) of a field or repetition
+func (field *HL7Field) ComponentValue(component int) string {
+	if component < 1 {
+		return ""
+	}
+	if len(field.Components) == 0 {
+		// A field without component separators is its own first component
+		if component == 1 {
+			return field.Value
+		}
+		return ""
+	}
+	if component > len(field.Components) {
+		return ""
+	}
+	return field.Components[component-1].Value
+}
+
+// SetFieldValue sets the field at the given HL7 position (1-based), adding empty
+// fields as needed. Any components and repetitions of the previous value are
+// discarded. value is the plain text: delimiters and the escape character in
+// it are escaped by Encode.
+// The segment's Raw string is not updated.
+func (s *HL7Segment) SetFieldValue(position int, value string) {
+	index := s.fieldIndex(position)
+	if index < 0 {
+		return
+	}
+	for len(s.Fields) <= index {
+		s.Fields = append(s.Fields, HL7Field{})
+	}
+	s.Fields[index] = HL7Field{Value: value, set: true}
+}
+
+// SetComponentValue sets a component (1-based) of the field at the given HL7
+// position (its first repetition), adding empty fields and components as
+// needed
+func (s *HL7Segment) SetComponentValue(position, component int, value string) {
+	index := s.fieldIndex(position)
+	if index < 0 || component < 1 {
+		return
+	}
+	for len(s.Fields) <= index {
+		s.Fields = append(s.Fields, HL7Field{})
+	}
+	s.Fields[index].SetComponentValue(component, value)
+}
+
+// SetComponentValue sets a component (1-based) of a field or repetition,
+// adding empty components as needed. value is the plain text, escaped by
+// Encode like the value of SetFieldValue.
+func (field *HL7Field) SetComponentValue(component int, value string) {
+	if component < 1 {
+		return
+	}
+	if len(field.Components) == 0 {
+		field.Components = []HL7Component{{Value: field.Value, set: field.set}}
+	}
+	for len(field.Components) < component {
+		field.Components = append(field.Components, HL7Component{})
+	}
+	field.Components[component-1] = HL7Component{Value: value, set: true}
+	field.Value = field.Components[0].Value
+}
+
+// fieldIndex converts an HL7 field position into an index into Fields
+func (s *HL7Segment) fieldIndex(position int) int {
+	if isHeaderSegment(s.Type) {
+		return position - 2
+	}
+	return position - 1
+}
+
+// isHeaderSegment reports whether a segment type declares the encoding
+// characters in its first two fields, like MSH
+func isHeaderSegment(segmentType string) bool {
+	switch segmentType {
+	case HL7_SEG_MSH, HL7_SEG_FHS, HL7_SEG_BHS:
+		return true
+	}
+	return false
+}
+
+// MSHSegment provides named access to the MSH (Message Header) segment
+type MSHSegment struct {
+	*HL7Segment
+}
+
+// PIDSegment provides named access to the PID (Patient Identification) segment
+type PIDSegment struct {
+	*HL7Segment
+}
+
+// PV1Segment provides named access to the PV1 (Patient Visit) segment
+type PV1Segment struct {
+	*HL7Segment
+}
+
+// OBXSegment provides named access to an OBX (Observation Result) segment
+type OBXSegment struct {
+	*HL7Segment
+}
+
+// MSH returns the message header segment, or nil if the message has none
+func (m *HL7Message) MSH() *MSHSegment {
+	if segment := m.GetSegmentByType(HL7_SEG_MSH); segment != nil {
+		return &MSHSegment{segment}
+	}
+	return nil
+}
+
+// PID returns the first patient identification segment, or nil if absent
+func (m *HL7Message) PID() *PIDSegment {
+	if segment := m.GetSegmentByType(HL7_SEG_PID); segment != nil {
+		return &PIDSegment{segment}
+	}
+	return nil
+}
+
+// PV1 returns the first patient visit segment, or nil if absent
+func (m *HL7Message) PV1() *PV1Segment {
+	if segment := m.GetSegmentByType(HL7_SEG_PV1); segment != nil {
+		return &PV1Segment{segment}
+	}
+	return nil
+}
+
+// OBXSegments returns all observation result segments in message order
+func (m *HL7Message) OBXSegments() []*OBXSegment {
+	segments := m.GetSegmentsByType(HL7_SEG_OBX)
+	observations := make([]*OBXSegment, 0, len(segments))
+	for _, segment := range segments {
+		observations = append(observations, &OBXSegment{segment})
+	}
+	return observations
+}
+
+// EncodingCharacters returns MSH-2
+func (s *MSHSegment) EncodingCharacters() string {
+	return s.FieldValue(2)
+}
+
+// SendingApplication returns MSH-3
+func (s *MSHSegment) SendingApplication() string {
+	return s.FieldValue(3)
+}
+
+// SendingFacility returns MSH-4
+func (s *MSHSegment) SendingFacility() string {
+	return s.FieldValue(4)
+}
+
+// ReceivingApplication returns MSH-5
+func (s *MSHSegment) ReceivingApplication() string {
+	return s.FieldValue(5)
+}
+
+// ReceivingFacility returns MSH-6
+func (s *MSHSegment) ReceivingFacility() string {
+	return s.FieldValue(6)
+}
+
+// DateTime returns the date/time of message (MSH-7)
+func (s *MSHSegment) DateTime() string {
+	return s.FieldValue(7)
+}
+
+// MessageType returns the message code (MSH-9.1, e.g. "ORU")
+func (s *MSHSegment) MessageType() string {
+	return s.Component(9, 1)
+}
+
+// TriggerEvent returns the trigger event (MSH-9.2, e.g. "R01")
+func (s *MSHSegment) TriggerEvent() string {
+	return s.Component(9, 2)
+}
+
+// MessageStructure returns the message structure (MSH-9.3, e.g. "ORU_R01")
+func (s *MSHSegment) MessageStructure() string {
+	return s.Component(9, 3)
+}
+
+// ControlID returns the message control ID (MSH-10)
+func (s *MSHSegment) ControlID() string {
+	return s.FieldValue(10)
+}
+
+// ProcessingID returns the processing ID (MSH-11, e.g. "P")
+func (s *MSHSegment) ProcessingID() string {
+	return s.FieldValue(11)
+}
+
+// Version returns the HL7 version ID (MSH-12)
+func (s *MSHSegment) Version() string {
+	return s.FieldValue(12)
+}
+
+// ContinuationPointer returns the continuation pointer (MSH-14) of a
+// fragment that continues an earlier one
+func (s *MSHSegment) ContinuationPointer() string {
+	return s.FieldValue(14)
+}
+
+// AcceptAckType returns the accept acknowledgment type (MSH-15)
+func (s *MSHSegment) AcceptAckType() string {
+	return s.FieldValue(15)
+}
+
+// ApplicationAckType returns the application acknowledgment type (MSH-16)
+func (s *MSHSegment) ApplicationAckType() string {
+	return s.FieldValue(16)
+}
+
+// CharacterSet returns the character set (MSH-18)
+func (s *MSHSegment) CharacterSet() string {
+	return s.FieldValue(18)
+}
+
+// MessageProfileID returns the message profile identifier (MSH-21.1)
+func (s *MSHSegment) MessageProfileID() string {
+	return s.Component(21, 1)
+}
+
+// SetControlID sets the message control ID (MSH-10)
+func (s *MSHSegment) SetControlID(id string) {
+	s.SetFieldValue(10, id)
+}
+
+// PatientIdentifierList returns PID-3 with all of its components
+func (s *PIDSegment) PatientIdentifierList() *HL7Field {
+	return s.Field(3)
+}
+
+// PatientID returns the ID number of the first patient identifier (PID-3.1).
+// Use HL7Message.GetPatientID to also search later repetitions and PID-2.
+func (s *PIDSegment) PatientID() string {
+	return s.Component(3, 1)
+}
+
+// ExternalPatientID returns the external patient ID (PID-2), used in place of
+// PID-3 by some v2.3 and v2.4 senders
+func (s *PIDSegment) ExternalPatientID() string {
+	return s.Component(2, 1)
+}
+
+// IdentifierTypeCode returns the identifier type code (PID-3.5, e.g. "MR")
+func (s *PIDSegment) IdentifierTypeCode() string {
+	return s.Component(3, 5)
+}
+
+// PatientName returns the patient name (PID-5)
+func (s *PIDSegment) PatientName() string {
+	return s.FieldValue(5)
+}
+
+// FamilyName returns the family name (PID-5.1)
+func (s *PIDSegment) FamilyName() string {
+	return s.Component(5, 1)
+}
+
+// GivenName returns the given name (PID-5.2)
+func (s *PIDSegment) GivenName() string {
+	return s.Component(5, 2)
+}
+
+// DateOfBirth returns the date/time of birth (PID-7)
+func (s *PIDSegment) DateOfBirth() string {
+	return s.FieldValue(7)
+}
+
+// Sex returns the administrative sex (PID-8)
+func (s *PIDSegment) Sex() string {
+	return s.FieldValue(8)
+}
+
+// Address returns the patient address (PID-11)
+func (s *PIDSegment) Address() string {
+	return s.FieldValue(11)
+}
+
+// HomePhone returns the home phone number (PID-13)
+func (s *PIDSegment) HomePhone() string {
+	return s.FieldValue(13)
+}
+
+// AccountNumber returns the patient account number (PID-18)
+func (s *PIDSegment) AccountNumber() string {
+	return s.FieldValue(18)
+}
+
+// SetPatientID sets the ID number of the patient identifier (PID-3.1)
+func (s *PIDSegment) SetPatientID(id string) {
+	s.SetComponentValue(3, 1, id)
+}
+
+// SetPatientName sets the family and given name (PID-5.1, PID-5.2)
+func (s *PIDSegment) SetPatientName(family, given string) {
+	s.SetComponentValue(5, 1, family)
+	s.SetComponentValue(5, 2, given)
+}
+
+// SetDateOfBirth sets the date/time of birth (PID-7)
+func (s *PIDSegment) SetDateOfBirth(dob string) {
+	s.SetFieldValue(7, dob)
+}
+
+// SetSex sets the administrative sex (PID-8)
+func (s *PIDSegment) SetSex(sex string) {
+	s.SetFieldValue(8, sex)
+}
+
+// PatientClass returns the patient class (PV1-2, e.g. "I", "E")
+func (s *PV1Segment) PatientClass() string {
+	return s.FieldValue(2)
+}
+
+// AssignedLocation returns the assigned patient location (PV1-3)
+func (s *PV1Segment) AssignedLocation() *HL7Field {
+	return s.Field(3)
+}
+
+// PointOfCare returns the point of care / unit (PV1-3.1)
+func (s *PV1Segment) PointOfCare() string {
+	return s.Component(3, 1)
+}
+
+// Room returns the room (PV1-3.2)
+func (s *PV1Segment) Room() string {
+	return s.Component(3, 2)
+}
+
+// Bed returns the bed (PV1-3.3)
+func (s *PV1Segment) Bed() string {
+	return s.Component(3, 3)
+}
+
+// AttendingDoctor returns the attending doctor (PV1-7)
+func (s *PV1Segment) AttendingDoctor() string {
+	return s.FieldValue(7)
+}
+
+// VisitNumber returns the visit number (PV1-19)
+func (s *PV1Segment) VisitNumber() string {
+	return s.FieldValue(19)
+}
+
+// AdmitDateTime returns the admit date/time (PV1-44)
+func (s *PV1Segment) AdmitDateTime() string {
+	return s.FieldValue(44)
+}
+
+// DischargeDateTime returns the discharge date/time (PV1-45)
+func (s *PV1Segment) DischargeDateTime() string {
+	return s.FieldValue(45)
+}
+
+// SetPatientClass sets the patient class (PV1-2)
+func (s *PV1Segment) SetPatientClass(class string) {
+	s.SetFieldValue(2, class)
+}
+
+// SetAssignedLocation sets the point of care, room and bed (PV1-3.1 to PV1-3.3)
+func (s *PV1Segment) SetAssignedLocation(pointOfCare, room, bed string) {
+	s.SetComponentValue(3, 1, pointOfCare)
+	s.SetComponentValue(3, 2, room)
+	s.SetComponentValue(3, 3, bed)
+}
+
+// ObservationSetID returns the set ID (OBX-1)
+func (s *OBXSegment) ObservationSetID() string {
+	return s.FieldValue(1)
+}
+
+// ValueType returns the value type (OBX-2, e.g. "NM", "ST")
+func (s *OBXSegment) ValueType() string {
+	return s.FieldValue(2)
+}
+
+// ObservationIdentifier returns OBX-3 with all of its components
+func (s *OBXSegment) ObservationIdentifier() *HL7Field {
+	return s.Field(3)
+}
+
+// ObservationCode returns the observation identifier code (OBX-3.1, e.g. "150033")
+func (s *OBXSegment) ObservationCode() string {
+	return s.Component(3, 1)
+}
+
+// ObservationText returns the observation identifier text (OBX-3.2, e.g. "MDC_PRESS_BLD_ART_SYS")
+func (s *OBXSegment) ObservationText() string {
+	return s.Component(3, 2)
+}
+
+// ObservationCodingSystem returns the coding system (OBX-3.3, e.g. "MDC")
+func (s *OBXSegment) ObservationCodingSystem() string {
+	return s.Component(3, 3)
+}
+
+// ObservationSubID returns the observation sub-ID (OBX-4, e.g. "1.13.1.1")
+func (s *OBXSegment) ObservationSubID() string {
+	return s.FieldValue(4)
+}
+
+// ObservationValue returns the first component of the observation value
+// (OBX-5), the whole value of NM and ST values. Coded (CE, CWE) and
+// structured (SN) values have more components: see ObservationValueField.
+func (s *OBXSegment) ObservationValue() string {
+	return s.FieldValue(5)
+}
+
+// ObservationValueField returns OBX-5 with all of its components and
+// repetitions, e.g. "^182^-^200" (SN) or "code^text^system" (CE)
+func (s *OBXSegment) ObservationValueField() *HL7Field {
+	return s.Field(5)
+}
+
+// Units returns OBX-6 with all of its components
+func (s *OBXSegment) Units() *HL7Field {
+	return s.Field(6)
+}
+
+// UnitCode returns the unit identifier (OBX-6.1, e.g. "266016")
+func (s *OBXSegment) UnitCode() string {
+	return s.Component(6, 1)
+}
+
+// UnitText returns the unit text (OBX-6.2, e.g. "MDC_DIM_MMHG")
+func (s *OBXSegment) UnitText() string {
+	return s.Component(6, 2)
+}
+
+// ReferenceRange returns the reference range (OBX-7)
+func (s *OBXSegment) ReferenceRange() string {
+	return s.FieldValue(7)
+}
+
+// AbnormalFlags returns the abnormal flags (OBX-8)
+func (s *OBXSegment) AbnormalFlags() string {
+	return s.FieldValue(8)
+}
+
+// ResultStatus returns the observation result status (OBX-11, e.g. "F", "R", "X")
+func (s *OBXSegment) ResultStatus() string {
+	return s.FieldValue(11)
+}
+
+// ObservationDateTime returns the date/time of the observation (OBX-14).
+// VersionProfile.ObservationTime also falls back to OBX-19 for v2.5 and later.
+func (s *OBXSegment) ObservationDateTime() string {
+	return s.FieldValue(14)
+}
+
+// EquipmentInstanceIdentifier returns the equipment instance identifier (OBX-18)
+func (s *OBXSegment) EquipmentInstanceIdentifier() string {
+	return s.FieldValue(18)
+}
+
+// AnalysisDateTime returns the date/time of the analysis (OBX-19, v2.5 and later)
+func (s *OBXSegment) AnalysisDateTime() string {
+	return s.FieldValue(19)
+}
+
+// SetObservationValue sets the observation value (OBX-5)
+func (s *OBXSegment) SetObservationValue(value string) {
+	s.SetFieldValue(5, value)
+}
+
+// SetUnits sets the unit identifier and text (OBX-6.1, OBX-6.2)
+func (s *OBXSegment) SetUnits(code, text string) {
+	s.SetComponentValue(6, 1, code)
+	s.SetComponentValue(6, 2, text)
+}
+
+// SetAbnormalFlags sets the abnormal flags (OBX-8)
+func (s *OBXSegment) SetAbnormalFlags(flags string) {
+	s.SetFieldValue(8, flags)
+}
+
+// SetResultStatus sets the observation result status (OBX-11)
+func (s *OBXSegment) SetResultStatus(status string) {
+	s.SetFieldValue(11, status)
+}
@@ -0,0 +1,45 @@
+package hl7
+
+import "testing"
+
+func TestOBXObservationValue(t *testing.T) {
+	raw := "MSH|^~\\&|MONITOR|ICU|GATEWAY|HOSP|20240601120000||ORU^R01^ORU_R01|CTRL-0043|P|2.5.1\r" +
+		"PID|1||12345^^^HOSP^MR||DOE^JOHN\r" +
+		"OBX|1|CE|8884-9^Heart rhythm^LN||427084000^Sinus tachycardia^SCT||||||F\r" +
+		"OBX|2|SN|8480-6^Systolic blood pressure^LN||^182^-^200|mm[Hg]^mmHg^UCUM|90-140|H|||F\r"
+	message, err := NewHL7Parser().ParseMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obx := message.OBXSegments()
+	if len(obx) != 2 {
+		t.Fatalf("OBXSegments() returned %d segments, want 2", len(obx))
+	}
+
+	if value := obx[0].ObservationValue(); value != "427084000" {
+		t.Errorf("ObservationValue() = %q, want the first component 427084000", value)
+	}
+	field := obx[0].ObservationValueField()
+	if field == nil {
+		t.Fatal("ObservationValueField() = nil")
+	}
+	if code, text, system := field.ComponentValue(1), field.ComponentValue(2), field.ComponentValue(3); code != "427084000" || text != "Sinus tachycardia" || system != "SCT" {
+		t.Errorf("OBX-5 components = %q, %q, %q, want 427084000, Sinus tachycardia, SCT", code, text, system)
+	}
+	if id := obx[1].ObservationSetID(); id != "2" {
+		t.Errorf("ObservationSetID() = %q, want 2", id)
+	}
+	if reference := obx[1].ReferenceRange(); reference != "90-140" {
+		t.Errorf("ReferenceRange() = %q, want 90-140", reference)
+	}
+
+	observations := ExtractObservations(message).Observations
+	if len(observations) != 2 {
+		t.Fatalf("ExtractObservations returned %d observations, want 2", len(observations))
+	}
+	for i, want := range []string{"427084000^Sinus tachycardia^SCT", "^182^-^200"} {
+		if observations[i].Value != want {
+			t.Errorf("observation %d Value = %q, want OBX-5 as received %q", i, observations[i].Value, want)
+		}
+	}
+}
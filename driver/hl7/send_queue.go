@@ -0,0 +1,465 @@
+package hl7
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+)
+
+// Send queue defaults
+const (
+	SEND_QUEUE_MAX_MESSAGES   = 10000 // Messages kept before Enqueue fails
+	SEND_QUEUE_RETRY_INTERVAL = 5     // Seconds before the first retry after a failed delivery
+)
+
+// ErrSendQueueFull is returned by Enqueue when the queue holds its maximum
+// number of messages, so that the caller can slow down or refuse work
+var ErrSendQueueFull = errors.New("send queue full")
+
+// errSendQueueStopped is returned by Enqueue after Stop
+var errSendQueueStopped = errors.New("send queue stopped")
+
+// SendQueueConfig configures a durable queue of outbound messages
+type SendQueueConfig struct {
+	Name          string `json:"name"`           // Label of the queue in logs and metrics
+	Store         string `json:"store"`          // "filesystem" or "sqlite"
+	Path          string `json:"path"`           // Directory (filesystem) or database file (sqlite)
+	MaxMessages   int    `json:"max_messages"`   // Messages kept before Enqueue fails (0: 10000)
+	RetryInterval int    `json:"retry_interval"` // Seconds before the first retry, doubled up to 5 minutes (0: 5)
+}
+
+// SendQueueStatus is the delivery state of a send queue
+type SendQueueStatus struct {
+	Name      string     `json:"name"`
+	Queued    int        `json:"queued"`   // Messages waiting, including the one being sent
+	Sent      int        `json:"sent"`     // Since start
+	Rejected  int        `json:"rejected"` // Since start
+	Full      int        `json:"full"`     // Messages refused by Enqueue since start
+	LastSent  *time.Time `json:"last_sent,omitempty"`
+	LastError string     `json:"last_error,omitempty"` // Error of the last failed attempt, cleared by the next delivery
+}
+
+// sendStore keeps the messages of a send queue in the order they were queued
+type sendStore interface {
+	add(raw string, now time.Time) error
+	first() (id string, raw string, found bool, err error) // Oldest message not delivered or refused
+	remove(id string) error
+	fail(id string) error // Keeps a refused message for inspection
+	count() (int, error)
+	close() error
+}
+
+// SendQueue sends messages with an MLLP client in the order they were
+// queued. Messages are written to a store before Enqueue returns, so those
+// generated while the receiving system is down are kept, also across
+// restarts, and resent once it accepts connections again. A message is
+// retried until it is accepted or refused with AE or CE; refused messages
+// are kept in the store but no longer sent.
+type SendQueue struct {
+	config  SendQueueConfig
+	client  *MLLPClient
+	store   sendStore
+	clock   clock.Clock
+	onError func(error)
+
+	queued   int64
+	wake     chan struct{}
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	mutex     sync.Mutex
+	sent      int
+	rejected  int
+	full      int
+	lastSent  time.Time
+	lastError string
+}
+
+// NewSendQueue opens the store of config and creates a queue that delivers
+// its messages with client once started
+func NewSendQueue(client *MLLPClient, config SendQueueConfig) (*SendQueue, error) {
+	if client == nil {
+		return nil, fmt.Errorf("send queue requires a client")
+	}
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = SEND_QUEUE_MAX_MESSAGES
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = SEND_QUEUE_RETRY_INTERVAL
+	}
+	if config.Name == "" {
+		config.Name = client.address
+	}
+
+	var store sendStore
+	var err error
+	switch config.Store {
+	case STORAGE_FILESYSTEM:
+		store, err = openFileSendStore(config.Path)
+	case STORAGE_SQLITE:
+		store, err = openSQLiteSendStore(config.Path)
+	default:
+		return nil, fmt.Errorf("unknown send queue store %q", config.Store)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := store.count()
+	if err != nil {
+		store.close()
+		return nil, err
+	}
+	q := &SendQueue{
+		config:   config,
+		client:   client,
+		store:    store,
+		clock:    clock.Real,
+		wake:     make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+	q.setQueued(int64(count))
+	return q, nil
+}
+
+// SetClock replaces the clock used for retry delays (for tests)
+func (q *SendQueue) SetClock(c clock.Clock) {
+	q.clock = clock.OrReal(c)
+}
+
+// SetErrorHandler is called with failed delivery attempts
+func (q *SendQueue) SetErrorHandler(handler func(error)) {
+	q.onError = handler
+}
+
+// reportError passes an error to the error handler
+func (q *SendQueue) reportError(err error) {
+	if q.onError != nil {
+		q.onError(fmt.Errorf("send queue %s: %v", q.config.Name, err))
+	}
+}
+
+// Enqueue stores a message for delivery. It returns ErrSendQueueFull when
+// the queue already holds max_messages messages.
+func (q *SendQueue) Enqueue(message string) error {
+	select {
+	case <-q.stopChan:
+		return errSendQueueStopped
+	default:
+	}
+	if q.Pending() >= q.config.MaxMessages {
+		q.mutex.Lock()
+		q.full++
+		q.mutex.Unlock()
+		return fmt.Errorf("%w (%d messages)", ErrSendQueueFull, q.config.MaxMessages)
+	}
+
+	if err := q.store.add(message, q.clock.Now()); err != nil {
+		return fmt.Errorf("failed to store message: %v", err)
+	}
+	q.setQueued(1)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns the number of messages waiting, including the one being sent
+func (q *SendQueue) Pending() int {
+	return int(atomic.LoadInt64(&q.queued))
+}
+
+// setQueued adds delta to the messages waiting
+func (q *SendQueue) setQueued(delta int64) {
+	metricSendQueued.Set(float64(atomic.AddInt64(&q.queued, delta)), q.config.Name)
+}
+
+// Start delivers the queued messages until Stop is called
+func (q *SendQueue) Start() {
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.deliver()
+	}()
+}
+
+// Stop stops delivering, waits for the attempt in progress and closes the
+// store. Queued messages are sent by the next queue opened on the store.
+// It is safe to call Stop more than once.
+func (q *SendQueue) Stop() {
+	q.stopOnce.Do(func() {
+		close(q.stopChan)
+		q.wg.Wait()
+		if err := q.store.close(); err != nil {
+			q.reportError(err)
+		}
+	})
+}
+
+// Status returns the delivery state of the queue
+func (q *SendQueue) Status() SendQueueStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	status := SendQueueStatus{
+		Name:      q.config.Name,
+		Queued:    q.Pending(),
+		Sent:      q.sent,
+		Rejected:  q.rejected,
+		Full:      q.full,
+		LastError: q.lastError,
+	}
+	if !q.lastSent.IsZero() {
+		lastSent := q.lastSent
+		status.LastSent = &lastSent
+	}
+	return status
+}
+
+// next waits for the oldest queued message. It returns false once the
+// queue stops.
+func (q *SendQueue) next() (string, string, bool) {
+	for {
+		id, raw, found, err := q.store.first()
+		if err != nil {
+			q.reportError(err)
+			if count, err := q.store.count(); err == nil {
+				q.setQueued(int64(count) - atomic.LoadInt64(&q.queued))
+			}
+		} else if found {
+			return id, raw, true
+		}
+		select {
+		case <-q.wake:
+		case <-q.clock.After(time.Duration(q.config.RetryInterval) * time.Second):
+		case <-q.stopChan:
+			return "", "", false
+		}
+	}
+}
+
+// deliver sends the messages in order until the queue stops. A message is
+// retried with exponential backoff until it is accepted or refused with AE
+// or CE, so that a later message never overtakes it.
+func (q *SendQueue) deliver() {
+	interval := time.Duration(q.config.RetryInterval) * time.Second
+	for {
+		id, raw, ok := q.next()
+		if !ok {
+			return
+		}
+
+		backoff := interval
+		for {
+			ack, err := q.client.Send(raw)
+			if err == nil {
+				q.done(id, true, q.clock.Now(), "")
+				break
+			}
+			if ack != nil && !retryableAck(ack) {
+				q.done(id, false, time.Time{}, err.Error())
+				q.reportError(err)
+				break
+			}
+
+			q.mutex.Lock()
+			q.lastError = err.Error()
+			q.mutex.Unlock()
+			q.reportError(fmt.Errorf("retrying in %s: %v", backoff, err))
+			select {
+			case <-q.clock.After(backoff):
+			case <-q.stopChan:
+				return
+			}
+			if backoff *= 2; backoff > ROUTER_MAX_BACKOFF {
+				backoff = ROUTER_MAX_BACKOFF
+			}
+		}
+	}
+}
+
+// done removes a delivered or refused message from the queue
+func (q *SendQueue) done(id string, accepted bool, sent time.Time, lastError string) {
+	var err error
+	if accepted {
+		err = q.store.remove(id)
+	} else {
+		err = q.store.fail(id)
+	}
+	if err != nil {
+		// The message stays first in the store and would be sent again
+		lastError = err.Error()
+		q.reportError(err)
+	} else {
+		q.setQueued(-1)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if accepted {
+		q.sent++
+		q.lastSent = sent
+	} else {
+		q.rejected++
+	}
+	q.lastError = lastError
+}
+
+// fileSendStore keeps every message in a file of a directory, named so that
+// the files sort in the order they were queued
+type fileSendStore struct {
+	dir string
+}
+
+// openFileSendStore creates the directory of a filesystem store
+func openFileSendStore(dir string) (*fileSendStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("filesystem send queue requires a path")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create send queue directory: %v", err)
+	}
+	return &fileSendStore{dir: dir}, nil
+}
+
+func (s *fileSendStore) add(raw string, now time.Time) error {
+	name := fmt.Sprintf("%s-%08d%s", now.UTC().Format("20060102T150405.000000000"), atomic.AddUint64(&routeSequence, 1), ROUTER_STORE_EXT)
+	return writeFileSync(filepath.Join(s.dir, name), []byte(raw))
+}
+
+func (s *fileSendStore) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+ROUTER_STORE_EXT))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list send queue: %v", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *fileSendStore) first() (string, string, bool, error) {
+	files, err := s.files()
+	if err != nil || len(files) == 0 {
+		return "", "", false, err
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		// Set an unreadable file aside so that it does not block the queue
+		os.Rename(files[0], strings.TrimSuffix(files[0], ROUTER_STORE_EXT)+ROUTER_FAILED_EXT)
+		return "", "", false, fmt.Errorf("failed to read queued message: %v", err)
+	}
+	return files[0], string(data), true, nil
+}
+
+func (s *fileSendStore) remove(id string) error {
+	if err := os.Remove(id); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove sent message: %v", err)
+	}
+	return nil
+}
+
+func (s *fileSendStore) fail(id string) error {
+	if err := os.Rename(id, strings.TrimSuffix(id, ROUTER_STORE_EXT)+ROUTER_FAILED_EXT); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to keep refused message: %v", err)
+	}
+	return nil
+}
+
+func (s *fileSendStore) count() (int, error) {
+	files, err := s.files()
+	return len(files), err
+}
+
+func (s *fileSendStore) close() error {
+	return nil
+}
+
+// sqliteSendQueueSchema creates the table of a SQLite send queue. Refused
+// messages are kept with failed set.
+const sqliteSendQueueSchema = `
+CREATE TABLE IF NOT EXISTS hl7_send_queue (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	queued_at   INTEGER NOT NULL,
+	raw_message TEXT NOT NULL,
+	failed      INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS hl7_send_queue_pending ON hl7_send_queue (failed, id);
+`
+
+// sqliteSendStore keeps the messages in a table of a SQLite database, in
+// the order of their row IDs
+type sqliteSendStore struct {
+	db *sql.DB
+}
+
+// openSQLiteSendStore opens (or creates) the database of a SQLite store
+// with the driver named by SQLiteDriverName
+func openSQLiteSendStore(path string) (*sqliteSendStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite send queue requires a path")
+	}
+	db, err := sql.Open(SQLiteDriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+	}
+	if _, err := db.Exec(sqliteSendQueueSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema: %v", err)
+	}
+	return &sqliteSendStore{db: db}, nil
+}
+
+func (s *sqliteSendStore) add(raw string, now time.Time) error {
+	if _, err := s.db.Exec(`INSERT INTO hl7_send_queue (queued_at, raw_message) VALUES (?, ?)`, now.UnixNano(), raw); err != nil {
+		return fmt.Errorf("failed to insert message: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteSendStore) first() (string, string, bool, error) {
+	var id int64
+	var raw string
+	err := s.db.QueryRow(`SELECT id, raw_message FROM hl7_send_queue WHERE failed = 0 ORDER BY id LIMIT 1`).Scan(&id, &raw)
+	if err == sql.ErrNoRows {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to read queued message: %v", err)
+	}
+	return fmt.Sprint(id), raw, true, nil
+}
+
+func (s *sqliteSendStore) remove(id string) error {
+	if _, err := s.db.Exec(`DELETE FROM hl7_send_queue WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove sent message: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteSendStore) fail(id string) error {
+	if _, err := s.db.Exec(`UPDATE hl7_send_queue SET failed = 1 WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to keep refused message: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteSendStore) count() (int, error) {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM hl7_send_queue WHERE failed = 0`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count queued messages: %v", err)
+	}
+	return count, nil
+}
+
+func (s *sqliteSendStore) close() error {
+	return s.db.Close()
+}
@@ -1,7 +1,8 @@
 package hl7
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -10,8 +11,28 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+	"github.com/harusin0516/healthcare/driver/fhir"
+	"github.com/harusin0516/healthcare/driver/memwatch"
+	"github.com/harusin0516/healthcare/driver/precision"
+	"github.com/harusin0516/healthcare/driver/publish"
+	"github.com/harusin0516/healthcare/driver/stream"
 )
 
+// HL7_DEFAULT_TOPIC is the topic template used when none is configured
+const HL7_DEFAULT_TOPIC = "hl7.{type}"
+
+// Acknowledgment codes (MSA-1)
+const (
+	HL7_ACK_ACCEPT = "AA" // Accepted
+	HL7_ACK_ERROR  = "AE" // Error in the message, e.g. too large; resending it unchanged does not help
+	HL7_ACK_REJECT = "AR" // Rejected, e.g. while the server is overloaded; the sender retries
+)
+
+// HL7_IDLE_CHECK_INTERVAL is how often clients are checked against the idle timeout
+const HL7_IDLE_CHECK_INTERVAL = time.Second
+
 // HL7Server represents the HL7 server
 type HL7Server struct {
 	config     *ServerConfig
@@ -19,9 +40,67 @@ type HL7Server struct {
 	listener   net.Listener
 	clients    map[string]*Client
 	mutex      sync.RWMutex
-	messageChan chan *HL7Message
+	queues     []chan *HL7Message // One queue per processing worker
+	queueMutex sync.RWMutex       // Held for reading while a message is sent to a queue, for writing to close the queues
+	workers    sync.WaitGroup     // Processing workers, waited for by Stop
 	stopChan   chan bool
+	stopOnce   sync.Once
 	logger     *log.Logger
+	onError    func(error)
+	crashReports []*CrashReport
+	storage    Storage
+	publisher  publish.Publisher
+	topicTemplate string
+	clock      clock.Clock
+	stats      MessageStats
+	statsMutex sync.Mutex
+	bpChecker  *BPChecker
+	access     *accessList
+	onAlert    func(*BPAlert)
+	timeline   *Timeline
+	infusions  *InfusionRegistry
+	hub        stream.Publisher
+	critical   *CriticalDetector
+	duplicates *DuplicateDetector // Control IDs of recently accepted messages, nil if disabled
+	criticalChan chan *LabCriticalAlert
+	onCritical func(*LabCriticalAlert)
+	fhirClient *fhir.Client
+	fhirConverter *fhir.Converter
+	registry   *PatientRegistry
+	onAudit    func(*PatientMergeAudit)
+	encounters *EncounterTracker
+	remote     *RemoteSyncer
+	syncSites  map[string]*syncSiteState // Remote sites that synced since start
+	features   map[string]bool // Feature flags set by the fleet management service
+	observer   *Observer // Records outputs instead of sending them in observer mode
+	units      *UnitNormalizer // Rewrites free-text OBX units before storage
+	continuations *continuationBuffer // Fragments of messages continued with DSC
+	memory     *memwatch.Monitor // Heap and subsystem growth, nil if disabled
+	precision  *precision.Policy // Rounds OBX values before storage
+	queryResponder QueryResponder // Answers QBP^Q22 queries, nil if they are rejected
+	router     *Router // Forwards messages to downstream systems, nil if disabled
+	transformer *Transformer // Mapping rules applied on receipt, nil if disabled; replaced by Reload
+	deidentifier *Deidentifier // Removes patient identifiers for research outputs, nil if disabled
+	syncMutex  sync.Mutex
+}
+
+// ServerError describes an error that occurred while the server was running.
+// It is passed to the handler registered with SetErrorHandler.
+type ServerError struct {
+	Op       string // Operation that failed: "accept", "parse", "store", "ack", "publish", "panic", "admin", "timeout", "spill", "notify", "fhir", "order", "registry", "merge", "encounter", "remote", "fleet", "observer", "route", "transform", "certificate", "deidentify"
+	ClientID string // Remote address of the client, empty for listener errors
+	Err      error
+}
+
+func (e *ServerError) Error() string {
+	if e.ClientID == "" {
+		return fmt.Sprintf("hl7 server %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("hl7 server %s (%s): %v", e.Op, e.ClientID, e.Err)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
 }
 
 // Client represents a connected client
@@ -29,56 +108,308 @@ type Client struct {
 	ID       string
 	Conn     net.Conn
 	Address  string
+	ConnectedAt time.Time
 	LastSeen time.Time
 }
 
 // NewHL7Server creates a new HL7 server
 func NewHL7Server(config *ServerConfig) *HL7Server {
-	return &HL7Server{
+	server := &HL7Server{
 		config:     config,
 		parser:     NewHL7Parser(),
 		clients:    make(map[string]*Client),
-		messageChan: make(chan *HL7Message, 100),
+		queues:     newQueues(config.Processing),
 		stopChan:   make(chan bool),
 		logger:     log.New(os.Stdout, "[HL7-SERVER] ", log.LstdFlags),
+		clock:      clock.Real,
+		stats:      MessageStats{ByType: make(map[string]int)},
+		infusions:  NewInfusionRegistry(),
+		fhirConverter: fhir.NewConverter(config.FHIR),
+		continuations: newContinuationBuffer(),
+	}
+	if config.BPCheck.Enabled {
+		server.bpChecker = NewBPChecker(config.BPCheck)
+	}
+	if config.Precision.Enabled {
+		server.precision = precision.NewPolicy(config.Precision.Decimals)
+	}
+	if config.Timeline.Enabled {
+		server.timeline = NewTimeline(config.Timeline)
+		server.timeline.SetPrecision(server.precision)
+	}
+	if config.Units.Enabled {
+		server.units = NewUnitNormalizer(config.Units.Mappings)
+	}
+	if config.Duplicates.Enabled {
+		server.duplicates = NewDuplicateDetector(config.Duplicates)
+	}
+	if config.LabCritical.Enabled {
+		server.critical = NewCriticalDetector(config.LabCritical)
+		server.criticalChan = make(chan *LabCriticalAlert, CRITICAL_QUEUE_SIZE)
+	}
+	if config.PatientRegistry.Enabled {
+		// Start with an empty registry rather than refusing to start; ADT
+		// messages fill it again
+		registry, err := NewPatientRegistry(config.PatientRegistry.File)
+		if err != nil {
+			server.logf(LOG_LEVEL_ERROR, "Patient registry not loaded: %v", err)
+		}
+		server.registry = registry
+		server.queryResponder = registry
+		metricRegistryPatients.Set(float64(registry.Count()))
+	}
+	if config.Encounters.Enabled {
+		encounters, err := NewEncounterTracker(config.Encounters.File)
+		if err != nil {
+			server.logf(LOG_LEVEL_ERROR, "Encounters not loaded: %v", err)
+		}
+		server.encounters = encounters
+	}
+	if config.Observer.Enabled {
+		// Observe without the output file rather than refusing to start
+		observer, err := NewObserver(config.Observer)
+		if err != nil {
+			server.logf(LOG_LEVEL_ERROR, "Observer output not recorded to file: %v", err)
+		}
+		server.observer = observer
+		server.logf(LOG_LEVEL_WARN, "Observer mode: nothing is sent downstream")
+	}
+	if config.Remote.Enabled && server.observer == nil {
+		// Keep the syncer so that messages are rejected rather than accepted
+		// without a copy when the buffer cannot be opened
+		remote, err := NewRemoteSyncer(config.Remote)
+		if err != nil {
+			server.logf(LOG_LEVEL_ERROR, "Remote buffer not opened, rejecting all messages: %v", err)
+		}
+		server.remote = remote
+	}
+	if config.Deidentify.Enabled {
+		server.deidentifier = NewDeidentifier(config.Deidentify)
+	}
+	if config.Router.Enabled {
+		router, err := NewRouter(config.Router)
+		if err != nil {
+			server.logf(LOG_LEVEL_ERROR, "Router not started, messages are not forwarded: %v", err)
+		} else {
+			router.SetErrorHandler(func(err error) { server.reportError("route", "", err) })
+			router.SetDeidentifier(server.deidentifier)
+			server.router = router
+		}
+	}
+	if config.Transform.Enabled {
+		transformer, err := LoadTransformer(config.Transform.File)
+		if err != nil {
+			server.logf(LOG_LEVEL_ERROR, "Transformation rules not loaded, messages are not transformed: %v", err)
+		}
+		server.transformer = transformer
+	}
+	
+	// Reject every client if the access lists are invalid rather than
+	// silently ignoring a deny rule
+	access, warnings, err := newAccessList(config.AllowedIPs, config.DeniedIPs)
+	if err != nil {
+		server.logf(LOG_LEVEL_ERROR, "Invalid access list, rejecting all clients: %v", err)
+		access = &accessList{closed: true}
+	}
+	for _, warning := range warnings {
+		server.logf(LOG_LEVEL_WARN, "Access list: %s", warning)
 	}
+	server.access = access
+	
+	if config.Memory.Enabled {
+		server.memory = memwatch.NewMonitor(config.Memory)
+		server.watchMemory(server.memory)
+	}
+	return server
 }
 
-// LoadConfig loads server configuration from file
-func LoadConfig(filename string) (*ServerConfig, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open config file: %v", err)
+// SetLogger replaces the server logger (use io.Discard to silence output)
+func (s *HL7Server) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
+// SetStorage archives every received message to storage (nil disables archiving).
+// The caller keeps ownership of storage and closes it after the server stops.
+func (s *HL7Server) SetStorage(storage Storage) {
+	s.storage = storage
+}
+
+// SetPublisher publishes every processed message as JSON to publisher (nil
+// disables publishing). topicTemplate may use {type}, {event}, {sending_app}
+// and {facility}; the default is "hl7.{type}". The caller keeps ownership of
+// publisher and closes it after the server stops.
+func (s *HL7Server) SetPublisher(publisher publish.Publisher, topicTemplate string) {
+	if topicTemplate == "" {
+		topicTemplate = HL7_DEFAULT_TOPIC
+	}
+	if publisher != nil && s.observer != nil {
+		publisher = &observerPublisher{server: s}
 	}
-	defer file.Close()
+	s.publisher = publisher
+	s.topicTemplate = topicTemplate
+}
 
-	var config struct {
-		Server ServerConfig `json:"server"`
+// QueryMessages returns archived messages matching filter
+func (s *HL7Server) QueryMessages(filter MessageFilter) ([]*StoredMessage, error) {
+	if s.storage == nil {
+		return nil, fmt.Errorf("message storage is not configured")
 	}
+	return s.storage.Query(filter)
+}
 
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to decode config file: %v", err)
+// SetClock sets the clock used for message timestamps, client activity and
+// accept retries. Tests use a simulated clock; connection deadlines always
+// use the wall clock because they are enforced by the operating system.
+func (s *HL7Server) SetClock(c clock.Clock) {
+	s.clock = clock.OrReal(c)
+	if s.router != nil {
+		s.router.SetClock(c)
 	}
+}
+
+// SetErrorHandler registers a callback for errors that occur while the server
+// is running (accept, parse and acknowledgment failures). The server keeps
+// running after reporting an error; the handler must not block.
+func (s *HL7Server) SetErrorHandler(handler func(error)) {
+	s.onError = handler
+}
 
-	return &config.Server, nil
+// SetAlertHandler registers a callback for alerts derived from received
+// observations (see BPChecker). The handler must not block.
+func (s *HL7Server) SetAlertHandler(handler func(*BPAlert)) {
+	s.onAlert = handler
 }
 
-// Start starts the HL7 server
-func (s *HL7Server) Start() error {
-	address := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
+// SetCriticalHandler registers a callback for critical lab results (see
+// CriticalDetector). It is called from the notifier goroutine, not from the
+// message workers; the handler must not block.
+func (s *HL7Server) SetCriticalHandler(handler func(*LabCriticalAlert)) {
+	s.onCritical = handler
+}
+
+// SetAuditHandler registers a callback for the audit records of patient
+// merges (A40). The handler must not block.
+func (s *HL7Server) SetAuditHandler(handler func(*PatientMergeAudit)) {
+	s.onAudit = handler
+}
+
+// SetFHIRClient exports the observations of ORU messages to a FHIR server
+// as transaction bundles (nil disables the export). The caller keeps
+// ownership of client and closes it after the server stops.
+func (s *HL7Server) SetFHIRClient(client *fhir.Client) {
+	s.fhirClient = client
+}
+
+// SetStream streams the observations and infusion pump states of ORU
+// messages to publisher, usually a *stream.Hub (nil disables streaming).
+// Events are keyed by bed (PV1-3), or by patient ID for messages without a
+// location.
+func (s *HL7Server) SetStream(publisher stream.Publisher) {
+	s.hub = publisher
+}
+
+// Infusions returns the latest infusion pump channel states
+func (s *HL7Server) Infusions() *InfusionRegistry {
+	return s.infusions
+}
+
+// Patients returns the patient registry, or nil if it is not enabled
+func (s *HL7Server) Patients() *PatientRegistry {
+	return s.registry
+}
+
+// Encounters returns the encounter tracker, or nil if it is not enabled
+func (s *HL7Server) Encounters() *EncounterTracker {
+	return s.encounters
+}
+
+// Timeline returns the vitals and medication timeline, or nil if it is not enabled
+func (s *HL7Server) Timeline() *Timeline {
+	return s.timeline
+}
+
+// reportError logs an error and passes it to the registered error handler
+func (s *HL7Server) reportError(op, clientID string, err error) {
+	serverErr := &ServerError{Op: op, ClientID: clientID, Err: err}
+	s.logf(LOG_LEVEL_ERROR, "%s", serverErr.Error())
+	if s.onError != nil {
+		s.onError(serverErr)
+	}
+}
+
+// Start starts the HL7 server and blocks until ctx is canceled or Stop is called
+func (s *HL7Server) Start(ctx context.Context) error {
+	config := s.settings()
+	address := listenAddress(config.Host, config.Port)
 	
-	listener, err := net.Listen("tcp", address)
+	var listenConfig net.ListenConfig
+	listener, err := listenConfig.Listen(ctx, listenNetwork(config.Network), address)
 	if err != nil {
 		return fmt.Errorf("failed to start server on %s: %v", address, err)
 	}
+	if config.TLS.Enabled {
+		tlsConfig, err := config.TLS.TLSConfig()
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to start server on %s: %v", address, err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	
+	s.mutex.Lock()
 	s.listener = listener
-	s.logger.Printf("HL7 server started on %s", address)
 	
-	// Start message processor
-	go s.processMessages()
+	// Stop may have run before the listener was set, without closing it
+	select {
+	case <-s.stopChan:
+		s.mutex.Unlock()
+		listener.Close()
+		return nil
+	default:
+	}
+	// Stop waits for the workers once it holds the mutex
+	s.workers.Add(len(s.queues))
+	s.mutex.Unlock()
+	s.logf(LOG_LEVEL_INFO, "HL7 server started on %s", address)
+	
+	// Start the processing workers
+	for _, queue := range s.queues {
+		go s.processMessages(queue)
+	}
+	if processing := config.Processing; processing.Overflow == OVERFLOW_SPILL {
+		go s.drainSpill(processing.SpillDir)
+	}
+	if s.critical != nil {
+		go s.notifyCritical()
+	}
+	if s.remote != nil {
+		go s.syncRemote()
+	}
+	if s.router != nil && s.observer == nil {
+		s.router.Start()
+	}
+	
+	// Close clients that stay idle longer than the idle timeout
+	go s.reapIdleClients()
+	
+	// Pick up renewed certificates and report those about to expire
+	go s.watchCertificates()
+	
+	if s.memory != nil {
+		s.memory.Start()
+	}
+	
+	// Stop the server when the context is canceled
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.stopChan:
+		}
+	}()
 	
 	// Accept connections
+	var retryDelay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -86,148 +417,474 @@ func (s *HL7Server) Start() error {
 			case <-s.stopChan:
 				return nil
 			default:
-				s.logger.Printf("Failed to accept connection: %v", err)
-				continue
 			}
+			
+			// Back off so a persistent accept error does not spin the loop
+			if retryDelay == 0 {
+				retryDelay = 5 * time.Millisecond
+			} else if retryDelay *= 2; retryDelay > time.Second {
+				retryDelay = time.Second
+			}
+			s.reportError("accept", "", err)
+			
+			select {
+			case <-s.clock.After(retryDelay):
+			case <-s.stopChan:
+				return nil
+			}
+			continue
 		}
+		retryDelay = 0
 		
 		// Check if client is allowed
-		if !s.isClientAllowed(conn.RemoteAddr().String()) {
-			s.logger.Printf("Connection rejected from %s", conn.RemoteAddr().String())
+		if allowed, reason := s.isClientAllowed(conn.RemoteAddr().String()); !allowed {
+			s.logf(LOG_LEVEL_WARN, "Connection rejected from %s: %s", conn.RemoteAddr().String(), reason)
+			metricRejectedConnections.Inc(REJECT_NOT_ALLOWED)
+			conn.Close()
+			continue
+		}
+		
+		// Register the client unless the connection limit is reached
+		client, limit := s.addClient(conn)
+		if client == nil {
+			s.logf(LOG_LEVEL_WARN, "Connection rejected from %s: connection limit (%d) reached", conn.RemoteAddr().String(), limit)
+			metricRejectedConnections.Inc(REJECT_LIMIT)
 			conn.Close()
 			continue
 		}
 		
 		// Handle client connection
-		go s.handleClient(conn)
+		go s.handleClient(client)
 	}
 }
 
-// Stop stops the HL7 server
+// Stop stops the HL7 server. Messages already queued for processing were
+// acknowledged, so Stop waits until the workers have processed them. It is
+// safe to call Stop more than once.
 func (s *HL7Server) Stop() error {
-	s.logger.Println("Stopping HL7 server...")
+	s.stopOnce.Do(s.shutdown)
+	return nil
+}
+
+// shutdown closes the listener and all client connections, lets the
+// workers process the queued messages and stops the outputs
+func (s *HL7Server) shutdown() {
+	s.logf(LOG_LEVEL_INFO, "Stopping HL7 server...")
 	
 	// Signal stop
 	close(s.stopChan)
 	
-	// Close listener
+	// Close the listener (Start closes it itself if it is set after this)
+	s.mutex.Lock()
 	if s.listener != nil {
 		s.listener.Close()
 	}
 	
 	// Close all client connections
-	s.mutex.Lock()
 	for _, client := range s.clients {
 		client.Conn.Close()
 	}
 	s.clients = make(map[string]*Client)
 	s.mutex.Unlock()
 	
-	s.logger.Println("HL7 server stopped")
-	return nil
+	// Process the queued messages while the outputs are still running
+	s.closeQueues()
+	s.workers.Wait()
+	
+	if s.memory != nil {
+		s.memory.Stop()
+	}
+	
+	if s.router != nil {
+		s.router.Stop()
+	}
+	
+	if s.observer != nil {
+		if err := s.observer.Close(); err != nil {
+			s.reportError("observer", "", err)
+		}
+	}
+	
+	s.logf(LOG_LEVEL_INFO, "HL7 server stopped")
 }
 
-// handleClient handles a single client connection
-func (s *HL7Server) handleClient(conn net.Conn) {
+// addClient registers a new connection. It returns nil and the limit if
+// max_connections clients are already connected.
+func (s *HL7Server) addClient(conn net.Conn) (*Client, int) {
 	clientID := conn.RemoteAddr().String()
+	limit := s.settings().MaxConnections
+	
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if limit > 0 && len(s.clients) >= limit {
+		return nil, limit
+	}
 	
 	client := &Client{
 		ID:       clientID,
 		Conn:     conn,
 		Address:  conn.RemoteAddr().String(),
-		LastSeen: time.Now(),
+		ConnectedAt: s.clock.Now(),
+		LastSeen: s.clock.Now(),
 	}
-	
-	// Add client to list
-	s.mutex.Lock()
 	s.clients[clientID] = client
-	s.mutex.Unlock()
+	metricConnections.Inc()
 	
-	s.logger.Printf("Client connected: %s", clientID)
+	return client, limit
+}
+
+// handleClient handles a single client connection
+func (s *HL7Server) handleClient(client *Client) {
+	clientID := client.ID
+	conn := client.Conn
+	
+	defer func() {
+		// Remove client from list
+		s.mutex.Lock()
+		delete(s.clients, clientID)
+		s.mutex.Unlock()
+		metricConnections.Dec()
+		s.continuations.drop(clientID)
+		
+		conn.Close()
+		s.logf(LOG_LEVEL_INFO, "Client disconnected: %s", clientID)
+	}()
 	
-	// Set connection timeout
-	conn.SetDeadline(time.Now().Add(time.Duration(s.config.Timeout) * time.Second))
+	s.logf(LOG_LEVEL_INFO, "Client connected: %s", clientID)
 	
-	// Handle client messages
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		message := scanner.Text()
+	// The session timeout limits the wait for the next message; once its
+	// start block arrives, the rest must arrive within the read timeout
+	reader := newMLLPReader(conn, s.settings().MaxMessageSize)
+	reader.onStart = func() {
+		if readTimeout := s.settings().ReadTimeout; readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(readTimeout) * time.Second))
+		}
+	}
+	framingErrors := 0
+	for {
+		config := s.settings()
+		conn.SetDeadline(time.Now().Add(time.Duration(config.Timeout) * time.Second))
+		reader.setMaxSize(config.MaxMessageSize)
+		
+		message, err := reader.next()
+		if framing, ok := err.(*framingError); ok {
+			framingErrors++
+			metricFramingErrors.Inc(framing.reason)
+			s.logf(LOG_LEVEL_WARN, "Framing error from %s: %s", clientID, framing.detail)
+			if framing.reason == FRAMING_TOO_LARGE {
+				s.rejectPartialMessage(conn, clientID, framing)
+			}
+			if config.MaxFramingErrors > 0 && framingErrors >= config.MaxFramingErrors {
+				s.logf(LOG_LEVEL_WARN, "Closing client %s after %d framing errors", clientID, framingErrors)
+				metricSessionsClosed.Inc(SESSION_CLOSE_FRAMING_ERRORS)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if timeout, ok := err.(net.Error); ok && timeout.Timeout() {
+				if reader.inBlock {
+					s.logf(LOG_LEVEL_WARN, "Closing client %s: message not completed within %ds", clientID, config.ReadTimeout)
+					metricSessionsClosed.Inc(SESSION_CLOSE_READ_TIMEOUT)
+				} else {
+					s.logf(LOG_LEVEL_INFO, "Closing client %s: no message within %ds", clientID, config.Timeout)
+					metricSessionsClosed.Inc(SESSION_CLOSE_TIMEOUT)
+				}
+			}
+			return
+		}
 		if message == "" {
 			continue
 		}
 		
 		// Update client last seen time
-		client.LastSeen = time.Now()
-		conn.SetDeadline(time.Now().Add(time.Duration(s.config.Timeout) * time.Second))
+		s.mutex.Lock()
+		client.LastSeen = s.clock.Now()
+		s.mutex.Unlock()
 		
-		// Parse HL7 message
-		hl7Message, err := s.parser.ParseMessage(message)
-		if err != nil {
-			s.logger.Printf("Failed to parse HL7 message from %s: %v", clientID, err)
-			continue
+		if !s.receiveMessage(conn, clientID, message) {
+			return
 		}
-		
-		// Send acknowledgment
-		ack := s.createAcknowledgment(hl7Message)
-		if err := s.sendAcknowledgment(conn, ack); err != nil {
-			s.logger.Printf("Failed to send acknowledgment to %s: %v", clientID, err)
+	}
+}
+
+// rejectPartialMessage acknowledges a message that was too large with an
+// error, addressed from its MSH segment, so that the sender does not wait
+// for an acknowledgment and resend it. Nothing is sent if the start of the
+// message has no MSH segment.
+func (s *HL7Server) rejectPartialMessage(conn net.Conn, clientID string, framing *framingError) {
+	segment := framing.partial
+	if end := strings.IndexAny(segment, "\r\n"); end >= 0 {
+		segment = segment[:end]
+	}
+	message, err := s.parser.ParseMessage(segment)
+	if err != nil || message.MSH() == nil {
+		return
+	}
+	ack := s.createAcknowledgmentCode(message, HL7_ACK_ERROR, fmt.Sprintf("message exceeds %d bytes", len(framing.partial)))
+	if err := s.sendAcknowledgment(conn, ack); err != nil {
+		s.reportError("ack", clientID, err)
+	}
+}
+
+// receiveMessage parses and acknowledges one message from a client and queues
+// it for processing. It returns false if the client should be disconnected,
+// either because the server is stopping or because parsing the message panicked.
+func (s *HL7Server) receiveMessage(conn net.Conn, clientID string, message string) (keep bool) {
+	defer func() {
+		if s.recoverPanic(recover(), "parse", clientID, message) {
+			keep = false
 		}
-		
-		// Process message
-		s.messageChan <- hl7Message
-		
-		s.logger.Printf("Received HL7 message from %s: %s", clientID, hl7Message.Type)
+	}()
+	
+	receivedAt := s.clock.Now()
+	
+	// Batches and files are acknowledged as a whole
+	if IsBatch(message) {
+		return s.receiveBatch(conn, clientID, message, receivedAt)
 	}
 	
-	// Remove client from list
-	s.mutex.Lock()
-	delete(s.clients, clientID)
-	s.mutex.Unlock()
+	// Parse HL7 message
+	hl7Message, err := s.parser.ParseMessage(message)
+	if err != nil {
+		metricParseErrors.Inc()
+		s.recordParseError(clientID, err)
+		s.reportError("parse", clientID, err)
+		return true
+	}
+	hl7Message.Time = receivedAt
+	
+	// Queries are answered rather than stored
+	if msh := hl7Message.MSH(); msh != nil && msh.MessageType() == HL7_MSG_QBP {
+		s.answerQuery(conn, clientID, hl7Message)
+		return true
+	}
+	
+	// A message sent in fragments (DSC) is processed once its last fragment
+	// has arrived; every fragment is acknowledged
+	fragment := hl7Message
+	var code, text string
+	if isFragment(fragment) {
+		hl7Message, code, text = s.reassemble(clientID, fragment)
+	}
+	if hl7Message != nil {
+		var ok bool
+		if code, text, ok = s.ingest(hl7Message, clientID); !ok {
+			return false
+		}
+	}
 	
-	conn.Close()
-	s.logger.Printf("Client disconnected: %s", clientID)
+	messageType := ""
+	if msh := fragment.MSH(); msh != nil {
+		messageType = msh.MessageType()
+	}
+	
+	// Observer mode acknowledges per its policy, or not at all
+	if s.observer != nil {
+		var send bool
+		if code, text, send = s.observedAck(code, text); !send {
+			s.logf(LOG_LEVEL_INFO, "Received HL7 message from %s: %s", clientID, messageType)
+			return true
+		}
+	}
+	
+	// Send acknowledgment
+	ack := s.createAcknowledgmentCode(fragment, code, text)
+	if err := s.sendAcknowledgment(conn, ack); err != nil {
+		s.reportError("ack", clientID, err)
+	} else {
+		metricAcks.Inc(messageType, code)
+		metricAckLatency.Observe(s.clock.Since(receivedAt).Seconds())
+	}
+	
+	s.logf(LOG_LEVEL_INFO, "Received HL7 message from %s: %s", clientID, messageType)
+	return true
 }
 
-// processMessages processes received HL7 messages
-func (s *HL7Server) processMessages() {
-	for {
-		select {
-		case message := <-s.messageChan:
-			s.handleMessage(message)
-		case <-s.stopChan:
-			return
+// ingest records, archives and queues a parsed message and returns the
+// acknowledgment code for it. It returns false if the server is stopping.
+func (s *HL7Server) ingest(hl7Message *HL7Message, clientID string) (code, text string, ok bool) {
+	// A retransmitted message was already processed; the sender only needs
+	// the acknowledgment it missed. A message that is not accepted is
+	// forgotten so that its retransmission is processed.
+	if s.checkDuplicate(hl7Message, clientID) {
+		return HL7_ACK_ACCEPT, "", true
+	}
+	if s.duplicates != nil {
+		duplicate := hl7Message
+		defer func() {
+			if !ok || code != HL7_ACK_ACCEPT {
+				s.duplicates.Forget(duplicate)
+			}
+		}()
+	}
+
+	s.recordMessage(clientID, hl7Message)
+	
+	messageType := ""
+	if msh := hl7Message.MSH(); msh != nil {
+		messageType = msh.MessageType()
+	}
+	metricMessagesReceived.Inc(messageType)
+	
+	// Apply the mapping rules first so that every output gets the
+	// transformed message
+	hl7Message = s.transformMessage(hl7Message, clientID)
+	
+	// Assign the encounter, normalize units and round values before the
+	// message is stored or forwarded
+	s.assignEncounter(hl7Message)
+	if s.units != nil {
+		for _, warning := range s.units.Normalize(hl7Message) {
+			s.logf(LOG_LEVEL_WARN, "Unit not normalized in message from %s: %s", clientID, warning)
+		}
+	}
+	if s.precision != nil {
+		RoundObservationValues(hl7Message, s.precision)
+	}
+	
+	// Remote sites keep an encrypted copy until the central deployment has
+	// it; without the copy the sender must retry
+	if s.observer != nil && s.settings().Remote.Enabled {
+		controlID := ""
+		if msh := hl7Message.MSH(); msh != nil {
+			controlID = msh.ControlID()
+		}
+		s.observe(OBSERVER_OUTPUT_REMOTE, SyncLane(hl7Message), "", controlID, []byte(hl7Message.Raw))
+	} else if s.remote != nil {
+		if err := s.remote.Buffer(hl7Message, clientID); err != nil {
+			s.reportError("remote", clientID, err)
+			return HL7_ACK_REJECT, err.Error(), true
+		}
+	}
+	
+	// Archive the message before it is acknowledged; a message that is not
+	// archived is not accepted, so that the sender keeps it
+	if s.storage != nil {
+		if err := s.storage.Save(hl7Message); err != nil {
+			s.reportError("store", clientID, err)
+			return HL7_ACK_ERROR, err.Error(), true
+		}
+	}
+	
+	// Critical lab results bypass the processing queue
+	if !s.checkCritical(hl7Message) {
+		return "", "", false
+	}
+	
+	// Queue the message for processing; a full queue is handled by the overflow policy
+	code = HL7_ACK_ACCEPT
+	if err := s.enqueue(hl7Message); err != nil {
+		if err == errServerStopping {
+			return "", "", false
 		}
+		code, text = HL7_ACK_REJECT, err.Error()
+		s.logf(LOG_LEVEL_WARN, "Rejected HL7 message from %s: %v", clientID, err)
 	}
+	return code, text, true
+}
+
+// safeHandleMessage handles a message, recovering from panics so that one
+// malformed message does not stop processing for all clients
+func (s *HL7Server) safeHandleMessage(message *HL7Message) {
+	defer func() {
+		s.recoverPanic(recover(), "handle", "", message.Raw)
+	}()
+	
+	s.handleMessage(message)
 }
 
 // handleMessage handles a single HL7 message
 func (s *HL7Server) handleMessage(message *HL7Message) {
 	// Log message details
-	s.logger.Printf("Processing HL7 message: Type=%s, ID=%s", message.Type, message.ID)
+	s.logf(LOG_LEVEL_DEBUG, "Processing HL7 message: Type=%s, ID=%s", message.Type, message.ID)
 	
 	// Convert to JSON
 	jsonStr, err := message.ToJSON()
 	if err != nil {
-		s.logger.Printf("Failed to convert message to JSON: %v", err)
+		s.logf(LOG_LEVEL_ERROR, "Failed to convert message to JSON: %v", err)
 		return
 	}
 	
+	// De-identified outputs get a copy without patient identifiers and are
+	// skipped if it cannot be made
+	logged, published := message, message
+	if s.deidentifies(DEIDENTIFY_LOG) || (s.publisher != nil && s.deidentifies(DEIDENTIFY_PUBLISH)) {
+		deidentified, err := s.deidentifier.Apply(message)
+		if err != nil {
+			s.reportError("deidentify", "", err)
+		}
+		if s.deidentifies(DEIDENTIFY_LOG) {
+			logged = deidentified
+		}
+		if s.deidentifies(DEIDENTIFY_PUBLISH) {
+			published = deidentified
+		}
+	}
+	
 	// Log JSON output
-	s.logger.Printf("HL7 Message JSON:\n%s", jsonStr)
+	if logged == message {
+		s.logf(LOG_LEVEL_DEBUG, "HL7 Message JSON:\n%s", jsonStr)
+	} else if logged != nil {
+		if loggedJSON, err := logged.ToJSON(); err == nil {
+			s.logf(LOG_LEVEL_DEBUG, "HL7 Message JSON (de-identified):\n%s", loggedJSON)
+		}
+	}
+	
+	// Publish to the event bus
+	if s.publisher != nil && published != nil {
+		publishedJSON := jsonStr
+		if published != message {
+			publishedJSON, err = published.ToJSON()
+		}
+		if err == nil {
+			err = s.publishMessage(published, publishedJSON)
+		}
+		if err != nil {
+			s.reportError("publish", "", err)
+		}
+	}
+	
+	// Forward to downstream systems
+	if s.router != nil {
+		s.routeMessage(message)
+	}
 	
-	// Handle different message types
-	switch message.Type {
+	// Handle different message types (MSH-9.1)
+	messageType := ""
+	if msh := message.MSH(); msh != nil {
+		messageType = msh.MessageType()
+	}
+	switch messageType {
 	case HL7_MSG_ADT:
 		s.handleADTMessage(message)
 	case HL7_MSG_ORU:
 		s.handleORUMessage(message)
 	case HL7_MSG_ORM:
 		s.handleORMMessage(message)
+	case HL7_MSG_RAS, HL7_MSG_RGV:
+		s.handleMedicationMessage(message)
 	default:
-		s.logger.Printf("Unknown message type: %s", message.Type)
+		s.logf(LOG_LEVEL_WARN, "Unknown message type: %s", messageType)
 	}
 }
 
+// publishMessage publishes a message keyed by patient ID so that messages of
+// one patient stay ordered on partitioned buses
+func (s *HL7Server) publishMessage(message *HL7Message, jsonStr string) error {
+	values := make(map[string]string)
+	if msh := message.MSH(); msh != nil {
+		values["type"] = msh.MessageType()
+		values["event"] = msh.TriggerEvent()
+		values["sending_app"] = msh.SendingApplication()
+		values["facility"] = msh.SendingFacility()
+	}
+	
+	topic := publish.Topic(s.topicTemplate, values)
+	return s.publisher.Publish(topic, message.GetPatientID(), []byte(jsonStr))
+}
+
 // handleADTMessage handles ADT (Admission, Discharge, Transfer) messages
 func (s *HL7Server) handleADTMessage(message *HL7Message) {
 	patientID := message.GetPatientID()
@@ -235,25 +892,41 @@ func (s *HL7Server) handleADTMessage(message *HL7Message) {
 	patientDOB := message.GetPatientDOB()
 	patientSex := message.GetPatientSex()
 	
-	s.logger.Printf("ADT Message - Patient: ID=%s, Name=%s, DOB=%s, Sex=%s", 
+	s.logf(LOG_LEVEL_DEBUG, "ADT Message - Patient: ID=%s, Name=%s, DOB=%s, Sex=%s", 
 		patientID, patientName, patientDOB, patientSex)
 	
+	// Track the patient in every bed
+	if s.registry != nil {
+		changed, err := s.registry.Apply(message)
+		if err != nil {
+			s.reportError("registry", "", err)
+		}
+		if changed {
+			metricRegistryPatients.Set(float64(s.registry.Count()))
+		}
+	}
+	
+	// Move the data of merged patients to the surviving patient
+	if msh := message.MSH(); msh != nil && msh.TriggerEvent() == ADT_MERGE {
+		s.mergePatients(message)
+	}
+	
 	// Extract additional information
 	admissionDate := message.GetAdmissionDate()
 	dischargeDate := message.GetDischargeDate()
 	
 	if admissionDate != "" {
-		s.logger.Printf("Admission Date: %s", admissionDate)
+		s.logf(LOG_LEVEL_DEBUG, "Admission Date: %s", admissionDate)
 	}
 	if dischargeDate != "" {
-		s.logger.Printf("Discharge Date: %s", dischargeDate)
+		s.logf(LOG_LEVEL_DEBUG, "Discharge Date: %s", dischargeDate)
 	}
 	
 	// Get diagnoses
 	diagnoses := message.GetDiagnoses()
 	for i, diagnosis := range diagnoses {
 		if len(diagnosis.Fields) > 2 {
-			s.logger.Printf("Diagnosis %d: %s", i+1, diagnosis.Fields[2].Value)
+			s.logf(LOG_LEVEL_DEBUG, "Diagnosis %d: %s", i+1, diagnosis.Fields[2].Value)
 		}
 	}
 	
@@ -261,7 +934,7 @@ func (s *HL7Server) handleADTMessage(message *HL7Message) {
 	allergies := message.GetAllergies()
 	for i, allergy := range allergies {
 		if len(allergy.Fields) > 2 {
-			s.logger.Printf("Allergy %d: %s", i+1, allergy.Fields[2].Value)
+			s.logf(LOG_LEVEL_DEBUG, "Allergy %d: %s", i+1, allergy.Fields[2].Value)
 		}
 	}
 }
@@ -271,20 +944,114 @@ func (s *HL7Server) handleORUMessage(message *HL7Message) {
 	patientID := message.GetPatientID()
 	patientName := message.GetPatientName()
 	
-	s.logger.Printf("ORU Message - Patient: ID=%s, Name=%s", patientID, patientName)
+	s.logf(LOG_LEVEL_DEBUG, "ORU Message - Patient: ID=%s, Name=%s", patientID, patientName)
 	
 	// Get observation results
-	observations := message.GetObservationResults()
-	for i, observation := range observations {
-		if len(observation.Fields) >= 5 {
-			value := observation.Fields[4].Value
-			units := ""
-			if len(observation.Fields) >= 6 {
-				units = observation.Fields[5].Value
+	observations := ExtractObservations(message)
+	
+	// Identify the patient of bedside devices that send the bed only
+	if observations.PatientID == "" && observations.Location != "" && s.registry != nil {
+		if patient := s.registry.ByLocation(observations.Location); patient != nil {
+			observations.PatientID = patient.PatientID
+		}
+	}
+	for i, observation := range observations.Observations {
+		s.logf(LOG_LEVEL_DEBUG, "Observation %d: %s=%s %s", i+1, observation.ReferenceID, observation.Value, observation.Unit)
+	}
+	
+	// Cross-check NIBP with the arterial line
+	if s.bpChecker != nil {
+		if alert := s.bpChecker.Check(observations); alert != nil {
+			s.raiseAlert(alert)
+		}
+	}
+	
+	if s.timeline != nil {
+		s.timeline.AddObservations(observations)
+	}
+	
+	// Infusion pump channels
+	infusions := ExtractInfusions(observations)
+	for _, infusion := range infusions {
+		s.logf(LOG_LEVEL_DEBUG, "Infusion %s/%s: %s %s", infusion.EquipmentID, infusion.Channel, infusion.DrugName, infusion.Status)
+		s.infusions.Update(infusion)
+		if s.publisher != nil {
+			payload, err := json.Marshal(infusion)
+			if err == nil {
+				err = s.publisher.Publish(HL7_INFUSION_TOPIC, infusion.PatientID, payload)
+			}
+			if err != nil {
+				s.reportError("publish", "", err)
 			}
-			s.logger.Printf("Observation %d: %s %s", i+1, value, units)
 		}
 	}
+	
+	s.streamObservations(observations, infusions)
+	
+	s.exportFHIR(message, observations)
+}
+
+// streamObservations sends the observations and infusion states of a message
+// to the stream hub clients subscribed to its bed
+func (s *HL7Server) streamObservations(observations *ObservationSet, infusions []*InfusionChannel) {
+	if s.hub == nil {
+		return
+	}
+	bed := observations.Location
+	if bed == "" {
+		bed = observations.PatientID
+	}
+	if bed == "" {
+		return
+	}
+	
+	// Messages of pumps only are streamed as infusion states
+	for i := range observations.Observations {
+		if !IsInfusionObservation(&observations.Observations[i]) {
+			if err := s.hub.Publish(stream.EVENT_VITALS, bed, stream.CHANNEL_VITALS, observations); err != nil {
+				s.logf(LOG_LEVEL_DEBUG, "Failed to stream observations: %v", err)
+			}
+			break
+		}
+	}
+	for _, infusion := range infusions {
+		if err := s.hub.Publish(stream.EVENT_INFUSION, bed, stream.CHANNEL_INFUSION, infusion); err != nil {
+			s.logf(LOG_LEVEL_DEBUG, "Failed to stream infusion: %v", err)
+		}
+	}
+}
+
+// handleMedicationMessage adds the administrations of RAS and RGV messages to the timeline
+func (s *HL7Server) handleMedicationMessage(message *HL7Message) {
+	events := ExtractMedicationEvents(message)
+	for _, event := range events {
+		s.logf(LOG_LEVEL_DEBUG, "Medication %s: %s (%s) at %s", event.ID, event.Name, event.Code, event.Time.Format(time.RFC3339))
+		if s.timeline == nil {
+			continue
+		}
+		if err := s.timeline.AddMedication(event); err != nil {
+			s.logf(LOG_LEVEL_WARN, "Medication %s not added to timeline: %v", event.ID, err)
+		}
+	}
+}
+
+// raiseAlert logs a derived alert, publishes it and passes it to the alert handler
+func (s *HL7Server) raiseAlert(alert *BPAlert) {
+	s.logf(LOG_LEVEL_WARN, "Alert %s for patient %s: %s", alert.Type, s.loggedPatientID(alert.PatientID), alert.Message)
+	
+	if s.publisher != nil {
+		payload, err := json.Marshal(alert)
+		if err == nil {
+			err = s.publisher.Publish(HL7_ALERT_TOPIC, alert.PatientID, payload)
+		}
+		if err != nil {
+			s.reportError("publish", "", err)
+		}
+	}
+	
+	if s.onAlert != nil {
+		s.onAlert(alert)
+	}
 }
 
 // handleORMMessage handles ORM (Order Message) messages
@@ -292,35 +1059,66 @@ func (s *HL7Server) handleORMMessage(message *HL7Message) {
 	patientID := message.GetPatientID()
 	patientName := message.GetPatientName()
 	
-	s.logger.Printf("ORM Message - Patient: ID=%s, Name=%s", patientID, patientName)
+	s.logf(LOG_LEVEL_DEBUG, "ORM Message - Patient: ID=%s, Name=%s", patientID, patientName)
 	
 	// Get order information from ORC segments
 	orders := message.GetSegmentsByType(HL7_SEG_ORC)
 	for i, order := range orders {
 		if len(order.Fields) >= 2 {
 			orderID := order.Fields[1].Value
-			s.logger.Printf("Order %d: %s", i+1, orderID)
+			s.logf(LOG_LEVEL_DEBUG, "Order %d: %s", i+1, orderID)
 		}
 	}
 }
 
 // createAcknowledgment creates an HL7 acknowledgment message
 func (s *HL7Server) createAcknowledgment(message *HL7Message) string {
+	return s.createAcknowledgmentCode(message, HL7_ACK_ACCEPT, "")
+}
+
+// createAcknowledgmentCode creates an acknowledgment with the given code
+// (MSA-1) and error text (MSA-3), empty for accepted messages
+func (s *HL7Server) createAcknowledgmentCode(message *HL7Message, code, text string) string {
+	// Address the acknowledgment back to the sender (MSH-3/MSH-4)
+	sendingApplication, sendingFacility := "", ""
+	if msh := message.MSH(); msh != nil {
+		sendingApplication = msh.SendingApplication()
+		sendingFacility = msh.SendingFacility()
+	}
+	
 	// Create MSH segment for acknowledgment
 	msh := fmt.Sprintf("MSH|^~\\&|HL7SERVER|HOSPITAL|%s|%s|%s||ACK^A01|%s|P|2.5",
-		message.GetFieldValue(HL7_SEG_MSH, 2), // Sending application
-		message.GetFieldValue(HL7_SEG_MSH, 3), // Sending facility
-		time.Now().Format("20060102150405"),    // Message date/time
-		message.ID)                             // Message control ID
+		sendingApplication,                  // Receiving application
+		sendingFacility,                     // Receiving facility
+		s.clock.Now().Format("20060102150405"), // Message date/time
+		message.ID)                          // Message control ID
+	
+	// Answer in the character set of the message (MSH-18)
+	if message.Charset != "" {
+		msh += "||||||" + message.Charset
+	}
 	
 	// Create MSA segment
-	msa := fmt.Sprintf("MSA|AA|%s", message.ID) // AA = Application Accept
+	msa := fmt.Sprintf("MSA|%s|%s", code, message.ID)
+	if text != "" {
+		msa += "|" + text
+	}
 	
 	// Create ERR segment (empty for successful acknowledgment)
 	err := "ERR|"
+	if code != HL7_ACK_ACCEPT {
+		// ERR-3 207 = application internal error, ERR-4 E = error
+		err = fmt.Sprintf("ERR|||207^Application internal error^HL70357|E||||%s", text)
+	}
 	
 	// Combine segments
 	ack := fmt.Sprintf("%s\r%s\r%s\r", msh, msa, err)
+	if message.Charset != "" {
+		if encoded, encodeErr := EncodeMessage(ack); encodeErr == nil {
+			return encoded
+		}
+		return setMSHCharset(ack, CHARSET_UTF8)
+	}
 	
 	return ack
 }
@@ -328,32 +1126,61 @@ func (s *HL7Server) createAcknowledgment(message *HL7Message) string {
 // sendAcknowledgment sends an acknowledgment to the client
 func (s *HL7Server) sendAcknowledgment(conn net.Conn, ack string) error {
 	// Add MLLP wrapper
-	mllpAck := fmt.Sprintf("%c%s%c%c", 0x0B, ack, 0x1C, 0x0D)
+	mllpAck := fmt.Sprintf("%c%s%c%c", MLLP_START_BLOCK, ack, MLLP_END_BLOCK, MLLP_CR)
 	
 	_, err := conn.Write([]byte(mllpAck))
 	return err
 }
 
-// isClientAllowed checks if the client IP is allowed
-func (s *HL7Server) isClientAllowed(clientIP string) bool {
-	if len(s.config.AllowedIPs) == 0 {
-		return true // Allow all if no restrictions
-	}
-	
-	// Extract IP address from client address
-	ip := strings.Split(clientIP, ":")[0]
+// reapIdleClients closes clients that have not sent a message for longer
+// than the idle timeout, until the server stops
+func (s *HL7Server) reapIdleClients() {
+	ticker := s.clock.NewTicker(HL7_IDLE_CHECK_INTERVAL)
+	defer ticker.Stop()
 	
-	for _, allowedIP := range s.config.AllowedIPs {
-		if ip == allowedIP {
-			return true
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.stopChan:
+			return
+		}
+		
+		idleTimeout := time.Duration(s.settings().IdleTimeout) * time.Second
+		if idleTimeout <= 0 {
+			continue
+		}
+		
+		now := s.clock.Now()
+		idle := make([]*Client, 0)
+		s.mutex.RLock()
+		for _, client := range s.clients {
+			if now.Sub(client.LastSeen) > idleTimeout {
+				idle = append(idle, client)
+			}
+		}
+		s.mutex.RUnlock()
+		
+		// handleClient removes the client once its connection is closed
+		for _, client := range idle {
+			s.logf(LOG_LEVEL_INFO, "Closing idle client %s (no message for %s)", client.ID, idleTimeout)
+			metricSessionsClosed.Inc(SESSION_CLOSE_IDLE)
+			client.Conn.Close()
 		}
 	}
+}
+
+// isClientAllowed checks the client address against the allowed and denied
+// IPs and returns the reason for the decision
+func (s *HL7Server) isClientAllowed(clientAddress string) (bool, string) {
+	s.mutex.RLock()
+	access := s.access
+	s.mutex.RUnlock()
 	
-	return false
+	return access.check(clientAddress)
 }
 
-// GetConnectedClients returns the list of connected clients
-func (s *HL7Server) GetConnectedClients() []*Client {
+// Clients returns the list of connected clients
+func (s *HL7Server) Clients() []*Client {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	
@@ -365,8 +1192,8 @@ func (s *HL7Server) GetConnectedClients() []*Client {
 	return clients
 }
 
-// GetClientCount returns the number of connected clients
-func (s *HL7Server) GetClientCount() int {
+// ClientCount returns the number of connected clients
+func (s *HL7Server) ClientCount() int {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	
@@ -376,28 +1203,41 @@ func (s *HL7Server) GetClientCount() int {
 // DisconnectClient disconnects a specific client
 func (s *HL7Server) DisconnectClient(clientID string) error {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	
 	client, exists := s.clients[clientID]
 	if !exists {
+		s.mutex.Unlock()
 		return fmt.Errorf("client %s not found", clientID)
 	}
 	
 	client.Conn.Close()
 	delete(s.clients, clientID)
+	s.mutex.Unlock()
 	
-	s.logger.Printf("Client %s disconnected by server", clientID)
+	s.logf(LOG_LEVEL_INFO, "Client %s disconnected by server", clientID)
 	return nil
 }
 
-// GetServerStatus returns the server status information
-func (s *HL7Server) GetServerStatus() map[string]interface{} {
+// Status returns the server status information
+func (s *HL7Server) Status() map[string]interface{} {
+	config := s.settings()
+	s.mutex.Lock()
+	running := s.listener != nil
+	s.mutex.Unlock()
 	return map[string]interface{}{
-		"host":           s.config.Host,
-		"port":           s.config.Port,
-		"timeout":        s.config.Timeout,
-		"max_connections": s.config.MaxConnections,
-		"connected_clients": s.GetClientCount(),
-		"is_running":     s.listener != nil,
+		"host":           config.Host,
+		"port":           config.Port,
+		"timeout":        config.Timeout,
+		"max_connections": config.MaxConnections,
+		"idle_timeout":   config.IdleTimeout,
+		"read_timeout":   config.ReadTimeout,
+		"max_message_size": config.MaxMessageSize,
+		"max_framing_errors": config.MaxFramingErrors,
+		"log_level":      config.LogLevel,
+		"connected_clients": s.ClientCount(),
+		"is_running":     running,
+		"crash_reports":  len(s.CrashReports()),
+		"queued_messages": s.queuedMessages(),
+		"observer":       s.observer != nil,
+		"memory":         s.memoryStatus(),
 	}
 }
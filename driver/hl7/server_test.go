@@ -0,0 +1,61 @@
+package hl7
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+// failingStorage is a Storage whose Save always fails
+type failingStorage struct{}
+
+func (failingStorage) Save(message *HL7Message) error {
+	return errors.New("disk full")
+}
+
+func (failingStorage) Query(filter MessageFilter) ([]*StoredMessage, error) {
+	return nil, nil
+}
+
+func (failingStorage) Close() error {
+	return nil
+}
+
+func TestReceiveMessageStorageFailure(t *testing.T) {
+	server := NewHL7Server(&ServerConfig{Host: "127.0.0.1"})
+	server.SetLogger(log.New(io.Discard, "", 0))
+	server.SetStorage(failingStorage{})
+
+	conn, client := net.Pipe()
+	defer conn.Close()
+	defer client.Close()
+	acks := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, 4096)
+		n, _ := client.Read(buffer)
+		acks <- string(buffer[:n])
+	}()
+
+	if !server.receiveMessage(conn, "test", NewSampleHL7Messages().GetORUMessage()) {
+		t.Fatal("receiveMessage closed the connection")
+	}
+	ack, err := NewHL7Parser().ParseMessage(strings.Trim(<-acks, "\x0b\x1c\r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msa := ack.GetSegmentByType("MSA")
+	if msa == nil || msa.FieldValue(1) != HL7_ACK_ERROR {
+		t.Fatalf("MSA-1 is not AE: %q", ack.Raw)
+	}
+	if !strings.Contains(ack.Raw, "disk full") {
+		t.Errorf("acknowledgment does not carry the storage error: %q", ack.Raw)
+	}
+	for i, queue := range server.queues {
+		if len(queue) != 0 {
+			t.Errorf("queue %d holds %d messages that were not archived", i, len(queue))
+		}
+	}
+}
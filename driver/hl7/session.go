@@ -0,0 +1,135 @@
+package hl7
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// MLLP_DEFAULT_MAX_MESSAGE_SIZE is the default limit of one message in bytes
+const MLLP_DEFAULT_MAX_MESSAGE_SIZE = 1 << 20
+
+// MLLP framing errors, the reason label of hl7_framing_errors_total
+const (
+	FRAMING_OUTSIDE_BLOCK = "outside_block" // Data other than CR/LF between messages
+	FRAMING_UNTERMINATED  = "unterminated"  // Start block before the end block of the previous message
+	FRAMING_TOO_LARGE     = "too_large"     // Message longer than max_message_size
+)
+
+// Reasons the server closed a session, the reason label of
+// hl7_sessions_closed_total
+const (
+	SESSION_CLOSE_TIMEOUT        = "timeout"        // No message within timeout
+	SESSION_CLOSE_READ_TIMEOUT   = "read_timeout"   // Message not completed within read_timeout
+	SESSION_CLOSE_IDLE           = "idle"           // No message within idle_timeout
+	SESSION_CLOSE_FRAMING_ERRORS = "framing_errors" // max_framing_errors reached
+)
+
+// framingError is a violation of the MLLP framing. The session can go on
+// reading the next message after it.
+type framingError struct {
+	reason  string // FRAMING_*
+	detail  string
+	partial string // Start of a message that was too large, for the acknowledgment
+}
+
+func (e *framingError) Error() string {
+	return fmt.Sprintf("MLLP framing error (%s): %s", e.reason, e.detail)
+}
+
+// mllpReader reads the messages of an MLLP session: the bytes between a
+// start block (0x0B) and an end block (0x1C). The CR after the end block
+// and line breaks between messages are skipped.
+type mllpReader struct {
+	reader  *bufio.Reader
+	maxSize int
+	inBlock bool   // A start block was read and its end block was not
+	onStart func() // Called when a start block is read, e.g. to set the read timeout
+}
+
+// newMLLPReader creates a reader of messages of at most maxSize bytes
+// (0: MLLP_DEFAULT_MAX_MESSAGE_SIZE)
+func newMLLPReader(r io.Reader, maxSize int) *mllpReader {
+	reader := &mllpReader{reader: bufio.NewReader(r)}
+	reader.setMaxSize(maxSize)
+	return reader
+}
+
+// setMaxSize changes the limit of the next messages (0:
+// MLLP_DEFAULT_MAX_MESSAGE_SIZE), e.g. after a configuration reload
+func (r *mllpReader) setMaxSize(maxSize int) {
+	r.maxSize = maxMessageSize(maxSize)
+}
+
+// maxMessageSize returns the effective limit of a configured
+// max_message_size
+func maxMessageSize(configured int) int {
+	if configured <= 0 {
+		return MLLP_DEFAULT_MAX_MESSAGE_SIZE
+	}
+	return configured
+}
+
+// next returns the next message. A framing error is returned as a
+// *framingError, after which next can be called again: data outside a
+// block is skipped, a message interrupted by a new start block is dropped
+// and reading continues with the new message, and a message longer than
+// the limit is dropped up to its end block. Other errors are those of the
+// connection.
+func (r *mllpReader) next() (string, error) {
+	if !r.inBlock {
+		outside := 0
+		for !r.inBlock {
+			b, err := r.reader.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			switch b {
+			case MLLP_START_BLOCK:
+				r.start()
+			case MLLP_CR, '\n':
+			default:
+				outside++
+			}
+		}
+		if outside > 0 {
+			return "", &framingError{reason: FRAMING_OUTSIDE_BLOCK,
+				detail: fmt.Sprintf("%d bytes outside a start and end block", outside)}
+		}
+	}
+
+	var message []byte
+	size := 0
+	for {
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case MLLP_END_BLOCK:
+			r.inBlock = false
+			if size > r.maxSize {
+				return "", &framingError{reason: FRAMING_TOO_LARGE,
+					detail:  fmt.Sprintf("message of %d bytes exceeds the limit of %d bytes", size, r.maxSize),
+					partial: string(message)}
+			}
+			return string(message), nil
+		case MLLP_START_BLOCK:
+			r.start()
+			return "", &framingError{reason: FRAMING_UNTERMINATED,
+				detail: fmt.Sprintf("start block after %d bytes without an end block", size)}
+		}
+		if size < r.maxSize {
+			message = append(message, b)
+		}
+		size++
+	}
+}
+
+// start records a start block
+func (r *mllpReader) start() {
+	r.inBlock = true
+	if r.onStart != nil {
+		r.onStart()
+	}
+}
@@ -0,0 +1,346 @@
+package hl7
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SS-MIX2 storage layout
+const (
+	SSMIX2_NONE         = "-"             // Clinical date of data types not tied to a date, and missing order numbers and departments
+	SSMIX2_VALID        = "1"             // Condition flag of a valid message
+	SSMIX2_CANCELLED    = "0"             // Condition flag of a cancelled message
+	SSMIX2_ISO_2022     = "ISO 2022-1994" // MSH-20 of messages stored in ISO IR87
+	SSMIX2_TIMESTAMP    = 17              // Digits of the message time in a file name (YYYYMMDDHHMMSSfff)
+	SSMIX2_HASH_LENGTH  = 3               // Characters of the patient ID per hash directory
+	SSMIX2_ORDER_CANCEL = "CA"            // ORC-1 of an order cancellation
+	SSMIX2_OC_CANCEL    = "OC"            // ORC-1 of an order cancelled by the filler
+)
+
+// SSMIX2Config configures the export of received messages to an SS-MIX2
+// standardized storage
+type SSMIX2Config struct {
+	Enabled      bool   `json:"enabled"`
+	Root         string `json:"root"`          // Root directory of the standardized storage
+	ExtendedRoot string `json:"extended_root"` // Root directory of the extended storage for other message types (empty: not stored)
+	Charset      string `json:"charset"`       // Character set of the stored messages (empty: ISO IR87, as the standard requires)
+}
+
+// ssmix2DataType is the SS-MIX2 data type of a message type and trigger event
+type ssmix2DataType struct {
+	code   string
+	cancel bool // The event cancels an earlier message of the data type
+	dated  bool // Stored under the clinical date, otherwise under "-"
+}
+
+// ssmix2DataTypes maps MSH-9 (type^event) to the data types of the
+// standardized storage
+var ssmix2DataTypes = map[string]ssmix2DataType{
+	"ADT^A08": {code: "ADT-00"},
+	"ADT^A54": {code: "ADT-01", dated: true},
+	"ADT^A55": {code: "ADT-01", dated: true, cancel: true},
+	"ADT^A04": {code: "ADT-12", dated: true},
+	"ADT^A14": {code: "ADT-21", dated: true},
+	"ADT^A27": {code: "ADT-21", dated: true, cancel: true},
+	"ADT^A01": {code: "ADT-22", dated: true},
+	"ADT^A11": {code: "ADT-22", dated: true, cancel: true},
+	"ADT^A21": {code: "ADT-31", dated: true},
+	"ADT^A52": {code: "ADT-31", dated: true, cancel: true},
+	"ADT^A22": {code: "ADT-32", dated: true},
+	"ADT^A53": {code: "ADT-32", dated: true, cancel: true},
+	"ADT^A02": {code: "ADT-41", dated: true},
+	"ADT^A12": {code: "ADT-41", dated: true, cancel: true},
+	"ADT^A16": {code: "ADT-51", dated: true},
+	"ADT^A25": {code: "ADT-51", dated: true, cancel: true},
+	"ADT^A03": {code: "ADT-52", dated: true},
+	"ADT^A13": {code: "ADT-52", dated: true, cancel: true},
+	"ADT^A60": {code: "ADT-61"},
+	"PPR^ZD1": {code: "PPR-01", dated: true},
+	"OMD^O03": {code: "OMD", dated: true},
+	"RDE^O11": {code: "OMP-01", dated: true},
+	"RDS^O13": {code: "OMP-11", dated: true},
+	"RAS^O17": {code: "OMP-12", dated: true},
+	"OML^O33": {code: "OML-01", dated: true},
+	"OUL^R22": {code: "OML-11", dated: true},
+	"OMI^O23": {code: "OMG-01", dated: true},
+}
+
+// SSMIX2Exporter writes received messages to an SS-MIX2 standardized
+// storage: root/<ID 1-3>/<ID 4-6>/<patient ID>/<clinical date>/<data type>/,
+// one file per message named
+// <patient ID>_<date>_<data type>_<order number>_<message time>_<department>_<condition flag>.
+// Message types without an SS-MIX2 data type go to the extended storage,
+// with the message type (e.g. ORU-R01) as data type. It is safe for
+// concurrent use.
+type SSMIX2Exporter struct {
+	config  SSMIX2Config
+	charset string
+	mutex   sync.Mutex
+}
+
+// NewSSMIX2Exporter creates an exporter and its root directories
+func NewSSMIX2Exporter(config SSMIX2Config) (*SSMIX2Exporter, error) {
+	if config.Root == "" {
+		return nil, fmt.Errorf("SS-MIX2 root directory is not configured")
+	}
+	charset := CHARSET_ISO_IR87
+	if config.Charset != "" {
+		charset = charsetOf(config.Charset, "~")
+		if charset == "" {
+			return nil, fmt.Errorf("unsupported SS-MIX2 character set %q", config.Charset)
+		}
+	}
+	for _, root := range []string{config.Root, config.ExtendedRoot} {
+		if root == "" {
+			continue
+		}
+		if err := os.MkdirAll(root, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create SS-MIX2 storage %s: %v", root, err)
+		}
+	}
+	return &SSMIX2Exporter{config: config, charset: charset}, nil
+}
+
+// Export stores a message in the standardized or extended storage. Messages
+// without a patient ID, and other message types when no extended storage is
+// configured, are not stored. A cancellation is stored with condition flag 0;
+// an order cancellation also sets the flag of the stored messages of the
+// order to 0.
+func (e *SSMIX2Exporter) Export(message *HL7Message) error {
+	msh := message.MSH()
+	patientID := message.GetPatientID()
+	if msh == nil || patientID == "" {
+		return nil
+	}
+
+	root := e.config.Root
+	dataType, standard := ssmix2DataTypes[msh.MessageType()+"^"+msh.TriggerEvent()]
+	if !standard {
+		if e.config.ExtendedRoot == "" {
+			return nil
+		}
+		root = e.config.ExtendedRoot
+		dataType = ssmix2DataType{code: msh.MessageType() + "-" + msh.TriggerEvent(), dated: true}
+	}
+	dataType.code = safeFileName(dataType.code)
+
+	orderNumber := ssmix2OrderNumber(message)
+	flag := SSMIX2_VALID
+	if dataType.cancel || ssmix2OrderCancelled(message) {
+		flag = SSMIX2_CANCELLED
+	}
+	date := SSMIX2_NONE
+	if dataType.dated {
+		date = ssmix2ClinicalDate(message)
+	}
+
+	id := safeFileName(patientID)
+	patientDir := filepath.Join(root, ssmix2HashDirs(id), id)
+	dir := filepath.Join(patientDir, date, dataType.code)
+	name := strings.Join([]string{
+		id,
+		date,
+		dataType.code,
+		orderNumber,
+		ssmix2Timestamp(msh.DateTime()),
+		ssmix2Department(message),
+		flag,
+	}, "_")
+
+	data, err := e.encode(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode message %s for SS-MIX2: %v", msh.ControlID(), err)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create SS-MIX2 directory: %v", err)
+	}
+	if err := writeFileSync(filepath.Join(dir, name), []byte(data)); err != nil {
+		return fmt.Errorf("failed to store message in SS-MIX2 storage: %v", err)
+	}
+	if flag == SSMIX2_CANCELLED && orderNumber != SSMIX2_NONE {
+		return e.cancelOrder(patientDir, id, dataType.code, orderNumber)
+	}
+	return nil
+}
+
+// cancelOrder sets the condition flag of the stored messages of an order to 0
+func (e *SSMIX2Exporter) cancelOrder(patientDir, id, dataType, orderNumber string) error {
+	pattern := filepath.Join(patientDir, "*", dataType, id+"_*_"+dataType+"_"+orderNumber+"_*_"+SSMIX2_VALID)
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		cancelled := strings.TrimSuffix(path, SSMIX2_VALID) + SSMIX2_CANCELLED
+		if err := os.Rename(path, cancelled); err != nil {
+			return fmt.Errorf("failed to cancel SS-MIX2 message %s: %v", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// encode returns the message in the character set of the storage, with
+// MSH-18 (and MSH-20 for ISO IR87) declaring it
+func (e *SSMIX2Exporter) encode(message *HL7Message) (string, error) {
+	encoded := message.Encode()
+	config := message.EncodingConfig()
+	switch e.charset {
+	case CHARSET_ISO_IR87:
+		encoded = setMSHField(encoded, 18, config.RepetitionSeparator+CHARSET_ISO_IR87)
+		encoded = setMSHField(encoded, 20, SSMIX2_ISO_2022)
+	default:
+		encoded = setMSHCharset(encoded, e.charset)
+	}
+	return EncodeMessage(encoded)
+}
+
+// ssmix2HashDirs returns the two hash directories of a patient ID: its
+// first three and next three characters, padded with zeros
+func ssmix2HashDirs(id string) string {
+	if len(id) < 2*SSMIX2_HASH_LENGTH {
+		id += strings.Repeat("0", 2*SSMIX2_HASH_LENGTH-len(id))
+	}
+	return filepath.Join(id[:SSMIX2_HASH_LENGTH], id[SSMIX2_HASH_LENGTH:2*SSMIX2_HASH_LENGTH])
+}
+
+// ssmix2ClinicalDate returns the date (YYYYMMDD) a message belongs to: the
+// event time of ADT messages (EVN-6, EVN-2), the observation, administration
+// or order time of others (OBR-7, RXA-3, ORC-9), or else the message time
+func ssmix2ClinicalDate(message *HL7Message) string {
+	candidates := []struct {
+		segment  string
+		position int
+	}{
+		{HL7_SEG_EVN, 6},
+		{HL7_SEG_EVN, 2},
+		{HL7_SEG_OBR, 7},
+		{HL7_SEG_RXA, 3},
+		{HL7_SEG_ORC, 9},
+		{HL7_SEG_MSH, 7},
+	}
+	for _, candidate := range candidates {
+		segment := message.GetSegmentByType(candidate.segment)
+		if segment == nil {
+			continue
+		}
+		value := segment.Component(candidate.position, 1)
+		if len(value) >= 8 && isDigits(value[:8]) {
+			return value[:8]
+		}
+	}
+	return SSMIX2_NONE
+}
+
+// ssmix2Timestamp returns an HL7 timestamp as the 17 digits of an SS-MIX2
+// file name, without time zone and padded with zeros
+func ssmix2Timestamp(value string) string {
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value = value[:i]
+	}
+	value = strings.Replace(value, ".", "", 1)
+	if value == "" || !isDigits(value) {
+		return strings.Repeat("0", SSMIX2_TIMESTAMP)
+	}
+	if len(value) < SSMIX2_TIMESTAMP {
+		value += strings.Repeat("0", SSMIX2_TIMESTAMP-len(value))
+	}
+	return value[:SSMIX2_TIMESTAMP]
+}
+
+// ssmix2OrderNumber returns the placer order number (ORC-2, OBR-2), "-" if
+// the message has none
+func ssmix2OrderNumber(message *HL7Message) string {
+	for _, segmentType := range []string{HL7_SEG_ORC, HL7_SEG_OBR} {
+		if segment := message.GetSegmentByType(segmentType); segment != nil {
+			if number := segment.Component(2, 1); number != "" {
+				return safeFileName(number)
+			}
+		}
+	}
+	return SSMIX2_NONE
+}
+
+// ssmix2OrderCancelled reports whether the order control (ORC-1) cancels
+// the order
+func ssmix2OrderCancelled(message *HL7Message) bool {
+	orc := message.GetSegmentByType(HL7_SEG_ORC)
+	if orc == nil {
+		return false
+	}
+	control := orc.FieldValue(1)
+	return control == SSMIX2_ORDER_CANCEL || control == SSMIX2_OC_CANCEL
+}
+
+// ssmix2Department returns the department code (PV1-10, ORC-17), "-" if
+// the message has none
+func ssmix2Department(message *HL7Message) string {
+	if pv1 := message.PV1(); pv1 != nil {
+		if department := pv1.Component(10, 1); department != "" {
+			return safeFileName(department)
+		}
+	}
+	if orc := message.GetSegmentByType(HL7_SEG_ORC); orc != nil {
+		if department := orc.Component(17, 1); department != "" {
+			return safeFileName(department)
+		}
+	}
+	return SSMIX2_NONE
+}
+
+// ssmix2Storage archives messages to a storage backend and exports them to
+// an SS-MIX2 storage
+type ssmix2Storage struct {
+	backend  Storage // nil when only the SS-MIX2 export is configured
+	exporter *SSMIX2Exporter
+}
+
+// Save archives the message to the backend, then exports it
+func (s *ssmix2Storage) Save(message *HL7Message) error {
+	if s.backend != nil {
+		if err := s.backend.Save(message); err != nil {
+			return err
+		}
+	}
+	return s.exporter.Export(message)
+}
+
+// Query queries the backend
+func (s *ssmix2Storage) Query(filter MessageFilter) ([]*StoredMessage, error) {
+	if s.backend == nil {
+		return nil, fmt.Errorf("SS-MIX2 storage cannot be queried, configure a storage type")
+	}
+	return s.backend.Query(filter)
+}
+
+// MergePatient re-keys the stored messages of the backend. The SS-MIX2
+// storage keeps the messages under the patient ID they were received with.
+func (s *ssmix2Storage) MergePatient(retiredID, survivingID string) (int, error) {
+	if merger, ok := s.backend.(PatientMerger); ok {
+		return merger.MergePatient(retiredID, survivingID)
+	}
+	return 0, nil
+}
+
+// Close closes the backend
+func (s *ssmix2Storage) Close() error {
+	if s.backend == nil {
+		return nil
+	}
+	return s.backend.Close()
+}
+
+// isDigits reports whether value consists of ASCII digits only
+func isDigits(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package hl7
+
+import (
+	"time"
+)
+
+// MAX_RECENT_MESSAGES is the number of message summaries kept for the admin API
+const MAX_RECENT_MESSAGES = 100
+
+// MessageSummary describes one message received by the server (no PHI)
+type MessageSummary struct {
+	Time         time.Time `json:"time"`
+	ClientID     string    `json:"client_id"`
+	MessageType  string    `json:"message_type,omitempty"`
+	TriggerEvent string    `json:"trigger_event,omitempty"`
+	ControlID    string    `json:"control_id,omitempty"`
+	Error        string    `json:"error,omitempty"` // Parse error, empty if the message was accepted
+}
+
+// MessageStats counts the messages received since the server started
+type MessageStats struct {
+	Received     int              `json:"received"`
+	Accepted     int              `json:"accepted"`
+	ParseErrors  int              `json:"parse_errors"`
+	ByType       map[string]int   `json:"by_type"` // Accepted messages by MSH-9 (e.g. "ORU^R01")
+	LastReceived time.Time        `json:"last_received,omitempty"`
+	Recent       []MessageSummary `json:"recent"` // Most recent messages, oldest first
+}
+
+// recordMessage counts an accepted message
+func (s *HL7Server) recordMessage(clientID string, message *HL7Message) {
+	summary := MessageSummary{
+		Time:     s.clock.Now(),
+		ClientID: clientID,
+	}
+	if msh := message.MSH(); msh != nil {
+		summary.MessageType = msh.MessageType()
+		summary.TriggerEvent = msh.TriggerEvent()
+		summary.ControlID = msh.ControlID()
+	}
+
+	messageType := summary.MessageType
+	if summary.TriggerEvent != "" {
+		messageType += "^" + summary.TriggerEvent
+	}
+	if messageType == "" {
+		messageType = "UNKNOWN"
+	}
+
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	s.stats.Accepted++
+	s.stats.ByType[messageType]++
+	s.addSummary(summary)
+}
+
+// recordParseError counts a message that could not be parsed
+func (s *HL7Server) recordParseError(clientID string, err error) {
+	summary := MessageSummary{
+		Time:     s.clock.Now(),
+		ClientID: clientID,
+		Error:    err.Error(),
+	}
+
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	s.stats.ParseErrors++
+	s.addSummary(summary)
+}
+
+// addSummary appends to the recent messages. Callers hold s.statsMutex.
+func (s *HL7Server) addSummary(summary MessageSummary) {
+	s.stats.Received++
+	s.stats.LastReceived = summary.Time
+	s.stats.Recent = append(s.stats.Recent, summary)
+	if len(s.stats.Recent) > MAX_RECENT_MESSAGES {
+		s.stats.Recent = s.stats.Recent[len(s.stats.Recent)-MAX_RECENT_MESSAGES:]
+	}
+}
+
+// Stats returns the message counters and the most recent messages
+func (s *HL7Server) Stats() MessageStats {
+	s.statsMutex.Lock()
+	defer s.statsMutex.Unlock()
+
+	stats := s.stats
+	stats.ByType = make(map[string]int, len(s.stats.ByType))
+	for messageType, count := range s.stats.ByType {
+		stats.ByType[messageType] = count
+	}
+	stats.Recent = make([]MessageSummary, len(s.stats.Recent))
+	copy(stats.Recent, s.stats.Recent)
+	return stats
+}
@@ -0,0 +1,136 @@
+package hl7
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage backend types
+const (
+	STORAGE_FILESYSTEM = "filesystem"
+	STORAGE_SQLITE     = "sqlite"
+)
+
+// Storage archives received HL7 messages
+type Storage interface {
+	// Save durably stores a received message
+	Save(message *HL7Message) error
+	// Query returns the stored messages matching filter, oldest first
+	Query(filter MessageFilter) ([]*StoredMessage, error)
+	// Close releases the resources held by the backend
+	Close() error
+}
+
+// StorageConfig selects and configures the storage backend
+type StorageConfig struct {
+	Type   string       `json:"type"`   // "filesystem", "sqlite" or empty to disable
+	Path   string       `json:"path"`   // Root directory (filesystem) or database file (sqlite)
+	SSMIX2 SSMIX2Config `json:"ssmix2"` // Also export messages to an SS-MIX2 standardized storage
+}
+
+// StoredMessage is a message as kept by a storage backend
+type StoredMessage struct {
+	ControlID    string    `json:"control_id"`
+	MessageType  string    `json:"message_type"`
+	TriggerEvent string    `json:"trigger_event"`
+	PatientID    string    `json:"patient_id"`
+	VisitNumber  string    `json:"visit_number"` // PV1-19, or the encounter assigned by the server
+	ReceivedAt   time.Time `json:"received_at"`
+	Raw          string    `json:"raw_message"`
+}
+
+// MessageFilter selects stored messages. Empty fields match all messages;
+// From is inclusive and To is exclusive.
+type MessageFilter struct {
+	PatientID   string    `json:"patient_id,omitempty"`
+	VisitNumber string    `json:"visit_number,omitempty"`
+	MessageType string    `json:"message_type,omitempty"`
+	From        time.Time `json:"from,omitempty"`
+	To          time.Time `json:"to,omitempty"`
+	Limit       int       `json:"limit,omitempty"`
+}
+
+// NewStorage creates the backend selected by config, exporting saved
+// messages to an SS-MIX2 storage if enabled. It returns nil and no error
+// when storage is disabled.
+func NewStorage(config StorageConfig) (Storage, error) {
+	backend, err := newStorageBackend(config)
+	if err != nil || !config.SSMIX2.Enabled {
+		return backend, err
+	}
+	exporter, err := NewSSMIX2Exporter(config.SSMIX2)
+	if err != nil {
+		if backend != nil {
+			backend.Close()
+		}
+		return nil, err
+	}
+	return &ssmix2Storage{backend: backend, exporter: exporter}, nil
+}
+
+// newStorageBackend creates the backend of a storage type
+func newStorageBackend(config StorageConfig) (Storage, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case STORAGE_FILESYSTEM:
+		return NewFileStorage(config.Path)
+	case STORAGE_SQLITE:
+		return OpenSQLiteStorage(config.Path)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", config.Type)
+	}
+}
+
+// newStoredMessage extracts the indexed fields of a message
+func newStoredMessage(message *HL7Message) *StoredMessage {
+	stored := &StoredMessage{
+		ReceivedAt: message.Time,
+		Raw:        message.Raw,
+	}
+	if stored.ReceivedAt.IsZero() {
+		stored.ReceivedAt = time.Now()
+	}
+	if msh := message.MSH(); msh != nil {
+		stored.ControlID = msh.ControlID()
+		stored.MessageType = msh.MessageType()
+		stored.TriggerEvent = msh.TriggerEvent()
+	}
+	stored.PatientID = message.GetPatientID()
+	stored.VisitNumber = message.VisitNumber
+	if pv1 := message.PV1(); pv1 != nil && pv1.VisitNumber() != "" {
+		stored.VisitNumber = pv1.VisitNumber()
+	}
+	return stored
+}
+
+// Matches returns true if the stored message satisfies filter
+func (f MessageFilter) Matches(message *StoredMessage) bool {
+	if f.PatientID != "" && message.PatientID != f.PatientID {
+		return false
+	}
+	if f.VisitNumber != "" && message.VisitNumber != f.VisitNumber {
+		return false
+	}
+	if f.MessageType != "" && message.MessageType != f.MessageType {
+		return false
+	}
+	if !f.From.IsZero() && message.ReceivedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !message.ReceivedAt.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// Message parses the raw message
+func (m *StoredMessage) Message() (*HL7Message, error) {
+	message, err := NewHL7Parser().ParseMessage(m.Raw)
+	if err != nil {
+		return nil, err
+	}
+	message.Time = m.ReceivedAt
+	message.VisitNumber = m.VisitNumber
+	return message, nil
+}
@@ -0,0 +1,293 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FILE_STORAGE_MERGES is the file of merged patient IDs in the storage root
+const FILE_STORAGE_MERGES = "patient_merges.json"
+
+// FileStorage stores one file per message under a date-partitioned directory
+// tree: <root>/YYYY/MM/DD/<HHMMSS.nnnnnnnnn>_<type>_<control id>.hl7 (UTC),
+// or <HHMMSS.nnnnnnnnn>_<type>_<visit>_<control id>.hl7 for messages of an
+// encounter, so that visits assigned by the server are kept with the message.
+// Message files are never rewritten; merged patient IDs are kept in
+// <root>/patient_merges.json and resolved when messages are queried.
+type FileStorage struct {
+	root   string
+	mutex  sync.Mutex
+	merges map[string]string // Retired patient ID to surviving patient ID
+}
+
+// NewFileStorage creates a filesystem storage rooted at root
+func NewFileStorage(root string) (*FileStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("filesystem storage requires a path")
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+	merges := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(root, FILE_STORAGE_MERGES))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read patient merges: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &merges); err != nil {
+			return nil, fmt.Errorf("invalid patient merges: %v", err)
+		}
+	}
+	return &FileStorage{root: root, merges: merges}, nil
+}
+
+// Save writes the message to its own file and syncs it to disk
+func (s *FileStorage) Save(message *HL7Message) error {
+	stored := newStoredMessage(message)
+	receivedAt := stored.ReceivedAt.UTC()
+
+	dir := filepath.Join(s.root, receivedAt.Format("2006"), receivedAt.Format("01"), receivedAt.Format("02"))
+	base := fmt.Sprintf("%s_%s_%s", receivedAt.Format("150405.000000000"), safeFileName(stored.MessageType), safeFileName(stored.ControlID))
+	if stored.VisitNumber != "" {
+		base = fmt.Sprintf("%s_%s_%s_%s", receivedAt.Format("150405.000000000"), safeFileName(stored.MessageType), safeFileName(stored.VisitNumber), safeFileName(stored.ControlID))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create partition directory: %v", err)
+	}
+
+	// Never overwrite an archived message
+	path := filepath.Join(dir, base+".hl7")
+	for i := 1; fileExists(path); i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d.hl7", base, i))
+	}
+
+	// Write to a temporary file first so readers never see partial messages
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create message file: %v", err)
+	}
+	if _, err := file.WriteString(stored.Raw); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write message file: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync message file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close message file: %v", err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Query scans the partitions covered by the filter's time range
+func (s *FileStorage) Query(filter MessageFilter) ([]*StoredMessage, error) {
+	paths := make([]string, 0)
+	err := filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if !s.partitionInRange(path, filter) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".hl7") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan storage: %v", err)
+	}
+	sort.Strings(paths)
+
+	messages := make([]*StoredMessage, 0)
+	for _, path := range paths {
+		receivedAt, err := s.timeFromPath(path)
+		if err != nil {
+			continue // Not written by FileStorage
+		}
+		if !filter.From.IsZero() && receivedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !receivedAt.Before(filter.To) {
+			continue
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		message, err := NewHL7Parser().ParseMessage(string(raw))
+		if err != nil {
+			continue
+		}
+		message.Time = receivedAt
+		message.VisitNumber = visitFromPath(path)
+
+		stored := newStoredMessage(message)
+		stored.PatientID = s.survivingID(stored.PatientID)
+		if !filter.Matches(stored) {
+			continue
+		}
+		messages = append(messages, stored)
+		if filter.Limit > 0 && len(messages) >= filter.Limit {
+			break
+		}
+	}
+
+	return messages, nil
+}
+
+// MergePatient re-keys the messages of a retired patient ID to the surviving
+// one by recording the merge. Messages of the retired ID are returned with
+// the surviving ID from then on, including those saved later.
+func (s *FileStorage) MergePatient(retiredID, survivingID string) (int, error) {
+	messages, err := s.Query(MessageFilter{PatientID: retiredID})
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Keep the merges flat: IDs merged into the retired ID now resolve to the surviving ID
+	merges := make(map[string]string, len(s.merges)+1)
+	for retired, surviving := range s.merges {
+		if surviving == retiredID {
+			surviving = survivingID
+		}
+		if retired != survivingID {
+			merges[retired] = surviving
+		}
+	}
+	merges[retiredID] = survivingID
+
+	data, err := json.MarshalIndent(merges, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	path := filepath.Join(s.root, FILE_STORAGE_MERGES)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return 0, fmt.Errorf("failed to save patient merges: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return 0, fmt.Errorf("failed to save patient merges: %v", err)
+	}
+	s.merges = merges
+	return len(messages), nil
+}
+
+// survivingID returns the patient ID a patient was merged into, or the ID itself
+func (s *FileStorage) survivingID(patientID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if surviving, merged := s.merges[patientID]; merged {
+		return surviving
+	}
+	return patientID
+}
+
+// Close is a no-op for filesystem storage
+func (s *FileStorage) Close() error {
+	return nil
+}
+
+// partitionInRange returns false for year/month/day directories entirely
+// outside the filter's time range
+func (s *FileStorage) partitionInRange(path string, filter MessageFilter) bool {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil || rel == "." {
+		return true
+	}
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	layouts := []string{"2006", "2006/01", "2006/01/02"}
+	if len(parts) > len(layouts) {
+		return true
+	}
+	start, err := time.Parse(layouts[len(parts)-1], strings.Join(parts, "/"))
+	if err != nil {
+		return false
+	}
+
+	var end time.Time
+	switch len(parts) {
+	case 1:
+		end = start.AddDate(1, 0, 0)
+	case 2:
+		end = start.AddDate(0, 1, 0)
+	default:
+		end = start.AddDate(0, 0, 1)
+	}
+
+	if !filter.From.IsZero() && !end.After(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !start.Before(filter.To) {
+		return false
+	}
+	return true
+}
+
+// timeFromPath recovers the receive time encoded in a message file path
+func (s *FileStorage) timeFromPath(path string) (time.Time, error) {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 4 {
+		return time.Time{}, fmt.Errorf("unexpected path: %s", path)
+	}
+	clock := strings.SplitN(parts[3], "_", 2)[0]
+	return time.Parse("2006/01/02 150405.000000000", strings.Join(parts[:3], "/")+" "+clock)
+}
+
+// visitFromPath returns the visit number encoded in a message file name, or
+// an empty string for messages stored without one
+func visitFromPath(path string) string {
+	parts := strings.Split(filepath.Base(path), "_")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[2]
+}
+
+// safeFileName replaces characters that are not safe in file names
+func safeFileName(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, value)
+}
+
+// fileExists returns true if path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
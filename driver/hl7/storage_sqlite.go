@@ -0,0 +1,213 @@
+package hl7
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLiteDriverName is the database/sql driver used by OpenSQLiteStorage.
+// The driver itself must be registered by the application, e.g. with
+// import _ "github.com/mattn/go-sqlite3" (driver name "sqlite3") or
+// import _ "modernc.org/sqlite" (driver name "sqlite").
+var SQLiteDriverName = "sqlite3"
+
+// sqliteSchema creates the message table and its query indexes
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS hl7_messages (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	control_id    TEXT NOT NULL,
+	message_type  TEXT NOT NULL,
+	trigger_event TEXT NOT NULL,
+	patient_id    TEXT NOT NULL,
+	visit_number  TEXT NOT NULL DEFAULT '',
+	received_at   INTEGER NOT NULL,
+	raw_message   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS hl7_messages_patient ON hl7_messages (patient_id, received_at);
+CREATE INDEX IF NOT EXISTS hl7_messages_type ON hl7_messages (message_type, received_at);
+CREATE INDEX IF NOT EXISTS hl7_messages_time ON hl7_messages (received_at);
+CREATE TABLE IF NOT EXISTS hl7_patient_merges (
+	retired_id   TEXT PRIMARY KEY,
+	surviving_id TEXT NOT NULL,
+	merged_at    INTEGER NOT NULL
+);
+`
+
+// sqliteVisitIndex is created after databases of earlier versions gained the visit_number column
+const sqliteVisitIndex = `CREATE INDEX IF NOT EXISTS hl7_messages_visit ON hl7_messages (patient_id, visit_number, received_at)`
+
+// SQLiteStorage stores messages in a SQLite database
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStorage opens (or creates) the SQLite database at path
+func OpenSQLiteStorage(path string) (*SQLiteStorage, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite storage requires a path")
+	}
+	db, err := sql.Open(SQLiteDriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %v", err)
+	}
+	storage, err := NewSQLiteStorage(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+// NewSQLiteStorage uses an already opened database, creating the schema if needed
+func NewSQLiteStorage(db *sql.DB) (*SQLiteStorage, error) {
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, fmt.Errorf("failed to create sqlite schema: %v", err)
+	}
+	if err := migrateSQLiteVisit(db); err != nil {
+		return nil, err
+	}
+	return &SQLiteStorage{db: db}, nil
+}
+
+// migrateSQLiteVisit adds the visit_number column to databases created before
+// encounters were tracked, and its index
+func migrateSQLiteVisit(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(hl7_messages)`)
+	if err != nil {
+		return fmt.Errorf("failed to read sqlite schema: %v", err)
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read sqlite schema: %v", err)
+		}
+		if name == "visit_number" {
+			found = true
+		}
+	}
+	rows.Close()
+
+	if !found {
+		if _, err := db.Exec(`ALTER TABLE hl7_messages ADD COLUMN visit_number TEXT NOT NULL DEFAULT ''`); err != nil {
+			return fmt.Errorf("failed to add visit_number column: %v", err)
+		}
+	}
+	if _, err := db.Exec(sqliteVisitIndex); err != nil {
+		return fmt.Errorf("failed to create sqlite schema: %v", err)
+	}
+	return nil
+}
+
+// Save inserts the message, keyed by the surviving patient ID if the patient was merged
+func (s *SQLiteStorage) Save(message *HL7Message) error {
+	stored := newStoredMessage(message)
+	_, err := s.db.Exec(
+		`INSERT INTO hl7_messages (control_id, message_type, trigger_event, patient_id, visit_number, received_at, raw_message) VALUES (?, ?, ?, COALESCE((SELECT surviving_id FROM hl7_patient_merges WHERE retired_id = ?), ?), ?, ?, ?)`,
+		stored.ControlID, stored.MessageType, stored.TriggerEvent, stored.PatientID, stored.PatientID, stored.VisitNumber, stored.ReceivedAt.UnixNano(), stored.Raw,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert message: %v", err)
+	}
+	return nil
+}
+
+// Query selects the messages matching filter
+func (s *SQLiteStorage) Query(filter MessageFilter) ([]*StoredMessage, error) {
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	if filter.PatientID != "" {
+		conditions = append(conditions, "patient_id = ?")
+		args = append(args, filter.PatientID)
+	}
+	if filter.VisitNumber != "" {
+		conditions = append(conditions, "visit_number = ?")
+		args = append(args, filter.VisitNumber)
+	}
+	if filter.MessageType != "" {
+		conditions = append(conditions, "message_type = ?")
+		args = append(args, filter.MessageType)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "received_at >= ?")
+		args = append(args, filter.From.UnixNano())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "received_at < ?")
+		args = append(args, filter.To.UnixNano())
+	}
+
+	query := "SELECT control_id, message_type, trigger_event, patient_id, visit_number, received_at, raw_message FROM hl7_messages"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY received_at, id"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+
+	messages := make([]*StoredMessage, 0)
+	for rows.Next() {
+		stored := &StoredMessage{}
+		var receivedAt int64
+		if err := rows.Scan(&stored.ControlID, &stored.MessageType, &stored.TriggerEvent, &stored.PatientID, &stored.VisitNumber, &receivedAt, &stored.Raw); err != nil {
+			return nil, fmt.Errorf("failed to read message: %v", err)
+		}
+		stored.ReceivedAt = time.Unix(0, receivedAt)
+		messages = append(messages, stored)
+	}
+	return messages, rows.Err()
+}
+
+// MergePatient re-keys the messages of a retired patient ID to the surviving
+// one and records the merge, so that later messages of the retired ID are
+// re-keyed when saved. The raw messages are kept as received.
+func (s *SQLiteStorage) MergePatient(retiredID, survivingID string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to merge patient: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE hl7_messages SET patient_id = ? WHERE patient_id = ?`, survivingID, retiredID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-key messages: %v", err)
+	}
+	count, _ := result.RowsAffected()
+
+	// Keep the merges flat: IDs merged into the retired ID now resolve to the surviving ID
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`DELETE FROM hl7_patient_merges WHERE retired_id = ?`, []interface{}{survivingID}},
+		{`UPDATE hl7_patient_merges SET surviving_id = ? WHERE surviving_id = ?`, []interface{}{survivingID, retiredID}},
+		{`INSERT OR REPLACE INTO hl7_patient_merges (retired_id, surviving_id, merged_at) VALUES (?, ?, ?)`, []interface{}{retiredID, survivingID, time.Now().UnixNano()}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return 0, fmt.Errorf("failed to record patient merge: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to merge patient: %v", err)
+	}
+	return int(count), nil
+}
+
+// Close closes the database
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
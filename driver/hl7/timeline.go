@@ -0,0 +1,569 @@
+package hl7
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/precision"
+)
+
+// TIMELINE_RETENTION is the default number of hours kept per patient
+const TIMELINE_RETENTION = 24
+
+// TIMELINE_EFFECT_WINDOW is the default window before and after a drug is given
+const TIMELINE_EFFECT_WINDOW = 15 * time.Minute
+
+// TIMELINE_CONFLICT_WINDOW is the default number of seconds within which
+// respiratory rates of a monitor and a ventilator conflict
+const TIMELINE_CONFLICT_WINDOW = 60
+
+// Sources of timeline observations, and the respiratory rate conflict rules
+const (
+	TIMELINE_SOURCE_MONITOR    = "monitor"
+	TIMELINE_SOURCE_VENTILATOR = "ventilator"
+	TIMELINE_SOURCE_PUMP       = "pump"
+	TIMELINE_SOURCE_BOTH       = "both" // Conflict rule only: keep the rates of both sources
+)
+
+// respRateReferenceIDs are the respiratory rates compared between sources
+var respRateReferenceIDs = map[string]bool{
+	"MDC_RESP_RATE":       true,
+	"MDC_VENT_RESP_RATE":  true,
+	"MDC_AWAY_RESP_RATE":  true,
+	"MDC_TTHOR_RESP_RATE": true,
+	"MDC_CO2_RESP_RATE":   true,
+}
+
+// ventilatorDevicePrefix identifies the MDS of a ventilator in IHE PCD containment
+const ventilatorDevicePrefix = "MDC_DEV_SYS_PT_VENT"
+
+// TimelineConfig configures the vitals and medication timeline
+type TimelineConfig struct {
+	Enabled        bool     `json:"enabled"`
+	Retention      int      `json:"retention"`        // Hours of history kept per patient (0: 24)
+	Ventilators    []string `json:"ventilators"`      // Sending applications (MSH-3) or equipment IDs (OBX-18) of ventilator feeds
+	RespRateSource string   `json:"resp_rate_source"` // Respiratory rate kept when both report: ventilator (default), monitor or both
+	ConflictWindow int      `json:"conflict_window"`  // Seconds within which the two respiratory rates conflict (0: 60)
+}
+
+// TimelinePoint is a numeric observation on the timeline
+type TimelinePoint struct {
+	Time        time.Time `json:"time"`
+	ReferenceID string    `json:"reference_id"`
+	Value       float64   `json:"value"`
+	Unit        string    `json:"unit,omitempty"`
+	Source      string    `json:"source"` // monitor, ventilator or pump
+	EquipmentID string    `json:"equipment_id,omitempty"`
+	Channel     string    `json:"channel,omitempty"` // Pump delivery channel (see InfusionChannel)
+}
+
+// TimelineJSON is the vitals of a patient with the medication events overlaid
+type TimelineJSON struct {
+	PatientID    string             `json:"patient_id"`
+	From         *time.Time         `json:"from,omitempty"`
+	To           *time.Time         `json:"to,omitempty"`
+	Observations []TimelinePoint    `json:"observations"`
+	Medications  []*MedicationEvent `json:"medications"`
+	Suppressed   int                `json:"suppressed,omitempty"` // Respiratory rates hidden by the conflict rule
+}
+
+// WindowStats summarizes the values of one observation in a time window
+type WindowStats struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Count int       `json:"count"`
+	Mean  float64   `json:"mean,omitempty"`
+	Min   float64   `json:"min,omitempty"`
+	Max   float64   `json:"max,omitempty"`
+}
+
+// DrugEffect compares an observation before and after a medication event.
+// The before window ends when administration starts, the after window starts
+// when it ends (or starts, for a bolus).
+type DrugEffect struct {
+	Medication    *MedicationEvent `json:"medication"`
+	ReferenceID   string           `json:"reference_id"`
+	Before        WindowStats      `json:"before"`
+	After         WindowStats      `json:"after"`
+	Change        *float64         `json:"change,omitempty"` // After mean minus before mean
+	PercentChange *float64         `json:"percent_change,omitempty"`
+}
+
+// patientTimeline holds the history of one patient, both in time order
+type patientTimeline struct {
+	points      []TimelinePoint
+	medications []*MedicationEvent
+}
+
+// Timeline keeps recent numeric observations and medication events per
+// patient so that drug administrations can be shown on the vitals trend and
+// their effect analysed. Feeds of ventilators and monitors at the same bed
+// are merged: observations without a patient ID are assigned to the patient
+// last reported at their location (PV1-3), and are held until one is. When
+// both sources report a respiratory rate, the rate of the preferred source
+// is shown. It is safe for concurrent use.
+type Timeline struct {
+	retention      time.Duration
+	ventilators    map[string]bool
+	respRateSource string
+	conflictWindow time.Duration
+	mutex          sync.RWMutex
+	patients       map[string]*patientTimeline
+	beds           map[string]string           // Location to patient ID
+	unassigned     map[string]*patientTimeline // Observations of locations without a known patient
+	sequence       int
+	precision      *precision.Policy // Rounds the statistics of Effect (nil: not rounded)
+}
+
+// NewTimeline creates a timeline
+func NewTimeline(config TimelineConfig) *Timeline {
+	retention := config.Retention
+	if retention <= 0 {
+		retention = TIMELINE_RETENTION
+	}
+	respRateSource := strings.ToLower(config.RespRateSource)
+	if respRateSource == "" {
+		respRateSource = TIMELINE_SOURCE_VENTILATOR
+	}
+	conflictWindow := config.ConflictWindow
+	if conflictWindow <= 0 {
+		conflictWindow = TIMELINE_CONFLICT_WINDOW
+	}
+	ventilators := make(map[string]bool)
+	for _, ventilator := range config.Ventilators {
+		ventilators[ventilator] = true
+	}
+	return &Timeline{
+		retention:      time.Duration(retention) * time.Hour,
+		ventilators:    ventilators,
+		respRateSource: respRateSource,
+		conflictWindow: time.Duration(conflictWindow) * time.Second,
+		patients:       make(map[string]*patientTimeline),
+		beds:           make(map[string]string),
+		unassigned:     make(map[string]*patientTimeline),
+	}
+}
+
+// SetPrecision rounds the means and changes reported by Effect to the
+// precision of the parameter, and percent changes to one decimal
+func (t *Timeline) SetPrecision(policy *precision.Policy) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.precision = policy
+}
+
+// AddObservations adds the numeric observations of a patient, or of a bed
+// if the set has no patient ID. Values repeated with the same time (periodic
+// results resending the last NIBP) are added once.
+func (t *Timeline) AddObservations(set *ObservationSet) {
+	if set.PatientID == "" && set.Location == "" {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var patient *patientTimeline
+	switch {
+	case set.PatientID != "":
+		patient = t.patient(set.PatientID)
+		if set.Location != "" {
+			t.assignBed(set.Location, set.PatientID, patient)
+		}
+	case t.beds[set.Location] != "":
+		patient = t.patient(t.beds[set.Location])
+	default:
+		patient = t.unassigned[set.Location]
+		if patient == nil {
+			patient = &patientTimeline{}
+			t.unassigned[set.Location] = patient
+		}
+	}
+
+	for _, observation := range set.Observations {
+		if observation.NumericValue == nil || observation.Timestamp.IsZero() {
+			continue
+		}
+		point := TimelinePoint{
+			Time:        observation.Timestamp,
+			ReferenceID: observation.ReferenceID,
+			Value:       *observation.NumericValue,
+			Unit:        observation.Unit,
+			Source:      t.sourceOf(set, &observation),
+			EquipmentID: observation.EquipmentID,
+		}
+		if point.Source == TIMELINE_SOURCE_PUMP {
+			point.Channel = infusionChannelID(observation.SubID)
+		}
+		patient.insert(point)
+	}
+	t.prune(patient)
+}
+
+// assignBed records the patient at a location, moving the observations held
+// for the location to the patient. The patient is removed from other beds.
+// The caller must hold the lock.
+func (t *Timeline) assignBed(location, patientID string, patient *patientTimeline) {
+	if t.beds[location] == patientID {
+		return
+	}
+	for bed, occupant := range t.beds {
+		if occupant == patientID {
+			delete(t.beds, bed)
+		}
+	}
+	t.beds[location] = patientID
+
+	if held, exists := t.unassigned[location]; exists {
+		for _, point := range held.points {
+			patient.insert(point)
+		}
+		delete(t.unassigned, location)
+	}
+}
+
+// sourceOf classifies an observation as coming from a ventilator, an
+// infusion pump or a monitor
+func (t *Timeline) sourceOf(set *ObservationSet, observation *Observation) string {
+	if IsInfusionObservation(observation) {
+		return TIMELINE_SOURCE_PUMP
+	}
+	if t.ventilators[set.SendingApplication] || t.ventilators[observation.EquipmentID] {
+		return TIMELINE_SOURCE_VENTILATOR
+	}
+	if len(observation.DevicePath) > 0 && strings.HasPrefix(observation.DevicePath[0].ReferenceID, ventilatorDevicePrefix) {
+		return TIMELINE_SOURCE_VENTILATOR
+	}
+	return TIMELINE_SOURCE_MONITOR
+}
+
+// AddMedication adds a medication event, replacing an event of the same
+// patient with the same ID. Events without an ID are assigned one.
+func (t *Timeline) AddMedication(event *MedicationEvent) error {
+	if err := event.Validate(); err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if event.ID == "" {
+		t.sequence++
+		event.ID = fmt.Sprintf("%s-%d", MEDICATION_SOURCE_API, t.sequence)
+	}
+
+	patient := t.patient(event.PatientID)
+	for i, existing := range patient.medications {
+		if existing.ID == event.ID {
+			patient.medications = append(patient.medications[:i], patient.medications[i+1:]...)
+			break
+		}
+	}
+	i := sort.Search(len(patient.medications), func(i int) bool {
+		return patient.medications[i].Time.After(event.Time)
+	})
+	patient.medications = append(patient.medications, nil)
+	copy(patient.medications[i+1:], patient.medications[i:])
+	patient.medications[i] = event
+	t.prune(patient)
+	return nil
+}
+
+// Range returns the observations and the medication events of a patient
+// between from and to. A zero from or to leaves the range open.
+func (t *Timeline) Range(patientID string, from, to time.Time) *TimelineJSON {
+	result := &TimelineJSON{
+		PatientID:    patientID,
+		Observations: make([]TimelinePoint, 0),
+		Medications:  make([]*MedicationEvent, 0),
+	}
+	if !from.IsZero() {
+		result.From = &from
+	}
+	if !to.IsZero() {
+		result.To = &to
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	patient, exists := t.patients[patientID]
+	if !exists {
+		return result
+	}
+	points, suppressed := t.resolveConflicts(patient.points)
+	for _, point := range points {
+		if inRange(point.Time, point.Time, from, to) {
+			result.Observations = append(result.Observations, point)
+		}
+	}
+	result.Suppressed = suppressed
+	for _, event := range patient.medications {
+		if inRange(event.Time, medicationEnd(event), from, to) {
+			result.Medications = append(result.Medications, event)
+		}
+	}
+	return result
+}
+
+// Effect compares the values of referenceID in the window before and after
+// a medication event of a patient
+func (t *Timeline) Effect(patientID, medicationID, referenceID string, window time.Duration) (*DrugEffect, error) {
+	if window <= 0 {
+		window = TIMELINE_EFFECT_WINDOW
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	patient, exists := t.patients[patientID]
+	if !exists {
+		return nil, fmt.Errorf("no timeline for patient %s", patientID)
+	}
+	var event *MedicationEvent
+	for _, candidate := range patient.medications {
+		if candidate.ID == medicationID {
+			event = candidate
+			break
+		}
+	}
+	if event == nil {
+		return nil, fmt.Errorf("medication event %s not found for patient %s", medicationID, patientID)
+	}
+
+	end := medicationEnd(event)
+	effect := &DrugEffect{
+		Medication:  event,
+		ReferenceID: referenceID,
+		Before:      WindowStats{Start: event.Time.Add(-window), End: event.Time},
+		After:       WindowStats{Start: end, End: end.Add(window)},
+	}
+	before := make([]float64, 0)
+	after := make([]float64, 0)
+	points, _ := t.resolveConflicts(patient.points)
+	for _, point := range points {
+		if point.ReferenceID != referenceID {
+			continue
+		}
+		switch {
+		case !point.Time.Before(effect.Before.Start) && point.Time.Before(effect.Before.End):
+			before = append(before, point.Value)
+		case point.Time.After(effect.After.Start) && !point.Time.After(effect.After.End):
+			after = append(after, point.Value)
+		}
+	}
+	summarize(&effect.Before, before)
+	summarize(&effect.After, after)
+
+	if effect.Before.Count > 0 && effect.After.Count > 0 {
+		change := effect.After.Mean - effect.Before.Mean
+		effect.Change = &change
+		if effect.Before.Mean != 0 {
+			percent := change / math.Abs(effect.Before.Mean) * 100
+			if t.precision != nil {
+				percent = precision.Round(percent, 1)
+			}
+			effect.PercentChange = &percent
+		}
+	}
+	for _, value := range []*float64{&effect.Before.Mean, &effect.After.Mean, effect.Change} {
+		if value != nil {
+			*value = t.precision.Round(referenceID, "", *value)
+		}
+	}
+	return effect, nil
+}
+
+// Forget discards the timeline of a patient
+func (t *Timeline) Forget(patientID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.patients, patientID)
+	for bed, occupant := range t.beds {
+		if occupant == patientID {
+			delete(t.beds, bed)
+		}
+	}
+}
+
+// objectCount returns the observations and medication events held, for the
+// memory monitor
+func (t *Timeline) objectCount() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	count := 0
+	for _, patients := range []map[string]*patientTimeline{t.patients, t.unassigned} {
+		for _, patient := range patients {
+			count += len(patient.points) + len(patient.medications)
+		}
+	}
+	return count
+}
+
+// Merge moves the timeline and beds of a retired patient ID to the surviving
+// patient ID (A40) and returns the number of observations and medication
+// events moved
+func (t *Timeline) Merge(retiredID, survivingID string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	retired, exists := t.patients[retiredID]
+	if !exists || retiredID == survivingID {
+		return 0
+	}
+	delete(t.patients, retiredID)
+	surviving := t.patient(survivingID)
+	for _, point := range retired.points {
+		surviving.insert(point)
+	}
+	for _, event := range retired.medications {
+		moved := *event
+		moved.PatientID = survivingID
+		i := sort.Search(len(surviving.medications), func(i int) bool {
+			return surviving.medications[i].Time.After(moved.Time)
+		})
+		surviving.medications = append(surviving.medications, nil)
+		copy(surviving.medications[i+1:], surviving.medications[i:])
+		surviving.medications[i] = &moved
+	}
+	for bed, occupant := range t.beds {
+		if occupant == retiredID {
+			t.beds[bed] = survivingID
+		}
+	}
+	t.prune(surviving)
+	return len(retired.points) + len(retired.medications)
+}
+
+// patient returns the timeline of a patient, creating it. The caller must hold the lock.
+func (t *Timeline) patient(patientID string) *patientTimeline {
+	patient, exists := t.patients[patientID]
+	if !exists {
+		patient = &patientTimeline{}
+		t.patients[patientID] = patient
+	}
+	return patient
+}
+
+// prune drops the history older than the retention, measured from the
+// latest observation or medication event of the patient
+func (t *Timeline) prune(patient *patientTimeline) {
+	var latest time.Time
+	if n := len(patient.points); n > 0 {
+		latest = patient.points[n-1].Time
+	}
+	if n := len(patient.medications); n > 0 && patient.medications[n-1].Time.After(latest) {
+		latest = patient.medications[n-1].Time
+	}
+	cutoff := latest.Add(-t.retention)
+
+	i := sort.Search(len(patient.points), func(i int) bool {
+		return !patient.points[i].Time.Before(cutoff)
+	})
+	patient.points = patient.points[i:]
+
+	kept := patient.medications[:0]
+	for _, event := range patient.medications {
+		if !medicationEnd(event).Before(cutoff) {
+			kept = append(kept, event)
+		}
+	}
+	patient.medications = kept
+}
+
+// resolveConflicts applies the respiratory rate conflict rule, returning the
+// points without the rates of the other source that lie within the conflict
+// window of a rate of the preferred source, and the number of points removed
+func (t *Timeline) resolveConflicts(points []TimelinePoint) ([]TimelinePoint, int) {
+	if t.respRateSource == TIMELINE_SOURCE_BOTH {
+		return points, 0
+	}
+
+	preferred := make([]time.Time, 0)
+	for _, point := range points {
+		if respRateReferenceIDs[point.ReferenceID] && point.Source == t.respRateSource {
+			preferred = append(preferred, point.Time)
+		}
+	}
+	if len(preferred) == 0 {
+		return points, 0
+	}
+
+	resolved := make([]TimelinePoint, 0, len(points))
+	for _, point := range points {
+		if respRateReferenceIDs[point.ReferenceID] && point.Source != t.respRateSource {
+			i := sort.Search(len(preferred), func(i int) bool {
+				return !preferred[i].Before(point.Time.Add(-t.conflictWindow))
+			})
+			if i < len(preferred) && !preferred[i].After(point.Time.Add(t.conflictWindow)) {
+				continue
+			}
+		}
+		resolved = append(resolved, point)
+	}
+	return resolved, len(points) - len(resolved)
+}
+
+// insert adds a point in time order unless it repeats a point of the same source
+func (p *patientTimeline) insert(point TimelinePoint) {
+	i := sort.Search(len(p.points), func(i int) bool {
+		return p.points[i].Time.After(point.Time)
+	})
+	if isRepeatedPoint(p.points[:i], point) {
+		return
+	}
+	p.points = append(p.points, TimelinePoint{})
+	copy(p.points[i+1:], p.points[i:])
+	p.points[i] = point
+}
+
+// isRepeatedPoint reports whether points (ending at or before point's time)
+// already hold the same observation of the same source and pump channel at
+// the same time
+func isRepeatedPoint(points []TimelinePoint, point TimelinePoint) bool {
+	for i := len(points) - 1; i >= 0 && points[i].Time.Equal(point.Time); i-- {
+		if points[i].ReferenceID == point.ReferenceID && points[i].Source == point.Source && points[i].Channel == point.Channel {
+			return true
+		}
+	}
+	return false
+}
+
+// medicationEnd returns the end of administration, or its start for a bolus
+func medicationEnd(event *MedicationEvent) time.Time {
+	if event.EndTime != nil {
+		return *event.EndTime
+	}
+	return event.Time
+}
+
+// inRange reports whether the interval start-end overlaps from-to
+func inRange(start, end, from, to time.Time) bool {
+	if !from.IsZero() && end.Before(from) {
+		return false
+	}
+	if !to.IsZero() && start.After(to) {
+		return false
+	}
+	return true
+}
+
+// summarize fills the count, mean, minimum and maximum of values
+func summarize(stats *WindowStats, values []float64) {
+	stats.Count = len(values)
+	if len(values) == 0 {
+		return
+	}
+	stats.Min, stats.Max = values[0], values[0]
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+		stats.Min = math.Min(stats.Min, value)
+		stats.Max = math.Max(stats.Max, value)
+	}
+	stats.Mean = sum / float64(len(values))
+}
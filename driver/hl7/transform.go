@@ -0,0 +1,285 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Transformation actions
+const (
+	TRANSFORM_MAP          = "map"          // Replace listed values of a field or component
+	TRANSFORM_SET          = "set"          // Set a field or component to a fixed value
+	TRANSFORM_DROP_SEGMENT = "drop_segment" // Remove every segment of a type
+	TRANSFORM_ADD_OBX      = "add_obx"      // Add an observation after the last OBX
+)
+
+// TransformConfig enables the transformation of received messages with the
+// rules of a mapping file. Messages are transformed before they are stored,
+// published or forwarded; the acknowledgment is unchanged.
+type TransformConfig struct {
+	Enabled bool   `json:"enabled"`
+	File    string `json:"file"` // JSON mapping file, read again on reload
+}
+
+// TransformMapping is the content of a mapping file
+type TransformMapping struct {
+	Rules []TransformRule `json:"rules"` // Applied in order; every matching rule applies
+}
+
+// TransformRule applies actions to the messages it matches. The criteria
+// are those of RouteRule and are checked against the message as changed
+// by the previous rules.
+type TransformRule struct {
+	Name            string            `json:"name"`             // Counted in hl7_transformed_messages_total
+	MessageType     string            `json:"message_type"`     // MSH-9.1, or MSH-9.1^MSH-9.2 such as "ORU^R01"
+	SendingFacility string            `json:"sending_facility"` // MSH-4.1
+	Fields          map[string]string `json:"fields"`           // Values by position such as "PV1-3.1"
+	Actions         []TransformAction `json:"actions"`          // Applied in order
+}
+
+// TransformAction is one change to a message
+type TransformAction struct {
+	Action   string            `json:"action"`   // map, set, drop_segment or add_obx
+	Position string            `json:"position"` // map, set: field or component such as "MSH-4" or "PID-3.4"
+	Values   map[string]string `json:"values"`   // map: new value by current value; other values are kept
+	Value    string            `json:"value"`    // set: the new value
+	Segment  string            `json:"segment"`  // drop_segment: segment type such as "NTE"
+	OBX      *TransformOBX     `json:"obx"`      // add_obx: the observation
+}
+
+// TransformOBX is an observation added by a rule
+type TransformOBX struct {
+	ValueType    string `json:"value_type"`    // OBX-2 (default ST)
+	Code         string `json:"code"`          // OBX-3.1
+	Text         string `json:"text"`          // OBX-3.2
+	CodingSystem string `json:"coding_system"` // OBX-3.3
+	Value        string `json:"value"`         // OBX-5
+	Units        string `json:"units"`         // OBX-6.1
+	Status       string `json:"status"`        // OBX-11 (default F)
+}
+
+// transformRule is a rule with its criteria and positions parsed
+type transformRule struct {
+	TransformRule
+	matcher   messageMatcher
+	positions []fieldCriterion // Parsed position of each action; only segment, field and component are set
+}
+
+// Transformer changes received messages with declarative rules. It is safe
+// for concurrent use.
+type Transformer struct {
+	rules  []transformRule
+	parser *HL7Parser
+}
+
+// LoadTransformer reads a JSON mapping file
+func LoadTransformer(file string) (*Transformer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping file: %v", err)
+	}
+	var mapping TransformMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("failed to parse mapping file %s: %v", file, err)
+	}
+	return NewTransformer(mapping)
+}
+
+// NewTransformer validates the rules of a mapping
+func NewTransformer(mapping TransformMapping) (*Transformer, error) {
+	t := &Transformer{parser: NewHL7Parser()}
+	for i, rule := range mapping.Rules {
+		name := rule.Name
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		matcher, err := newMessageMatcher(rule.MessageType, rule.SendingFacility, rule.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("transform rule %s: %v", name, err)
+		}
+		parsed := transformRule{TransformRule: rule, matcher: matcher}
+		parsed.Name = name
+		for j, action := range rule.Actions {
+			position, err := parseTransformAction(action)
+			if err != nil {
+				return nil, fmt.Errorf("transform rule %s, action %d: %v", name, j+1, err)
+			}
+			parsed.positions = append(parsed.positions, position)
+		}
+		t.rules = append(t.rules, parsed)
+	}
+	return t, nil
+}
+
+// parseTransformAction checks an action and parses its position
+func parseTransformAction(action TransformAction) (fieldCriterion, error) {
+	switch action.Action {
+	case TRANSFORM_MAP, TRANSFORM_SET:
+		position, err := parseFieldPosition(action.Position)
+		if err != nil {
+			return fieldCriterion{}, err
+		}
+		if isHeaderSegment(position.segment) && position.field <= 2 {
+			return fieldCriterion{}, fmt.Errorf("the encoding characters (%s) cannot be changed", action.Position)
+		}
+		if action.Action == TRANSFORM_MAP && len(action.Values) == 0 {
+			return fieldCriterion{}, fmt.Errorf("map requires values")
+		}
+		return position, nil
+	case TRANSFORM_DROP_SEGMENT:
+		segment := strings.ToUpper(action.Segment)
+		if len(segment) != 3 {
+			return fieldCriterion{}, fmt.Errorf("invalid segment %q", action.Segment)
+		}
+		if segment == HL7_SEG_MSH {
+			return fieldCriterion{}, fmt.Errorf("MSH cannot be dropped")
+		}
+		return fieldCriterion{segment: segment}, nil
+	case TRANSFORM_ADD_OBX:
+		if action.OBX == nil || action.OBX.Code == "" {
+			return fieldCriterion{}, fmt.Errorf("add_obx requires obx with a code")
+		}
+		return fieldCriterion{}, nil
+	}
+	return fieldCriterion{}, fmt.Errorf("unknown action %q", action.Action)
+}
+
+// Apply transforms a message and returns the names of the rules that
+// matched it. The rules change a copy, which is then encoded and parsed
+// again so that Raw and the parsed fields agree. When no rule matches, the
+// message itself is returned.
+func (t *Transformer) Apply(message *HL7Message) (*HL7Message, []string, error) {
+	applied := make([]string, 0)
+	working := message
+	for i := range t.rules {
+		rule := &t.rules[i]
+		if !rule.matcher.matches(working) {
+			continue
+		}
+		if working == message {
+			copied, err := t.parser.ParseMessage(message.Encode())
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to copy message: %v", err)
+			}
+			working = copied
+		}
+		for j, action := range rule.Actions {
+			applyTransformAction(working, action, rule.positions[j])
+		}
+		applied = append(applied, rule.Name)
+	}
+	if len(applied) == 0 {
+		return message, applied, nil
+	}
+
+	transformed, err := t.parser.ParseMessage(working.Encode())
+	if err != nil {
+		return nil, nil, fmt.Errorf("transformed message is invalid (rules %s): %v", strings.Join(applied, ", "), err)
+	}
+	transformed.Time = message.Time
+	transformed.VisitNumber = message.VisitNumber
+	return transformed, applied, nil
+}
+
+// applyTransformAction applies one action to every segment it concerns
+func applyTransformAction(message *HL7Message, action TransformAction, position fieldCriterion) {
+	switch action.Action {
+	case TRANSFORM_MAP:
+		component := position.component
+		if component == 0 {
+			component = 1
+		}
+		for i := range message.Segments {
+			segment := &message.Segments[i]
+			if segment.Type != position.segment {
+				continue
+			}
+			for _, repetition := range segment.Repetitions(position.field) {
+				if value, mapped := action.Values[repetition.ComponentValue(component)]; mapped {
+					repetition.SetComponentValue(component, value)
+				}
+			}
+		}
+	case TRANSFORM_SET:
+		for i := range message.Segments {
+			segment := &message.Segments[i]
+			if segment.Type != position.segment {
+				continue
+			}
+			if position.component == 0 {
+				segment.SetFieldValue(position.field, action.Value)
+			} else {
+				segment.SetComponentValue(position.field, position.component, action.Value)
+			}
+		}
+	case TRANSFORM_DROP_SEGMENT:
+		kept := message.Segments[:0]
+		for _, segment := range message.Segments {
+			if segment.Type != position.segment {
+				kept = append(kept, segment)
+			}
+		}
+		message.Segments = kept
+	case TRANSFORM_ADD_OBX:
+		addObservation(message, action.OBX)
+	}
+}
+
+// addObservation inserts an OBX after the last one of the message, or at
+// the end, numbered after the existing ones
+func addObservation(message *HL7Message, observation *TransformOBX) {
+	valueType, status := observation.ValueType, observation.Status
+	if valueType == "" {
+		valueType = "ST"
+	}
+	if status == "" {
+		status = "F"
+	}
+	segment := HL7Segment{Type: HL7_SEG_OBX}
+	segment.SetFieldValue(2, valueType)
+	segment.SetComponentValue(3, 1, observation.Code)
+	if observation.Text != "" || observation.CodingSystem != "" {
+		segment.SetComponentValue(3, 2, observation.Text)
+		segment.SetComponentValue(3, 3, observation.CodingSystem)
+	}
+	segment.SetFieldValue(5, observation.Value)
+	segment.SetFieldValue(6, observation.Units)
+	segment.SetFieldValue(11, status)
+
+	count, insertAt := 0, len(message.Segments)
+	for i := range message.Segments {
+		if message.Segments[i].Type == HL7_SEG_OBX {
+			count++
+			insertAt = i + 1
+		}
+	}
+	segment.SetFieldValue(1, strconv.Itoa(count+1))
+
+	segments := make([]HL7Segment, 0, len(message.Segments)+1)
+	segments = append(segments, message.Segments[:insertAt]...)
+	segments = append(segments, segment)
+	message.Segments = append(segments, message.Segments[insertAt:]...)
+}
+
+// transformMessage applies the transformation rules to a received message.
+// A message the rules make invalid is reported and kept unchanged.
+func (s *HL7Server) transformMessage(message *HL7Message, clientID string) *HL7Message {
+	s.mutex.RLock()
+	transformer := s.transformer
+	s.mutex.RUnlock()
+	if transformer == nil {
+		return message
+	}
+	transformed, applied, err := transformer.Apply(message)
+	if err != nil {
+		s.reportError("transform", clientID, err)
+		return message
+	}
+	for _, rule := range applied {
+		metricTransformedMessages.Inc(rule)
+	}
+	return transformed
+}
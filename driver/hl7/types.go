@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/harusin0516/healthcare/driver/fhir"
+	"github.com/harusin0516/healthcare/driver/memwatch"
+	"github.com/harusin0516/healthcare/driver/publish"
+	"github.com/harusin0516/healthcare/driver/transport"
 )
 
 // HL7 Message Types
@@ -12,6 +17,8 @@ const (
 	HL7_MSG_ADT = "ADT" // Admission, Discharge, Transfer
 	HL7_MSG_ORU = "ORU" // Observation Result
 	HL7_MSG_ORM = "ORM" // Order Message
+	HL7_MSG_RAS = "RAS" // Pharmacy/Treatment Administration
+	HL7_MSG_RGV = "RGV" // Pharmacy/Treatment Give
 	HL7_MSG_ACK = "ACK" // Acknowledgment
 	HL7_MSG_NACK = "NAK" // Negative Acknowledgment
 )
@@ -24,19 +31,29 @@ const (
 	HL7_SEG_OBR = "OBR" // Observation Request
 	HL7_SEG_OBX = "OBX" // Observation Result
 	HL7_SEG_ORC = "ORC" // Order
+	HL7_SEG_MSA = "MSA" // Message Acknowledgment
 	HL7_SEG_AL1 = "AL1" // Allergy Information
 	HL7_SEG_DG1 = "DG1" // Diagnosis
 	HL7_SEG_PRX = "PRX" // Patient Result
+	HL7_SEG_RXA = "RXA" // Pharmacy/Treatment Administration
+	HL7_SEG_RXG = "RXG" // Pharmacy/Treatment Give
+	HL7_SEG_RXR = "RXR" // Pharmacy/Treatment Route
+	HL7_SEG_FHS = "FHS" // File Header
+	HL7_SEG_FTS = "FTS" // File Trailer
+	HL7_SEG_BHS = "BHS" // Batch Header
+	HL7_SEG_BTS = "BTS" // Batch Trailer
 )
 
 // HL7 Message Structure
 type HL7Message struct {
 	Segments []HL7Segment `json:"segments"`
 	Raw      string       `json:"raw_message"`
-	Version  string       `json:"version"`
-	Type     string       `json:"message_type"`
-	ID       string       `json:"message_id"`
+	Version  string       `json:"version"`      // MSH-12
+	Type     string       `json:"message_type"` // MSH-9.1, e.g. "ORU"; MSH().TriggerEvent() returns MSH-9.2
+	ID       string       `json:"message_id"`   // Message control ID (MSH-10)
 	Time     time.Time    `json:"timestamp"`
+	VisitNumber string    `json:"visit_number,omitempty"` // Encounter assigned by the server when PV1-19 is empty
+	Charset  string       `json:"charset,omitempty"` // MSH-18 the message was received with, if it was decoded to UTF-8
 }
 
 // HL7 Segment Structure
@@ -46,17 +63,22 @@ type HL7Segment struct {
 	Raw      string        `json:"raw_segment"`
 }
 
-// HL7 Field Structure
+// HL7 Field Structure. A field is its first repetition: Value is its first
+// component (first subcomponent) and Components its components. The
+// repetitions after the first (PID-3 with three identifiers holds two) are
+// in Repetitions, each with its own components and no repetitions.
 type HL7Field struct {
 	Value      string        `json:"value"`
 	Components []HL7Component `json:"components,omitempty"`
 	Repetitions []HL7Field   `json:"repetitions,omitempty"`
+	set        bool          // Value was set by the application rather than received (see Encode)
 }
 
-// HL7 Component Structure
+// HL7 Component Structure. Value is the first subcomponent.
 type HL7Component struct {
 	Value         string           `json:"value"`
 	Subcomponents []HL7Subcomponent `json:"subcomponents,omitempty"`
+	set           bool             // Value was set by the application rather than received (see Encode)
 }
 
 // HL7 Subcomponent Structure
@@ -77,11 +99,43 @@ type HL7Config struct {
 
 // HL7 Server Configuration
 type ServerConfig struct {
-	Host           string   `json:"host"`
+	Host           string   `json:"host"`  // Listen address; "::" or empty listens on IPv4 and IPv6
 	Port           int      `json:"port"`
+	Network        string   `json:"network"` // tcp (default, dual stack), tcp4 or tcp6 (IPv6 only)
 	Timeout        int      `json:"timeout"`
-	MaxConnections int      `json:"max_connections"`
-	AllowedIPs     []string `json:"allowed_ips"`
+	MaxConnections int      `json:"max_connections"` // 0: unlimited
+	IdleTimeout    int      `json:"idle_timeout"`    // Seconds without a message before a client is closed (0: disabled)
+	ReadTimeout    int      `json:"read_timeout"`    // Seconds to receive the rest of a message after its start block (0: timeout applies)
+	MaxMessageSize int      `json:"max_message_size"` // Bytes of one message (0: 1 MiB)
+	MaxFramingErrors int    `json:"max_framing_errors"` // MLLP framing errors before a client is closed (0: never)
+	AllowedIPs     []string `json:"allowed_ips"` // IP addresses, CIDR ranges or host names (empty: allow all)
+	DeniedIPs      []string `json:"denied_ips"`  // Rejected even if allowed
+	TLS            transport.ServerConfig `json:"tls"` // TLS on the MLLP listener; a renewed certificate is used without a restart
+	CertificateWarningDays int `json:"certificate_warning_days"` // Days before expiry when server and client certificates are reported (0: 30)
+	CrashReportDir string   `json:"crash_report_dir"` // Directory for crash reports (empty: keep in memory only)
+	Storage        StorageConfig `json:"storage"`      // Archive of received messages
+	Publisher      publish.Config `json:"publisher"`   // Event bus for parsed messages
+	Admin          AdminConfig   `json:"admin"`        // HTTP admin API
+	LogLevel       string        `json:"log_level"`    // debug, info (default), warn or error
+	BPCheck        BPCheckConfig `json:"bp_check"`     // NIBP to arterial line cross-check
+	Timeline       TimelineConfig `json:"timeline"`    // Vitals and medication timeline
+	Processing     ProcessingConfig `json:"processing"` // Worker pool and queue overflow policy
+	Duplicates     DuplicateConfig `json:"duplicates"`  // Retransmitted messages acknowledged without processing
+	LabCritical    LabCriticalConfig `json:"lab_critical"` // Critical lab result notification
+	FHIR           fhir.Config   `json:"fhir"`         // Export of observations to a FHIR R4 server
+	Orders         OrderConfig   `json:"orders"`       // ORM^O01 orders sent for internal applications
+	PatientRegistry PatientRegistryConfig `json:"patient_registry"` // Patient in every bed from ADT messages
+	Encounters     EncounterConfig `json:"encounters"`   // Visits (PV1-19) of patients from ADT messages
+	Remote         RemoteConfig  `json:"remote"`       // Encrypted buffer and sync of a remote site
+	Sync           SyncConfig    `json:"sync"`         // Remote sites the central deployment accepts messages from
+	Fleet          FleetConfig   `json:"fleet"`        // Registration with a fleet management service
+	Observer       ObserverConfig `json:"observer"`    // Shadow an interface engine without sending anything downstream
+	Router         RouterConfig  `json:"router"`       // Forwarding of messages to downstream systems (interface-engine mode)
+	Transform      TransformConfig `json:"transform"`  // Mapping rules applied to messages before storage and forwarding
+	Deidentify     DeidentifyConfig `json:"deidentify"` // Removal of patient identifiers from research outputs
+	Units          UnitsConfig   `json:"units"`        // Normalization of free-text OBX units to UCUM/MDC
+	Precision      PrecisionConfig `json:"precision"`  // Rounding of numeric OBX values per parameter
+	Memory         memwatch.Config `json:"memory"`     // Heap and subsystem growth monitoring
 }
 
 // HL7 Parser
@@ -92,15 +146,21 @@ type HL7Parser struct {
 // NewHL7Parser creates a new HL7 parser with default configuration
 func NewHL7Parser() *HL7Parser {
 	return &HL7Parser{
-		config: HL7Config{
-			Version:               "2.5",
-			Encoding:              "UTF-8",
-			FieldSeparator:        "|",
-			ComponentSeparator:    "^",
-			SubcomponentSeparator: "&",
-			RepetitionSeparator:   "~",
-			EscapeCharacter:       "\\",
-		},
+		config: DefaultHL7Config(),
+	}
+}
+
+// DefaultHL7Config returns the default configuration: HL7 2.5 with the
+// standard encoding characters |^~\&
+func DefaultHL7Config() HL7Config {
+	return HL7Config{
+		Version:               "2.5",
+		Encoding:              "UTF-8",
+		FieldSeparator:        "|",
+		ComponentSeparator:    "^",
+		SubcomponentSeparator: "&",
+		RepetitionSeparator:   "~",
+		EscapeCharacter:       "\\",
 	}
 }
 
@@ -116,6 +176,15 @@ func (p *HL7Parser) ParseMessage(rawMessage string) (*HL7Message, error) {
 	// Remove MLLP wrapper if present
 	message := p.removeMLLPWrapper(rawMessage)
 	
+	// Decode messages in another character set (MSH-18) to UTF-8
+	message, charset := decodeMessageCharset(message)
+	if charset != "" {
+		rawMessage = message
+	}
+	
+	// Use the encoding characters declared in MSH-1/MSH-2 for this message
+	parser := p.withMessageEncoding(message)
+	
 	// Split message into segments
 	segments := strings.Split(message, "\r")
 	
@@ -123,6 +192,7 @@ func (p *HL7Parser) ParseMessage(rawMessage string) (*HL7Message, error) {
 		Segments: make([]HL7Segment, 0, len(segments)),
 		Raw:      rawMessage,
 		Time:     time.Now(),
+		Charset:  charset,
 	}
 	
 	for _, segmentRaw := range segments {
@@ -131,28 +201,60 @@ func (p *HL7Parser) ParseMessage(rawMessage string) (*HL7Message, error) {
 			continue
 		}
 		
-		segment, err := p.parseSegment(segmentRaw)
+		segment, err := parser.parseSegment(segmentRaw)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse segment: %v", err)
 		}
 		
 		hl7Message.Segments = append(hl7Message.Segments, *segment)
-		
-		// Extract message header information from MSH segment
-		if segment.Type == HL7_SEG_MSH && len(segment.Fields) >= 9 {
-			hl7Message.Version = segment.Fields[8].Value
-			if len(segment.Fields) >= 10 {
-				hl7Message.Type = segment.Fields[8].Value
-			}
-			if len(segment.Fields) >= 10 {
-				hl7Message.ID = segment.Fields[9].Value
-			}
-		}
+	}
+	
+	// Extract message header information from the MSH segment by HL7
+	// position (MSH-1 is the field separator, so MSH-9 is Fields[7])
+	if msh := hl7Message.MSH(); msh != nil {
+		hl7Message.Type = msh.MessageType()
+		hl7Message.ID = msh.ControlID()
+		hl7Message.Version = msh.Version()
 	}
 	
 	return hl7Message, nil
 }
 
+// withMessageEncoding returns a parser that uses the encoding characters declared
+// in the MSH segment (MSH-1 field separator, MSH-2 component, repetition, escape
+// and subcomponent characters), or in the FHS/BHS segment of a file or batch.
+// The parser's own configuration is returned unchanged when the message does
+// not start with one of these segments.
+func (p *HL7Parser) withMessageEncoding(message string) *HL7Parser {
+	message = strings.TrimLeft(message, " \t\r\n")
+	if len(message) < 4 || !isHeaderSegment(message[:3]) {
+		return p
+	}
+	
+	config := p.config
+	config.FieldSeparator = string(message[3])
+	
+	// MSH-2 runs until the next field separator (or end of segment)
+	encoding := message[4:]
+	if end := strings.IndexAny(encoding, config.FieldSeparator+"\r\n"); end >= 0 {
+		encoding = encoding[:end]
+	}
+	
+	separators := []*string{
+		&config.ComponentSeparator,
+		&config.RepetitionSeparator,
+		&config.EscapeCharacter,
+		&config.SubcomponentSeparator,
+	}
+	for i, separator := range separators {
+		if i < len(encoding) {
+			*separator = string(encoding[i])
+		}
+	}
+	
+	return &HL7Parser{config: config}
+}
+
 // parseSegment parses a single HL7 segment
 func (p *HL7Parser) parseSegment(segmentRaw string) (*HL7Segment, error) {
 	fields := strings.Split(segmentRaw, p.config.FieldSeparator)
@@ -172,6 +274,12 @@ func (p *HL7Parser) parseSegment(segmentRaw string) (*HL7Segment, error) {
 			continue
 		}
 		
+		// MSH-2 holds the encoding characters themselves and must not be split
+		if isHeaderSegment(segment.Type) && i == 1 {
+			segment.Fields = append(segment.Fields, HL7Field{Value: fieldRaw})
+			continue
+		}
+		
 		field, err := p.parseField(fieldRaw)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse field %d: %v", i, err)
@@ -183,32 +291,37 @@ func (p *HL7Parser) parseSegment(segmentRaw string) (*HL7Segment, error) {
 	return segment, nil
 }
 
-// parseField parses a single HL7 field
+// parseField parses a single HL7 field. The field holds its first
+// repetition; every further repetition is parsed on its own into
+// Repetitions.
 func (p *HL7Parser) parseField(fieldRaw string) (*HL7Field, error) {
-	// Check for repetitions
-	if strings.Contains(fieldRaw, p.config.RepetitionSeparator) {
-		repetitions := strings.Split(fieldRaw, p.config.RepetitionSeparator)
-		field := &HL7Field{
-			Value:      repetitions[0],
-			Repetitions: make([]HL7Field, 0, len(repetitions)),
-		}
-		
-		for _, repetition := range repetitions {
-			repField, err := p.parseField(repetition)
-			if err != nil {
-				return nil, err
-			}
-			field.Repetitions = append(field.Repetitions, *repField)
+	if p.config.RepetitionSeparator == "" || !strings.Contains(fieldRaw, p.config.RepetitionSeparator) {
+		return p.parseRepetition(fieldRaw)
+	}
+	
+	repetitions := strings.Split(fieldRaw, p.config.RepetitionSeparator)
+	field, err := p.parseRepetition(repetitions[0])
+	if err != nil {
+		return nil, err
+	}
+	field.Repetitions = make([]HL7Field, 0, len(repetitions)-1)
+	for _, repetitionRaw := range repetitions[1:] {
+		repetition, err := p.parseRepetition(repetitionRaw)
+		if err != nil {
+			return nil, err
 		}
-		
-		return field, nil
+		field.Repetitions = append(field.Repetitions, *repetition)
 	}
 	
+	return field, nil
+}
+
+// parseRepetition parses one repetition of a field into its components
+func (p *HL7Parser) parseRepetition(repetitionRaw string) (*HL7Field, error) {
 	// Check for components
-	if strings.Contains(fieldRaw, p.config.ComponentSeparator) {
-		components := strings.Split(fieldRaw, p.config.ComponentSeparator)
+	if strings.Contains(repetitionRaw, p.config.ComponentSeparator) {
+		components := strings.Split(repetitionRaw, p.config.ComponentSeparator)
 		field := &HL7Field{
-			Value:      components[0],
 			Components: make([]HL7Component, 0, len(components)),
 		}
 		
@@ -219,13 +332,14 @@ func (p *HL7Parser) parseField(fieldRaw string) (*HL7Field, error) {
 			}
 			field.Components = append(field.Components, *component)
 		}
+		field.Value = field.Components[0].Value
 		
 		return field, nil
 	}
 	
 	// Simple field
 	return &HL7Field{
-		Value: fieldRaw,
+		Value: repetitionRaw,
 	}, nil
 }
 
@@ -276,9 +390,9 @@ func (m *HL7Message) ToJSON() (string, error) {
 
 // GetSegmentByType returns the first segment of the specified type
 func (m *HL7Message) GetSegmentByType(segmentType string) *HL7Segment {
-	for _, segment := range m.Segments {
-		if segment.Type == segmentType {
-			return &segment
+	for i := range m.Segments {
+		if m.Segments[i].Type == segmentType {
+			return &m.Segments[i]
 		}
 	}
 	return nil
@@ -295,30 +409,6 @@ func (m *HL7Message) GetSegmentsByType(segmentType string) []*HL7Segment {
 	return segments
 }
 
-// GetFieldValue returns the value of a specific field in a segment
-func (m *HL7Message) GetFieldValue(segmentType string, fieldIndex int) string {
-	segment := m.GetSegmentByType(segmentType)
-	if segment == nil || fieldIndex >= len(segment.Fields) {
-		return ""
-	}
-	return segment.Fields[fieldIndex].Value
-}
-
-// GetComponentValue returns the value of a specific component in a field
-func (m *HL7Message) GetComponentValue(segmentType string, fieldIndex, componentIndex int) string {
-	segment := m.GetSegmentByType(segmentType)
-	if segment == nil || fieldIndex >= len(segment.Fields) {
-		return ""
-	}
-	
-	field := segment.Fields[fieldIndex]
-	if componentIndex >= len(field.Components) {
-		return ""
-	}
-	
-	return field.Components[componentIndex].Value
-}
-
 // IsADTMessage returns true if this is an ADT message
 func (m *HL7Message) IsADTMessage() bool {
 	return m.Type == HL7_MSG_ADT
@@ -334,34 +424,51 @@ func (m *HL7Message) IsORMMessage() bool {
 	return m.Type == HL7_MSG_ORM
 }
 
-// GetPatientID returns the patient ID from PID segment
+// GetPatientID returns the patient ID from PID segment, searching the fields
+// of the message's version profile (every PID-3 repetition, then PID-2 for
+// v2.3 and v2.4)
 func (m *HL7Message) GetPatientID() string {
-	return m.GetFieldValue(HL7_SEG_PID, 2)
+	return m.Profile().PatientID(m.PID())
 }
 
 // GetPatientName returns the patient name from PID segment
 func (m *HL7Message) GetPatientName() string {
-	return m.GetFieldValue(HL7_SEG_PID, 4)
+	return m.pidFieldValue(5)
 }
 
 // GetPatientDOB returns the patient date of birth from PID segment
 func (m *HL7Message) GetPatientDOB() string {
-	return m.GetFieldValue(HL7_SEG_PID, 6)
+	return m.pidFieldValue(7)
 }
 
 // GetPatientSex returns the patient sex from PID segment
 func (m *HL7Message) GetPatientSex() string {
-	return m.GetFieldValue(HL7_SEG_PID, 7)
+	return m.pidFieldValue(8)
 }
 
-// GetAdmissionDate returns the admission date from PV1 segment
+// pidFieldValue returns a field of the PID segment by HL7 position
+func (m *HL7Message) pidFieldValue(position int) string {
+	pid := m.GetSegmentByType(HL7_SEG_PID)
+	if pid == nil {
+		return ""
+	}
+	return pid.FieldValue(position)
+}
+
+// GetAdmissionDate returns the admission date from PV1 segment (PV1-44)
 func (m *HL7Message) GetAdmissionDate() string {
-	return m.GetFieldValue(HL7_SEG_PV1, 44)
+	if pv1 := m.PV1(); pv1 != nil {
+		return pv1.AdmitDateTime()
+	}
+	return ""
 }
 
-// GetDischargeDate returns the discharge date from PV1 segment
+// GetDischargeDate returns the discharge date from PV1 segment (PV1-45)
 func (m *HL7Message) GetDischargeDate() string {
-	return m.GetFieldValue(HL7_SEG_PV1, 45)
+	if pv1 := m.PV1(); pv1 != nil {
+		return pv1.DischargeDateTime()
+	}
+	return ""
 }
 
 // GetObservationResults returns all OBX segments
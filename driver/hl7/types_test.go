@@ -0,0 +1,69 @@
+package hl7
+
+import (
+	"strings"
+	"testing"
+)
+
+// mshFields returns the fields of the MSH segment of a raw message split at
+// the field separator in MSH-1, so that MSH-n is fields[n-1], and the
+// component separator of MSH-2
+func mshFields(t *testing.T, raw string) ([]string, string) {
+	t.Helper()
+	raw = strings.Trim(raw, "\x0b\x1c\r\n")
+	line := strings.SplitN(raw, "\r", 2)[0]
+	if !strings.HasPrefix(line, "MSH") || len(line) < 5 {
+		t.Fatalf("message does not start with MSH: %q", line)
+	}
+	return strings.Split(line, line[3:4]), line[4:5]
+}
+
+func TestParseMessageHeader(t *testing.T) {
+	messages := NewSampleHL7Messages().GetAllSampleMessages()
+	// MSH-1 '#', MSH-2 '$' (component) '*' (repetition) '\' (escape) '@' (subcomponent)
+	messages["Custom_Encoding"] = "MSH#$*\\@#MONITOR#ICU#GATEWAY#HOSP#20240601120000##ORU$R01$ORU_R01#CTRL-0042#P#2.5.1\r" +
+		"PID#1##12345$$$HOSP$MR*67890$$$HOSP$PI##DOE$JOHN\r" +
+		"OBX#1#NM#8867-4$Heart rate$LN##72#/min###N\r"
+
+	parser := NewHL7Parser()
+	for name, raw := range messages {
+		t.Run(name, func(t *testing.T) {
+			message, err := parser.ParseMessage(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields, componentSeparator := mshFields(t, raw)
+			if len(fields) < 12 {
+				t.Fatalf("MSH has %d fields", len(fields))
+			}
+			wantType := strings.Split(fields[8], componentSeparator)[0] // MSH-9.1
+			wantID := fields[9]                                         // MSH-10
+			wantVersion := fields[11]                                   // MSH-12
+
+			if message.Type != wantType {
+				t.Errorf("Type = %q, want MSH-9.1 %q", message.Type, wantType)
+			}
+			if message.ID != wantID {
+				t.Errorf("ID = %q, want MSH-10 %q", message.ID, wantID)
+			}
+			if message.Version != wantVersion {
+				t.Errorf("Version = %q, want MSH-12 %q", message.Version, wantVersion)
+			}
+		})
+	}
+}
+
+func TestParseMessageCustomEncoding(t *testing.T) {
+	raw := "MSH#$*\\@#MONITOR#ICU#GATEWAY#HOSP#20240601120000##ADT$A01#CTRL-7#P#2.4\r" +
+		"PID#1##12345$$$HOSP$MR*67890$$$HOSP$PI##DOE$JOHN\r"
+	message, err := NewHL7Parser().ParseMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != "ADT" || message.ID != "CTRL-7" || message.Version != "2.4" {
+		t.Errorf("Type, ID, Version = %q, %q, %q, want ADT, CTRL-7, 2.4", message.Type, message.ID, message.Version)
+	}
+	if id := message.GetPatientID(); id != "12345" {
+		t.Errorf("GetPatientID() = %q, want the first repetition of PID-3, 12345", id)
+	}
+}
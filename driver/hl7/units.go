@@ -0,0 +1,245 @@
+package hl7
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+	"github.com/harusin0516/healthcare/driver/ucum"
+)
+
+// UnitMapping is the normalized form of a free-text unit: a UCUM code and,
+// for units with one, the MDC unit reference ID
+type UnitMapping struct {
+	UCUM string `json:"ucum"` // UCUM code (e.g. "mm[Hg]")
+	MDC  string `json:"mdc"`  // MDC unit reference ID (e.g. "MDC_DIM_MMHG")
+}
+
+// UnitsConfig configures the normalization of inbound OBX units
+type UnitsConfig struct {
+	Enabled  bool                   `json:"enabled"`
+	Mappings map[string]UnitMapping `json:"mappings"` // Free-text units added to or replacing the built-in table
+}
+
+// defaultUnitMappings maps the unit strings seen on monitor and lab feeds.
+// Keys are matched case-insensitively and without spaces (see unitKey).
+var defaultUnitMappings = map[string]UnitMapping{
+	"%":             {UCUM: "%", MDC: "MDC_DIM_PERCENT"},
+	"percent":       {UCUM: "%", MDC: "MDC_DIM_PERCENT"},
+	"mmHg":          {UCUM: "mm[Hg]", MDC: "MDC_DIM_MMHG"},
+	"mm(hg)":        {UCUM: "mm[Hg]", MDC: "MDC_DIM_MMHG"},
+	"mm[Hg]":        {UCUM: "mm[Hg]", MDC: "MDC_DIM_MMHG"},
+	"torr":          {UCUM: "mm[Hg]", MDC: "MDC_DIM_MMHG"},
+	"cmH2O":         {UCUM: "cm[H2O]", MDC: "MDC_DIM_CM_H2O"},
+	"cm(h2o)":       {UCUM: "cm[H2O]", MDC: "MDC_DIM_CM_H2O"},
+	"cm[H2O]":       {UCUM: "cm[H2O]", MDC: "MDC_DIM_CM_H2O"},
+	"bpm":           {UCUM: "/min", MDC: "MDC_DIM_BEAT_PER_MIN"},
+	"beats/min":     {UCUM: "/min", MDC: "MDC_DIM_BEAT_PER_MIN"},
+	"/min":          {UCUM: "/min"}, // Beats or breaths: no MDC unit
+	"1/min":         {UCUM: "/min"},
+	"{beats}/min":   {UCUM: "/min", MDC: "MDC_DIM_BEAT_PER_MIN"},
+	"rpm":           {UCUM: "/min", MDC: "MDC_DIM_RESP_PER_MIN"},
+	"brpm":          {UCUM: "/min", MDC: "MDC_DIM_RESP_PER_MIN"},
+	"breaths/min":   {UCUM: "/min", MDC: "MDC_DIM_RESP_PER_MIN"},
+	"{breaths}/min": {UCUM: "/min", MDC: "MDC_DIM_RESP_PER_MIN"},
+	"°C":            {UCUM: "Cel", MDC: "MDC_DIM_DEGC"},
+	"degC":          {UCUM: "Cel", MDC: "MDC_DIM_DEGC"},
+	"Cel":           {UCUM: "Cel", MDC: "MDC_DIM_DEGC"},
+	"C":             {UCUM: "Cel", MDC: "MDC_DIM_DEGC"},
+	"mV":            {UCUM: "mV", MDC: "MDC_DIM_MILLI_VOLT"},
+	"uV":            {UCUM: "uV", MDC: "MDC_DIM_MICRO_VOLT"},
+	"µV":            {UCUM: "uV", MDC: "MDC_DIM_MICRO_VOLT"},
+	"mL":            {UCUM: "mL", MDC: "MDC_DIM_MILLI_L"},
+	"cc":            {UCUM: "mL", MDC: "MDC_DIM_MILLI_L"},
+	"mL/h":          {UCUM: "mL/h", MDC: "MDC_DIM_MILLI_L_PER_HR"},
+	"mL/hr":         {UCUM: "mL/h", MDC: "MDC_DIM_MILLI_L_PER_HR"},
+	"cc/h":          {UCUM: "mL/h", MDC: "MDC_DIM_MILLI_L_PER_HR"},
+	"cc/hr":         {UCUM: "mL/h", MDC: "MDC_DIM_MILLI_L_PER_HR"},
+	"L/min":         {UCUM: "L/min", MDC: "MDC_DIM_L_PER_MIN"},
+	"lpm":           {UCUM: "L/min", MDC: "MDC_DIM_L_PER_MIN"},
+	"min":           {UCUM: "min", MDC: "MDC_DIM_MIN"},
+	"mmol/L":        {UCUM: "mmol/L"},
+	"mEq/L":         {UCUM: "meq/L"},
+	"meq/L":         {UCUM: "meq/L"},
+	"mg/dL":         {UCUM: "mg/dL"},
+	"g/dL":          {UCUM: "g/dL"},
+	"U/L":           {UCUM: "U/L"},
+	"IU/L":          {UCUM: "[IU]/L"},
+}
+
+// UnitNormalizer rewrites the free-text units (OBX-6) of inbound messages
+// as coded units before they are stored and forwarded. A unit with an MDC
+// code becomes "code^MDC_DIM_x^MDC^ucum^ucum^UCUM", the form IHE PCD
+// expects; a unit with a UCUM code only becomes "ucum^ucum^UCUM". Units
+// already coded in MDC or UCUM are left alone. It is safe for concurrent use.
+type UnitNormalizer struct {
+	mutex    sync.Mutex
+	table    map[string]UnitMapping
+	unmapped map[string]int
+}
+
+// NewUnitNormalizer creates a normalizer with the built-in table and the
+// configured mappings, which take precedence
+func NewUnitNormalizer(mappings map[string]UnitMapping) *UnitNormalizer {
+	normalizer := &UnitNormalizer{
+		table:    make(map[string]UnitMapping),
+		unmapped: make(map[string]int),
+	}
+	for unit, mapping := range defaultUnitMappings {
+		normalizer.Add(unit, mapping)
+	}
+	for unit, mapping := range mappings {
+		normalizer.Add(unit, mapping)
+	}
+	return normalizer
+}
+
+// Add maps a free-text unit, replacing any previous mapping
+func (n *UnitNormalizer) Add(unit string, mapping UnitMapping) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.table[unitKey(unit)] = mapping
+}
+
+// Lookup returns the mapping of a free-text unit
+func (n *UnitNormalizer) Lookup(unit string) (UnitMapping, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	mapping, exists := n.table[unitKey(unit)]
+	return mapping, exists
+}
+
+// Unmapped returns how often each unit without a mapping was received
+func (n *UnitNormalizer) Unmapped() map[string]int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	unmapped := make(map[string]int, len(n.unmapped))
+	for unit, count := range n.unmapped {
+		unmapped[unit] = count
+	}
+	return unmapped
+}
+
+// Normalize rewrites the units of the OBX segments of a message, updating
+// the parsed fields, the segment and the raw message, and returns a warning
+// for every unit without a mapping
+func (n *UnitNormalizer) Normalize(message *HL7Message) []string {
+	_, componentSeparator := messageSeparators(message)
+
+	var warnings []string
+	for _, obx := range message.OBXSegments() {
+		units := obx.Units()
+		if units == nil || obx.UnitCode() == "" && obx.UnitText() == "" {
+			continue
+		}
+		switch units.ComponentValue(3) {
+		case mdc.CODING_SYSTEM, ucum.CODING_SYSTEM:
+			continue
+		}
+
+		unit := obx.UnitCode()
+		mapping, exists := n.Lookup(unit)
+		if !exists && obx.UnitText() != "" {
+			unit = obx.UnitText()
+			mapping, exists = n.Lookup(unit)
+		}
+		if !exists {
+			n.mutex.Lock()
+			n.unmapped[unit]++
+			n.mutex.Unlock()
+			metricUnmappedUnits.Inc(unit)
+			warnings = append(warnings, fmt.Sprintf("OBX %s (%s): no mapping for unit %q",
+				obx.ObservationSetID(), obx.ObservationText(), unit))
+			continue
+		}
+
+		components := []string{mapping.UCUM, mapping.UCUM, ucum.CODING_SYSTEM}
+		if code, found := mdc.LookupReferenceID(mapping.MDC); found {
+			components = []string{fmt.Sprint(code.Code), code.ReferenceID, mdc.CODING_SYSTEM}
+			if mapping.UCUM != "" {
+				components = append(components, mapping.UCUM, mapping.UCUM, ucum.CODING_SYSTEM)
+			}
+		}
+		for i, component := range components {
+			obx.SetComponentValue(6, i+1, component)
+		}
+		units = obx.Units()
+		units.Components = units.Components[:len(components)]
+		setRawField(message, obx.HL7Segment, 6, strings.Join(components, componentSeparator))
+	}
+	return warnings
+}
+
+// ValidateUnits returns a problem for every OBX unit (OBX-6) of a message
+// that claims a coding system it does not conform to: a UCUM code
+// (OBX-6.3 or OBX-6.6 "UCUM") that is not a valid UCUM unit, or an MDC
+// code (OBX-6.3 "MDC") that is not an MDC unit
+func ValidateUnits(message *HL7Message) []string {
+	var problems []string
+	for _, obx := range message.OBXSegments() {
+		units := obx.Units()
+		if units == nil {
+			continue
+		}
+		for _, triplet := range []int{1, 4} {
+			code := units.ComponentValue(triplet)
+			switch units.ComponentValue(triplet + 2) {
+			case ucum.CODING_SYSTEM:
+				if err := ucum.Validate(code); err != nil {
+					problems = append(problems, fmt.Sprintf("OBX %s: %v", obx.ObservationSetID(), err))
+				}
+			case mdc.CODING_SYSTEM:
+				unit, found := mdc.LookupReferenceID(units.ComponentValue(triplet + 1))
+				if number, err := strconv.ParseUint(code, 10, 32); err == nil {
+					unit, found = mdc.Lookup(uint32(number))
+				}
+				if !found || unit.Kind != mdc.KindUnit {
+					problems = append(problems, fmt.Sprintf("OBX %s: %q is not an MDC unit", obx.ObservationSetID(), code))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// unitKey returns the lookup key of a unit: lower case without spaces
+func unitKey(unit string) string {
+	return strings.ToLower(strings.Join(strings.Fields(unit), ""))
+}
+
+// validateUnitMappings returns the problems of configured unit mappings,
+// sorted by unit
+func validateUnitMappings(mappings map[string]UnitMapping) []string {
+	units := make([]string, 0, len(mappings))
+	for unit := range mappings {
+		units = append(units, unit)
+	}
+	sort.Strings(units)
+
+	var problems []string
+	for _, unit := range units {
+		mapping := mappings[unit]
+		if strings.TrimSpace(unit) == "" {
+			problems = append(problems, "server.units.mappings must not contain an empty unit")
+		}
+		if mapping.UCUM == "" && mapping.MDC == "" {
+			problems = append(problems, fmt.Sprintf("server.units.mappings[%q] needs a ucum or mdc unit", unit))
+		}
+		if mapping.UCUM != "" {
+			if err := ucum.Validate(mapping.UCUM); err != nil {
+				problems = append(problems, fmt.Sprintf("server.units.mappings[%q].ucum must be a UCUM unit: %v", unit, err))
+			} else if strings.ContainsAny(mapping.UCUM, "|^~\\&") {
+				problems = append(problems, fmt.Sprintf("server.units.mappings[%q].ucum must not contain HL7 delimiters, got %q", unit, mapping.UCUM))
+			}
+		}
+		if mapping.MDC != "" {
+			if code, found := mdc.LookupReferenceID(mapping.MDC); !found || code.Kind != mdc.KindUnit {
+				problems = append(problems, fmt.Sprintf("server.units.mappings[%q].mdc must be an MDC unit, got %q", unit, mapping.MDC))
+			}
+		}
+	}
+	return problems
+}
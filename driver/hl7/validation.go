@@ -0,0 +1,364 @@
+package hl7
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severities of validation issues
+const (
+	VALIDATION_ERROR   = "error"   // The message does not conform
+	VALIDATION_WARNING = "warning" // Accepted, but likely a problem of the sender
+)
+
+// Kinds of validation issues
+const (
+	VALIDATION_STRUCTURE = "structure" // Missing, misplaced or malformed segment
+	VALIDATION_REQUIRED  = "required"  // Required field is empty
+	VALIDATION_DATATYPE  = "datatype"  // Value does not conform to the datatype of its field
+)
+
+// HL7_SEG_EVN is the event type segment of ADT messages
+const HL7_SEG_EVN = "EVN"
+
+// HL7 datatypes checked by ValidateMessage
+const (
+	DATATYPE_TS = "TS" // Time stamp (also DTM and DT)
+	DATATYPE_NM = "NM" // Numeric
+	DATATYPE_SI = "SI" // Sequence ID
+	DATATYPE_ID = "ID" // Coded value of an HL7 table
+)
+
+// ValidationIssue is a problem found in a message. Segment, Sequence, Field,
+// Repetition and Component locate it; the position fields are 0 when the
+// issue concerns the whole segment (or message).
+type ValidationIssue struct {
+	Severity   string `json:"severity"`
+	Kind       string `json:"kind"`
+	Segment    string `json:"segment"`              // Segment type, e.g. "PID"
+	Sequence   int    `json:"sequence,omitempty"`   // Position of the segment in the message, from 1
+	Field      int    `json:"field,omitempty"`      // HL7 field position
+	Repetition int    `json:"repetition,omitempty"` // Repetition of the field, from 1
+	Component  int    `json:"component,omitempty"`
+	Message    string `json:"message"`
+}
+
+// Position returns the HL7 position of the issue, e.g. "PID-3(2).1" for
+// the first component of the second repetition of PID-3
+func (i ValidationIssue) Position() string {
+	position := i.Segment
+	if i.Field > 0 {
+		position += fmt.Sprintf("-%d", i.Field)
+		if i.Repetition > 1 {
+			position += fmt.Sprintf("(%d)", i.Repetition)
+		}
+		if i.Component > 0 {
+			position += fmt.Sprintf(".%d", i.Component)
+		}
+	}
+	return position
+}
+
+func (i ValidationIssue) String() string {
+	return fmt.Sprintf("%s %s %s: %s", i.Severity, i.Kind, i.Position(), i.Message)
+}
+
+// datatypeRule is the datatype of a field, checked in every message
+type datatypeRule struct {
+	segment  string
+	field    int
+	datatype string
+	table    []string // Values of an ID field; others are reported as warnings
+}
+
+// HL7 tables of the coded fields that are checked
+var (
+	tableProcessingID = []string{"D", "P", "T"}                                              // 0103
+	tableSex          = []string{"A", "F", "M", "N", "O", "U"}                               // 0001
+	tablePatientClass = []string{"B", "C", "E", "I", "N", "O", "P", "R", "U"}                // 0004
+	tableResultStatus = []string{"C", "D", "F", "I", "N", "O", "P", "R", "S", "U", "W", "X"} // 0085
+	tableAckCode      = []string{"AA", "AE", "AR", "CA", "CE", "CR"}                         // 0008
+	tableCompletion   = []string{"CP", "NA", "PA", "RE"}                                     // 0322
+	tableValueType    = []string{"AD", "CE", "CF", "CK", "CN", "CNE", "CP", "CWE", "CX", "DT", "DTM", "ED",
+		"FT", "ID", "IS", "MA", "MO", "NA", "NM", "PN", "RP", "SN", "ST", "TM", "TN", "TS", "TX", "XAD",
+		"XCN", "XON", "XPN", "XTN"} // 0125
+)
+
+// datatypeRules lists the fields whose values are checked
+var datatypeRules = []datatypeRule{
+	{segment: HL7_SEG_MSH, field: 7, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_MSH, field: 11, datatype: DATATYPE_ID, table: tableProcessingID},
+	{segment: HL7_SEG_MSH, field: 13, datatype: DATATYPE_NM},
+	{segment: HL7_SEG_EVN, field: 2, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_EVN, field: 6, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_PID, field: 1, datatype: DATATYPE_SI},
+	{segment: HL7_SEG_PID, field: 7, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_PID, field: 8, datatype: DATATYPE_ID, table: tableSex},
+	{segment: HL7_SEG_PV1, field: 1, datatype: DATATYPE_SI},
+	{segment: HL7_SEG_PV1, field: 2, datatype: DATATYPE_ID, table: tablePatientClass},
+	{segment: HL7_SEG_PV1, field: 44, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_PV1, field: 45, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_OBR, field: 1, datatype: DATATYPE_SI},
+	{segment: HL7_SEG_OBR, field: 7, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_OBR, field: 8, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_OBX, field: 1, datatype: DATATYPE_SI},
+	{segment: HL7_SEG_OBX, field: 2, datatype: DATATYPE_ID, table: tableValueType},
+	{segment: HL7_SEG_OBX, field: 11, datatype: DATATYPE_ID, table: tableResultStatus},
+	{segment: HL7_SEG_OBX, field: 14, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_OBX, field: 19, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_MSA, field: 1, datatype: DATATYPE_ID, table: tableAckCode},
+	{segment: HL7_SEG_AL1, field: 1, datatype: DATATYPE_SI},
+	{segment: HL7_SEG_DG1, field: 1, datatype: DATATYPE_SI},
+	{segment: HL7_SEG_RXA, field: 3, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_RXA, field: 4, datatype: DATATYPE_TS},
+	{segment: HL7_SEG_RXA, field: 6, datatype: DATATYPE_NM},
+	{segment: HL7_SEG_RXA, field: 20, datatype: DATATYPE_ID, table: tableCompletion},
+	{segment: HL7_SEG_RXG, field: 5, datatype: DATATYPE_NM},
+}
+
+// ValidateMessage checks a message against the conformance statement of its
+// type (MSH-9.1): the required segments, in the order of the statement, and
+// the required fields of every segment present. The timestamp, numeric and
+// coded fields of datatypeRules, and OBX-5 by its value type (OBX-2), are
+// checked in every message; message types the server does not process are
+// only checked for these and for MSH. The issues are ordered by segment.
+func ValidateMessage(message *HL7Message) []ValidationIssue {
+	var issues []ValidationIssue
+	structure := func(segment string, sequence int, text string) {
+		issues = append(issues, ValidationIssue{Severity: VALIDATION_ERROR, Kind: VALIDATION_STRUCTURE, Segment: segment, Sequence: sequence, Message: text})
+	}
+
+	mshSequence := 0 // Position of the first MSH
+	for i, segment := range message.Segments {
+		switch {
+		case !validSegmentID(segment.Type):
+			structure(segment.Type, i+1, fmt.Sprintf("invalid segment ID %q (three upper case letters or digits)", segment.Type))
+		case segment.Type != HL7_SEG_MSH:
+		case mshSequence > 0:
+			structure(segment.Type, i+1, "second MSH (two messages without a separator?)")
+		case i > 0:
+			structure(segment.Type, i+1, "MSH must be the first segment")
+		}
+		if segment.Type == HL7_SEG_MSH && mshSequence == 0 {
+			mshSequence = i + 1
+		}
+	}
+
+	segments := []ConformanceSegment{conformanceMSH}
+	for _, definition := range conformanceMessages {
+		if definition.Type == message.Type {
+			segments = definition.Segments
+			break
+		}
+	}
+	issues = append(issues, validateStructure(message, segments)...)
+	for _, definition := range segments {
+		for _, field := range definition.Fields {
+			if field.Usage == USAGE_REQUIRED {
+				issues = append(issues, validateRequired(message, definition.ID, field)...)
+			}
+		}
+	}
+
+	for i := range message.Segments {
+		segment := &message.Segments[i]
+		for _, rule := range datatypeRules {
+			if rule.segment == segment.Type {
+				issues = append(issues, validateDatatype(segment, i+1, rule)...)
+			}
+		}
+		if segment.Type == HL7_SEG_OBX {
+			issues = append(issues, validateObservationValue(segment, i+1)...)
+		}
+	}
+	if msh := message.MSH(); msh != nil {
+		if msh.MessageType() != "" && msh.TriggerEvent() == "" && message.Type != HL7_MSG_ACK {
+			issues = append(issues, ValidationIssue{Severity: VALIDATION_WARNING, Kind: VALIDATION_REQUIRED, Segment: HL7_SEG_MSH,
+				Sequence: mshSequence, Field: 9, Component: 2, Message: "trigger event is empty"})
+		}
+		if version := msh.Version(); version != "" && strings.Trim(version, "0123456789.") != "" {
+			issues = append(issues, ValidationIssue{Severity: VALIDATION_WARNING, Kind: VALIDATION_DATATYPE, Segment: HL7_SEG_MSH,
+				Sequence: mshSequence, Field: 12, Message: fmt.Sprintf("version %q is not a version number", version)})
+		}
+	}
+
+	// Issues of the whole message first, then in segment order
+	sort.SliceStable(issues, func(a, b int) bool { return issues[a].Sequence < issues[b].Sequence })
+	return issues
+}
+
+// validSegmentID reports whether a segment ID is three upper case letters
+// or digits starting with a letter
+func validSegmentID(id string) bool {
+	if len(id) != 3 || id[0] < 'A' || id[0] > 'Z' {
+		return false
+	}
+	for _, c := range id[1:] {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateStructure checks that the required segments are present and
+// that the first occurrences of the segments of the statement follow its
+// order. Non-repeating segments sent more than once are reported as
+// warnings (a second MSH is reported by ValidateMessage).
+func validateStructure(message *HL7Message, segments []ConformanceSegment) []ValidationIssue {
+	var issues []ValidationIssue
+	first := make(map[string]int) // First position of each segment type, from 1
+	count := make(map[string]int)
+	for i, segment := range message.Segments {
+		if _, seen := first[segment.Type]; !seen {
+			first[segment.Type] = i + 1
+		}
+		count[segment.Type]++
+	}
+
+	previous, previousID := 0, ""
+	for _, definition := range segments {
+		position, present := first[definition.ID]
+		if !present {
+			if definition.Usage == USAGE_REQUIRED {
+				issues = append(issues, ValidationIssue{Severity: VALIDATION_ERROR, Kind: VALIDATION_STRUCTURE, Segment: definition.ID,
+					Message: fmt.Sprintf("required segment %s is missing", definition.ID)})
+			}
+			continue
+		}
+		if position < previous {
+			issues = append(issues, ValidationIssue{Severity: VALIDATION_ERROR, Kind: VALIDATION_STRUCTURE, Segment: definition.ID,
+				Sequence: position, Message: fmt.Sprintf("%s must follow %s", definition.ID, previousID)})
+		} else {
+			previous, previousID = position, definition.ID
+		}
+		if !definition.Repeating && count[definition.ID] > 1 && definition.ID != HL7_SEG_MSH {
+			issues = append(issues, ValidationIssue{Severity: VALIDATION_WARNING, Kind: VALIDATION_STRUCTURE, Segment: definition.ID,
+				Message: fmt.Sprintf("%s is sent %d times; only the first is read", definition.ID, count[definition.ID])})
+		}
+	}
+	return issues
+}
+
+// validateRequired checks a required field (e.g. "PID-3") in every
+// segment of its type. The patient ID is searched in the fields of the
+// version profile of the message.
+func validateRequired(message *HL7Message, segmentType string, field ConformanceField) []ValidationIssue {
+	position, err := strconv.Atoi(strings.TrimPrefix(field.Position, segmentType+"-"))
+	if err != nil {
+		return nil
+	}
+	var issues []ValidationIssue
+	for i := range message.Segments {
+		segment := &message.Segments[i]
+		if segment.Type != segmentType {
+			continue
+		}
+		if segmentType == HL7_SEG_PID && position == 3 {
+			if message.Profile().PatientID(&PIDSegment{segment}) != "" {
+				continue
+			}
+		} else if strings.TrimSpace(segment.FieldValue(position)) != "" {
+			continue
+		}
+		issues = append(issues, ValidationIssue{Severity: VALIDATION_ERROR, Kind: VALIDATION_REQUIRED, Segment: segmentType,
+			Sequence: i + 1, Field: position, Message: fmt.Sprintf("%s (%s) is required", field.Position, field.Name)})
+	}
+	return issues
+}
+
+// validateDatatype checks the first component of every repetition of a
+// field against its datatype
+func validateDatatype(segment *HL7Segment, sequence int, rule datatypeRule) []ValidationIssue {
+	var issues []ValidationIssue
+	for r, repetition := range segment.Repetitions(rule.field) {
+		value := repetition.ComponentValue(1)
+		if value == "" || value == `""` {
+			continue
+		}
+		severity, problem := checkDatatype(rule.datatype, value, rule.table)
+		if problem == "" {
+			continue
+		}
+		issue := ValidationIssue{Severity: severity, Kind: VALIDATION_DATATYPE, Segment: segment.Type, Sequence: sequence,
+			Field: rule.field, Repetition: r + 1, Message: problem}
+		if len(repetition.Components) > 1 {
+			issue.Component = 1
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// validateObservationValue checks every repetition of OBX-5 against the
+// value type of OBX-2
+func validateObservationValue(segment *HL7Segment, sequence int) []ValidationIssue {
+	datatype := ""
+	switch segment.FieldValue(2) {
+	case "NM":
+		datatype = DATATYPE_NM
+	case "TS", "DTM", "DT":
+		datatype = DATATYPE_TS
+	}
+	if segment.FieldValue(2) == "" && strings.TrimSpace(segment.FieldValue(5)) != "" {
+		return []ValidationIssue{{Severity: VALIDATION_WARNING, Kind: VALIDATION_REQUIRED, Segment: segment.Type, Sequence: sequence,
+			Field: 2, Message: "OBX-2 (Value Type) is empty, OBX-5 is read as text"}}
+	}
+	if datatype == "" {
+		return nil
+	}
+	var issues []ValidationIssue
+	for r, repetition := range segment.Repetitions(5) {
+		if repetition.Value == "" || repetition.Value == `""` {
+			continue
+		}
+		if severity, problem := checkDatatype(datatype, repetition.Value, nil); problem != "" {
+			issues = append(issues, ValidationIssue{Severity: severity, Kind: VALIDATION_DATATYPE, Segment: segment.Type, Sequence: sequence,
+				Field: 5, Repetition: r + 1, Message: fmt.Sprintf("%s (value type %s)", problem, segment.FieldValue(2))})
+		}
+	}
+	return issues
+}
+
+// checkDatatype returns the severity and description of a value that does
+// not conform to a datatype, or an empty description
+func checkDatatype(datatype, value string, table []string) (string, string) {
+	switch datatype {
+	case DATATYPE_TS:
+		if _, err := ParseHL7Time(value); err != nil {
+			return VALIDATION_ERROR, fmt.Sprintf("%q is not a valid timestamp (YYYY[MM[DD[HH[MM[SS[.S]]]]]][+/-ZZZZ])", value)
+		}
+	case DATATYPE_NM:
+		if !isNumeric(value) {
+			return VALIDATION_ERROR, fmt.Sprintf("%q is not a number", value)
+		}
+	case DATATYPE_SI:
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return VALIDATION_ERROR, fmt.Sprintf("%q is not a sequence ID (a non-negative integer)", value)
+		}
+	case DATATYPE_ID:
+		for _, code := range table {
+			if value == code {
+				return "", ""
+			}
+		}
+		return VALIDATION_WARNING, fmt.Sprintf("%q is not a value of the HL7 table (%s)", value, strings.Join(table, ", "))
+	}
+	return "", ""
+}
+
+// isNumeric reports whether value is an HL7 NM: an optional sign, digits
+// and an optional decimal point, without exponent
+func isNumeric(value string) bool {
+	digits := strings.TrimLeft(value, "+-")
+	if len(value)-len(digits) > 1 || digits == "" || digits == "." {
+		return false
+	}
+	if strings.Count(digits, ".") > 1 || strings.Trim(digits, "0123456789.") != "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(digits, 64)
+	return err == nil
+}
@@ -0,0 +1,158 @@
+package hl7
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Waveform value encodings (OBX-2), as in the IHE PCD Waveform Content Module
+const (
+	WAVEFORM_ENCODING_NA = "NA" // Numeric array: the physical values separated by components
+	WAVEFORM_ENCODING_ED = "ED" // Encapsulated data: the physical values as Base64 float32 little-endian
+)
+
+// Waveform OBX details
+const (
+	WAVEFORM_CODE_SAMPLE_PERIOD = "67981^MDC_ATTR_TIME_PD_SAMP^MDC" // Attribute OBX with the sample period
+	WAVEFORM_UNIT_MILLI_SEC     = "264338^MDC_DIM_MILLI_SEC^MDC"
+	WAVEFORM_NA_DECIMALS        = 3                          // Decimal places of NA values at most
+	WAVEFORM_ED_HEADER          = "^AP^octet-stream^Base64^" // ED components before the data: application data, Base64
+	WAVEFORM_TIME_FORMAT        = "20060102150405.000-0700"
+)
+
+// Waveform is a snippet of one waveform channel, e.g. a short ECG strip,
+// to report in OBX segments
+type Waveform struct {
+	Code         string    // OBX-3, e.g. 131328^MDC_ECG_ELEC_POTL^MDC
+	Unit         string    // OBX-6, e.g. 266419^MDC_DIM_MICRO_VOLT^MDC
+	SubID        string    // OBX-4 (empty: 1.0.0.n for the nth waveform)
+	SamplingRate int       // Samples per second
+	Start        time.Time // Time of the first sample (OBX-14)
+	Samples      []float64 // Physical values, NaN where the signal was not available
+	DeviceID     string    // OBX-18
+}
+
+// Validate checks the fields the OBX segments need
+func (w *Waveform) Validate() error {
+	problems := make([]string, 0)
+	if w.Code == "" {
+		problems = append(problems, "code is required")
+	}
+	if w.SamplingRate <= 0 {
+		problems = append(problems, fmt.Sprintf("sampling rate must be positive, got %d", w.SamplingRate))
+	}
+	if len(w.Samples) == 0 {
+		problems = append(problems, "samples are required")
+	}
+	if w.Start.IsZero() {
+		problems = append(problems, "start is required")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid waveform: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// WaveformOBX returns the OBX segments of a waveform: the samples as NA or
+// ED value, followed by an attribute OBX with the sample period in
+// milliseconds (OBX-4 of the waveform with ".1" appended). setID is OBX-1
+// of the first segment.
+func WaveformOBX(waveform Waveform, setID int, encoding string) ([]string, error) {
+	if err := waveform.Validate(); err != nil {
+		return nil, err
+	}
+	var value string
+	switch encoding {
+	case WAVEFORM_ENCODING_NA:
+		value = waveformNA(waveform.Samples)
+	case WAVEFORM_ENCODING_ED:
+		value = waveformED(waveform.Samples)
+	default:
+		return nil, fmt.Errorf("waveform encoding must be %s or %s, got %q", WAVEFORM_ENCODING_NA, WAVEFORM_ENCODING_ED, encoding)
+	}
+
+	subID := firstNonEmpty(waveform.SubID, "1.0.0.1")
+	start := waveform.Start.Format(WAVEFORM_TIME_FORMAT)
+	device := escapeHL7(waveform.DeviceID)
+	period := strconv.FormatFloat(roundDecimals(1000/float64(waveform.SamplingRate), WAVEFORM_NA_DECIMALS), 'f', -1, 64)
+	return []string{
+		strings.Join([]string{"OBX", strconv.Itoa(setID), encoding, waveform.Code, subID, value,
+			waveform.Unit, "", "", "", "", "F", "", "", start, "", "", "", device}, "|"),
+		strings.Join([]string{"OBX", strconv.Itoa(setID + 1), "NM", WAVEFORM_CODE_SAMPLE_PERIOD, subID + ".1", period,
+			WAVEFORM_UNIT_MILLI_SEC, "", "", "", "", "F", "", "", start, "", "", "", device}, "|"),
+	}, nil
+}
+
+// AppendWaveforms adds the OBX segments of waveforms to an ORU message,
+// e.g. one with the numeric vital signs of the same monitor, after its last
+// OBX. The message is parsed again before it is returned.
+func AppendWaveforms(message string, waveforms []Waveform, encoding string) (string, error) {
+	parsed, err := NewHL7Parser().ParseMessage(message)
+	if err != nil {
+		return "", err
+	}
+	if msh := parsed.MSH(); msh == nil || msh.MessageType() != HL7_MSG_ORU {
+		return "", fmt.Errorf("waveforms can only be added to %s messages", HL7_MSG_ORU)
+	}
+	if parsed.GetSegmentByType(HL7_SEG_OBR) == nil {
+		return "", fmt.Errorf("message has no OBR segment for the waveforms")
+	}
+
+	setID := 0
+	for _, obx := range parsed.OBXSegments() {
+		if id, err := strconv.Atoi(obx.ObservationSetID()); err == nil && id > setID {
+			setID = id
+		}
+	}
+	segments := []string{strings.TrimRight(parsed.Encode(), "\r")}
+	for i, waveform := range waveforms {
+		if waveform.SubID == "" {
+			waveform.SubID = fmt.Sprintf("1.0.0.%d", i+1)
+		}
+		obx, err := WaveformOBX(waveform, setID+1, encoding)
+		if err != nil {
+			return "", fmt.Errorf("waveform %d: %v", i+1, err)
+		}
+		segments = append(segments, obx...)
+		setID += len(obx)
+	}
+	result := strings.Join(segments, "\r") + "\r"
+
+	if _, err := NewHL7Parser().ParseMessage(result); err != nil {
+		return "", fmt.Errorf("message with waveforms is invalid: %v", err)
+	}
+	return result, nil
+}
+
+// waveformNA formats samples as an NA value; missing samples are empty
+func waveformNA(samples []float64) string {
+	values := make([]string, len(samples))
+	for i, sample := range samples {
+		if math.IsNaN(sample) || math.IsInf(sample, 0) {
+			continue
+		}
+		values[i] = strconv.FormatFloat(roundDecimals(sample, WAVEFORM_NA_DECIMALS), 'f', -1, 64)
+	}
+	return strings.Join(values, "^")
+}
+
+// waveformED formats samples as an ED value of float32 little-endian
+// values; missing samples are NaN
+func waveformED(samples []float64) string {
+	data := make([]byte, 4*len(samples))
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(float32(sample)))
+	}
+	return WAVEFORM_ED_HEADER + base64.StdEncoding.EncodeToString(data)
+}
+
+// roundDecimals rounds value to decimals decimal places
+func roundDecimals(value float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(value*scale) / scale
+}
@@ -0,0 +1,137 @@
+package mdc
+
+// codeTable lists the MDC terms used by the monitors and sample messages.
+// Codes are context-free (partition << 16 | term code) as sent in OBX-3 and OBX-6.
+var codeTable = []Code{
+	// Devices (partition 1)
+	{Code: 69965, ReferenceID: "MDC_DEV_MON_PHYSIO_MULTI_PARAM_MDS", Description: "Multi-parameter physiological monitor", Kind: KindDevice},
+	{Code: 69798, ReferenceID: "MDC_DEV_ECG_VMD", Description: "ECG", Kind: KindDevice},
+	{Code: 69799, ReferenceID: "MDC_DEV_ECG_CHAN", Description: "ECG channel", Kind: KindDevice},
+	{Code: 69854, ReferenceID: "MDC_DEV_METER_PRESS_BLD_VMD", Description: "Blood pressure", Kind: KindDevice},
+	{Code: 69855, ReferenceID: "MDC_DEV_METER_PRESS_BLD_CHAN", Description: "Blood pressure channel", Kind: KindDevice},
+	{Code: 69902, ReferenceID: "MDC_DEV_METER_TEMP_VMD", Description: "Temperature", Kind: KindDevice},
+	{Code: 69903, ReferenceID: "MDC_DEV_METER_TEMP_CHAN", Description: "Temperature channel", Kind: KindDevice},
+	{Code: 69642, ReferenceID: "MDC_DEV_ANALY_SAT_O2_VMD", Description: "Pulse oximetry", Kind: KindDevice},
+	{Code: 69643, ReferenceID: "MDC_DEV_ANALY_SAT_O2_CHAN", Description: "Pulse oximetry channel", Kind: KindDevice},
+	{Code: 69985, ReferenceID: "MDC_DEV_PUMP_INFUS_MDS", Description: "Infusion pump", Kind: KindDevice},
+	{Code: 69986, ReferenceID: "MDC_DEV_PUMP_INFUS_VMD", Description: "Infusion pump module", Kind: KindDevice},
+	{Code: 126978, ReferenceID: "MDC_DEV_PUMP_INFUS_CHAN_DELIVERY", Description: "Infusion delivery channel", Kind: KindDevice},
+
+	// ECG (partition 2)
+	{Code: 147842, ReferenceID: "MDC_ECG_HEART_RATE", Description: "Heart rate (ECG)", Kind: KindMetric, DefaultUnit: "MDC_DIM_BEAT_PER_MIN"},
+	{Code: 148066, ReferenceID: "MDC_ECG_V_P_C_RATE", Description: "Premature ventricular contraction rate", Kind: KindMetric, DefaultUnit: "MDC_DIM_BEAT_PER_MIN"},
+	{Code: 131841, ReferenceID: "MDC_ECG_AMPL_ST_I", Description: "ST level lead I", Kind: KindMetric, DefaultUnit: "MDC_DIM_MILLI_VOLT"},
+	{Code: 131328, ReferenceID: "MDC_ECG_ELEC_POTL", Description: "ECG waveform (lead unspecified)", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131329, ReferenceID: "MDC_ECG_ELEC_POTL_I", Description: "ECG waveform lead I", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131330, ReferenceID: "MDC_ECG_ELEC_POTL_II", Description: "ECG waveform lead II", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131389, ReferenceID: "MDC_ECG_ELEC_POTL_III", Description: "ECG waveform lead III", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131390, ReferenceID: "MDC_ECG_ELEC_POTL_AVR", Description: "ECG waveform lead aVR", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131391, ReferenceID: "MDC_ECG_ELEC_POTL_AVL", Description: "ECG waveform lead aVL", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131392, ReferenceID: "MDC_ECG_ELEC_POTL_AVF", Description: "ECG waveform lead aVF", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131331, ReferenceID: "MDC_ECG_ELEC_POTL_V1", Description: "ECG waveform lead V1", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131332, ReferenceID: "MDC_ECG_ELEC_POTL_V2", Description: "ECG waveform lead V2", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131333, ReferenceID: "MDC_ECG_ELEC_POTL_V3", Description: "ECG waveform lead V3", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131334, ReferenceID: "MDC_ECG_ELEC_POTL_V4", Description: "ECG waveform lead V4", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131335, ReferenceID: "MDC_ECG_ELEC_POTL_V5", Description: "ECG waveform lead V5", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+	{Code: 131336, ReferenceID: "MDC_ECG_ELEC_POTL_V6", Description: "ECG waveform lead V6", Kind: KindMetric, DefaultUnit: "MDC_DIM_MICRO_VOLT"},
+
+	// Blood pressure (partition 2)
+	{Code: 150016, ReferenceID: "MDC_PRESS_BLD", Description: "Blood pressure (site unspecified)", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150032, ReferenceID: "MDC_PRESS_BLD_ART", Description: "Arterial blood pressure", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150033, ReferenceID: "MDC_PRESS_BLD_ART_SYS", Description: "Arterial blood pressure systolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150034, ReferenceID: "MDC_PRESS_BLD_ART_DIA", Description: "Arterial blood pressure diastolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150035, ReferenceID: "MDC_PRESS_BLD_ART_MEAN", Description: "Arterial blood pressure mean", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150036, ReferenceID: "MDC_PRESS_BLD_ART_ABP", Description: "Arterial blood pressure (ABP)", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150037, ReferenceID: "MDC_PRESS_BLD_ART_ABP_SYS", Description: "ABP systolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150038, ReferenceID: "MDC_PRESS_BLD_ART_ABP_DIA", Description: "ABP diastolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150039, ReferenceID: "MDC_PRESS_BLD_ART_ABP_MEAN", Description: "ABP mean", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150044, ReferenceID: "MDC_PRESS_BLD_ART_PULM", Description: "Pulmonary artery pressure", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150045, ReferenceID: "MDC_PRESS_BLD_ART_PULM_SYS", Description: "Pulmonary artery pressure systolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150046, ReferenceID: "MDC_PRESS_BLD_ART_PULM_DIA", Description: "Pulmonary artery pressure diastolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150047, ReferenceID: "MDC_PRESS_BLD_ART_PULM_MEAN", Description: "Pulmonary artery pressure mean", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150084, ReferenceID: "MDC_PRESS_BLD_VEN_CENT", Description: "Central venous pressure", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150087, ReferenceID: "MDC_PRESS_BLD_VEN_CENT_MEAN", Description: "Central venous pressure mean", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150301, ReferenceID: "MDC_PRESS_BLD_NONINV_SYS", Description: "Non-invasive blood pressure systolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150302, ReferenceID: "MDC_PRESS_BLD_NONINV_DIA", Description: "Non-invasive blood pressure diastolic", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150303, ReferenceID: "MDC_PRESS_BLD_NONINV_MEAN", Description: "Non-invasive blood pressure mean", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 149522, ReferenceID: "MDC_BLD_PULS_RATE_INV", Description: "Pulse rate (invasive pressure)", Kind: KindMetric, DefaultUnit: "MDC_DIM_BEAT_PER_MIN"},
+
+	// Pulse oximetry, temperature and respiration (partition 2)
+	{Code: 150452, ReferenceID: "MDC_PULS_OXIM_PLETH", Description: "Plethysmogram", Kind: KindMetric, DefaultUnit: "MDC_DIM_DIMLESS"},
+	{Code: 150456, ReferenceID: "MDC_PULS_OXIM_SAT_O2", Description: "SpO2", Kind: KindMetric, DefaultUnit: "MDC_DIM_PERCENT"},
+	{Code: 149530, ReferenceID: "MDC_PULS_OXIM_PULS_RATE", Description: "Pulse rate (pulse oximetry)", Kind: KindMetric, DefaultUnit: "MDC_DIM_BEAT_PER_MIN"},
+	{Code: 150344, ReferenceID: "MDC_TEMP", Description: "Temperature", Kind: KindMetric, DefaultUnit: "MDC_DIM_DEGC"},
+	{Code: 151562, ReferenceID: "MDC_RESP_RATE", Description: "Respiration rate", Kind: KindMetric, DefaultUnit: "MDC_DIM_RESP_PER_MIN"},
+	{Code: 151708, ReferenceID: "MDC_AWAY_CO2_ET", Description: "End-tidal CO2", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 151712, ReferenceID: "MDC_CONC_AWAY_CO2_EXP", Description: "Expired CO2 concentration", Kind: KindMetric, DefaultUnit: "MDC_DIM_PERCENT"},
+	{Code: 151716, ReferenceID: "MDC_CONC_AWAY_CO2_INSP", Description: "Inspired CO2 concentration", Kind: KindMetric, DefaultUnit: "MDC_DIM_PERCENT"},
+	{Code: 155024, ReferenceID: "MDC_EEG_PAROX_CRTX_BURST_SUPPRN", Description: "EEG burst suppression ratio", Kind: KindMetric, DefaultUnit: "MDC_DIM_PERCENT"},
+
+	// Ventilation and hemodynamics (partition 2, DRI flow & volume and C.O. groups)
+	{Code: 151957, ReferenceID: "MDC_PRESS_AWAY_INSP_MAX", Description: "Peak airway pressure", Kind: KindMetric, DefaultUnit: "MDC_DIM_CM_H2O"},
+	{Code: 151976, ReferenceID: "MDC_PRESS_AWAY_END_EXP_POS", Description: "PEEP", Kind: KindMetric, DefaultUnit: "MDC_DIM_CM_H2O"},
+	{Code: 151784, ReferenceID: "MDC_PRESS_RESP_PLAT", Description: "Plateau pressure", Kind: KindMetric, DefaultUnit: "MDC_DIM_CM_H2O"},
+	{Code: 151868, ReferenceID: "MDC_VOL_AWAY_TIDAL", Description: "Tidal volume", Kind: KindMetric, DefaultUnit: "MDC_DIM_MILLI_L"},
+	{Code: 151880, ReferenceID: "MDC_VOL_MINUTE_AWAY", Description: "Minute volume", Kind: KindMetric, DefaultUnit: "MDC_DIM_L_PER_MIN"},
+	{Code: 150276, ReferenceID: "MDC_OUTPUT_CARD", Description: "Cardiac output", Kind: KindMetric, DefaultUnit: "MDC_DIM_L_PER_MIN"},
+	{Code: 150052, ReferenceID: "MDC_PRESS_BLD_ART_PULM_WEDGE", Description: "Pulmonary capillary wedge pressure", Kind: KindMetric, DefaultUnit: "MDC_DIM_MMHG"},
+	{Code: 150392, ReferenceID: "MDC_TEMP_BLD", Description: "Blood temperature", Kind: KindMetric, DefaultUnit: "MDC_DIM_DEGC"},
+
+	// Infusion pumps (partition 2, IHE PCD PIV/DEC)
+	{Code: 157784, ReferenceID: "MDC_FLOW_FLUID_PUMP", Description: "Infusion rate", Kind: KindMetric, DefaultUnit: "MDC_DIM_MILLI_L_PER_HR"},
+	{Code: 166504, ReferenceID: "MDC_VOL_FLUID_TBI", Description: "Volume to be infused (VTBI)", Kind: KindMetric, DefaultUnit: "MDC_DIM_MILLI_L"},
+	{Code: 157872, ReferenceID: "MDC_VOL_FLUID_TBI_REMAIN", Description: "Volume to be infused remaining", Kind: KindMetric, DefaultUnit: "MDC_DIM_MILLI_L"},
+	{Code: 157976, ReferenceID: "MDC_VOL_FLUID_DELIV_TOTAL", Description: "Volume delivered", Kind: KindMetric, DefaultUnit: "MDC_DIM_MILLI_L"},
+	{Code: 157916, ReferenceID: "MDC_TIME_PD_REMAIN", Description: "Infusion time remaining", Kind: KindMetric, DefaultUnit: "MDC_DIM_MIN"},
+	{Code: 184330, ReferenceID: "MDC_DRUG_NAME_TYPE", Description: "Drug name", Kind: KindMetric},
+	{Code: 184504, ReferenceID: "MDC_PUMP_STAT", Description: "Pump status", Kind: KindMetric},
+	{Code: 184512, ReferenceID: "MDC_PUMP_MODE", Description: "Pump mode", Kind: KindMetric},
+
+	// Units (partition 4)
+	{Code: 262656, ReferenceID: "MDC_DIM_DIMLESS", Description: "Dimensionless", Kind: KindUnit},
+	{Code: 262688, ReferenceID: "MDC_DIM_PERCENT", Description: "%", Kind: KindUnit},
+	{Code: 264864, ReferenceID: "MDC_DIM_BEAT_PER_MIN", Description: "bpm", Kind: KindUnit},
+	{Code: 264928, ReferenceID: "MDC_DIM_RESP_PER_MIN", Description: "breaths/min", Kind: KindUnit},
+	{Code: 266016, ReferenceID: "MDC_DIM_MMHG", Description: "mmHg", Kind: KindUnit},
+	{Code: 266048, ReferenceID: "MDC_DIM_CM_H2O", Description: "cmH2O", Kind: KindUnit},
+	{Code: 268192, ReferenceID: "MDC_DIM_DEGC", Description: "°C", Kind: KindUnit},
+	{Code: 266418, ReferenceID: "MDC_DIM_MILLI_VOLT", Description: "mV", Kind: KindUnit},
+	{Code: 266419, ReferenceID: "MDC_DIM_MICRO_VOLT", Description: "µV", Kind: KindUnit},
+	{Code: 263762, ReferenceID: "MDC_DIM_MILLI_L", Description: "mL", Kind: KindUnit},
+	{Code: 265266, ReferenceID: "MDC_DIM_MILLI_L_PER_HR", Description: "mL/h", Kind: KindUnit},
+	{Code: 265216, ReferenceID: "MDC_DIM_L_PER_MIN", Description: "L/min", Kind: KindUnit},
+	{Code: 264352, ReferenceID: "MDC_DIM_MIN", Description: "min", Kind: KindUnit},
+}
+
+// DRI waveform subrecord types (see DRI_WF_* in driver/serial)
+const (
+	driWfECG1   = 1
+	driWfECG3   = 3
+	driWfINVP1  = 4
+	driWfINVP4  = 7
+	driWfPLETH  = 8
+	driWfINVP5  = 16
+	driWfINVP6  = 17
+	driWfINVP7  = 36
+	driWfINVP8  = 37
+	driWfPLETH2 = 38
+)
+
+// ForDRIWaveform returns the MDC code for a DRI waveform subrecord type.
+// ECG channels are reported without a lead because the lead assigned to
+// ECG1-3 is configured on the monitor; invasive pressure channels are
+// reported as MDC_PRESS_BLD because their site depends on the channel label.
+func ForDRIWaveform(subrecordType int) (Code, bool) {
+	switch {
+	case subrecordType >= driWfECG1 && subrecordType <= driWfECG3:
+		return LookupReferenceID("MDC_ECG_ELEC_POTL")
+	case subrecordType >= driWfINVP1 && subrecordType <= driWfINVP4,
+		subrecordType == driWfINVP5, subrecordType == driWfINVP6,
+		subrecordType == driWfINVP7, subrecordType == driWfINVP8:
+		return LookupReferenceID("MDC_PRESS_BLD")
+	case subrecordType == driWfPLETH, subrecordType == driWfPLETH2:
+		return LookupReferenceID("MDC_PULS_OXIM_PLETH")
+	default:
+		return Code{}, false
+	}
+}
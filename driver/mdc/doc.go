@@ -0,0 +1,3 @@
+// Package mdc holds the ISO/IEEE 11073-10101 (MDC) code table and the
+// lookups used to resolve observation (OBX-3) and unit (OBX-6) codes.
+package mdc
@@ -0,0 +1,162 @@
+package mdc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ISO/IEEE 11073-10101 code partitions
+const (
+	PARTITION_OBJECT = 1 // Object infrastructure (devices: MDS, VMD, CHAN)
+	PARTITION_SCADA  = 2 // Supervisory control and data acquisition (metrics)
+	PARTITION_DIM    = 4 // Dimensions (units of measure)
+)
+
+// CODING_SYSTEM is the HL7 coding system name for MDC codes (CE/CWE component 3)
+const CODING_SYSTEM = "MDC"
+
+// Kind classifies an entry of the code table
+type Kind int
+
+const (
+	KindMetric Kind = iota // Numeric or waveform observation
+	KindDevice             // MDS, VMD or CHAN containment level
+	KindUnit               // Unit of measure
+)
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	switch k {
+	case KindMetric:
+		return "metric"
+	case KindDevice:
+		return "device"
+	case KindUnit:
+		return "unit"
+	default:
+		return "unknown"
+	}
+}
+
+// Code represents an MDC nomenclature entry
+type Code struct {
+	Code        uint32 `json:"code"`                   // Context-free code (e.g. 147842)
+	ReferenceID string `json:"reference_id"`           // Reference ID (e.g. "MDC_ECG_HEART_RATE")
+	Description string `json:"description"`            // Human readable description
+	Kind        Kind   `json:"kind"`                   // Metric, device or unit
+	DefaultUnit string `json:"default_unit,omitempty"` // Reference ID of the default unit for metrics
+}
+
+// Partition returns the code partition (upper 16 bits of the context-free code)
+func (c Code) Partition() uint16 {
+	return Partition(c.Code)
+}
+
+// TermCode returns the term code within the partition (lower 16 bits)
+func (c Code) TermCode() uint16 {
+	return TermCode(c.Code)
+}
+
+// Unit returns the default unit of a metric
+func (c Code) Unit() (Code, bool) {
+	if c.DefaultUnit == "" {
+		return Code{}, false
+	}
+	return LookupReferenceID(c.DefaultUnit)
+}
+
+// CE formats the code as an HL7 coded element ("code^reference_id^MDC")
+func (c Code) CE() string {
+	return fmt.Sprintf("%d^%s^%s", c.Code, c.ReferenceID, CODING_SYSTEM)
+}
+
+// Partition returns the partition of a context-free code
+func Partition(code uint32) uint16 {
+	return uint16(code >> 16)
+}
+
+// TermCode returns the term code of a context-free code
+func TermCode(code uint32) uint16 {
+	return uint16(code & 0xFFFF)
+}
+
+// ContextFree builds a context-free code from a partition and term code
+func ContextFree(partition, termCode uint16) uint32 {
+	return uint32(partition)<<16 | uint32(termCode)
+}
+
+var (
+	byCode        = make(map[uint32]Code)
+	byReferenceID = make(map[string]Code)
+)
+
+func init() {
+	for _, code := range codeTable {
+		byCode[code.Code] = code
+		byReferenceID[code.ReferenceID] = code
+	}
+}
+
+// Lookup returns the table entry for a context-free code
+func Lookup(code uint32) (Code, bool) {
+	entry, exists := byCode[code]
+	return entry, exists
+}
+
+// LookupReferenceID returns the table entry for a reference ID (e.g. "MDC_DIM_MMHG")
+func LookupReferenceID(referenceID string) (Code, bool) {
+	entry, exists := byReferenceID[strings.TrimSpace(referenceID)]
+	return entry, exists
+}
+
+// Describe returns the description of a code, or the reference ID if the code is unknown
+func Describe(code uint32, referenceID string) string {
+	if entry, exists := Lookup(code); exists {
+		return entry.Description
+	}
+	if entry, exists := LookupReferenceID(referenceID); exists {
+		return entry.Description
+	}
+	return referenceID
+}
+
+// Codes returns all table entries of the given kind
+func Codes(kind Kind) []Code {
+	codes := make([]Code, 0)
+	for _, code := range codeTable {
+		if code.Kind == kind {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// ParseCE resolves an HL7 coded element such as OBX-3 or OBX-6
+// ("150033^MDC_PRESS_BLD_ART_SYS^MDC"). The numeric code takes precedence;
+// the reference ID is used when the code is missing or not in the table.
+// componentSeparator is usually "^".
+func ParseCE(value, componentSeparator string) (Code, error) {
+	components := strings.Split(value, componentSeparator)
+	if len(components) >= 3 && components[2] != "" && components[2] != CODING_SYSTEM {
+		return Code{}, fmt.Errorf("unsupported coding system: %s", components[2])
+	}
+
+	if components[0] != "" {
+		number, err := strconv.ParseUint(strings.TrimSpace(components[0]), 10, 32)
+		if err != nil {
+			return Code{}, fmt.Errorf("invalid MDC code %q: %v", components[0], err)
+		}
+		if entry, exists := Lookup(uint32(number)); exists {
+			return entry, nil
+		}
+	}
+
+	if len(components) >= 2 {
+		if entry, exists := LookupReferenceID(components[1]); exists {
+			return entry, nil
+		}
+	}
+
+	return Code{}, fmt.Errorf("unknown MDC code: %s", value)
+}
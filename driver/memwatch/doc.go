@@ -0,0 +1,4 @@
+// Package memwatch samples the heap, the goroutines and the sizes of
+// registered subsystems, and reports those that grow monotonically
+// (suspected leaks).
+package memwatch
@@ -0,0 +1,278 @@
+package memwatch
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+	"github.com/harusin0516/healthcare/driver/metrics"
+)
+
+// Defaults of Config
+const (
+	DEFAULT_INTERVAL   = 60 // Seconds between samples
+	DEFAULT_WINDOW     = 60 // Samples compared for growth (an hour at the default interval)
+	DEFAULT_MIN_GROWTH = 20 // Percent growth over the window flagged as a suspected leak
+)
+
+// WINDOW_SEGMENTS is the number of parts of the window whose lowest values
+// must all rise for growth to be monotonic
+const WINDOW_SEGMENTS = 4
+
+// Built-in sources of the Go runtime
+const (
+	SOURCE_HEAP_BYTES   = "heap_bytes"   // Bytes of allocated heap objects
+	SOURCE_HEAP_OBJECTS = "heap_objects" // Allocated heap objects
+	SOURCE_GOROUTINES   = "goroutines"
+)
+
+var (
+	metricUsage = metrics.Default.NewGauge("driver_resource_usage",
+		"Latest sample of a watched resource: heap, goroutines, channel depth or object count, by source", "source")
+	metricSuspectedLeaks = metrics.Default.NewGauge("driver_suspected_leak",
+		"1 while a watched resource grows monotonically over the watch window (suspected leak), by source", "source")
+)
+
+// Config configures the monitor
+type Config struct {
+	Enabled   bool    `json:"enabled"`
+	Interval  int     `json:"interval"`   // Seconds between samples (0: 60)
+	Window    int     `json:"window"`     // Samples compared for growth (0: 60)
+	MinGrowth float64 `json:"min_growth"` // Percent growth over the window flagged as a suspected leak (0: 20)
+}
+
+// Source reports the current size of a resource: a channel depth or the
+// number of objects a subsystem holds
+type Source func() int
+
+// Suspect is a resource that grew monotonically over the window
+type Suspect struct {
+	Source string    `json:"source"`
+	First  float64   `json:"first"`  // Lowest value in the first part of the window
+	Last   float64   `json:"last"`   // Lowest value in the last part of the window
+	Growth float64   `json:"growth"` // Percent
+	Since  time.Time `json:"since"`  // Time of the first sample of the window
+}
+
+// Sample is the latest value of every source
+type Sample struct {
+	Time     time.Time          `json:"time"`
+	Values   map[string]float64 `json:"values"`
+	Suspects []Suspect          `json:"suspects,omitempty"`
+}
+
+// Monitor samples the heap, the goroutines and the registered sources at an
+// interval, publishes them as metrics and flags a resource whose lowest
+// values keep rising over the window as a suspected leak. Comparing the
+// lowest values filters out the rise and fall of the heap between garbage
+// collections and of queues under load, so that growth is flagged long
+// before memory runs out. It is safe for concurrent use.
+type Monitor struct {
+	config    Config
+	clock     clock.Clock
+	mutex     sync.Mutex
+	sources   map[string]Source
+	history   map[string][]float64 // Last Window samples, oldest first
+	times     []time.Time          // Times of the samples in history
+	suspects  map[string]Suspect
+	onSuspect func(Suspect)
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewMonitor creates a monitor of the Go runtime; subsystems are added with
+// Register
+func NewMonitor(config Config) *Monitor {
+	if config.Interval <= 0 {
+		config.Interval = DEFAULT_INTERVAL
+	}
+	if config.Window < WINDOW_SEGMENTS {
+		config.Window = DEFAULT_WINDOW
+	}
+	if config.MinGrowth <= 0 {
+		config.MinGrowth = DEFAULT_MIN_GROWTH
+	}
+	return &Monitor{
+		config:   config,
+		clock:    clock.Real,
+		sources:  make(map[string]Source),
+		history:  make(map[string][]float64),
+		suspects: make(map[string]Suspect),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// SetClock replaces the clock, e.g. with a simulated clock in tests
+func (m *Monitor) SetClock(c clock.Clock) {
+	m.clock = clock.OrReal(c)
+}
+
+// Register adds a source, replacing one of the same name
+func (m *Monitor) Register(name string, source Source) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sources[name] = source
+}
+
+// OnSuspect registers a function called when a source starts growing
+// monotonically. It is called again only after the growth stopped.
+func (m *Monitor) OnSuspect(fn func(Suspect)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.onSuspect = fn
+}
+
+// Start samples at the interval until Stop is called
+func (m *Monitor) Start() {
+	go func() {
+		ticker := m.clock.NewTicker(time.Duration(m.config.Interval) * time.Second)
+		defer ticker.Stop()
+		m.Sample()
+		for {
+			select {
+			case <-ticker.C():
+				m.Sample()
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sampling
+func (m *Monitor) Stop() {
+	m.stopOnce.Do(func() { close(m.stopChan) })
+}
+
+// Sample takes a sample of every source now and returns it
+func (m *Monitor) Sample() Sample {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	values := map[string]float64{
+		SOURCE_HEAP_BYTES:   float64(memory.HeapAlloc),
+		SOURCE_HEAP_OBJECTS: float64(memory.HeapObjects),
+		SOURCE_GOROUTINES:   float64(runtime.NumGoroutine()),
+	}
+
+	m.mutex.Lock()
+	for name, source := range m.sources {
+		values[name] = float64(source())
+	}
+	now := m.clock.Now()
+	m.times = append(m.times, now)
+	if len(m.times) > m.config.Window {
+		m.times = m.times[len(m.times)-m.config.Window:]
+	}
+	var raised []Suspect
+	for name, value := range values {
+		metricUsage.Set(value, name)
+		history := append(m.history[name], value)
+		if len(history) > m.config.Window {
+			history = history[len(history)-m.config.Window:]
+		}
+		m.history[name] = history
+
+		suspect, growing := m.growth(name, history)
+		_, flagged := m.suspects[name]
+		switch {
+		case growing && !flagged:
+			m.suspects[name] = suspect
+			metricSuspectedLeaks.Set(1, name)
+			raised = append(raised, suspect)
+		case growing:
+			m.suspects[name] = suspect
+		case flagged:
+			delete(m.suspects, name)
+			metricSuspectedLeaks.Set(0, name)
+		}
+	}
+	sample := Sample{Time: now, Values: values, Suspects: m.suspectList()}
+	onSuspect := m.onSuspect
+	m.mutex.Unlock()
+
+	if onSuspect != nil {
+		for _, suspect := range raised {
+			onSuspect(suspect)
+		}
+	}
+	return sample
+}
+
+// growth reports whether the history of a source, once the window is full,
+// grew monotonically: the lowest value of each part of the window is higher
+// than that of the part before, and the last is at least MinGrowth percent
+// above the first. The caller holds the mutex.
+func (m *Monitor) growth(name string, history []float64) (Suspect, bool) {
+	if len(history) < m.config.Window {
+		return Suspect{}, false
+	}
+	size := len(history) / WINDOW_SEGMENTS
+	lows := make([]float64, WINDOW_SEGMENTS)
+	for i := range lows {
+		part := history[i*size : (i+1)*size]
+		if i == WINDOW_SEGMENTS-1 {
+			part = history[i*size:]
+		}
+		lows[i] = part[0]
+		for _, value := range part[1:] {
+			if value < lows[i] {
+				lows[i] = value
+			}
+		}
+		if i > 0 && lows[i] <= lows[i-1] {
+			return Suspect{}, false
+		}
+	}
+	first, last := lows[0], lows[WINDOW_SEGMENTS-1]
+	growth := 100.0
+	if first > 0 {
+		growth = (last - first) / first * 100
+	}
+	if growth < m.config.MinGrowth {
+		return Suspect{}, false
+	}
+	since := time.Time{}
+	if offset := len(m.times) - len(history); offset >= 0 {
+		since = m.times[offset]
+	}
+	return Suspect{Source: name, First: first, Last: last, Growth: growth, Since: since}, true
+}
+
+// Suspects returns the sources currently growing monotonically
+func (m *Monitor) Suspects() []Suspect {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.suspectList()
+}
+
+// suspectList returns the suspects by source name. The caller holds the
+// mutex.
+func (m *Monitor) suspectList() []Suspect {
+	suspects := make([]Suspect, 0, len(m.suspects))
+	for _, suspect := range m.suspects {
+		suspects = append(suspects, suspect)
+	}
+	sort.Slice(suspects, func(i, j int) bool { return suspects[i].Source < suspects[j].Source })
+	return suspects
+}
+
+// GetStatus returns the latest values and the suspects for the driver status
+func (m *Monitor) GetStatus() map[string]interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	latest := make(map[string]float64, len(m.history))
+	for name, history := range m.history {
+		if len(history) > 0 {
+			latest[name] = history[len(history)-1]
+		}
+	}
+	return map[string]interface{}{
+		"interval": m.config.Interval,
+		"window":   m.config.Window,
+		"samples":  len(m.times),
+		"values":   latest,
+		"suspects": m.suspectList(),
+	}
+}
@@ -0,0 +1,3 @@
+// Package metrics implements Prometheus counters, gauges and histograms
+// and their text exposition format, without external libraries.
+package metrics
@@ -0,0 +1,299 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+)
+
+// CONTENT_TYPE is the Prometheus text exposition format
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram buckets suited to latencies in seconds
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Default is the registry used by the drivers and served by Handler
+var Default = NewRegistry()
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mutex   sync.RWMutex
+	metrics map[string]*metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+// metric is a named metric family with one series per label value combination
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	mutex      sync.Mutex
+	series     map[string]*series
+}
+
+// series is the value of one label value combination
+type series struct {
+	labelValues []string
+	value       float64  // Counter or gauge value, histogram sum
+	count       uint64   // Histogram observations
+	buckets     []uint64 // Histogram observations per bucket (not cumulative)
+}
+
+// Counter is a value that only increases
+type Counter struct {
+	metric *metric
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	metric *metric
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	metric *metric
+}
+
+// NewCounter registers a counter. It panics if the name is already registered.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{metric: r.register(name, help, TYPE_COUNTER, labelNames, nil)}
+}
+
+// NewGauge registers a gauge. It panics if the name is already registered.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{metric: r.register(name, help, TYPE_GAUGE, labelNames, nil)}
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds (nil
+// selects DefaultBuckets). It panics if the name is already registered.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	return &Histogram{metric: r.register(name, help, TYPE_HISTOGRAM, labelNames, sorted)}
+}
+
+// register adds a metric family
+func (r *Registry) register(name, help, kind string, labelNames []string, buckets []float64) *metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.metrics[name]; exists {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	m := &metric{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	if len(labelNames) == 0 {
+		// Unlabeled metrics are exported as zero before their first update
+		m.update(nil, func(s *series) {})
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Inc adds one to the counter for the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a non-negative value to the counter for the given label values
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	c.metric.update(labelValues, func(s *series) {
+		s.value += value
+	})
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.metric.update(labelValues, func(s *series) {
+		s.value = value
+	})
+}
+
+// Inc adds one to the gauge for the given label values
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec subtracts one from the gauge for the given label values
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Add adds value to the gauge for the given label values
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.metric.update(labelValues, func(s *series) {
+		s.value += value
+	})
+}
+
+// Observe records one observation for the given label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.metric.update(labelValues, func(s *series) {
+		s.value += value
+		s.count++
+		for i, bound := range h.metric.buckets {
+			if value <= bound {
+				s.buckets[i]++
+				break
+			}
+		}
+	})
+}
+
+// update applies fn to the series of the given label values. Missing label
+// values are treated as empty, extra values are ignored.
+func (m *metric) update(labelValues []string, fn func(s *series)) {
+	values := make([]string, len(m.labelNames))
+	copy(values, labelValues)
+	key := strings.Join(values, "\xff")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, exists := m.series[key]
+	if !exists {
+		s = &series{labelValues: values}
+		if m.kind == TYPE_HISTOGRAM {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	fn(s)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	r.Write(w)
+}
+
+// Write writes all metrics in the Prometheus text format, ordered by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]*metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mutex.RUnlock()
+
+	buffer := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffer)
+	}
+	return buffer.Flush()
+}
+
+// write writes one metric family
+func (m *metric) write(w *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		labels := m.formatLabels(s.labelValues, "", "")
+		if m.kind != TYPE_HISTOGRAM {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatValue(s.value))
+			continue
+		}
+
+		cumulative := uint64(0)
+		for i, bound := range m.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labelValues, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+// formatLabels formats label pairs, optionally followed by an extra label (le)
+func (m *metric) formatLabels(values []string, extraName, extraValue string) string {
+	if len(m.labelNames) == 0 && extraName == "" {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(m.labelNames)+1)
+	for i, name := range m.labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats a sample value
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// escapeLabel escapes a label value
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// escapeHelp escapes a help text
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
@@ -0,0 +1,3 @@
+// Package precision defines the display precision of each parameter and
+// rounds measured values to it, so that JSON, HL7 OBX-5 and reports agree.
+package precision
@@ -0,0 +1,93 @@
+package precision
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Decimal separators of report values
+const (
+	DECIMAL_POINT = "."
+	DECIMAL_COMMA = ","
+)
+
+// SIGNIFICANT_DIGITS is the number of significant digits Format keeps.
+// Values computed from measurements (scaled DRI values, unit conversions,
+// means) are not exact beyond it.
+const SIGNIFICANT_DIGITS = 15
+
+// Format formats a value in plain decimal notation without float
+// artifacts: "36.8" for 36.800000000000004, "0.3" for 0.1+0.2, "120" for
+// 120. It never uses an exponent, which HL7 NM values and most CSV readers
+// do not accept. NaN and infinities have no such representation and are
+// formatted as "".
+func Format(value float64) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ""
+	}
+	clean, err := strconv.ParseFloat(strconv.FormatFloat(value, 'g', SIGNIFICANT_DIGITS, 64), 64)
+	if err != nil || clean == 0 {
+		clean = 0 // Not -0
+	}
+	return strconv.FormatFloat(clean, 'f', -1, 64)
+}
+
+// FormatDecimals formats a value rounded (see Round) to exactly decimals
+// digits after the point ("37.0" with one decimal). NaN and infinities are
+// formatted as "".
+func FormatDecimals(value float64, decimals int) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ""
+	}
+	value = Round(value, decimals)
+	if value == 0 {
+		value = 0 // Not -0
+	}
+	return strconv.FormatFloat(value, 'f', decimals, 64)
+}
+
+// Formatter formats values for reports read by people or spreadsheets,
+// with the decimal separator of their locale. HL7 messages and JSON always
+// use Format and FormatDecimals.
+type Formatter struct {
+	DecimalSeparator string // DECIMAL_POINT (default) or DECIMAL_COMMA
+}
+
+// Format formats a value like Format with the decimal separator
+func (f Formatter) Format(value float64) string {
+	return f.localize(Format(value))
+}
+
+// FormatDecimals formats a value like FormatDecimals with the decimal
+// separator
+func (f Formatter) FormatDecimals(value float64, decimals int) string {
+	return f.localize(FormatDecimals(value, decimals))
+}
+
+// CSVDelimiter returns the field delimiter of CSV reports: a semicolon with
+// a decimal comma, as spreadsheets in those locales expect, else a comma
+func (f Formatter) CSVDelimiter() rune {
+	if f.DecimalSeparator == DECIMAL_COMMA {
+		return ';'
+	}
+	return ','
+}
+
+// localize replaces the decimal point of a formatted value
+func (f Formatter) localize(text string) string {
+	if f.DecimalSeparator == "" || f.DecimalSeparator == DECIMAL_POINT {
+		return text
+	}
+	return strings.Replace(text, DECIMAL_POINT, f.DecimalSeparator, 1)
+}
+
+// ValidDecimalSeparator reports whether separator can be used by a
+// Formatter (empty is the decimal point)
+func ValidDecimalSeparator(separator string) bool {
+	switch separator {
+	case "", DECIMAL_POINT, DECIMAL_COMMA:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package precision
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/harusin0516/healthcare/driver/mdc"
+)
+
+// MAX_DECIMALS is the largest number of decimals a parameter can be given
+const MAX_DECIMALS = 6
+
+// defaultDecimals is the display precision of the parameters and units seen
+// on the monitors. Keys are MDC reference IDs of parameters or units (a
+// parameter without an entry takes the entry of its unit), UCUM units and
+// DRI trend parameters (see serial.TrendRows).
+var defaultDecimals = map[string]int{
+	// MDC units
+	"MDC_DIM_PERCENT":        0,
+	"MDC_DIM_BEAT_PER_MIN":   0,
+	"MDC_DIM_RESP_PER_MIN":   0,
+	"MDC_DIM_MMHG":           0,
+	"MDC_DIM_CM_H2O":         0,
+	"MDC_DIM_DEGC":           1,
+	"MDC_DIM_MILLI_VOLT":     2,
+	"MDC_DIM_MICRO_VOLT":     0,
+	"MDC_DIM_MILLI_L":        1,
+	"MDC_DIM_MILLI_L_PER_HR": 1,
+	"MDC_DIM_L_PER_MIN":      1,
+	"MDC_DIM_MIN":            0,
+
+	// UCUM units of observations not coded in MDC
+	"Cel":     1,
+	"[degF]":  1,
+	"mm[Hg]":  0,
+	"cm[H2O]": 0,
+	"/min":    0,
+
+	// MDC parameters finer or coarser than their unit
+	"MDC_CONC_AWAY_CO2_EXP":  1,
+	"MDC_CONC_AWAY_CO2_INSP": 1,
+	"MDC_VOL_AWAY_TIDAL":     0,
+	"MDC_OUTPUT_CARD":        2,
+
+	// DRI trend parameters
+	"hr": 0, "hr_max": 0, "hr_min": 0,
+	"rr": 0, "ppeak": 0, "peep": 0, "pplat": 0,
+	"tv_insp": 0, "tv_exp": 0, "compliance": 1, "mv_exp": 1,
+	"o2_et": 0, "o2_fi": 0, "n2o_et": 0, "n2o_fi": 0,
+	"aa_et": 1, "aa_fi": 1, "aa_mac_sum": 1,
+	"co": 0, "blood_temp": 1, "ref": 0, "pcwp": 0,
+	"nmt_t1": 0, "nmt_tratio": 0,
+	"so2": 0, "sao2": 0, "svo2": 0,
+}
+
+// Policy rounds the values of each parameter to its display precision, so
+// that every output shows the same value (36.8 rather than
+// 36.800000000000004). A Policy is not changed after it is created and is
+// safe for concurrent use.
+type Policy struct {
+	decimals map[string]int
+}
+
+// NewPolicy creates a policy with the built-in table and the configured
+// decimals, which take precedence
+func NewPolicy(decimals map[string]int) *Policy {
+	policy := &Policy{decimals: make(map[string]int, len(defaultDecimals)+len(decimals))}
+	for key, value := range defaultDecimals {
+		policy.decimals[key] = value
+	}
+	for key, value := range decimals {
+		policy.decimals[strings.TrimSpace(key)] = value
+	}
+	return policy
+}
+
+// Decimals returns the decimals of a parameter: the entry of the parameter,
+// else the entry of unit, else the entry of the default unit of an MDC
+// parameter. Parameters without an entry are not rounded.
+func (p *Policy) Decimals(parameter, unit string) (int, bool) {
+	if p == nil {
+		return 0, false
+	}
+	if decimals, exists := p.decimals[parameter]; exists {
+		return decimals, true
+	}
+	if decimals, exists := p.decimals[unit]; exists && unit != "" {
+		return decimals, true
+	}
+	if code, found := mdc.LookupReferenceID(parameter); found && code.DefaultUnit != "" {
+		decimals, exists := p.decimals[code.DefaultUnit]
+		return decimals, exists
+	}
+	return 0, false
+}
+
+// Round rounds a value of a parameter to its decimals (half away from zero
+// in decimal, so 36.85 becomes 36.9)
+func (p *Policy) Round(parameter, unit string, value float64) float64 {
+	decimals, exists := p.Decimals(parameter, unit)
+	if !exists {
+		return value
+	}
+	return Round(value, decimals)
+}
+
+// Format formats a value of a parameter with at most its decimals, without
+// trailing zeros ("36.8", "120")
+func (p *Policy) Format(parameter, unit string, value float64) string {
+	return Format(p.Round(parameter, unit, value))
+}
+
+// Round rounds a value to a number of decimals. The value is rounded as the
+// shortest decimal that reads back as the same float, so 36.85 (stored as
+// 36.8499999...) is rounded up as it is written.
+func Round(value float64, decimals int) float64 {
+	text := strconv.FormatFloat(value, 'f', -1, 64)
+	dot := strings.IndexByte(text, '.')
+	if dot < 0 || len(text)-dot-1 <= decimals {
+		return value
+	}
+	rounded, err := strconv.ParseFloat(text[:dot+1+decimals], 64)
+	if err != nil {
+		return value
+	}
+	// Round half away from zero on the first dropped digit
+	if text[dot+1+decimals] >= '5' {
+		step := 1.0
+		for i := 0; i < decimals; i++ {
+			step /= 10
+		}
+		if value < 0 {
+			step = -step
+		}
+		rounded, _ = strconv.ParseFloat(strconv.FormatFloat(rounded+step, 'f', decimals, 64), 64)
+	}
+	if rounded == 0 {
+		return 0 // Not -0
+	}
+	return rounded
+}
@@ -0,0 +1,3 @@
+// Package publish delivers parsed HL7 messages and DRI records as JSON to
+// Kafka (through the REST Proxy) or NATS.
+package publish
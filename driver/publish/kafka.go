@@ -0,0 +1,103 @@
+package publish
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KAFKA_CONTENT_TYPE is the Kafka REST Proxy v2 embedded JSON format
+const KAFKA_CONTENT_TYPE = "application/vnd.kafka.json.v2+json"
+
+// KafkaPublisher publishes to Kafka through a Kafka REST Proxy
+// (POST /topics/{topic}), which avoids a native Kafka client dependency.
+type KafkaPublisher struct {
+	baseURL string
+	client  *http.Client
+}
+
+// kafkaRecord is one record of a REST Proxy produce request
+type kafkaRecord struct {
+	Key   *string         `json:"key,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// kafkaProduceResponse is the REST Proxy produce response
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// NewKafkaPublisher creates a publisher for the REST Proxy at baseURL
+func NewKafkaPublisher(baseURL string, timeout int) (*KafkaPublisher, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, fmt.Errorf("invalid Kafka REST Proxy URL: %s", baseURL)
+	}
+	if timeout <= 0 {
+		timeout = 5
+	}
+	return &KafkaPublisher{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}, nil
+}
+
+// Publish produces one record to topic. Records with the same key go to the same partition.
+func (p *KafkaPublisher) Publish(topic, key string, payload []byte) error {
+	if !json.Valid(payload) {
+		return fmt.Errorf("payload is not valid JSON")
+	}
+
+	record := kafkaRecord{Value: json.RawMessage(payload)}
+	if key != "" {
+		record.Key = &key
+	}
+	body, err := json.Marshal(map[string][]kafkaRecord{"records": {record}})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, p.baseURL+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", KAFKA_CONTENT_TYPE)
+	request.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to publish to Kafka: %v", err)
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Kafka REST Proxy returned %s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	var produced kafkaProduceResponse
+	if err := json.Unmarshal(responseBody, &produced); err == nil {
+		for _, offset := range produced.Offsets {
+			if offset.ErrorCode != nil {
+				return fmt.Errorf("Kafka produce error %d: %s", *offset.ErrorCode, offset.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// Close releases idle HTTP connections
+func (p *KafkaPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,237 @@
+package publish
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// NATS_DEFAULT_PORT is used when the URL has no port
+const NATS_DEFAULT_PORT = "4222"
+
+// NATS_MAX_INFO is the longest INFO greeting read from a server, in bytes
+const NATS_MAX_INFO = 64 << 10
+
+// NATS URL schemes
+const (
+	NATS_SCHEME     = "nats"
+	NATS_SCHEME_TLS = "tls" // TLS after the INFO greeting, as the server requires
+)
+
+// NATSPublisher publishes to NATS subjects using the NATS text protocol
+// (CONNECT/PUB/PING/PONG). The connection is re-established on the next
+// Publish after a write failure.
+type NATSPublisher struct {
+	url       *url.URL
+	timeout   time.Duration
+	transport transport.Config
+	dialer    *transport.Dialer
+	conn      net.Conn
+	writer    *bufio.Writer
+	mutex     sync.Mutex
+	lastErr   error
+}
+
+// NewNATSPublisher connects to the NATS server at rawURL
+func NewNATSPublisher(rawURL string, timeout int) (*NATSPublisher, error) {
+	return newNATSPublisher(rawURL, timeout, transport.Config{})
+}
+
+// newNATSPublisher connects to the NATS server at rawURL with the TLS and
+// proxy settings of settings
+func newNATSPublisher(rawURL string, timeout int, settings transport.Config) (*NATSPublisher, error) {
+	serverURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS URL: %v", err)
+	}
+	if serverURL.Scheme != NATS_SCHEME && serverURL.Scheme != NATS_SCHEME_TLS {
+		return nil, fmt.Errorf("invalid NATS URL scheme: %s", serverURL.Scheme)
+	}
+	if timeout <= 0 {
+		timeout = 5
+	}
+
+	p := &NATSPublisher{
+		url:       serverURL,
+		timeout:   time.Duration(timeout) * time.Second,
+		transport: settings,
+	}
+	// TLS is started after the greeting, not when connecting
+	settings.TLS = false
+	if p.dialer, err = settings.NewDialer(p.timeout); err != nil {
+		return nil, fmt.Errorf("NATS transport: %v", err)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// connect dials the server, reads INFO and sends CONNECT. Callers hold p.mutex.
+func (p *NATSPublisher) connect() error {
+	address := p.url.Host
+	if p.url.Port() == "" {
+		address = net.JoinHostPort(p.url.Hostname(), NATS_DEFAULT_PORT)
+	}
+
+	conn, err := p.dialer.Dial(address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS server: %v", err)
+	}
+
+	// The server greets with INFO {...} in plain text, byte by byte so that
+	// nothing of the TLS handshake that may follow is buffered
+	conn.SetReadDeadline(time.Now().Add(p.timeout))
+	line, err := readLine(conn)
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting: %q", line)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if p.url.Scheme == NATS_SCHEME_TLS || p.transport.TLS || natsRequiresTLS(line) {
+		if conn, err = p.transport.StartTLS(conn, address, p.timeout); err != nil {
+			return fmt.Errorf("failed to start TLS with NATS server: %v", err)
+		}
+	}
+	reader := bufio.NewReader(conn)
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "healthcare-driver",
+		"lang":     "go",
+	}
+	if user := p.url.User; user != nil {
+		if password, hasPassword := user.Password(); hasPassword {
+			options["user"] = user.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "CONNECT %s\r\n", connect)
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send NATS CONNECT: %v", err)
+	}
+
+	p.conn = conn
+	p.writer = writer
+	p.lastErr = nil
+	go p.readLoop(conn, reader)
+	return nil
+}
+
+// readLine reads a line ending with LF one byte at a time
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < NATS_MAX_INFO {
+		if _, err := conn.Read(b); err != nil {
+			return string(line), err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+	}
+	return string(line), fmt.Errorf("INFO longer than %d bytes", NATS_MAX_INFO)
+}
+
+// natsRequiresTLS reports whether the INFO line of a server requires TLS
+func natsRequiresTLS(info string) bool {
+	var options struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(info, "INFO"))), &options)
+	return options.TLSRequired
+}
+
+// readLoop answers server PINGs and records -ERR responses
+func (p *NATSPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		p.mutex.Lock()
+		switch {
+		case line == "PING" && p.conn == conn:
+			p.writer.WriteString("PONG\r\n")
+			p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+			p.writer.Flush()
+		case strings.HasPrefix(line, "-ERR"):
+			p.lastErr = fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// Publish sends payload to the subject topic. NATS has no partitions, so key is ignored.
+func (p *NATSPublisher) Publish(topic, key string, payload []byte) error {
+	if topic == "" || strings.ContainsAny(topic, " \t\r\n") {
+		return fmt.Errorf("invalid NATS subject: %q", topic)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.lastErr != nil {
+		err := p.lastErr
+		p.lastErr = nil
+		p.closeConn()
+		return err
+	}
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(p.writer, "PUB %s %d\r\n", topic, len(payload))
+	p.writer.Write(payload)
+	p.writer.WriteString("\r\n")
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	if err := p.writer.Flush(); err != nil {
+		p.closeConn()
+		return fmt.Errorf("failed to publish to NATS: %v", err)
+	}
+	return nil
+}
+
+// Close closes the connection
+func (p *NATSPublisher) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closeConn()
+	return nil
+}
+
+// closeConn drops the current connection. Callers hold p.mutex.
+func (p *NATSPublisher) closeConn() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+		p.writer = nil
+	}
+}
@@ -0,0 +1,204 @@
+package serial
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+)
+
+// ACM_QUEUE_SIZE is the number of alerts waiting to be sent to the alert manager
+const ACM_QUEUE_SIZE = 256
+
+// AlertSender sends alerts to an alert manager (*hl7.ACMSender)
+type AlertSender interface {
+	Send(alert hl7.ACMAlert) (string, error)
+}
+
+// ACMAlert converts an alarm event of an AlarmManager into an IHE PCD-04
+// alert. DRI colors map to the alert priority (red: PH, yellow: PM, white:
+// PL); the events of one alarm share an alert ID derived from the monitor,
+// the alarm text and the time it was raised. DRI does not tell physiological
+// from technical alarms, so every alert is reported as physiological.
+func ACMAlert(event *AlarmEventJSON) hl7.ACMAlert {
+	hash := fnv.New32a()
+	hash.Write([]byte(event.Text))
+
+	alert := hl7.ACMAlert{
+		AlertID:      fmt.Sprintf("%d-%d-%08x", event.PlugID, event.RaisedAt.UnixMilli(), hash.Sum32()),
+		Text:         event.Text,
+		Priority:     acmPriority(event.Color),
+		Kind:         hl7.ACM_KIND_PHYSIOLOGICAL,
+		State:        hl7.ACM_STATE_ACTIVE,
+		Inactivation: acmInactivation(event),
+		Time:         event.Time,
+		DeviceID:     fmt.Sprintf("%d", event.PlugID),
+	}
+	switch event.Type {
+	case ALARM_EVENT_RAISED:
+		alert.Phase = hl7.ACM_PHASE_START
+	case ALARM_EVENT_ESCALATED:
+		alert.Phase = hl7.ACM_PHASE_ESCALATE
+	case ALARM_EVENT_DEESCALATED:
+		alert.Phase = hl7.ACM_PHASE_DEESCALATE
+	case ALARM_EVENT_CLEARED:
+		alert.Phase = hl7.ACM_PHASE_END
+		alert.State = hl7.ACM_STATE_INACTIVE
+	default:
+		alert.Phase = hl7.ACM_PHASE_UPDATE
+	}
+	return alert
+}
+
+// acmPriority maps a DRI alarm color to an alert priority
+func acmPriority(color int) string {
+	switch color {
+	case DRI_PR3:
+		return hl7.ACM_PRIORITY_HIGH
+	case DRI_PR2:
+		return hl7.ACM_PRIORITY_MEDIUM
+	case DRI_PR1:
+		return hl7.ACM_PRIORITY_LOW
+	default:
+		return hl7.ACM_PRIORITY_NONE
+	}
+}
+
+// acmInactivation maps the bedside silence of a monitor to an inactivation state
+func acmInactivation(event *AlarmEventJSON) string {
+	switch {
+	case !event.Silenced:
+		return hl7.ACM_INACTIVATION_ENABLED
+	case event.SilenceInfo == DRI_SI_2MIN || event.SilenceInfo == DRI_SI_5MIN || event.SilenceInfo == DRI_SI_20S:
+		return hl7.ACM_INACTIVATION_AUDIO_PAUSED
+	default:
+		return hl7.ACM_INACTIVATION_AUDIO_OFF
+	}
+}
+
+// ACMSink sends the alarm events of an AlarmManager to an alert manager
+// (e.g. a nurse call system) as ORU^R40 messages. Events are sent in order
+// on a separate goroutine behind a bounded queue, so a slow alert manager
+// never delays the alarm manager; events are rejected when the queue is full.
+type ACMSink struct {
+	sender    AlertSender
+	queue     chan hl7.ACMAlert
+	done      chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	locations map[int]string // Bed (point of care^room^bed) by plug ID
+	devices   *hl7.DeviceRegistry
+	registry  *hl7.PatientRegistry
+	onError   func(error)
+}
+
+// NewACMSink starts sending alerts to sender (usually an *hl7.ACMSender)
+func NewACMSink(sender AlertSender) *ACMSink {
+	s := &ACMSink{
+		sender:    sender,
+		queue:     make(chan hl7.ACMAlert, ACM_QUEUE_SIZE),
+		done:      make(chan struct{}),
+		locations: make(map[int]string),
+	}
+	go s.run()
+	return s
+}
+
+// SetLocation sets the bed (point of care^room^bed) of the monitor with a plug ID
+func (s *ACMSink) SetLocation(plugID int, location string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.locations[plugID] = location
+}
+
+// SetDeviceRegistry identifies the monitors in the alerts by the EUI-64 of
+// their plug ID and places them in the bed of the registry unless SetLocation
+// sets another one (nil: alerts carry the plug ID)
+func (s *ACMSink) SetDeviceRegistry(devices *hl7.DeviceRegistry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.devices = devices
+}
+
+// SetPatientRegistry identifies the patient in the bed of each monitor in
+// the alerts (nil: alerts carry the bed only)
+func (s *ACMSink) SetPatientRegistry(registry *hl7.PatientRegistry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.registry = registry
+}
+
+// SetErrorHandler registers a callback for alerts the alert manager did not
+// accept. It runs on the sending goroutine and must not block.
+func (s *ACMSink) SetErrorHandler(handler func(error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onError = handler
+}
+
+// HandleAlarmEvent queues the alert of an alarm event
+func (s *ACMSink) HandleAlarmEvent(event *AlarmEventJSON) error {
+	alert := ACMAlert(event)
+
+	s.mutex.Lock()
+	alert.Location = s.locations[event.PlugID]
+	devices := s.devices
+	registry := s.registry
+	s.mutex.Unlock()
+	if devices != nil {
+		if identity, found := devices.Lookup(event.PlugID); found {
+			alert.DeviceID = identity.EUI64
+			if alert.Location == "" {
+				alert.Location = identity.Bed
+			}
+		}
+	}
+	if registry != nil && alert.Location != "" {
+		if patient := registry.ByLocation(alert.Location); patient != nil {
+			alert.PatientID = patient.PatientID
+			alert.FamilyName = patient.FamilyName
+			alert.GivenName = patient.GivenName
+			alert.DateOfBirth = patient.DateOfBirth
+			alert.Sex = patient.Sex
+			alert.PatientClass = patient.PatientClass
+		}
+	}
+
+	select {
+	case s.queue <- alert:
+		return nil
+	default:
+		metricACMMessages.Inc("dropped")
+		return fmt.Errorf("alert queue full, dropped %s alert %s", alert.Phase, alert.AlertID)
+	}
+}
+
+// Close stops the sending goroutine. Alerts still queued are not sent.
+func (s *ACMSink) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// run sends queued alerts until Close is called
+func (s *ACMSink) run() {
+	for {
+		select {
+		case alert := <-s.queue:
+			if _, err := s.sender.Send(alert); err != nil {
+				metricACMMessages.Inc("error")
+				s.mutex.Lock()
+				onError := s.onError
+				s.mutex.Unlock()
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+			metricACMMessages.Inc("ok")
+		case <-s.done:
+			return
+		}
+	}
+}
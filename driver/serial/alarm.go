@@ -0,0 +1,320 @@
+package serial
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alarm lifecycle event types
+const (
+	ALARM_EVENT_RAISED      = "raised"      // Alarm appeared on the monitor
+	ALARM_EVENT_ESCALATED   = "escalated"   // Alarm color rose (e.g. yellow to red)
+	ALARM_EVENT_DEESCALATED = "deescalated" // Alarm color fell
+	ALARM_EVENT_SILENCED    = "silenced"    // Alarms were silenced at the bedside while the alarm was active
+	ALARM_EVENT_UNSILENCED  = "unsilenced"  // The silence ended while the alarm was still active
+	ALARM_EVENT_CLEARED     = "cleared"     // Alarm is no longer displayed
+)
+
+// AlarmEventJSON is a change in the lifecycle of one alarm of a monitor
+type AlarmEventJSON struct {
+	Type            string    `json:"type"`
+	PlugID          int       `json:"plug_id"`
+	Text            string    `json:"text"`
+	Color           int       `json:"color"` // enum dri_alarm_color (DRI_PR1..DRI_PR3)
+	ColorName       string    `json:"color_name"`
+	PreviousColor   int       `json:"previous_color,omitempty"` // Escalated and deescalated events
+	Time            time.Time `json:"time"`                     // Record time of the change
+	RaisedAt        time.Time `json:"raised_at"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"` // Cleared events
+	Silenced        bool      `json:"silenced"`
+	SilenceInfo     int       `json:"silence_info"` // DRI_SI_* of the monitor
+}
+
+// ActiveAlarmJSON is an alarm currently displayed by a monitor
+type ActiveAlarmJSON struct {
+	Text      string    `json:"text"`
+	Color     int       `json:"color"`
+	ColorName string    `json:"color_name"`
+	RaisedAt  time.Time `json:"raised_at"`
+	Silenced  bool      `json:"silenced"`
+}
+
+// AlarmSink receives the alarm events of an AlarmManager
+type AlarmSink interface {
+	HandleAlarmEvent(event *AlarmEventJSON) error
+}
+
+// AlarmSinkFunc adapts a function to an AlarmSink
+type AlarmSinkFunc func(event *AlarmEventJSON) error
+
+// HandleAlarmEvent calls f(event)
+func (f AlarmSinkFunc) HandleAlarmEvent(event *AlarmEventJSON) error {
+	return f(event)
+}
+
+// trackedAlarm is the state of one active alarm
+type trackedAlarm struct {
+	color        byte
+	raisedAt     time.Time
+	missingSince time.Time // First record without the alarm while the clear delay runs
+}
+
+// monitorAlarms is the alarm state of one monitor
+type monitorAlarms struct {
+	alarms      map[string]*trackedAlarm // By alarm text
+	silenceInfo byte
+	lastNbr     byte
+	lastRTime   uint32
+	seen        bool
+}
+
+// AlarmManager turns the successive alarm status records of monitors into
+// alarm lifecycle events. Alarms are identified by their text: the monitor's
+// text_changed and color_changed flags refer to display slots, which shift
+// as alarms are sorted by color, so the manager compares the records itself.
+// Records repeating the previous state and retransmitted records (same r_nbr
+// and r_time) produce no events. It is safe for concurrent use.
+type AlarmManager struct {
+	mutex      sync.Mutex
+	monitors   map[uint16]*monitorAlarms // By plug ID
+	sinks      []AlarmSink
+	timeSync   *TimeSync
+	clearDelay time.Duration
+}
+
+// NewAlarmManager creates an alarm manager without sinks
+func NewAlarmManager() *AlarmManager {
+	return &AlarmManager{monitors: make(map[uint16]*monitorAlarms)}
+}
+
+// AddSink registers a sink for the alarm events. Sinks are called in order
+// from Process and must not block.
+func (m *AlarmManager) AddSink(sink AlarmSink) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sinks = append(m.sinks, sink)
+}
+
+// SetTimeSync sets the monitor clock offset applied to record times (nil: no offset)
+func (m *AlarmManager) SetTimeSync(timeSync *TimeSync) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.timeSync = timeSync
+}
+
+// SetClearDelay keeps an alarm active until it has been missing from the
+// records for delay, so that an alarm flapping on and off is reported once.
+// The default 0 clears an alarm on the first record without it.
+func (m *AlarmManager) SetClearDelay(delay time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clearDelay = delay
+}
+
+// ProcessRecord parses an alarm record (DRI_MT_ALARM) and processes its
+// alarm status subrecord (see Process)
+func (m *AlarmManager) ProcessRecord(data []byte) ([]*AlarmEventJSON, error) {
+	header, message, err := ParseAlarmStatus(data)
+	if err != nil {
+		return nil, err
+	}
+	return m.Process(header, message)
+}
+
+// Process compares an alarm status message with the previous state of its
+// monitor, passes the resulting events to the sinks and returns them. The
+// error reports sinks that failed; the events are returned regardless.
+func (m *AlarmManager) Process(header *DatexHeader, message *AlarmStatusMessage) ([]*AlarmEventJSON, error) {
+	m.mutex.Lock()
+	monitor := m.monitors[header.PlugID]
+	if monitor == nil {
+		monitor = &monitorAlarms{alarms: make(map[string]*trackedAlarm)}
+		m.monitors[header.PlugID] = monitor
+	}
+	if monitor.seen && header.RNbr == monitor.lastNbr && header.RTime == monitor.lastRTime {
+		m.mutex.Unlock()
+		return nil, nil
+	}
+	monitor.seen, monitor.lastNbr, monitor.lastRTime = true, header.RNbr, header.RTime
+
+	events := m.diff(int(header.PlugID), monitor, message, m.timeSync.RecordTime(header.RTime))
+	sinks := m.sinks
+	m.mutex.Unlock()
+
+	failures := make([]string, 0)
+	for _, event := range events {
+		metricAlarmEvents.Inc(event.Type)
+		for _, sink := range sinks {
+			if err := sink.HandleAlarmEvent(event); err != nil {
+				failures = append(failures, err.Error())
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return events, fmt.Errorf("alarm sink failed: %s", strings.Join(failures, "; "))
+	}
+	return events, nil
+}
+
+// diff updates the state of a monitor from a message and returns the events.
+// The caller must hold the lock.
+func (m *AlarmManager) diff(plugID int, monitor *monitorAlarms, message *AlarmStatusMessage, t time.Time) []*AlarmEventJSON {
+	silenced := message.SilenceInfo != DRI_SI_NONE
+	silenceChanged := message.SilenceInfo != monitor.silenceInfo
+	monitor.silenceInfo = message.SilenceInfo
+
+	newEvent := func(eventType, text string, alarm *trackedAlarm) *AlarmEventJSON {
+		return &AlarmEventJSON{
+			Type:        eventType,
+			PlugID:      plugID,
+			Text:        text,
+			Color:       int(alarm.color),
+			ColorName:   alarmColorName(alarm.color),
+			Time:        t,
+			RaisedAt:    alarm.raisedAt,
+			Silenced:    silenced,
+			SilenceInfo: int(message.SilenceInfo),
+		}
+	}
+
+	// The same text in several slots is one alarm at its highest color
+	current := make(map[string]byte)
+	order := make([]string, 0, len(message.AlDisp))
+	for i := range message.AlDisp {
+		display := &message.AlDisp[i]
+		text := strings.TrimSpace(display.GetAlarmText())
+		if !display.IsActiveAlarm() || text == "" {
+			continue
+		}
+		if color, exists := current[text]; !exists {
+			order = append(order, text)
+		} else if color >= display.Color {
+			continue
+		}
+		current[text] = display.Color
+	}
+
+	events := make([]*AlarmEventJSON, 0)
+	for _, text := range order {
+		color := current[text]
+		alarm, exists := monitor.alarms[text]
+		switch {
+		case !exists:
+			alarm = &trackedAlarm{color: color, raisedAt: t}
+			monitor.alarms[text] = alarm
+			events = append(events, newEvent(ALARM_EVENT_RAISED, text, alarm))
+			continue
+		case color != alarm.color:
+			eventType := ALARM_EVENT_ESCALATED
+			if color < alarm.color {
+				eventType = ALARM_EVENT_DEESCALATED
+			}
+			previous := alarm.color
+			alarm.color = color
+			event := newEvent(eventType, text, alarm)
+			event.PreviousColor = int(previous)
+			events = append(events, event)
+		}
+		alarm.missingSince = time.Time{}
+		if silenceChanged {
+			if silenced {
+				events = append(events, newEvent(ALARM_EVENT_SILENCED, text, alarm))
+			} else {
+				events = append(events, newEvent(ALARM_EVENT_UNSILENCED, text, alarm))
+			}
+		}
+	}
+
+	cleared := make([]string, 0)
+	for text, alarm := range monitor.alarms {
+		if _, active := current[text]; active {
+			continue
+		}
+		if alarm.missingSince.IsZero() {
+			alarm.missingSince = t
+		}
+		if t.Sub(alarm.missingSince) >= m.clearDelay {
+			cleared = append(cleared, text)
+		}
+	}
+	sort.Strings(cleared)
+	for _, text := range cleared {
+		alarm := monitor.alarms[text]
+		event := newEvent(ALARM_EVENT_CLEARED, text, alarm)
+		event.Time = alarm.missingSince
+		event.DurationSeconds = alarm.missingSince.Sub(alarm.raisedAt).Seconds()
+		events = append(events, event)
+		delete(monitor.alarms, text)
+	}
+	return events
+}
+
+// Active returns the alarms currently displayed by a monitor, highest color first
+func (m *AlarmManager) Active(plugID uint16) []ActiveAlarmJSON {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	active := make([]ActiveAlarmJSON, 0)
+	monitor := m.monitors[plugID]
+	if monitor == nil {
+		return active
+	}
+	for text, alarm := range monitor.alarms {
+		active = append(active, ActiveAlarmJSON{
+			Text:      text,
+			Color:     int(alarm.color),
+			ColorName: alarmColorName(alarm.color),
+			RaisedAt:  alarm.raisedAt,
+			Silenced:  monitor.silenceInfo != DRI_SI_NONE,
+		})
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].Color != active[j].Color {
+			return active[i].Color > active[j].Color
+		}
+		return active[i].RaisedAt.Before(active[j].RaisedAt)
+	})
+	return active
+}
+
+// Forget discards the alarm state of a monitor (e.g. when it is unplugged)
+// without emitting events
+func (m *AlarmManager) Forget(plugID uint16) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.monitors, plugID)
+}
+
+// ParseAlarmStatus returns the header and the alarm status subrecord of an
+// alarm record (DRI_MT_ALARM)
+func ParseAlarmStatus(data []byte) (*DatexHeader, *AlarmStatusMessage, error) {
+	header, subrecords, err := ValidateRecord(data)
+	if err != nil {
+		return header, nil, err
+	}
+	if header.RMainType != DRI_MT_ALARM {
+		return nil, nil, fmt.Errorf("expected alarm record type %d, got %d", DRI_MT_ALARM, header.RMainType)
+	}
+	for _, subrecord := range subrecords {
+		if subrecord.Type == DRI_AL_STATUS {
+			message := &AlarmStatusMessage{}
+			if err := ValidateSubrecordSize(subrecord, message.Size()); err != nil {
+				return header, nil, err
+			}
+			if err := message.UnmarshalBinary(subrecord.Data); err != nil {
+				return header, nil, err
+			}
+			return header, message, nil
+		}
+	}
+	return header, nil, fmt.Errorf("alarm record has no alarm status subrecord")
+}
+
+// alarmColorName returns the name of an alarm color (e.g. "Red")
+func alarmColorName(color byte) string {
+	display := AlarmDisplay{Color: color}
+	return display.GetAlarmColor()
+}
@@ -0,0 +1,159 @@
+package serial
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CALIBRATION_ALL_MONITORS is the plug ID of calibrations that apply to every monitor
+const CALIBRATION_ALL_MONITORS = 0
+
+// Calibration is a site-specific correction of one signal of one monitor.
+// Corrected values are value*Gain + Offset, in the signal's physical unit.
+type Calibration struct {
+	PlugID int     `json:"plug_id"`          // Monitor plug ID, 0 for all monitors
+	Signal string  `json:"signal"`           // Channel key, e.g. "INVP1" (see GetWaveformChannelKey)
+	Gain   float64 `json:"gain"`             // Multiplier, 0 is treated as 1
+	Offset float64 `json:"offset"`           // Added after the gain, e.g. -3.5 for a transducer reading 3.5 mmHg high
+	Reason string  `json:"reason,omitempty"` // Why the correction exists (who measured it, when)
+}
+
+// CalibrationJSON annotates a waveform whose values were corrected
+type CalibrationJSON struct {
+	PlugID int     `json:"plug_id"` // Plug ID of the calibration entry (0: all monitors)
+	Signal string  `json:"signal"`
+	Gain   float64 `json:"gain"`
+	Offset float64 `json:"offset"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// calibrationKey identifies a calibration entry
+type calibrationKey struct {
+	plugID int
+	signal string
+}
+
+// CalibrationTable holds the calibrations of an installation. It is safe for
+// concurrent use, so entries can be changed while parsers are running.
+type CalibrationTable struct {
+	mutex   sync.RWMutex
+	entries map[calibrationKey]Calibration
+}
+
+// NewCalibrationTable creates a calibration table
+func NewCalibrationTable(calibrations ...Calibration) (*CalibrationTable, error) {
+	t := &CalibrationTable{entries: make(map[calibrationKey]Calibration)}
+	for _, calibration := range calibrations {
+		if err := t.Set(calibration); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// LoadCalibrationTable reads a calibration table from a JSON file of the form
+// {"calibrations": [{"plug_id": 1234, "signal": "INVP1", "offset": -3.5}]}
+func LoadCalibrationTable(filename string) (*CalibrationTable, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read calibration file: %w", err)
+	}
+
+	var file struct {
+		Calibrations []Calibration `json:"calibrations"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode calibration file: %w", err)
+	}
+
+	return NewCalibrationTable(file.Calibrations...)
+}
+
+// Set adds or replaces the calibration of a signal
+func (t *CalibrationTable) Set(calibration Calibration) error {
+	calibration.Signal = strings.ToUpper(strings.TrimSpace(calibration.Signal))
+	if calibration.Signal == "" {
+		return fmt.Errorf("calibration for plug %d has no signal", calibration.PlugID)
+	}
+	if calibration.PlugID < 0 {
+		return fmt.Errorf("calibration for %s has invalid plug ID %d", calibration.Signal, calibration.PlugID)
+	}
+	if calibration.Gain == 0 {
+		calibration.Gain = 1
+	}
+	if math.IsNaN(calibration.Gain) || math.IsInf(calibration.Gain, 0) || math.IsNaN(calibration.Offset) || math.IsInf(calibration.Offset, 0) {
+		return fmt.Errorf("calibration for plug %d %s has a non-finite gain or offset", calibration.PlugID, calibration.Signal)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entries[calibrationKey{calibration.PlugID, calibration.Signal}] = calibration
+	return nil
+}
+
+// Remove deletes the calibration of a signal
+func (t *CalibrationTable) Remove(plugID int, signal string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.entries, calibrationKey{plugID, strings.ToUpper(signal)})
+}
+
+// Lookup returns the calibration of a signal of a monitor. An entry for the
+// monitor takes precedence over an entry for all monitors.
+func (t *CalibrationTable) Lookup(plugID int, signal string) (Calibration, bool) {
+	if t == nil {
+		return Calibration{}, false
+	}
+	signal = strings.ToUpper(signal)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if calibration, exists := t.entries[calibrationKey{plugID, signal}]; exists {
+		return calibration, true
+	}
+	calibration, exists := t.entries[calibrationKey{CALIBRATION_ALL_MONITORS, signal}]
+	return calibration, exists
+}
+
+// Calibrations returns all entries ordered by plug ID and signal
+func (t *CalibrationTable) Calibrations() []Calibration {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	calibrations := make([]Calibration, 0, len(t.entries))
+	for _, calibration := range t.entries {
+		calibrations = append(calibrations, calibration)
+	}
+	sort.Slice(calibrations, func(i, j int) bool {
+		if calibrations[i].PlugID != calibrations[j].PlugID {
+			return calibrations[i].PlugID < calibrations[j].PlugID
+		}
+		return calibrations[i].Signal < calibrations[j].Signal
+	})
+	return calibrations
+}
+
+// Apply corrects a physical value. NaN (control codes, invalid data) is returned unchanged.
+func (c Calibration) Apply(value float64) float64 {
+	if math.IsNaN(value) {
+		return value
+	}
+	return value*c.Gain + c.Offset
+}
+
+// ToJSON returns the provenance annotation of the calibration
+func (c Calibration) ToJSON() *CalibrationJSON {
+	return &CalibrationJSON{
+		PlugID: c.PlugID,
+		Signal: c.Signal,
+		Gain:   c.Gain,
+		Offset: c.Offset,
+		Reason: c.Reason,
+	}
+}
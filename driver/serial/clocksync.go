@@ -0,0 +1,268 @@
+package serial
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+)
+
+// Clock synchronization defaults
+const (
+	CLOCK_SYNC_THRESHOLD = 2 * time.Second // Drift corrected by SyncClock
+	CLOCK_SYNC_INTERVAL  = time.Minute     // Interval of SyncClock
+	CLOCK_SYNC_WINDOW    = 30              // Records per monitor used to estimate the drift
+	CLOCK_SYNC_RECENT    = 100             // Adjustments kept for Adjustments
+)
+
+// Clock adjustment methods
+const (
+	CLOCK_ADJUST_MONITOR = "monitor" // The monitor clock was set by the ClockSetter
+	CLOCK_ADJUST_OFFSET  = "offset"  // The TimeSync offset of the monitor was changed
+)
+
+// ClockSetter sets the clock of a monitor to now. The S/5 DRI record
+// specification (8005313) and computer interface specification (M1017617)
+// define no record for setting the monitor clock, so the serial interface
+// has no setter; a transport that can set the clock, e.g. the central
+// station of a network interface, implements it.
+type ClockSetter interface {
+	SetMonitorClock(plugID int, now time.Time) error
+}
+
+// ClockSetterFunc adapts a function to a ClockSetter
+type ClockSetterFunc func(plugID int, now time.Time) error
+
+// SetMonitorClock calls f(plugID, now)
+func (f ClockSetterFunc) SetMonitorClock(plugID int, now time.Time) error {
+	return f(plugID, now)
+}
+
+// ClockAdjustment is a correction of the clock of a monitor
+type ClockAdjustment struct {
+	PlugID          int       `json:"plug_id"`
+	Time            time.Time `json:"time"`
+	Method          string    `json:"method"`           // monitor or offset
+	DriftSeconds    float64   `json:"drift_seconds"`    // Estimated drift beyond the previous offset
+	PreviousSeconds float64   `json:"previous_seconds"` // TimeSync offset before the adjustment
+	OffsetSeconds   float64   `json:"offset_seconds"`   // TimeSync offset after the adjustment
+	Error           string    `json:"error,omitempty"`  // Why the monitor clock could not be set
+}
+
+// monitorClock is the drift estimate of one monitor
+type monitorClock struct {
+	timeSync *TimeSync
+	lags     []time.Duration // Arrival time minus r_time of the most recent records
+}
+
+// ClockSync estimates the drift of the clocks of monitors from the r_time of
+// their records and corrects it when it exceeds a threshold. Arrival time
+// minus r_time is the clock offset plus the transmission delay and the
+// truncation of r_time to whole seconds, so the smallest value of recent
+// records estimates the offset. A monitor clock set back by hand is noticed
+// once its earlier records have left the window (CLOCK_SYNC_WINDOW records).
+// A correction sets the monitor clock if a ClockSetter is configured and
+// otherwise (or if setting fails) changes the TimeSync offset of the
+// monitor, which parsers and the alarm manager apply to record times. It is
+// safe for concurrent use.
+type ClockSync struct {
+	mutex       sync.Mutex
+	clock       clock.Clock
+	logger      *log.Logger
+	threshold   time.Duration
+	setter      ClockSetter
+	monitors    map[int]*monitorClock
+	adjustments []ClockAdjustment
+}
+
+// NewClockSync creates a clock synchronization correcting drift beyond
+// threshold (CLOCK_SYNC_THRESHOLD if threshold is 0)
+func NewClockSync(threshold time.Duration) *ClockSync {
+	if threshold <= 0 {
+		threshold = CLOCK_SYNC_THRESHOLD
+	}
+	return &ClockSync{
+		clock:     clock.Real,
+		logger:    log.New(os.Stdout, "[DRI-CLOCK] ", log.LstdFlags),
+		threshold: threshold,
+		monitors:  make(map[int]*monitorClock),
+	}
+}
+
+// SetClock sets the reference clock (tests use a simulated clock)
+func (c *ClockSync) SetClock(clk clock.Clock) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clock = clock.OrReal(clk)
+}
+
+// SetLogger replaces the logger of the adjustments (use io.Discard to silence output)
+func (c *ClockSync) SetLogger(logger *log.Logger) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.logger = logger
+}
+
+// SetClockSetter sets the monitor clocks through setter (nil: correct TimeSync offsets only)
+func (c *ClockSync) SetClockSetter(setter ClockSetter) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setter = setter
+}
+
+// TimeSync returns the clock offset of a monitor, to be set on its parsers
+// and on the alarm manager
+func (c *ClockSync) TimeSync(plugID int) *TimeSync {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.monitor(plugID).timeSync
+}
+
+// Observe records the r_time of a record received now
+func (c *ClockSync) Observe(header *DatexHeader) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lag := c.clock.Now().Sub(time.Unix(int64(header.RTime), 0))
+	monitor := c.monitor(int(header.PlugID))
+	monitor.lags = append(monitor.lags, lag)
+	if len(monitor.lags) > CLOCK_SYNC_WINDOW {
+		monitor.lags = monitor.lags[len(monitor.lags)-CLOCK_SYNC_WINDOW:]
+	}
+}
+
+// Drift returns the estimated drift of a monitor beyond its current
+// TimeSync offset, false if no record of the monitor was observed
+func (c *ClockSync) Drift(plugID int) (time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	monitor, exists := c.monitors[plugID]
+	if !exists || len(monitor.lags) == 0 {
+		return 0, false
+	}
+	return monitor.estimate() - monitor.timeSync.Offset(), true
+}
+
+// Check corrects every monitor whose drift exceeds the threshold and
+// returns the adjustments made
+func (c *ClockSync) Check() []ClockAdjustment {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	plugIDs := make([]int, 0, len(c.monitors))
+	for plugID := range c.monitors {
+		plugIDs = append(plugIDs, plugID)
+	}
+	sort.Ints(plugIDs)
+
+	var adjustments []ClockAdjustment
+	for _, plugID := range plugIDs {
+		monitor := c.monitors[plugID]
+		if len(monitor.lags) == 0 {
+			continue
+		}
+		estimate := monitor.estimate()
+		previous := monitor.timeSync.Offset()
+		drift := estimate - previous
+		if drift <= c.threshold && drift >= -c.threshold {
+			continue
+		}
+
+		adjustment := ClockAdjustment{
+			PlugID:          plugID,
+			Time:            c.clock.Now(),
+			Method:          CLOCK_ADJUST_OFFSET,
+			DriftSeconds:    drift.Seconds(),
+			PreviousSeconds: previous.Seconds(),
+			OffsetSeconds:   estimate.Seconds(),
+		}
+		offset := estimate
+		if c.setter != nil {
+			if err := c.setter.SetMonitorClock(plugID, adjustment.Time); err != nil {
+				adjustment.Error = err.Error()
+			} else {
+				// Records sent after the monitor clock was set need no offset
+				adjustment.Method = CLOCK_ADJUST_MONITOR
+				adjustment.OffsetSeconds = 0
+				offset = 0
+				monitor.lags = nil
+			}
+		}
+		monitor.timeSync.SetOffset(offset)
+		metricClockAdjustments.Inc(adjustment.Method)
+		c.log(adjustment)
+
+		adjustments = append(adjustments, adjustment)
+		c.adjustments = append(c.adjustments, adjustment)
+		if len(c.adjustments) > CLOCK_SYNC_RECENT {
+			c.adjustments = c.adjustments[len(c.adjustments)-CLOCK_SYNC_RECENT:]
+		}
+	}
+	return adjustments
+}
+
+// SyncClock checks the drift of the monitors every interval
+// (CLOCK_SYNC_INTERVAL if interval is 0) until ctx is done
+func (c *ClockSync) SyncClock(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = CLOCK_SYNC_INTERVAL
+	}
+	c.mutex.Lock()
+	ticker := c.clock.NewTicker(interval)
+	c.mutex.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			c.Check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Adjustments returns the most recent adjustments, oldest first
+func (c *ClockSync) Adjustments() []ClockAdjustment {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]ClockAdjustment(nil), c.adjustments...)
+}
+
+// monitor returns the state of a monitor, creating it if needed
+func (c *ClockSync) monitor(plugID int) *monitorClock {
+	monitor, exists := c.monitors[plugID]
+	if !exists {
+		monitor = &monitorClock{timeSync: NewTimeSync(0)}
+		c.monitors[plugID] = monitor
+	}
+	return monitor
+}
+
+// log writes an adjustment to the logger
+func (c *ClockSync) log(adjustment ClockAdjustment) {
+	if c.logger == nil {
+		return
+	}
+	if adjustment.Error != "" {
+		c.logger.Printf("Failed to set the clock of monitor %d: %s", adjustment.PlugID, adjustment.Error)
+	}
+	c.logger.Printf("Monitor %d clock drift %+.1fs exceeds %v, corrected by %s (offset %+.1fs -> %+.1fs)",
+		adjustment.PlugID, adjustment.DriftSeconds, c.threshold, adjustment.Method,
+		adjustment.PreviousSeconds, adjustment.OffsetSeconds)
+}
+
+// estimate returns the smallest lag of the recent records, the best
+// estimate of the clock offset
+func (m *monitorClock) estimate() time.Duration {
+	estimate := m.lags[0]
+	for _, lag := range m.lags[1:] {
+		if lag < estimate {
+			estimate = lag
+		}
+	}
+	return estimate
+}
@@ -0,0 +1,160 @@
+package serial
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// CompactWaveformJSON is a waveform subrecord in columnar form: the
+// physical values in one array with the time of the first sample and the
+// interval between samples, instead of a SampleJSON with its own timestamp
+// and unit per sample. Control codes are NaN (null in JSON) and listed as
+// runs by condition.
+type CompactWaveformJSON struct {
+	Timestamp     time.Time        `json:"timestamp"`   // Time of the first sample
+	IntervalMs    float64          `json:"interval_ms"` // Time between two samples
+	SubrecordType int              `json:"subrecord_type"`
+	Channel       string           `json:"channel"` // See GetWaveformChannelKey
+	Unit          string           `json:"unit"`
+	SamplingRate  int              `json:"sampling_rate"`
+	Status        uint16           `json:"status"` // Status bits of the waveform header (WF_STATUS_*)
+	Values        StreamValues     `json:"values"`
+	Invalid       []StreamGap      `json:"invalid,omitempty"` // Runs of control codes by condition (e.g. lead_off, over_range)
+	RTime         uint32           `json:"r_time,omitempty"`  // Record transmission time (monitor clock)
+	TimeSource    string           `json:"time_source"`       // "r_time" or "host"
+	RecordsMissed int              `json:"records_missed,omitempty"`
+	Calibration   *CalibrationJSON `json:"calibration,omitempty"` // Site calibration applied to the values
+}
+
+// compactWaveformPool holds released compact waveforms, whose value and
+// run arrays are reused by the next parse
+var compactWaveformPool = sync.Pool{
+	New: func() interface{} { return &CompactWaveformJSON{} },
+}
+
+// Time returns the timestamp of Values[i]
+func (w *CompactWaveformJSON) Time(i int) time.Time {
+	return SampleTime(w.Timestamp, i, w.SamplingRate)
+}
+
+// Release returns the waveform to the pool of the compact parser once it
+// has been used (e.g. encoded). The waveform and its Values must not be
+// used afterwards; waveforms that are kept need not be released.
+func (w *CompactWaveformJSON) Release() {
+	*w = CompactWaveformJSON{Values: w.Values[:0], Invalid: w.Invalid[:0]}
+	compactWaveformPool.Put(w)
+}
+
+// ParseCompactWaveformRecord is ParseWaveformRecord with compact output
+func (wp *WaveformParser) ParseCompactWaveformRecord(header *DatexHeader, data []byte) (*CompactWaveformJSON, error) {
+	waveform, err := wp.parseCompact(data, wp.timeSync.RecordTime(header.RTime))
+	if err != nil {
+		return nil, err
+	}
+	waveform.RTime = header.RTime
+	waveform.TimeSource = TIME_SOURCE_RECORD
+	wp.calibrateCompact(waveform, int(header.PlugID))
+	return waveform, nil
+}
+
+// ParseCompactWaveformData is ParseWaveformData with compact output
+func (wp *WaveformParser) ParseCompactWaveformData(data []byte) (*CompactWaveformJSON, error) {
+	waveform, err := wp.parseCompact(data, wp.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	waveform.TimeSource = TIME_SOURCE_HOST
+	wp.calibrateCompact(waveform, CALIBRATION_ALL_MONITORS)
+	return waveform, nil
+}
+
+// ParseCompactWaveformRecords is ParseWaveformRecords with compact output
+func ParseCompactWaveformRecords(data []byte, timeSync *TimeSync, calibration *CalibrationTable) (*DatexHeader, []*CompactWaveformJSON, error) {
+	header, subrecords, err := ValidateRecord(data)
+	if err != nil {
+		return header, nil, err
+	}
+	if header.RMainType != DRI_MT_WAVE {
+		return header, nil, fmt.Errorf("%w: expected waveform record type %d, got %d", ErrInvalidRecord, DRI_MT_WAVE, header.RMainType)
+	}
+
+	waveforms := make([]*CompactWaveformJSON, 0, len(subrecords))
+	for _, subrecord := range subrecords {
+		parser := NewWaveformParser(int(subrecord.Type))
+		parser.SetTimeSync(timeSync)
+		parser.SetCalibration(calibration)
+		waveform, err := parser.ParseCompactWaveformRecord(header, subrecord.Data)
+		if err != nil {
+			return header, waveforms, fmt.Errorf("failed to parse subrecord %d: %w", subrecord.Index, err)
+		}
+		waveforms = append(waveforms, waveform)
+	}
+	return header, waveforms, nil
+}
+
+// parseCompact parses a waveform subrecord whose first sample was acquired
+// at startTime straight into the value array of a pooled waveform
+func (wp *WaveformParser) parseCompact(data []byte, startTime time.Time) (waveform *CompactWaveformJSON, err error) {
+	defer func() {
+		recoverFrame(recover(), "wave", data, &err)
+		recordParseResult(DRI_MT_WAVE, err)
+	}()
+
+	header, err := decodeWaveformHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	waveform = compactWaveformPool.Get().(*CompactWaveformJSON)
+	waveform.Timestamp = startTime
+	waveform.IntervalMs = 1000 / float64(wp.samplingRate)
+	waveform.SubrecordType = wp.subrecordType
+	waveform.Channel = GetWaveformChannelKey(wp.subrecordType)
+	waveform.Unit = wp.getUnit(wp.subrecordType)
+	waveform.SamplingRate = wp.samplingRate
+	waveform.Status = header.Status
+
+	values := waveform.Values[:0]
+	for i := 0; i < int(header.ActLen); i++ {
+		sample := int16(binary.LittleEndian.Uint16(data[6+i*2:]))
+		if IsControlCode(sample) {
+			waveform.addInvalid(i, ClassifyWaveformSample(sample, header))
+		}
+		values = append(values, ConvertSampleToPhysicalValue(sample, wp.subrecordType))
+	}
+	waveform.Values = values
+
+	metricWaveformSamples.Add(float64(len(values)), waveform.Channel)
+	return waveform, nil
+}
+
+// addInvalid adds a control code at offset to the runs of invalid samples
+func (w *CompactWaveformJSON) addInvalid(offset int, condition SampleCondition) {
+	reason := condition.String()
+	if last := len(w.Invalid) - 1; last >= 0 {
+		run := &w.Invalid[last]
+		if run.Reason == reason && run.Offset+run.Count == offset {
+			run.Count++
+			return
+		}
+	}
+	w.Invalid = append(w.Invalid, StreamGap{Offset: offset, Count: 1, Reason: reason})
+}
+
+// calibrateCompact applies the site calibration of the parser's signal on
+// monitor plugID to the values of a compact waveform
+func (wp *WaveformParser) calibrateCompact(waveform *CompactWaveformJSON, plugID int) {
+	calibration, exists := wp.calibration.Lookup(plugID, waveform.Channel)
+	if !exists {
+		return
+	}
+	for i, value := range waveform.Values {
+		if !math.IsNaN(value) {
+			waveform.Values[i] = calibration.Apply(value)
+		}
+	}
+	waveform.Calibration = calibration.ToJSON()
+}
@@ -0,0 +1,91 @@
+package serial
+
+import (
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// CrashReport records a panic recovered while parsing one DRI frame
+type CrashReport struct {
+	Time     time.Time `json:"time"`
+	Parser   string    `json:"parser"` // "alarm", "trend", "wave" or "subrecord" (a SubrecordHandler)
+	Panic    string    `json:"panic"`
+	Stack    string    `json:"stack"`
+	Length   int       `json:"length"`
+	Frame    string    `json:"frame"`    // Hex dump of the frame with PHI scrubbed
+	Scrubbed bool      `json:"scrubbed"` // True if patient data was removed from Frame
+}
+
+// PanicError is returned by a parser that recovered from a panic
+type PanicError struct {
+	Report *CrashReport
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s parser panic: %s", e.Report.Parser, e.Report.Panic)
+}
+
+var (
+	crashMutex   sync.RWMutex
+	crashHandler func(*CrashReport)
+)
+
+// SetCrashHandler registers a callback that receives a report for every
+// panic recovered by the parsers. The handler must not block.
+func SetCrashHandler(handler func(*CrashReport)) {
+	crashMutex.Lock()
+	defer crashMutex.Unlock()
+	crashHandler = handler
+}
+
+// recoverFrame converts a panic in a parser into a PanicError so that a
+// malformed frame only fails its own parse call. recover() only works when
+// called by the deferred function itself, so callers pass its result:
+//
+//	defer func() { recoverFrame(recover(), "trend", data, &err) }()
+func recoverFrame(recovered interface{}, parser string, data []byte, err *error) {
+	if recovered == nil {
+		return
+	}
+
+	frame, scrubbed := ScrubFrame(data)
+	report := &CrashReport{
+		Time:     time.Now(),
+		Parser:   parser,
+		Panic:    fmt.Sprint(recovered),
+		Stack:    string(debug.Stack()),
+		Length:   len(data),
+		Frame:    hex.EncodeToString(frame),
+		Scrubbed: scrubbed,
+	}
+	*err = &PanicError{Report: report}
+
+	crashMutex.RLock()
+	handler := crashHandler
+	crashMutex.RUnlock()
+	if handler != nil {
+		handler(report)
+	}
+}
+
+// ScrubFrame returns a copy of a DRI frame that is safe to include in crash
+// reports. Patient identification records (DRI_MT_NETWORK) carry names and
+// demographics, so only their header is kept and the payload is zeroed.
+// Other record types contain no patient identifiers and are returned as is.
+func ScrubFrame(data []byte) ([]byte, bool) {
+	frame := make([]byte, len(data))
+	copy(frame, data)
+
+	header := &DatexHeader{}
+	if err := header.UnmarshalBinary(frame); err != nil || header.RMainType != DRI_MT_NETWORK {
+		return frame, false
+	}
+
+	for i := header.Size(); i < len(frame); i++ {
+		frame[i] = 0
+	}
+	return frame, true
+}
@@ -0,0 +1,356 @@
+package serial
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+)
+
+// Diagnostics defaults
+const (
+	DIAG_FAILURE_THRESHOLD = 3   // Consecutive parse failures before frames are captured
+	DIAG_MAX_FRAMES        = 100 // Frames kept per source
+)
+
+// FrameHeaderInfo holds the Datex-Ohmeda header fields of a captured frame
+type FrameHeaderInfo struct {
+	RLen           int16  `json:"r_len"`
+	RNbr           byte   `json:"r_nbr"`
+	DriLevel       byte   `json:"dri_level"`
+	PlugID         uint16 `json:"plug_id"`
+	RTime          uint32 `json:"r_time"`
+	RMainType      int16  `json:"r_maintype"`
+	SubrecordTypes []int  `json:"subrecord_types"`
+}
+
+// FrameCapture is a raw DRI frame captured for vendor escalation
+type FrameCapture struct {
+	Sequence   int              `json:"sequence"`
+	ReceivedAt time.Time        `json:"received_at"`
+	Length     int              `json:"length"`
+	Checksum   byte             `json:"checksum"` // DRI serial checksum (low byte of the byte sum)
+	CRC32      uint32           `json:"crc32"`    // CRC-32 (IEEE) of the captured bytes
+	Header     *FrameHeaderInfo `json:"header,omitempty"`
+	HeaderErr  string           `json:"header_error,omitempty"`
+	ParseErr   string           `json:"parse_error,omitempty"`
+	Scrubbed   bool             `json:"scrubbed"`
+	Frame      []byte           `json:"-"`
+}
+
+// sourceDiagnostics holds the capture state of one monitor
+type sourceDiagnostics struct {
+	frames              int
+	failures            int
+	consecutiveFailures int
+	armed               int // Frames still to capture after a manual trigger
+	sequence            int
+	captures            []FrameCapture
+	lastFailure         time.Time
+}
+
+// DiagnosticsRecorder captures raw frames from monitors whose frames repeatedly
+// fail to parse, so they can be exported as a diagnostics bundle for GE support.
+// Frames are captured once a source reaches the failure threshold, or for a
+// number of frames after a manual trigger (Trigger). At most maxFrames frames
+// are kept per source; older captures are dropped first.
+type DiagnosticsRecorder struct {
+	mutex            sync.Mutex
+	failureThreshold int
+	maxFrames        int
+	sources          map[string]*sourceDiagnostics
+	clock            clock.Clock
+}
+
+// NewDiagnosticsRecorder creates a recorder with the default threshold and limits
+func NewDiagnosticsRecorder() *DiagnosticsRecorder {
+	return NewDiagnosticsRecorderWithLimits(DIAG_FAILURE_THRESHOLD, DIAG_MAX_FRAMES)
+}
+
+// NewDiagnosticsRecorderWithLimits creates a recorder with custom limits
+func NewDiagnosticsRecorderWithLimits(failureThreshold, maxFrames int) *DiagnosticsRecorder {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	if maxFrames < 1 {
+		maxFrames = 1
+	}
+	return &DiagnosticsRecorder{
+		failureThreshold: failureThreshold,
+		maxFrames:        maxFrames,
+		sources:          make(map[string]*sourceDiagnostics),
+		clock:            clock.Real,
+	}
+}
+
+// SetClock sets the clock used to timestamp captures (tests use a simulated clock)
+func (d *DiagnosticsRecorder) SetClock(c clock.Clock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.clock = clock.OrReal(c)
+}
+
+// Record registers the outcome of parsing one frame from source (e.g. the
+// serial port or the monitor address). parseErr is nil for frames that parsed.
+func (d *DiagnosticsRecorder) Record(source string, frame []byte, parseErr error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	state := d.source(source)
+	state.frames++
+
+	if parseErr != nil {
+		state.failures++
+		state.consecutiveFailures++
+		state.lastFailure = d.clock.Now()
+	} else {
+		state.consecutiveFailures = 0
+	}
+
+	switch {
+	case state.armed > 0:
+		state.armed--
+	case parseErr != nil && state.consecutiveFailures >= d.failureThreshold:
+	default:
+		return
+	}
+
+	state.sequence++
+	state.captures = append(state.captures, newFrameCapture(state.sequence, d.clock.Now(), frame, parseErr))
+	if len(state.captures) > d.maxFrames {
+		state.captures = state.captures[len(state.captures)-d.maxFrames:]
+	}
+}
+
+// Trigger captures the next count frames from source regardless of parse outcome
+func (d *DiagnosticsRecorder) Trigger(source string, count int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if count > d.maxFrames {
+		count = d.maxFrames
+	}
+	d.source(source).armed = count
+}
+
+// Reset discards the captures and counters of source
+func (d *DiagnosticsRecorder) Reset(source string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.sources, source)
+}
+
+// Sources returns the names of all sources seen by the recorder
+func (d *DiagnosticsRecorder) Sources() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	sources := make([]string, 0, len(d.sources))
+	for source := range d.sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Captures returns a copy of the frames captured for source
+func (d *DiagnosticsRecorder) Captures(source string) []FrameCapture {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	state, exists := d.sources[source]
+	if !exists {
+		return nil
+	}
+	captures := make([]FrameCapture, len(state.captures))
+	copy(captures, state.captures)
+	return captures
+}
+
+// source returns the state of a source, creating it if needed
+func (d *DiagnosticsRecorder) source(source string) *sourceDiagnostics {
+	state, exists := d.sources[source]
+	if !exists {
+		state = &sourceDiagnostics{}
+		d.sources[source] = state
+	}
+	return state
+}
+
+// newFrameCapture builds a capture from a raw frame. Patient data is scrubbed
+// before the frame is stored (see ScrubFrame).
+func newFrameCapture(sequence int, receivedAt time.Time, data []byte, parseErr error) FrameCapture {
+	frame, scrubbed := ScrubFrame(data)
+
+	capture := FrameCapture{
+		Sequence:   sequence,
+		ReceivedAt: receivedAt,
+		Length:     len(data),
+		Checksum:   Checksum(data),
+		CRC32:      crc32.ChecksumIEEE(frame),
+		Scrubbed:   scrubbed,
+		Frame:      frame,
+	}
+	if parseErr != nil {
+		capture.ParseErr = parseErr.Error()
+	}
+
+	header := &DatexHeader{}
+	if err := header.UnmarshalBinary(data); err != nil {
+		capture.HeaderErr = err.Error()
+		return capture
+	}
+	capture.Header = &FrameHeaderInfo{
+		RLen:           header.RLen,
+		RNbr:           header.RNbr,
+		DriLevel:       header.DriLevel,
+		PlugID:         header.PlugID,
+		RTime:          header.RTime,
+		RMainType:      header.RMainType,
+		SubrecordTypes: make([]int, 0),
+	}
+	for i := 0; i < 8 && header.SrDesc[i].IsValid(); i++ {
+		capture.Header.SubrecordTypes = append(capture.Header.SubrecordTypes, int(header.SrDesc[i].SrType))
+	}
+	return capture
+}
+
+// DiagnosticsManifest describes the contents of a diagnostics bundle
+type DiagnosticsManifest struct {
+	GeneratedAt         time.Time      `json:"generated_at"`
+	Source              string         `json:"source"`
+	FramesSeen          int            `json:"frames_seen"`
+	Failures            int            `json:"failures"`
+	ConsecutiveFailures int            `json:"consecutive_failures"`
+	LastFailure         time.Time      `json:"last_failure"`
+	FailureThreshold    int            `json:"failure_threshold"`
+	Frames              []FrameCapture `json:"frames"`
+}
+
+// WriteBundle writes a zip diagnostics bundle for source to w. The bundle
+// contains manifest.json (counters, header fields, checksums and parse errors
+// of every captured frame) and the raw frames as frames/NNNNNN.bin.
+func (d *DiagnosticsRecorder) WriteBundle(w io.Writer, source string) error {
+	d.mutex.Lock()
+	state, exists := d.sources[source]
+	if !exists {
+		d.mutex.Unlock()
+		return fmt.Errorf("no diagnostics for source %s", source)
+	}
+	manifest := DiagnosticsManifest{
+		GeneratedAt:         d.clock.Now(),
+		Source:              source,
+		FramesSeen:          state.frames,
+		Failures:            state.failures,
+		ConsecutiveFailures: state.consecutiveFailures,
+		LastFailure:         state.lastFailure,
+		FailureThreshold:    d.failureThreshold,
+		Frames:              make([]FrameCapture, len(state.captures)),
+	}
+	copy(manifest.Frames, state.captures)
+	d.mutex.Unlock()
+
+	archive := zip.NewWriter(w)
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := writeZipFile(archive, "manifest.json", manifestJSON); err != nil {
+		return err
+	}
+
+	for _, capture := range manifest.Frames {
+		name := fmt.Sprintf("frames/%06d.bin", capture.Sequence)
+		if err := writeZipFile(archive, name, capture.Frame); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// writeZipFile adds a file to a zip archive
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// ServeHTTP exposes the recorder on an admin API (see hl7.AdminServer.Handle):
+//
+//	GET    ?source=...          download the diagnostics bundle of a source
+//	GET                         list the sources
+//	POST   ?source=...&count=N  capture the next N frames of a source (default DIAG_MAX_FRAMES)
+//	DELETE ?source=...          discard the captures of a source
+func (d *DiagnosticsRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	if source == "" && r.Method != http.MethodGet {
+		http.Error(w, "missing source", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if source == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]string{"sources": d.Sources()})
+			return
+		}
+		if d.Captures(source) == nil {
+			http.Error(w, fmt.Sprintf("no diagnostics for source %s", source), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "diagnostics-"+safeBundleName(source)+".zip"))
+		if err := d.WriteBundle(w, source); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		count := d.maxFrames
+		if value := r.URL.Query().Get("count"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+			count = parsed
+		}
+		d.Trigger(source, count)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		d.Reset(source)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// safeBundleName replaces characters of a source name (e.g. /dev/ttyUSB0) that
+// are not allowed in file names
+func safeBundleName(source string) string {
+	name := make([]byte, 0, len(source))
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' {
+			name = append(name, c)
+		} else {
+			name = append(name, '_')
+		}
+	}
+	return string(name)
+}
@@ -0,0 +1,4 @@
+// Package serial reads and decodes the Datex-Ohmeda Record Interface (DRI)
+// of GE Healthcare S/5 monitors: frames, records, waveforms, trends and
+// alarms, and their JSON output.
+package serial
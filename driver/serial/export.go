@@ -0,0 +1,465 @@
+package serial
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/precision"
+)
+
+// Trend export formats
+const (
+	EXPORT_FORMAT_CSV     = "csv"
+	EXPORT_FORMAT_PARQUET = "parquet"
+)
+
+// Trend export rotation periods
+const (
+	EXPORT_ROTATE_HOUR = "hour"
+	EXPORT_ROTATE_DAY  = "day"
+)
+
+// Trend export defaults
+const (
+	EXPORT_PREFIX         = "trend"
+	EXPORT_ROW_GROUP_SIZE = 10000 // Rows buffered per Parquet row group
+)
+
+// Trend row statuses; group status flags are appended separated by "|"
+const (
+	TREND_STATUS_VALID   = "valid"
+	TREND_STATUS_INVALID = "invalid" // Control code instead of a measurement (-32000 and below)
+)
+
+// trendExportColumns are the columns of the exported files, in order
+var trendExportColumns = []string{"timestamp", "plug_id", "parameter", "value", "unit", "status"}
+
+// TrendRow is one value of a physiological data group as a table row
+type TrendRow struct {
+	Time      time.Time `json:"timestamp"`
+	PlugID    int       `json:"plug_id"`
+	Parameter string    `json:"parameter"` // e.g. "hr", "o2_et", "aa_et"
+	Value     *float64  `json:"value"`     // nil if the monitor sent a control code
+	Unit      string    `json:"unit"`
+	Status    string    `json:"status"` // valid or invalid, followed by group flags (e.g. "valid|calibrating")
+}
+
+var (
+	precisionMutex sync.RWMutex
+	valuePrecision = precision.NewPolicy(nil)
+)
+
+// SetPrecision replaces the display precision that TrendRows and
+// PHDBMeasurements round values to (default: the built-in table of package
+// precision; nil: values as computed from the record)
+func SetPrecision(policy *precision.Policy) {
+	precisionMutex.Lock()
+	defer precisionMutex.Unlock()
+	valuePrecision = policy
+}
+
+// currentPrecision returns the policy set with SetPrecision
+func currentPrecision() *precision.Policy {
+	precisionMutex.RLock()
+	defer precisionMutex.RUnlock()
+	return valuePrecision
+}
+
+// trendValue is one value of a group before flattening
+type trendValue struct {
+	parameter string
+	raw       int16
+	value     float64
+	unit      string
+}
+
+// TrendRows flattens the values of physiological data groups (*O2Group,
+// *N2OGroup, *AnesthesiaAgentGroup, *FlowVolumeGroup, *COWedgeGroup,
+// *NMTGroup, *ECGExtraGroup, *SvO2Group) into rows. The device is the plug
+// ID of header and t is the time of the record. Groups of other types are
+// skipped; values that are control codes are kept with a nil value. Values
+// are rounded to the precision of their parameter (see SetPrecision).
+func TrendRows(header *DatexHeader, t time.Time, groups ...interface{}) []TrendRow {
+	policy := currentPrecision()
+	rows := make([]TrendRow, 0)
+	for _, group := range groups {
+		var values []trendValue
+		var flags []string
+		switch g := group.(type) {
+		case *O2Group:
+			values = []trendValue{
+				{"o2_et", g.Et, g.GetExpiratoryConcentration(), "%"},
+				{"o2_fi", g.Fi, g.GetInspiratoryConcentration(), "%"},
+			}
+		case *N2OGroup:
+			values = []trendValue{
+				{"n2o_et", g.Et, g.GetExpiratoryConcentration(), "%"},
+				{"n2o_fi", g.Fi, g.GetInspiratoryConcentration(), "%"},
+			}
+			flags = statusFlags(trendFlag{g.IsCalibrating(), "calibrating"}, trendFlag{g.IsMeasurementOff(), "measurement_off"})
+		case *AnesthesiaAgentGroup:
+			values = []trendValue{
+				{"aa_et", g.Et, g.GetExpiratoryConcentration(), "%"},
+				{"aa_fi", g.Fi, g.GetInspiratoryConcentration(), "%"},
+				{"aa_mac_sum", g.MacSum, g.GetMacSum(), "MAC"},
+			}
+			flags = statusFlags(trendFlag{g.IsCalibrating(), "calibrating"}, trendFlag{g.IsMeasurementOff(), "measurement_off"})
+			flags = append(flags, "agent="+g.GetAgentLabel())
+		case *FlowVolumeGroup:
+			values = []trendValue{
+				{"rr", g.Rr, g.GetRespirationRate(), "breaths/min"},
+				{"ppeak", g.Ppeak, g.GetPeakPressure(), "cmH2O"},
+				{"peep", g.Peep, g.GetPeep(), "cmH2O"},
+				{"pplat", g.Pplat, g.GetPlateauPressure(), "cmH2O"},
+				{"tv_insp", g.TvInsp, g.GetInspiratoryTidalVolume(), "ml"},
+				{"tv_exp", g.TvExp, g.GetExpiratoryTidalVolume(), "ml"},
+				{"compliance", g.Compliance, g.GetCompliance(), "ml/cmH2O"},
+				{"mv_exp", g.MvExp, g.GetExpiratoryMinuteVolume(), "l/min"},
+			}
+			flags = statusFlags(trendFlag{g.IsDisconnection(), "disconnection"}, trendFlag{g.IsCalibrating(), "calibrating"},
+				trendFlag{g.IsZeroing(), "zeroing"}, trendFlag{g.IsObstruction(), "obstruction"}, trendFlag{g.IsLeak(), "leak"}, trendFlag{g.IsMeasurementOff(), "measurement_off"})
+		case *COWedgeGroup:
+			values = []trendValue{
+				{"co", g.Co, g.GetCardiacOutput(), "ml/min"},
+				{"blood_temp", g.BloodTemp, g.GetBloodTemperature(), "°C"},
+				{"ref", g.Ref, g.GetRightHeartEjectionFraction(), "%"},
+				{"pcwp", g.Pcwp, g.GetWedgePressure(), "mmHg"},
+			}
+			flags = statusFlags(trendFlag{g.IsCOOver60sOld(), "co_over_60s_old"}, trendFlag{g.IsPCWPOver60sOld(), "pcwp_over_60s_old"})
+		case *NMTGroup:
+			values = []trendValue{
+				{"nmt_t1", g.T1, g.GetT1(), "%"},
+				{"nmt_tratio", g.Tratio, g.GetTratio(), "%"},
+			}
+			flags = statusFlags(trendFlag{!g.IsCalibrated(), "not_calibrated"})
+		case *ECGExtraGroup:
+			values = []trendValue{
+				{"hr", g.HrEcg, g.GetHeartRate(), "bpm"},
+				{"hr_max", g.HrMax, g.GetMaxHeartRate(), "bpm"},
+				{"hr_min", g.HrMin, g.GetMinHeartRate(), "bpm"},
+			}
+		case *SvO2Group:
+			values = []trendValue{
+				{strings.ToLower(g.GetSaturationType()), g.SvO2, g.GetSvO2Value(), "%"},
+			}
+			flags = statusFlags(trendFlag{g.IsCalibratedOver24hAgo(), "calibrated_over_24h_ago"}, trendFlag{g.IsFaultyCable(), "faulty_cable"},
+				trendFlag{g.IsNoCable(), "no_cable"}, trendFlag{g.IsNotCalibrated(), "not_calibrated"})
+		}
+
+		for _, value := range values {
+			row := TrendRow{
+				Time:      t,
+				PlugID:    int(header.PlugID),
+				Parameter: value.parameter,
+				Unit:      value.unit,
+				Status:    TREND_STATUS_VALID,
+			}
+			if IsControlCode(value.raw) {
+				row.Status = TREND_STATUS_INVALID
+			} else {
+				numeric := policy.Round(value.parameter, "", value.value)
+				row.Value = &numeric
+			}
+			if len(flags) > 0 {
+				row.Status += "|" + strings.Join(flags, "|")
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// trendFlag is a status flag of a group and its name in the status column
+type trendFlag struct {
+	set  bool
+	name string
+}
+
+// statusFlags returns the names of the flags that are set
+func statusFlags(candidates ...trendFlag) []string {
+	flags := make([]string, 0)
+	for _, flag := range candidates {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	return flags
+}
+
+// TrendExportConfig configures a TrendExporter
+type TrendExportConfig struct {
+	Dir              string `json:"dir"`               // Directory of the exported files
+	Format           string `json:"format"`            // csv (default) or parquet
+	Rotation         string `json:"rotation"`          // hour or day (default)
+	Prefix           string `json:"prefix"`            // File name prefix (default "trend")
+	DecimalSeparator string `json:"decimal_separator"` // Decimal separator of CSV values: "." (default) or "," (fields then separated by ";")
+	DiscardPartial   bool   `json:"discard_partial"`   // Remove the incomplete Parquet file instead of completing it when Export is canceled
+}
+
+// TrendExporter writes trend rows to CSV or Parquet files, one file per
+// hour or day (UTC) of the row timestamps, for retrospective analytics.
+// CSV files are appended to; Parquet files are written under a .tmp name
+// and renamed when the period ends or the exporter is closed, since a
+// Parquet file is readable only once its footer is written. Rows of a
+// period whose Parquet file was already closed go to a new part file.
+type TrendExporter struct {
+	config    TrendExportConfig
+	period    string // Period of the open file
+	file      *os.File
+	name      string // Final name of the open file
+	csv       *csv.Writer
+	buffer    *bufio.Writer
+	parquet   *parquetWriter
+	pending   [][]parquetValue    // Rows of the current Parquet row group
+	formatter precision.Formatter // Formats CSV values
+}
+
+// NewTrendExporter creates an exporter writing to config.Dir
+func NewTrendExporter(config TrendExportConfig) (*TrendExporter, error) {
+	if config.Format == "" {
+		config.Format = EXPORT_FORMAT_CSV
+	}
+	if config.Rotation == "" {
+		config.Rotation = EXPORT_ROTATE_DAY
+	}
+	if config.Prefix == "" {
+		config.Prefix = EXPORT_PREFIX
+	}
+	if config.Format != EXPORT_FORMAT_CSV && config.Format != EXPORT_FORMAT_PARQUET {
+		return nil, fmt.Errorf("unknown trend export format %q", config.Format)
+	}
+	if config.Rotation != EXPORT_ROTATE_HOUR && config.Rotation != EXPORT_ROTATE_DAY {
+		return nil, fmt.Errorf("unknown trend export rotation %q", config.Rotation)
+	}
+	if !precision.ValidDecimalSeparator(config.DecimalSeparator) {
+		return nil, fmt.Errorf("unknown trend export decimal separator %q", config.DecimalSeparator)
+	}
+	if err := os.MkdirAll(config.Dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create trend export directory: %v", err)
+	}
+	return &TrendExporter{config: config, formatter: precision.Formatter{DecimalSeparator: config.DecimalSeparator}}, nil
+}
+
+// periodOf returns the rotation period of a row time
+func (e *TrendExporter) periodOf(t time.Time) string {
+	if e.config.Rotation == EXPORT_ROTATE_HOUR {
+		return t.UTC().Format("20060102T15")
+	}
+	return t.UTC().Format("20060102")
+}
+
+// Write appends rows, switching files when a row belongs to another period
+func (e *TrendExporter) Write(rows []TrendRow) error {
+	for _, row := range rows {
+		if period := e.periodOf(row.Time); period != e.period || e.file == nil {
+			if err := e.closeFile(); err != nil {
+				return err
+			}
+			if err := e.open(period); err != nil {
+				return err
+			}
+		}
+		if err := e.writeRow(row); err != nil {
+			return err
+		}
+	}
+	metricTrendRowsExported.Add(float64(len(rows)), e.config.Format)
+	return e.flush()
+}
+
+// open opens the file of a period
+func (e *TrendExporter) open(period string) error {
+	base := filepath.Join(e.config.Dir, e.config.Prefix+"-"+period)
+	e.period = period
+
+	if e.config.Format == EXPORT_FORMAT_CSV {
+		e.name = base + ".csv"
+		file, err := os.OpenFile(e.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open trend export: %v", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to open trend export: %v", err)
+		}
+		e.file = file
+		e.buffer = bufio.NewWriter(file)
+		e.csv = csv.NewWriter(e.buffer)
+		e.csv.Comma = e.formatter.CSVDelimiter()
+		if info.Size() == 0 {
+			return e.csv.Write(trendExportColumns)
+		}
+		return nil
+	}
+
+	e.name = base + ".parquet"
+	for part := 1; fileExists(e.name) || fileExists(e.name+".tmp"); part++ {
+		e.name = fmt.Sprintf("%s.%d.parquet", base, part)
+	}
+	file, err := os.OpenFile(e.name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open trend export: %v", err)
+	}
+	e.file = file
+	e.buffer = bufio.NewWriter(file)
+	e.parquet, err = newParquetWriter(e.buffer, []parquetColumn{
+		{name: "timestamp", physicalType: parquetInt64, convertedType: parquetTimestampMillis},
+		{name: "plug_id", physicalType: parquetInt32, convertedType: -1},
+		{name: "parameter", physicalType: parquetByteArray, convertedType: parquetUTF8},
+		{name: "value", physicalType: parquetDouble, convertedType: -1, optional: true},
+		{name: "unit", physicalType: parquetByteArray, convertedType: parquetUTF8},
+		{name: "status", physicalType: parquetByteArray, convertedType: parquetUTF8},
+	})
+	return err
+}
+
+// fileExists reports whether a file exists
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// writeRow writes a row to the open file
+func (e *TrendExporter) writeRow(row TrendRow) error {
+	if e.csv != nil {
+		value := ""
+		if row.Value != nil {
+			value = e.formatter.Format(*row.Value)
+		}
+		return e.csv.Write([]string{row.Time.UTC().Format(time.RFC3339Nano), strconv.Itoa(row.PlugID),
+			row.Parameter, value, row.Unit, row.Status})
+	}
+
+	var value parquetValue
+	if row.Value != nil {
+		value = *row.Value
+	}
+	e.pending = append(e.pending, []parquetValue{row.Time.UnixMilli(), int32(row.PlugID),
+		row.Parameter, value, row.Unit, row.Status})
+	if len(e.pending) >= EXPORT_ROW_GROUP_SIZE {
+		return e.writeRowGroup()
+	}
+	return nil
+}
+
+// writeRowGroup writes the pending Parquet rows as a row group
+func (e *TrendExporter) writeRowGroup() error {
+	if err := e.parquet.WriteRowGroup(e.pending); err != nil {
+		return fmt.Errorf("failed to write trend export: %v", err)
+	}
+	e.pending = e.pending[:0]
+	return nil
+}
+
+// flush writes buffered CSV rows to the file. Parquet rows stay buffered
+// until a row group is full.
+func (e *TrendExporter) flush() error {
+	if e.csv == nil {
+		return nil
+	}
+	e.csv.Flush()
+	if err := e.csv.Error(); err != nil {
+		return fmt.Errorf("failed to write trend export: %v", err)
+	}
+	if err := e.buffer.Flush(); err != nil {
+		return fmt.Errorf("failed to write trend export: %v", err)
+	}
+	return nil
+}
+
+// closeFile completes and closes the open file
+func (e *TrendExporter) closeFile() error {
+	if e.file == nil {
+		return nil
+	}
+	file := e.file
+	e.file = nil
+
+	var err error
+	if e.parquet != nil {
+		if err = e.writeRowGroup(); err == nil {
+			err = e.parquet.Close()
+		}
+		e.parquet = nil
+	} else {
+		err = e.flush()
+		e.csv = nil
+	}
+	if err == nil {
+		err = e.buffer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close trend export %s: %v", e.name, err)
+	}
+	if e.config.Format == EXPORT_FORMAT_PARQUET {
+		if err := os.Rename(e.name+".tmp", e.name); err != nil {
+			return fmt.Errorf("failed to close trend export %s: %v", e.name, err)
+		}
+	}
+	return nil
+}
+
+// Close completes the open file
+func (e *TrendExporter) Close() error {
+	return e.closeFile()
+}
+
+// Abort closes the open file without completing it. An incomplete Parquet
+// file (still under its .tmp name) is removed; the rows already written to
+// a CSV file are kept, since every row written is complete.
+func (e *TrendExporter) Abort() error {
+	if e.file == nil || e.parquet == nil {
+		return e.closeFile()
+	}
+	file := e.file
+	e.file, e.parquet, e.pending = nil, nil, e.pending[:0]
+	file.Close()
+	if err := os.Remove(e.name + ".tmp"); err != nil {
+		return fmt.Errorf("failed to remove trend export %s: %v", e.name, err)
+	}
+	return nil
+}
+
+// Export writes the rows received on rows until the channel is closed or
+// ctx is done, then closes the exporter. On cancellation the open file is
+// completed, or removed with DiscardPartial, and ctx.Err() is returned.
+func (e *TrendExporter) Export(ctx context.Context, rows <-chan []TrendRow) error {
+	for {
+		select {
+		case batch, ok := <-rows:
+			if !ok {
+				return e.Close()
+			}
+			if err := e.Write(batch); err != nil {
+				e.Abort()
+				return err
+			}
+		case <-ctx.Done():
+			var err error
+			if e.config.DiscardPartial {
+				err = e.Abort()
+			} else {
+				err = e.Close()
+			}
+			if err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package serial
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/fhir"
+	"github.com/harusin0516/healthcare/driver/mdc"
+	"github.com/harusin0516/healthcare/driver/precision"
+)
+
+// phdbValue is one value of a physiological data group
+type phdbValue struct {
+	referenceID string  // MDC reference ID of the value
+	raw         int16   // Value as sent, for the invalid value check
+	value       float64 // Value in the unit of the MDC code
+}
+
+// PHDBMeasurements converts the values of physiological data groups
+// (*ECGExtraGroup, *FlowVolumeGroup, *COWedgeGroup) into measurements for
+// the FHIR export. The device is the plug ID of header and t is the time of
+// the record. Values that are not measurement data (-32000 and below) and
+// groups of other types are skipped. Values are rounded to the precision of
+// their MDC code (see SetPrecision).
+func PHDBMeasurements(header *DatexHeader, t time.Time, groups ...interface{}) []fhir.Measurement {
+	policy := currentPrecision()
+	deviceID := fmt.Sprintf("%d", header.PlugID)
+	measurements := make([]fhir.Measurement, 0)
+
+	for _, group := range groups {
+		var values []phdbValue
+		switch g := group.(type) {
+		case *ECGExtraGroup:
+			values = []phdbValue{
+				{"MDC_ECG_HEART_RATE", g.HrEcg, g.GetHeartRate()},
+			}
+		case *FlowVolumeGroup:
+			values = []phdbValue{
+				{"MDC_RESP_RATE", g.Rr, g.GetRespirationRate()},
+				{"MDC_PRESS_AWAY_INSP_MAX", g.Ppeak, g.GetPeakPressure()},
+				{"MDC_PRESS_AWAY_END_EXP_POS", g.Peep, g.GetPeep()},
+				{"MDC_PRESS_RESP_PLAT", g.Pplat, g.GetPlateauPressure()},
+				{"MDC_VOL_AWAY_TIDAL", g.TvExp, g.GetExpiratoryTidalVolume()},
+				{"MDC_VOL_MINUTE_AWAY", g.MvExp, g.GetExpiratoryMinuteVolume()},
+			}
+		case *COWedgeGroup:
+			values = []phdbValue{
+				{"MDC_OUTPUT_CARD", g.Co, g.GetCardiacOutput() / 1000}, // ml/min to L/min
+				{"MDC_TEMP_BLD", g.BloodTemp, g.GetBloodTemperature()},
+				{"MDC_PRESS_BLD_ART_PULM_WEDGE", g.Pcwp, g.GetWedgePressure()},
+			}
+		}
+
+		for _, value := range values {
+			code, found := mdc.LookupReferenceID(value.referenceID)
+			if !found || IsControlCode(value.raw) {
+				continue
+			}
+			numeric := policy.Round(code.ReferenceID, code.DefaultUnit, value.value)
+			measurements = append(measurements, fhir.Measurement{
+				ID:           fmt.Sprintf("%s-%d-%s", deviceID, t.Unix(), code.ReferenceID),
+				Code:         fmt.Sprintf("%d", code.Code),
+				CodingSystem: mdc.CODING_SYSTEM,
+				Display:      code.ReferenceID,
+				Value:        precision.Format(numeric),
+				NumericValue: &numeric,
+				Unit:         code.DefaultUnit,
+				Time:         t,
+				DeviceID:     deviceID,
+				Category:     fhir.CATEGORY_VITAL_SIGNS,
+			})
+		}
+	}
+
+	return measurements
+}
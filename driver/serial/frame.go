@@ -0,0 +1,269 @@
+package serial
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Serial interface framing (S/5 Computer Interface Specification M1017617)
+const (
+	FRAME_FLAG       = 0x7E   // Start and end flag of every frame
+	FRAME_CONTROL    = 0x7D   // Control character preceding an escaped byte
+	FRAME_ESCAPE_BIT = 0x20   // Bit cleared in the byte following a control character
+	FRAME_MAX_LENGTH = 0x8000 // Largest record (r_len is a short) plus its checksum
+)
+
+// Checksum returns the serial checksum of a record: the sum of all its
+// bytes in 8 bit unsigned arithmetic
+func Checksum(record []byte) byte {
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	return sum
+}
+
+// VerifyChecksum checks the application data of a frame (a record followed
+// by its checksum byte) and returns the record
+func VerifyChecksum(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("%w: %d bytes of application data", ErrInvalidFrame, len(data))
+	}
+	record, checksum := data[:len(data)-1], data[len(data)-1]
+	if computed := Checksum(record); computed != checksum {
+		return nil, fmt.Errorf("%w: received 0x%02X, computed 0x%02X over %d bytes",
+			ErrChecksumMismatch, checksum, computed, len(record))
+	}
+	return record, nil
+}
+
+// Frame encodes a record for transmission: the record and its checksum,
+// with flag and control bytes escaped, between two flags
+func Frame(record []byte) []byte {
+	frame := make([]byte, 0, len(record)+4)
+	frame = append(frame, FRAME_FLAG)
+	for _, b := range append(record[:len(record):len(record)], Checksum(record)) {
+		if b == FRAME_FLAG || b == FRAME_CONTROL {
+			frame = append(frame, FRAME_CONTROL, b&^FRAME_ESCAPE_BIT)
+			continue
+		}
+		frame = append(frame, b)
+	}
+	return append(frame, FRAME_FLAG)
+}
+
+// Deframe decodes a frame (with or without its flags), verifies the
+// checksum and returns the record. Checksum mismatches are counted in
+// dri_checksum_failures_total.
+func Deframe(frame []byte) ([]byte, error) {
+	if len(frame) > 0 && frame[0] == FRAME_FLAG {
+		frame = frame[1:]
+	}
+	if len(frame) > 0 && frame[len(frame)-1] == FRAME_FLAG {
+		frame = frame[:len(frame)-1]
+	}
+	data, err := unescapeFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	record, err := VerifyChecksum(data)
+	if errors.Is(err, ErrChecksumMismatch) {
+		RecordChecksumFailure()
+	}
+	return record, err
+}
+
+// unescapeFrame restores the application data of a frame without its flags
+func unescapeFrame(frame []byte) ([]byte, error) {
+	data := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); i++ {
+		b := frame[i]
+		switch b {
+		case FRAME_FLAG:
+			return nil, fmt.Errorf("%w: flag at byte %d", ErrInvalidFrame, i)
+		case FRAME_CONTROL:
+			i++
+			if i == len(frame) {
+				return nil, fmt.Errorf("%w: control character at the end", ErrInvalidFrame)
+			}
+			b = frame[i] | FRAME_ESCAPE_BIT
+		}
+		data = append(data, b)
+	}
+	return data, nil
+}
+
+// FrameStats counts the frames read by a FrameReader
+type FrameStats struct {
+	Frames           int `json:"frames"`            // Frames whose checksum matched
+	ChecksumFailures int `json:"checksum_failures"` // Frames discarded because of a checksum mismatch
+	InvalidFrames    int `json:"invalid_frames"`    // Frames discarded because of a framing error
+	DiscardedBytes   int `json:"discarded_bytes"`   // Bytes received outside of a frame
+}
+
+// FrameReader reads the records of a monitor from its serial line. Each
+// call to ReadRecord returns the next record whose checksum matches, or an
+// error wrapping ErrChecksumMismatch or ErrInvalidFrame for a discarded
+// frame, after which reading can continue with the next frame.
+type FrameReader struct {
+	source io.Reader
+	reader *bufio.Reader
+	mutex  sync.Mutex
+	stats  FrameStats
+}
+
+// readDeadliner is a reader whose blocked reads can be interrupted, such as
+// a net.Conn or the *os.File of a serial port
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// NewFrameReader creates a reader of the frames received on r
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{source: r, reader: bufio.NewReader(r)}
+}
+
+// ReadRecord returns the next record. Bytes before the first flag are
+// discarded; consecutive flags (an end flag followed by a start flag) are
+// not frames.
+func (f *FrameReader) ReadRecord() ([]byte, error) {
+	for {
+		frame, err := f.readFrame()
+		if err != nil && !errors.Is(err, ErrInvalidFrame) {
+			return nil, err
+		}
+		if err == nil && len(frame) == 0 {
+			continue
+		}
+
+		var record []byte
+		if err == nil {
+			record, err = Deframe(frame)
+		}
+		f.mutex.Lock()
+		switch {
+		case err == nil:
+			f.stats.Frames++
+		case errors.Is(err, ErrChecksumMismatch):
+			f.stats.ChecksumFailures++
+		default:
+			f.stats.InvalidFrames++
+		}
+		f.mutex.Unlock()
+		return record, err
+	}
+}
+
+// ReadRecords calls handle with every record until the reader ends (nil is
+// returned), handle fails (its error is returned) or ctx is done (ctx.Err()
+// is returned). Discarded frames are skipped; they are counted in Stats. If
+// the reader has a read deadline, a read blocked when ctx is canceled is
+// interrupted and the deadline is cleared again before returning;
+// otherwise cancellation takes effect once the read returns.
+func (f *FrameReader) ReadRecords(ctx context.Context, handle func(record []byte) error) error {
+	if deadliner, ok := f.source.(readDeadliner); ok && ctx.Done() != nil {
+		done, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				deadliner.SetReadDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			<-stopped
+			if ctx.Err() != nil {
+				deadliner.SetReadDeadline(time.Time{})
+			}
+		}()
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := f.ReadRecord()
+		if errors.Is(err, ErrInvalidFrame) || errors.Is(err, ErrChecksumMismatch) {
+			continue
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := handle(record); err != nil {
+			return err
+		}
+	}
+}
+
+// Stats returns the frame counters
+func (f *FrameReader) Stats() FrameStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.stats
+}
+
+// GetStatus returns the frame counters for the driver status
+func (f *FrameReader) GetStatus() map[string]interface{} {
+	stats := f.Stats()
+	return map[string]interface{}{
+		"frames":            stats.Frames,
+		"checksum_failures": stats.ChecksumFailures,
+		"invalid_frames":    stats.InvalidFrames,
+		"discarded_bytes":   stats.DiscardedBytes,
+	}
+}
+
+// readFrame returns the bytes up to the next flag, skipping the bytes
+// before the start flag of the frame. A frame longer than the largest
+// escaped record (2*FRAME_MAX_LENGTH bytes) is invalid; its remaining bytes
+// are discarded before the next frame.
+func (f *FrameReader) readFrame() ([]byte, error) {
+	discarded := 0
+	for {
+		b, err := f.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == FRAME_FLAG {
+			break
+		}
+		discarded++
+	}
+	if discarded > 0 {
+		f.mutex.Lock()
+		f.stats.DiscardedBytes += discarded
+		f.mutex.Unlock()
+	}
+
+	frame := make([]byte, 0, 256)
+	for {
+		b, err := f.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == FRAME_FLAG {
+			// The end flag is left for the start of the next frame
+			if err := f.reader.UnreadByte(); err != nil {
+				return nil, err
+			}
+			return frame, nil
+		}
+		frame = append(frame, b)
+		if len(frame) > 2*FRAME_MAX_LENGTH {
+			return nil, fmt.Errorf("%w: longer than %d bytes", ErrInvalidFrame, 2*FRAME_MAX_LENGTH)
+		}
+	}
+}
@@ -0,0 +1,768 @@
+package serial
+
+import (
+	"time"
+)
+
+// Typed JSON structures of the physiological groups and the trend and alarm
+// records. The ToStruct methods build them without the intermediate maps of
+// the ToJSON methods, which are kept as wrappers for callers that expect a
+// map[string]interface{}.
+
+// ScaledValueJSON is a measured value with its raw value in DRI units
+type ScaledValueJSON struct {
+	RawValue int16   `json:"raw_value"`
+	Value    float64 `json:"value"`
+	Unit     string  `json:"unit"`
+}
+
+// ConcentrationJSON is a gas concentration with its raw value in 1/100%
+type ConcentrationJSON struct {
+	RawValue int16   `json:"raw_value"`
+	Percent  float64 `json:"percent"`
+	Unit     string  `json:"unit"`
+}
+
+// CodeJSON is a coded setting of a group header with its description
+type CodeJSON struct {
+	Value       int    `json:"value"`
+	Description string `json:"description"`
+}
+
+// GroupHeaderJSON is the header of a group (struct group_hdr)
+type GroupHeaderJSON struct {
+	Status uint16 `json:"status"`
+	Label  uint16 `json:"label"`
+}
+
+// O2GroupJSON is the JSON structure of an O2Group
+type O2GroupJSON struct {
+	Header GroupHeaderJSON   `json:"header"`
+	Et     ConcentrationJSON `json:"et"`
+	Fi     ConcentrationJSON `json:"fi"`
+}
+
+// GasHeaderJSON is the header of the N2O and anesthesia agent groups
+type GasHeaderJSON struct {
+	GroupHeaderJSON
+	AgentLabel       string `json:"agent_label,omitempty"` // Anesthesia agent only
+	IsCalibrating    bool   `json:"is_calibrating"`
+	IsMeasurementOff bool   `json:"is_measurement_off"`
+}
+
+// N2OGroupJSON is the JSON structure of an N2OGroup
+type N2OGroupJSON struct {
+	Header GasHeaderJSON     `json:"header"`
+	Et     ConcentrationJSON `json:"et"`
+	Fi     ConcentrationJSON `json:"fi"`
+}
+
+// AnesthesiaAgentGroupJSON is the JSON structure of an AnesthesiaAgentGroup
+type AnesthesiaAgentGroupJSON struct {
+	Header GasHeaderJSON     `json:"header"`
+	Et     ConcentrationJSON `json:"et"`
+	Fi     ConcentrationJSON `json:"fi"`
+	MacSum ScaledValueJSON   `json:"mac_sum"`
+}
+
+// FlowVolumeStatusJSON is the status bits of a FlowVolumeGroup
+type FlowVolumeStatusJSON struct {
+	Disconnection  bool `json:"disconnection"`
+	Calibrating    bool `json:"calibrating"`
+	Zeroing        bool `json:"zeroing"`
+	Obstruction    bool `json:"obstruction"`
+	Leak           bool `json:"leak"`
+	MeasurementOff bool `json:"measurement_off"`
+}
+
+// FlowVolumeHeaderJSON is the header of a FlowVolumeGroup
+type FlowVolumeHeaderJSON struct {
+	GroupHeaderJSON
+	TvBase     CodeJSON             `json:"tv_base"`
+	StatusBits FlowVolumeStatusJSON `json:"status_bits"`
+}
+
+// FlowVolumeGroupJSON is the JSON structure of a FlowVolumeGroup
+type FlowVolumeGroupJSON struct {
+	Header     FlowVolumeHeaderJSON `json:"header"`
+	Rr         ScaledValueJSON      `json:"rr"`
+	Ppeak      ScaledValueJSON      `json:"ppeak"`
+	Peep       ScaledValueJSON      `json:"peep"`
+	Pplat      ScaledValueJSON      `json:"pplat"`
+	TvInsp     ScaledValueJSON      `json:"tv_insp"`
+	TvExp      ScaledValueJSON      `json:"tv_exp"`
+	Compliance ScaledValueJSON      `json:"compliance"`
+	MvExp      ScaledValueJSON      `json:"mv_exp"`
+}
+
+// COWedgeHeaderJSON is the header of a COWedgeGroup
+type COWedgeHeaderJSON struct {
+	GroupHeaderJSON
+	COOver60sOld   bool     `json:"co_over_60s_old"`
+	PCWPOver60sOld bool     `json:"pcwp_over_60s_old"`
+	COMode         CodeJSON `json:"co_mode"`
+}
+
+// COWedgeGroupJSON is the JSON structure of a COWedgeGroup
+type COWedgeGroupJSON struct {
+	Header    COWedgeHeaderJSON `json:"header"`
+	Co        ScaledValueJSON   `json:"co"`
+	BloodTemp ScaledValueJSON   `json:"blood_temp"`
+	Ref       ScaledValueJSON   `json:"ref"`
+	Pcwp      ScaledValueJSON   `json:"pcwp"`
+}
+
+// NMTHeaderJSON is the header of an NMTGroup
+type NMTHeaderJSON struct {
+	GroupHeaderJSON
+	StimulusMode           CodeJSON `json:"stimulus_mode"`
+	PulseWidth             CodeJSON `json:"pulse_width"`
+	IsSupramaxCurrentFound bool     `json:"is_supramax_current_found"`
+	IsCalibrated           bool     `json:"is_calibrated"`
+}
+
+// StimulusCurrentJSON is the NMT stimulus current
+type StimulusCurrentJSON struct {
+	Value int    `json:"value"`
+	Unit  string `json:"unit"`
+}
+
+// PTCJSON is the ptc bit field of an NMTGroup (Table 3-43)
+type PTCJSON struct {
+	RawValue         int16               `json:"raw_value"`
+	PostTetanicCount int                 `json:"post_tetanic_count"`
+	TOFCount         int                 `json:"tof_count"`
+	StimulusCurrent  StimulusCurrentJSON `json:"stimulus_current"`
+}
+
+// NMTGroupJSON is the JSON structure of an NMTGroup
+type NMTGroupJSON struct {
+	Header NMTHeaderJSON   `json:"header"`
+	T1     ScaledValueJSON `json:"t1"`
+	Tratio ScaledValueJSON `json:"tratio"`
+	Ptc    PTCJSON         `json:"ptc"`
+}
+
+// ECGExtraGroupJSON is the JSON structure of an ECGExtraGroup
+type ECGExtraGroupJSON struct {
+	HrEcg ScaledValueJSON `json:"hr_ecg"`
+	HrMax ScaledValueJSON `json:"hr_max"`
+	HrMin ScaledValueJSON `json:"hr_min"`
+}
+
+// SvO2StatusJSON is the status bits of an SvO2Group
+type SvO2StatusJSON struct {
+	CalibratedOver24hAgo  bool `json:"calibrated_over_24h_ago"`
+	FaultyCable           bool `json:"faulty_cable"`
+	NoCable               bool `json:"no_cable"`
+	NotCalibrated         bool `json:"not_calibrated"`
+	Recalibrated          bool `json:"recalibrated"`
+	SvO2OutOfRange        bool `json:"svo2_out_of_range"`
+	CheckCatheterPosition bool `json:"check_catheter_position"`
+	IntensityShift        bool `json:"intensity_shift"`
+}
+
+// SvO2HeaderJSON is the header of an SvO2Group
+type SvO2HeaderJSON struct {
+	GroupHeaderJSON
+	SaturationType string         `json:"saturation_type"`
+	StatusBits     SvO2StatusJSON `json:"status_bits"`
+}
+
+// SvO2GroupJSON is the JSON structure of an SvO2Group
+type SvO2GroupJSON struct {
+	Header SvO2HeaderJSON  `json:"header"`
+	SvO2   ScaledValueJSON `json:"svo2"`
+}
+
+// PhysiologicalDataJSON is the data of a physiological data class, which
+// is not decoded further
+type PhysiologicalDataJSON struct {
+	Type string `json:"type"` // basic, extended1, extended2, extended3
+	Data []byte `json:"data"`
+	Size int    `json:"size"`
+}
+
+// PhysiologicalDatabaseRecordJSON is the JSON structure of a
+// PhysiologicalDatabaseRecord
+type PhysiologicalDatabaseRecordJSON struct {
+	Timestamp         string                 `json:"timestamp"`
+	UnixTimestamp     uint32                 `json:"unix_timestamp"`
+	Marker            byte                   `json:"marker"`
+	Reserved          byte                   `json:"reserved"`
+	ClDriLvlSubt      uint16                 `json:"cl_drilvl_subt"`
+	DataClass         int                    `json:"data_class"`
+	DataClassName     string                 `json:"data_class_name"`
+	IsValid           bool                   `json:"is_valid"`
+	PhysiologicalData *PhysiologicalDataJSON `json:"physiological_data,omitempty"`
+}
+
+// PhysiologicalSubrecordsJSON lists the physiological database records of a
+// PHDB record in subrecord order
+type PhysiologicalSubrecordsJSON struct {
+	Records []*PhysiologicalDatabaseRecordJSON `json:"records"`
+}
+
+// AuxiliaryPhysiologicalInfoJSON is the JSON structure of an
+// AuxiliaryPhysiologicalInfo
+type AuxiliaryPhysiologicalInfoJSON struct {
+	NibpTime        uint32          `json:"nibp_time"` // Unix time, 0: not known
+	Reserved1       int16           `json:"reserved1"`
+	CoTime          uint32          `json:"co_time"`   // Unix time, 0: not known
+	PcwpTime        uint32          `json:"pcwp_time"` // Unix time, 0: not known
+	BodySurfaceArea ScaledValueJSON `json:"pat_bsa"`
+	IsValid         bool            `json:"is_valid"`
+}
+
+// RawSubrecordJSON is a subrecord without a parser
+type RawSubrecordJSON struct {
+	RawData []byte `json:"raw_data"`
+	Size    int    `json:"size"`
+}
+
+// AlarmTextJSON is the text of an AlarmDisplay
+type AlarmTextJSON struct {
+	Value   string `json:"value"`
+	Changed bool   `json:"changed"`
+}
+
+// AlarmColorJSON is the color (priority) of an AlarmDisplay
+type AlarmColorJSON struct {
+	Value   byte   `json:"value"`
+	Name    string `json:"name"`
+	Changed bool   `json:"changed"`
+}
+
+// AlarmPriorityJSON is the priority level of an AlarmDisplay
+type AlarmPriorityJSON struct {
+	Level    int  `json:"level"`
+	IsActive bool `json:"is_active"`
+}
+
+// AlarmDisplayJSON is the JSON structure of an AlarmDisplay
+type AlarmDisplayJSON struct {
+	Text     AlarmTextJSON     `json:"text"`
+	Color    AlarmColorJSON    `json:"color"`
+	Priority AlarmPriorityJSON `json:"priority"`
+	Reserved [6]int16          `json:"reserved"`
+}
+
+// SoundOnOffJSON is the alarm sound status of an AlarmStatusMessage
+type SoundOnOffJSON struct {
+	Value  bool `json:"value"`
+	Status bool `json:"status"`
+}
+
+// SilenceInfoJSON is the alarm silence status of an AlarmStatusMessage
+type SilenceInfoJSON struct {
+	Value       byte   `json:"value"`
+	Description string `json:"description"`
+	IsSilenced  bool   `json:"is_silenced"`
+}
+
+// AlarmStatusMessageJSON is the JSON structure of an AlarmStatusMessage
+type AlarmStatusMessageJSON struct {
+	Reserved             int16              `json:"reserved"`
+	SoundOnOff           SoundOnOffJSON     `json:"sound_on_off"`
+	Reserved2            int16              `json:"reserved2"`
+	Reserved3            int16              `json:"reserved3"`
+	SilenceInfo          SilenceInfoJSON    `json:"silence_info"`
+	Alarms               []AlarmDisplayJSON `json:"alarms"`
+	ActiveAlarmCount     int                `json:"active_alarm_count"`
+	HighestPriorityAlarm *AlarmDisplayJSON  `json:"highest_priority_alarm"` // null without an active alarm
+	Reserved4            [5]int16           `json:"reserved4"`
+}
+
+// AlarmSubrecordsJSON is the JSON structure of AlarmSubrecords
+type AlarmSubrecordsJSON struct {
+	Type string                  `json:"type"` // alarm_status_message or empty
+	Data *AlarmStatusMessageJSON `json:"data"`
+}
+
+// ToStruct returns the typed JSON structure of the group header
+func (h *GroupHeader) ToStruct() GroupHeaderJSON {
+	return GroupHeaderJSON{Status: h.Status, Label: h.Label}
+}
+
+// ToStruct returns the typed JSON structure of the O2 group
+func (o *O2Group) ToStruct() *O2GroupJSON {
+	return &O2GroupJSON{
+		Header: o.Header.ToStruct(),
+		Et:     ConcentrationJSON{RawValue: o.Et, Percent: o.GetExpiratoryConcentration(), Unit: "%"},
+		Fi:     ConcentrationJSON{RawValue: o.Fi, Percent: o.GetInspiratoryConcentration(), Unit: "%"},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the N2O group
+func (n *N2OGroup) ToStruct() *N2OGroupJSON {
+	return &N2OGroupJSON{
+		Header: GasHeaderJSON{
+			GroupHeaderJSON:  n.Header.ToStruct(),
+			IsCalibrating:    n.IsCalibrating(),
+			IsMeasurementOff: n.IsMeasurementOff(),
+		},
+		Et: ConcentrationJSON{RawValue: n.Et, Percent: n.GetExpiratoryConcentration(), Unit: "%"},
+		Fi: ConcentrationJSON{RawValue: n.Fi, Percent: n.GetInspiratoryConcentration(), Unit: "%"},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the anesthesia agent group
+func (a *AnesthesiaAgentGroup) ToStruct() *AnesthesiaAgentGroupJSON {
+	return &AnesthesiaAgentGroupJSON{
+		Header: GasHeaderJSON{
+			GroupHeaderJSON:  a.Header.ToStruct(),
+			AgentLabel:       a.GetAgentLabel(),
+			IsCalibrating:    a.IsCalibrating(),
+			IsMeasurementOff: a.IsMeasurementOff(),
+		},
+		Et:     ConcentrationJSON{RawValue: a.Et, Percent: a.GetExpiratoryConcentration(), Unit: "%"},
+		Fi:     ConcentrationJSON{RawValue: a.Fi, Percent: a.GetInspiratoryConcentration(), Unit: "%"},
+		MacSum: ScaledValueJSON{RawValue: a.MacSum, Value: a.GetMacSum(), Unit: "MAC"},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the flow and volume group
+func (f *FlowVolumeGroup) ToStruct() *FlowVolumeGroupJSON {
+	return &FlowVolumeGroupJSON{
+		Header: FlowVolumeHeaderJSON{
+			GroupHeaderJSON: f.Header.ToStruct(),
+			TvBase:          CodeJSON{Value: f.GetTvBase(), Description: f.GetTvBaseDescription()},
+			StatusBits: FlowVolumeStatusJSON{
+				Disconnection:  f.IsDisconnection(),
+				Calibrating:    f.IsCalibrating(),
+				Zeroing:        f.IsZeroing(),
+				Obstruction:    f.IsObstruction(),
+				Leak:           f.IsLeak(),
+				MeasurementOff: f.IsMeasurementOff(),
+			},
+		},
+		Rr:         ScaledValueJSON{RawValue: f.Rr, Value: f.GetRespirationRate(), Unit: "breaths/min"},
+		Ppeak:      ScaledValueJSON{RawValue: f.Ppeak, Value: f.GetPeakPressure(), Unit: "cmH2O"},
+		Peep:       ScaledValueJSON{RawValue: f.Peep, Value: f.GetPeep(), Unit: "cmH2O"},
+		Pplat:      ScaledValueJSON{RawValue: f.Pplat, Value: f.GetPlateauPressure(), Unit: "cmH2O"},
+		TvInsp:     ScaledValueJSON{RawValue: f.TvInsp, Value: f.GetInspiratoryTidalVolume(), Unit: "ml"},
+		TvExp:      ScaledValueJSON{RawValue: f.TvExp, Value: f.GetExpiratoryTidalVolume(), Unit: "ml"},
+		Compliance: ScaledValueJSON{RawValue: f.Compliance, Value: f.GetCompliance(), Unit: "ml/cmH2O"},
+		MvExp:      ScaledValueJSON{RawValue: f.MvExp, Value: f.GetExpiratoryMinuteVolume(), Unit: "l/min"},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the cardiac output and wedge
+// pressure group
+func (c *COWedgeGroup) ToStruct() *COWedgeGroupJSON {
+	return &COWedgeGroupJSON{
+		Header: COWedgeHeaderJSON{
+			GroupHeaderJSON: c.Header.ToStruct(),
+			COOver60sOld:    c.IsCOOver60sOld(),
+			PCWPOver60sOld:  c.IsPCWPOver60sOld(),
+			COMode:          CodeJSON{Value: c.GetCOMode(), Description: c.GetCOModeDescription()},
+		},
+		Co:        ScaledValueJSON{RawValue: c.Co, Value: c.GetCardiacOutput(), Unit: "ml/min"},
+		BloodTemp: ScaledValueJSON{RawValue: c.BloodTemp, Value: c.GetBloodTemperature(), Unit: "°C"},
+		Ref:       ScaledValueJSON{RawValue: c.Ref, Value: c.GetRightHeartEjectionFraction(), Unit: "%"},
+		Pcwp:      ScaledValueJSON{RawValue: c.Pcwp, Value: c.GetWedgePressure(), Unit: "mmHg"},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the NMT group
+func (n *NMTGroup) ToStruct() *NMTGroupJSON {
+	return &NMTGroupJSON{
+		Header: NMTHeaderJSON{
+			GroupHeaderJSON:        n.Header.ToStruct(),
+			StimulusMode:           CodeJSON{Value: n.GetStimulusMode(), Description: n.GetStimulusModeDescription()},
+			PulseWidth:             CodeJSON{Value: n.GetPulseWidth(), Description: n.GetPulseWidthDescription()},
+			IsSupramaxCurrentFound: n.IsSupramaxCurrentFound(),
+			IsCalibrated:           n.IsCalibrated(),
+		},
+		T1:     ScaledValueJSON{RawValue: n.T1, Value: n.GetT1(), Unit: "%"},
+		Tratio: ScaledValueJSON{RawValue: n.Tratio, Value: n.GetTratio(), Unit: "%"},
+		Ptc: PTCJSON{
+			RawValue:         n.Ptc,
+			PostTetanicCount: n.GetPostTetanicCount(),
+			TOFCount:         n.GetTOFCount(),
+			StimulusCurrent:  StimulusCurrentJSON{Value: n.GetStimulusCurrent(), Unit: "mA"},
+		},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the ECG extra group
+func (e *ECGExtraGroup) ToStruct() *ECGExtraGroupJSON {
+	return &ECGExtraGroupJSON{
+		HrEcg: ScaledValueJSON{RawValue: e.HrEcg, Value: e.GetHeartRate(), Unit: "bpm"},
+		HrMax: ScaledValueJSON{RawValue: e.HrMax, Value: e.GetMaxHeartRate(), Unit: "bpm"},
+		HrMin: ScaledValueJSON{RawValue: e.HrMin, Value: e.GetMinHeartRate(), Unit: "bpm"},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the SvO2 group
+func (s *SvO2Group) ToStruct() *SvO2GroupJSON {
+	return &SvO2GroupJSON{
+		Header: SvO2HeaderJSON{
+			GroupHeaderJSON: s.Header.ToStruct(),
+			SaturationType:  s.GetSaturationType(),
+			StatusBits: SvO2StatusJSON{
+				CalibratedOver24hAgo:  s.IsCalibratedOver24hAgo(),
+				FaultyCable:           s.IsFaultyCable(),
+				NoCable:               s.IsNoCable(),
+				NotCalibrated:         s.IsNotCalibrated(),
+				Recalibrated:          s.IsRecalibrated(),
+				SvO2OutOfRange:        s.IsSvO2OutOfRange(),
+				CheckCatheterPosition: s.IsCheckCatheterPosition(),
+				IntensityShift:        s.IsIntensityShift(),
+			},
+		},
+		SvO2: ScaledValueJSON{RawValue: s.SvO2, Value: s.GetSvO2Value(), Unit: "%"},
+	}
+}
+
+// ToStruct returns the typed JSON structure of the basic physiological data
+func (b *BasicPhysiologicalData) ToStruct() *PhysiologicalDataJSON {
+	return &PhysiologicalDataJSON{Type: "basic", Data: b.Data, Size: len(b.Data)}
+}
+
+// ToStruct returns the typed JSON structure of the extended 1 physiological data
+func (e *Extended1PhysiologicalData) ToStruct() *PhysiologicalDataJSON {
+	return &PhysiologicalDataJSON{Type: "extended1", Data: e.Data, Size: len(e.Data)}
+}
+
+// ToStruct returns the typed JSON structure of the extended 2 physiological data
+func (e *Extended2PhysiologicalData) ToStruct() *PhysiologicalDataJSON {
+	return &PhysiologicalDataJSON{Type: "extended2", Data: e.Data, Size: len(e.Data)}
+}
+
+// ToStruct returns the typed JSON structure of the extended 3 physiological data
+func (e *Extended3PhysiologicalData) ToStruct() *PhysiologicalDataJSON {
+	return &PhysiologicalDataJSON{Type: "extended3", Data: e.Data, Size: len(e.Data)}
+}
+
+// ToStruct returns the typed JSON structure of the physiological database record
+func (p *PhysiologicalDatabaseRecord) ToStruct() *PhysiologicalDatabaseRecordJSON {
+	record := &PhysiologicalDatabaseRecordJSON{
+		Timestamp:     p.GetTimestamp().Format(time.RFC3339),
+		UnixTimestamp: p.Time,
+		Marker:        p.Marker,
+		Reserved:      p.Reserved,
+		ClDriLvlSubt:  p.ClDriLvlSubt,
+		DataClass:     p.GetDataClass(),
+		DataClassName: GetDataClassName(p.GetDataClass()),
+		IsValid:       p.IsValid(),
+	}
+	switch {
+	case p.PhysData.Basic != nil:
+		record.PhysiologicalData = p.PhysData.Basic.ToStruct()
+	case p.PhysData.Ext1 != nil:
+		record.PhysiologicalData = p.PhysData.Ext1.ToStruct()
+	case p.PhysData.Ext2 != nil:
+		record.PhysiologicalData = p.PhysData.Ext2.ToStruct()
+	case p.PhysData.Ext3 != nil:
+		record.PhysiologicalData = p.PhysData.Ext3.ToStruct()
+	}
+	return record
+}
+
+// ToStruct returns the typed JSON structure of the auxiliary physiological information
+func (a *AuxiliaryPhysiologicalInfo) ToStruct() *AuxiliaryPhysiologicalInfoJSON {
+	return &AuxiliaryPhysiologicalInfoJSON{
+		NibpTime:        a.NibpTime,
+		Reserved1:       a.Reserved1,
+		CoTime:          a.CoTime,
+		PcwpTime:        a.PcwpTime,
+		BodySurfaceArea: ScaledValueJSON{RawValue: a.PatBsa, Value: a.GetBodySurfaceArea(), Unit: "m2"},
+		IsValid:         a.IsValid(),
+	}
+}
+
+// ToStruct returns the typed JSON structure of the alarm display
+func (a *AlarmDisplay) ToStruct() AlarmDisplayJSON {
+	return AlarmDisplayJSON{
+		Text:     AlarmTextJSON{Value: a.GetAlarmText(), Changed: a.TextChanged},
+		Color:    AlarmColorJSON{Value: a.Color, Name: a.GetAlarmColor(), Changed: a.ColorChanged},
+		Priority: AlarmPriorityJSON{Level: a.GetAlarmPriority(), IsActive: a.IsActiveAlarm()},
+		Reserved: a.Reserved,
+	}
+}
+
+// ToStruct returns the typed JSON structure of the alarm status message
+func (a *AlarmStatusMessage) ToStruct() *AlarmStatusMessageJSON {
+	message := &AlarmStatusMessageJSON{
+		Reserved:   a.Reserved,
+		SoundOnOff: SoundOnOffJSON{Value: a.SoundOnOff, Status: a.IsSoundOn()},
+		Reserved2:  a.Reserved2,
+		Reserved3:  a.Reserved3,
+		SilenceInfo: SilenceInfoJSON{
+			Value:       a.SilenceInfo,
+			Description: a.GetSilenceInfoDescription(),
+			IsSilenced:  a.IsSilenced(),
+		},
+		Alarms:           make([]AlarmDisplayJSON, len(a.AlDisp)),
+		ActiveAlarmCount: a.GetActiveAlarmCount(),
+		Reserved4:        a.Reserved4,
+	}
+	for i := range a.AlDisp {
+		message.Alarms[i] = a.AlDisp[i].ToStruct()
+	}
+	if highest := a.GetHighestPriorityAlarm(); highest != nil {
+		display := highest.ToStruct()
+		message.HighestPriorityAlarm = &display
+	}
+	return message
+}
+
+// ToStruct returns the typed JSON structure of the alarm subrecords
+func (a *AlarmSubrecords) ToStruct() *AlarmSubrecordsJSON {
+	if a.AlarmMsg != nil {
+		return &AlarmSubrecordsJSON{Type: "alarm_status_message", Data: a.AlarmMsg.ToStruct()}
+	}
+	return &AlarmSubrecordsJSON{Type: "empty"}
+}
+
+// The toMap methods build the maps of the ToJSON methods field by field
+// from the typed structures, with the Go types of the fields (e.g. int16
+// raw values, []byte data), as the ToJSON methods always returned them.
+
+func (v ScaledValueJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"raw_value": v.RawValue,
+		"value":     v.Value,
+		"unit":      v.Unit,
+	}
+}
+
+func (c ConcentrationJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"raw_value": c.RawValue,
+		"percent":   c.Percent,
+		"unit":      c.Unit,
+	}
+}
+
+func (c CodeJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"value":       c.Value,
+		"description": c.Description,
+	}
+}
+
+func (h GroupHeaderJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"status": h.Status,
+		"label":  h.Label,
+	}
+}
+
+func (o *O2GroupJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"header": o.Header.toMap(),
+		"et":     o.Et.toMap(),
+		"fi":     o.Fi.toMap(),
+	}
+}
+
+func (h GasHeaderJSON) toMap() map[string]interface{} {
+	header := h.GroupHeaderJSON.toMap()
+	if h.AgentLabel != "" {
+		header["agent_label"] = h.AgentLabel
+	}
+	header["is_calibrating"] = h.IsCalibrating
+	header["is_measurement_off"] = h.IsMeasurementOff
+	return header
+}
+
+func (n *N2OGroupJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"header": n.Header.toMap(),
+		"et":     n.Et.toMap(),
+		"fi":     n.Fi.toMap(),
+	}
+}
+
+func (a *AnesthesiaAgentGroupJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"header":  a.Header.toMap(),
+		"et":      a.Et.toMap(),
+		"fi":      a.Fi.toMap(),
+		"mac_sum": a.MacSum.toMap(),
+	}
+}
+
+func (f *FlowVolumeGroupJSON) toMap() map[string]interface{} {
+	header := f.Header.GroupHeaderJSON.toMap()
+	header["tv_base"] = f.Header.TvBase.toMap()
+	header["status_bits"] = map[string]interface{}{
+		"disconnection":   f.Header.StatusBits.Disconnection,
+		"calibrating":     f.Header.StatusBits.Calibrating,
+		"zeroing":         f.Header.StatusBits.Zeroing,
+		"obstruction":     f.Header.StatusBits.Obstruction,
+		"leak":            f.Header.StatusBits.Leak,
+		"measurement_off": f.Header.StatusBits.MeasurementOff,
+	}
+	return map[string]interface{}{
+		"header":     header,
+		"rr":         f.Rr.toMap(),
+		"ppeak":      f.Ppeak.toMap(),
+		"peep":       f.Peep.toMap(),
+		"pplat":      f.Pplat.toMap(),
+		"tv_insp":    f.TvInsp.toMap(),
+		"tv_exp":     f.TvExp.toMap(),
+		"compliance": f.Compliance.toMap(),
+		"mv_exp":     f.MvExp.toMap(),
+	}
+}
+
+func (c *COWedgeGroupJSON) toMap() map[string]interface{} {
+	header := c.Header.GroupHeaderJSON.toMap()
+	header["co_over_60s_old"] = c.Header.COOver60sOld
+	header["pcwp_over_60s_old"] = c.Header.PCWPOver60sOld
+	header["co_mode"] = c.Header.COMode.toMap()
+	return map[string]interface{}{
+		"header":     header,
+		"co":         c.Co.toMap(),
+		"blood_temp": c.BloodTemp.toMap(),
+		"ref":        c.Ref.toMap(),
+		"pcwp":       c.Pcwp.toMap(),
+	}
+}
+
+func (n *NMTGroupJSON) toMap() map[string]interface{} {
+	header := n.Header.GroupHeaderJSON.toMap()
+	header["stimulus_mode"] = n.Header.StimulusMode.toMap()
+	header["pulse_width"] = n.Header.PulseWidth.toMap()
+	header["is_supramax_current_found"] = n.Header.IsSupramaxCurrentFound
+	header["is_calibrated"] = n.Header.IsCalibrated
+	return map[string]interface{}{
+		"header": header,
+		"t1":     n.T1.toMap(),
+		"tratio": n.Tratio.toMap(),
+		"ptc": map[string]interface{}{
+			"raw_value":          n.Ptc.RawValue,
+			"post_tetanic_count": n.Ptc.PostTetanicCount,
+			"tof_count":          n.Ptc.TOFCount,
+			"stimulus_current": map[string]interface{}{
+				"value": n.Ptc.StimulusCurrent.Value,
+				"unit":  n.Ptc.StimulusCurrent.Unit,
+			},
+		},
+	}
+}
+
+func (e *ECGExtraGroupJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"hr_ecg": e.HrEcg.toMap(),
+		"hr_max": e.HrMax.toMap(),
+		"hr_min": e.HrMin.toMap(),
+	}
+}
+
+func (s *SvO2GroupJSON) toMap() map[string]interface{} {
+	header := s.Header.GroupHeaderJSON.toMap()
+	header["saturation_type"] = s.Header.SaturationType
+	header["status_bits"] = map[string]interface{}{
+		"calibrated_over_24h_ago": s.Header.StatusBits.CalibratedOver24hAgo,
+		"faulty_cable":            s.Header.StatusBits.FaultyCable,
+		"no_cable":                s.Header.StatusBits.NoCable,
+		"not_calibrated":          s.Header.StatusBits.NotCalibrated,
+		"recalibrated":            s.Header.StatusBits.Recalibrated,
+		"svo2_out_of_range":       s.Header.StatusBits.SvO2OutOfRange,
+		"check_catheter_position": s.Header.StatusBits.CheckCatheterPosition,
+		"intensity_shift":         s.Header.StatusBits.IntensityShift,
+	}
+	return map[string]interface{}{
+		"header": header,
+		"svo2":   s.SvO2.toMap(),
+	}
+}
+
+func (d *PhysiologicalDataJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type": d.Type,
+		"data": d.Data,
+		"size": d.Size,
+	}
+}
+
+func (p *PhysiologicalDatabaseRecordJSON) toMap() map[string]interface{} {
+	record := map[string]interface{}{
+		"timestamp":       p.Timestamp,
+		"unix_timestamp":  p.UnixTimestamp,
+		"marker":          p.Marker,
+		"reserved":        p.Reserved,
+		"cl_drilvl_subt":  p.ClDriLvlSubt,
+		"data_class":      p.DataClass,
+		"data_class_name": p.DataClassName,
+		"is_valid":        p.IsValid,
+	}
+	if p.PhysiologicalData != nil {
+		record["physiological_data"] = p.PhysiologicalData.toMap()
+	}
+	return record
+}
+
+func (a *AuxiliaryPhysiologicalInfoJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"nibp_time": a.NibpTime,
+		"reserved1": a.Reserved1,
+		"co_time":   a.CoTime,
+		"pcwp_time": a.PcwpTime,
+		"pat_bsa":   a.BodySurfaceArea.toMap(),
+		"is_valid":  a.IsValid,
+	}
+}
+
+func (a AlarmDisplayJSON) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"text": map[string]interface{}{
+			"value":   a.Text.Value,
+			"changed": a.Text.Changed,
+		},
+		"color": map[string]interface{}{
+			"value":   a.Color.Value,
+			"name":    a.Color.Name,
+			"changed": a.Color.Changed,
+		},
+		"priority": map[string]interface{}{
+			"level":     a.Priority.Level,
+			"is_active": a.Priority.IsActive,
+		},
+		"reserved": a.Reserved,
+	}
+}
+
+func (a *AlarmStatusMessageJSON) toMap() map[string]interface{} {
+	alarms := make([]map[string]interface{}, len(a.Alarms))
+	for i, alarm := range a.Alarms {
+		alarms[i] = alarm.toMap()
+	}
+	var highest interface{}
+	if a.HighestPriorityAlarm != nil {
+		highest = a.HighestPriorityAlarm.toMap()
+	}
+	return map[string]interface{}{
+		"reserved": a.Reserved,
+		"sound_on_off": map[string]interface{}{
+			"value":  a.SoundOnOff.Value,
+			"status": a.SoundOnOff.Status,
+		},
+		"reserved2": a.Reserved2,
+		"reserved3": a.Reserved3,
+		"silence_info": map[string]interface{}{
+			"value":       a.SilenceInfo.Value,
+			"description": a.SilenceInfo.Description,
+			"is_silenced": a.SilenceInfo.IsSilenced,
+		},
+		"alarms":                 alarms,
+		"active_alarm_count":     a.ActiveAlarmCount,
+		"highest_priority_alarm": highest,
+		"reserved4":              a.Reserved4,
+	}
+}
+
+func (a *AlarmSubrecordsJSON) toMap() map[string]interface{} {
+	var data interface{}
+	if a.Data != nil {
+		data = a.Data.toMap()
+	}
+	return map[string]interface{}{
+		"type": a.Type,
+		"data": data,
+	}
+}
@@ -0,0 +1,119 @@
+package serial
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+	"github.com/harusin0516/healthcare/driver/mdc"
+)
+
+// HL7Waveform converts a waveform subrecord of a monitor into a waveform for
+// HL7 OBX segments (hl7.WaveformOBX, hl7.AppendWaveforms), coded with the
+// MDC code of its channel. Control codes (gaps, lead off, pacer) become
+// missing samples.
+func HL7Waveform(plugID int, waveform *WaveformJSON) (hl7.Waveform, error) {
+	unit := ""
+	if len(waveform.Samples) > 0 {
+		unit = waveform.Samples[0].Unit
+	}
+	code, unitCE, err := hl7WaveformCodes(waveform.SubrecordType, unit)
+	if err != nil {
+		return hl7.Waveform{}, err
+	}
+	samples := make([]float64, len(waveform.Samples))
+	for i, sample := range waveform.Samples {
+		if sample.IsControlCode {
+			samples[i] = math.NaN()
+			continue
+		}
+		samples[i] = sample.PhysicalValue
+	}
+	return hl7.Waveform{
+		Code:         code,
+		Unit:         unitCE,
+		SamplingRate: waveform.SamplingRate,
+		Start:        waveform.Timestamp,
+		Samples:      samples,
+		DeviceID:     fmt.Sprintf("%d", plugID),
+	}, nil
+}
+
+// HL7Waveform returns the buffered samples of a channel from from up to
+// before to as a waveform for HL7 OBX segments, e.g. a short ECG strip
+// around an alarm. Samples missing between the buffered ones (control codes,
+// lost records) are filled in as missing samples.
+func (b *WaveformBuffer) HL7Waveform(plugID int, channel string, from, to time.Time) (hl7.Waveform, error) {
+	ring, err := b.Ring(plugID, channel)
+	if err != nil {
+		return hl7.Waveform{}, err
+	}
+	subrecordType, found := waveformSubrecordType(channel)
+	if !found {
+		return hl7.Waveform{}, fmt.Errorf("unknown waveform channel %s", channel)
+	}
+	code, unitCE, err := hl7WaveformCodes(subrecordType, ring.Unit())
+	if err != nil {
+		return hl7.Waveform{}, err
+	}
+	samplingRate := ring.SamplingRate()
+	points := ring.Range(from, to)
+	if len(points) == 0 || samplingRate <= 0 {
+		return hl7.Waveform{}, fmt.Errorf("no waveform buffered for plug %d channel %s in the range", plugID, channel)
+	}
+
+	period := float64(time.Second) / float64(samplingRate)
+	samples := make([]float64, 0, len(points))
+	for i, point := range points {
+		if i > 0 {
+			missing := int(math.Round(float64(point.Time.Sub(points[i-1].Time))/period)) - 1
+			for j := 0; j < missing; j++ {
+				samples = append(samples, math.NaN())
+			}
+		}
+		samples = append(samples, point.Value)
+	}
+	return hl7.Waveform{
+		Code:         code,
+		Unit:         unitCE,
+		SamplingRate: samplingRate,
+		Start:        points[0].Time,
+		Samples:      samples,
+		DeviceID:     fmt.Sprintf("%d", plugID),
+	}, nil
+}
+
+// hl7WaveformCodes returns the MDC code of a waveform channel and the MDC
+// unit of its physical values (the default unit of the code if the unit is
+// not known)
+func hl7WaveformCodes(subrecordType int, unit string) (string, string, error) {
+	code, found := mdc.ForDRIWaveform(subrecordType)
+	if !found {
+		return "", "", fmt.Errorf("no MDC code for waveform %s", GetWaveformChannelKey(subrecordType))
+	}
+	// DRI writes micro with the Greek letter mu, the code table with the micro sign
+	unit = strings.ReplaceAll(unit, "μ", "µ")
+	for _, candidate := range mdc.Codes(mdc.KindUnit) {
+		if candidate.Description == unit {
+			return code.CE(), candidate.CE(), nil
+		}
+	}
+	if defaultUnit, found := code.Unit(); found && unit == "" {
+		return code.CE(), defaultUnit.CE(), nil
+	}
+	// Values of unknown scale (raw) are sent without a unit
+	return code.CE(), "", nil
+}
+
+// waveformSubrecordType returns the waveform subrecord type of a channel key
+// (see GetWaveformChannelKey)
+func waveformSubrecordType(channel string) (int, bool) {
+	for subrecordType := DRI_WF_ECG1; subrecordType <= DRI_WF_RESP_100; subrecordType++ {
+		if GetWaveformChannelKey(subrecordType) == channel {
+			return subrecordType, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,256 @@
+package serial
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// binaryLayout is a structure read from (and possibly written to) DRI records
+type binaryLayout interface {
+	Size() int
+	UnmarshalBinary(data []byte) error
+}
+
+// layoutVector is a known-good encoding of a structure: every field holds a
+// distinct value, so that reordering or resizing any field changes the
+// decoded value or the encoding
+type layoutVector struct {
+	name  string
+	new   func() binaryLayout // Returns an empty structure to decode into
+	value binaryLayout        // The structure data decodes to
+	data  string              // Hex, spaces ignored; one group per field
+}
+
+// layoutVectors covers every fixed binary structure of the DRI records. The
+// classes of the physdata union keep their 270 bytes raw and are covered by
+// dri_phdb.
+var layoutVectors = []layoutVector{
+	{
+		name:  "sr_desc",
+		new:   func() binaryLayout { return &SrDesc{} },
+		value: &SrDesc{SrOffset: 0x0150, SrType: 0x08},
+		data:  "5001 08",
+	},
+	{
+		// 40 bytes: the 16 byte fixed part and sr_desc[8] of 3 bytes each
+		name: "datex_hdr",
+		new:  func() binaryLayout { return &DatexHeader{} },
+		value: &DatexHeader{
+			RLen: 0x0130, RNbr: 0x07, DriLevel: 0x0B, PlugID: 0x1234, RTime: 0x665A1B00,
+			NSubnet: 0x21, Reserved2: 0x22, Reserved3: 0x2423, RMainType: 0x0001,
+			SrDesc: [8]SrDesc{
+				{SrOffset: 0x0000, SrType: 0x01}, {SrOffset: 0x0050, SrType: 0x08},
+				{SrType: DRI_EOL_SUBR_LIST}, {SrType: DRI_EOL_SUBR_LIST}, {SrType: DRI_EOL_SUBR_LIST},
+				{SrType: DRI_EOL_SUBR_LIST}, {SrType: DRI_EOL_SUBR_LIST}, {SrType: DRI_EOL_SUBR_LIST},
+			},
+		},
+		data: "3001 07 0b 3412 001b5a66 21 22 2324 0100" +
+			" 000001 500008 0000ff 0000ff 0000ff 0000ff 0000ff 0000ff",
+	},
+	{
+		name:  "wf_hdr",
+		new:   func() binaryLayout { return &WaveformHeader{} },
+		value: &WaveformHeader{ActLen: 0x0002, Status: WF_STATUS_PACER_DET, Label: 0x0A0B},
+		data:  "0200 0400 0b0a",
+	},
+	{
+		name: "waveform",
+		new:  func() binaryLayout { return &WaveformData{} },
+		value: &WaveformData{
+			Header:  WaveformHeader{ActLen: 0x0002, Status: WF_STATUS_GAP, Label: 0x0A0B},
+			Samples: []int16{0x0123, -2},
+		},
+		data: "0200 0100 0b0a 2301 feff",
+	},
+	{
+		name:  "phdb_class_bf",
+		new:   func() binaryLayout { return &PhysiologicalDataClassBitField{} },
+		value: &PhysiologicalDataClassBitField{BasicClass: 0x0101, Ext1Class: 0x0202, Ext2Class: 0x0303, Ext3Class: 0x0404},
+		data:  "0101 0202 0303 0404",
+	},
+	{
+		// 278 bytes: time, physdata[270] of the class in cl_drilvl_subt,
+		// marker, reserved and cl_drilvl_subt
+		name: "dri_phdb",
+		new:  func() binaryLayout { return &PhysiologicalDatabaseRecord{} },
+		value: &PhysiologicalDatabaseRecord{
+			Time:         0x665A1B00,
+			PhysData:     PhysiologicalDataUnion{Ext2: &Extended2PhysiologicalData{Data: referencePhysData()}},
+			Marker:       0x05,
+			Reserved:     0x06,
+			ClDriLvlSubt: 0x020B,
+		},
+		data: "001b5a66 11" + strings.Repeat("00", PH_DATA_CLASS_SIZE-2) + "99 05 06 0b02",
+	},
+	{
+		name: "aux_phdb_info",
+		new:  func() binaryLayout { return &AuxiliaryPhysiologicalInfo{} },
+		value: &AuxiliaryPhysiologicalInfo{
+			NibpTime: 0x665A1B00, Reserved1: 0x0102, CoTime: 0x665A1C00, PcwpTime: 0x665A1D00, PatBsa: 0x00B4,
+			Reserved: [98]byte{0: 0x11, 97: 0x99},
+		},
+		data: "001b5a66 0201 001c5a66 001d5a66 b400 11" + strings.Repeat("00", 96) + "99",
+	},
+	{
+		name:  "group_hdr",
+		new:   func() binaryLayout { return &GroupHeader{} },
+		value: &GroupHeader{Status: 0x0003, Label: 0x0102},
+		data:  "0300 0201",
+	},
+	{
+		name:  "o2_group",
+		new:   func() binaryLayout { return &O2Group{} },
+		value: &O2Group{Header: GroupHeader{Status: 0x0003, Label: 0x0102}, Et: 1650, Fi: 2100},
+		data:  "0300 0201 7206 3408",
+	},
+	{
+		name:  "n2o_group",
+		new:   func() binaryLayout { return &N2OGroup{} },
+		value: &N2OGroup{Header: GroupHeader{Status: 0x0003, Label: 0x0102}, Et: 4800, Fi: 5000},
+		data:  "0300 0201 c012 8813",
+	},
+	{
+		name:  "aa_group",
+		new:   func() binaryLayout { return &AnesthesiaAgentGroup{} },
+		value: &AnesthesiaAgentGroup{Header: GroupHeader{Status: 0x0003, Label: 0x0102}, Et: 180, Fi: 210, MacSum: 95},
+		data:  "0300 0201 b400 d200 5f00",
+	},
+	{
+		name: "flow_vol_group",
+		new:  func() binaryLayout { return &FlowVolumeGroup{} },
+		value: &FlowVolumeGroup{
+			Header: GroupHeader{Status: 0x0003, Label: 0x0102},
+			Rr:     12, Ppeak: 2200, Peep: 500, Pplat: 1800, TvInsp: 4500, TvExp: 4400, Compliance: 4000, MvExp: 540,
+		},
+		data: "0300 0201 0c00 9808 f401 0807 9411 3011 a00f 1c02",
+	},
+	{
+		name:  "co_wedge_group",
+		new:   func() binaryLayout { return &COWedgeGroup{} },
+		value: &COWedgeGroup{Header: GroupHeader{Status: 0x0003, Label: 0x0102}, Co: 5200, BloodTemp: 3690, Ref: 4500, Pcwp: 1200},
+		data:  "0300 0201 5014 6a0e 9411 b004",
+	},
+	{
+		name:  "nmt_group",
+		new:   func() binaryLayout { return &NMTGroup{} },
+		value: &NMTGroup{Header: GroupHeader{Status: 0x0003, Label: 0x0102}, T1: 950, Tratio: 900, Ptc: 0x0304},
+		data:  "0300 0201 b603 8403 0403",
+	},
+	{
+		name:  "ecg_extra_group",
+		new:   func() binaryLayout { return &ECGExtraGroup{} },
+		value: &ECGExtraGroup{HrEcg: 72, HrMax: 120, HrMin: 50},
+		data:  "4800 7800 3200",
+	},
+	{
+		name:  "svo2_group",
+		new:   func() binaryLayout { return &SvO2Group{} },
+		value: &SvO2Group{Header: GroupHeader{Status: 0x0003, Label: 0x0102}, SvO2: 75},
+		data:  "0300 0201 4b00",
+	},
+	{
+		// 95 bytes: text[80], three flags and reserved[6]
+		name:  "al_disp_al",
+		new:   func() binaryLayout { return &AlarmDisplay{} },
+		value: referenceAlarmDisplay(),
+		data:  referenceAlarmDisplayHex,
+	},
+	{
+		// 493 bytes: 8 bytes before al_disp[5] and reserved4[5] after it
+		name: "dri_al_msg",
+		new:  func() binaryLayout { return &AlarmStatusMessage{} },
+		value: &AlarmStatusMessage{
+			Reserved: 0x0102, SoundOnOff: true, Reserved2: 0x0304, Reserved3: 0x0506, SilenceInfo: DRI_SI_2MIN,
+			AlDisp:    [5]AlarmDisplay{*referenceAlarmDisplay()},
+			Reserved4: [5]int16{0x0708, 0, 0, 0, 0x090A},
+		},
+		data: "0201 01 0403 0605 05" + referenceAlarmDisplayHex + strings.Repeat("00", 4*95) +
+			"0807 0000 0000 0000 0a09",
+	},
+}
+
+// referencePhysData returns the physdata of the reference vectors
+func referencePhysData() []byte {
+	data := make([]byte, PH_DATA_CLASS_SIZE)
+	data[0], data[PH_DATA_CLASS_SIZE-1] = 0x11, 0x99
+	return data
+}
+
+// referenceAlarmDisplayHex encodes referenceAlarmDisplay
+var referenceAlarmDisplayHex = hex.EncodeToString([]byte("APNEA")) + strings.Repeat("00", 75) +
+	" 01 03 00 0100 0000 0000 0000 0000 0600"
+
+// referenceAlarmDisplay returns the alarm display of the reference vectors
+func referenceAlarmDisplay() *AlarmDisplay {
+	display := &AlarmDisplay{TextChanged: true, Color: DRI_PR3, Reserved: [6]int16{0: 0x0001, 5: 0x0006}}
+	display.SetAlarmText("APNEA")
+	return display
+}
+
+// LayoutError lists every structure whose binary layout does not match its
+// reference vector
+type LayoutError struct {
+	Problems []string
+}
+
+func (e *LayoutError) Error() string {
+	return fmt.Sprintf("binary layout check failed:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// VerifyLayouts checks every binary structure against its reference vector:
+// Size() must equal the length of the vector, UnmarshalBinary must decode it
+// to the reference value and reject it one byte short, and MarshalBinary,
+// where implemented, must encode the reference value to the vector. A field
+// moved, resized or dropped in one of them fails the check. The cmd/
+// binaries that decode DRI records run it at startup and layout_test.go
+// runs it with the tests; applications embedding the package should call
+// it once before reading records.
+func VerifyLayouts() error {
+	var problems []string
+	for _, vector := range layoutVectors {
+		if err := vector.verify(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", vector.name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return &LayoutError{Problems: problems}
+	}
+	return nil
+}
+
+// verify checks a structure against its vector
+func (v layoutVector) verify() error {
+	data, err := hex.DecodeString(strings.ReplaceAll(v.data, " ", ""))
+	if err != nil {
+		return fmt.Errorf("invalid reference vector: %v", err)
+	}
+	if size := v.value.Size(); size != len(data) {
+		return fmt.Errorf("Size() is %d bytes, the reference is %d", size, len(data))
+	}
+
+	decoded := v.new()
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("UnmarshalBinary: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, v.value) {
+		return fmt.Errorf("UnmarshalBinary decoded %+v, the reference is %+v", decoded, v.value)
+	}
+	if err := v.new().UnmarshalBinary(data[:len(data)-1]); err == nil {
+		return fmt.Errorf("UnmarshalBinary accepted %d of %d bytes", len(data)-1, len(data))
+	}
+
+	if marshaler, ok := v.value.(encoding.BinaryMarshaler); ok {
+		encoded, err := marshaler.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("MarshalBinary: %v", err)
+		}
+		if !bytes.Equal(encoded, data) {
+			return fmt.Errorf("MarshalBinary encoded %x, the reference is %x", encoded, data)
+		}
+	}
+	return nil
+}
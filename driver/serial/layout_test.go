@@ -0,0 +1,9 @@
+package serial
+
+import "testing"
+
+func TestVerifyLayouts(t *testing.T) {
+	if err := VerifyLayouts(); err != nil {
+		t.Fatal(err)
+	}
+}
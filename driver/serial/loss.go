@@ -0,0 +1,158 @@
+package serial
+
+import (
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+)
+
+// LossEventJSON reports records missing in the record number sequence of a
+// monitor
+type LossEventJSON struct {
+	Source        string    `json:"source"`         // Transport or capture the records were read from
+	PlugID        int       `json:"plug_id"`        // Plug ID of the monitor
+	Expected      int       `json:"expected"`       // r_nbr following the previous record
+	Received      int       `json:"received"`       // r_nbr of the record received instead
+	RecordsMissed int       `json:"records_missed"` // Records missing in between
+	Time          time.Time `json:"time"`           // When the gap was detected
+}
+
+// LossSink receives the loss events of a LossDetector
+type LossSink interface {
+	HandleLossEvent(event *LossEventJSON) error
+}
+
+// LossSinkFunc adapts a function to a LossSink
+type LossSinkFunc func(event *LossEventJSON) error
+
+// HandleLossEvent calls f(event)
+func (f LossSinkFunc) HandleLossEvent(event *LossEventJSON) error {
+	return f(event)
+}
+
+// LOSS_REORDER_WINDOW is how many record numbers a record may lag behind
+// the last one and still count as late (reordered or retransmitted) rather
+// than as a gap of almost 256 records
+const LOSS_REORDER_WINDOW = 16
+
+// lossKey identifies the record number sequence of a monitor on a source
+type lossKey struct {
+	source string
+	plugID uint16
+}
+
+// lossState is the last record number of a sequence
+type lossState struct {
+	lastNbr byte
+	missed  int
+}
+
+// LossDetector tracks the record numbers (r_nbr) of every monitor of every
+// source and detects records lost in between, e.g. frames discarded for a
+// bad checksum or dropped by a gateway. A record with the same number as
+// the previous one is a retransmission, not a gap, and a record up to
+// LOSS_REORDER_WINDOW numbers behind the last one arrived late: neither is
+// counted nor moves the sequence back. A late record does not take back a
+// gap already reported. As r_nbr wraps at 256, a gap of 256 records or
+// more cannot be told from a smaller one, and a gap of more than
+// 255-LOSS_REORDER_WINDOW records is taken for a late record.
+type LossDetector struct {
+	mutex     sync.Mutex
+	sequences map[lossKey]*lossState
+	sinks     []LossSink
+	clock     clock.Clock
+}
+
+// NewLossDetector creates a detector without known sequences
+func NewLossDetector() *LossDetector {
+	return &LossDetector{
+		sequences: make(map[lossKey]*lossState),
+		clock:     clock.Real,
+	}
+}
+
+// SetClock sets the clock used to timestamp loss events (tests use a simulated clock)
+func (d *LossDetector) SetClock(c clock.Clock) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.clock = clock.OrReal(c)
+}
+
+// AddSink registers a sink for the loss events. Sinks are called in order
+// from Check and must not block.
+func (d *LossDetector) AddSink(sink LossSink) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.sinks = append(d.sinks, sink)
+}
+
+// Check registers the record number of a record read from source and
+// returns the number of records missing before it. Gaps are counted in
+// dri_records_missed_total and reported to the sinks.
+func (d *LossDetector) Check(source string, header *DatexHeader) int {
+	key := lossKey{source: source, plugID: header.PlugID}
+
+	d.mutex.Lock()
+	state, exists := d.sequences[key]
+	if !exists {
+		d.sequences[key] = &lossState{lastNbr: header.RNbr}
+		d.mutex.Unlock()
+		return 0
+	}
+	// r_nbr is a byte and wraps from 255 to 0
+	if step := header.RNbr - state.lastNbr; step == 0 || step > 255-LOSS_REORDER_WINDOW {
+		d.mutex.Unlock()
+		return 0
+	}
+	expected := state.lastNbr + 1
+	missed := int(header.RNbr - expected)
+	state.lastNbr = header.RNbr
+	if missed == 0 {
+		d.mutex.Unlock()
+		return 0
+	}
+	state.missed += missed
+	event := &LossEventJSON{
+		Source:        source,
+		PlugID:        int(header.PlugID),
+		Expected:      int(expected),
+		Received:      int(header.RNbr),
+		RecordsMissed: missed,
+		Time:          d.clock.Now(),
+	}
+	sinks := d.sinks
+	d.mutex.Unlock()
+
+	metricRecordsMissed.Add(float64(missed), source)
+	for _, sink := range sinks {
+		// A failing sink does not keep the others from the event
+		sink.HandleLossEvent(event)
+	}
+	return missed
+}
+
+// Missed returns the records missed on a source over all its monitors
+func (d *LossDetector) Missed(source string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	missed := 0
+	for key, state := range d.sequences {
+		if key.source == source {
+			missed += state.missed
+		}
+	}
+	return missed
+}
+
+// Reset forgets the sequences of a source, e.g. when it is replaced by
+// another capture. Its missed records are no longer counted.
+func (d *LossDetector) Reset(source string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key := range d.sequences {
+		if key.source == source {
+			delete(d.sequences, key)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package serial
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+)
+
+// MANAGER_BUFFER_SIZE is the default number of records waiting in the
+// aggregated stream of a Manager
+const MANAGER_BUFFER_SIZE = 1024
+
+// SourceRecord is a parsed record of one of the monitors of a Manager,
+// tagged with the connection it was received on
+type SourceRecord struct {
+	Source        string          `json:"source"`                   // Name of the transport
+	PlugID        int             `json:"plug_id"`                  // Plug ID of the monitor
+	Type          string          `json:"type"`                     // Main type: phdb, wave, alarm, network, fo
+	ReceivedAt    time.Time       `json:"received_at"`              // When the record was received
+	RecordsMissed int             `json:"records_missed,omitempty"` // Records of the monitor missing before this one
+	Header        *DatexHeader    `json:"-"`
+	Trend         *TrendJSON      `json:"trend,omitempty"`     // phdb
+	Waveforms     []*WaveformJSON `json:"waveforms,omitempty"` // wave
+	Alarm         *AlarmJSON      `json:"alarm,omitempty"`     // alarm
+	Record        []byte          `json:"-"`                   // The record as received, without its checksum
+}
+
+// PortOptions configures how the records of one monitor are parsed
+type PortOptions struct {
+	TimeSync    *TimeSync         // Monitor clock offset applied to record times (nil: none)
+	Calibration *CalibrationTable // Site calibrations of the waveforms (nil: none)
+}
+
+// PortHealth describes the state of one connection of a Manager
+type PortHealth struct {
+	Source      string     `json:"source"`
+	Running     bool       `json:"running"`               // Records are being read
+	Connected   bool       `json:"connected"`             // The port is open (false: reconnecting, data is stale)
+	Reconnects  int        `json:"reconnects"`            // Times the port was opened again
+	LastRecord  *time.Time `json:"last_record,omitempty"` // When the last record was received
+	Records     int        `json:"records"`               // Records parsed
+	ParseErrors int        `json:"parse_errors"`          // Records that failed to parse
+	Dropped     int        `json:"dropped"`               // Records dropped because the stream was full
+	Missed      int        `json:"records_missed"`        // Records missing in the record numbers of the monitors
+	Frames      FrameStats `json:"frames"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// managedPort is a transport read by a Manager
+type managedPort struct {
+	transport Transport
+	options   PortOptions
+	cancel    context.CancelFunc
+	done      chan struct{}
+	health    PortHealth
+}
+
+// Manager reads the records of several monitors at once, one transport per
+// monitor, and delivers them parsed and tagged with their source in a
+// single stream. A slow consumer never blocks the ports: records are
+// dropped when the stream is full and counted in the health of their port.
+type Manager struct {
+	mutex   sync.Mutex
+	ports   map[string]*managedPort
+	records chan SourceRecord
+	losses  *LossDetector
+	running sync.WaitGroup
+	clock   clock.Clock
+	closed  bool
+}
+
+// NewManager creates a manager whose stream holds up to bufferSize records
+// (0: MANAGER_BUFFER_SIZE)
+func NewManager(bufferSize int) *Manager {
+	if bufferSize <= 0 {
+		bufferSize = MANAGER_BUFFER_SIZE
+	}
+	return &Manager{
+		ports:   make(map[string]*managedPort),
+		records: make(chan SourceRecord, bufferSize),
+		losses:  NewLossDetector(),
+		clock:   clock.Real,
+	}
+}
+
+// SetClock sets the clock used to timestamp received records (tests use a simulated clock)
+func (m *Manager) SetClock(c clock.Clock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clock = clock.OrReal(c)
+}
+
+// Records returns the stream of the records of all ports. It is closed by Close.
+func (m *Manager) Records() <-chan SourceRecord {
+	return m.records
+}
+
+// Losses returns the detector of the records missing on the ports, e.g.
+// to add a sink for its events
+func (m *Manager) Losses() *LossDetector {
+	return m.losses
+}
+
+// Add starts reading the records of a transport. Transport names must be unique.
+func (m *Manager) Add(transport Transport, options PortOptions) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return fmt.Errorf("manager is closed")
+	}
+	if _, exists := m.ports[transport.Name()]; exists {
+		return fmt.Errorf("port %s is already managed", transport.Name())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	port := &managedPort{
+		transport: transport,
+		options:   options,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		health:    PortHealth{Source: transport.Name(), Running: true},
+	}
+	m.ports[transport.Name()] = port
+	m.running.Add(1)
+	go m.read(ctx, port)
+	return nil
+}
+
+// Remove stops reading a port and closes its transport
+func (m *Manager) Remove(name string) error {
+	m.mutex.Lock()
+	port, exists := m.ports[name]
+	delete(m.ports, name)
+	m.mutex.Unlock()
+	if !exists {
+		return fmt.Errorf("port %s is not managed", name)
+	}
+	err := m.stop(port)
+	m.losses.Reset(name)
+	return err
+}
+
+// Transport returns the transport of a port, e.g. to send requests to its monitor
+func (m *Manager) Transport(name string) (Transport, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	port, exists := m.ports[name]
+	if !exists {
+		return nil, false
+	}
+	return port.transport, true
+}
+
+// Health returns the state of every port ordered by name
+func (m *Manager) Health() []PortHealth {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	health := make([]PortHealth, 0, len(m.ports))
+	for _, port := range m.ports {
+		state := port.health
+		state.Connected = port.transport.Connected()
+		state.Reconnects = port.transport.Reconnects()
+		state.Missed = m.losses.Missed(port.health.Source)
+		state.Frames = port.transport.Stats()
+		health = append(health, state)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Source < health[j].Source })
+	return health
+}
+
+// GetStatus returns the health of the ports for the driver status
+func (m *Manager) GetStatus() map[string]interface{} {
+	return map[string]interface{}{
+		"ports": m.Health(),
+	}
+}
+
+// Close stops reading all ports, closes their transports and then the stream
+func (m *Manager) Close() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	ports := make([]*managedPort, 0, len(m.ports))
+	for _, port := range m.ports {
+		ports = append(ports, port)
+	}
+	m.mutex.Unlock()
+
+	var firstErr error
+	for _, port := range ports {
+		if err := m.stop(port); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	m.running.Wait()
+	close(m.records)
+	return firstErr
+}
+
+// stop cancels the reading of a port, closes its transport (in case the
+// read cannot be interrupted) and waits for the reading to end
+func (m *Manager) stop(port *managedPort) error {
+	port.cancel()
+	err := port.transport.Close()
+	<-port.done
+	return err
+}
+
+// read reads the records of a port until it ends or is stopped
+func (m *Manager) read(ctx context.Context, port *managedPort) {
+	defer m.running.Done()
+	defer close(port.done)
+
+	err := port.transport.ReadRecords(ctx, func(record []byte) error {
+		m.handle(port, record)
+		return nil
+	})
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	port.health.Running = false
+	if err != nil && ctx.Err() == nil {
+		port.health.LastError = err.Error()
+	}
+}
+
+// handle parses a record of a port and adds it to the stream
+func (m *Manager) handle(port *managedPort, record []byte) {
+	m.mutex.Lock()
+	receivedAt := m.clock.Now()
+	m.mutex.Unlock()
+
+	result, err := parseSourceRecord(record, port.options)
+	if result.Header != nil {
+		result.setRecordsMissed(m.losses.Check(port.transport.Name(), result.Header))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	port.health.LastRecord = &receivedAt
+	if err != nil {
+		port.health.ParseErrors++
+		port.health.LastError = err.Error()
+		// A waveform record still delivers the subrecords parsed before the failure
+		if len(result.Waveforms) == 0 {
+			return
+		}
+	} else {
+		port.health.Records++
+	}
+	result.Source = port.transport.Name()
+	result.ReceivedAt = receivedAt
+	select {
+	case m.records <- result:
+	default:
+		port.health.Dropped++
+	}
+}
+
+// setRecordsMissed annotates a record and its parsed data with the number
+// of records missing before it
+func (r *SourceRecord) setRecordsMissed(missed int) {
+	r.RecordsMissed = missed
+	if r.Trend != nil {
+		r.Trend.RecordsMissed = missed
+	}
+	if r.Alarm != nil {
+		r.Alarm.RecordsMissed = missed
+	}
+	for _, waveform := range r.Waveforms {
+		waveform.RecordsMissed = missed
+	}
+}
+
+// parseSourceRecord parses a record with the parser of its main type.
+// Records of other main types (network, fo) are delivered with their header
+// only.
+func parseSourceRecord(record []byte, options PortOptions) (SourceRecord, error) {
+	header, _, err := ValidateRecord(record)
+	if err != nil {
+		return SourceRecord{}, err
+	}
+	result := SourceRecord{
+		PlugID: int(header.PlugID),
+		Type:   GetMainTypeKey(header.RMainType),
+		Header: header,
+		Record: record,
+	}
+	switch header.RMainType {
+	case DRI_MT_PHDB:
+		result.Trend, err = NewTrendParser().ParseTrendData(record)
+	case DRI_MT_WAVE:
+		_, result.Waveforms, err = ParseWaveformRecords(record, options.TimeSync, options.Calibration)
+	case DRI_MT_ALARM:
+		result.Alarm, err = NewAlarmParser().ParseAlarmData(record)
+	}
+	return result, err
+}
@@ -0,0 +1,42 @@
+package serial
+
+import (
+	"github.com/harusin0516/healthcare/driver/metrics"
+)
+
+// DRI driver metrics, exported on the default metrics registry
+var (
+	metricRecordsParsed = metrics.Default.NewCounter("dri_records_parsed_total",
+		"DRI records parsed, by main type (phdb, wave, alarm)", "main_type")
+	metricParseErrors = metrics.Default.NewCounter("dri_parse_errors_total",
+		"DRI records that could not be parsed, by main type", "main_type")
+	metricChecksumFailures = metrics.Default.NewCounter("dri_checksum_failures_total",
+		"DRI frames discarded because of a checksum mismatch")
+	metricWaveformSamples = metrics.Default.NewCounter("dri_waveform_samples_total",
+		"Waveform samples parsed, by channel (rate() gives samples per second)", "channel")
+	metricAlarmEvents = metrics.Default.NewCounter("dri_alarm_events_total",
+		"Alarm lifecycle events of the alarm manager, by type (raised, escalated, cleared, ...)", "type")
+	metricTrendRowsExported = metrics.Default.NewCounter("dri_trend_rows_exported_total",
+		"Trend rows written by trend exporters, by format (csv, parquet)", "format")
+	metricACMMessages = metrics.Default.NewCounter("dri_acm_messages_total",
+		"ORU^R40 alert messages for the alert manager, by result (ok, error, dropped)", "result")
+	metricRecordsMissed = metrics.Default.NewCounter("dri_records_missed_total",
+		"DRI records missing in the record number sequence of a monitor, by source", "source")
+	metricClockAdjustments = metrics.Default.NewCounter("dri_clock_adjustments_total",
+		"Monitor clock drift corrections, by method (monitor, offset)", "method")
+)
+
+// RecordChecksumFailure counts a frame rejected by the serial framing layer
+// because its checksum did not match
+func RecordChecksumFailure() {
+	metricChecksumFailures.Inc()
+}
+
+// recordParseResult counts a parsed record or a parse error
+func recordParseResult(mainType int16, err error) {
+	if err != nil {
+		metricParseErrors.Inc(GetMainTypeKey(mainType))
+		return
+	}
+	metricRecordsParsed.Inc(GetMainTypeKey(mainType))
+}
@@ -0,0 +1,138 @@
+package serial
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NDJSON_BUFFER_SIZE is the size of the write buffer of an NDJSONWriter
+const NDJSON_BUFFER_SIZE = 64 * 1024
+
+// NDJSONWriter writes parsed records (*TrendJSON, *WaveformJSON,
+// *AlarmJSON, SourceRecord, events, ...) as newline-delimited JSON, one
+// record per line, optionally gzip-compressed. Each record is encoded
+// straight into a buffer without indentation, so continuous output can be
+// piped into files or log shippers without building JSON strings in
+// memory. The output policy is applied as in MarshalOutput. It is safe for
+// concurrent use.
+type NDJSONWriter struct {
+	mutex      sync.Mutex
+	buffer     *bufio.Writer
+	compressor *gzip.Writer // nil unless compressed
+	encoder    *json.Encoder
+	closer     io.Closer // File opened by CreateNDJSONFile
+	lines      int
+	closed     bool
+}
+
+// NewNDJSONWriter creates a writer of records to w, compressed with gzip
+// if compress is set. Closing the writer does not close w.
+func NewNDJSONWriter(w io.Writer, compress bool) *NDJSONWriter {
+	writer := &NDJSONWriter{}
+	if compress {
+		writer.compressor = gzip.NewWriter(w)
+		w = writer.compressor
+	}
+	writer.buffer = bufio.NewWriterSize(w, NDJSON_BUFFER_SIZE)
+	writer.encoder = json.NewEncoder(writer.buffer)
+	writer.encoder.SetEscapeHTML(false)
+	return writer
+}
+
+// CreateNDJSONFile creates (or truncates) a file of records, compressed
+// with gzip if its name ends with .gz. Close closes the file.
+func CreateNDJSONFile(name string) (*NDJSONWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", name, err)
+	}
+	writer := NewNDJSONWriter(file, strings.HasSuffix(name, ".gz"))
+	writer.closer = file
+	return writer, nil
+}
+
+// Write adds a record as one line
+func (w *NDJSONWriter) Write(record interface{}) error {
+	policy := GetOutputPolicy()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return fmt.Errorf("NDJSON writer is closed")
+	}
+	if policy == (OutputPolicy{}) {
+		if err := w.encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to encode record: %v", err)
+		}
+		w.lines++
+		return nil
+	}
+
+	encoded, err := MarshalOutput(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode record: %v", err)
+	}
+	if _, err := w.buffer.Write(encoded); err != nil {
+		return err
+	}
+	if err := w.buffer.WriteByte('\n'); err != nil {
+		return err
+	}
+	w.lines++
+	return nil
+}
+
+// Lines returns the number of records written
+func (w *NDJSONWriter) Lines() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.lines
+}
+
+// Flush writes the buffered records, so that a reader of the output (e.g. a
+// log shipper following the file) sees every complete line. Compressed
+// output is flushed to the end of the last record.
+func (w *NDJSONWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+	if w.compressor != nil {
+		return w.compressor.Flush()
+	}
+	return nil
+}
+
+// Close writes the buffered records and the end of the gzip stream and
+// closes the file of CreateNDJSONFile
+func (w *NDJSONWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.buffer.Flush()
+	if w.compressor != nil {
+		if closeErr := w.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
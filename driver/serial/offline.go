@@ -0,0 +1,279 @@
+package serial
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files written by IngestCapture in the output directory. Except for the
+// summary they hold one JSON object per line.
+const (
+	OFFLINE_FILE_TRENDS       = "trends.jsonl"       // Physiological data records (TrendJSON)
+	OFFLINE_FILE_WAVEFORMS    = "waveforms.jsonl"    // Waveform subrecords (WaveformJSON)
+	OFFLINE_FILE_ALARMS       = "alarms.jsonl"       // Alarm records (AlarmJSON)
+	OFFLINE_FILE_ALARM_EVENTS = "alarm_events.jsonl" // Alarm lifecycle events (AlarmEventJSON)
+	OFFLINE_FILE_ERRORS       = "errors.jsonl"       // Discarded frames and records that failed to parse
+	OFFLINE_FILE_SUMMARY      = "summary.json"       // OfflineSummary
+)
+
+// Capture formats
+const (
+	CAPTURE_RAW  = "raw"  // Bytes received on the serial line
+	CAPTURE_PCAP = "pcap" // Packets of serial-over-TCP traffic
+)
+
+// OfflineOptions configures the ingestion of a capture
+type OfflineOptions struct {
+	OutputDir   string            // Directory of the JSON output files, created if needed
+	Port        int               // pcap: only the TCP connections from or to this port (0: all)
+	TimeSync    *TimeSync         // Monitor clock offset applied to record times (nil: none)
+	Calibration *CalibrationTable // Site calibrations of the waveforms (nil: none)
+}
+
+// OfflineSummary describes an ingested capture
+type OfflineSummary struct {
+	Input   string                `json:"input"`
+	Format  string                `json:"format"` // raw or pcap
+	Sources []OfflineSourceReport `json:"sources"`
+}
+
+// OfflineSourceReport counts the records of one source of a capture: the
+// raw file, or one direction of a TCP connection
+type OfflineSourceReport struct {
+	Source      string     `json:"source"`
+	Stream      *TCPStream `json:"stream,omitempty"` // pcap only
+	Frames      FrameStats `json:"frames"`
+	Trends      int        `json:"trends"`
+	Waveforms   int        `json:"waveforms"` // Subrecords
+	Alarms      int        `json:"alarms"`
+	AlarmEvents int        `json:"alarm_events"`
+	Skipped     int        `json:"skipped"`        // Records of other main types, and network records holding patient data
+	Missed      int        `json:"records_missed"` // Records missing in the record numbers (r_nbr)
+	Errors      int        `json:"errors"`         // Records that failed to parse
+	FirstRecord *time.Time `json:"first_record,omitempty"`
+	LastRecord  *time.Time `json:"last_record,omitempty"`
+}
+
+// offlineEntry is a line of the output files
+type offlineEntry struct {
+	Source string          `json:"source"`
+	Record int             `json:"record"` // Position of the record in its source, from 1
+	Data   json.RawMessage `json:"data,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// offlineWriter writes the output files
+type offlineWriter struct {
+	files   []*os.File
+	writers map[string]*bufio.Writer
+}
+
+// IngestCapture runs a capture taken in the field through the same
+// deframing and parsing as live traffic and writes the results to JSON
+// files in the output directory, so that it can be analyzed without the
+// monitor. The file is a raw dump of the serial line or a pcap of
+// serial-over-TCP traffic, recognized by its header; every direction of
+// every TCP connection is processed as a separate source. Network records
+// (patient identification) are counted but not written.
+func IngestCapture(file string, options OfflineOptions) (*OfflineSummary, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture: %v", err)
+	}
+	if options.OutputDir == "" {
+		return nil, fmt.Errorf("an output directory is required")
+	}
+	if err := os.MkdirAll(options.OutputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	summary := &OfflineSummary{Input: file, Format: CAPTURE_RAW}
+	var streams []*TCPStream
+	if IsPcap(data) {
+		summary.Format = CAPTURE_PCAP
+		if streams, err = ReadTCPStreams(bytes.NewReader(data), options.Port); err != nil {
+			return nil, err
+		}
+	}
+
+	output, err := newOfflineWriter(options.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	defer output.close()
+
+	if summary.Format == CAPTURE_RAW {
+		report := ingestStream(filepath.Base(file), data, options, output)
+		summary.Sources = append(summary.Sources, report)
+	}
+	for _, stream := range streams {
+		report := ingestStream(stream.Name(), stream.Data, options, output)
+		report.Stream = stream
+		summary.Sources = append(summary.Sources, report)
+	}
+
+	if err := output.flush(); err != nil {
+		return summary, err
+	}
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(summary); err != nil {
+		return summary, err
+	}
+	if err := os.WriteFile(filepath.Join(options.OutputDir, OFFLINE_FILE_SUMMARY), encoded.Bytes(), 0644); err != nil {
+		return summary, fmt.Errorf("failed to write summary: %v", err)
+	}
+	return summary, nil
+}
+
+// ingestStream deframes and parses the bytes of one source. Each source has
+// its own alarm state, as a monitor would.
+func ingestStream(source string, data []byte, options OfflineOptions, output *offlineWriter) OfflineSourceReport {
+	report := OfflineSourceReport{Source: source}
+	reader := NewFrameReader(bytes.NewReader(data))
+	alarms := NewAlarmManager()
+	alarms.SetTimeSync(options.TimeSync)
+	losses := NewLossDetector()
+
+	for n := 1; ; n++ {
+		record, err := reader.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Discarded frames are counted in the frame statistics
+			output.write(OFFLINE_FILE_ERRORS, offlineEntry{Source: source, Record: n, Error: err.Error()}, nil)
+			if errors.Is(err, ErrInvalidFrame) || errors.Is(err, ErrChecksumMismatch) {
+				continue
+			}
+			break
+		}
+		ingestRecord(source, n, record, &report, options, alarms, losses, output)
+	}
+	report.Frames = reader.Stats()
+	return report
+}
+
+// ingestRecord parses a record with the parser of its main type
+func ingestRecord(source string, n int, record []byte, report *OfflineSourceReport, options OfflineOptions,
+	alarms *AlarmManager, losses *LossDetector, output *offlineWriter) {
+	entry := offlineEntry{Source: source, Record: n}
+	failed := func(err error) {
+		report.Errors++
+		entry.Error = err.Error()
+		output.write(OFFLINE_FILE_ERRORS, entry, nil)
+	}
+
+	header, _, err := ValidateRecord(record)
+	if err != nil {
+		failed(err)
+		return
+	}
+	recordTime := options.TimeSync.RecordTime(header.RTime)
+	if report.FirstRecord == nil {
+		report.FirstRecord = &recordTime
+	}
+	report.LastRecord = &recordTime
+	missed := losses.Check(source, header)
+	report.Missed += missed
+
+	switch header.RMainType {
+	case DRI_MT_PHDB:
+		trend, err := NewTrendParser().ParseTrendData(record)
+		if err != nil {
+			failed(err)
+			return
+		}
+		trend.RecordsMissed = missed
+		report.Trends++
+		output.write(OFFLINE_FILE_TRENDS, entry, trend)
+	case DRI_MT_WAVE:
+		_, waveforms, err := ParseWaveformRecords(record, options.TimeSync, options.Calibration)
+		for _, waveform := range waveforms {
+			waveform.RecordsMissed = missed
+			report.Waveforms++
+			output.write(OFFLINE_FILE_WAVEFORMS, entry, waveform)
+		}
+		if err != nil {
+			failed(err)
+		}
+	case DRI_MT_ALARM:
+		alarm, err := NewAlarmParser().ParseAlarmData(record)
+		if err != nil {
+			failed(err)
+			return
+		}
+		alarm.RecordsMissed = missed
+		report.Alarms++
+		output.write(OFFLINE_FILE_ALARMS, entry, alarm)
+		events, err := alarms.ProcessRecord(record)
+		for _, event := range events {
+			report.AlarmEvents++
+			output.write(OFFLINE_FILE_ALARM_EVENTS, entry, event)
+		}
+		if err != nil {
+			failed(err)
+		}
+	default:
+		report.Skipped++
+	}
+}
+
+// newOfflineWriter creates the output files, replacing previous results
+func newOfflineWriter(dir string) (*offlineWriter, error) {
+	w := &offlineWriter{writers: make(map[string]*bufio.Writer)}
+	names := []string{OFFLINE_FILE_TRENDS, OFFLINE_FILE_WAVEFORMS, OFFLINE_FILE_ALARMS, OFFLINE_FILE_ALARM_EVENTS, OFFLINE_FILE_ERRORS}
+	for _, name := range names {
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			w.close()
+			return nil, fmt.Errorf("failed to create output file: %v", err)
+		}
+		w.files = append(w.files, file)
+		w.writers[name] = bufio.NewWriter(file)
+	}
+	return w, nil
+}
+
+// write adds a line to an output file with data encoded by the output
+// policy. A value that cannot be encoded is written as an error.
+func (w *offlineWriter) write(name string, entry offlineEntry, data interface{}) {
+	if data != nil {
+		encoded, err := MarshalOutput(data)
+		if err != nil {
+			entry.Error = fmt.Sprintf("failed to encode output: %v", err)
+			name = OFFLINE_FILE_ERRORS
+		} else {
+			entry.Data = encoded
+		}
+	}
+	encoder := json.NewEncoder(w.writers[name])
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(entry)
+}
+
+// flush writes the buffered lines
+func (w *offlineWriter) flush() error {
+	for name, writer := range w.writers {
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// close closes the output files
+func (w *offlineWriter) close() {
+	for _, file := range w.files {
+		file.Close()
+	}
+}
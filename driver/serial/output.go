@@ -0,0 +1,169 @@
+package serial
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Field naming of the JSON output
+const (
+	FIELD_NAMING_AS_DEFINED = ""           // Field names as defined by the parsers (mostly snake_case)
+	FIELD_NAMING_SNAKE      = "snake_case" // Every field name, including those of subrecord handlers, in snake_case
+	FIELD_NAMING_CAMEL      = "camelCase"
+)
+
+// rawFields are the fields holding undecoded values, dropped by OmitRawValues
+var rawFields = map[string]bool{
+	"raw_value": true,
+	"raw_data":  true,
+}
+
+// OutputPolicy configures the JSON of parsed records (ParseTrendJSON,
+// ParseWaveJSON, ParseAlarmJSON, the ParseMultiple...ToJSON functions,
+// WaveformData.ToJSON and RecordPublisher). The zero value outputs the records as defined.
+type OutputPolicy struct {
+	FieldNaming   string `json:"field_naming"`    // FIELD_NAMING_*
+	OmitRawValues bool   `json:"omit_raw_values"` // Drop raw_value and raw_data fields
+	OmitReserved  bool   `json:"omit_reserved"`   // Drop reserved fields (reserved, reserved2, ...)
+}
+
+var (
+	outputMutex  sync.RWMutex
+	outputPolicy OutputPolicy
+)
+
+// Validate checks the field naming of the policy
+func (p OutputPolicy) Validate() error {
+	switch p.FieldNaming {
+	case FIELD_NAMING_AS_DEFINED, FIELD_NAMING_SNAKE, FIELD_NAMING_CAMEL:
+		return nil
+	}
+	return fmt.Errorf("unknown field naming %q (snake_case, camelCase)", p.FieldNaming)
+}
+
+// SetOutputPolicy replaces the policy applied to the JSON output
+func SetOutputPolicy(policy OutputPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	outputPolicy = policy
+	return nil
+}
+
+// GetOutputPolicy returns the policy set with SetOutputPolicy
+func GetOutputPolicy() OutputPolicy {
+	outputMutex.RLock()
+	defer outputMutex.RUnlock()
+	return outputPolicy
+}
+
+// MarshalOutput encodes a parsed record (or any value) as JSON with the
+// output policy applied. With a policy other than the zero value, the fields
+// of each object are written in name order.
+func MarshalOutput(v interface{}) ([]byte, error) {
+	return marshalOutput(v, "")
+}
+
+// MarshalOutputIndent is MarshalOutput with indentation
+func MarshalOutputIndent(v interface{}, indent string) ([]byte, error) {
+	return marshalOutput(v, indent)
+}
+
+// marshalOutput encodes v and rewrites the encoding with the output policy
+func marshalOutput(v interface{}, indent string) ([]byte, error) {
+	policy := GetOutputPolicy()
+	if policy == (OutputPolicy{}) {
+		if indent != "" {
+			return json.MarshalIndent(v, "", indent)
+		}
+		return json.Marshal(v)
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value = policy.apply(value)
+	if indent != "" {
+		return json.MarshalIndent(value, "", indent)
+	}
+	return json.Marshal(value)
+}
+
+// apply renames and drops the fields of a decoded JSON value
+func (p OutputPolicy) apply(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			name := snakeCase(key)
+			if (p.OmitRawValues && rawFields[name]) || (p.OmitReserved && isReservedField(name)) {
+				continue
+			}
+			switch p.FieldNaming {
+			case FIELD_NAMING_AS_DEFINED:
+				name = key
+			case FIELD_NAMING_CAMEL:
+				name = camelCase(name)
+			}
+			fields[name] = p.apply(field)
+		}
+		return fields
+	case []interface{}:
+		for i := range v {
+			v[i] = p.apply(v[i])
+		}
+	}
+	return value
+}
+
+// isReservedField reports whether a snake_case field name is reserved,
+// reserved1 ... reserved9
+func isReservedField(name string) bool {
+	suffix := strings.TrimPrefix(name, "reserved")
+	return suffix != name && strings.Trim(suffix, "0123456789") == ""
+}
+
+// snakeCase converts a field name to snake_case ("PlugID" and "plugId" to
+// "plug_id"); snake_case names are returned unchanged
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var builder strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// A word starts at an upper case letter after a lower case
+			// letter or digit, or at the last letter of an acronym
+			if i > 0 && runes[i-1] != '_' && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				builder.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// camelCase converts a snake_case field name to camelCase ("plug_id" to
+// "plugId")
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,351 @@
+package serial
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Parquet physical types, repetition types and converted types (parquet.thrift)
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+)
+
+// parquetMagic starts and ends every Parquet file
+const parquetMagic = "PAR1"
+
+// parquetColumn describes a flat column of a Parquet file
+type parquetColumn struct {
+	name          string
+	physicalType  int32
+	convertedType int32 // -1: none
+	optional      bool
+}
+
+// parquetValue is a cell of a column; nil is null (optional columns only)
+type parquetValue interface{}
+
+// parquetChunk locates a written column chunk for the footer
+type parquetChunk struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+// parquetRowGroup locates a written row group for the footer
+type parquetRowGroup struct {
+	chunks  []parquetChunk
+	numRows int64
+	size    int64
+}
+
+// parquetWriter writes a Parquet file with flat columns, one uncompressed
+// PLAIN data page per column chunk and one row group per WriteRowGroup. It
+// implements the subset of the format needed for tabular exports; readers
+// such as Spark, DuckDB and pyarrow accept the files.
+type parquetWriter struct {
+	w         io.Writer
+	columns   []parquetColumn
+	offset    int64
+	rowGroups []parquetRowGroup
+}
+
+// newParquetWriter writes the file header to w
+func newParquetWriter(w io.Writer, columns []parquetColumn) (*parquetWriter, error) {
+	p := &parquetWriter{w: w, columns: columns}
+	if err := p.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// write writes data and advances the file offset
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+// WriteRowGroup writes rows (one value per column each) as a row group
+func (p *parquetWriter) WriteRowGroup(rows [][]parquetValue) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	group := parquetRowGroup{numRows: int64(len(rows))}
+	for index, column := range p.columns {
+		levels := make([]bool, len(rows))
+		values := make([]byte, 0, len(rows)*8)
+		for i, row := range rows {
+			value := row[index]
+			if value == nil {
+				if !column.optional {
+					return fmt.Errorf("parquet column %s: null in required column", column.name)
+				}
+				continue
+			}
+			levels[i] = true
+			encoded, err := parquetPlain(column.physicalType, value)
+			if err != nil {
+				return fmt.Errorf("parquet column %s: %v", column.name, err)
+			}
+			values = append(values, encoded...)
+		}
+
+		page := make([]byte, 0, len(values)+16)
+		if column.optional {
+			definition := parquetLevels(levels)
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(definition)))
+			page = append(page, definition...)
+		}
+		page = append(page, values...)
+
+		var header parquetThrift
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.beginStruct(5) // DataPageHeader
+		header.i32(1, int32(len(rows)))
+		header.i32(2, parquetEncodingPlain)
+		header.i32(3, parquetEncodingRLE)
+		header.i32(4, parquetEncodingRLE)
+		header.endStruct()
+		header.stop()
+
+		chunk := parquetChunk{offset: p.offset, numValues: int64(len(rows))}
+		if err := p.write(header.data); err != nil {
+			return err
+		}
+		if err := p.write(page); err != nil {
+			return err
+		}
+		chunk.size = p.offset - chunk.offset
+		group.size += chunk.size
+		group.chunks = append(group.chunks, chunk)
+	}
+	p.rowGroups = append(p.rowGroups, group)
+	return nil
+}
+
+// Close writes the footer. It does not close the underlying writer.
+func (p *parquetWriter) Close() error {
+	var footer parquetThrift
+	footer.i32(1, 1) // version
+
+	footer.beginList(2, len(p.columns)+1) // schema
+	footer.beginElement()
+	footer.str(4, "schema")
+	footer.i32(5, int32(len(p.columns)))
+	footer.endStruct()
+	for _, column := range p.columns {
+		footer.beginElement()
+		footer.i32(1, column.physicalType)
+		repetition := int32(parquetRequired)
+		if column.optional {
+			repetition = parquetOptional
+		}
+		footer.i32(3, repetition)
+		footer.str(4, column.name)
+		if column.convertedType >= 0 {
+			footer.i32(6, column.convertedType)
+		}
+		footer.endStruct()
+	}
+
+	numRows := int64(0)
+	for _, group := range p.rowGroups {
+		numRows += group.numRows
+	}
+	footer.i64(3, numRows)
+
+	footer.beginList(4, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		footer.beginElement()
+		footer.beginList(1, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			footer.beginElement()
+			footer.i64(2, chunk.offset)
+			footer.beginStruct(3) // ColumnMetaData
+			footer.i32(1, column.physicalType)
+			footer.i32List(2, []int32{parquetEncodingPlain, parquetEncodingRLE})
+			footer.strList(3, []string{column.name})
+			footer.i32(4, 0) // UNCOMPRESSED
+			footer.i64(5, chunk.numValues)
+			footer.i64(6, chunk.size)
+			footer.i64(7, chunk.size)
+			footer.i64(9, chunk.offset)
+			footer.endStruct()
+			footer.endStruct()
+		}
+		footer.i64(2, group.size)
+		footer.i64(3, group.numRows)
+		footer.endStruct()
+	}
+	footer.str(6, "healthcare driver/serial")
+	footer.stop()
+
+	if err := p.write(footer.data); err != nil {
+		return err
+	}
+	if err := p.write(binary.LittleEndian.AppendUint32(nil, uint32(len(footer.data)))); err != nil {
+		return err
+	}
+	return p.write([]byte(parquetMagic))
+}
+
+// parquetPlain encodes a value with the PLAIN encoding of its physical type
+func parquetPlain(physicalType int32, value parquetValue) ([]byte, error) {
+	switch physicalType {
+	case parquetInt32:
+		if v, ok := value.(int32); ok {
+			return binary.LittleEndian.AppendUint32(nil, uint32(v)), nil
+		}
+	case parquetInt64:
+		if v, ok := value.(int64); ok {
+			return binary.LittleEndian.AppendUint64(nil, uint64(v)), nil
+		}
+	case parquetDouble:
+		if v, ok := value.(float64); ok {
+			return binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)), nil
+		}
+	case parquetByteArray:
+		if v, ok := value.(string); ok {
+			return append(binary.LittleEndian.AppendUint32(nil, uint32(len(v))), v...), nil
+		}
+	}
+	return nil, fmt.Errorf("value %v does not match physical type %d", value, physicalType)
+}
+
+// parquetLevels encodes definition levels of bit width 1 as RLE runs
+func parquetLevels(defined []bool) []byte {
+	data := make([]byte, 0, 16)
+	for i := 0; i < len(defined); {
+		run := 1
+		for i+run < len(defined) && defined[i+run] == defined[i] {
+			run++
+		}
+		data = binary.AppendUvarint(data, uint64(run)<<1)
+		if defined[i] {
+			data = append(data, 1)
+		} else {
+			data = append(data, 0)
+		}
+		i += run
+	}
+	return data
+}
+
+// Thrift compact protocol type IDs
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetThrift encodes the Parquet metadata structures with the Thrift
+// compact protocol
+type parquetThrift struct {
+	data    []byte
+	lastID  int16
+	idStack []int16
+}
+
+// field writes a field header
+func (t *parquetThrift) field(id int16, fieldType byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.data = append(t.data, byte(delta)<<4|fieldType)
+	} else {
+		t.data = append(t.data, fieldType)
+		t.data = binary.AppendVarint(t.data, int64(id))
+	}
+	t.lastID = id
+}
+
+func (t *parquetThrift) i32(id int16, value int32) {
+	t.field(id, thriftI32)
+	t.data = binary.AppendVarint(t.data, int64(value))
+}
+
+func (t *parquetThrift) i64(id int16, value int64) {
+	t.field(id, thriftI64)
+	t.data = binary.AppendVarint(t.data, value)
+}
+
+func (t *parquetThrift) str(id int16, value string) {
+	t.field(id, thriftBinary)
+	t.data = binary.AppendUvarint(t.data, uint64(len(value)))
+	t.data = append(t.data, value...)
+}
+
+// listHeader writes the header of a list of size elements
+func (t *parquetThrift) listHeader(size int, elementType byte) {
+	if size < 15 {
+		t.data = append(t.data, byte(size)<<4|elementType)
+		return
+	}
+	t.data = append(t.data, 0xF0|elementType)
+	t.data = binary.AppendUvarint(t.data, uint64(size))
+}
+
+func (t *parquetThrift) i32List(id int16, values []int32) {
+	t.field(id, thriftList)
+	t.listHeader(len(values), thriftI32)
+	for _, value := range values {
+		t.data = binary.AppendVarint(t.data, int64(value))
+	}
+}
+
+func (t *parquetThrift) strList(id int16, values []string) {
+	t.field(id, thriftList)
+	t.listHeader(len(values), thriftBinary)
+	for _, value := range values {
+		t.data = binary.AppendUvarint(t.data, uint64(len(value)))
+		t.data = append(t.data, value...)
+	}
+}
+
+// beginList starts a field holding a list of size structs; write each with
+// beginElement and endStruct
+func (t *parquetThrift) beginList(id int16, size int) {
+	t.field(id, thriftList)
+	t.listHeader(size, thriftStruct)
+}
+
+// beginElement starts a struct element of a list
+func (t *parquetThrift) beginElement() {
+	t.idStack = append(t.idStack, t.lastID)
+	t.lastID = 0
+}
+
+// beginStruct starts a struct field
+func (t *parquetThrift) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElement()
+}
+
+// endStruct ends a struct field or element
+func (t *parquetThrift) endStruct() {
+	t.data = append(t.data, 0)
+	t.lastID = t.idStack[len(t.idStack)-1]
+	t.idStack = t.idStack[:len(t.idStack)-1]
+}
+
+// stop ends the top-level struct
+func (t *parquetThrift) stop() {
+	t.data = append(t.data, 0)
+}
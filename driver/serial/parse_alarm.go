@@ -1,7 +1,6 @@
 package serial
 
 import (
-	"encoding/json"
 	"fmt"
 	"time"
 )
@@ -12,13 +11,14 @@ type AlarmJSON struct {
 	UnixTimestamp uint32                 `json:"unix_timestamp"`
 	RecordType    string                 `json:"record_type"`
 	RecordNumber  int                    `json:"record_number"`
+	RecordsMissed int                    `json:"records_missed,omitempty"` // Records missing before this one (see LossDetector)
 	DriLevel      int                    `json:"dri_level"`
 	DriLevelDesc  string                 `json:"dri_level_description"`
 	PlugID        int                    `json:"plug_id"`
 	MainType      int                    `json:"main_type"`
 	MainTypeName  string                 `json:"main_type_name"`
 	Subrecords    []AlarmSubrecordJSON   `json:"subrecords"`
-	AlarmData     map[string]interface{} `json:"alarm_data"`
+	AlarmData     *AlarmSubrecordsJSON   `json:"alarm_data"`
 	IsValid       bool                   `json:"is_valid"`
 	ParseErrors   []string               `json:"parse_errors,omitempty"`
 }
@@ -31,40 +31,42 @@ type AlarmSubrecordJSON struct {
 	TypeName     string                 `json:"type_name"`
 	IsValid      bool                   `json:"is_valid"`
 	IsEndOfList  bool                   `json:"is_end_of_list"`
-	Data         map[string]interface{} `json:"data,omitempty"`
+	Data         interface{}            `json:"data,omitempty"`
 }
 
-// AlarmParser manages the parsing process for alarm data
-type AlarmParser struct {
+// AlarmParser manages the parsing process for alarm data. It keeps no state
+// between records (the problems of a record are returned in its
+// ParseErrors), so one parser can be shared by concurrent readers.
+type AlarmParser struct{}
+
+// alarmParse is the state of the parse of one alarm record
+type alarmParse struct {
 	errors []string
 }
 
 // NewAlarmParser creates a new alarm parser
 func NewAlarmParser() *AlarmParser {
-	return &AlarmParser{
-		errors: make([]string, 0),
-	}
+	return &AlarmParser{}
 }
 
 // ParseAlarmData parses a single binary alarm record into AlarmJSON
-func (p *AlarmParser) ParseAlarmData(data []byte) (*AlarmJSON, error) {
-	if len(data) < 32 { // Minimum size for DatexHeader
-		p.addError("data too short for alarm record")
-		return nil, ErrInvalidDataLength
-	}
-
-	// Parse the Datex-Ohmeda Record header
-	header := &DatexHeader{}
-	if err := header.UnmarshalBinary(data[:32]); err != nil {
-		p.addError(fmt.Sprintf("failed to parse header: %v", err))
+func (p *AlarmParser) ParseAlarmData(data []byte) (alarm *AlarmJSON, err error) {
+	defer func() {
+		recoverFrame(recover(), "alarm", data, &err)
+		recordParseResult(DRI_MT_ALARM, err)
+	}()
+	
+	// Parse the Datex-Ohmeda Record header and locate the subrecords
+	header, subrecords, err := ValidateRecord(data)
+	if err != nil {
 		return nil, err
 	}
 
 	// Validate that this is an alarm record
 	if header.RMainType != DRI_MT_ALARM {
-		p.addError(fmt.Sprintf("expected alarm record type %d, got %d", DRI_MT_ALARM, header.RMainType))
-		return nil, fmt.Errorf("invalid record type for alarm data")
+		return nil, fmt.Errorf("%w: invalid record type for alarm data: expected %d, got %d", ErrInvalidRecord, DRI_MT_ALARM, header.RMainType)
 	}
+	run := &alarmParse{errors: make([]string, 0)}
 
 	// Create the JSON structure
 	alarmJSON := &AlarmJSON{
@@ -78,31 +80,29 @@ func (p *AlarmParser) ParseAlarmData(data []byte) (*AlarmJSON, error) {
 		MainType:      int(header.RMainType),
 		MainTypeName:  header.GetMainTypeName(),
 		Subrecords:    make([]AlarmSubrecordJSON, 0),
-		AlarmData:     make(map[string]interface{}),
 		IsValid:       true,
-		ParseErrors:   make([]string, 0),
 	}
 
 	// Parse subrecords
-	if err := p.parseAlarmSubrecords(header, data, alarmJSON); err != nil {
-		p.addError(fmt.Sprintf("failed to parse subrecords: %v", err))
+	if err := run.parseAlarmSubrecords(data, header, subrecords, alarmJSON); err != nil {
+		run.addError(fmt.Sprintf("failed to parse subrecords: %v", err))
 		alarmJSON.IsValid = false
 	}
 
 	// Parse alarm data
-	if err := p.parseAlarmData(header, data, alarmJSON); err != nil {
-		p.addError(fmt.Sprintf("failed to parse alarm data: %v", err))
+	if err := run.parseAlarmData(subrecords, alarmJSON); err != nil {
+		run.addError(fmt.Sprintf("failed to parse alarm data: %v", err))
 		alarmJSON.IsValid = false
 	}
 
 	// Add any parsing errors
-	alarmJSON.ParseErrors = p.errors
+	alarmJSON.ParseErrors = run.errors
 
 	return alarmJSON, nil
 }
 
 // parseAlarmSubrecords parses the subrecord descriptors
-func (p *AlarmParser) parseAlarmSubrecords(header *DatexHeader, data []byte, alarmJSON *AlarmJSON) error {
+func (p *alarmParse) parseAlarmSubrecords(data []byte, header *DatexHeader, subrecords []Subrecord, alarmJSON *AlarmJSON) error {
 	for i := 0; i < 8; i++ {
 		srDesc := header.SrDesc[i]
 		
@@ -115,10 +115,17 @@ func (p *AlarmParser) parseAlarmSubrecords(header *DatexHeader, data []byte, ala
 			IsEndOfList: srDesc.IsEndOfList(),
 		}
 
-		// Parse subrecord data if it's valid
-		if srDesc.IsValid() && srDesc.SrOffset >= 0 && int(srDesc.SrOffset) < len(data) {
-			subrecordData := p.parseSubrecordData(srDesc.SrType, data[srDesc.SrOffset:])
-			if subrecordData != nil {
+		// Parse subrecord data if it's valid (subrecords lists the
+		// descriptors before the end of list in order)
+		if i < len(subrecords) {
+			if handler, exists := lookupSubrecordHandler(header.RMainType, subrecords[i].Type); exists {
+				subrecordJSON.TypeName = handler.Name
+				output, err := decodeSubrecord(handler, data, header, subrecords[i])
+				if err != nil {
+					p.addError(err.Error())
+				}
+				subrecordJSON.Data = output
+			} else if subrecordData := p.parseSubrecordData(subrecords[i].Type, subrecords[i].Data); subrecordData != nil {
 				subrecordJSON.Data = subrecordData
 			}
 		}
@@ -130,55 +137,54 @@ func (p *AlarmParser) parseAlarmSubrecords(header *DatexHeader, data []byte, ala
 }
 
 // parseAlarmData parses the actual alarm data
-func (p *AlarmParser) parseAlarmData(header *DatexHeader, data []byte, alarmJSON *AlarmJSON) error {
+func (p *alarmParse) parseAlarmData(subrecords []Subrecord, alarmJSON *AlarmJSON) error {
 	// Find the first valid alarm subrecord
 	var alarmSubrecord *AlarmSubrecords
-	for i := 0; i < 8; i++ {
-		srDesc := header.SrDesc[i]
-		if srDesc.IsValid() && srDesc.SrType == DRI_AL_STATUS {
+	for _, subrecord := range subrecords {
+		if subrecord.Type == DRI_AL_STATUS {
 			// Parse alarm subrecords
 			alarmSubrecord = &AlarmSubrecords{}
-			if srDesc.SrOffset >= 0 && int(srDesc.SrOffset) < len(data) {
-				if err := alarmSubrecord.UnmarshalBinary(data[srDesc.SrOffset:]); err != nil {
-					p.addError(fmt.Sprintf("failed to parse alarm subrecords: %v", err))
-					return err
-				}
+			if err := alarmSubrecord.UnmarshalBinary(subrecord.Data); err != nil {
+				p.addError(fmt.Sprintf("failed to parse alarm subrecords: %v", err))
+				return err
 			}
 			break
 		}
 	}
 
 	if alarmSubrecord != nil {
-		alarmJSON.AlarmData = alarmSubrecord.ToJSON()
+		alarmJSON.AlarmData = alarmSubrecord.ToStruct()
 	}
 
 	return nil
 }
 
 // parseSubrecordData dispatches parsing based on subrecord type
-func (p *AlarmParser) parseSubrecordData(subrecordType byte, data []byte) map[string]interface{} {
+func (p *alarmParse) parseSubrecordData(subrecordType byte, data []byte) interface{} {
 	switch subrecordType {
 	case DRI_AL_STATUS:
-		return p.parseAlarmStatusData(data)
+		if message := p.parseAlarmStatusData(data); message != nil {
+			return message
+		}
 	default:
 		p.addError(fmt.Sprintf("unknown alarm subrecord type: %d", subrecordType))
-		return nil
 	}
+	return nil
 }
 
 // parseAlarmStatusData parses alarm status data
-func (p *AlarmParser) parseAlarmStatusData(data []byte) map[string]interface{} {
+func (p *alarmParse) parseAlarmStatusData(data []byte) *AlarmStatusMessageJSON {
 	alarmMsg := &AlarmStatusMessage{}
 	if err := alarmMsg.UnmarshalBinary(data); err != nil {
 		p.addError(fmt.Sprintf("failed to parse alarm status message: %v", err))
 		return nil
 	}
 
-	return alarmMsg.ToJSON()
+	return alarmMsg.ToStruct()
 }
 
 // getAlarmSubrecordTypeName returns the human-readable name for alarm subrecord type
-func (p *AlarmParser) getAlarmSubrecordTypeName(subrecordType byte) string {
+func (p *alarmParse) getAlarmSubrecordTypeName(subrecordType byte) string {
 	switch subrecordType {
 	case DRI_AL_STATUS:
 		return "Alarm Status"
@@ -190,37 +196,41 @@ func (p *AlarmParser) getAlarmSubrecordTypeName(subrecordType byte) string {
 }
 
 // addError adds an error to the parser's list
-func (p *AlarmParser) addError(err string) {
+func (p *alarmParse) addError(err string) {
 	p.errors = append(p.errors, err)
 }
 
 // ParseMultipleAlarms parses multiple alarm records
 func (p *AlarmParser) ParseMultipleAlarms(data []byte) ([]*AlarmJSON, error) {
+	alarms, _ := p.parseMultipleAlarms(data)
+	return alarms, nil
+}
+
+// parseMultipleAlarms parses multiple alarm records and returns the
+// problems of the records that could not be parsed
+func (p *AlarmParser) parseMultipleAlarms(data []byte) ([]*AlarmJSON, []string) {
 	var alarms []*AlarmJSON
+	run := &alarmParse{errors: make([]string, 0)}
 	offset := 0
 
 	for offset < len(data) {
-		if len(data[offset:]) < 32 {
-			break
-		}
-
 		// Try to parse the header to get the record length
 		header := &DatexHeader{}
-		if err := header.UnmarshalBinary(data[offset:offset+32]); err != nil {
-			p.addError(fmt.Sprintf("failed to parse header at offset %d: %v", offset, err))
+		if err := header.UnmarshalBinary(data[offset:]); err != nil {
+			run.addError(fmt.Sprintf("failed to parse header at offset %d: %v", offset, err))
 			break
 		}
 
 		recordLength := int(header.RLen)
-		if recordLength <= 0 || offset+recordLength > len(data) {
-			p.addError(fmt.Sprintf("invalid record length %d at offset %d", recordLength, offset))
+		if recordLength < header.Size() || offset+recordLength > len(data) {
+			run.addError(fmt.Sprintf("invalid record length %d at offset %d", recordLength, offset))
 			break
 		}
 
 		// Parse the alarm record
 		alarmJSON, err := p.ParseAlarmData(data[offset : offset+recordLength])
 		if err != nil {
-			p.addError(fmt.Sprintf("failed to parse alarm record at offset %d: %v", offset, err))
+			run.addError(fmt.Sprintf("failed to parse alarm record at offset %d: %v", offset, err))
 			offset += recordLength
 			continue
 		}
@@ -229,12 +239,12 @@ func (p *AlarmParser) ParseMultipleAlarms(data []byte) ([]*AlarmJSON, error) {
 		offset += recordLength
 	}
 
-	return alarms, nil
+	return alarms, run.errors
 }
 
 // ToJSON converts AlarmJSON to a pretty-printed string
 func (p *AlarmParser) ToJSON(alarm *AlarmJSON) (string, error) {
-	jsonBytes, err := json.MarshalIndent(alarm, "", "  ")
+	jsonBytes, err := MarshalOutputIndent(alarm, "  ")
 	if err != nil {
 		return "", err
 	}
@@ -243,8 +253,8 @@ func (p *AlarmParser) ToJSON(alarm *AlarmJSON) (string, error) {
 
 // Convenience functions for easy use
 
-// ParseAndConvertToJSON parses binary alarm data and converts to JSON string
-func ParseAndConvertToJSON(data []byte) (string, error) {
+// ParseAlarmJSON parses binary alarm data and converts to JSON string
+func ParseAlarmJSON(data []byte) (string, error) {
 	parser := NewAlarmParser()
 	alarm, err := parser.ParseAlarmData(data)
 	if err != nil {
@@ -253,28 +263,24 @@ func ParseAndConvertToJSON(data []byte) (string, error) {
 	return parser.ToJSON(alarm)
 }
 
-// ParseAndConvertToStruct parses binary alarm data and returns the struct
-func ParseAndConvertToStruct(data []byte) (*AlarmJSON, error) {
+// ParseAlarmStruct parses binary alarm data and returns the struct
+func ParseAlarmStruct(data []byte) (*AlarmJSON, error) {
 	parser := NewAlarmParser()
 	return parser.ParseAlarmData(data)
 }
 
 // ParseMultipleAlarmsToJSON parses multiple alarm records and converts to JSON string
 func ParseMultipleAlarmsToJSON(data []byte) (string, error) {
-	parser := NewAlarmParser()
-	alarms, err := parser.ParseMultipleAlarms(data)
-	if err != nil {
-		return "", err
-	}
+	alarms, parseErrors := NewAlarmParser().parseMultipleAlarms(data)
 
 	// Create a wrapper structure for multiple alarms
 	result := map[string]interface{}{
 		"alarm_count": len(alarms),
 		"alarms":      alarms,
-		"parse_errors": parser.errors,
+		"parse_errors": parseErrors,
 	}
 
-	jsonBytes, err := json.MarshalIndent(result, "", "  ")
+	jsonBytes, err := MarshalOutputIndent(result, "  ")
 	if err != nil {
 		return "", err
 	}
@@ -283,21 +289,13 @@ func ParseMultipleAlarmsToJSON(data []byte) (string, error) {
 
 // ValidateAlarmData validates basic alarm data structure
 func ValidateAlarmData(data []byte) error {
-	if len(data) < 32 {
-		return fmt.Errorf("data too short for alarm record")
-	}
-
-	header := &DatexHeader{}
-	if err := header.UnmarshalBinary(data[:32]); err != nil {
-		return fmt.Errorf("invalid header: %v", err)
+	header, _, err := ValidateRecord(data)
+	if err != nil {
+		return err
 	}
 
 	if header.RMainType != DRI_MT_ALARM {
-		return fmt.Errorf("expected alarm record type %d, got %d", DRI_MT_ALARM, header.RMainType)
-	}
-
-	if header.RLen <= 0 || int(header.RLen) > len(data) {
-		return fmt.Errorf("invalid record length: %d", header.RLen)
+		return fmt.Errorf("%w: expected alarm record type %d, got %d", ErrInvalidRecord, DRI_MT_ALARM, header.RMainType)
 	}
 
 	return nil
@@ -316,26 +314,12 @@ func GetAlarmSummary(alarm *AlarmJSON) map[string]interface{} {
 	}
 
 	// Extract alarm information if available
-	if alarmData, ok := alarm.AlarmData["data"].(map[string]interface{}); ok {
-		if soundOnOff, ok := alarmData["sound_on_off"].(map[string]interface{}); ok {
-			if soundStatus, ok := soundOnOff["status"].(bool); ok {
-				summary["sound_on"] = soundStatus
-			}
-		}
-
-		if silenceInfo, ok := alarmData["silence_info"].(map[string]interface{}); ok {
-			if isSilenced, ok := silenceInfo["is_silenced"].(bool); ok {
-				summary["is_silenced"] = isSilenced
-			}
-		}
-
-		if activeCount, ok := alarmData["active_alarm_count"].(int); ok {
-			summary["active_alarm_count"] = activeCount
-		}
-
-		if alarms, ok := alarmData["alarms"].([]map[string]interface{}); ok {
-			summary["alarm_count"] = len(alarms)
-		}
+	if alarm.AlarmData != nil && alarm.AlarmData.Data != nil {
+		alarmData := alarm.AlarmData.Data
+		summary["sound_on"] = alarmData.SoundOnOff.Status
+		summary["is_silenced"] = alarmData.SilenceInfo.IsSilenced
+		summary["active_alarm_count"] = alarmData.ActiveAlarmCount
+		summary["alarm_count"] = len(alarmData.Alarms)
 	}
 
 	return summary
@@ -387,7 +371,7 @@ func CreateSampleAlarmData() *AlarmJSON {
 				TypeName:  "Alarm Status",
 				IsValid:   true,
 				IsEndOfList: false,
-				Data:      alarmSubrecords.ToJSON(),
+				Data:      alarmSubrecords.ToStruct(),
 			},
 			{
 				Index:     1,
@@ -398,7 +382,7 @@ func CreateSampleAlarmData() *AlarmJSON {
 				IsEndOfList: true,
 			},
 		},
-		AlarmData:   alarmSubrecords.ToJSON(),
+		AlarmData:   alarmSubrecords.ToStruct(),
 		IsValid:     true,
 		ParseErrors: []string{},
 	}
@@ -2,7 +2,6 @@ package serial
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"time"
 )
@@ -13,6 +12,7 @@ type TrendJSON struct {
 	UnixTimestamp uint32                 `json:"unix_timestamp"`
 	RecordType    string                 `json:"record_type"`
 	RecordNumber  int                    `json:"record_number"`
+	RecordsMissed int                    `json:"records_missed,omitempty"` // Records missing before this one (see LossDetector)
 	DriLevel      int                    `json:"dri_level"`
 	DriLevelDesc  string                 `json:"dri_level_description"`
 	PlugID        int                    `json:"plug_id"`
@@ -45,65 +45,68 @@ type GroupJSON struct {
 	ParseErrors []string               `json:"parse_errors,omitempty"`
 }
 
-// TrendParser handles parsing of trend data from binary format to JSON
-type TrendParser struct {
+// TrendParser handles parsing of trend data from binary format to JSON. It
+// keeps no state between records (the problems of a record are returned in
+// its ParseErrors), so one parser can be shared by concurrent readers.
+type TrendParser struct{}
+
+// trendParse is the state of the parse of one trend record
+type trendParse struct {
 	errors []string
 }
 
 // NewTrendParser creates a new trend parser
 func NewTrendParser() *TrendParser {
-	return &TrendParser{
-		errors: make([]string, 0),
-	}
+	return &TrendParser{}
 }
 
 // ParseTrendData parses binary trend data and converts it to JSON
-func (p *TrendParser) ParseTrendData(data []byte) (*TrendJSON, error) {
-	p.errors = make([]string, 0)
+func (p *TrendParser) ParseTrendData(data []byte) (trend *TrendJSON, err error) {
+	defer func() {
+		recoverFrame(recover(), "trend", data, &err)
+		recordParseResult(DRI_MT_PHDB, err)
+	}()
 	
-	if len(data) < 32 {
-		return nil, fmt.Errorf("data too short for trend record: %d bytes", len(data))
-	}
+	run := &trendParse{errors: make([]string, 0)}
 	
-	// Parse the Datex-Ohmeda Record
-	record := &DatexRecord{}
-	if err := record.UnmarshalBinary(data); err != nil {
-		p.addError("Failed to parse Datex-Ohmeda record: " + err.Error())
+	// Parse the Datex-Ohmeda Record header and locate the subrecords
+	header, subrecords, err := ValidateRecord(data)
+	if err != nil {
 		return nil, err
 	}
 	
 	// Create JSON structure
 	trendJSON := &TrendJSON{
-		Timestamp:     time.Unix(int64(record.Header.RTime), 0).Format(time.RFC3339),
-		UnixTimestamp: record.Header.RTime,
+		Timestamp:     time.Unix(int64(header.RTime), 0).Format(time.RFC3339),
+		UnixTimestamp: header.RTime,
 		RecordType:     "Trend Data",
-		RecordNumber:   int(record.Header.RNbr),
-		DriLevel:       int(record.Header.DriLevel),
-		DriLevelDesc:   record.Header.GetDriLevelDescription(),
-		PlugID:         int(record.Header.PlugID),
-		MainType:       int(record.Header.RMainType),
-		MainTypeName:   record.Header.GetMainTypeName(),
+		RecordNumber:   int(header.RNbr),
+		DriLevel:       int(header.DriLevel),
+		DriLevelDesc:   header.GetDriLevelDescription(),
+		PlugID:         int(header.PlugID),
+		MainType:       int(header.RMainType),
+		MainTypeName:   header.GetMainTypeName(),
 		Subrecords:     make([]SubrecordJSON, 0),
 		Groups:         make(map[string]interface{}),
-		IsValid:        record.Header.IsValid(),
+		IsValid:        true,
 	}
 	
 	// Parse subrecords
-	p.parseSubrecords(record, trendJSON)
+	run.parseSubrecords(data, header, subrecords, trendJSON)
 	
 	// Parse physiological data if this is a PHDB record
-	if record.Header.RMainType == DRI_MT_PHDB {
-		p.parsePhysiologicalData(record, trendJSON)
+	if header.RMainType == DRI_MT_PHDB {
+		run.parsePhysiologicalData(trendJSON)
 	}
 	
-	trendJSON.ParseErrors = p.errors
+	trendJSON.ParseErrors = run.errors
 	return trendJSON, nil
 }
 
 // parseSubrecords parses subrecord descriptors
-func (p *TrendParser) parseSubrecords(record *DatexRecord, trendJSON *TrendJSON) {
+func (p *trendParse) parseSubrecords(data []byte, header *DatexHeader, subrecords []Subrecord, trendJSON *TrendJSON) {
 	for i := 0; i < 8; i++ {
-		srDesc := record.Header.SrDesc[i]
+		srDesc := header.SrDesc[i]
 		subrecord := SubrecordJSON{
 			Index:       i,
 			Offset:      srDesc.SrOffset,
@@ -113,14 +116,18 @@ func (p *TrendParser) parseSubrecords(record *DatexRecord, trendJSON *TrendJSON)
 			IsEndOfList: srDesc.IsEndOfList(),
 		}
 		
-		if srDesc.IsValid() {
-			// Try to parse the actual subrecord data
-			if int(srDesc.SrOffset) < len(record.Data) {
-				subrecordData := record.Data[srDesc.SrOffset:]
-				parsedData := p.parseSubrecordData(srDesc.SrType, subrecordData)
-				if parsedData != nil {
-					subrecord.Data = parsedData
+		// Try to parse the actual subrecord data (subrecords lists the
+		// descriptors before the end of list in order)
+		if i < len(subrecords) {
+			if handler, exists := lookupSubrecordHandler(header.RMainType, subrecords[i].Type); exists {
+				subrecord.TypeName = handler.Name
+				output, err := decodeSubrecord(handler, data, header, subrecords[i])
+				if err != nil {
+					p.addError(err.Error())
 				}
+				subrecord.Data = output
+			} else if parsedData := p.parseSubrecordData(subrecords[i].Type, subrecords[i].Data); parsedData != nil {
+				subrecord.Data = parsedData
 			}
 		}
 		
@@ -128,61 +135,59 @@ func (p *TrendParser) parseSubrecords(record *DatexRecord, trendJSON *TrendJSON)
 	}
 }
 
-// parsePhysiologicalData parses physiological database records
-func (p *TrendParser) parsePhysiologicalData(record *DatexRecord, trendJSON *TrendJSON) {
-	// Parse physiological subrecords
-	phSubrecords := &PhysiologicalSubrecords{}
-	if err := phSubrecords.UnmarshalBinary(record.Data); err != nil {
-		p.addError("Failed to parse physiological subrecords: " + err.Error())
-		return
+// parsePhysiologicalData adds the physiological database records parsed from
+// the subrecords to the groups, as physiological_data and as ph_record_<n>
+// keyed by record index
+func (p *trendParse) parsePhysiologicalData(trendJSON *TrendJSON) {
+	phSubrecords := &PhysiologicalSubrecordsJSON{Records: []*PhysiologicalDatabaseRecordJSON{}}
+	for _, subrecord := range trendJSON.Subrecords {
+		if phRecord, ok := subrecord.Data.(*PhysiologicalDatabaseRecordJSON); ok {
+			groupKey := fmt.Sprintf("ph_record_%d", len(phSubrecords.Records))
+			trendJSON.Groups[groupKey] = phRecord
+			phSubrecords.Records = append(phSubrecords.Records, phRecord)
+		}
 	}
 	
 	// Add physiological data to groups
-	trendJSON.Groups["physiological_data"] = phSubrecords.ToJSON()
-	
-	// Parse individual physiological database records
-	for i, phRecord := range phSubrecords.Records {
-		if phRecord != nil {
-			groupKey := fmt.Sprintf("ph_record_%d", i)
-			trendJSON.Groups[groupKey] = phRecord.ToJSON()
-		}
-	}
+	trendJSON.Groups["physiological_data"] = phSubrecords
 }
 
 // parseSubrecordData parses individual subrecord data based on type
-func (p *TrendParser) parseSubrecordData(subrecordType byte, data []byte) interface{} {
+func (p *trendParse) parseSubrecordData(subrecordType byte, data []byte) interface{} {
 	switch subrecordType {
 	case DRI_PH_DISPL, DRI_PH_10S_TREND, DRI_PH_60S_TREND:
-		return p.parsePhysiologicalDatabaseRecord(data)
+		if record := p.parsePhysiologicalDatabaseRecord(subrecordType, data); record != nil {
+			return record
+		}
 	case DRI_PH_AUX_INFO:
-		return p.parseAuxiliaryPhysiologicalInfo(data)
+		if auxInfo := p.parseAuxiliaryPhysiologicalInfo(data); auxInfo != nil {
+			return auxInfo
+		}
 	default:
 		// For unknown types, return raw data
-		return map[string]interface{}{
-			"raw_data": data,
-			"size":     len(data),
-		}
+		return &RawSubrecordJSON{RawData: data, Size: len(data)}
 	}
+	return nil
 }
 
 // parsePhysiologicalDatabaseRecord parses a physiological database record
-func (p *TrendParser) parsePhysiologicalDatabaseRecord(data []byte) interface{} {
+func (p *trendParse) parsePhysiologicalDatabaseRecord(subrecordType byte, data []byte) *PhysiologicalDatabaseRecordJSON {
 	if len(data) < 8 {
 		p.addError("Physiological database record too short")
 		return nil
 	}
 	
-	phRecord := &PhysiologicalDatabaseRecord{}
+	phRecord := &PhysiologicalDatabaseRecord{SubrecordType: subrecordType}
 	if err := phRecord.UnmarshalBinary(data); err != nil {
 		p.addError("Failed to parse physiological database record: " + err.Error())
 		return nil
 	}
 	
-	return phRecord.ToJSON()
+	return phRecord.ToStruct()
 }
 
 // parseAuxiliaryPhysiologicalInfo parses auxiliary physiological information
-func (p *TrendParser) parseAuxiliaryPhysiologicalInfo(data []byte) interface{} {
+func (p *trendParse) parseAuxiliaryPhysiologicalInfo(data []byte) *AuxiliaryPhysiologicalInfoJSON {
 	if len(data) < 114 {
 		p.addError("Auxiliary physiological info too short")
 		return nil
@@ -194,11 +199,11 @@ func (p *TrendParser) parseAuxiliaryPhysiologicalInfo(data []byte) interface{} {
 		return nil
 	}
 	
-	return auxInfo.ToJSON()
+	return auxInfo.ToStruct()
 }
 
 // getSubrecordTypeName returns the human-readable name for subrecord type
-func (p *TrendParser) getSubrecordTypeName(subrecordType byte) string {
+func (p *trendParse) getSubrecordTypeName(subrecordType byte) string {
 	switch subrecordType {
 	case DRI_PH_DISPL:
 		return "Displayed Values"
@@ -216,7 +221,7 @@ func (p *TrendParser) getSubrecordTypeName(subrecordType byte) string {
 }
 
 // addError adds an error to the parser's error list
-func (p *TrendParser) addError(err string) {
+func (p *trendParse) addError(err string) {
 	p.errors = append(p.errors, err)
 }
 
@@ -231,17 +236,15 @@ func (p *TrendParser) ParseMultipleTrends(data []byte) ([]*TrendJSON, error) {
 		}
 		
 		// Read record length
-		recordLen := int(binary.LittleEndian.Uint16(data[offset:offset+2]))
+		recordLen := int(int16(binary.LittleEndian.Uint16(data[offset:offset+2])))
 		if recordLen <= 0 || offset+recordLen > len(data) {
 			break
 		}
 		
 		// Parse single trend record
 		trendData := data[offset:offset+recordLen]
-		trend, err := p.ParseTrendData(trendData)
-		if err != nil {
-			p.addError(fmt.Sprintf("Failed to parse trend at offset %d: %v", offset, err))
-		} else {
+		// Records that fail to parse are skipped (and counted in the parse metrics)
+		if trend, err := p.ParseTrendData(trendData); err == nil {
 			trends = append(trends, trend)
 		}
 		
@@ -253,7 +256,7 @@ func (p *TrendParser) ParseMultipleTrends(data []byte) ([]*TrendJSON, error) {
 
 // ToJSON converts trend data to JSON string
 func (p *TrendParser) ToJSON(trend *TrendJSON) (string, error) {
-	jsonBytes, err := json.MarshalIndent(trend, "", "  ")
+	jsonBytes, err := MarshalOutputIndent(trend, "  ")
 	if err != nil {
 		return "", err
 	}
@@ -262,8 +265,8 @@ func (p *TrendParser) ToJSON(trend *TrendJSON) (string, error) {
 
 // Convenience functions for easy usage
 
-// ParseAndConvertToJSON parses binary trend data and returns JSON string
-func ParseAndConvertToJSON(data []byte) (string, error) {
+// ParseTrendJSON parses binary trend data and returns JSON string
+func ParseTrendJSON(data []byte) (string, error) {
 	parser := NewTrendParser()
 	trend, err := parser.ParseTrendData(data)
 	if err != nil {
@@ -272,8 +275,8 @@ func ParseAndConvertToJSON(data []byte) (string, error) {
 	return parser.ToJSON(trend)
 }
 
-// ParseAndConvertToStruct parses binary trend data and returns TrendJSON struct
-func ParseAndConvertToStruct(data []byte) (*TrendJSON, error) {
+// ParseTrendStruct parses binary trend data and returns TrendJSON struct
+func ParseTrendStruct(data []byte) (*TrendJSON, error) {
 	parser := NewTrendParser()
 	return parser.ParseTrendData(data)
 }
@@ -286,7 +289,7 @@ func ParseMultipleTrendsToJSON(data []byte) (string, error) {
 		return "", err
 	}
 	
-	jsonBytes, err := json.MarshalIndent(trends, "", "  ")
+	jsonBytes, err := MarshalOutputIndent(trends, "  ")
 	if err != nil {
 		return "", err
 	}
@@ -295,26 +298,19 @@ func ParseMultipleTrendsToJSON(data []byte) (string, error) {
 
 // ValidateTrendData validates trend data structure
 func ValidateTrendData(data []byte) error {
-	if len(data) < 32 {
-		return fmt.Errorf("data too short for trend record: %d bytes", len(data))
-	}
-	
-	// Check record length
-	recordLen := int(binary.LittleEndian.Uint16(data[0:2]))
-	if recordLen <= 0 || recordLen > len(data) {
-		return fmt.Errorf("invalid record length: %d", recordLen)
+	header, _, err := ValidateRecord(data)
+	if err != nil {
+		return err
 	}
 	
 	// Check DRI level
-	driLevel := data[3]
-	if driLevel < DRI_LEVEL_95 || driLevel > DRI_LEVEL_06 {
-		return fmt.Errorf("invalid DRI level: %d", driLevel)
+	if header.DriLevel < DRI_LEVEL_95 || header.DriLevel > DRI_LEVEL_06 {
+		return fmt.Errorf("invalid DRI level: %d", header.DriLevel)
 	}
 	
 	// Check main type
-	mainType := int16(binary.LittleEndian.Uint16(data[28:30]))
-	if mainType < 0 {
-		return fmt.Errorf("invalid main type: %d", mainType)
+	if header.RMainType < 0 {
+		return fmt.Errorf("invalid main type: %d", header.RMainType)
 	}
 	
 	return nil
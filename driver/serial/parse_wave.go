@@ -2,10 +2,11 @@ package serial
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
-	"math"
+	"sync"
 	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
 )
 
 // WaveformJSON represents the JSON structure for waveform data
@@ -18,6 +19,10 @@ type WaveformJSON struct {
 	SamplingRate  int             `json:"sampling_rate"`
 	Duration      float64         `json:"duration_seconds"`
 	TotalSamples  int             `json:"total_samples"`
+	RTime         uint32          `json:"r_time,omitempty"` // Record transmission time (monitor clock)
+	RecordsMissed int             `json:"records_missed,omitempty"` // Records missing before this one (see LossDetector)
+	TimeSource    string          `json:"time_source"`      // "r_time" or "host"
+	Calibration   *CalibrationJSON `json:"calibration,omitempty"` // Site calibration applied to the physical values
 }
 
 // WaveformHeaderJSON represents the header in JSON format
@@ -38,52 +43,151 @@ type SampleJSON struct {
 	PhysicalValue   float64 `json:"physical_value"`
 	Unit            string  `json:"unit"`
 	IsControlCode   bool    `json:"is_control_code"`
+	Condition       SampleCondition `json:"condition,omitempty"` // Meaning of a control code (omitted for measurements)
 	Timestamp       time.Time `json:"timestamp"`
+	Corrected       bool    `json:"corrected,omitempty"` // PhysicalValue includes a site calibration
 }
 
 // WaveformParser handles parsing of waveform binary data
 type WaveformParser struct {
 	subrecordType int
 	samplingRate  int
-	startTime     time.Time
+	clock         clock.Clock
+	timeSync      *TimeSync
+	calibration   *CalibrationTable
 }
 
+// Waveform time sources
+const (
+	TIME_SOURCE_RECORD = "r_time" // Sample times derived from the record r_time
+	TIME_SOURCE_HOST   = "host"   // Sample times derived from the host clock at parse time
+)
+
 // NewWaveformParser creates a new waveform parser
 func NewWaveformParser(subrecordType int) *WaveformParser {
 	return &WaveformParser{
 		subrecordType: subrecordType,
 		samplingRate:  GetSamplingRate(subrecordType),
-		startTime:     time.Now(),
+		clock:         clock.Real,
+	}
+}
+
+// SetClock sets the clock used to timestamp parsed waveforms (tests use a simulated clock)
+func (wp *WaveformParser) SetClock(c clock.Clock) {
+	wp.clock = clock.OrReal(c)
+}
+
+// SetTimeSync sets the monitor clock offset applied to record times (nil: no offset)
+func (wp *WaveformParser) SetTimeSync(timeSync *TimeSync) {
+	wp.timeSync = timeSync
+}
+
+// SetCalibration sets the site calibrations applied to physical values (nil: none)
+func (wp *WaveformParser) SetCalibration(calibration *CalibrationTable) {
+	wp.calibration = calibration
+}
+
+// ParseWaveformRecord parses a waveform subrecord of the record described by
+// header. Sample i is stamped r_time + TimeSync offset + i / sampling rate, so
+// the timestamps follow the monitor's acquisition time, not host arrival time.
+func (wp *WaveformParser) ParseWaveformRecord(header *DatexHeader, data []byte) (*WaveformJSON, error) {
+	waveform, err := wp.parse(data, wp.timeSync.RecordTime(header.RTime))
+	if err != nil {
+		return nil, err
 	}
+	waveform.RTime = header.RTime
+	waveform.TimeSource = TIME_SOURCE_RECORD
+	wp.calibrate(waveform, int(header.PlugID))
+	return waveform, nil
 }
 
-// ParseWaveformData parses binary waveform data and returns JSON
+// ParseWaveformData parses binary waveform data and returns JSON. Without the
+// record header the samples are stamped from the host clock at parse time;
+// use ParseWaveformRecord when the header is available.
 func (wp *WaveformParser) ParseWaveformData(data []byte) (*WaveformJSON, error) {
+	waveform, err := wp.parse(data, wp.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	waveform.TimeSource = TIME_SOURCE_HOST
+	wp.calibrate(waveform, CALIBRATION_ALL_MONITORS)
+	return waveform, nil
+}
+
+// calibrate applies the site calibration of the parser's signal on monitor
+// plugID and annotates the waveform and its corrected samples
+func (wp *WaveformParser) calibrate(waveform *WaveformJSON, plugID int) {
+	calibration, exists := wp.calibration.Lookup(plugID, GetWaveformChannelKey(wp.subrecordType))
+	if !exists {
+		return
+	}
+
+	for i := range waveform.Samples {
+		sample := &waveform.Samples[i]
+		if sample.IsControlCode {
+			continue
+		}
+		sample.PhysicalValue = calibration.Apply(sample.PhysicalValue)
+		sample.Corrected = true
+	}
+	waveform.Calibration = calibration.ToJSON()
+}
+
+// sampleBufferPool holds the buffers of the raw samples decoded by parse
+var sampleBufferPool = sync.Pool{
+	New: func() interface{} { return new([]int16) },
+}
+
+// decodeWaveformHeader decodes the header of a waveform subrecord and checks
+// that the subrecord holds all of its samples
+func decodeWaveformHeader(data []byte) (*WaveformHeader, error) {
 	if len(data) < 6 {
-		return nil, fmt.Errorf("data too short: %d bytes", len(data))
+		return nil, fmt.Errorf("%w: waveform subrecord of %d bytes, shorter than its 6 byte header", ErrInvalidRecord, len(data))
 	}
 
 	// Parse header
 	header := &WaveformHeader{}
 	if err := header.UnmarshalBinary(data[:6]); err != nil {
-		return nil, fmt.Errorf("failed to parse header: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse waveform header: %v", ErrInvalidRecord, err)
 	}
 
 	// Validate data length
+	if header.ActLen < 0 {
+		return nil, fmt.Errorf("%w: negative sample count: %d", ErrInvalidRecord, header.ActLen)
+	}
 	expectedLength := 6 + int(header.ActLen)*2
 	if len(data) < expectedLength {
-		return nil, fmt.Errorf("data length mismatch: expected %d, got %d", expectedLength, len(data))
+		return nil, fmt.Errorf("%w: data length mismatch: expected %d, got %d", ErrInvalidRecord, expectedLength, len(data))
 	}
+	return header, nil
+}
 
-	// Parse samples
-	samples := make([]int16, header.ActLen)
+// parse parses a waveform subrecord whose first sample was acquired at startTime
+func (wp *WaveformParser) parse(data []byte, startTime time.Time) (waveform *WaveformJSON, err error) {
+	defer func() {
+		recoverFrame(recover(), "wave", data, &err)
+		recordParseResult(DRI_MT_WAVE, err)
+	}()
+	
+	header, err := decodeWaveformHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse samples into a pooled buffer; convertToJSON copies them
+	buffer := sampleBufferPool.Get().(*[]int16)
+	defer sampleBufferPool.Put(buffer)
+	samples := (*buffer)[:0]
 	for i := 0; i < int(header.ActLen); i++ {
 		offset := 6 + i*2
-		samples[i] = int16(binary.LittleEndian.Uint16(data[offset : offset+2]))
+		samples = append(samples, int16(binary.LittleEndian.Uint16(data[offset:offset+2])))
 	}
+	*buffer = samples
 
+	metricWaveformSamples.Add(float64(len(samples)), GetWaveformChannelKey(wp.subrecordType))
+	
 	// Convert to JSON format
-	return wp.convertToJSON(header, samples)
+	return wp.convertToJSON(header, samples, startTime)
 }
 
 // ParseMultipleWaveforms parses multiple waveform records from binary data
@@ -104,6 +208,9 @@ func ParseMultipleWaveforms(data []byte, subrecordType int) ([]*WaveformJSON, er
 		}
 
 		// Calculate total length for this waveform
+		if header.ActLen < 0 {
+			return nil, fmt.Errorf("negative sample count %d at offset %d", header.ActLen, offset)
+		}
 		waveformLength := 6 + int(header.ActLen)*2
 		if offset+waveformLength > len(data) {
 			return nil, fmt.Errorf("incomplete waveform data at offset %d", offset)
@@ -123,10 +230,36 @@ func ParseMultipleWaveforms(data []byte, subrecordType int) ([]*WaveformJSON, er
 	return results, nil
 }
 
+// ParseWaveformRecords parses every waveform subrecord of a complete
+// waveform record (header followed by the data area). Each subrecord
+// is located by ValidateRecord and stamped from the record r_time corrected
+// by timeSync (nil: monitor clock as is), so channels of the same record
+// share one time base. Site calibrations are applied if calibration is set.
+func ParseWaveformRecords(data []byte, timeSync *TimeSync, calibration *CalibrationTable) (*DatexHeader, []*WaveformJSON, error) {
+	header, subrecords, err := ValidateRecord(data)
+	if err != nil {
+		return header, nil, err
+	}
+	if header.RMainType != DRI_MT_WAVE {
+		return header, nil, fmt.Errorf("%w: expected waveform record type %d, got %d", ErrInvalidRecord, DRI_MT_WAVE, header.RMainType)
+	}
+
+	var waveforms []*WaveformJSON
+	for _, subrecord := range subrecords {
+		parser := NewWaveformParser(int(subrecord.Type))
+		parser.SetTimeSync(timeSync)
+		parser.SetCalibration(calibration)
+		waveform, err := parser.ParseWaveformRecord(header, subrecord.Data)
+		if err != nil {
+			return header, waveforms, fmt.Errorf("failed to parse subrecord %d: %w", subrecord.Index, err)
+		}
+		waveforms = append(waveforms, waveform)
+	}
+	return header, waveforms, nil
+}
+
 // convertToJSON converts parsed data to JSON format
-func (wp *WaveformParser) convertToJSON(header *WaveformHeader, samples []int16) (*WaveformJSON, error) {
-	now := time.Now()
-	
+func (wp *WaveformParser) convertToJSON(header *WaveformHeader, samples []int16, startTime time.Time) (*WaveformJSON, error) {
 	// Create header JSON
 	headerJSON := WaveformHeaderJSON{
 		ActLen:           int(header.ActLen),
@@ -140,11 +273,10 @@ func (wp *WaveformParser) convertToJSON(header *WaveformHeader, samples []int16)
 
 	// Create samples JSON
 	samplesJSON := make([]SampleJSON, len(samples))
-	sampleInterval := time.Duration(float64(time.Second) / float64(wp.samplingRate))
+	unit := wp.getUnit(wp.subrecordType)
 	
 	for i, sample := range samples {
 		physicalValue := ConvertSampleToPhysicalValue(sample, wp.subrecordType)
-		unit := wp.getUnit(wp.subrecordType)
 		
 		samplesJSON[i] = SampleJSON{
 			Index:         i,
@@ -152,7 +284,8 @@ func (wp *WaveformParser) convertToJSON(header *WaveformHeader, samples []int16)
 			PhysicalValue: physicalValue,
 			Unit:          unit,
 			IsControlCode: IsControlCode(sample),
-			Timestamp:     now.Add(time.Duration(i) * sampleInterval),
+			Condition:     ClassifyWaveformSample(sample, header),
+			Timestamp:     SampleTime(startTime, i, wp.samplingRate),
 		}
 	}
 
@@ -160,7 +293,7 @@ func (wp *WaveformParser) convertToJSON(header *WaveformHeader, samples []int16)
 	duration := float64(len(samples)) / float64(wp.samplingRate)
 
 	return &WaveformJSON{
-		Timestamp:     now,
+		Timestamp:     startTime,
 		SubrecordType: wp.subrecordType,
 		TypeName:      wp.getTypeName(wp.subrecordType),
 		Header:        headerJSON,
@@ -197,6 +330,14 @@ func (wp *WaveformParser) getTypeName(subrecordType int) string {
 		return "Airway Flow"
 	case DRI_WF_RESP:
 		return "ECG Respiratory"
+	case DRI_WF_INVP1:
+		return "Invasive Pressure 1"
+	case DRI_WF_INVP2:
+		return "Invasive Pressure 2"
+	case DRI_WF_INVP3:
+		return "Invasive Pressure 3"
+	case DRI_WF_INVP4:
+		return "Invasive Pressure 4"
 	case DRI_WF_INVP5:
 		return "Invasive Pressure 5"
 	case DRI_WF_INVP6:
@@ -239,7 +380,7 @@ func (wp *WaveformParser) getUnit(subrecordType int) string {
 	switch subrecordType {
 	case DRI_WF_ECG12:
 		return "μV"
-	case DRI_WF_INVP5, DRI_WF_INVP6, DRI_WF_INVP7, DRI_WF_INVP8:
+	case DRI_WF_INVP1, DRI_WF_INVP2, DRI_WF_INVP3, DRI_WF_INVP4, DRI_WF_INVP5, DRI_WF_INVP6, DRI_WF_INVP7, DRI_WF_INVP8:
 		return "mmHg"
 	case DRI_WF_PLETH, DRI_WF_PLETH_2:
 		return "%"
@@ -261,12 +402,13 @@ func (wp *WaveformParser) getUnit(subrecordType int) string {
 // ToJSON converts WaveformData to JSON string
 func (wd *WaveformData) ToJSON(subrecordType int) (string, error) {
 	parser := NewWaveformParser(subrecordType)
-	jsonData, err := parser.convertToJSON(&wd.Header, wd.Samples)
+	jsonData, err := parser.convertToJSON(&wd.Header, wd.Samples, parser.clock.Now())
 	if err != nil {
 		return "", err
 	}
+	jsonData.TimeSource = TIME_SOURCE_HOST
 	
-	jsonBytes, err := json.MarshalIndent(jsonData, "", "  ")
+	jsonBytes, err := MarshalOutputIndent(jsonData, "  ")
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal JSON: %w", err)
 	}
@@ -274,15 +416,15 @@ func (wd *WaveformData) ToJSON(subrecordType int) (string, error) {
 	return string(jsonBytes), nil
 }
 
-// ParseAndConvertToJSON is a convenience function that parses binary data and returns JSON string
-func ParseAndConvertToJSON(data []byte, subrecordType int) (string, error) {
+// ParseWaveJSON is a convenience function that parses binary data and returns JSON string
+func ParseWaveJSON(data []byte, subrecordType int) (string, error) {
 	parser := NewWaveformParser(subrecordType)
 	waveform, err := parser.ParseWaveformData(data)
 	if err != nil {
 		return "", err
 	}
 	
-	jsonBytes, err := json.MarshalIndent(waveform, "", "  ")
+	jsonBytes, err := MarshalOutputIndent(waveform, "  ")
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal JSON: %w", err)
 	}
@@ -290,8 +432,8 @@ func ParseAndConvertToJSON(data []byte, subrecordType int) (string, error) {
 	return string(jsonBytes), nil
 }
 
-// ParseAndConvertToStruct parses binary data and returns WaveformJSON struct
-func ParseAndConvertToStruct(data []byte, subrecordType int) (*WaveformJSON, error) {
+// ParseWaveStruct parses binary data and returns WaveformJSON struct
+func ParseWaveStruct(data []byte, subrecordType int) (*WaveformJSON, error) {
 	parser := NewWaveformParser(subrecordType)
 	return parser.ParseWaveformData(data)
 }
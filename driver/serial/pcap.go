@@ -0,0 +1,293 @@
+package serial
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Magic numbers of capture files, as read in big-endian order
+const (
+	PCAP_MAGIC_MICROSECONDS = 0xA1B2C3D4
+	PCAP_MAGIC_NANOSECONDS  = 0xA1B23C4D
+	PCAPNG_MAGIC            = 0x0A0D0D0A // Section header block of pcapng
+)
+
+// Link types of the pcap files that can be read
+const (
+	PCAP_LINK_NULL     = 0   // BSD loopback
+	PCAP_LINK_ETHERNET = 1   // Ethernet, with or without VLAN tags
+	PCAP_LINK_RAW      = 101 // Raw IPv4 or IPv6
+	PCAP_LINK_SLL      = 113 // Linux cooked capture ("any" interface)
+)
+
+// PCAP_MAX_PACKET is the largest packet record accepted
+const PCAP_MAX_PACKET = 256 * 1024
+
+// TCPStream is the data sent in one direction of a TCP connection,
+// reassembled in sequence order
+type TCPStream struct {
+	Source       string    `json:"source"`        // host:port of the sender
+	Destination  string    `json:"destination"`   // host:port of the receiver
+	First        time.Time `json:"first"`         // Capture time of the first segment with data
+	Last         time.Time `json:"last"`          // Capture time of the last segment with data
+	Segments     int       `json:"segments"`      // Segments with data, retransmissions included
+	MissingBytes int64     `json:"missing_bytes"` // Bytes not captured (gaps in the sequence numbers)
+	Data         []byte    `json:"-"`
+}
+
+// Name identifies the stream, e.g. "10.0.0.5:4001>10.0.0.9:53211"
+func (s *TCPStream) Name() string {
+	return s.Source + ">" + s.Destination
+}
+
+// tcpSegment is the payload of a captured TCP segment
+type tcpSegment struct {
+	seq     uint32
+	payload []byte
+}
+
+// tcpFlow collects the segments of one direction of a connection
+type tcpFlow struct {
+	stream   *TCPStream
+	isn      uint32 // Sequence number of the first data byte
+	started  bool
+	synSeen  bool
+	segments []tcpSegment
+}
+
+// IsPcap reports whether data starts like a pcap or pcapng file
+func IsPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(data) {
+	case PCAP_MAGIC_MICROSECONDS, PCAP_MAGIC_NANOSECONDS, PCAPNG_MAGIC:
+		return true
+	}
+	switch binary.LittleEndian.Uint32(data) {
+	case PCAP_MAGIC_MICROSECONDS, PCAP_MAGIC_NANOSECONDS:
+		return true
+	}
+	return false
+}
+
+// ReadTCPStreams reads a pcap file and returns the TCP streams it carries,
+// ordered by their first segment. If port is not 0, only the connections
+// from or to that port are kept. Packets that are not TCP over IPv4 or IPv6
+// are skipped; IP fragments and IPv6 extension headers are not supported.
+// pcapng files must be converted first (editcap -F pcap).
+func ReadTCPStreams(r io.Reader, port int) ([]*TCPStream, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read pcap header: %v", err)
+	}
+
+	var order binary.ByteOrder
+	nanoseconds := false
+	switch magic := binary.BigEndian.Uint32(header); {
+	case magic == PCAPNG_MAGIC:
+		return nil, fmt.Errorf("pcapng is not supported, convert the file to pcap (editcap -F pcap)")
+	case magic == PCAP_MAGIC_MICROSECONDS || magic == PCAP_MAGIC_NANOSECONDS:
+		order, nanoseconds = binary.BigEndian, magic == PCAP_MAGIC_NANOSECONDS
+	default:
+		magic = binary.LittleEndian.Uint32(header)
+		if magic != PCAP_MAGIC_MICROSECONDS && magic != PCAP_MAGIC_NANOSECONDS {
+			return nil, fmt.Errorf("not a pcap file")
+		}
+		order, nanoseconds = binary.LittleEndian, magic == PCAP_MAGIC_NANOSECONDS
+	}
+	linkType := order.Uint32(header[20:24]) & 0x0FFFFFFF
+	switch linkType {
+	case PCAP_LINK_NULL, PCAP_LINK_ETHERNET, PCAP_LINK_RAW, PCAP_LINK_SLL:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", linkType)
+	}
+
+	flows := make(map[string]*tcpFlow)
+	var ordered []*tcpFlow
+	record := make([]byte, 16)
+	for n := 1; ; n++ {
+		if _, err := io.ReadFull(reader, record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("packet %d: truncated record header", n)
+		}
+		seconds, fraction := order.Uint32(record[0:4]), order.Uint32(record[4:8])
+		length := order.Uint32(record[8:12])
+		if length > PCAP_MAX_PACKET {
+			return nil, fmt.Errorf("packet %d: length %d exceeds %d bytes", n, length, PCAP_MAX_PACKET)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return nil, fmt.Errorf("packet %d: truncated data", n)
+		}
+		if !nanoseconds {
+			fraction *= 1000
+		}
+		captured := time.Unix(int64(seconds), int64(fraction))
+
+		segment, ok := parseTCPPacket(linkType, packet)
+		if !ok || len(segment.payload) == 0 && !segment.syn {
+			continue
+		}
+		if port != 0 && segment.sourcePort != port && segment.destinationPort != port {
+			continue
+		}
+		key := segment.source() + ">" + segment.destination()
+		flow, exists := flows[key]
+		if !exists {
+			flow = &tcpFlow{stream: &TCPStream{Source: segment.source(), Destination: segment.destination()}}
+			flows[key] = flow
+			ordered = append(ordered, flow)
+		}
+		flow.add(segment, captured)
+	}
+
+	streams := make([]*TCPStream, 0, len(ordered))
+	for _, flow := range ordered {
+		if flow.stream.Segments == 0 {
+			continue
+		}
+		flow.assemble()
+		streams = append(streams, flow.stream)
+	}
+	return streams, nil
+}
+
+// capturedSegment is a TCP segment decoded from a packet
+type capturedSegment struct {
+	sourceIP, destinationIP     net.IP
+	sourcePort, destinationPort int
+	seq                         uint32
+	syn                         bool
+	payload                     []byte
+}
+
+func (s capturedSegment) source() string {
+	return net.JoinHostPort(s.sourceIP.String(), strconv.Itoa(s.sourcePort))
+}
+
+func (s capturedSegment) destination() string {
+	return net.JoinHostPort(s.destinationIP.String(), strconv.Itoa(s.destinationPort))
+}
+
+// parseTCPPacket decodes the link, IP and TCP headers of a packet
+func parseTCPPacket(linkType uint32, packet []byte) (capturedSegment, bool) {
+	var segment capturedSegment
+	switch linkType {
+	case PCAP_LINK_NULL:
+		if len(packet) < 4 {
+			return segment, false
+		}
+		packet = packet[4:]
+	case PCAP_LINK_ETHERNET:
+		if len(packet) < 14 {
+			return segment, false
+		}
+		etherType, offset := binary.BigEndian.Uint16(packet[12:14]), 14
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(packet) >= offset+4 {
+			etherType, offset = binary.BigEndian.Uint16(packet[offset+2:offset+4]), offset+4
+		}
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return segment, false
+		}
+		packet = packet[offset:]
+	case PCAP_LINK_SLL:
+		if len(packet) < 16 {
+			return segment, false
+		}
+		packet = packet[16:]
+	}
+
+	var tcp []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		headerLength := int(packet[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		fragmented := binary.BigEndian.Uint16(packet[6:8])&0x3FFF != 0
+		if packet[9] != 6 || fragmented || headerLength < 20 || total < headerLength || total > len(packet) {
+			return segment, false
+		}
+		segment.sourceIP, segment.destinationIP = net.IP(packet[12:16]), net.IP(packet[16:20])
+		tcp = packet[headerLength:total]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if packet[6] != 6 || total > len(packet) {
+			return segment, false
+		}
+		segment.sourceIP, segment.destinationIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+		tcp = packet[40:total]
+	default:
+		return segment, false
+	}
+
+	if len(tcp) < 20 {
+		return segment, false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return segment, false
+	}
+	segment.sourcePort = int(binary.BigEndian.Uint16(tcp[0:2]))
+	segment.destinationPort = int(binary.BigEndian.Uint16(tcp[2:4]))
+	segment.seq = binary.BigEndian.Uint32(tcp[4:8])
+	segment.syn = tcp[13]&0x02 != 0
+	segment.payload = tcp[dataOffset:]
+	return segment, true
+}
+
+// add records a segment. The first data byte of the flow is the one after
+// the SYN, or the earliest byte captured if the capture started after the
+// handshake.
+func (f *tcpFlow) add(segment capturedSegment, captured time.Time) {
+	if segment.syn {
+		f.isn, f.started, f.synSeen = segment.seq+1, true, true
+		if len(segment.payload) == 0 {
+			return
+		}
+		segment.seq++
+	}
+	if !f.started || !f.synSeen && int32(segment.seq-f.isn) < 0 {
+		f.isn, f.started = segment.seq, true
+	}
+	if f.stream.Segments == 0 {
+		f.stream.First = captured
+	}
+	f.stream.Last = captured
+	f.stream.Segments++
+	f.segments = append(f.segments, tcpSegment{seq: segment.seq, payload: segment.payload})
+}
+
+// assemble orders the segments by sequence number, relative to the first
+// byte so that the numbers may wrap, and joins them. Retransmitted bytes
+// are kept once; gaps are counted in MissingBytes.
+func (f *tcpFlow) assemble() {
+	sort.SliceStable(f.segments, func(i, j int) bool {
+		return f.segments[i].seq-f.isn < f.segments[j].seq-f.isn
+	})
+	var data []byte
+	var next int64
+	for _, segment := range f.segments {
+		start := int64(segment.seq - f.isn)
+		end := start + int64(len(segment.payload))
+		if end <= next {
+			continue
+		}
+		if start > next {
+			f.stream.MissingBytes += start - next
+			next = start
+		}
+		data = append(data, segment.payload[next-start:]...)
+		next = end
+	}
+	f.stream.Data = data
+	f.segments = nil
+}
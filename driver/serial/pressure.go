@@ -0,0 +1,248 @@
+package serial
+
+import (
+	"math"
+	"time"
+)
+
+// Pressure event detection defaults (physical values in mmHg)
+const (
+	PRESSURE_FLAT_RANGE   = 2.0                    // Peak-to-peak variation of a plateau
+	ZERO_BAND             = 3.0                    // A zeroing plateau lies within ±ZERO_BAND of 0
+	ZERO_MIN_DURATION     = time.Second            // Shortest zeroing plateau
+	FLUSH_MIN_LEVEL       = 200.0                  // A flush plateau lies at or above the flush bag pressure
+	FLUSH_MIN_DURATION    = 200 * time.Millisecond // Shortest flush plateau
+	FLUSH_RELEASE_WINDOW  = 500 * time.Millisecond // Samples after the flush analysed for oscillations
+	DAMPING_MIN_AMPLITUDE = 2.0                    // Smallest oscillation counted, peak to trough
+)
+
+// Pressure event types
+const (
+	PRESSURE_EVENT_ZERO  = "zero"  // Transducer opened to air for zeroing
+	PRESSURE_EVENT_FLUSH = "flush" // Fast-flush square wave test
+)
+
+// PressureEventJSON annotates a zeroing or fast-flush event of an invasive pressure channel
+type PressureEventJSON struct {
+	Type            string       `json:"type"`
+	Channel         string       `json:"channel"` // Channel key, e.g. "INVP1"
+	Start           time.Time    `json:"start"`
+	End             time.Time    `json:"end"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	Level           float64      `json:"level"` // Mean pressure of the plateau
+	Unit            string       `json:"unit"`
+	Damping         *DampingJSON `json:"damping,omitempty"` // Flush events only, if enabled
+}
+
+// DampingJSON describes the dynamic response of a pressure line measured from
+// the oscillations after a fast flush. The damping coefficient is derived from
+// the ratio of successive oscillation amplitudes:
+// ζ = -ln(r) / sqrt(π² + ln²(r)).
+type DampingJSON struct {
+	Coefficient          float64 `json:"damping_coefficient,omitempty"`
+	NaturalFrequency     float64 `json:"natural_frequency_hz,omitempty"`     // Undamped natural frequency
+	OscillationFrequency float64 `json:"oscillation_frequency_hz,omitempty"` // Observed (damped) frequency
+	AmplitudeRatio       float64 `json:"amplitude_ratio,omitempty"`
+	Overdamped           bool    `json:"overdamped"` // No oscillation after the flush; the other values are not measurable
+}
+
+// pressureSample is a physical value of a pressure waveform
+type pressureSample struct {
+	value float64
+	time  time.Time
+}
+
+// pressurePlateau is a run of samples within PRESSURE_FLAT_RANGE
+type pressurePlateau struct {
+	start, end time.Time
+	min, max   float64
+	sum        float64
+	count      int
+}
+
+// PressureEventDetector finds zeroing and fast-flush events in the waveform
+// of one invasive pressure channel. Zeroing shows as a plateau at 0 mmHg,
+// a fast flush as a plateau at the flush bag pressure followed by a sharp
+// release. Records must be added in order; plateaus may span records.
+type PressureEventDetector struct {
+	computeDamping bool
+	samplingRate   int
+	plateau        pressurePlateau
+	flush          *PressureEventJSON // Flush waiting for release samples
+	release        []pressureSample
+}
+
+// NewPressureEventDetector creates a detector for one channel
+func NewPressureEventDetector() *PressureEventDetector {
+	return &PressureEventDetector{}
+}
+
+// SetComputeDamping enables the damping coefficient and natural frequency of
+// flush events. Flush events are then reported FLUSH_RELEASE_WINDOW later.
+func (d *PressureEventDetector) SetComputeDamping(enabled bool) {
+	d.computeDamping = enabled
+}
+
+// Add processes the samples of a waveform and returns the events that ended
+// in it. Waveforms of other than invasive pressure channels are ignored.
+func (d *PressureEventDetector) Add(waveform *WaveformJSON) []*PressureEventJSON {
+	if !IsPressureWaveform(waveform.SubrecordType) || waveform.SamplingRate <= 0 {
+		return nil
+	}
+	if waveform.SamplingRate != d.samplingRate {
+		d.reset()
+		d.samplingRate = waveform.SamplingRate
+	}
+	channel := GetWaveformChannelKey(waveform.SubrecordType)
+
+	var events []*PressureEventJSON
+	if waveform.Header.HasGap {
+		// Samples are missing; a pending flush is reported without damping
+		events = appendPressureEvent(events, d.endPlateau(channel))
+		events = appendPressureEvent(events, d.flush)
+		d.reset()
+	}
+
+	for _, sample := range waveform.Samples {
+		if math.IsNaN(sample.PhysicalValue) || math.IsInf(sample.PhysicalValue, 0) {
+			// Control codes interrupt the signal
+			events = appendPressureEvent(events, d.endPlateau(channel))
+			d.plateau = pressurePlateau{}
+			continue
+		}
+		if d.flush != nil {
+			d.release = append(d.release, pressureSample{sample.PhysicalValue, sample.Timestamp})
+			if sample.Timestamp.Sub(d.flush.End) >= FLUSH_RELEASE_WINDOW {
+				d.flush.Damping = measureDamping(d.release)
+				events = append(events, d.flush)
+				d.flush, d.release = nil, nil
+			}
+		}
+
+		if d.plateau.count > 0 && math.Max(d.plateau.max, sample.PhysicalValue)-math.Min(d.plateau.min, sample.PhysicalValue) <= PRESSURE_FLAT_RANGE {
+			d.plateau.extend(sample.PhysicalValue, sample.Timestamp)
+			continue
+		}
+
+		event := d.endPlateau(channel)
+		if event != nil && event.Type == PRESSURE_EVENT_FLUSH && d.computeDamping {
+			d.flush = event
+			d.release = []pressureSample{{sample.PhysicalValue, sample.Timestamp}}
+			event = nil
+		}
+		events = appendPressureEvent(events, event)
+		d.plateau = pressurePlateau{start: sample.Timestamp, min: sample.PhysicalValue, max: sample.PhysicalValue}
+		d.plateau.extend(sample.PhysicalValue, sample.Timestamp)
+	}
+
+	return events
+}
+
+// endPlateau classifies the current plateau, returning nil if it is not an event
+func (d *PressureEventDetector) endPlateau(channel string) *PressureEventJSON {
+	p := d.plateau
+	if p.count == 0 {
+		return nil
+	}
+	// The plateau lasts until the next sample would have been taken
+	end := SampleTime(p.end, 1, d.samplingRate)
+	duration := end.Sub(p.start)
+	level := p.sum / float64(p.count)
+
+	eventType := ""
+	switch {
+	case math.Abs(level) <= ZERO_BAND && duration >= ZERO_MIN_DURATION:
+		eventType = PRESSURE_EVENT_ZERO
+	case level >= FLUSH_MIN_LEVEL && duration >= FLUSH_MIN_DURATION:
+		eventType = PRESSURE_EVENT_FLUSH
+	default:
+		return nil
+	}
+
+	return &PressureEventJSON{
+		Type:            eventType,
+		Channel:         channel,
+		Start:           p.start,
+		End:             end,
+		DurationSeconds: duration.Seconds(),
+		Level:           level,
+		Unit:            "mmHg",
+	}
+}
+
+// appendPressureEvent appends event to events unless it is nil
+func appendPressureEvent(events []*PressureEventJSON, event *PressureEventJSON) []*PressureEventJSON {
+	if event == nil {
+		return events
+	}
+	return append(events, event)
+}
+
+// reset discards the state of the previous signal
+func (d *PressureEventDetector) reset() {
+	d.plateau = pressurePlateau{}
+	d.flush, d.release = nil, nil
+}
+
+// extend adds a sample to the plateau
+func (p *pressurePlateau) extend(value float64, t time.Time) {
+	p.min = math.Min(p.min, value)
+	p.max = math.Max(p.max, value)
+	p.sum += value
+	p.count++
+	p.end = t
+}
+
+// measureDamping measures the oscillations after a flush release. The first
+// extremum is the undershoot after the pressure falls from the plateau; the
+// amplitude ratio is taken from the next two half cycles.
+func measureDamping(release []pressureSample) *DampingJSON {
+	extrema := findExtrema(release, DAMPING_MIN_AMPLITUDE)
+	if len(extrema) < 3 {
+		return &DampingJSON{Overdamped: true}
+	}
+
+	first := math.Abs(extrema[1].value - extrema[0].value)
+	second := math.Abs(extrema[2].value - extrema[1].value)
+	if second >= first {
+		// Not a decaying oscillation (e.g. the next heartbeat)
+		return &DampingJSON{Overdamped: true}
+	}
+
+	ratio := second / first
+	logRatio := math.Log(ratio)
+	coefficient := -logRatio / math.Sqrt(math.Pi*math.Pi+logRatio*logRatio)
+
+	// Extrema 0 and 2 are one damped period apart
+	oscillation := 1 / extrema[2].time.Sub(extrema[0].time).Seconds()
+	return &DampingJSON{
+		Coefficient:          coefficient,
+		NaturalFrequency:     oscillation / math.Sqrt(1-coefficient*coefficient),
+		OscillationFrequency: oscillation,
+		AmplitudeRatio:       ratio,
+	}
+}
+
+// findExtrema returns the alternating minima and maxima of samples that
+// differ from their neighbouring extrema by at least threshold. Samples are
+// expected to start falling.
+func findExtrema(samples []pressureSample, threshold float64) []pressureSample {
+	var extrema []pressureSample
+	if len(samples) == 0 {
+		return extrema
+	}
+
+	falling := true
+	candidate := samples[0]
+	for _, sample := range samples[1:] {
+		switch {
+		case falling && sample.value < candidate.value, !falling && sample.value > candidate.value:
+			candidate = sample
+		case falling && sample.value-candidate.value >= threshold, !falling && candidate.value-sample.value >= threshold:
+			extrema = append(extrema, candidate)
+			candidate = sample
+			falling = !falling
+		}
+	}
+	return extrema
+}
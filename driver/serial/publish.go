@@ -0,0 +1,112 @@
+package serial
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/harusin0516/healthcare/driver/publish"
+)
+
+// DRI_DEFAULT_TOPIC is the topic template used when none is configured
+const DRI_DEFAULT_TOPIC = "dri.{device}.{type}"
+
+// RecordPublisher publishes parsed DRI records to an event bus. The topic
+// template may use {device} (plug ID), {type} (phdb, wave, alarm, network, fo)
+// and {level} (DRI level).
+type RecordPublisher struct {
+	publisher     publish.Publisher
+	topicTemplate string
+}
+
+// NewRecordPublisher creates a record publisher
+func NewRecordPublisher(publisher publish.Publisher, topicTemplate string) *RecordPublisher {
+	if topicTemplate == "" {
+		topicTemplate = DRI_DEFAULT_TOPIC
+	}
+	return &RecordPublisher{
+		publisher:     publisher,
+		topicTemplate: topicTemplate,
+	}
+}
+
+// Publish JSON-encodes record (e.g. *TrendJSON, *AlarmJSON, *WaveformJSON) and
+// publishes it keyed by plug ID so that the records of one monitor stay ordered
+func (p *RecordPublisher) Publish(header *DatexHeader, record interface{}) error {
+	payload, err := MarshalOutput(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	device := strconv.Itoa(int(header.PlugID))
+	topic := publish.Topic(p.topicTemplate, map[string]string{
+		"device": device,
+		"type":   GetMainTypeKey(header.RMainType),
+		"level":  strconv.Itoa(int(header.DriLevel)),
+	})
+	return p.publisher.Publish(topic, device, payload)
+}
+
+// HandleAlarmEvent publishes an alarm lifecycle event of an AlarmManager
+// with the type "alarm_event", keyed by plug ID
+func (p *RecordPublisher) HandleAlarmEvent(event *AlarmEventJSON) error {
+	payload, err := MarshalOutput(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode alarm event: %w", err)
+	}
+
+	device := strconv.Itoa(event.PlugID)
+	topic := publish.Topic(p.topicTemplate, map[string]string{
+		"device": device,
+		"type":   "alarm_event",
+	})
+	return p.publisher.Publish(topic, device, payload)
+}
+
+// HandleConnectionEvent publishes a connection state change of a transport
+// with the type "connection", keyed by the transport name
+func (p *RecordPublisher) HandleConnectionEvent(event *ConnectionEventJSON) error {
+	payload, err := MarshalOutput(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode connection event: %w", err)
+	}
+
+	topic := publish.Topic(p.topicTemplate, map[string]string{
+		"device": event.Source,
+		"type":   "connection",
+	})
+	return p.publisher.Publish(topic, event.Source, payload)
+}
+
+// HandleLossEvent publishes records missing in the stream of a monitor
+// with the type "records_missed", keyed by plug ID
+func (p *RecordPublisher) HandleLossEvent(event *LossEventJSON) error {
+	payload, err := MarshalOutput(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode loss event: %w", err)
+	}
+
+	device := strconv.Itoa(event.PlugID)
+	topic := publish.Topic(p.topicTemplate, map[string]string{
+		"device": device,
+		"type":   "records_missed",
+	})
+	return p.publisher.Publish(topic, device, payload)
+}
+
+// GetMainTypeKey returns a short key for a record main type, used in topic names
+func GetMainTypeKey(mainType int16) string {
+	switch mainType {
+	case DRI_MT_PHDB:
+		return "phdb"
+	case DRI_MT_WAVE:
+		return "wave"
+	case DRI_MT_ALARM:
+		return "alarm"
+	case DRI_MT_NETWORK:
+		return "network"
+	case DRI_MT_FO:
+		return "fo"
+	default:
+		return "unknown"
+	}
+}
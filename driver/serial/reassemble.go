@@ -0,0 +1,207 @@
+package serial
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// REASSEMBLY_MAX_GAP is the longest gap filled with NaN samples; after a
+// longer gap the channel starts a new stream
+const REASSEMBLY_MAX_GAP = 10 * time.Second
+
+// StreamValues are the physical values of a sample stream. NaN marks a
+// missing sample and is encoded as null in JSON.
+type StreamValues []float64
+
+// MarshalJSON encodes the values with null for NaN
+func (v StreamValues) MarshalJSON() ([]byte, error) {
+	data := make([]byte, 0, len(v)*8+2)
+	data = append(data, '[')
+	for i, value := range v {
+		if i > 0 {
+			data = append(data, ',')
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			data = append(data, "null"...)
+			continue
+		}
+		data = strconv.AppendFloat(data, value, 'g', -1, 64)
+	}
+	return append(data, ']'), nil
+}
+
+// StreamGap is a run of NaN samples inserted for missing data, or of
+// control codes with the same meaning
+type StreamGap struct {
+	Offset int    `json:"offset"` // Index of the first sample of the run within the stream
+	Count  int    `json:"count"`
+	Reason string `json:"reason"` // gap (missing records), status_gap (WF_STATUS_GAP) or the SampleCondition of the control codes
+}
+
+// StreamChunk is the part of a continuous sample stream produced by one
+// waveform record: the values of the record, preceded by NaN samples if
+// data is missing since the previous record
+type StreamChunk struct {
+	PlugID       int          `json:"plug_id"`
+	Channel      string       `json:"channel"`
+	StreamID     int          `json:"stream_id"`
+	NewStream    bool         `json:"new_stream"`            // First chunk of the stream
+	Reason       string       `json:"reason,omitempty"`      // Why the stream started (new_stream only)
+	GapSeconds   float64      `json:"gap_seconds,omitempty"` // Length of the gap before the stream, if known
+	StreamStart  time.Time    `json:"stream_start"`
+	SamplingRate int          `json:"sampling_rate"`
+	Offset       int          `json:"offset"` // Index of Values[0] within the stream
+	Values       StreamValues `json:"values"` // NaN for missing samples and control codes
+	Gaps         []StreamGap  `json:"gaps,omitempty"`
+	Invalid      []StreamGap  `json:"invalid,omitempty"` // Runs of control codes by condition (e.g. lead_off, over_range)
+	Unit         string       `json:"unit,omitempty"`
+}
+
+// Time returns the timestamp of Values[i]
+func (c *StreamChunk) Time(i int) time.Time {
+	return SampleTime(c.StreamStart, c.Offset+i, c.SamplingRate)
+}
+
+// reassemblyChannel is the stream state of one channel
+type reassemblyChannel struct {
+	stitcher     *WaveformStitcher
+	streamID     int
+	start        time.Time
+	length       int
+	samplingRate int
+}
+
+// WaveformReassembler joins the waveform subrecords of every channel of
+// every monitor into continuous sample streams at a fixed rate. Records are
+// stitched with a WaveformStitcher per channel; where it starts a new
+// segment because records are missing or the monitor set the gap bit, the
+// missing time is filled with NaN samples instead, so that the stream stays
+// continuous and sample i is at StreamStart + i/rate. A gap of unknown
+// length (gap bit without a later r_time) is marked with one NaN sample.
+// Gaps longer than the maximum, rate changes and clock resets start a new
+// stream. It is safe for concurrent use.
+type WaveformReassembler struct {
+	mutex    sync.Mutex
+	maxGap   time.Duration
+	channels map[waveformRingKey]*reassemblyChannel
+}
+
+// NewWaveformReassembler creates a reassembler filling gaps up to maxGap
+// (REASSEMBLY_MAX_GAP if maxGap is 0)
+func NewWaveformReassembler(maxGap time.Duration) *WaveformReassembler {
+	if maxGap <= 0 {
+		maxGap = REASSEMBLY_MAX_GAP
+	}
+	return &WaveformReassembler{maxGap: maxGap, channels: make(map[waveformRingKey]*reassemblyChannel)}
+}
+
+// Add appends a waveform parsed with ParseWaveformRecord to the stream of
+// its channel. It returns nil if the record only repeats samples that were
+// already received.
+func (r *WaveformReassembler) Add(header *DatexHeader, waveform *WaveformJSON) *StreamChunk {
+	key := waveformRingKey{plugID: int(header.PlugID), channel: GetWaveformChannelKey(waveform.SubrecordType)}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	channel := r.channels[key]
+	if channel == nil {
+		channel = &reassemblyChannel{stitcher: NewWaveformStitcher()}
+		r.channels[key] = channel
+	}
+	stitched := channel.stitcher.Add(header, waveform)
+	if stitched == nil {
+		return nil
+	}
+
+	chunk := &StreamChunk{PlugID: key.plugID, Channel: key.channel}
+	missing := 0
+	if stitched.NewSegment {
+		switch stitched.Reason {
+		case SEGMENT_GAP, SEGMENT_STATUS_GAP:
+			gap := stitched.SegmentStart.Sub(channel.nextTime())
+			missing = int(math.Round(gap.Seconds() * float64(channel.samplingRate)))
+			if missing < 1 {
+				missing = 1
+			}
+			if gap > r.maxGap {
+				channel.startStream(chunk, stitched.Reason, stitched)
+				chunk.GapSeconds = stitched.GapSeconds
+				missing = 0
+			}
+		default:
+			channel.startStream(chunk, stitched.Reason, stitched)
+		}
+	}
+
+	chunk.StreamID = channel.streamID
+	chunk.StreamStart = channel.start
+	chunk.SamplingRate = channel.samplingRate
+	chunk.Offset = channel.length
+	chunk.Values = make(StreamValues, 0, missing+len(stitched.Samples))
+	if missing > 0 {
+		chunk.Gaps = []StreamGap{{Offset: channel.length, Count: missing, Reason: stitched.Reason}}
+		for i := 0; i < missing; i++ {
+			chunk.Values = append(chunk.Values, math.NaN())
+		}
+	}
+	for _, sample := range stitched.Samples {
+		if sample.IsControlCode {
+			condition := sample.Condition
+			if condition == SAMPLE_VALID {
+				condition = ClassifySample(sample.RawValue)
+			}
+			chunk.addInvalid(channel.length+len(chunk.Values), condition)
+			chunk.Values = append(chunk.Values, math.NaN())
+			continue
+		}
+		chunk.Values = append(chunk.Values, sample.PhysicalValue)
+		if chunk.Unit == "" {
+			chunk.Unit = sample.Unit
+		}
+	}
+	channel.length += len(chunk.Values)
+	return chunk
+}
+
+// addInvalid adds a control code at offset to the runs of invalid samples
+func (c *StreamChunk) addInvalid(offset int, condition SampleCondition) {
+	reason := condition.String()
+	if last := len(c.Invalid) - 1; last >= 0 {
+		run := &c.Invalid[last]
+		if run.Reason == reason && run.Offset+run.Count == offset {
+			run.Count++
+			return
+		}
+	}
+	c.Invalid = append(c.Invalid, StreamGap{Offset: offset, Count: 1, Reason: reason})
+}
+
+// Reset forgets the streams of a monitor, e.g. after it was disconnected
+func (r *WaveformReassembler) Reset(plugID int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key := range r.channels {
+		if key.plugID == plugID {
+			delete(r.channels, key)
+		}
+	}
+}
+
+// startStream begins a new stream at the start of a stitched segment
+func (c *reassemblyChannel) startStream(chunk *StreamChunk, reason string, stitched *StitchedChunk) {
+	c.streamID++
+	c.start = stitched.SegmentStart
+	c.length = 0
+	c.samplingRate = stitched.SamplingRate
+
+	chunk.NewStream = true
+	chunk.Reason = reason
+}
+
+// nextTime returns the time of the next sample of the stream
+func (c *reassemblyChannel) nextTime() time.Time {
+	return SampleTime(c.start, c.length, c.samplingRate)
+}
@@ -0,0 +1,86 @@
+package serial
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Subrecord is a subrecord of a validated record
+type Subrecord struct {
+	Index  int    // Position of the descriptor in sr_desc
+	Type   byte   // sr_type
+	Offset int    // sr_offset, from the start of the data area
+	Data   []byte // Bytes of the subrecord, up to the next subrecord or the end of the record
+}
+
+// ValidateRecord checks the header of a complete record against its data
+// and returns the header and the subrecords listed before the end of list
+// marker. It rejects, with an error wrapping ErrInvalidRecord, a record
+// shorter than its header, an r_len shorter than the header or longer than
+// the data, and subrecords at a negative offset, at or beyond the end of
+// the record, or at the same offset as another subrecord. Bytes beyond
+// r_len are not part of the record. Each subrecord extends to the next
+// subrecord in offset order, so a parser that stays within Data cannot
+// read another subrecord or beyond the record; every parser locates
+// subrecords through ValidateRecord rather than slicing at sr_offset.
+// Descriptors listed out of offset order are accepted, not rejected: the
+// subrecords are bounded by their offsets and returned in sr_desc order.
+func ValidateRecord(data []byte) (*DatexHeader, []Subrecord, error) {
+	header := &DatexHeader{}
+	if len(data) < header.Size() {
+		return nil, nil, fmt.Errorf("%w: %d bytes, shorter than the %d byte header", ErrInvalidRecord, len(data), header.Size())
+	}
+	if err := header.UnmarshalBinary(data); err != nil {
+		return nil, nil, err
+	}
+	if int(header.RLen) < header.Size() {
+		return header, nil, fmt.Errorf("%w: r_len %d shorter than the %d byte header", ErrInvalidRecord, header.RLen, header.Size())
+	}
+	if int(header.RLen) > len(data) {
+		return header, nil, fmt.Errorf("%w: r_len %d longer than the %d bytes received", ErrInvalidRecord, header.RLen, len(data))
+	}
+
+	area := data[header.Size():header.RLen]
+	var subrecords []Subrecord
+	for i := 0; i < len(header.SrDesc); i++ {
+		srDesc := header.SrDesc[i]
+		if srDesc.IsEndOfList() {
+			break
+		}
+		if srDesc.SrOffset < 0 || int(srDesc.SrOffset) >= len(area) {
+			return header, nil, fmt.Errorf("%w: subrecord %d offset %d outside the data area (%d bytes)",
+				ErrInvalidRecord, i, srDesc.SrOffset, len(area))
+		}
+		subrecords = append(subrecords, Subrecord{Index: i, Type: srDesc.SrType, Offset: int(srDesc.SrOffset)})
+	}
+
+	// Bound each subrecord by the next one in offset order
+	order := make([]int, len(subrecords))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return subrecords[order[a]].Offset < subrecords[order[b]].Offset })
+	for n, i := range order {
+		end := len(area)
+		if n+1 < len(order) {
+			next := subrecords[order[n+1]]
+			if next.Offset == subrecords[i].Offset {
+				return header, nil, fmt.Errorf("%w: subrecords %d and %d overlap at offset %d",
+					ErrInvalidRecord, subrecords[i].Index, next.Index, next.Offset)
+			}
+			end = next.Offset
+		}
+		subrecords[i].Data = area[subrecords[i].Offset:end:end]
+	}
+	return header, subrecords, nil
+}
+
+// ValidateSubrecordSize checks that a subrecord holds a structure of size
+// bytes
+func ValidateSubrecordSize(subrecord Subrecord, size int) error {
+	if len(subrecord.Data) < size {
+		return fmt.Errorf("%w: subrecord %d (type %d) has %d bytes, %d needed",
+			ErrInvalidRecord, subrecord.Index, subrecord.Type, len(subrecord.Data), size)
+	}
+	return nil
+}
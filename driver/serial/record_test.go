@@ -0,0 +1,95 @@
+package serial
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+)
+
+// seedRecords adds the records of the deterioration scenario (alarm and
+// waveform records) and a trend record to the corpus of a fuzz target
+func seedRecords(f *testing.F) {
+	f.Helper()
+	scenario := (&hl7.SampleHL7Messages{}).GetDeteriorationScenario(time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC))
+	records, err := ScenarioRecords(scenario, ScenarioRecordOptions{Waveforms: true})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, record := range records {
+		f.Add(record.Data)
+	}
+
+	trend, err := buildRecord(DatexHeader{DriLevel: DRI_LEVEL_05, PlugID: 1, RTime: 1717228800, RMainType: DRI_MT_PHDB},
+		DRI_PH_DISPL, make([]byte, 4+PH_DATA_CLASS_SIZE+4))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(trend)
+	f.Add([]byte{})
+}
+
+// checkParseError fails if a parser panicked or returned an error that
+// does not wrap ErrInvalidRecord
+func checkParseError(t *testing.T, err error) {
+	t.Helper()
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		t.Fatalf("parser panicked: %s\n%s", panicErr.Report.Panic, panicErr.Report.Stack)
+	}
+	if err != nil && !errors.Is(err, ErrInvalidRecord) {
+		t.Fatalf("error does not wrap ErrInvalidRecord: %v", err)
+	}
+}
+
+func FuzzValidateRecord(f *testing.F) {
+	seedRecords(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, subrecords, err := ValidateRecord(data)
+		checkParseError(t, err)
+		if err != nil {
+			return
+		}
+
+		// Subrecords lie within the data area and do not overlap
+		area := int(header.RLen) - header.Size()
+		for i, subrecord := range subrecords {
+			end := subrecord.Offset + len(subrecord.Data)
+			if subrecord.Offset < 0 || len(subrecord.Data) == 0 || end > area {
+				t.Fatalf("subrecord %d at %d+%d outside the %d byte data area", i, subrecord.Offset, len(subrecord.Data), area)
+			}
+			for j, other := range subrecords[:i] {
+				if subrecord.Offset < other.Offset+len(other.Data) && other.Offset < end {
+					t.Fatalf("subrecords %d and %d overlap", j, i)
+				}
+			}
+		}
+	})
+}
+
+func FuzzParseAlarmData(f *testing.F) {
+	seedRecords(f)
+	parser := NewAlarmParser()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := parser.ParseAlarmData(data)
+		checkParseError(t, err)
+	})
+}
+
+func FuzzParseTrendData(f *testing.F) {
+	seedRecords(f)
+	parser := NewTrendParser()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := parser.ParseTrendData(data)
+		checkParseError(t, err)
+	})
+}
+
+func FuzzParseWaveformRecords(f *testing.F) {
+	seedRecords(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _, err := ParseWaveformRecords(data, nil, nil)
+		checkParseError(t, err)
+	})
+}
@@ -0,0 +1,192 @@
+package serial
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/hl7"
+)
+
+// Scenario record defaults
+const (
+	SCENARIO_PLUG_ID         = 1    // Plug ID of the simulated monitor
+	SCENARIO_PULSE_RATE      = 60   // Pulse rate of the pleth waveform without a heart rate trajectory
+	SCENARIO_PLETH_AMPLITUDE = 5000 // Peak of the pleth waveform (1/100 %)
+)
+
+// ScenarioRecordOptions configures the DRI records generated for a scenario
+type ScenarioRecordOptions struct {
+	PlugID    uint16 // Plug ID of the simulated monitor (0: 1)
+	DriLevel  byte   // DRI level of the records (0: DRI_LEVEL_05)
+	Waveforms bool   // Add a pleth waveform record every second, pulsing at the scenario pulse rate
+}
+
+// ScenarioRecord is a DRI record the monitor of a scenario transmits
+type ScenarioRecord struct {
+	Time time.Time `json:"time"`
+	Data []byte    `json:"data"`
+}
+
+// ScenarioRecords generates the DRI records matching the HL7 messages of a
+// scenario (hl7.Scenario.Generate): an alarm status record (DRI_MT_ALARM)
+// whenever an alarm starts or ends, listing the active alarms by color, and
+// optionally pleth waveform records (DRI_MT_WAVE). Scenario priorities map
+// to colors the way ACMAlert maps them back (PH: red, PM: yellow, PL:
+// white). Trend records are not generated because the physiological data
+// classes are not decoded field by field. Records are numbered from 0 in
+// time order and stamped with the scenario time.
+func ScenarioRecords(scenario *hl7.Scenario, options ScenarioRecordOptions) ([]ScenarioRecord, error) {
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+	if options.PlugID == 0 {
+		options.PlugID = SCENARIO_PLUG_ID
+	}
+	if options.DriLevel == 0 {
+		options.DriLevel = DRI_LEVEL_05
+	}
+
+	type pending struct {
+		at       int // Seconds after the start
+		mainType int16
+		srType   byte
+		data     []byte
+	}
+	var records []pending
+
+	// Alarm status at every start and end of an alarm
+	changes := make(map[int]bool)
+	for _, alarm := range scenario.Alarms {
+		changes[alarm.At] = true
+		if alarm.Duration > 0 && alarm.At+alarm.Duration <= scenario.Duration {
+			changes[alarm.At+alarm.Duration] = true
+		}
+	}
+	times := make([]int, 0, len(changes))
+	for at := range changes {
+		times = append(times, at)
+	}
+	sort.Ints(times)
+	previous := &AlarmStatusMessage{}
+	for _, at := range times {
+		message := scenarioAlarmStatus(scenario.AlarmsAt(time.Duration(at)*time.Second), previous)
+		data, err := message.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, pending{at, DRI_MT_ALARM, DRI_AL_STATUS, data})
+		previous = message
+	}
+
+	// Pleth waveform, one second per record with a continuous pulse phase
+	if options.Waveforms {
+		rate := GetSamplingRate(DRI_WF_PLETH)
+		phase := 0.0
+		for at := 0; at < scenario.Duration; at++ {
+			pulseRate := scenarioPulseRate(scenario.VitalsAt(time.Duration(at) * time.Second))
+			samples := make([]int16, rate)
+			for i := range samples {
+				samples[i] = int16(SCENARIO_PLETH_AMPLITUDE * plethShape(phase))
+				phase = math.Mod(phase+pulseRate/60/float64(rate), 1)
+			}
+			waveform := &WaveformData{Header: WaveformHeader{ActLen: int16(rate)}, Samples: samples}
+			data, err := waveform.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, pending{at, DRI_MT_WAVE, DRI_WF_PLETH, data})
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].at < records[j].at })
+	result := make([]ScenarioRecord, len(records))
+	for i, record := range records {
+		recordTime := scenario.Start.Add(time.Duration(record.at) * time.Second)
+		header := DatexHeader{
+			RNbr:      byte(i),
+			DriLevel:  options.DriLevel,
+			PlugID:    options.PlugID,
+			RTime:     uint32(recordTime.Unix()),
+			RMainType: record.mainType,
+		}
+		data, err := buildRecord(header, record.srType, record.data)
+		if err != nil {
+			return nil, fmt.Errorf("record at %ds: %v", record.at, err)
+		}
+		result[i] = ScenarioRecord{Time: recordTime, Data: data}
+	}
+	return result, nil
+}
+
+// buildRecord assembles a record of one subrecord behind header, setting
+// r_len and the subrecord list
+func buildRecord(header DatexHeader, srType byte, subrecord []byte) ([]byte, error) {
+	header.ClearSubrecords()
+	if err := header.SetSubrecord(0, 0, srType); err != nil {
+		return nil, err
+	}
+	header.RLen = int16(header.Size() + len(subrecord))
+	data, err := header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, subrecord...), nil
+}
+
+// scenarioAlarmStatus builds the alarm status message of the active alarms,
+// highest color first as the monitor sorts them, flagging the texts and
+// colors that differ from the previous message
+func scenarioAlarmStatus(alarms []hl7.ScenarioAlarm, previous *AlarmStatusMessage) *AlarmStatusMessage {
+	sort.SliceStable(alarms, func(i, j int) bool {
+		return scenarioAlarmColor(alarms[i].Priority) > scenarioAlarmColor(alarms[j].Priority)
+	})
+	message := &AlarmStatusMessage{SoundOnOff: len(alarms) > 0, SilenceInfo: DRI_SI_NONE}
+	for i := 0; i < len(message.AlDisp) && i < len(alarms); i++ {
+		display := &message.AlDisp[i]
+		display.SetAlarmText(alarms[i].Text)
+		display.Color = scenarioAlarmColor(alarms[i].Priority)
+	}
+	for i := range message.AlDisp {
+		display := &message.AlDisp[i]
+		display.TextChanged = display.Text != previous.AlDisp[i].Text
+		display.ColorChanged = display.Color != previous.AlDisp[i].Color
+	}
+	return message
+}
+
+// scenarioAlarmColor maps an alert priority to a DRI alarm color
+func scenarioAlarmColor(priority string) byte {
+	switch priority {
+	case hl7.ACM_PRIORITY_HIGH:
+		return DRI_PR3
+	case hl7.ACM_PRIORITY_MEDIUM:
+		return DRI_PR2
+	case hl7.ACM_PRIORITY_LOW:
+		return DRI_PR1
+	default:
+		return DRI_PR0
+	}
+}
+
+// scenarioPulseRate returns the pulse rate of the vital signs, preferring
+// the pulse oximeter over the ECG
+func scenarioPulseRate(vitals map[string]float64) float64 {
+	for _, parameter := range []string{"MDC_PULS_OXIM_PULS_RATE", "MDC_ECG_HEART_RATE"} {
+		if rate, exists := vitals[parameter]; exists && rate > 0 {
+			return rate
+		}
+	}
+	return SCENARIO_PULSE_RATE
+}
+
+// plethShape returns the pleth waveform (0 to 1) at a phase of the pulse:
+// a fast systolic upstroke followed by an exponential diastolic decay
+func plethShape(phase float64) float64 {
+	const upstroke = 0.15
+	if phase < upstroke {
+		return math.Sin(math.Pi / 2 * phase / upstroke)
+	}
+	return math.Exp(-4 * (phase - upstroke))
+}
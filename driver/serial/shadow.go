@@ -0,0 +1,271 @@
+package serial
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shadow comparison defaults
+const (
+	SHADOW_QUEUE_SIZE = 256 // Frames waiting for the shadow parser
+	SHADOW_MAX_DIFFS  = 100 // Mismatches kept in memory
+)
+
+// FrameParser parses one DRI frame into a JSON-encodable value
+type FrameParser func(data []byte) (interface{}, error)
+
+// ShadowDiff describes a frame for which the shadow parser disagreed with the primary
+type ShadowDiff struct {
+	Time        time.Time `json:"time"`
+	Frame       string    `json:"frame"` // Hex dump with PHI scrubbed
+	PrimaryErr  string    `json:"primary_error,omitempty"`
+	ShadowErr   string    `json:"shadow_error,omitempty"`
+	Differences []string  `json:"differences"`
+}
+
+// ShadowStats counts the frames seen by a ShadowRunner
+type ShadowStats struct {
+	Frames     int `json:"frames"`     // Frames parsed by the primary parser
+	Compared   int `json:"compared"`   // Frames also parsed by the shadow parser
+	Matched    int `json:"matched"`    // Frames with identical output
+	Mismatched int `json:"mismatched"` // Frames with different output or errors
+	Dropped    int `json:"dropped"`    // Frames skipped because the shadow queue was full
+}
+
+// shadowJob is a frame queued for the shadow parser
+type shadowJob struct {
+	data        []byte
+	primaryJSON []byte
+	primaryErr  error
+}
+
+// ShadowRunner runs a secondary ("shadow") parser on the frames handled by the
+// primary parser and records where their outputs differ. Only the primary
+// result is returned to the caller; the shadow parser runs on a separate
+// goroutine behind a bounded queue, so a slow or panicking shadow parser never
+// delays or changes delivery. Frames are dropped from comparison when the
+// queue is full.
+type ShadowRunner struct {
+	primary      FrameParser
+	shadow       FrameParser
+	ignoreFields map[string]bool
+	queue        chan shadowJob
+	done         chan struct{}
+	closeOnce    sync.Once
+	mutex        sync.Mutex
+	stats        ShadowStats
+	diffs        []ShadowDiff
+	onDiff       func(ShadowDiff)
+}
+
+// NewShadowRunner starts a shadow comparison between two parsers. Fields named
+// in ignoreFields (e.g. "parse_time") are skipped when comparing outputs.
+func NewShadowRunner(primary, shadow FrameParser, ignoreFields ...string) *ShadowRunner {
+	r := &ShadowRunner{
+		primary:      primary,
+		shadow:       shadow,
+		ignoreFields: make(map[string]bool),
+		queue:        make(chan shadowJob, SHADOW_QUEUE_SIZE),
+		done:         make(chan struct{}),
+	}
+	for _, field := range ignoreFields {
+		r.ignoreFields[field] = true
+	}
+	go r.run()
+	return r
+}
+
+// SetDiffHandler registers a callback for every mismatch. It runs on the
+// shadow goroutine and must not block.
+func (r *ShadowRunner) SetDiffHandler(handler func(ShadowDiff)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.onDiff = handler
+}
+
+// Parse parses data with the primary parser and returns its result. The frame
+// is queued for the shadow parser if there is room in the queue.
+func (r *ShadowRunner) Parse(data []byte) (interface{}, error) {
+	result, err := r.primary(data)
+
+	r.mutex.Lock()
+	r.stats.Frames++
+	r.mutex.Unlock()
+
+	// Encode the primary result now, before the caller can modify it
+	job := shadowJob{primaryErr: err}
+	if len(r.queue) < cap(r.queue) {
+		job.data = make([]byte, len(data))
+		copy(job.data, data)
+		if err == nil {
+			job.primaryJSON, _ = json.Marshal(result)
+		}
+	}
+
+	select {
+	case r.queue <- job:
+	default:
+		r.mutex.Lock()
+		r.stats.Dropped++
+		r.mutex.Unlock()
+	}
+
+	return result, err
+}
+
+// Stats returns the comparison counters
+func (r *ShadowRunner) Stats() ShadowStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.stats
+}
+
+// Diffs returns the most recent mismatches (oldest first)
+func (r *ShadowRunner) Diffs() []ShadowDiff {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	diffs := make([]ShadowDiff, len(r.diffs))
+	copy(diffs, r.diffs)
+	return diffs
+}
+
+// Close stops the shadow goroutine. Frames still queued are not compared.
+func (r *ShadowRunner) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// run compares queued frames until Close is called
+func (r *ShadowRunner) run() {
+	for {
+		select {
+		case job := <-r.queue:
+			if job.data == nil {
+				// Queue filled up while the job was prepared
+				r.mutex.Lock()
+				r.stats.Dropped++
+				r.mutex.Unlock()
+				continue
+			}
+			r.compare(job)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// compare runs the shadow parser on one frame and records the outcome
+func (r *ShadowRunner) compare(job shadowJob) {
+	shadowJSON, shadowErr := r.runShadow(job.data)
+
+	differences := make([]string, 0)
+	switch {
+	case job.primaryErr != nil || shadowErr != nil:
+		if (job.primaryErr == nil) != (shadowErr == nil) || job.primaryErr.Error() != shadowErr.Error() {
+			differences = append(differences, fmt.Sprintf("error: %v != %v", job.primaryErr, shadowErr))
+		}
+	default:
+		var primaryValue, shadowValue interface{}
+		json.Unmarshal(job.primaryJSON, &primaryValue)
+		json.Unmarshal(shadowJSON, &shadowValue)
+		differences = r.diffValues("$", primaryValue, shadowValue, differences)
+	}
+
+	r.mutex.Lock()
+	r.stats.Compared++
+	if len(differences) == 0 {
+		r.stats.Matched++
+		r.mutex.Unlock()
+		return
+	}
+	r.stats.Mismatched++
+
+	frame, _ := ScrubFrame(job.data)
+	diff := ShadowDiff{
+		Time:        time.Now(),
+		Frame:       hex.EncodeToString(frame),
+		Differences: differences,
+	}
+	if job.primaryErr != nil {
+		diff.PrimaryErr = job.primaryErr.Error()
+	}
+	if shadowErr != nil {
+		diff.ShadowErr = shadowErr.Error()
+	}
+	r.diffs = append(r.diffs, diff)
+	if len(r.diffs) > SHADOW_MAX_DIFFS {
+		r.diffs = r.diffs[len(r.diffs)-SHADOW_MAX_DIFFS:]
+	}
+	handler := r.onDiff
+	r.mutex.Unlock()
+
+	if handler != nil {
+		handler(diff)
+	}
+}
+
+// runShadow runs the shadow parser, converting panics into errors
+func (r *ShadowRunner) runShadow(data []byte) (shadowJSON []byte, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("shadow parser panic: %v", recovered)
+		}
+	}()
+
+	result, err := r.shadow(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// diffValues appends the paths at which two decoded JSON values differ
+func (r *ShadowRunner) diffValues(path string, primary, shadow interface{}, differences []string) []string {
+	primaryMap, primaryIsMap := primary.(map[string]interface{})
+	shadowMap, shadowIsMap := shadow.(map[string]interface{})
+	if primaryIsMap && shadowIsMap {
+		keys := make(map[string]bool)
+		for key := range primaryMap {
+			keys[key] = true
+		}
+		for key := range shadowMap {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			if !r.ignoreFields[key] {
+				sorted = append(sorted, key)
+			}
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			differences = r.diffValues(path+"."+key, primaryMap[key], shadowMap[key], differences)
+		}
+		return differences
+	}
+
+	primaryList, primaryIsList := primary.([]interface{})
+	shadowList, shadowIsList := shadow.([]interface{})
+	if primaryIsList && shadowIsList {
+		if len(primaryList) != len(shadowList) {
+			return append(differences, fmt.Sprintf("%s: length %d != %d", path, len(primaryList), len(shadowList)))
+		}
+		for i := range primaryList {
+			differences = r.diffValues(fmt.Sprintf("%s[%d]", path, i), primaryList[i], shadowList[i], differences)
+		}
+		return differences
+	}
+
+	primaryJSON, _ := json.Marshal(primary)
+	shadowJSON, _ := json.Marshal(shadow)
+	if string(primaryJSON) != string(shadowJSON) {
+		differences = append(differences, fmt.Sprintf("%s: %s != %s", path, primaryJSON, shadowJSON))
+	}
+	return differences
+}
@@ -0,0 +1,218 @@
+package serial
+
+import (
+	"time"
+)
+
+// Stitching defaults
+const (
+	STITCH_TOLERANCE    = 250 * time.Millisecond // Timing error accepted beyond the 1s resolution of r_time
+	STITCH_TAIL_SECONDS = 5                      // Seconds of samples kept to detect overlaps
+	STITCH_RECENT       = 16                     // Records remembered to detect retransmissions
+)
+
+// Reasons a new segment was started
+const (
+	SEGMENT_START       = "start"       // First record
+	SEGMENT_GAP         = "gap"         // Record starts later than the previous one ended
+	SEGMENT_STATUS_GAP  = "status_gap"  // Monitor flagged a gap in sampling (WF_STATUS_GAP)
+	SEGMENT_CLOCK_RESET = "clock_reset" // Record starts before the previous one ended and does not repeat it
+	SEGMENT_RATE_CHANGE = "rate_change" // Sampling rate changed
+)
+
+// StitchedChunk is the part of a waveform record appended to a continuous
+// stream. Samples are restamped so that timestamps within a segment are
+// monotonic and exactly 1/sampling rate apart.
+type StitchedChunk struct {
+	SegmentID        int          `json:"segment_id"`
+	NewSegment       bool         `json:"new_segment"`           // First chunk of the segment
+	Reason           string       `json:"reason,omitempty"`      // Why the segment started (new_segment only)
+	GapSeconds       float64      `json:"gap_seconds,omitempty"` // Length of the gap before the segment, if known
+	SegmentStart     time.Time    `json:"segment_start"`
+	SamplingRate     int          `json:"sampling_rate"`
+	Offset           int          `json:"offset"` // Index of the first sample within the segment
+	Samples          []SampleJSON `json:"samples"`
+	DuplicateSamples int          `json:"duplicate_samples,omitempty"` // Leading samples dropped as already received
+}
+
+// recordKey identifies a record for retransmission detection
+type recordKey struct {
+	rNbr  byte
+	rTime uint32
+}
+
+// WaveformStitcher joins the waveform subrecords of one channel of one
+// monitor into continuous segments. Consecutive records continue the current
+// segment as long as their r_time is consistent with the samples already
+// received; a new segment is started only where data is really missing.
+// Retransmitted records and overlapping samples are dropped.
+type WaveformStitcher struct {
+	tolerance    time.Duration
+	samplingRate int
+	segmentID    int
+	segmentStart time.Time
+	segmentLen   int
+	tail         []int16
+	recent       []recordKey
+}
+
+// NewWaveformStitcher creates a stitcher for one channel
+func NewWaveformStitcher() *WaveformStitcher {
+	return &WaveformStitcher{tolerance: STITCH_TOLERANCE}
+}
+
+// SetTolerance sets the timing error accepted beyond the r_time resolution
+func (s *WaveformStitcher) SetTolerance(tolerance time.Duration) {
+	s.tolerance = tolerance
+}
+
+// Add appends a waveform parsed with ParseWaveformRecord. It returns nil if
+// the record only repeats samples that were already received.
+func (s *WaveformStitcher) Add(header *DatexHeader, waveform *WaveformJSON) *StitchedChunk {
+	key := recordKey{rNbr: header.RNbr, rTime: header.RTime}
+	if s.seen(key) {
+		return nil
+	}
+	s.remember(key)
+
+	raw := make([]int16, len(waveform.Samples))
+	for i, sample := range waveform.Samples {
+		raw[i] = sample.RawValue
+	}
+
+	chunk := &StitchedChunk{}
+	recordStart := waveform.Timestamp
+	nextTime := s.nextTime()
+	window := time.Second + s.tolerance
+
+	switch {
+	case s.segmentID == 0:
+		s.startSegment(chunk, SEGMENT_START, recordStart, waveform.SamplingRate)
+	case waveform.SamplingRate != s.samplingRate:
+		s.startSegment(chunk, SEGMENT_RATE_CHANGE, laterOf(recordStart, nextTime), waveform.SamplingRate)
+	case waveform.Header.HasGap:
+		s.startSegment(chunk, SEGMENT_STATUS_GAP, laterOf(recordStart, nextTime), waveform.SamplingRate)
+		if recordStart.After(nextTime) {
+			chunk.GapSeconds = recordStart.Sub(nextTime).Seconds()
+		}
+	case recordStart.Sub(nextTime) > s.tolerance:
+		// r_time is truncated to whole seconds, so the record can start up
+		// to 1s after r_time; it cannot start before it
+		s.startSegment(chunk, SEGMENT_GAP, recordStart, waveform.SamplingRate)
+		chunk.GapSeconds = recordStart.Sub(nextTime).Seconds()
+	case nextTime.Sub(recordStart) > window:
+		// The record starts before the samples already received ended
+		overlap := s.overlap(raw)
+		if overlap == len(raw) {
+			return nil
+		}
+		if overlap == 0 {
+			s.startSegment(chunk, SEGMENT_CLOCK_RESET, nextTime, waveform.SamplingRate)
+		}
+		chunk.DuplicateSamples = overlap
+		raw = raw[overlap:]
+		waveform = trimmedWaveform(waveform, overlap)
+	}
+
+	chunk.SegmentID = s.segmentID
+	chunk.SegmentStart = s.segmentStart
+	chunk.SamplingRate = s.samplingRate
+	chunk.Offset = s.segmentLen
+	chunk.Samples = make([]SampleJSON, len(waveform.Samples))
+	for i, sample := range waveform.Samples {
+		sample.Index = s.segmentLen + i
+		sample.Timestamp = SampleTime(s.segmentStart, s.segmentLen+i, s.samplingRate)
+		chunk.Samples[i] = sample
+	}
+
+	s.segmentLen += len(raw)
+	s.appendTail(raw)
+	return chunk
+}
+
+// startSegment begins a new segment at start
+func (s *WaveformStitcher) startSegment(chunk *StitchedChunk, reason string, start time.Time, samplingRate int) {
+	s.segmentID++
+	s.segmentStart = start
+	s.segmentLen = 0
+	s.samplingRate = samplingRate
+	s.tail = s.tail[:0]
+
+	chunk.NewSegment = true
+	chunk.Reason = reason
+}
+
+// nextTime returns the expected time of the next sample of the current segment
+func (s *WaveformStitcher) nextTime() time.Time {
+	return SampleTime(s.segmentStart, s.segmentLen, s.samplingRate)
+}
+
+// overlap returns the number of leading samples of raw that repeat the end of
+// the samples already received
+func (s *WaveformStitcher) overlap(raw []int16) int {
+	longest := len(raw)
+	if longest > len(s.tail) {
+		longest = len(s.tail)
+	}
+	for length := longest; length > 0; length-- {
+		if equalSamples(s.tail[len(s.tail)-length:], raw[:length]) {
+			return length
+		}
+	}
+	return 0
+}
+
+// appendTail keeps the most recent samples for overlap detection
+func (s *WaveformStitcher) appendTail(raw []int16) {
+	s.tail = append(s.tail, raw...)
+	limit := s.samplingRate * STITCH_TAIL_SECONDS
+	if len(s.tail) > limit {
+		s.tail = append(s.tail[:0], s.tail[len(s.tail)-limit:]...)
+	}
+}
+
+// seen reports whether a record was received recently
+func (s *WaveformStitcher) seen(key recordKey) bool {
+	for _, recent := range s.recent {
+		if recent == key {
+			return true
+		}
+	}
+	return false
+}
+
+// remember records a received record
+func (s *WaveformStitcher) remember(key recordKey) {
+	s.recent = append(s.recent, key)
+	if len(s.recent) > STITCH_RECENT {
+		s.recent = s.recent[len(s.recent)-STITCH_RECENT:]
+	}
+}
+
+// trimmedWaveform returns a shallow copy of waveform without its first n samples
+func trimmedWaveform(waveform *WaveformJSON, n int) *WaveformJSON {
+	trimmed := *waveform
+	trimmed.Samples = waveform.Samples[n:]
+	return &trimmed
+}
+
+// equalSamples reports whether two sample slices are identical
+func equalSamples(a, b []int16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// laterOf returns the later of two times
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,101 @@
+package serial
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/harusin0516/healthcare/driver/stream"
+)
+
+// StreamWaveform sends a parsed waveform subrecord to the stream hub clients
+// subscribed to its channel (see GetWaveformChannelKey). hub is usually a
+// *stream.Hub.
+func StreamWaveform(hub stream.Publisher, header *DatexHeader, waveform *WaveformJSON) error {
+	plugID := strconv.Itoa(int(header.PlugID))
+	return hub.Publish(stream.EVENT_WAVEFORM, plugID, GetWaveformChannelKey(waveform.SubrecordType), waveform)
+}
+
+// StreamVitals sends a parsed displayed values record to the stream hub
+// clients subscribed to the VITALS channel
+func StreamVitals(hub stream.Publisher, header *DatexHeader, trend *TrendJSON) error {
+	plugID := strconv.Itoa(int(header.PlugID))
+	return hub.Publish(stream.EVENT_VITALS, plugID, stream.CHANNEL_VITALS, trend)
+}
+
+// StreamPressureEvent sends a zeroing or flush event to the stream hub clients
+// subscribed to the pressure channel
+func StreamPressureEvent(hub stream.Publisher, header *DatexHeader, event *PressureEventJSON) error {
+	plugID := strconv.Itoa(int(header.PlugID))
+	return hub.Publish(stream.EVENT_ANNOTATION, plugID, event.Channel, event)
+}
+
+// GetWaveformChannelKey returns the channel name of a waveform subrecord type
+// used for stream subscriptions, e.g. "ECG12" or "PLETH"
+func GetWaveformChannelKey(subrecordType int) string {
+	switch subrecordType {
+	case DRI_WF_ECG1:
+		return "ECG1"
+	case DRI_WF_ECG2:
+		return "ECG2"
+	case DRI_WF_ECG3:
+		return "ECG3"
+	case DRI_WF_INVP1:
+		return "INVP1"
+	case DRI_WF_INVP2:
+		return "INVP2"
+	case DRI_WF_INVP3:
+		return "INVP3"
+	case DRI_WF_INVP4:
+		return "INVP4"
+	case DRI_WF_PLETH:
+		return "PLETH"
+	case DRI_WF_CO2:
+		return "CO2"
+	case DRI_WF_O2:
+		return "O2"
+	case DRI_WF_N2O:
+		return "N2O"
+	case DRI_WF_AA:
+		return "AA"
+	case DRI_WF_AWP:
+		return "AWP"
+	case DRI_WF_FLOW:
+		return "FLOW"
+	case DRI_WF_RESP:
+		return "RESP"
+	case DRI_WF_INVP5:
+		return "INVP5"
+	case DRI_WF_INVP6:
+		return "INVP6"
+	case DRI_WF_EEG1:
+		return "EEG1"
+	case DRI_WF_EEG2:
+		return "EEG2"
+	case DRI_WF_EEG3:
+		return "EEG3"
+	case DRI_WF_EEG4:
+		return "EEG4"
+	case DRI_WF_ECG12:
+		return "ECG12"
+	case DRI_WF_VOL:
+		return "VOL"
+	case DRI_WF_TONO_PRESS:
+		return "TONO_PRESS"
+	case DRI_WF_SPI_LOOP_STATUS:
+		return "SPI_LOOP_STATUS"
+	case DRI_WF_ENT_100:
+		return "ENT_100"
+	case DRI_WF_EEG_BIS:
+		return "EEG_BIS"
+	case DRI_WF_INVP7:
+		return "INVP7"
+	case DRI_WF_INVP8:
+		return "INVP8"
+	case DRI_WF_PLETH_2:
+		return "PLETH_2"
+	case DRI_WF_RESP_100:
+		return "RESP_100"
+	default:
+		return fmt.Sprintf("WF%d", subrecordType)
+	}
+}
@@ -0,0 +1,86 @@
+package serial
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SubrecordContext is passed to a subrecord handler: the subrecord, bounded
+// by ValidateRecord, and the header of its record (r_time, plug_id, DRI
+// level, main type)
+type SubrecordContext struct {
+	Header    *DatexHeader
+	Subrecord Subrecord
+}
+
+// SubrecordHandler decodes a vendor-specific or future subrecord type that
+// the parsers would otherwise output as raw bytes. Decode returns the typed
+// output placed in the data of the subrecord in the record JSON; it must not
+// keep Subrecord.Data, which is part of the received frame.
+type SubrecordHandler struct {
+	Name   string // Type name in the record JSON (type_name)
+	Decode func(context SubrecordContext) (interface{}, error)
+}
+
+// subrecordKey identifies a subrecord type: sr_type is only unique within
+// a main type
+type subrecordKey struct {
+	mainType int16
+	srType   byte
+}
+
+var (
+	subrecordMutex    sync.RWMutex
+	subrecordHandlers = make(map[subrecordKey]SubrecordHandler)
+)
+
+// RegisterSubrecordHandler registers a handler for subrecords of type srType
+// in records of main type mainType (DRI_MT_*). The trend (physiological
+// data) and alarm parsers use it in place of their own decoding, so it can
+// also replace the decoding of a known type. Waveform subrecords are always
+// decoded as samples. It fails if a handler is already registered for the
+// type.
+func RegisterSubrecordHandler(mainType int16, srType byte, handler SubrecordHandler) error {
+	if handler.Decode == nil {
+		return fmt.Errorf("subrecord handler for main type %d, type %d has no Decode function", mainType, srType)
+	}
+	if srType == DRI_EOL_SUBR_LIST {
+		return fmt.Errorf("subrecord type %d marks the end of the subrecord list", srType)
+	}
+
+	subrecordMutex.Lock()
+	defer subrecordMutex.Unlock()
+	key := subrecordKey{mainType: mainType, srType: srType}
+	if existing, exists := subrecordHandlers[key]; exists {
+		return fmt.Errorf("subrecord handler %q is already registered for main type %d, type %d", existing.Name, mainType, srType)
+	}
+	subrecordHandlers[key] = handler
+	return nil
+}
+
+// UnregisterSubrecordHandler removes the handler of a subrecord type
+func UnregisterSubrecordHandler(mainType int16, srType byte) {
+	subrecordMutex.Lock()
+	defer subrecordMutex.Unlock()
+	delete(subrecordHandlers, subrecordKey{mainType: mainType, srType: srType})
+}
+
+// lookupSubrecordHandler returns the handler registered for a subrecord type
+func lookupSubrecordHandler(mainType int16, srType byte) (SubrecordHandler, bool) {
+	subrecordMutex.RLock()
+	defer subrecordMutex.RUnlock()
+	handler, exists := subrecordHandlers[subrecordKey{mainType: mainType, srType: srType}]
+	return handler, exists
+}
+
+// decodeSubrecord decodes a subrecord of record with a handler. A panic in
+// the handler only fails the subrecord and is reported like a parser panic.
+func decodeSubrecord(handler SubrecordHandler, record []byte, header *DatexHeader, subrecord Subrecord) (output interface{}, err error) {
+	defer func() { recoverFrame(recover(), "subrecord", record, &err) }()
+
+	output, err = handler.Decode(SubrecordContext{Header: header, Subrecord: subrecord})
+	if err != nil {
+		return nil, fmt.Errorf("%s subrecord %d: %w", handler.Name, subrecord.Index, err)
+	}
+	return output, nil
+}
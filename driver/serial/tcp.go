@@ -0,0 +1,94 @@
+package serial
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/transport"
+)
+
+// TCP connection defaults
+const (
+	TCP_DEFAULT_TIMEOUT   = 10 // Seconds to connect to the gateway
+	TCP_DEFAULT_KEEPALIVE = 15 // Seconds between TCP keepalive probes
+)
+
+// TCPConfig configures the connection to a gateway that forwards the DRI
+// stream of a monitor over TCP instead of RS-232
+type TCPConfig struct {
+	Address   string           `json:"address"`   // host:port of the gateway
+	Timeout   int              `json:"timeout"`   // Seconds to connect (0: 10)
+	KeepAlive int              `json:"keepalive"` // Seconds between TCP keepalive probes (0: 15, negative: off)
+	Transport transport.Config `json:"transport"` // TLS and proxy
+}
+
+// TCPTransport is the connection to a monitor through a network gateway.
+// The records are framed as on the serial line. The connection is dialed
+// again with exponential backoff when it fails or the gateway closes it,
+// and dead connections are detected with TCP keepalive.
+type TCPTransport struct {
+	*SerialTransport
+	config TCPConfig
+}
+
+// DialTCPTransport connects to the gateway of config
+func DialTCPTransport(config TCPConfig) (*TCPTransport, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	if err := config.Transport.Validate(); err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = TCP_DEFAULT_TIMEOUT
+	}
+	dialer, err := config.Transport.NewDialer(time.Duration(timeout) * time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TCPTransport{config: config}
+	t.SerialTransport = newTransport(config.Address, func() (io.ReadWriteCloser, error) {
+		conn, err := dialer.Dial(config.Address)
+		if err != nil {
+			return nil, err
+		}
+		t.setKeepAlive(conn)
+		return conn, nil
+	})
+	conn, err := t.open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", config.Address, err)
+	}
+	t.port = conn
+	t.frames = NewFrameReader(conn)
+	return t, nil
+}
+
+// Address returns host:port of the gateway
+func (t *TCPTransport) Address() string {
+	return t.config.Address
+}
+
+// setKeepAlive enables TCP keepalive on a connection, below TLS if it is used
+func (t *TCPTransport) setKeepAlive(conn net.Conn) {
+	if t.config.KeepAlive < 0 {
+		return
+	}
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	period := t.config.KeepAlive
+	if period == 0 {
+		period = TCP_DEFAULT_KEEPALIVE
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(time.Duration(period) * time.Second)
+}
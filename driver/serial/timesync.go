@@ -0,0 +1,69 @@
+package serial
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TimeSync holds the offset between a monitor's clock and the reference clock.
+// DRI records are stamped by the monitor (r_time); adding the offset converts
+// them to reference time. The zero offset trusts the monitor clock.
+type TimeSync struct {
+	mutex  sync.RWMutex
+	offset time.Duration
+}
+
+// NewTimeSync creates a TimeSync with the given monitor clock offset
+func NewTimeSync(offset time.Duration) *TimeSync {
+	return &TimeSync{offset: offset}
+}
+
+// SetOffset sets the correction added to monitor time
+func (t *TimeSync) SetOffset(offset time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.offset = offset
+}
+
+// Offset returns the correction added to monitor time
+func (t *TimeSync) Offset() time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.offset
+}
+
+// MarshalText encodes the offset as a duration (e.g. "-1.5s")
+func (t *TimeSync) MarshalText() ([]byte, error) {
+	return []byte(t.Offset().String()), nil
+}
+
+// UnmarshalText sets the offset from a duration (e.g. "-1.5s"), so that a
+// known clock skew of a monitor can be corrected from configuration
+func (t *TimeSync) UnmarshalText(text []byte) error {
+	offset, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid clock offset %q: %v", text, err)
+	}
+	t.SetOffset(offset)
+	return nil
+}
+
+// RecordTime converts a record r_time (seconds since 1.1.1970, monitor clock)
+// to reference time
+func (t *TimeSync) RecordTime(rTime uint32) time.Time {
+	return time.Unix(int64(rTime), 0).UTC().Add(t.Offset())
+}
+
+// SampleTime returns the acquisition time of sample index of a waveform
+// subrecord sampled at samplingRate, relative to the record start time
+func SampleTime(recordTime time.Time, index, samplingRate int) time.Time {
+	if samplingRate <= 0 {
+		return recordTime
+	}
+	// Multiply before dividing so rates that do not divide 1s stay exact
+	return recordTime.Add(time.Duration(index) * time.Second / time.Duration(samplingRate))
+}
@@ -0,0 +1,357 @@
+package serial
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+)
+
+// Reconnection delays: the first reopen waits RECONNECT_INITIAL_DELAY, each
+// failed attempt doubles the delay up to RECONNECT_MAX_DELAY
+const (
+	RECONNECT_INITIAL_DELAY = time.Second
+	RECONNECT_MAX_DELAY     = 30 * time.Second
+)
+
+// Connection states of a SerialTransport
+const (
+	CONNECTION_CONNECTED    = "connected"
+	CONNECTION_DISCONNECTED = "disconnected" // Data of the monitor is stale until it is connected again
+)
+
+// ConnectionEventJSON reports a change of the connection state of a transport
+type ConnectionEventJSON struct {
+	Source     string    `json:"source"`          // Name of the transport
+	State      string    `json:"state"`           // connected or disconnected
+	Time       time.Time `json:"time"`            // When the state changed
+	Error      string    `json:"error,omitempty"` // Why the connection was lost
+	Reconnects int       `json:"reconnects"`      // Times the connection was opened again
+}
+
+// ConnectionSink receives the connection events of a transport
+type ConnectionSink interface {
+	HandleConnectionEvent(event *ConnectionEventJSON) error
+}
+
+// ConnectionSinkFunc adapts a function to a ConnectionSink
+type ConnectionSinkFunc func(event *ConnectionEventJSON) error
+
+// HandleConnectionEvent calls f(event)
+func (f ConnectionSinkFunc) HandleConnectionEvent(event *ConnectionEventJSON) error {
+	return f(event)
+}
+
+// Transport is a connection to a monitor, over a serial port
+// (*SerialTransport) or the network (*TCPTransport). Parsers and the
+// Manager work the same over both.
+type Transport interface {
+	Name() string
+	ReadRecords(ctx context.Context, handle func(record []byte) error) error
+	Send(record []byte) error
+	Subscribe(request []byte) error
+	Stats() FrameStats
+	Connected() bool
+	Reconnects() int
+	AddSink(sink ConnectionSink)
+	Close() error
+}
+
+// SerialTransport is the connection to one monitor: the records read from
+// its serial port and the requests written to it. The port can be any byte
+// stream framed as on the serial line, such as a serial-over-TCP connection.
+// A transport that knows how to open its port reopens it when reading
+// fails or ends (I/O error, unplugged adapter), with exponential backoff,
+// and sends the subscribed requests again.
+type SerialTransport struct {
+	name          string
+	open          func() (io.ReadWriteCloser, error) // nil: the port cannot be reopened
+	mutex         sync.Mutex
+	writeMutex    sync.Mutex
+	port          io.ReadWriteCloser // nil while disconnected
+	frames        *FrameReader
+	stats         FrameStats // Frames of the previous connections
+	subscriptions [][]byte
+	sinks         []ConnectionSink
+	reconnects    int
+	initialDelay  time.Duration
+	maxDelay      time.Duration
+	clock         clock.Clock
+	closed        bool
+}
+
+// NewSerialTransport creates the transport of a monitor connected on port.
+// name identifies the connection, e.g. the device path of the port. The
+// port is not reopened when it ends.
+func NewSerialTransport(name string, port io.ReadWriteCloser) *SerialTransport {
+	t := newTransport(name, nil)
+	t.port = port
+	t.frames = NewFrameReader(port)
+	return t
+}
+
+// OpenSerialTransport opens a serial port device such as /dev/ttyUSB0. The
+// line settings of the monitor (19200 baud, 8 data bits, even parity, 1
+// stop bit, RTS/CTS) must be set beforehand, e.g. with stty. The device is
+// reopened when it fails or is unplugged.
+func OpenSerialTransport(device string) (*SerialTransport, error) {
+	t := newTransport(device, func() (io.ReadWriteCloser, error) {
+		return os.OpenFile(device, os.O_RDWR, 0)
+	})
+	port, err := t.open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open serial port: %v", err)
+	}
+	t.port = port
+	t.frames = NewFrameReader(port)
+	return t, nil
+}
+
+// newTransport creates a disconnected transport
+func newTransport(name string, open func() (io.ReadWriteCloser, error)) *SerialTransport {
+	return &SerialTransport{
+		name:         name,
+		open:         open,
+		initialDelay: RECONNECT_INITIAL_DELAY,
+		maxDelay:     RECONNECT_MAX_DELAY,
+		clock:        clock.Real,
+	}
+}
+
+// Name returns the name of the connection
+func (t *SerialTransport) Name() string {
+	return t.name
+}
+
+// SetReconnectDelays sets the delay before the first reopen and the
+// largest delay between attempts (0: the defaults)
+func (t *SerialTransport) SetReconnectDelays(initial, max time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if initial <= 0 {
+		initial = RECONNECT_INITIAL_DELAY
+	}
+	if max < initial {
+		max = RECONNECT_MAX_DELAY
+	}
+	t.initialDelay, t.maxDelay = initial, max
+}
+
+// SetClock sets the clock of the reconnection delays and event times (tests use a simulated clock)
+func (t *SerialTransport) SetClock(c clock.Clock) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clock = clock.OrReal(c)
+}
+
+// AddSink registers a sink for the connection events. Sinks are called in
+// order on the reading goroutine and must not block.
+func (t *SerialTransport) AddSink(sink ConnectionSink) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sinks = append(t.sinks, sink)
+}
+
+// Connected reports whether the port is open
+func (t *SerialTransport) Connected() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.port != nil
+}
+
+// Reconnects returns the number of times the port was opened again
+func (t *SerialTransport) Reconnects() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.reconnects
+}
+
+// ReadRecords calls handle with every record received until the port ends,
+// handle fails or ctx is done (see FrameReader.ReadRecords). A port that can
+// be reopened does not end: reading continues once it is open again, and
+// ReadRecords only returns when ctx is done, the transport is closed or
+// handle fails.
+func (t *SerialTransport) ReadRecords(ctx context.Context, handle func(record []byte) error) error {
+	for {
+		frames, err := t.connection(ctx)
+		if err != nil {
+			return err
+		}
+		var handleErr error
+		err = frames.ReadRecords(ctx, func(record []byte) error {
+			handleErr = handle(record)
+			return handleErr
+		})
+		switch {
+		case handleErr != nil:
+			return handleErr
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case t.isClosed():
+			return nil
+		case t.open == nil:
+			return err
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		t.disconnect(err)
+	}
+}
+
+// Send frames a record (e.g. a transmission request) and writes it to the monitor
+func (t *SerialTransport) Send(record []byte) error {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	t.mutex.Lock()
+	port := t.port
+	t.mutex.Unlock()
+	if port == nil {
+		return fmt.Errorf("%s: not connected", t.name)
+	}
+	if _, err := port.Write(Frame(record)); err != nil {
+		return fmt.Errorf("%s: failed to send record: %v", t.name, err)
+	}
+	return nil
+}
+
+// Subscribe sends a transmission request (e.g. for displayed values or
+// waveforms) and sends it again whenever the port is reopened. While the
+// port is disconnected the request is only remembered.
+func (t *SerialTransport) Subscribe(request []byte) error {
+	t.mutex.Lock()
+	t.subscriptions = append(t.subscriptions, append([]byte(nil), request...))
+	connected := t.port != nil
+	t.mutex.Unlock()
+	if !connected {
+		return nil
+	}
+	return t.Send(request)
+}
+
+// Stats returns the frame counters of the port over all its connections
+func (t *SerialTransport) Stats() FrameStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.frames == nil {
+		return t.stats
+	}
+	return t.stats.add(t.frames.Stats())
+}
+
+// Close closes the port, which ends a blocked ReadRecords, and stops reopening it
+func (t *SerialTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	if t.port == nil {
+		return nil
+	}
+	return t.port.Close()
+}
+
+// isClosed reports whether Close was called
+func (t *SerialTransport) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
+
+// connection returns the frame reader of the open port, reopening the port
+// with exponential backoff while it is disconnected
+func (t *SerialTransport) connection(ctx context.Context) (*FrameReader, error) {
+	t.mutex.Lock()
+	frames, wait, delay := t.frames, t.clock, t.initialDelay
+	t.mutex.Unlock()
+	if frames != nil {
+		return frames, nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait.After(delay):
+		}
+		port, err := t.open()
+		if err == nil {
+			return t.connect(port)
+		}
+		t.mutex.Lock()
+		if delay *= 2; delay > t.maxDelay {
+			delay = t.maxDelay
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// connect makes a reopened port the current one, sends the subscriptions
+// again and reports the connection
+func (t *SerialTransport) connect(port io.ReadWriteCloser) (*FrameReader, error) {
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		port.Close()
+		return nil, fmt.Errorf("%s: transport is closed", t.name)
+	}
+	t.port = port
+	t.frames = NewFrameReader(port)
+	t.reconnects++
+	frames := t.frames
+	subscriptions := t.subscriptions
+	event := t.event(CONNECTION_CONNECTED, nil)
+	t.mutex.Unlock()
+
+	for _, request := range subscriptions {
+		// A failed request surfaces as a read error and another reconnection
+		t.Send(request)
+	}
+	t.notify(event)
+	return frames, nil
+}
+
+// disconnect closes a failed port and reports the loss of the connection
+func (t *SerialTransport) disconnect(cause error) {
+	t.mutex.Lock()
+	if t.port != nil {
+		t.port.Close()
+	}
+	t.stats = t.stats.add(t.frames.Stats())
+	t.port, t.frames = nil, nil
+	event := t.event(CONNECTION_DISCONNECTED, cause)
+	t.mutex.Unlock()
+	t.notify(event)
+}
+
+// add returns the sum of two frame counters
+func (s FrameStats) add(other FrameStats) FrameStats {
+	return FrameStats{
+		Frames:           s.Frames + other.Frames,
+		ChecksumFailures: s.ChecksumFailures + other.ChecksumFailures,
+		InvalidFrames:    s.InvalidFrames + other.InvalidFrames,
+		DiscardedBytes:   s.DiscardedBytes + other.DiscardedBytes,
+	}
+}
+
+// event creates a connection event; the mutex must be held
+func (t *SerialTransport) event(state string, cause error) *ConnectionEventJSON {
+	event := &ConnectionEventJSON{Source: t.name, State: state, Time: t.clock.Now(), Reconnects: t.reconnects}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+	return event
+}
+
+// notify calls the sinks with an event; failing sinks do not stop the others
+func (t *SerialTransport) notify(event *ConnectionEventJSON) {
+	t.mutex.Lock()
+	sinks := t.sinks
+	t.mutex.Unlock()
+	for _, sink := range sinks {
+		sink.HandleConnectionEvent(event)
+	}
+}
@@ -158,7 +158,7 @@ type DatexHeader struct {
 
 // Size returns the size of DatexHeader in bytes
 func (h *DatexHeader) Size() int {
-	return 2 + 1 + 1 + 2 + 4 + 1 + 1 + 2 + 2 + 8*3 // 32 bytes total (updated for new SrDesc size)
+	return 2 + 1 + 1 + 2 + 4 + 1 + 1 + 2 + 2 + 8*3 // 40 bytes total
 }
 
 // MarshalBinary converts the header to binary format
@@ -396,6 +396,15 @@ func (h *DatexHeader) ZeroReservedFields() {
 
 // DRI Waveform Subrecord Types
 const (
+	DRI_WF_CMD           = 0  // Waveform control command
+	DRI_WF_ECG1          = 1  // ECG channel 1
+	DRI_WF_ECG2          = 2  // ECG channel 2
+	DRI_WF_ECG3          = 3  // ECG channel 3
+	DRI_WF_INVP1         = 4  // Invasive Pressure channel 1
+	DRI_WF_INVP2         = 5  // Invasive Pressure channel 2
+	DRI_WF_INVP3         = 6  // Invasive Pressure channel 3
+	DRI_WF_INVP4         = 7  // Invasive Pressure channel 4
+	DRI_WF_PLETH         = 8  // Plethysmograph
 	DRI_WF_CO2           = 9  // CO2 Interface level 3
 	DRI_WF_O2            = 10 // O2 Interface level 3
 	DRI_WF_N2O           = 11 // N2O Interface level 3
@@ -535,7 +544,7 @@ func (w *WaveformData) UnmarshalBinary(data []byte) error {
 	
 	// Parse samples
 	sampleCount := int(w.Header.ActLen)
-	if len(data) < w.Header.Size()+sampleCount*2 {
+	if sampleCount < 0 || len(data) < w.Header.Size()+sampleCount*2 {
 		return ErrInvalidDataLength
 	}
 	
@@ -554,6 +563,102 @@ func IsControlCode(sample int16) bool {
 	return sample <= -32000
 }
 
+// Control codes sent instead of measurement data
+const (
+	DATA_INVALID_LIMIT  = -32001 // Values at or below are invalid data
+	DATA_INVALID        = -32767 // There is no valid data
+	DATA_NOT_UPDATED    = -32766 // Value is not updated
+	DATA_DISCONT        = -32765 // Discontinuity in data
+	DATA_UNDER_RANGE    = -32764 // Value is under the measurement range
+	DATA_OVER_RANGE     = -32763 // Value is over the measurement range
+	DATA_NOT_CALIBRATED = -32762 // Value is not calibrated
+)
+
+// SampleCondition tells why a sample is not a measurement
+type SampleCondition int
+
+// Sample conditions
+const (
+	SAMPLE_VALID          SampleCondition = iota // Measurement data
+	SAMPLE_INVALID                               // DATA_INVALID
+	SAMPLE_NOT_UPDATED                           // DATA_NOT_UPDATED
+	SAMPLE_DISCONTINUITY                         // DATA_DISCONT
+	SAMPLE_UNDER_RANGE                           // DATA_UNDER_RANGE
+	SAMPLE_OVER_RANGE                            // DATA_OVER_RANGE
+	SAMPLE_NOT_CALIBRATED                        // DATA_NOT_CALIBRATED
+	SAMPLE_LEAD_OFF                              // Control code of an ECG channel flagged WF_STATUS_LEAD_OFF
+	SAMPLE_UNKNOWN_CODE                          // Other control code
+)
+
+var sampleConditionNames = map[SampleCondition]string{
+	SAMPLE_VALID:          "valid",
+	SAMPLE_INVALID:        "invalid",
+	SAMPLE_NOT_UPDATED:    "not_updated",
+	SAMPLE_DISCONTINUITY:  "discontinuity",
+	SAMPLE_UNDER_RANGE:    "under_range",
+	SAMPLE_OVER_RANGE:     "over_range",
+	SAMPLE_NOT_CALIBRATED: "not_calibrated",
+	SAMPLE_LEAD_OFF:       "lead_off",
+	SAMPLE_UNKNOWN_CODE:   "unknown_code",
+}
+
+// String returns the name of the condition
+func (c SampleCondition) String() string {
+	if name, ok := sampleConditionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("SampleCondition(%d)", int(c))
+}
+
+// MarshalText encodes the condition by name in JSON
+func (c SampleCondition) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// ClassifySample returns the meaning of a sample value
+func ClassifySample(sample int16) SampleCondition {
+	if !IsControlCode(sample) {
+		return SAMPLE_VALID
+	}
+	switch sample {
+	case DATA_INVALID:
+		return SAMPLE_INVALID
+	case DATA_NOT_UPDATED:
+		return SAMPLE_NOT_UPDATED
+	case DATA_DISCONT:
+		return SAMPLE_DISCONTINUITY
+	case DATA_UNDER_RANGE:
+		return SAMPLE_UNDER_RANGE
+	case DATA_OVER_RANGE:
+		return SAMPLE_OVER_RANGE
+	case DATA_NOT_CALIBRATED:
+		return SAMPLE_NOT_CALIBRATED
+	default:
+		return SAMPLE_UNKNOWN_CODE
+	}
+}
+
+// ClassifyWaveformSample returns the meaning of a sample of a waveform
+// subrecord. The control codes of a channel whose leads are off are
+// reported as SAMPLE_LEAD_OFF rather than by their value.
+func ClassifyWaveformSample(sample int16, header *WaveformHeader) SampleCondition {
+	condition := ClassifySample(sample)
+	if condition != SAMPLE_VALID && header != nil && header.HasLeadOff() {
+		return SAMPLE_LEAD_OFF
+	}
+	return condition
+}
+
+// IsPressureWaveform returns true if the subrecord type is an invasive pressure channel
+func IsPressureWaveform(subrecordType int) bool {
+	switch subrecordType {
+	case DRI_WF_INVP1, DRI_WF_INVP2, DRI_WF_INVP3, DRI_WF_INVP4, DRI_WF_INVP5, DRI_WF_INVP6, DRI_WF_INVP7, DRI_WF_INVP8:
+		return true
+	default:
+		return false
+	}
+}
+
 // ConvertSampleToPhysicalValue converts sample value to physical value based on subrecord type
 func ConvertSampleToPhysicalValue(sample int16, subrecordType int) float64 {
 	if IsControlCode(sample) {
@@ -563,7 +668,7 @@ func ConvertSampleToPhysicalValue(sample int16, subrecordType int) float64 {
 	switch subrecordType {
 	case DRI_WF_ECG12:
 		return float64(sample) // μV
-	case DRI_WF_INVP5, DRI_WF_INVP6, DRI_WF_INVP7, DRI_WF_INVP8:
+	case DRI_WF_INVP1, DRI_WF_INVP2, DRI_WF_INVP3, DRI_WF_INVP4, DRI_WF_INVP5, DRI_WF_INVP6, DRI_WF_INVP7, DRI_WF_INVP8:
 		return float64(sample) / 100.0 // mmHg
 	case DRI_WF_PLETH, DRI_WF_PLETH_2:
 		return float64(sample) / 100.0 // %
@@ -579,7 +684,7 @@ func GetSamplingRate(subrecordType int) int {
 	switch subrecordType {
 	case DRI_WF_ECG12:
 		return SAMPLE_RATE_ECG12
-	case DRI_WF_INVP5, DRI_WF_INVP6, DRI_WF_INVP7, DRI_WF_INVP8:
+	case DRI_WF_INVP1, DRI_WF_INVP2, DRI_WF_INVP3, DRI_WF_INVP4, DRI_WF_INVP5, DRI_WF_INVP6, DRI_WF_INVP7, DRI_WF_INVP8:
 		return SAMPLE_RATE_INVP
 	case DRI_WF_PLETH, DRI_WF_PLETH_2:
 		return SAMPLE_RATE_PLETH
@@ -593,6 +698,9 @@ func GetSamplingRate(subrecordType int) int {
 // Error definitions
 var (
 	ErrInvalidDataLength = &DRIError{Message: "invalid data length"}
+	ErrChecksumMismatch  = &DRIError{Message: "checksum mismatch"}
+	ErrInvalidFrame      = &DRIError{Message: "invalid frame"}
+	ErrInvalidRecord     = &DRIError{Message: "invalid record"}
 )
 
 // DRIError represents DRI-specific errors
@@ -625,6 +733,7 @@ type PhysiologicalDatabaseRecord struct {
 	Marker         byte                          // Contains the number of the latest entered mark
 	Reserved       byte                          // Reserved for future use
 	ClDriLvlSubt   uint16                       // See Table 3-5 Usage of cl_drilvl_subt
+	SubrecordType  byte                          // Subrecord type of the record header (DRI_PH_*), not part of the structure
 }
 
 // Physiological Data Union Structure
@@ -657,40 +766,47 @@ func (p *PhysiologicalDatabaseRecord) Size() int {
 	return baseSize
 }
 
-// UnmarshalBinary converts binary data to physiological database record
+// UnmarshalBinary converts binary data to physiological database record.
+// The class of the physdata union is taken from cl_drilvl_subt, which
+// follows the union, and the union is decoded with the fixed size of that
+// class. Bytes after cl_drilvl_subt (padding of the subrecord) are ignored.
 func (p *PhysiologicalDatabaseRecord) UnmarshalBinary(data []byte) error {
-	if len(data) < 8 {
+	if len(data) < 4+PH_DATA_CLASS_SIZE+4 {
 		return ErrInvalidDataLength
 	}
 
-	offset := 0
-
 	// time: Contains the time stamp of the record in Unix time
-	p.Time = binary.LittleEndian.Uint32(data[offset:])
-	offset += 4
+	p.Time = binary.LittleEndian.Uint32(data[0:4])
 
-	// physdata: Union of physiological data structures
-	// Note: This would need to be determined based on the cl_drilvl_subt field or other context
-	// For now, we'll assume Basic class as default
-	p.PhysData.Basic = &BasicPhysiologicalData{}
-	if err := p.PhysData.Basic.UnmarshalBinary(data[offset:]); err != nil {
-		return err
-	}
-	offset += p.PhysData.Basic.Size()
+	// The fields after the union are at the fixed size of the union
+	trailer := 4 + PH_DATA_CLASS_SIZE
 
 	// marker: Contains the number of the latest entered mark
-	p.Marker = data[offset]
-	offset += 1
+	p.Marker = data[trailer]
 
 	// reserved: Reserved for future use
-	p.Reserved = data[offset]
-	offset += 1
+	p.Reserved = data[trailer+1]
 
 	// cl_drilvl_subt: See Table 3-5 Usage of cl_drilvl_subt
-	p.ClDriLvlSubt = binary.LittleEndian.Uint16(data[offset:])
-	offset += 2
+	p.ClDriLvlSubt = binary.LittleEndian.Uint16(data[trailer+2:])
 
-	return nil
+	// physdata: Union of physiological data structures
+	physData := data[4:trailer]
+	p.PhysData = PhysiologicalDataUnion{}
+	switch GetDataClassFromClDriLvlSubt(p.ClDriLvlSubt) {
+	case DRI_PHDBCL_EXT1:
+		p.PhysData.Ext1 = &Extended1PhysiologicalData{}
+		return p.PhysData.Ext1.UnmarshalBinary(physData)
+	case DRI_PHDBCL_EXT2:
+		p.PhysData.Ext2 = &Extended2PhysiologicalData{}
+		return p.PhysData.Ext2.UnmarshalBinary(physData)
+	case DRI_PHDBCL_EXT3:
+		p.PhysData.Ext3 = &Extended3PhysiologicalData{}
+		return p.PhysData.Ext3.UnmarshalBinary(physData)
+	default:
+		p.PhysData.Basic = &BasicPhysiologicalData{}
+		return p.PhysData.Basic.UnmarshalBinary(physData)
+	}
 }
 
 // IsValid returns true if this physiological database record is valid
@@ -788,41 +904,7 @@ func (p *PhysiologicalDatabaseRecord) SetTimestamp(t time.Time) {
 
 // ToJSON converts the physiological database record to JSON format
 func (p *PhysiologicalDatabaseRecord) ToJSON() map[string]interface{} {
-	result := map[string]interface{}{
-		"timestamp":        p.GetTimestamp().Format(time.RFC3339),
-		"unix_timestamp":   p.Time,
-		"marker":           p.Marker,
-		"reserved":         p.Reserved,
-		"cl_drilvl_subt":   p.ClDriLvlSubt,
-		"data_class":       p.GetDataClass(),
-		"data_class_name":  GetDataClassName(p.GetDataClass()),
-		"is_valid":         p.IsValid(),
-	}
-
-	// Add physiological data based on the union content
-	if p.PhysData.Basic != nil {
-		result["physiological_data"] = map[string]interface{}{
-			"type": "basic",
-			"data": p.PhysData.Basic.Data,
-		}
-	} else if p.PhysData.Ext1 != nil {
-		result["physiological_data"] = map[string]interface{}{
-			"type": "extended1",
-			"data": p.PhysData.Ext1.Data,
-		}
-	} else if p.PhysData.Ext2 != nil {
-		result["physiological_data"] = map[string]interface{}{
-			"type": "extended2",
-			"data": p.PhysData.Ext2.Data,
-		}
-	} else if p.PhysData.Ext3 != nil {
-		result["physiological_data"] = map[string]interface{}{
-			"type": "extended3",
-			"data": p.PhysData.Ext3.Data,
-		}
-	}
-
-	return result
+	return p.ToStruct().toMap()
 }
 
 // Basic Physiological Data Structure
@@ -839,23 +921,22 @@ type BasicPhysiologicalData struct {
 
 // Size returns the size of BasicPhysiologicalData in bytes
 func (b *BasicPhysiologicalData) Size() int {
-	return len(b.Data)
+	return PH_DATA_CLASS_SIZE
 }
 
 // UnmarshalBinary converts binary data to basic physiological data
 func (b *BasicPhysiologicalData) UnmarshalBinary(data []byte) error {
-	b.Data = make([]byte, len(data))
+	if len(data) < b.Size() {
+		return ErrInvalidDataLength
+	}
+	b.Data = make([]byte, b.Size())
 	copy(b.Data, data)
 	return nil
 }
 
 // ToJSON converts the basic physiological data to JSON format
 func (b *BasicPhysiologicalData) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"type": "basic",
-		"data": b.Data,
-		"size": len(b.Data),
-	}
+	return b.ToStruct().toMap()
 }
 
 // Extended 1 Physiological Data Structure
@@ -872,23 +953,22 @@ type Extended1PhysiologicalData struct {
 
 // Size returns the size of Extended1PhysiologicalData in bytes
 func (e *Extended1PhysiologicalData) Size() int {
-	return len(e.Data)
+	return PH_DATA_CLASS_SIZE
 }
 
 // UnmarshalBinary converts binary data to extended 1 physiological data
 func (e *Extended1PhysiologicalData) UnmarshalBinary(data []byte) error {
-	e.Data = make([]byte, len(data))
+	if len(data) < e.Size() {
+		return ErrInvalidDataLength
+	}
+	e.Data = make([]byte, e.Size())
 	copy(e.Data, data)
 	return nil
 }
 
 // ToJSON converts the extended 1 physiological data to JSON format
 func (e *Extended1PhysiologicalData) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"type": "extended1",
-		"data": e.Data,
-		"size": len(e.Data),
-	}
+	return e.ToStruct().toMap()
 }
 
 // Extended 2 Physiological Data Structure
@@ -905,23 +985,22 @@ type Extended2PhysiologicalData struct {
 
 // Size returns the size of Extended2PhysiologicalData in bytes
 func (e *Extended2PhysiologicalData) Size() int {
-	return len(e.Data)
+	return PH_DATA_CLASS_SIZE
 }
 
 // UnmarshalBinary converts binary data to extended 2 physiological data
 func (e *Extended2PhysiologicalData) UnmarshalBinary(data []byte) error {
-	e.Data = make([]byte, len(data))
+	if len(data) < e.Size() {
+		return ErrInvalidDataLength
+	}
+	e.Data = make([]byte, e.Size())
 	copy(e.Data, data)
 	return nil
 }
 
 // ToJSON converts the extended 2 physiological data to JSON format
 func (e *Extended2PhysiologicalData) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"type": "extended2",
-		"data": e.Data,
-		"size": len(e.Data),
-	}
+	return e.ToStruct().toMap()
 }
 
 // Extended 3 Physiological Data Structure
@@ -938,23 +1017,22 @@ type Extended3PhysiologicalData struct {
 
 // Size returns the size of Extended3PhysiologicalData in bytes
 func (e *Extended3PhysiologicalData) Size() int {
-	return len(e.Data)
+	return PH_DATA_CLASS_SIZE
 }
 
 // UnmarshalBinary converts binary data to extended 3 physiological data
 func (e *Extended3PhysiologicalData) UnmarshalBinary(data []byte) error {
-	e.Data = make([]byte, len(data))
+	if len(data) < e.Size() {
+		return ErrInvalidDataLength
+	}
+	e.Data = make([]byte, e.Size())
 	copy(e.Data, data)
 	return nil
 }
 
 // ToJSON converts the extended 3 physiological data to JSON format
 func (e *Extended3PhysiologicalData) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"type": "extended3",
-		"data": e.Data,
-		"size": len(e.Data),
-	}
+	return e.ToStruct().toMap()
 }
 
 // Physiological Data Subrecord Classes
@@ -975,6 +1053,10 @@ const (
 	PH_DATA_CLASS_EXT3  = 3 // More gas measurement data, gas exchange data, more spirometry parameters, tonometry, invasive pressure data, delta pressure, CPP and PiCCO data
 )
 
+// PH_DATA_CLASS_SIZE is the size of the physdata union: every class
+// (basic_phdb, ext1_phdb, ext2_phdb, ext3_phdb) is 270 bytes
+const PH_DATA_CLASS_SIZE = 270
+
 // Physiological Data Class Bit Masks
 // Table 3-3 Bit description for the phdb_class_bf
 const (
@@ -1217,6 +1299,11 @@ func (a *AuxiliaryPhysiologicalInfo) IsValid() bool {
 	return a.NibpTime > 0 || a.CoTime > 0 || a.PcwpTime > 0
 }
 
+// ToJSON converts the auxiliary physiological information to JSON format
+func (a *AuxiliaryPhysiologicalInfo) ToJSON() map[string]interface{} {
+	return a.ToStruct().toMap()
+}
+
 // GetDataClassName returns the human-readable name for the data class
 func GetDataClassName(dataClass int) string {
 	switch dataClass {
@@ -1276,7 +1363,7 @@ func GetDataClassFromClDriLvlSubt(clDriLvlSubt uint16) int {
 // SetDataClassInClDriLvlSubt sets the data class in cl_drilvl_subt field
 func SetDataClassInClDriLvlSubt(clDriLvlSubt uint16, dataClass int) uint16 {
 	// Clear the class bits (bits 8-11)
-	clDriLvlSubt &= ^CL_DRILVL_SUBT_CLASS_MASK
+	clDriLvlSubt &^= CL_DRILVL_SUBT_CLASS_MASK
 	// Set the new class bits
 	clDriLvlSubt |= uint16(dataClass) << 8
 	return clDriLvlSubt
@@ -1327,10 +1414,7 @@ func (h *GroupHeader) UnmarshalBinary(data []byte) error {
 
 // ToJSON converts the GroupHeader to JSON format
 func (h *GroupHeader) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"status": h.Status,
-		"label":  h.Label,
-	}
+	return h.ToStruct().toMap()
 }
 
 // O2 Group Structure
@@ -1384,19 +1468,7 @@ func (o *O2Group) GetInspiratoryConcentration() float64 {
 
 // ToJSON converts the O2Group to JSON format
 func (o *O2Group) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"header": o.Header.ToJSON(),
-		"et": map[string]interface{}{
-			"raw_value": o.Et,
-			"percent":   o.GetExpiratoryConcentration(),
-			"unit":      "%",
-		},
-		"fi": map[string]interface{}{
-			"raw_value": o.Fi,
-			"percent":   o.GetInspiratoryConcentration(),
-			"unit":      "%",
-		},
-	}
+	return o.ToStruct().toMap()
 }
 
 // N2O Group Structure
@@ -1460,24 +1532,7 @@ func (n *N2OGroup) IsMeasurementOff() bool {
 
 // ToJSON converts the N2OGroup to JSON format
 func (n *N2OGroup) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"header": map[string]interface{}{
-			"status": n.Header.Status,
-			"label":  n.Header.Label,
-			"is_calibrating": n.IsCalibrating(),
-			"is_measurement_off": n.IsMeasurementOff(),
-		},
-		"et": map[string]interface{}{
-			"raw_value": n.Et,
-			"percent":   n.GetExpiratoryConcentration(),
-			"unit":      "%",
-		},
-		"fi": map[string]interface{}{
-			"raw_value": n.Fi,
-			"percent":   n.GetInspiratoryConcentration(),
-			"unit":      "%",
-		},
-	}
+	return n.ToStruct().toMap()
 }
 
 // Anesthesia Agent Label Constants
@@ -1584,30 +1639,7 @@ func (a *AnesthesiaAgentGroup) IsMeasurementOff() bool {
 
 // ToJSON converts the AnesthesiaAgentGroup to JSON format
 func (a *AnesthesiaAgentGroup) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"header": map[string]interface{}{
-			"status": a.Header.Status,
-			"label":  a.Header.Label,
-			"agent_label": a.GetAgentLabel(),
-			"is_calibrating": a.IsCalibrating(),
-			"is_measurement_off": a.IsMeasurementOff(),
-		},
-		"et": map[string]interface{}{
-			"raw_value": a.Et,
-			"percent":   a.GetExpiratoryConcentration(),
-			"unit":      "%",
-		},
-		"fi": map[string]interface{}{
-			"raw_value": a.Fi,
-			"percent":   a.GetInspiratoryConcentration(),
-			"unit":      "%",
-		},
-		"mac_sum": map[string]interface{}{
-			"raw_value": a.MacSum,
-			"value":     a.GetMacSum(),
-			"unit":      "MAC",
-		},
-	}
+	return a.ToStruct().toMap()
 }
 
 // TV Base Constants
@@ -1776,64 +1808,7 @@ func (f *FlowVolumeGroup) IsMeasurementOff() bool {
 
 // ToJSON converts the FlowVolumeGroup to JSON format
 func (f *FlowVolumeGroup) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"header": map[string]interface{}{
-			"status": f.Header.Status,
-			"label":  f.Header.Label,
-			"tv_base": map[string]interface{}{
-				"value": f.GetTvBase(),
-				"description": f.GetTvBaseDescription(),
-			},
-			"status_bits": map[string]interface{}{
-				"disconnection": f.IsDisconnection(),
-				"calibrating": f.IsCalibrating(),
-				"zeroing": f.IsZeroing(),
-				"obstruction": f.IsObstruction(),
-				"leak": f.IsLeak(),
-				"measurement_off": f.IsMeasurementOff(),
-			},
-		},
-		"rr": map[string]interface{}{
-			"raw_value": f.Rr,
-			"value":     f.GetRespirationRate(),
-			"unit":      "breaths/min",
-		},
-		"ppeak": map[string]interface{}{
-			"raw_value": f.Ppeak,
-			"value":     f.GetPeakPressure(),
-			"unit":      "cmH2O",
-		},
-		"peep": map[string]interface{}{
-			"raw_value": f.Peep,
-			"value":     f.GetPeep(),
-			"unit":      "cmH2O",
-		},
-		"pplat": map[string]interface{}{
-			"raw_value": f.Pplat,
-			"value":     f.GetPlateauPressure(),
-			"unit":      "cmH2O",
-		},
-		"tv_insp": map[string]interface{}{
-			"raw_value": f.TvInsp,
-			"value":     f.GetInspiratoryTidalVolume(),
-			"unit":      "ml",
-		},
-		"tv_exp": map[string]interface{}{
-			"raw_value": f.TvExp,
-			"value":     f.GetExpiratoryTidalVolume(),
-			"unit":      "ml",
-		},
-		"compliance": map[string]interface{}{
-			"raw_value": f.Compliance,
-			"value":     f.GetCompliance(),
-			"unit":      "ml/cmH2O",
-		},
-		"mv_exp": map[string]interface{}{
-			"raw_value": f.MvExp,
-			"value":     f.GetExpiratoryMinuteVolume(),
-			"unit":      "l/min",
-		},
-	}
+	return f.ToStruct().toMap()
 }
 
 // CO & PCWP Label Bit Constants
@@ -1943,38 +1918,7 @@ func (c *COWedgeGroup) GetCOModeDescription() string {
 
 // ToJSON converts the COWedgeGroup to JSON format
 func (c *COWedgeGroup) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"header": map[string]interface{}{
-			"status": c.Header.Status,
-			"label":  c.Header.Label,
-			"co_over_60s_old": c.IsCOOver60sOld(),
-			"pcwp_over_60s_old": c.IsPCWPOver60sOld(),
-			"co_mode": map[string]interface{}{
-				"value": c.GetCOMode(),
-				"description": c.GetCOModeDescription(),
-			},
-		},
-		"co": map[string]interface{}{
-			"raw_value": c.Co,
-			"value":     c.GetCardiacOutput(),
-			"unit":      "ml/min",
-		},
-		"blood_temp": map[string]interface{}{
-			"raw_value": c.BloodTemp,
-			"value":     c.GetBloodTemperature(),
-			"unit":      "°C",
-		},
-		"ref": map[string]interface{}{
-			"raw_value": c.Ref,
-			"value":     c.GetRightHeartEjectionFraction(),
-			"unit":      "%",
-		},
-		"pcwp": map[string]interface{}{
-			"raw_value": c.Pcwp,
-			"value":     c.GetWedgePressure(),
-			"unit":      "mmHg",
-		},
-	}
+	return c.ToStruct().toMap()
 }
 
 // Stimulus Type Constants
@@ -2119,41 +2063,7 @@ func (n *NMTGroup) GetStimulusCurrent() int {
 
 // ToJSON converts the NMTGroup to JSON format
 func (n *NMTGroup) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"header": map[string]interface{}{
-			"status": n.Header.Status,
-			"label":  n.Header.Label,
-			"stimulus_mode": map[string]interface{}{
-				"value": n.GetStimulusMode(),
-				"description": n.GetStimulusModeDescription(),
-			},
-			"pulse_width": map[string]interface{}{
-				"value": n.GetPulseWidth(),
-				"description": n.GetPulseWidthDescription(),
-			},
-			"is_supramax_current_found": n.IsSupramaxCurrentFound(),
-			"is_calibrated": n.IsCalibrated(),
-		},
-		"t1": map[string]interface{}{
-			"raw_value": n.T1,
-			"value":     n.GetT1(),
-			"unit":      "%",
-		},
-		"tratio": map[string]interface{}{
-			"raw_value": n.Tratio,
-			"value":     n.GetTratio(),
-			"unit":      "%",
-		},
-		"ptc": map[string]interface{}{
-			"raw_value": n.Ptc,
-			"post_tetanic_count": n.GetPostTetanicCount(),
-			"tof_count": n.GetTOFCount(),
-			"stimulus_current": map[string]interface{}{
-				"value": n.GetStimulusCurrent(),
-				"unit":  "mA",
-			},
-		},
-	}
+	return n.ToStruct().toMap()
 }
 
 // ECG Extra Group Structure
@@ -2209,23 +2119,7 @@ func (e *ECGExtraGroup) GetMinHeartRate() float64 {
 
 // ToJSON converts the ECGExtraGroup to JSON format
 func (e *ECGExtraGroup) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"hr_ecg": map[string]interface{}{
-			"raw_value": e.HrEcg,
-			"value":     e.GetHeartRate(),
-			"unit":      "bpm",
-		},
-		"hr_max": map[string]interface{}{
-			"raw_value": e.HrMax,
-			"value":     e.GetMaxHeartRate(),
-			"unit":      "bpm",
-		},
-		"hr_min": map[string]interface{}{
-			"raw_value": e.HrMin,
-			"value":     e.GetMinHeartRate(),
-			"unit":      "bpm",
-		},
-	}
+	return e.ToStruct().toMap()
 }
 
 // SvO2 Label Constants
@@ -2332,28 +2226,7 @@ func (s *SvO2Group) IsIntensityShift() bool {
 
 // ToJSON converts the SvO2Group to JSON format
 func (s *SvO2Group) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"header": map[string]interface{}{
-			"status": s.Header.Status,
-			"label":  s.Header.Label,
-			"saturation_type": s.GetSaturationType(),
-			"status_bits": map[string]interface{}{
-				"calibrated_over_24h_ago": s.IsCalibratedOver24hAgo(),
-				"faulty_cable": s.IsFaultyCable(),
-				"no_cable": s.IsNoCable(),
-				"not_calibrated": s.IsNotCalibrated(),
-				"recalibrated": s.IsRecalibrated(),
-				"svo2_out_of_range": s.IsSvO2OutOfRange(),
-				"check_catheter_position": s.IsCheckCatheterPosition(),
-				"intensity_shift": s.IsIntensityShift(),
-			},
-		},
-		"svo2": map[string]interface{}{
-			"raw_value": s.SvO2,
-			"value":     s.GetSvO2Value(),
-			"unit":      "%",
-		},
-	}
+	return s.ToStruct().toMap()
 }
 
 // DRI Alarm Subrecord Types
@@ -2399,6 +2272,40 @@ func (a *AlarmDisplay) Size() int {
 	return 80 + 1 + 1 + 1 + 6*2 // text[80] + text_changed + color + color_changed + reserved[6]
 }
 
+// MarshalBinary converts the alarm display to binary format
+func (a *AlarmDisplay) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, a.Size())
+	offset := 0
+
+	// text[]: The actual alarm text displayed by the S/5 monitor
+	copy(buf[offset:offset+80], a.Text[:])
+	offset += 80
+
+	// text_changed: Is true if the alarm text has changed
+	if a.TextChanged {
+		buf[offset] = 1
+	}
+	offset += 1
+
+	// color: The priority of the alarm
+	buf[offset] = a.Color
+	offset += 1
+
+	// color_changed: Is true if the alarm color has changed
+	if a.ColorChanged {
+		buf[offset] = 1
+	}
+	offset += 1
+
+	// reserved: Reserved for future extensions
+	for i := 0; i < 6; i++ {
+		binary.LittleEndian.PutUint16(buf[offset:], uint16(a.Reserved[i]))
+		offset += 2
+	}
+
+	return buf, nil
+}
+
 // UnmarshalBinary converts binary data to alarm display
 func (a *AlarmDisplay) UnmarshalBinary(data []byte) error {
 	if len(data) < a.Size() {
@@ -2490,22 +2397,7 @@ func (a *AlarmDisplay) IsActiveAlarm() bool {
 
 // ToJSON converts the AlarmDisplay to JSON format
 func (a *AlarmDisplay) ToJSON() map[string]interface{} {
-	return map[string]interface{}{
-		"text": map[string]interface{}{
-			"value":   a.GetAlarmText(),
-			"changed": a.TextChanged,
-		},
-		"color": map[string]interface{}{
-			"value":   a.Color,
-			"name":    a.GetAlarmColor(),
-			"changed": a.ColorChanged,
-		},
-		"priority": map[string]interface{}{
-			"level": a.GetAlarmPriority(),
-			"is_active": a.IsActiveAlarm(),
-		},
-		"reserved": a.Reserved,
-	}
+	return a.ToStruct().toMap()
 }
 
 // Alarm Status Message Structure
@@ -2522,7 +2414,53 @@ type AlarmStatusMessage struct {
 
 // Size returns the size of AlarmStatusMessage in bytes
 func (a *AlarmStatusMessage) Size() int {
-	return 2 + 1 + 2 + 2 + 1 + 5*93 + 5*2 // reserved + sound_on_off + reserved2 + reserved3 + silence_info + 5*al_disp + reserved4
+	return 2 + 1 + 2 + 2 + 1 + 5*a.AlDisp[0].Size() + 5*2 // reserved + sound_on_off + reserved2 + reserved3 + silence_info + 5*al_disp + reserved4
+}
+
+// MarshalBinary converts the alarm status message to binary format
+func (a *AlarmStatusMessage) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, a.Size())
+	offset := 0
+
+	// reserved: Reserved for future extensions
+	binary.LittleEndian.PutUint16(buf[offset:], uint16(a.Reserved))
+	offset += 2
+
+	// sound_on_off: Indicates the on/off status of the alarm sound
+	if a.SoundOnOff {
+		buf[offset] = 1
+	}
+	offset += 1
+
+	// reserved2: Reserved for future extensions
+	binary.LittleEndian.PutUint16(buf[offset:], uint16(a.Reserved2))
+	offset += 2
+
+	// reserved3: Reserved for future extensions
+	binary.LittleEndian.PutUint16(buf[offset:], uint16(a.Reserved3))
+	offset += 2
+
+	// silence_info: Indicates the alarm silence status at the monitor
+	buf[offset] = a.SilenceInfo
+	offset += 1
+
+	// al_disp: Array of alarm messages
+	for i := 0; i < 5; i++ {
+		displayBytes, err := a.AlDisp[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		copy(buf[offset:], displayBytes)
+		offset += a.AlDisp[i].Size()
+	}
+
+	// reserved4: Reserved for future extensions
+	for i := 0; i < 5; i++ {
+		binary.LittleEndian.PutUint16(buf[offset:], uint16(a.Reserved4[i]))
+		offset += 2
+	}
+
+	return buf, nil
 }
 
 // UnmarshalBinary converts binary data to alarm status message
@@ -2632,34 +2570,7 @@ func (a *AlarmStatusMessage) IsSilenced() bool {
 
 // ToJSON converts the AlarmStatusMessage to JSON format
 func (a *AlarmStatusMessage) ToJSON() map[string]interface{} {
-	alarms := make([]map[string]interface{}, 5)
-	for i := 0; i < 5; i++ {
-		alarms[i] = a.AlDisp[i].ToJSON()
-	}
-
-	return map[string]interface{}{
-		"reserved": a.Reserved,
-		"sound_on_off": map[string]interface{}{
-			"value": a.SoundOnOff,
-			"status": a.IsSoundOn(),
-		},
-		"reserved2": a.Reserved2,
-		"reserved3": a.Reserved3,
-		"silence_info": map[string]interface{}{
-			"value": a.SilenceInfo,
-			"description": a.GetSilenceInfoDescription(),
-			"is_silenced": a.IsSilenced(),
-		},
-		"alarms": alarms,
-		"active_alarm_count": a.GetActiveAlarmCount(),
-		"highest_priority_alarm": func() interface{} {
-			if highest := a.GetHighestPriorityAlarm(); highest != nil {
-				return highest.ToJSON()
-			}
-			return nil
-		}(),
-		"reserved4": a.Reserved4,
-	}
+	return a.ToStruct().toMap()
 }
 
 // Alarm Subrecords Union Structure
@@ -2689,14 +2600,5 @@ func (a *AlarmSubrecords) UnmarshalBinary(data []byte) error {
 
 // ToJSON converts the AlarmSubrecords to JSON format
 func (a *AlarmSubrecords) ToJSON() map[string]interface{} {
-	if a.AlarmMsg != nil {
-		return map[string]interface{}{
-			"type": "alarm_status_message",
-			"data": a.AlarmMsg.ToJSON(),
-		}
-	}
-	return map[string]interface{}{
-		"type": "empty",
-		"data": nil,
-	}
+	return a.ToStruct().toMap()
 }
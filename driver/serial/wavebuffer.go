@@ -0,0 +1,374 @@
+package serial
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WAVE_BUFFER_WINDOW is the default length of waveform kept per channel
+const WAVE_BUFFER_WINDOW = 5 * time.Minute
+
+// WaveformPoint is a sample, or the mean of several samples, at a time
+type WaveformPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// EnvelopeBucket is the range of the samples within a time bucket, for
+// drawing a waveform at fewer pixels than samples
+type EnvelopeBucket struct {
+	Start time.Time `json:"start"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Count int       `json:"count"` // Samples in the bucket
+}
+
+// WaveformRing keeps the most recent samples of one channel: the physical
+// values and their timestamps in a fixed ring sized for the window at the
+// sampling rate. Control codes and samples older than the last one stored
+// are not kept. It is safe for concurrent use.
+type WaveformRing struct {
+	mutex        sync.RWMutex
+	window       time.Duration
+	samplingRate int
+	times        []int64 // Unix nanoseconds
+	values       []float64
+	head         int // Index of the oldest sample
+	count        int
+	unit         string
+}
+
+// NewWaveformRing creates a ring keeping window of samples of one channel
+// (WAVE_BUFFER_WINDOW if window is 0)
+func NewWaveformRing(window time.Duration) *WaveformRing {
+	if window <= 0 {
+		window = WAVE_BUFFER_WINDOW
+	}
+	return &WaveformRing{window: window}
+}
+
+// Add stores the samples of a waveform subrecord or stitched chunk sampled
+// at samplingRate. Samples without a timestamp are placed after recordTime
+// at their index. A change of sampling rate clears the ring.
+func (r *WaveformRing) Add(recordTime time.Time, samplingRate int, unit string, samples []SampleJSON) {
+	if samplingRate <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if samplingRate != r.samplingRate {
+		size := int(r.window.Seconds() * float64(samplingRate))
+		if size < 1 {
+			size = 1
+		}
+		r.samplingRate = samplingRate
+		r.times = make([]int64, size)
+		r.values = make([]float64, size)
+		r.head, r.count = 0, 0
+	}
+	if unit != "" {
+		r.unit = unit
+	}
+
+	for i, sample := range samples {
+		if sample.IsControlCode {
+			continue
+		}
+		at := sample.Timestamp
+		if at.IsZero() {
+			at = SampleTime(recordTime, i, samplingRate)
+		}
+		nanos := at.UnixNano()
+		if r.count > 0 && nanos <= r.times[r.index(r.count-1)] {
+			continue
+		}
+		if r.count == len(r.times) {
+			r.head = (r.head + 1) % len(r.times)
+			r.count--
+		}
+		position := r.index(r.count)
+		r.times[position] = nanos
+		r.values[position] = sample.PhysicalValue
+		r.count++
+	}
+}
+
+// index returns the position in the ring of the i-th oldest sample
+func (r *WaveformRing) index(i int) int {
+	return (r.head + i) % len(r.times)
+}
+
+// ringTime converts a stored timestamp to UTC time
+func ringTime(nanos int64) time.Time {
+	return time.Unix(0, nanos).UTC()
+}
+
+// SamplingRate returns the sampling rate of the stored samples (0: none yet)
+func (r *WaveformRing) SamplingRate() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.samplingRate
+}
+
+// Unit returns the unit of the stored values
+func (r *WaveformRing) Unit() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.unit
+}
+
+// Span returns the times of the oldest and newest stored samples, or false if the ring is empty
+func (r *WaveformRing) Span() (time.Time, time.Time, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.count == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return ringTime(r.times[r.head]), ringTime(r.times[r.index(r.count-1)]), true
+}
+
+// bounds returns the range [first, last) of samples from from up to before
+// to. The caller must hold the lock.
+func (r *WaveformRing) bounds(from, to time.Time) (int, int) {
+	start, end := from.UnixNano(), to.UnixNano()
+	first := sort.Search(r.count, func(i int) bool { return r.times[r.index(i)] >= start })
+	last := sort.Search(r.count, func(i int) bool { return r.times[r.index(i)] >= end })
+	return first, last
+}
+
+// Range returns the samples from from up to before to
+func (r *WaveformRing) Range(from, to time.Time) []WaveformPoint {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	first, last := r.bounds(from, to)
+	points := make([]WaveformPoint, 0, last-first)
+	for i := first; i < last; i++ {
+		position := r.index(i)
+		points = append(points, WaveformPoint{Time: ringTime(r.times[position]), Value: r.values[position]})
+	}
+	return points
+}
+
+// Decimate returns the samples from from up to before to reduced by factor:
+// every point is the mean of factor consecutive samples, which suppresses
+// the frequencies the reduced rate cannot represent. Points are stamped with
+// the time of their first sample; a last incomplete group is averaged too.
+func (r *WaveformRing) Decimate(from, to time.Time, factor int) []WaveformPoint {
+	if factor <= 1 {
+		return r.Range(from, to)
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	first, last := r.bounds(from, to)
+	points := make([]WaveformPoint, 0, (last-first+factor-1)/factor)
+	for i := first; i < last; i += factor {
+		end := i + factor
+		if end > last {
+			end = last
+		}
+		sum := 0.0
+		for j := i; j < end; j++ {
+			sum += r.values[r.index(j)]
+		}
+		points = append(points, WaveformPoint{Time: ringTime(r.times[r.index(i)]), Value: sum / float64(end-i)})
+	}
+	return points
+}
+
+// Downsample returns the samples from from up to before to at about rate
+// samples per second (see Decimate). Rates at or above the sampling rate
+// return the samples unchanged.
+func (r *WaveformRing) Downsample(from, to time.Time, rate int) []WaveformPoint {
+	samplingRate := r.SamplingRate()
+	if rate <= 0 || rate >= samplingRate {
+		return r.Range(from, to)
+	}
+	return r.Decimate(from, to, (samplingRate+rate-1)/rate)
+}
+
+// Envelope divides from up to before to into buckets of equal length and
+// returns the minimum and maximum of the samples in each, so that peaks
+// (e.g. QRS complexes) remain visible at any resolution. Buckets without
+// samples are left out.
+func (r *WaveformRing) Envelope(from, to time.Time, buckets int) []EnvelopeBucket {
+	if buckets <= 0 || !to.After(from) {
+		return []EnvelopeBucket{}
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	first, last := r.bounds(from, to)
+	width := float64(to.Sub(from)) / float64(buckets)
+
+	envelope := make([]EnvelopeBucket, 0, buckets)
+	current := -1
+	for i := first; i < last; i++ {
+		position := r.index(i)
+		bucket := int(float64(r.times[position]-from.UnixNano()) / width)
+		if bucket >= buckets {
+			bucket = buckets - 1
+		}
+		value := r.values[position]
+		if bucket != current {
+			current = bucket
+			envelope = append(envelope, EnvelopeBucket{
+				Start: from.Add(time.Duration(float64(bucket) * width)),
+				Min:   value,
+				Max:   value,
+			})
+		}
+		entry := &envelope[len(envelope)-1]
+		if value < entry.Min {
+			entry.Min = value
+		}
+		if value > entry.Max {
+			entry.Max = value
+		}
+		entry.Count++
+	}
+	return envelope
+}
+
+// WaveformChannel identifies a buffered channel of a monitor
+type WaveformChannel struct {
+	PlugID       int       `json:"plug_id"`
+	Channel      string    `json:"channel"` // Channel key, e.g. "ECG1" (see GetWaveformChannelKey)
+	SamplingRate int       `json:"sampling_rate"`
+	Unit         string    `json:"unit"`
+	Oldest       time.Time `json:"oldest"`
+	Newest       time.Time `json:"newest"`
+}
+
+// WaveformBuffer keeps the recent waveforms of every channel of every
+// monitor in a WaveformRing, so that consumers can fetch a time range at the
+// resolution they draw instead of receiving every sample. It is safe for
+// concurrent use.
+type WaveformBuffer struct {
+	mutex  sync.RWMutex
+	window time.Duration
+	rings  map[waveformRingKey]*WaveformRing
+}
+
+// waveformRingKey identifies the ring of a channel of a monitor
+type waveformRingKey struct {
+	plugID  int
+	channel string
+}
+
+// NewWaveformBuffer creates a buffer keeping window of every channel (WAVE_BUFFER_WINDOW if 0)
+func NewWaveformBuffer(window time.Duration) *WaveformBuffer {
+	if window <= 0 {
+		window = WAVE_BUFFER_WINDOW
+	}
+	return &WaveformBuffer{window: window, rings: make(map[waveformRingKey]*WaveformRing)}
+}
+
+// Add stores a waveform subrecord parsed with ParseWaveformRecord
+func (b *WaveformBuffer) Add(header *DatexHeader, waveform *WaveformJSON) {
+	unit := ""
+	if len(waveform.Samples) > 0 {
+		unit = waveform.Samples[0].Unit
+	}
+	b.ring(int(header.PlugID), GetWaveformChannelKey(waveform.SubrecordType), true).
+		Add(waveform.Timestamp, waveform.SamplingRate, unit, waveform.Samples)
+}
+
+// AddChunk stores a chunk of a WaveformStitcher, whose samples carry restamped times
+func (b *WaveformBuffer) AddChunk(plugID int, channel string, chunk *StitchedChunk) {
+	unit := ""
+	if len(chunk.Samples) > 0 {
+		unit = chunk.Samples[0].Unit
+	}
+	b.ring(plugID, channel, true).Add(chunk.SegmentStart, chunk.SamplingRate, unit, chunk.Samples)
+}
+
+// ring returns the ring of a channel, creating it if create is set (nil if
+// it does not exist)
+func (b *WaveformBuffer) ring(plugID int, channel string, create bool) *WaveformRing {
+	key := waveformRingKey{plugID: plugID, channel: channel}
+	b.mutex.RLock()
+	ring := b.rings[key]
+	b.mutex.RUnlock()
+	if ring != nil || !create {
+		return ring
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if ring = b.rings[key]; ring == nil {
+		ring = NewWaveformRing(b.window)
+		b.rings[key] = ring
+	}
+	return ring
+}
+
+// Ring returns the ring of a channel of a monitor
+func (b *WaveformBuffer) Ring(plugID int, channel string) (*WaveformRing, error) {
+	ring := b.ring(plugID, channel, false)
+	if ring == nil {
+		return nil, fmt.Errorf("no waveform buffered for plug %d channel %s", plugID, channel)
+	}
+	return ring, nil
+}
+
+// Range returns the samples of a channel from from up to before to
+func (b *WaveformBuffer) Range(plugID int, channel string, from, to time.Time) ([]WaveformPoint, error) {
+	ring, err := b.Ring(plugID, channel)
+	if err != nil {
+		return nil, err
+	}
+	return ring.Range(from, to), nil
+}
+
+// Downsample returns the samples of a channel from from up to before to at about rate samples per second
+func (b *WaveformBuffer) Downsample(plugID int, channel string, from, to time.Time, rate int) ([]WaveformPoint, error) {
+	ring, err := b.Ring(plugID, channel)
+	if err != nil {
+		return nil, err
+	}
+	return ring.Downsample(from, to, rate), nil
+}
+
+// Envelope returns the min-max envelope of a channel from from up to before to in buckets
+func (b *WaveformBuffer) Envelope(plugID int, channel string, from, to time.Time, buckets int) ([]EnvelopeBucket, error) {
+	ring, err := b.Ring(plugID, channel)
+	if err != nil {
+		return nil, err
+	}
+	return ring.Envelope(from, to, buckets), nil
+}
+
+// Channels returns the buffered channels, ordered by plug ID and channel
+func (b *WaveformBuffer) Channels() []WaveformChannel {
+	b.mutex.RLock()
+	rings := make(map[waveformRingKey]*WaveformRing, len(b.rings))
+	for key, ring := range b.rings {
+		rings[key] = ring
+	}
+	b.mutex.RUnlock()
+
+	channels := make([]WaveformChannel, 0, len(rings))
+	for key, ring := range rings {
+		oldest, newest, ok := ring.Span()
+		if !ok {
+			continue
+		}
+		channels = append(channels, WaveformChannel{
+			PlugID:       key.plugID,
+			Channel:      key.channel,
+			SamplingRate: ring.SamplingRate(),
+			Unit:         ring.Unit(),
+			Oldest:       oldest,
+			Newest:       newest,
+		})
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].PlugID != channels[j].PlugID {
+			return channels[i].PlugID < channels[j].PlugID
+		}
+		return channels[i].Channel < channels[j].Channel
+	})
+	return channels
+}
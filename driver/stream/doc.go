@@ -0,0 +1,3 @@
+// Package stream serves parsed DRI waveforms and displayed values, and
+// HL7 vitals, to browser dashboards over WebSocket (RFC 6455).
+package stream
@@ -0,0 +1,549 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/clock"
+)
+
+// Streaming defaults
+const (
+	STREAM_QUEUE_SIZE    = 256              // Events buffered per client before the oldest are dropped
+	STREAM_WRITE_TIMEOUT = 10 * time.Second // Time allowed to write one message to a client
+	STREAM_PING_INTERVAL = 30 * time.Second // Interval between keepalive pings
+)
+
+// Event types
+const (
+	EVENT_WAVEFORM   = "waveform"
+	EVENT_VITALS     = "vitals"
+	EVENT_ANNOTATION = "annotation"
+	EVENT_INFUSION   = "infusion"
+	EVENT_SUBSCRIBED = "subscribed"
+	EVENT_ERROR      = "error"
+)
+
+// CHANNEL_VITALS is the channel carrying displayed values (DRI_PH_DISPL)
+const CHANNEL_VITALS = "VITALS"
+
+// CHANNEL_INFUSION is the channel carrying infusion pump states of a bed
+const CHANNEL_INFUSION = "INFUSION"
+
+// WILDCARD subscribes to every plug ID or every channel
+const WILDCARD = "*"
+
+// Publisher is the stable interface through which the drivers stream
+// events; *Hub implements it. An application can pass its own Publisher to
+// forward the events to another transport.
+type Publisher interface {
+	Publish(eventType, plugID, channel string, data interface{}) error
+}
+
+var _ Publisher = (*Hub)(nil)
+
+// Event is the envelope sent to WebSocket clients
+type Event struct {
+	Type      string          `json:"type"`
+	PlugID    string          `json:"plug_id,omitempty"`
+	Channel   string          `json:"channel,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Dropped   int             `json:"dropped,omitempty"` // Events discarded for this client since the previous event
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Subscription selects the events of one plug ID and channel. Either may be
+// WILDCARD.
+type Subscription struct {
+	PlugID  string `json:"plug_id"`
+	Channel string `json:"channel"`
+}
+
+// subscribeRequest is a message sent by a client to change its subscriptions
+type subscribeRequest struct {
+	Action   string   `json:"action"` // "subscribe" or "unsubscribe"
+	PlugID   string   `json:"plug_id"`
+	Channels []string `json:"channels"`
+}
+
+// ClientInfo describes a connected streaming client
+type ClientInfo struct {
+	ID            string         `json:"id"`
+	RemoteAddr    string         `json:"remote_addr"`
+	ConnectedAt   time.Time      `json:"connected_at"`
+	Subscriptions []Subscription `json:"subscriptions"`
+	Sent          int            `json:"sent"`
+	Dropped       int            `json:"dropped"`
+	Queued        int            `json:"queued"`
+}
+
+// Hub streams waveform samples and displayed values to WebSocket clients.
+// Each client subscribes to channels of individual monitors; publishing never
+// blocks on slow clients. When a client's queue is full the oldest event is
+// dropped and the number of dropped events is reported in the next event.
+type Hub struct {
+	mutex       sync.RWMutex
+	clients     map[*client]bool
+	nextID      int
+	queueSize   int
+	checkOrigin func(r *http.Request) bool
+	clock       clock.Clock
+	logger      *log.Logger
+}
+
+// client is a connected WebSocket client
+type client struct {
+	id            string
+	remoteAddr    string
+	connectedAt   time.Time
+	conn          *wsConn
+	hub           *Hub
+	mutex         sync.Mutex
+	subscriptions map[Subscription]bool
+	queue         []*Event
+	pendingDrops  int
+	sent          int
+	dropped       int
+	notify        chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewHub creates a streaming hub
+func NewHub() *Hub {
+	return &Hub{
+		clients:     make(map[*client]bool),
+		queueSize:   STREAM_QUEUE_SIZE,
+		checkOrigin: sameOrigin,
+		clock:       clock.Real,
+		logger:      log.New(log.Writer(), "[STREAM] ", log.LstdFlags),
+	}
+}
+
+// SetQueueSize sets the number of events buffered per client
+func (h *Hub) SetQueueSize(size int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if size > 0 {
+		h.queueSize = size
+	}
+}
+
+// SetCheckOrigin replaces the Origin check for new connections. By default
+// only same-origin browser connections (and non-browser clients) are accepted.
+func (h *Hub) SetCheckOrigin(check func(r *http.Request) bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checkOrigin = check
+}
+
+// SetClock sets the clock used for event timestamps; nil selects the wall clock
+func (h *Hub) SetClock(c clock.Clock) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.clock = clock.OrReal(c)
+}
+
+// sameOrigin accepts requests without an Origin header or whose Origin host
+// matches the request host
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, r.Host)
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection. Initial
+// subscriptions may be given as query parameters, e.g.
+// /stream?plug_id=1234&channels=ECG12,PLETH
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	checkOrigin := h.checkOrigin
+	h.mutex.RUnlock()
+	if checkOrigin != nil && !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrade(w, r)
+	if err != nil {
+		h.logger.Printf("WebSocket upgrade failed for %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	h.mutex.Lock()
+	h.nextID++
+	c := &client{
+		id:            fmt.Sprintf("ws-%d", h.nextID),
+		remoteAddr:    r.RemoteAddr,
+		connectedAt:   h.clock.Now(),
+		conn:          conn,
+		hub:           h,
+		subscriptions: make(map[Subscription]bool),
+		notify:        make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	query := r.URL.Query()
+	if query.Has("plug_id") || query.Has("channels") {
+		c.subscribe(query.Get("plug_id"), splitChannels(query.Get("channels")))
+	}
+	h.clients[c] = true
+	h.mutex.Unlock()
+
+	h.logger.Printf("Stream client %s connected from %s", c.id, c.remoteAddr)
+
+	go c.writeLoop()
+	c.readLoop()
+}
+
+// PublishWaveform streams waveform data (e.g. a parsed waveform subrecord) of
+// one channel of a monitor
+func (h *Hub) PublishWaveform(plugID, channel string, data interface{}) error {
+	return h.Publish(EVENT_WAVEFORM, plugID, channel, data)
+}
+
+// PublishVitals streams the displayed values of a monitor on CHANNEL_VITALS
+func (h *Hub) PublishVitals(plugID string, data interface{}) error {
+	return h.Publish(EVENT_VITALS, plugID, CHANNEL_VITALS, data)
+}
+
+// PublishInfusion streams the state of an infusion pump channel to the
+// clients subscribed to the INFUSION channel of a bed
+func (h *Hub) PublishInfusion(plugID string, data interface{}) error {
+	return h.Publish(EVENT_INFUSION, plugID, CHANNEL_INFUSION, data)
+}
+
+// PublishAnnotation streams an annotation (e.g. a detected event) of one
+// channel of a monitor to the clients subscribed to that channel
+func (h *Hub) PublishAnnotation(plugID, channel string, data interface{}) error {
+	return h.Publish(EVENT_ANNOTATION, plugID, channel, data)
+}
+
+// Publish sends an event to every client subscribed to plugID and channel.
+// Data is encoded once, and only if at least one client is subscribed.
+func (h *Hub) Publish(eventType, plugID, channel string, data interface{}) error {
+	channel = normalizeChannel(channel)
+
+	h.mutex.RLock()
+	subscribers := make([]*client, 0)
+	for c := range h.clients {
+		if c.isSubscribed(plugID, channel) {
+			subscribers = append(subscribers, c)
+		}
+	}
+	queueSize := h.queueSize
+	now := h.clock.Now()
+	h.mutex.RUnlock()
+
+	if len(subscribers) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %v", eventType, err)
+	}
+
+	for _, c := range subscribers {
+		c.enqueue(&Event{
+			Type:      eventType,
+			PlugID:    plugID,
+			Channel:   channel,
+			Timestamp: now,
+			Data:      payload,
+		}, queueSize)
+	}
+	return nil
+}
+
+// Clients returns the connected clients ordered by ID
+func (h *Hub) Clients() []ClientInfo {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	clients := make([]ClientInfo, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c.info())
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt) ||
+			(clients[i].ConnectedAt.Equal(clients[j].ConnectedAt) && clients[i].ID < clients[j].ID)
+	})
+	return clients
+}
+
+// Close disconnects every client
+func (h *Hub) Close() {
+	h.mutex.Lock()
+	clients := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mutex.Unlock()
+
+	for _, c := range clients {
+		c.conn.writeClose(WS_CLOSE_GOING_AWAY, "server shutting down")
+		c.close()
+	}
+}
+
+// removeClient forgets a disconnected client
+func (h *Hub) removeClient(c *client) {
+	h.mutex.Lock()
+	_, exists := h.clients[c]
+	delete(h.clients, c)
+	h.mutex.Unlock()
+
+	if exists {
+		h.logger.Printf("Stream client %s disconnected (sent %d, dropped %d)", c.id, c.sent, c.dropped)
+	}
+}
+
+// readLoop handles subscription requests until the connection is closed
+func (c *client) readLoop() {
+	defer func() {
+		c.close()
+		c.hub.removeClient(c)
+	}()
+
+	for {
+		opcode, message, err := c.conn.readMessage()
+		if err != nil {
+			switch {
+			case err == io.EOF:
+			case err == errMessageTooLarge:
+				c.conn.writeClose(WS_CLOSE_TOO_LARGE, err.Error())
+			default:
+				select {
+				case <-c.done:
+				default:
+					c.hub.logger.Printf("Stream client %s read error: %v", c.id, err)
+					c.conn.writeClose(WS_CLOSE_PROTOCOL_ERROR, "protocol error")
+				}
+			}
+			return
+		}
+		if opcode != WS_OP_TEXT {
+			c.sendControl(EVENT_ERROR, map[string]string{"error": "only text messages are accepted"})
+			continue
+		}
+		c.handleRequest(message)
+	}
+}
+
+// handleRequest applies a subscribe or unsubscribe request
+func (c *client) handleRequest(message []byte) {
+	var request subscribeRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		c.sendControl(EVENT_ERROR, map[string]string{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	c.hub.mutex.Lock()
+	switch request.Action {
+	case "subscribe":
+		c.subscribe(request.PlugID, request.Channels)
+	case "unsubscribe":
+		c.unsubscribe(request.PlugID, request.Channels)
+	default:
+		c.hub.mutex.Unlock()
+		c.sendControl(EVENT_ERROR, map[string]string{"error": fmt.Sprintf("unknown action %q", request.Action)})
+		return
+	}
+	subscriptions := c.subscriptionList()
+	c.hub.mutex.Unlock()
+
+	c.sendControl(EVENT_SUBSCRIBED, map[string]interface{}{"subscriptions": subscriptions})
+}
+
+// subscribe adds subscriptions. An empty plug ID or channel list means all.
+// Callers hold hub.mutex.
+func (c *client) subscribe(plugID string, channels []string) {
+	for _, subscription := range expandSubscriptions(plugID, channels) {
+		c.subscriptions[subscription] = true
+	}
+}
+
+// unsubscribe removes subscriptions. Callers hold hub.mutex.
+func (c *client) unsubscribe(plugID string, channels []string) {
+	for _, subscription := range expandSubscriptions(plugID, channels) {
+		delete(c.subscriptions, subscription)
+	}
+}
+
+// isSubscribed reports whether the client receives events of plugID and
+// channel. Callers hold hub.mutex.
+func (c *client) isSubscribed(plugID, channel string) bool {
+	return c.subscriptions[Subscription{plugID, channel}] ||
+		c.subscriptions[Subscription{plugID, WILDCARD}] ||
+		c.subscriptions[Subscription{WILDCARD, channel}] ||
+		c.subscriptions[Subscription{WILDCARD, WILDCARD}]
+}
+
+// subscriptionList returns the subscriptions in a stable order. Callers hold hub.mutex.
+func (c *client) subscriptionList() []Subscription {
+	subscriptions := make([]Subscription, 0, len(c.subscriptions))
+	for subscription := range c.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if subscriptions[i].PlugID != subscriptions[j].PlugID {
+			return subscriptions[i].PlugID < subscriptions[j].PlugID
+		}
+		return subscriptions[i].Channel < subscriptions[j].Channel
+	})
+	return subscriptions
+}
+
+// info returns the client's statistics. Callers hold hub.mutex.
+func (c *client) info() ClientInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return ClientInfo{
+		ID:            c.id,
+		RemoteAddr:    c.remoteAddr,
+		ConnectedAt:   c.connectedAt,
+		Subscriptions: c.subscriptionList(),
+		Sent:          c.sent,
+		Dropped:       c.dropped,
+		Queued:        len(c.queue),
+	}
+}
+
+// sendControl queues a reply to a client request
+func (c *client) sendControl(eventType string, data interface{}) {
+	payload, _ := json.Marshal(data)
+
+	c.hub.mutex.RLock()
+	queueSize := c.hub.queueSize
+	now := c.hub.clock.Now()
+	c.hub.mutex.RUnlock()
+
+	c.enqueue(&Event{Type: eventType, Timestamp: now, Data: payload}, queueSize)
+}
+
+// enqueue adds an event to the client's queue, dropping the oldest event if
+// the queue is full
+func (c *client) enqueue(event *Event, queueSize int) {
+	c.mutex.Lock()
+	if len(c.queue) >= queueSize {
+		dropCount := len(c.queue) - queueSize + 1
+		c.queue = append(c.queue[:0], c.queue[dropCount:]...)
+		c.pendingDrops += dropCount
+		c.dropped += dropCount
+	}
+	c.queue = append(c.queue, event)
+	c.mutex.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop sends queued events and keepalive pings until the client is closed
+func (c *client) writeLoop() {
+	ping := c.hub.clock.NewTicker(STREAM_PING_INTERVAL)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.notify:
+			if err := c.flush(); err != nil {
+				c.hub.logger.Printf("Stream client %s write error: %v", c.id, err)
+				c.close()
+				return
+			}
+		case <-ping.C():
+			if err := c.conn.writeFrame(WS_OP_PING, nil, time.Now().Add(STREAM_WRITE_TIMEOUT)); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// flush writes every queued event
+func (c *client) flush() error {
+	for {
+		c.mutex.Lock()
+		if len(c.queue) == 0 {
+			c.mutex.Unlock()
+			return nil
+		}
+		event := *c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		event.Dropped = c.pendingDrops
+		c.pendingDrops = 0
+		c.mutex.Unlock()
+
+		message, err := json.Marshal(&event)
+		if err != nil {
+			return err
+		}
+		if err := c.conn.writeFrame(WS_OP_TEXT, message, time.Now().Add(STREAM_WRITE_TIMEOUT)); err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		c.sent++
+		c.mutex.Unlock()
+	}
+}
+
+// close stops the client's goroutines and closes the connection
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.close()
+	})
+}
+
+// expandSubscriptions builds the subscriptions for a plug ID and channel list
+func expandSubscriptions(plugID string, channels []string) []Subscription {
+	plugID = strings.TrimSpace(plugID)
+	if plugID == "" {
+		plugID = WILDCARD
+	}
+	if len(channels) == 0 {
+		channels = []string{WILDCARD}
+	}
+
+	subscriptions := make([]Subscription, 0, len(channels))
+	for _, channel := range channels {
+		if channel = normalizeChannel(channel); channel != "" {
+			subscriptions = append(subscriptions, Subscription{PlugID: plugID, Channel: channel})
+		}
+	}
+	return subscriptions
+}
+
+// splitChannels parses a comma separated channel list
+func splitChannels(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// normalizeChannel makes channel names case-insensitive
+func normalizeChannel(channel string) string {
+	return strings.ToUpper(strings.TrimSpace(channel))
+}
@@ -0,0 +1,252 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xA
+)
+
+// WebSocket close codes used by the hub
+const (
+	WS_CLOSE_NORMAL         = 1000
+	WS_CLOSE_GOING_AWAY     = 1001
+	WS_CLOSE_PROTOCOL_ERROR = 1002
+	WS_CLOSE_TOO_LARGE      = 1009
+)
+
+// WS_MAX_MESSAGE_SIZE limits messages received from clients (subscription requests)
+const WS_MAX_MESSAGE_SIZE = 64 * 1024
+
+// websocketGUID is appended to the client key to compute Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// errMessageTooLarge is returned when a client message exceeds WS_MAX_MESSAGE_SIZE
+var errMessageTooLarge = errors.New("websocket message too large")
+
+// wsConn is a server side WebSocket connection
+type wsConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+}
+
+// upgrade performs the WebSocket opening handshake and takes over the connection
+func upgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hijack connection: %v", err)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write handshake: %v", err)
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write handshake: %v", err)
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for a client key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether a comma separated header contains token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage reads the next data message. Ping frames are answered and pong
+// frames are skipped; a close frame is returned as io.EOF after it is echoed.
+func (c *wsConn) readMessage() (opcode byte, payload []byte, err error) {
+	var message []byte
+	messageOpcode := byte(0)
+
+	for {
+		fin, op, data, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case WS_OP_PING:
+			if err := c.writeFrame(WS_OP_PONG, data, time.Now().Add(STREAM_WRITE_TIMEOUT)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case WS_OP_PONG:
+			continue
+		case WS_OP_CLOSE:
+			c.writeFrame(WS_OP_CLOSE, data, time.Now().Add(STREAM_WRITE_TIMEOUT))
+			return 0, nil, io.EOF
+		case WS_OP_CONTINUATION:
+			if messageOpcode == 0 {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+		case WS_OP_TEXT, WS_OP_BINARY:
+			if messageOpcode != 0 {
+				return 0, nil, errors.New("new message before previous message was finished")
+			}
+			messageOpcode = op
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode 0x%x", op)
+		}
+
+		if len(message)+len(data) > WS_MAX_MESSAGE_SIZE {
+			return 0, nil, errMessageTooLarge
+		}
+		message = append(message, data...)
+		if fin {
+			return messageOpcode, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame. Client frames must be masked.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("client frame is not masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= WS_OP_CLOSE && (length > 125 || !fin) {
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+	if length > WS_MAX_MESSAGE_SIZE {
+		return false, 0, nil, errMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a single unmasked frame with the FIN bit set
+func (c *wsConn) writeFrame(opcode byte, payload []byte, deadline time.Time) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	frame = append(frame, payload...)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(deadline)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// writeClose sends a close frame with a status code and reason
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return c.writeFrame(WS_OP_CLOSE, payload, time.Now().Add(STREAM_WRITE_TIMEOUT))
+}
+
+// close closes the underlying connection
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harusin0516/healthcare/driver/metrics"
+)
+
+var metricCertificateExpiry = metrics.Default.NewGauge("driver_certificate_expiry_timestamp_seconds",
+	"Expiry (Unix time) of the loaded TLS certificates, by certificate file", "file")
+
+// CertificateStatus describes a certificate loaded from files
+type CertificateStatus struct {
+	File     string    `json:"file"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Error    string    `json:"error,omitempty"` // Last failed reload; the previous certificate stays in use
+}
+
+// KeyPair is a certificate and private key loaded from files that can be
+// reloaded while in use. Connections established before a reload keep the
+// certificate they were opened with. It is safe for concurrent use.
+type KeyPair struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	modified    time.Time // Latest modification time of the two files at the last reload
+	status      CertificateStatus
+}
+
+// keyPairs holds every key pair loaded, so that the clients and servers
+// using the same files share one copy that ReloadCertificates updates
+var keyPairs = struct {
+	sync.Mutex
+	byFiles map[string]*KeyPair
+}{byFiles: make(map[string]*KeyPair)}
+
+// LoadKeyPair returns the key pair of the files, loading them when they are
+// used for the first time
+func LoadKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	keyPairs.Lock()
+	defer keyPairs.Unlock()
+	files := certFile + "\x00" + keyFile
+	if pair, exists := keyPairs.byFiles[files]; exists {
+		return pair, nil
+	}
+	pair := &KeyPair{certFile: certFile, keyFile: keyFile}
+	if err := pair.Reload(); err != nil {
+		return nil, err
+	}
+	keyPairs.byFiles[files] = pair
+	return pair, nil
+}
+
+// Reload reads the files again. On failure the previous certificate stays
+// in use and the error is kept in the status.
+func (k *KeyPair) Reload() error {
+	modified, _ := k.modifiedTime()
+	certificate, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err == nil {
+		certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.modified = modified
+	if err != nil {
+		err = fmt.Errorf("failed to load certificate %s: %v", k.certFile, err)
+		k.status.File = k.certFile
+		k.status.Error = err.Error()
+		return err
+	}
+	k.certificate = &certificate
+	k.status = CertificateStatus{
+		File:     k.certFile,
+		Subject:  certificate.Leaf.Subject.String(),
+		NotAfter: certificate.Leaf.NotAfter,
+		LoadedAt: time.Now(),
+	}
+	metricCertificateExpiry.Set(float64(certificate.Leaf.NotAfter.Unix()), k.certFile)
+	return nil
+}
+
+// changed reports whether a file was modified since the last reload. A
+// failed reload is not retried until a file changes again, e.g. when the
+// key of a renewed certificate is written after it.
+func (k *KeyPair) changed() bool {
+	modified, err := k.modifiedTime()
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return err == nil && !modified.Equal(k.modified)
+}
+
+// modifiedTime returns the latest modification time of the two files
+func (k *KeyPair) modifiedTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{k.certFile, k.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Certificate returns the current certificate
+func (k *KeyPair) Certificate() *tls.Certificate {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.certificate
+}
+
+// GetCertificate serves the current certificate in TLS servers
+// (tls.Config.GetCertificate)
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// GetClientCertificate sends the current certificate in TLS clients
+// (tls.Config.GetClientCertificate)
+func (k *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// Status returns the state of the certificate
+func (k *KeyPair) Status() CertificateStatus {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.status
+}
+
+// ReloadCertificates reads the files of every loaded certificate again,
+// e.g. on SIGHUP. The errors of the certificates that failed are joined.
+func ReloadCertificates() error {
+	return reloadKeyPairs(func(*KeyPair) bool { return true })
+}
+
+// ReloadChangedCertificates reloads the certificates whose files were
+// modified since their last reload. Calling it periodically picks up renewed
+// certificates without a restart.
+func ReloadChangedCertificates() error {
+	return reloadKeyPairs((*KeyPair).changed)
+}
+
+// reloadKeyPairs reloads the selected key pairs
+func reloadKeyPairs(selected func(*KeyPair) bool) error {
+	problems := make([]string, 0)
+	for _, pair := range loadedKeyPairs() {
+		if !selected(pair) {
+			continue
+		}
+		if err := pair.Reload(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Certificates returns the state of every loaded certificate, ordered by file
+func Certificates() []CertificateStatus {
+	pairs := loadedKeyPairs()
+	statuses := make([]CertificateStatus, 0, len(pairs))
+	for _, pair := range pairs {
+		statuses = append(statuses, pair.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].File < statuses[j].File })
+	return statuses
+}
+
+// loadedKeyPairs returns every loaded key pair
+func loadedKeyPairs() []*KeyPair {
+	keyPairs.Lock()
+	defer keyPairs.Unlock()
+	pairs := make([]*KeyPair, 0, len(keyPairs.byFiles))
+	for _, pair := range keyPairs.byFiles {
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// ServerConfig configures TLS on a listener
+type ServerConfig struct {
+	Enabled      bool   `json:"enabled"`
+	CertFile     string `json:"cert_file"`      // PEM server certificate, reloaded when the file changes
+	KeyFile      string `json:"key_file"`       // PEM private key of cert_file
+	ClientCAFile string `json:"client_ca_file"` // PEM CA bundle; when set, clients must present a certificate it signed
+}
+
+// Validate checks that the certificate and key are set
+func (c ServerConfig) Validate() error {
+	if c.Enabled && (c.CertFile == "" || c.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file are required when TLS is enabled")
+	}
+	return nil
+}
+
+// TLSConfig returns the TLS settings of the listener. The certificate is
+// served from a KeyPair, so that a renewed certificate is used for new
+// connections without a restart.
+func (c ServerConfig) TLSConfig() (*tls.Config, error) {
+	pair, err := LoadKeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: pair.GetCertificate, MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA file %s", c.ClientCAFile)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
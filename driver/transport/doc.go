@@ -0,0 +1,6 @@
+// Package transport configures how outbound integrations reach their
+// destination: TLS (CA bundle, server name, client certificate) and an
+// HTTP or SOCKS5 proxy. The MLLP, FHIR, Kafka, NATS and webhook clients
+// build their connections with it. Certificates are loaded once per file
+// pair and can be reloaded while in use, e.g. after renewal.
+package transport
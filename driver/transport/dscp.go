@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dscpClasses are the DSCP values by class name (RFC 2474, 2597, 3246, 5865)
+var dscpClasses = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"VA": 44, "EF": 46,
+}
+
+// ParseDSCP returns the DSCP value of a class name such as "EF", "AF41" or
+// "CS1", or of a number from 0 to 63
+func ParseDSCP(value string) (int, error) {
+	if dscp, found := dscpClasses[strings.ToUpper(value)]; found {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q: must be a class name such as EF, AF41 or CS1, or 0 to 63", value)
+	}
+	return dscp, nil
+}
+
+// dscpControl returns the net.Dialer control function that marks the
+// sockets of the destination with its DSCP, or nil if none is configured
+func (c Config) dscpControl() (func(network, address string, conn syscall.RawConn) error, error) {
+	if c.DSCP == "" {
+		return nil, nil
+	}
+	dscp, err := ParseDSCP(c.DSCP)
+	if err != nil {
+		return nil, err
+	}
+	return func(network, address string, conn syscall.RawConn) error {
+		var markErr error
+		err := conn.Control(func(fd uintptr) {
+			markErr = setDSCP(fd, network, dscp)
+		})
+		if err == nil {
+			err = markErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set DSCP %s on connection to %s: %v", c.DSCP, address, err)
+		}
+		return nil
+	}, nil
+}
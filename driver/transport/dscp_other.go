@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package transport
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// setDSCP fails: marking sockets is not supported on this platform
+func setDSCP(fd uintptr, network string, dscp int) error {
+	return fmt.Errorf("DSCP marking is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package transport
+
+import "syscall"
+
+// setDSCP sets the traffic class of an IPv6 socket or the TOS of an IPv4
+// socket; the DSCP is the upper six bits, ECN is left to the kernel
+func setDSCP(fd uintptr, network string, dscp int) error {
+	if network == "tcp6" || network == "udp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+}
@@ -0,0 +1,185 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol values (RFC 1928, RFC 1929)
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthRejected = 0xFF
+	socks5CmdConnect   = 0x01
+	socks5AddressIPv4  = 0x01
+	socks5AddressName  = 0x03
+	socks5AddressIPv6  = 0x04
+	socks5Succeeded    = 0x00
+)
+
+// socks5Replies describes the SOCKS5 reply codes
+var socks5Replies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to address
+func httpConnect(conn net.Conn, proxy *url.URL, address string) error {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %v", err)
+	}
+
+	// The tunnel starts right after the response header, so the response is
+	// read one byte at a time to leave the stream of the destination intact
+	response, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), request)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNECT response: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", address, response.Status)
+	}
+	return nil
+}
+
+// byteReader reads at most one byte per call
+type byteReader struct {
+	reader io.Reader
+}
+
+func (r byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.reader.Read(p)
+}
+
+// socks5Connect asks a SOCKS5 proxy to connect to address. Host names are
+// resolved by the proxy.
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portText)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if proxy.User != nil {
+		methods = []byte{socks5AuthPassword}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read method selection: %v", err)
+	}
+	if reply[0] != socks5Version || reply[1] == socks5AuthRejected || reply[1] != methods[0] {
+		return fmt.Errorf("no acceptable authentication method")
+	}
+	if reply[1] == socks5AuthPassword {
+		if err := socks5Authenticate(conn, proxy.User); err != nil {
+			return err
+		}
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		request = append(request, socks5AddressName, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, socks5AddressIPv4), ip4...)
+	} else {
+		request = append(append(request, socks5AddressIPv6), ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read CONNECT reply: %v", err)
+	}
+	if header[1] != socks5Succeeded {
+		if reason, known := socks5Replies[header[1]]; known {
+			return fmt.Errorf("CONNECT %s: %s", address, reason)
+		}
+		return fmt.Errorf("CONNECT %s: reply %d", address, header[1])
+	}
+	// Skip the bound address and port
+	skip := 0
+	switch header[3] {
+	case socks5AddressIPv4:
+		skip = net.IPv4len
+	case socks5AddressIPv6:
+		skip = net.IPv6len
+	case socks5AddressName:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("invalid address type %d in CONNECT reply", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("failed to read CONNECT reply: %v", err)
+	}
+	return nil
+}
+
+// socks5Authenticate sends the user and password of the proxy URL
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("user or password too long")
+	}
+	request := []byte{0x01, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read authentication reply: %v", err)
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Proxy URL schemes
+const (
+	PROXY_HTTP   = "http"   // HTTP CONNECT
+	PROXY_HTTPS  = "https"  // HTTP CONNECT over TLS to the proxy
+	PROXY_SOCKS5 = "socks5" // SOCKS5, with the user and password of the URL if set
+)
+
+// Config configures the connections to one destination. The zero value
+// connects directly with the system CA roots; HTTP clients then use the
+// proxy of the HTTPS_PROXY and HTTP_PROXY environment variables.
+type Config struct {
+	TLS        bool   `json:"tls"`         // Use TLS on MLLP connections (HTTP uses it for https URLs, NATS for tls:// URLs)
+	CAFile     string `json:"ca_file"`     // PEM CA bundle trusted instead of the system roots
+	ServerName string `json:"server_name"` // Name sent as SNI and verified in the certificate (default: host of the destination)
+	CertFile   string `json:"cert_file"`   // PEM client certificate for mutual TLS, reloaded when the file changes
+	KeyFile    string `json:"key_file"`    // PEM private key of cert_file
+	Proxy      string `json:"proxy"`       // http://, https:// or socks5:// proxy URL (empty: direct, or the environment for HTTP)
+	DSCP       string `json:"dscp"`        // DSCP class (e.g. EF, AF41, CS1) or 0-63 marked on outgoing packets (empty: unmarked)
+}
+
+// Validate checks the proxy URL, the DSCP and that the client certificate
+// and key are set together. The files are read when a client is created.
+func (c Config) Validate() error {
+	problems := make([]string, 0)
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		problems = append(problems, "cert_file and key_file must be set together")
+	}
+	if c.Proxy != "" {
+		if _, err := parseProxy(c.Proxy); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.DSCP != "" {
+		if _, err := ParseDSCP(c.DSCP); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseProxy parses a proxy URL
+func parseProxy(rawURL string) (*url.URL, error) {
+	proxy, err := url.Parse(rawURL)
+	if err != nil || proxy.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", rawURL)
+	}
+	switch proxy.Scheme {
+	case PROXY_HTTP, PROXY_HTTPS, PROXY_SOCKS5:
+		return proxy, nil
+	}
+	return nil, fmt.Errorf("proxy URL %q must be http, https or socks5", rawURL)
+}
+
+// TLSConfig returns the TLS settings of the destination. The server name
+// is left empty unless it is configured, so that the client using it sets
+// the host it connects to.
+func (c Config) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName, MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", c.CAFile)
+		}
+		config.RootCAs = roots
+	}
+	if c.CertFile != "" {
+		pair, err := LoadKeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = pair.GetClientCertificate
+	}
+	return config, nil
+}
+
+// HTTPClient returns an HTTP client for the destination with a timeout per
+// request
+func (c Config) HTTPClient(timeout time.Duration) (*http.Client, error) {
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	control, err := c.dscpControl()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if control != nil {
+		// The settings of http.DefaultTransport, with the sockets marked
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: control}
+		transport.DialContext = dialer.DialContext
+	}
+	if c.Proxy != "" {
+		proxy, err := parseProxy(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// Dialer opens TCP connections to a destination through the configured
+// proxy. It is safe for concurrent use.
+type Dialer struct {
+	timeout time.Duration
+	proxy   *url.URL
+	tls     *tls.Config                                               // nil unless Config.TLS is set
+	control func(network, address string, conn syscall.RawConn) error // Marks the sockets with the DSCP (nil: unmarked)
+}
+
+// NewDialer creates a dialer for config. timeout limits connecting,
+// including the proxy handshake and the TLS handshake.
+func (c Config) NewDialer(timeout time.Duration) (*Dialer, error) {
+	d := &Dialer{timeout: timeout}
+	if c.Proxy != "" {
+		proxy, err := parseProxy(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		d.proxy = proxy
+	}
+	control, err := c.dscpControl()
+	if err != nil {
+		return nil, err
+	}
+	d.control = control
+	if c.TLS {
+		tlsConfig, err := c.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		d.tls = tlsConfig
+	}
+	return d, nil
+}
+
+// Dial connects to address (host:port), with TLS if the configuration
+// enables it
+func (d *Dialer) Dial(address string) (net.Conn, error) {
+	ctx, cancel := d.context()
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if d.tls == nil {
+		return conn, nil
+	}
+	return handshake(ctx, conn, address, d.tls)
+}
+
+// DialContext connects to address through the proxy without TLS, e.g. for
+// protocols that start TLS after a plain text greeting. With a proxy, the
+// connection to the proxy is marked with the DSCP.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: d.timeout, Control: d.control}
+	if d.proxy == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress(d.proxy))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", d.proxy.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if d.proxy.Scheme == PROXY_HTTPS {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+	if d.proxy.Scheme == PROXY_SOCKS5 {
+		err = socks5Connect(conn, d.proxy, address)
+	} else {
+		err = httpConnect(conn, d.proxy, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", d.proxy.Host, err)
+	}
+	return conn, nil
+}
+
+// StartTLS starts TLS on a connection to address with the TLS settings of
+// the destination, whether or not the configuration enables TLS. The
+// connection is closed if the handshake fails.
+func (c Config) StartTLS(conn net.Conn, address string, timeout time.Duration) (net.Conn, error) {
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return handshake(ctx, conn, address, tlsConfig)
+}
+
+// handshake runs the TLS handshake on conn, verifying the configured server
+// name or the host of address
+func handshake(ctx context.Context, conn net.Conn, address string, config *tls.Config) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", address, err)
+	}
+	return tlsConn, nil
+}
+
+// context returns a context limited by the dial timeout (none if zero)
+func (d *Dialer) context() (context.Context, context.CancelFunc) {
+	if d.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), d.timeout)
+}
+
+// proxyAddress returns host:port of a proxy URL with the default port of its scheme
+func proxyAddress(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	port := "1080"
+	switch proxy.Scheme {
+	case PROXY_HTTP:
+		port = "80"
+	case PROXY_HTTPS:
+		port = "443"
+	}
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
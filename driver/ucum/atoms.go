@@ -0,0 +1,133 @@
+package ucum
+
+import "math"
+
+// atom is a UCUM unit atom: a magnitude in base units and the dimension
+// of the base units, or for special units (Cel, [degF]) a conversion to
+// and from the base unit
+type atom struct {
+	factor  float64
+	dim     dimension
+	metric  bool // Takes a prefix (mg, kPa)
+	special *special
+}
+
+// special converts the value of a special unit (a unit on an interval
+// scale) to its base unit and back
+type special struct {
+	toBase   func(value float64) float64
+	fromBase func(value float64) float64
+}
+
+// Base units of UCUM; arbitrary units get a dimension of their own
+const (
+	DIM_LENGTH      = "m"
+	DIM_MASS        = "g"
+	DIM_TIME        = "s"
+	DIM_ANGLE       = "rad"
+	DIM_TEMPERATURE = "K"
+	DIM_CHARGE      = "C"
+	DIM_LUMINOSITY  = "cd"
+)
+
+// AVOGADRO is the number of elementary entities in a mole, as UCUM defines it
+const AVOGADRO = 6.0221367e23
+
+// prefixes are the UCUM metric prefixes (case sensitive)
+var prefixes = map[string]float64{
+	"Y": 1e24, "Z": 1e21, "E": 1e18, "P": 1e15, "T": 1e12, "G": 1e9, "M": 1e6, "k": 1e3, "h": 1e2, "da": 1e1,
+	"d": 1e-1, "c": 1e-2, "m": 1e-3, "u": 1e-6, "n": 1e-9, "p": 1e-12, "f": 1e-15, "a": 1e-18, "z": 1e-21, "y": 1e-24,
+}
+
+// atoms are the UCUM unit atoms used in clinical observations (case
+// sensitive). Derived units are defined through the units they are
+// derived from, so their dimensions follow from the base units.
+var atoms = map[string]atom{}
+
+func init() {
+	base := func(symbol, dim string) {
+		atoms[symbol] = atom{factor: 1, dim: dimension{dim: 1}, metric: true}
+	}
+	base("m", DIM_LENGTH)
+	base("s", DIM_TIME)
+	base("g", DIM_MASS)
+	base("rad", DIM_ANGLE)
+	base("K", DIM_TEMPERATURE)
+	base("C", DIM_CHARGE)
+	base("cd", DIM_LUMINOSITY)
+
+	// define adds a unit equal to factor times the unit expression definition
+	define := func(symbol string, metric bool, factor float64, definition string) {
+		unit, err := Parse(definition)
+		if err != nil || unit.special != nil {
+			panic("ucum: invalid definition of " + symbol + ": " + definition)
+		}
+		atoms[symbol] = atom{factor: factor * unit.factor, dim: unit.dim, metric: metric}
+	}
+	// arbitrary adds a unit that is commensurable only with the units of
+	// the same kind
+	arbitrary := func(symbol, kind string, metric bool) {
+		atoms[symbol] = atom{factor: 1, dim: dimension{kind: 1}, metric: metric}
+	}
+
+	// Dimensionless
+	define("10*", false, 10, "1")
+	define("10^", false, 10, "1")
+	define("[pi]", false, math.Pi, "1")
+	define("%", false, 1e-2, "1")
+	define("[ppth]", false, 1e-3, "1")
+	define("[ppm]", false, 1e-6, "1")
+	define("mol", true, AVOGADRO, "1")
+	define("sr", true, 1, "rad2")
+	define("eq", true, 1, "mol")
+
+	// Time
+	define("min", false, 60, "s")
+	define("h", false, 60, "min")
+	define("d", false, 24, "h")
+	define("wk", false, 7, "d")
+	define("a", false, 365.25, "d")
+	define("mo", false, 1.0/12, "a")
+	define("Hz", true, 1, "s-1")
+
+	// Length, volume and mass
+	define("L", true, 1, "dm3")
+	define("l", true, 1, "dm3")
+	define("[in_i]", false, 2.54, "cm")
+	define("[ft_i]", false, 12, "[in_i]")
+	define("[lb_av]", false, 453.59237, "g")
+	define("[oz_av]", false, 1.0/16, "[lb_av]")
+	define("[drp]", false, 1.0/20, "mL")
+
+	// Mechanics and electricity
+	define("N", true, 1, "kg.m/s2")
+	define("Pa", true, 1, "N/m2")
+	define("bar", true, 1e5, "Pa")
+	define("atm", false, 101325, "Pa")
+	define("m[Hg]", true, 133.3220, "kPa")
+	define("m[H2O]", true, 9.80665, "kPa")
+	define("J", true, 1, "N.m")
+	define("W", true, 1, "J/s")
+	define("cal", true, 4.184, "J")
+	define("A", true, 1, "C/s")
+	define("V", true, 1, "J/C")
+	define("Ohm", true, 1, "V/A")
+	define("S", true, 1, "Ohm-1")
+
+	// Chemistry
+	define("kat", true, 1, "mol/s")
+	define("U", true, 1, "umol/min")
+	arbitrary("[IU]", "[IU]", true)
+	arbitrary("[iU]", "[IU]", true)
+	arbitrary("[arb'U]", "[arb'U]", false)
+
+	// Temperature
+	atoms["Cel"] = atom{factor: 1, dim: dimension{DIM_TEMPERATURE: 1}, special: &special{
+		toBase:   func(value float64) float64 { return value + 273.15 },
+		fromBase: func(value float64) float64 { return value - 273.15 },
+	}}
+	atoms["[degF]"] = atom{factor: 1, dim: dimension{DIM_TEMPERATURE: 1}, special: &special{
+		toBase:   func(value float64) float64 { return (value + 459.67) * 5 / 9 },
+		fromBase: func(value float64) float64 { return value*9/5 - 459.67 },
+	}}
+}
@@ -0,0 +1,3 @@
+// Package ucum validates UCUM unit codes and converts values between units
+// of the same dimension.
+package ucum
@@ -0,0 +1,380 @@
+package ucum
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CODING_SYSTEM is the HL7 coding system name for UCUM units (CWE component 3)
+const CODING_SYSTEM = "UCUM"
+
+// Errors returned by Parse and Convert
+var (
+	ErrInvalidUnit      = errors.New("invalid UCUM unit")
+	ErrNotCommensurable = errors.New("units are not commensurable")
+)
+
+// dimension is the exponent of each base unit (or arbitrary unit kind)
+type dimension map[string]int
+
+// Unit is a parsed UCUM unit expression (case sensitive UCUM, c/s)
+type Unit struct {
+	Code    string
+	factor  float64
+	dim     dimension
+	special *special
+}
+
+// Parse parses a UCUM unit expression such as "mm[Hg]", "mL/h",
+// "/min", "10*3/uL" or "{beats}/min". Special units on an interval scale
+// (Cel, [degF]) cannot be combined with prefixes, exponents or other units.
+func Parse(code string) (*Unit, error) {
+	if code == "" {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidUnit)
+	}
+	p := &parser{code: code}
+	unit, err := p.mainTerm()
+	if err == nil && p.pos < len(code) {
+		err = p.errorf("unexpected %q", code[p.pos])
+	}
+	if err != nil {
+		return nil, err
+	}
+	unit.Code = code
+	return unit, nil
+}
+
+// Validate returns an error wrapping ErrInvalidUnit if code is not a valid
+// UCUM unit
+func Validate(code string) error {
+	_, err := Parse(code)
+	return err
+}
+
+// Commensurable reports whether values in one unit can be converted to the
+// other (both must be valid)
+func Commensurable(from, to string) bool {
+	fromUnit, err := Parse(from)
+	if err != nil {
+		return false
+	}
+	toUnit, err := Parse(to)
+	if err != nil {
+		return false
+	}
+	return fromUnit.Commensurable(toUnit)
+}
+
+// Convert converts a value between commensurable units, e.g. 12 "kPa" to
+// "mm[Hg]" or 98.6 "[degF]" to "Cel"
+func Convert(value float64, from, to string) (float64, error) {
+	fromUnit, err := Parse(from)
+	if err != nil {
+		return 0, err
+	}
+	toUnit, err := Parse(to)
+	if err != nil {
+		return 0, err
+	}
+	return fromUnit.Convert(value, toUnit)
+}
+
+// Commensurable reports whether values in u can be converted to other
+func (u *Unit) Commensurable(other *Unit) bool {
+	return u.dim.equal(other.dim)
+}
+
+// Convert converts a value in u to other
+func (u *Unit) Convert(value float64, other *Unit) (float64, error) {
+	if !u.Commensurable(other) {
+		return 0, fmt.Errorf("%w: %s (%s) and %s (%s)", ErrNotCommensurable, u.Code, u.dim, other.Code, other.dim)
+	}
+	base := value * u.factor
+	if u.special != nil {
+		base = u.special.toBase(value)
+	}
+	if other.special != nil {
+		return other.special.fromBase(base), nil
+	}
+	return base / other.factor, nil
+}
+
+// Dimension returns the dimension of u in base units, e.g. "g.m-1.s-2"
+// for a pressure ("1" if dimensionless)
+func (u *Unit) Dimension() string {
+	return u.dim.String()
+}
+
+// parser is a recursive descent parser of the UCUM grammar
+type parser struct {
+	code string
+	pos  int
+}
+
+// mainTerm = "/" term | term
+func (p *parser) mainTerm() (*Unit, error) {
+	if p.peek() == '/' {
+		p.pos++
+		unit, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		return combine(&Unit{factor: 1, dim: dimension{}}, unit, -1, p)
+	}
+	return p.term()
+}
+
+// term = component {("." | "/") component}, evaluated left to right
+func (p *parser) term() (*Unit, error) {
+	unit, err := p.component()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator := p.peek()
+		if operator != '.' && operator != '/' {
+			return unit, nil
+		}
+		p.pos++
+		next, err := p.component()
+		if err != nil {
+			return nil, err
+		}
+		sign := 1
+		if operator == '/' {
+			sign = -1
+		}
+		if unit, err = combine(unit, next, sign, p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// component = "(" term ")" | annotation | simple unit [exponent] [annotation] | factor
+func (p *parser) component() (*Unit, error) {
+	switch p.peek() {
+	case '(':
+		p.pos++
+		unit, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return unit, nil
+	case '{':
+		if err := p.annotation(); err != nil {
+			return nil, err
+		}
+		return &Unit{factor: 1, dim: dimension{}}, nil
+	case 0:
+		return nil, p.errorf("missing unit")
+	}
+
+	start := p.pos
+	symbol, err := p.symbol()
+	if err != nil {
+		return nil, err
+	}
+	if symbol == "" {
+		return nil, p.errorf("unexpected %q", p.code[p.pos])
+	}
+	if p.peek() == '{' {
+		if err := p.annotation(); err != nil {
+			return nil, err
+		}
+	}
+
+	// A factor is a positive integer
+	if strings.Trim(symbol, "0123456789") == "" {
+		factor, err := strconv.ParseFloat(symbol, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: factor %s", ErrInvalidUnit, p.code, symbol)
+		}
+		return &Unit{factor: factor, dim: dimension{}}, nil
+	}
+
+	name, exponent := splitExponent(symbol)
+	unit, err := simpleUnit(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q at %d: %v", ErrInvalidUnit, p.code, start, err)
+	}
+	if exponent != 1 {
+		if unit.special != nil {
+			return nil, fmt.Errorf("%w: %q: %s cannot have an exponent", ErrInvalidUnit, p.code, name)
+		}
+		unit = power(unit, exponent)
+	}
+	return unit, nil
+}
+
+// symbol reads the characters of a unit symbol with its exponent; square
+// brackets are part of the symbol
+func (p *parser) symbol() (string, error) {
+	start := p.pos
+	for p.pos < len(p.code) {
+		switch c := p.code[p.pos]; {
+		case c == '[':
+			end := strings.IndexByte(p.code[p.pos:], ']')
+			if end < 0 {
+				return "", p.errorf("missing ]")
+			}
+			p.pos += end + 1
+		case c == '.' || c == '/' || c == '(' || c == ')' || c == '{' || c == '}' || c == ']':
+			return p.code[start:p.pos], nil
+		case c <= ' ' || c > '~':
+			return "", p.errorf("invalid character %q", c)
+		default:
+			p.pos++
+		}
+	}
+	return p.code[start:], nil
+}
+
+// annotation skips a "{...}" annotation, which does not change the unit
+func (p *parser) annotation() error {
+	end := strings.IndexByte(p.code[p.pos:], '}')
+	if end < 0 {
+		return p.errorf("missing }")
+	}
+	if strings.ContainsAny(p.code[p.pos+1:p.pos+end], "{") {
+		return p.errorf("nested annotation")
+	}
+	p.pos += end + 1
+	return nil
+}
+
+// peek returns the next character, 0 at the end
+func (p *parser) peek() byte {
+	if p.pos < len(p.code) {
+		return p.code[p.pos]
+	}
+	return 0
+}
+
+// errorf returns an error at the current position
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %q at %d: %s", ErrInvalidUnit, p.code, p.pos, fmt.Sprintf(format, args...))
+}
+
+// splitExponent splits a symbol into the unit and its exponent ("m2",
+// "s-1", "10*3"); digits inside square brackets are part of the unit
+func splitExponent(symbol string) (string, int) {
+	end := len(symbol)
+	for end > 0 && symbol[end-1] >= '0' && symbol[end-1] <= '9' {
+		end--
+	}
+	if end == len(symbol) || end == 0 {
+		return symbol, 1
+	}
+	if symbol[end-1] == '+' || symbol[end-1] == '-' {
+		end--
+	}
+	exponent, err := strconv.Atoi(symbol[end:])
+	if end == 0 || err != nil {
+		return symbol, 1
+	}
+	return symbol[:end], exponent
+}
+
+// simpleUnit resolves a unit atom with an optional metric prefix. An atom
+// takes precedence over a prefixed atom ("cd" is candela, "Pa" pascal).
+func simpleUnit(name string) (*Unit, error) {
+	if atom, exists := atoms[name]; exists {
+		return &Unit{factor: atom.factor, dim: atom.dim, special: atom.special}, nil
+	}
+	// "da" is the only prefix of two characters
+	for _, length := range []int{2, 1} {
+		if len(name) <= length {
+			continue
+		}
+		prefix := name[:length]
+		factor, exists := prefixes[prefix]
+		if !exists {
+			continue
+		}
+		atom, exists := atoms[name[length:]]
+		if !exists {
+			continue
+		}
+		if !atom.metric {
+			return nil, fmt.Errorf("%s does not take a prefix", name[length:])
+		}
+		return &Unit{factor: factor * atom.factor, dim: atom.dim}, nil
+	}
+	return nil, fmt.Errorf("unknown unit %s", name)
+}
+
+// combine multiplies (sign 1) or divides (sign -1) two units
+func combine(a, b *Unit, sign int, p *parser) (*Unit, error) {
+	if a.special != nil || b.special != nil {
+		return nil, fmt.Errorf("%w: %q: Cel and [degF] cannot be combined with other units", ErrInvalidUnit, p.code)
+	}
+	dim := make(dimension, len(a.dim)+len(b.dim))
+	for base, exponent := range a.dim {
+		dim[base] += exponent
+	}
+	for base, exponent := range b.dim {
+		dim[base] += sign * exponent
+	}
+	factor := a.factor * b.factor
+	if sign < 0 {
+		factor = a.factor / b.factor
+	}
+	return &Unit{factor: factor, dim: dim}, nil
+}
+
+// power raises a unit to an integer exponent
+func power(unit *Unit, exponent int) *Unit {
+	dim := make(dimension, len(unit.dim))
+	for base, e := range unit.dim {
+		dim[base] = e * exponent
+	}
+	factor := 1.0
+	for i := 0; i < exponent; i++ {
+		factor *= unit.factor
+	}
+	for i := 0; i > exponent; i-- {
+		factor /= unit.factor
+	}
+	return &Unit{factor: factor, dim: dim}
+}
+
+// equal reports whether two dimensions have the same exponents
+func (d dimension) equal(other dimension) bool {
+	for base, exponent := range d {
+		if exponent != other[base] {
+			return false
+		}
+	}
+	for base, exponent := range other {
+		if exponent != d[base] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the dimension as a UCUM term of base units
+func (d dimension) String() string {
+	var terms []string
+	for base, exponent := range d {
+		switch exponent {
+		case 0:
+		case 1:
+			terms = append(terms, base)
+		default:
+			terms = append(terms, base+strconv.Itoa(exponent))
+		}
+	}
+	if len(terms) == 0 {
+		return "1"
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ".")
+}
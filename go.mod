@@ -0,0 +1,3 @@
+module github.com/harusin0516/healthcare
+
+go 1.19
@@ -0,0 +1,635 @@
+package proto
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Files holds the versioned definitions under healthcare/<name>/<version>
+//
+//go:embed healthcare
+var Files embed.FS
+
+// Schema describes the definitions of Files, the way gRPC server reflection
+// lists services and their file descriptors
+type Schema struct {
+	Files []*File `json:"files"`
+}
+
+// File is a parsed .proto file
+type File struct {
+	Name     string     `json:"name"` // Path within Files, e.g. healthcare/hl7/v1/hl7.proto
+	Package  string     `json:"package"`
+	Imports  []string   `json:"imports,omitempty"`
+	Messages []*Message `json:"messages,omitempty"` // Nested messages are listed as Outer.Inner
+	Enums    []*Enum    `json:"enums,omitempty"`
+	Services []*Service `json:"services,omitempty"`
+}
+
+// Message is a message definition
+type Message struct {
+	Name     string   `json:"name"`
+	Fields   []*Field `json:"fields,omitempty"`
+	Reserved []int    `json:"reserved,omitempty"` // Reserved field numbers
+}
+
+// Field is a field of a message
+type Field struct {
+	Name     string `json:"name"`
+	Number   int    `json:"number"`
+	Type     string `json:"type"` // As written, e.g. string, HL7Segment, map<string,int32>
+	Repeated bool   `json:"repeated,omitempty"`
+}
+
+// Enum is an enum definition
+type Enum struct {
+	Name     string       `json:"name"`
+	Values   []*EnumValue `json:"values"`
+	Reserved []int        `json:"reserved,omitempty"`
+}
+
+// EnumValue is a value of an enum
+type EnumValue struct {
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+}
+
+// Service is a service definition
+type Service struct {
+	Name    string    `json:"name"`
+	Methods []*Method `json:"methods"`
+}
+
+// Method is an RPC of a service
+type Method struct {
+	Name            string `json:"name"`
+	Request         string `json:"request"`
+	Response        string `json:"response"`
+	ClientStreaming bool   `json:"client_streaming,omitempty"`
+	ServerStreaming bool   `json:"server_streaming,omitempty"`
+}
+
+// Load parses every .proto file of Files
+func Load() (*Schema, error) {
+	schema := &Schema{}
+	err := fs.WalkDir(Files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(name, ".proto") {
+			return err
+		}
+		source, err := Files.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		file, err := Parse(name, source)
+		if err != nil {
+			return err
+		}
+		schema.Files = append(schema.Files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// Services returns the fully qualified names of the services of the schema,
+// e.g. healthcare.hl7.v1.HL7Service
+func (s *Schema) Services() []string {
+	var names []string
+	for _, file := range s.Files {
+		for _, service := range file.Services {
+			names = append(names, file.Package+"."+service.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// File returns the file of the schema with the given name
+func (s *Schema) File(name string) (*File, bool) {
+	for _, file := range s.Files {
+		if file.Name == name {
+			return file, true
+		}
+	}
+	return nil, false
+}
+
+// Message returns the message of the file with the given name
+func (f *File) Message(name string) (*Message, bool) {
+	for _, message := range f.Messages {
+		if message.Name == name {
+			return message, true
+		}
+	}
+	return nil, false
+}
+
+// Enum returns the enum of the file with the given name
+func (f *File) Enum(name string) (*Enum, bool) {
+	for _, enum := range f.Enums {
+		if enum.Name == name {
+			return enum, true
+		}
+	}
+	return nil, false
+}
+
+// Service returns the service of the file with the given name
+func (f *File) Service(name string) (*Service, bool) {
+	for _, service := range f.Services {
+		if service.Name == name {
+			return service, true
+		}
+	}
+	return nil, false
+}
+
+// Field returns the field of the message with the given number
+func (m *Message) Field(number int) (*Field, bool) {
+	for _, field := range m.Fields {
+		if field.Number == number {
+			return field, true
+		}
+	}
+	return nil, false
+}
+
+// Breaking lists the changes from previous to current that break code
+// generated from previous, following the FILE category of buf breaking:
+// removed files, messages, enums, services and methods, a changed package,
+// field numbers removed without being reserved or reused with another name,
+// type or cardinality, removed or renumbered enum values and methods whose
+// request, response or streaming changed. Additions are not breaking.
+func Breaking(previous, current *Schema) []string {
+	var changes []string
+	report := func(format string, args ...interface{}) {
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+
+	for _, before := range previous.Files {
+		after, exists := current.File(before.Name)
+		if !exists {
+			report("%s: file removed", before.Name)
+			continue
+		}
+		if after.Package != before.Package {
+			report("%s: package changed from %s to %s", before.Name, before.Package, after.Package)
+		}
+
+		for _, message := range before.Messages {
+			now, exists := after.Message(message.Name)
+			if !exists {
+				report("%s: message %s removed", before.Name, message.Name)
+				continue
+			}
+			for _, field := range message.Fields {
+				changed, exists := now.Field(field.Number)
+				switch {
+				case !exists && !containsInt(now.Reserved, field.Number):
+					report("%s: field %s.%s (%d) removed without reserving its number", before.Name, message.Name, field.Name, field.Number)
+				case !exists:
+				case changed.Name != field.Name:
+					report("%s: field %d of %s renamed from %s to %s", before.Name, field.Number, message.Name, field.Name, changed.Name)
+				case changed.Type != field.Type || changed.Repeated != field.Repeated:
+					report("%s: field %s.%s (%d) changed from %s to %s", before.Name, message.Name, field.Name, field.Number, field.typeName(), changed.typeName())
+				}
+			}
+		}
+
+		for _, enum := range before.Enums {
+			now, exists := after.Enum(enum.Name)
+			if !exists {
+				report("%s: enum %s removed", before.Name, enum.Name)
+				continue
+			}
+			for _, value := range enum.Values {
+				if !now.hasValue(value) {
+					report("%s: enum value %s.%s (%d) removed or renumbered", before.Name, enum.Name, value.Name, value.Number)
+				}
+			}
+		}
+
+		for _, service := range before.Services {
+			now, exists := after.Service(service.Name)
+			if !exists {
+				report("%s: service %s removed", before.Name, service.Name)
+				continue
+			}
+			for _, method := range service.Methods {
+				changed, exists := now.method(method.Name)
+				if !exists {
+					report("%s: method %s.%s removed", before.Name, service.Name, method.Name)
+				} else if *changed != *method {
+					report("%s: method %s.%s changed from %s to %s", before.Name, service.Name, method.Name, method.signature(), changed.signature())
+				}
+			}
+		}
+	}
+	return changes
+}
+
+func (f *Field) typeName() string {
+	if f.Repeated {
+		return "repeated " + f.Type
+	}
+	return f.Type
+}
+
+func (e *Enum) hasValue(value *EnumValue) bool {
+	for _, now := range e.Values {
+		if *now == *value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) method(name string) (*Method, bool) {
+	for _, method := range s.Methods {
+		if method.Name == name {
+			return method, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Method) signature() string {
+	request, response := m.Request, m.Response
+	if m.ClientStreaming {
+		request = "stream " + request
+	}
+	if m.ServerStreaming {
+		response = "stream " + response
+	}
+	return fmt.Sprintf("(%s) returns (%s)", request, response)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parses the messages, enums and services of a proto3 file. Options
+// are skipped; oneof fields are listed as fields of their message.
+func Parse(name string, source []byte) (*File, error) {
+	p := &parser{tokens: tokenize(string(source))}
+	file := &File{Name: name}
+	if err := p.parseFile(file); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return file, nil
+}
+
+// parser reads the statements of a .proto file from its tokens
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) parseFile(file *File) error {
+	for !p.done() {
+		switch keyword := p.next(); keyword {
+		case ";":
+		case "syntax", "option":
+			p.skipStatement()
+		case "package":
+			file.Package = p.next()
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "import":
+			if p.peek() == "public" || p.peek() == "weak" {
+				p.next()
+			}
+			file.Imports = append(file.Imports, unquote(p.next()))
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "message":
+			if err := p.parseMessage(file, ""); err != nil {
+				return err
+			}
+		case "enum":
+			if err := p.parseEnum(file, ""); err != nil {
+				return err
+			}
+		case "service":
+			if err := p.parseService(file); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected %q", keyword)
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseMessage(file *File, scope string) error {
+	message := &Message{Name: scope + p.next()}
+	file.Messages = append(file.Messages, message)
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		switch token := p.next(); token {
+		case "":
+			return fmt.Errorf("message %s not closed", message.Name)
+		case "}":
+			return nil
+		case ";":
+		case "option", "extensions":
+			p.skipStatement()
+		case "reserved":
+			message.Reserved = append(message.Reserved, p.parseReserved()...)
+		case "message":
+			if err := p.parseMessage(file, message.Name+"."); err != nil {
+				return err
+			}
+		case "enum":
+			if err := p.parseEnum(file, message.Name+"."); err != nil {
+				return err
+			}
+		case "oneof":
+			p.next()
+			if err := p.expect("{"); err != nil {
+				return err
+			}
+			for p.peek() != "}" && !p.done() {
+				if p.peek() == "option" {
+					p.skipStatement()
+					continue
+				}
+				field, err := p.parseField(p.next())
+				if err != nil {
+					return err
+				}
+				message.Fields = append(message.Fields, field)
+			}
+			p.next()
+		default:
+			field, err := p.parseField(token)
+			if err != nil {
+				return fmt.Errorf("message %s: %v", message.Name, err)
+			}
+			message.Fields = append(message.Fields, field)
+		}
+	}
+}
+
+// parseField parses a field declaration starting with token
+func (p *parser) parseField(token string) (*Field, error) {
+	field := &Field{}
+	switch token {
+	case "repeated":
+		field.Repeated = true
+		token = p.next()
+	case "optional", "required":
+		token = p.next()
+	}
+	if token == "map" {
+		// map < key , value >
+		parts := []string{p.next(), p.next(), p.next(), p.next(), p.next()}
+		token = "map" + strings.Join(parts, "")
+	}
+	field.Type = token
+	field.Name = p.next()
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	number, err := strconv.Atoi(p.next())
+	if err != nil {
+		return nil, fmt.Errorf("field %s: invalid number: %v", field.Name, err)
+	}
+	field.Number = number
+	p.skipStatement()
+	return field, nil
+}
+
+func (p *parser) parseEnum(file *File, scope string) error {
+	enum := &Enum{Name: scope + p.next()}
+	file.Enums = append(file.Enums, enum)
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		switch token := p.next(); token {
+		case "":
+			return fmt.Errorf("enum %s not closed", enum.Name)
+		case "}":
+			return nil
+		case ";":
+		case "option":
+			p.skipStatement()
+		case "reserved":
+			enum.Reserved = append(enum.Reserved, p.parseReserved()...)
+		default:
+			if err := p.expect("="); err != nil {
+				return err
+			}
+			number, err := strconv.Atoi(p.next())
+			if err != nil {
+				return fmt.Errorf("enum value %s: invalid number: %v", token, err)
+			}
+			enum.Values = append(enum.Values, &EnumValue{Name: token, Number: number})
+			p.skipStatement()
+		}
+	}
+}
+
+func (p *parser) parseService(file *File) error {
+	service := &Service{Name: p.next()}
+	file.Services = append(file.Services, service)
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	for {
+		switch token := p.next(); token {
+		case "":
+			return fmt.Errorf("service %s not closed", service.Name)
+		case "}":
+			return nil
+		case ";":
+		case "option":
+			p.skipStatement()
+		case "rpc":
+			method := &Method{Name: p.next()}
+			var err error
+			if method.Request, method.ClientStreaming, err = p.parseRPCType(); err != nil {
+				return err
+			}
+			if err := p.expect("returns"); err != nil {
+				return err
+			}
+			if method.Response, method.ServerStreaming, err = p.parseRPCType(); err != nil {
+				return err
+			}
+			service.Methods = append(service.Methods, method)
+			p.skipStatement()
+		default:
+			return fmt.Errorf("service %s: unexpected %q", service.Name, token)
+		}
+	}
+}
+
+// parseRPCType parses ( [stream] Type )
+func (p *parser) parseRPCType() (string, bool, error) {
+	if err := p.expect("("); err != nil {
+		return "", false, err
+	}
+	streaming := false
+	if p.peek() == "stream" {
+		p.next()
+		streaming = true
+	}
+	name := p.next()
+	return name, streaming, p.expect(")")
+}
+
+// parseReserved parses the numbers and ranges of a reserved statement;
+// reserved names are skipped
+func (p *parser) parseReserved() []int {
+	var numbers []int
+	for {
+		token := p.next()
+		if token == ";" || token == "" {
+			return numbers
+		}
+		first, err := strconv.Atoi(token)
+		if err != nil {
+			continue
+		}
+		last := first
+		if p.peek() == "to" {
+			p.next()
+			if p.peek() == "max" {
+				p.next()
+				last = first
+			} else if n, err := strconv.Atoi(p.next()); err == nil {
+				last = n
+			}
+		}
+		for n := first; n <= last; n++ {
+			numbers = append(numbers, n)
+		}
+	}
+}
+
+// skipStatement skips to the end of the current statement: the next ; at
+// this level or a block in braces
+func (p *parser) skipStatement() {
+	depth := 0
+	for !p.done() {
+		switch p.next() {
+		case ";":
+			if depth == 0 {
+				return
+			}
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth <= 0 {
+				return
+			}
+		}
+	}
+}
+
+func (p *parser) expect(token string) error {
+	if got := p.next(); got != token {
+		return fmt.Errorf("expected %q, got %q", token, got)
+	}
+	return nil
+}
+
+func (p *parser) next() string {
+	if p.done() {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *parser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+// tokenize splits a .proto source into identifiers, numbers, strings and
+// symbols, dropping comments
+func tokenize(source string) []string {
+	var tokens []string
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(source[i:], "/*"):
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(source) && source[j] != c {
+				if source[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, source[i:min(j+1, len(source))])
+			i = j + 1
+		case unicode.IsSpace(rune(c)):
+			i++
+		case isWordByte(c):
+			j := i
+			for j < len(source) && isWordByte(source[j]) {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c == '+' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func unquote(token string) string {
+	if value, err := strconv.Unquote(token); err == nil {
+		return value
+	}
+	return strings.Trim(token, `"'`)
+}
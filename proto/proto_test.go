@@ -0,0 +1,131 @@
+package proto
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// RELEASED_SCHEMA is the schema of the released packages. Code generated
+// from it must keep working with the current definitions.
+const RELEASED_SCHEMA = "testdata/released.json"
+
+var update = flag.Bool("update", false, "record the current schema as released (after a release or a v2 package)")
+
+func TestLoad(t *testing.T) {
+	schema, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schema.Files) == 0 {
+		t.Fatal("no .proto files embedded")
+	}
+	for _, file := range schema.Files {
+		// healthcare/hl7/v1/hl7.proto declares healthcare.hl7.v1
+		want := strings.ReplaceAll(path.Dir(file.Name), "/", ".")
+		if file.Package != want {
+			t.Errorf("%s: package %s, want %s", file.Name, file.Package, want)
+		}
+	}
+	services := schema.Services()
+	for _, want := range []string{"healthcare.dri.v1.DRIService", "healthcare.hl7.v1.HL7Service"} {
+		if !containsString(services, want) {
+			t.Errorf("service %s not found in %v", want, services)
+		}
+	}
+}
+
+func TestCompatibility(t *testing.T) {
+	current, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		data, err := json.MarshalIndent(current, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(RELEASED_SCHEMA, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(RELEASED_SCHEMA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := &Schema{}
+	if err := json.Unmarshal(data, released); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range Breaking(released, current) {
+		t.Errorf("breaking change: %s", change)
+	}
+}
+
+func TestBreaking(t *testing.T) {
+	const before = `syntax = "proto3";
+package test.v1;
+message A {
+  string name = 1;
+  repeated int32 values = 2;
+  int64 old = 3;
+}
+enum Color {
+  COLOR_UNSPECIFIED = 0;
+  COLOR_RED = 1;
+}
+service S {
+  rpc Get(A) returns (stream A);
+}`
+	tests := []struct {
+		name  string
+		after string
+		want  string // Substring of the only change, empty if compatible
+	}{
+		{"unchanged", before, ""},
+		{"field added", strings.Replace(before, "int64 old = 3;", "int64 old = 3;\n  bool added = 4;", 1), ""},
+		{"field reserved", strings.Replace(before, "int64 old = 3;", "reserved 3;", 1), ""},
+		{"field removed", strings.Replace(before, "int64 old = 3;", "", 1), "removed without reserving"},
+		{"field renumbered", strings.Replace(before, "string name = 1;", "string name = 5;", 1), "A.name (1) removed"},
+		{"field renamed", strings.Replace(before, "string name = 1;", "string title = 1;", 1), "renamed from name to title"},
+		{"cardinality changed", strings.Replace(before, "repeated int32 values", "int32 values", 1), "changed from repeated int32 to int32"},
+		{"enum value removed", strings.Replace(before, "COLOR_RED = 1;", "", 1), "COLOR_RED"},
+		{"streaming changed", strings.Replace(before, "returns (stream A)", "returns (A)", 1), "method S.Get changed"},
+		{"service removed", strings.Replace(before, "rpc Get(A) returns (stream A);", "", 1), "method S.Get removed"},
+		{"package changed", strings.Replace(before, "test.v1", "test.v2", 1), "package changed"},
+	}
+	previous := parseSchema(t, before)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes := Breaking(previous, parseSchema(t, test.after))
+			switch {
+			case test.want == "" && len(changes) > 0:
+				t.Errorf("unexpected changes %q", changes)
+			case test.want != "" && (len(changes) != 1 || !strings.Contains(changes[0], test.want)):
+				t.Errorf("changes %q, want one containing %q", changes, test.want)
+			}
+		})
+	}
+}
+
+func parseSchema(t *testing.T, source string) *Schema {
+	t.Helper()
+	file, err := Parse("test.proto", []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Schema{Files: []*File{file}}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}